@@ -0,0 +1,413 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/contentsquare/chproxy/config"
+	"github.com/contentsquare/chproxy/internal/topology"
+	"github.com/contentsquare/chproxy/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	adminReloadEndpoint = "/admin/reload"
+
+	// adminErrorCodesEndpoint lists the most frequent codes
+	// of ClickHouse exceptions in proxied responses.
+	adminErrorCodesEndpoint = "/admin/error_codes"
+
+	// adminClustersPrefix is the prefix of endpoints managing cluster nodes:
+	//   POST /admin/clusters/{cluster}/nodes
+	//   DELETE /admin/clusters/{cluster}/nodes/{host:port}
+	//   GET|POST /admin/clusters/{cluster}/scheme
+	adminClustersPrefix = "/admin/clusters/"
+)
+
+const (
+	// defaultErrorCodesLimit is the number of error codes returned
+	// by adminErrorCodesEndpoint if `limit` isn't set.
+	defaultErrorCodesLimit = 10
+
+	// nodeDrainTimeout is the maximum duration to wait for running queries
+	// of the node removed via the admin API.
+	nodeDrainTimeout = time.Minute
+
+	nodeDrainCheckInterval = 100 * time.Millisecond
+)
+
+// serveAdmin serves /admin/* endpoints.
+func serveAdmin(rw http.ResponseWriter, r *http.Request) {
+	if !enableAdmin.Load() {
+		badRequest.Inc()
+		err := fmt.Errorf("%q: unsupported path: %q", r.RemoteAddr, r.URL.Path)
+		rw.Header().Set("Connection", "close")
+		respondWith(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	// nolint:forcetypeassert // We will cover this by tests as we control what is stored.
+	an := allowedNetworksAdmin.Load().(*config.Networks)
+	if !an.Contains(r.RemoteAddr) {
+		err := fmt.Errorf("connections to %s are not allowed from %s", r.URL.Path, r.RemoteAddr)
+		rw.Header().Set("Connection", "close")
+		respondWith(rw, err, http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case r.URL.Path == adminReloadEndpoint:
+		serveReload(rw, r)
+	case r.URL.Path == adminErrorCodesEndpoint:
+		serveErrorCodes(rw, r)
+	case strings.HasPrefix(r.URL.Path, adminClustersPrefix) && strings.HasSuffix(r.URL.Path, "/scheme"):
+		serveClusterScheme(rw, r)
+	case strings.HasPrefix(r.URL.Path, adminClustersPrefix):
+		serveClusterNodes(rw, r)
+	default:
+		badRequest.Inc()
+		err := fmt.Errorf("%q: unsupported path: %q", r.RemoteAddr, r.URL.Path)
+		rw.Header().Set("Connection", "close")
+		respondWith(rw, err, http.StatusBadRequest)
+	}
+}
+
+// adminNode describes the node added or removed via the admin API.
+type adminNode struct {
+	Cluster string `json:"cluster"`
+	Replica string `json:"replica,omitempty"`
+	Node    string `json:"node"`
+}
+
+func serveClusterNodes(rw http.ResponseWriter, r *http.Request) {
+	// The path is {cluster}/nodes or {cluster}/nodes/{host:port}.
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, adminClustersPrefix), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] != "nodes" {
+		badRequest.Inc()
+		err := fmt.Errorf("%q: unsupported path: %q", r.RemoteAddr, r.URL.Path)
+		respondWith(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	var (
+		node   adminNode
+		status int
+		err    error
+	)
+	switch {
+	case r.Method == http.MethodPost && len(parts) == 2:
+		if err := json.NewDecoder(r.Body).Decode(&node); err != nil {
+			err = fmt.Errorf("%q: cannot parse request body: %w", r.RemoteAddr, err)
+			respondWith(rw, err, http.StatusBadRequest)
+			return
+		}
+		node.Cluster = parts[0]
+		node.Replica, status, err = proxy.addNode(node.Cluster, node.Replica, node.Node)
+	case r.Method == http.MethodDelete && len(parts) == 3:
+		node = adminNode{
+			Cluster: parts[0],
+			Node:    parts[2],
+		}
+		node.Replica, status, err = proxy.removeNode(node.Cluster, node.Node)
+	default:
+		err = fmt.Errorf("%q: unsupported method %q for %q", r.RemoteAddr, r.Method, r.URL.Path)
+		status = http.StatusMethodNotAllowed
+	}
+	if err != nil {
+		respondWith(rw, err, status)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(node); err != nil {
+		log.Errorf("cannot send node info to %s: %s", r.RemoteAddr, err)
+	}
+}
+
+// addNode adds the node to the replica of the cluster until the next config reload.
+// The replica may be omitted for clusters with a single replica.
+//
+// Returns the name of the replica the node is added to.
+func (rp *reverseProxy) addNode(clusterName, replicaName, node string) (string, int, error) {
+	if node == "" {
+		return "", http.StatusBadRequest, fmt.Errorf("`node` must be set")
+	}
+
+	// configLock prevents starting the heartbeat while the config is reloaded.
+	rp.configLock.Lock()
+	defer rp.configLock.Unlock()
+
+	r, status, err := rp.findReplica(clusterName, replicaName)
+	if err != nil {
+		return "", status, err
+	}
+	hosts, err := newNodes([]string{node}, nil, r.cluster.scheme, r)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	h := hosts[0]
+	if err := r.addHost(h); err != nil {
+		return "", http.StatusConflict, err
+	}
+
+	r.updateHostWeightMetric(h)
+	rp.reloadWG.Add(1)
+	go func() {
+		h.StartHeartbeat(rp.reloadSignal)
+		rp.reloadWG.Done()
+	}()
+
+	log.Infof("Node %q added to replica %q of cluster %q via the admin API. "+
+		"The cluster topology diverges from config %s until the next reload", h.Host(), r.name, clusterName, *configFile)
+	return r.name, http.StatusOK, nil
+}
+
+// removeNode removes the node from the cluster until the next config reload.
+// The node stops receiving new queries at once, while its running queries
+// are waited for up to nodeDrainTimeout.
+//
+// Returns the name of the replica the node is removed from.
+func (rp *reverseProxy) removeNode(clusterName, node string) (string, int, error) {
+	r, h, status, err := rp.retireNode(clusterName, node)
+	if err != nil {
+		return "", status, err
+	}
+
+	// configLock isn't held while running queries are waited for,
+	// so config reloads aren't blocked.
+	deadline := time.Now().Add(nodeDrainTimeout)
+	for h.CurrentLoad() > 0 && time.Now().Before(deadline) {
+		time.Sleep(nodeDrainCheckInterval)
+	}
+	if load := h.CurrentLoad(); load > 0 {
+		log.Errorf("Node %q still has load %d after waiting %s for running queries; removing it anyway", node, load, nodeDrainTimeout)
+	}
+	rp.configLock.Lock()
+	err = r.removeHost(node)
+	rp.configLock.Unlock()
+	if err != nil {
+		return "", http.StatusConflict, err
+	}
+	hostWeight.Delete(prometheus.Labels{"cluster": clusterName, "replica": r.name, "cluster_node": node})
+
+	log.Infof("Node %q removed from replica %q of cluster %q via the admin API. "+
+		"The cluster topology diverges from config %s until the next reload", node, r.name, clusterName, *configFile)
+	return r.name, http.StatusOK, nil
+}
+
+// retireNode stops sending new queries to the node of the cluster
+// and returns the node along with its replica.
+func (rp *reverseProxy) retireNode(clusterName, node string) (*replica, *topology.Node, int, error) {
+	// configLock prevents retiring the node of the config being replaced.
+	rp.configLock.Lock()
+	defer rp.configLock.Unlock()
+
+	c := rp.snapshot.Load().clusters[clusterName]
+	if c == nil {
+		return nil, nil, http.StatusNotFound, fmt.Errorf("unknown cluster %q", clusterName)
+	}
+	for _, r := range c.replicas {
+		h, err := r.retireHost(node)
+		if err != nil {
+			return nil, nil, http.StatusConflict, err
+		}
+		if h != nil {
+			return r, h, http.StatusOK, nil
+		}
+	}
+	return nil, nil, http.StatusNotFound, fmt.Errorf("unknown node %q in cluster %q", node, clusterName)
+}
+
+// adminScheme describes the scheme of the cluster nodes
+// returned or changed via the admin API.
+type adminScheme struct {
+	Cluster string `json:"cluster"`
+	Scheme  string `json:"scheme"`
+}
+
+func serveClusterScheme(rw http.ResponseWriter, r *http.Request) {
+	// The path is {cluster}/scheme.
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, adminClustersPrefix), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		badRequest.Inc()
+		err := fmt.Errorf("%q: unsupported path: %q", r.RemoteAddr, r.URL.Path)
+		respondWith(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	var (
+		scheme adminScheme
+		status int
+		err    error
+	)
+	switch r.Method {
+	case http.MethodGet:
+		scheme.Cluster = parts[0]
+		scheme.Scheme, status, err = proxy.clusterScheme(scheme.Cluster)
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&scheme); err != nil {
+			err = fmt.Errorf("%q: cannot parse request body: %w", r.RemoteAddr, err)
+			respondWith(rw, err, http.StatusBadRequest)
+			return
+		}
+		scheme.Cluster = parts[0]
+		status, err = proxy.setClusterScheme(scheme.Cluster, scheme.Scheme)
+	default:
+		err = fmt.Errorf("%q: unsupported method %q for %q", r.RemoteAddr, r.Method, r.URL.Path)
+		status = http.StatusMethodNotAllowed
+	}
+	if err != nil {
+		respondWith(rw, err, status)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(scheme); err != nil {
+		log.Errorf("cannot send cluster scheme to %s: %s", r.RemoteAddr, err)
+	}
+}
+
+// clusterScheme returns the scheme of the cluster nodes.
+func (rp *reverseProxy) clusterScheme(clusterName string) (string, int, error) {
+	// configLock protects the scheme from concurrent changes.
+	rp.configLock.Lock()
+	defer rp.configLock.Unlock()
+
+	c := rp.snapshot.Load().clusters[clusterName]
+	if c == nil {
+		return "", http.StatusNotFound, fmt.Errorf("unknown cluster %q", clusterName)
+	}
+	return c.scheme, http.StatusOK, nil
+}
+
+// setClusterScheme changes the scheme of all the cluster nodes
+// until the next config reload.
+func (rp *reverseProxy) setClusterScheme(clusterName, scheme string) (int, error) {
+	if scheme != "http" && scheme != "https" {
+		return http.StatusBadRequest, fmt.Errorf("`scheme` must be `http` or `https`, got %q", scheme)
+	}
+
+	// configLock prevents replacing the cluster while its scheme is changed.
+	rp.configLock.Lock()
+	defer rp.configLock.Unlock()
+
+	c := rp.snapshot.Load().clusters[clusterName]
+	if c == nil {
+		return http.StatusNotFound, fmt.Errorf("unknown cluster %q", clusterName)
+	}
+	oldScheme := c.scheme
+	if scheme == oldScheme {
+		return http.StatusOK, nil
+	}
+	if c.fixedScheme {
+		return http.StatusConflict, fmt.Errorf("scheme of cluster %q with `http2` or `h2c` cannot be changed", clusterName)
+	}
+	for _, r := range c.replicas {
+		for _, h := range r.getHosts() {
+			h.SetScheme(scheme)
+		}
+	}
+	c.scheme = scheme
+
+	log.Infof("Scheme of cluster %q changed from %q to %q via the admin API. "+
+		"The cluster diverges from config %s until the next reload", clusterName, oldScheme, scheme, *configFile)
+	return http.StatusOK, nil
+}
+
+// findReplica returns the replica of the cluster with the given name.
+// The name may be empty for clusters with a single replica.
+func (rp *reverseProxy) findReplica(clusterName, replicaName string) (*replica, int, error) {
+	c := rp.snapshot.Load().clusters[clusterName]
+	if c == nil {
+		return nil, http.StatusNotFound, fmt.Errorf("unknown cluster %q", clusterName)
+	}
+
+	if replicaName == "" {
+		if len(c.replicas) > 1 {
+			return nil, http.StatusBadRequest, fmt.Errorf("`replica` must be set for cluster %q with multiple replicas", clusterName)
+		}
+		return c.replicas[0], http.StatusOK, nil
+	}
+	for _, r := range c.replicas {
+		if r.name == replicaName {
+			return r, http.StatusOK, nil
+		}
+	}
+	return nil, http.StatusNotFound, fmt.Errorf("unknown replica %q in cluster %q", replicaName, clusterName)
+}
+
+// adminErrorCode is the number of ClickHouse exceptions with the code
+// since chproxy start.
+type adminErrorCode struct {
+	ErrorCode string  `json:"error_code"`
+	Count     float64 `json:"count"`
+}
+
+func serveErrorCodes(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		err := fmt.Errorf("%q: unsupported method %q", r.RemoteAddr, r.Method)
+		respondWith(rw, err, http.StatusMethodNotAllowed)
+		return
+	}
+	limit := defaultErrorCodesLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			err := fmt.Errorf("%q: `limit` must be a positive integer; got %q", r.RemoteAddr, v)
+			respondWith(rw, err, http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(topErrorCodes(limit)); err != nil {
+		log.Errorf("cannot send error codes to %s: %s", r.RemoteAddr, err)
+	}
+}
+
+// topErrorCodes returns up to limit most frequent codes of ClickHouse exceptions
+// across all the clusters.
+func topErrorCodes(limit int) []adminErrorCode {
+	codes := make([]adminErrorCode, 0)
+	for code, n := range sumByLabel(clickhouseErrorCodes, "error_code") {
+		codes = append(codes, adminErrorCode{ErrorCode: code, Count: n})
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		if codes[i].Count != codes[j].Count {
+			return codes[i].Count > codes[j].Count
+		}
+		return codes[i].ErrorCode < codes[j].ErrorCode
+	})
+	if len(codes) > limit {
+		codes = codes[:limit]
+	}
+	return codes
+}
+
+func serveReload(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		err := fmt.Errorf("%q: unsupported method %q", r.RemoteAddr, r.Method)
+		respondWith(rw, err, http.StatusMethodNotAllowed)
+		return
+	}
+
+	log.Infof("%s: reload requested. Going to reload config %s ...", r.RemoteAddr, *configFile)
+	diff, status, err := reloadConfigWithDiff()
+	if err != nil {
+		err = fmt.Errorf("error while reloading config: %w", err)
+		respondWith(rw, err, status)
+		return
+	}
+	log.Infof("Reloading config %s: successful", *configFile)
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(diff); err != nil {
+		log.Errorf("cannot send config diff to %s: %s", r.RemoteAddr, err)
+	}
+}
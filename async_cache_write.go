@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/contentsquare/chproxy/cache"
+	"github.com/contentsquare/chproxy/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var _ sizeLimiter = &teeResponseWriter{}
+
+// teeResponseWriter streams the response to the client and writes it
+// into the temporary file at the same time, so the response may be put
+// into the cache once it is complete.
+//
+// The response isn't written into the file after it exceeds maxPayloadSize,
+// since it isn't cached anyway.
+type teeResponseWriter struct {
+	srw *statResponseWriter
+	tmp *cache.TmpFileResponseWriter
+
+	maxPayloadSize  int64
+	maxResponseSize int64
+
+	// finishOnDisconnect tells whether the response is still written
+	// into the file after the client disconnects.
+	finishOnDisconnect bool
+
+	written         int64
+	sizeExceeded    bool
+	payloadExceeded bool
+
+	// clientErr is the error of writing the response to the client.
+	clientErr error
+	// tmpErr is the error of writing the response into the file.
+	tmpErr error
+}
+
+func (rw *teeResponseWriter) Header() http.Header {
+	return rw.srw.Header()
+}
+
+// WriteHeader captures the status code. It is sent to the client
+// along with the first written bytes, so the request may be retried
+// until then.
+func (rw *teeResponseWriter) WriteHeader(statusCode int) {
+	rw.tmp.WriteHeader(statusCode)
+	rw.srw.WriteHeader(statusCode)
+}
+
+// StatusCode returns the status code of the proxied response.
+func (rw *teeResponseWriter) StatusCode() int {
+	return rw.tmp.StatusCode()
+}
+
+func (rw *teeResponseWriter) Write(b []byte) (int, error) {
+	if rw.maxResponseSize > 0 && rw.written+int64(len(b)) > rw.maxResponseSize {
+		rw.sizeExceeded = true
+		return 0, errResponseTooLarge
+	}
+	rw.written += int64(len(b))
+
+	if !rw.payloadExceeded && rw.tmpErr == nil {
+		if rw.written > rw.maxPayloadSize {
+			rw.payloadExceeded = true
+		} else if _, err := rw.tmp.Write(b); err != nil {
+			rw.tmpErr = err
+		}
+	}
+
+	if rw.clientErr == nil {
+		if _, err := rw.srw.Write(b); err != nil {
+			rw.clientErr = err
+		}
+	}
+	if rw.clientErr != nil && !rw.finishOnDisconnect {
+		return 0, rw.clientErr
+	}
+	return len(b), nil
+}
+
+// Flush sends the buffered response to the client,
+// so it receives the first bytes as soon as possible.
+func (rw *teeResponseWriter) Flush() {
+	if !rw.srw.wroteHeader || rw.clientErr != nil {
+		return
+	}
+	_ = http.NewResponseController(rw.srw.ResponseWriter).Flush()
+}
+
+// CloseNotify implements http.CloseNotifier.
+//
+// The returned channel is never closed if the response must be written
+// into the file after the client disconnects, so the query isn't canceled.
+func (rw *teeResponseWriter) CloseNotify() <-chan bool {
+	if rw.finishOnDisconnect {
+		return nil
+	}
+	return rw.srw.CloseNotify()
+}
+
+// SizeExceeded returns true if the response exceeded maxResponseSize.
+func (rw *teeResponseWriter) SizeExceeded() bool {
+	return rw.sizeExceeded
+}
+
+// serveCacheMissAsync proxies the request missing in the cache and streams
+// the response to the client while writing it into the temporary file.
+// The response is put into the cache in background once it is complete,
+// and the transaction is completed afterwards.
+func (rp *reverseProxy) serveCacheMissAsync(s *scope, srw *statResponseWriter, req *http.Request, key *cache.Key, q []byte, labels prometheus.Labels) {
+	rp.asyncCacheWrites.Add(1)
+	putInBackground := false
+	defer func() {
+		if !putInBackground {
+			rp.asyncCacheWrites.Done()
+		}
+	}()
+
+	userCache := s.user.cache
+	tmpFileRespWriter, err := cache.NewTmpFileResponseWriter(srw, os.TempDir())
+	if err != nil {
+		err = fmt.Errorf("%s: %w; query: %q", s, err, q)
+		respondWith(srw, err, http.StatusInternalServerError)
+		return
+	}
+	tmpFileRespWriter.SetCachedHeaders(userCache.CachedHeaders)
+
+	if err := userCache.Create(key, s.user.name); err != nil {
+		log.Errorf("%s: %s; query: %q - failed to register transaction", s, err, q)
+	}
+
+	rw := &teeResponseWriter{
+		srw:                srw,
+		tmp:                tmpFileRespWriter,
+		maxPayloadSize:     int64(userCache.MaxPayloadSize),
+		maxResponseSize:    s.user.maxResponseSize,
+		finishOnDisconnect: userCache.FinishWritesOnDisconnect,
+	}
+	srw.Header().Set("X-Cache", XCacheMiss)
+	rp.proxyRequest(s, rw, srw, req)
+
+	statusCode := rw.StatusCode()
+	switch {
+	case rw.SizeExceeded():
+		tmpFileRespWriter.Close()
+		rp.completeTransaction(s, http.StatusRequestEntityTooLarge, userCache, key, q,
+			fmt.Sprintf("%s response exceeds max_response_size limit: %d", failedTransactionPrefix, s.user.maxResponseSize))
+		return
+	case statusCode != http.StatusOK || s.canceled:
+		// Do not cache non-200 or cancelled responses.
+		rp.completeTransaction(s, statusCode, userCache, key, q, rp.errorReason(s, tmpFileRespWriter))
+		tmpFileRespWriter.Close()
+		return
+	case rw.payloadExceeded:
+		tmpFileRespWriter.Close()
+		cacheSkipped.With(labels).Inc()
+		log.Infof("%s: Request will not be cached. Content length (%d) is greater than max payload size (%d)", s, rw.written, userCache.MaxPayloadSize)
+		rp.completeTransaction(s, statusCode, userCache, key, q, "")
+		return
+	case rw.tmpErr != nil:
+		tmpFileRespWriter.Close()
+		cacheFailedInsert.With(labels).Inc()
+		log.Errorf("%s: %s; query: %q - failed to write response into temporary file", s, rw.tmpErr, q)
+		rp.completeTransaction(s, statusCode, userCache, key, q, "")
+		return
+	}
+
+	cacheMiss.With(labels).Inc()
+	log.Debugf("%s: cache miss", s)
+	putInBackground = true
+	go func() {
+		defer rp.asyncCacheWrites.Done()
+		defer tmpFileRespWriter.Close()
+		if err := putTmpFile(userCache, tmpFileRespWriter, key); err != nil {
+			cacheFailedInsert.With(labels).Inc()
+			log.Errorf("%s: %s; query: %q - failed to put response in the cache", s, err, q)
+		}
+		rp.completeTransaction(s, statusCode, userCache, key, q, "")
+	}()
+}
+
+// errorReason returns the reason of the failed transaction
+// from the response captured by tmpFileRespWriter.
+func (rp *reverseProxy) errorReason(s *scope, tmpFileRespWriter *cache.TmpFileResponseWriter) string {
+	contentLength, err := tmpFileRespWriter.GetCapturedContentLength()
+	if err != nil {
+		log.Errorf("%s failed to get error reason: %s", s, err)
+		return "unknown error reason"
+	}
+	if contentLength > rp.maxErrorReasonSize {
+		log.Infof("%s: Error reason length (%d) is greater than max error reason size (%d)", s, contentLength, rp.maxErrorReasonSize)
+		return "unknown error reason"
+	}
+	reader, err := tmpFileRespWriter.Reader()
+	if err != nil {
+		log.Errorf("%s failed to get error reason: %s", s, err)
+		return "unknown error reason"
+	}
+	errString, err := toString(reader)
+	if err != nil {
+		log.Errorf("%s failed to get error reason: %s", s, err)
+	}
+	return fmt.Sprintf("%s %s", failedTransactionPrefix, errString)
+}
+
+// putTmpFile puts the response captured by tmpFileRespWriter into userCache.
+func putTmpFile(userCache *cache.AsyncCache, tmpFileRespWriter *cache.TmpFileResponseWriter, key *cache.Key) error {
+	contentLength, err := tmpFileRespWriter.GetCapturedContentLength()
+	if err != nil {
+		return err
+	}
+	reader, err := tmpFileRespWriter.Reader()
+	if err != nil {
+		return err
+	}
+	contentMetadata := cache.ContentMetadata{
+		Length:   contentLength,
+		Encoding: tmpFileRespWriter.GetCapturedContentEncoding(),
+		Type:     tmpFileRespWriter.GetCapturedContentType(),
+		Headers:  tmpFileRespWriter.GetCapturedHeaders(),
+	}
+	_, err = userCache.Put(reader, contentMetadata, key)
+	return err
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/contentsquare/chproxy/config"
+	"github.com/contentsquare/chproxy/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultAuditLogQueueSize is used if `audit_log.queue_size` isn't set.
+const defaultAuditLogQueueSize = 1024
+
+// auditLogQueryField is the field of records with the query text.
+// It is logged if `audit_log.log_full_query` is set.
+const auditLogQueryField = "query"
+
+// auditLogger appends records of requests of authenticated users
+// to `audit_log.path`.
+//
+// Records are written by a separate goroutine, so the audit log
+// never blocks requests. Records are dropped according
+// to `audit_log.drop_policy` once the queue is full.
+type auditLogger struct {
+	cfg config.AuditLog
+
+	fields     []string
+	tsv        bool
+	dropOldest bool
+
+	records chan *auditRecord
+	done    chan struct{}
+	stopped chan struct{}
+
+	// mu protects f from concurrent writes and reopens.
+	mu sync.Mutex
+	f  *os.File
+}
+
+type auditRecord struct {
+	timestamp    time.Time
+	scopeID      scopeID
+	remoteAddr   string
+	user         string
+	clusterUser  string
+	clusterNode  string
+	method       string
+	query        string
+	statusCode   int
+	duration     time.Duration
+	bytesWritten int64
+}
+
+func newAuditLogger(cfg *config.AuditLog) (*auditLogger, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	f, err := openAuditLog(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	queueSize := cfg.QueueSize
+	if queueSize == 0 {
+		queueSize = defaultAuditLogQueueSize
+	}
+	al := &auditLogger{
+		cfg:        *cfg,
+		fields:     cfg.Fields,
+		tsv:        cfg.Format == "tsv",
+		dropOldest: cfg.DropPolicy == "drop_oldest",
+		records:    make(chan *auditRecord, queueSize),
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+		f:          f,
+	}
+	if len(al.fields) == 0 {
+		al.fields = config.AuditLogFields
+	}
+	if cfg.LogFullQuery {
+		al.fields = append(al.fields[:len(al.fields):len(al.fields)], auditLogQueryField)
+	}
+	go al.run()
+	return al, nil
+}
+
+func openAuditLog(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open `audit_log.path`: %w", err)
+	}
+	return f, nil
+}
+
+// reuseAuditLogger returns the logger of the previous config
+// if `audit_log` isn't changed. A new logger is returned otherwise.
+func reuseAuditLogger(cfg *config.AuditLog, prev *auditLogger) (*auditLogger, error) {
+	if cfg != nil && prev != nil && reflect.DeepEqual(*cfg, prev.cfg) {
+		return prev, nil
+	}
+	return newAuditLogger(cfg)
+}
+
+// auditRequest sends the record of the request to the audit log if it is configured.
+func (rp *reverseProxy) auditRequest(s *scope, req *http.Request, statusCode int, written int64, startTime time.Time) {
+	al := rp.snapshot.Load().auditLog
+	if al == nil {
+		return
+	}
+	r := &auditRecord{
+		timestamp:    startTime,
+		scopeID:      s.id,
+		remoteAddr:   s.remoteAddr,
+		user:         s.user.name,
+		clusterUser:  s.clusterUser.name,
+		method:       req.Method,
+		query:        getQuerySnippet(req),
+		statusCode:   statusCode,
+		duration:     time.Since(startTime),
+		bytesWritten: written,
+	}
+	if s.host != nil {
+		r.clusterNode = s.host.Host()
+	}
+	al.log(r)
+}
+
+// log enqueues r without blocking.
+func (al *auditLogger) log(r *auditRecord) {
+	select {
+	case al.records <- r:
+		return
+	default:
+	}
+	if al.dropOldest {
+		select {
+		case <-al.records:
+			auditLogRecords.With(prometheus.Labels{"result": "dropped"}).Inc()
+		default:
+		}
+		select {
+		case al.records <- r:
+			return
+		default:
+		}
+	}
+	auditLogRecords.With(prometheus.Labels{"result": "dropped"}).Inc()
+}
+
+func (al *auditLogger) run() {
+	defer close(al.stopped)
+	for {
+		select {
+		case r := <-al.records:
+			al.write(r)
+		case <-al.done:
+			// Write the queued records before closing the file.
+			for {
+				select {
+				case r := <-al.records:
+					al.write(r)
+				default:
+					al.mu.Lock()
+					al.f.Close()
+					al.mu.Unlock()
+					return
+				}
+			}
+		}
+	}
+}
+
+// write appends r to the file. The file is synced after every record,
+// so acknowledged requests aren't lost from the audit log on crashes.
+func (al *auditLogger) write(r *auditRecord) {
+	line := al.format(r)
+	al.mu.Lock()
+	_, err := al.f.Write(line)
+	if err == nil {
+		err = al.f.Sync()
+	}
+	al.mu.Unlock()
+	if err != nil {
+		auditLogRecords.With(prometheus.Labels{"result": "failed"}).Inc()
+		log.Errorf("cannot write audit log record to %q: %s", al.cfg.Path, err)
+		return
+	}
+	auditLogRecords.With(prometheus.Labels{"result": "written"}).Inc()
+}
+
+// format returns r with the configured fields as a single line.
+func (al *auditLogger) format(r *auditRecord) []byte {
+	var b []byte
+	if !al.tsv {
+		b = append(b, '{')
+	}
+	for i, field := range al.fields {
+		if i > 0 {
+			if al.tsv {
+				b = append(b, '\t')
+			} else {
+				b = append(b, ',')
+			}
+		}
+		if !al.tsv {
+			b = strconv.AppendQuote(b, field)
+			b = append(b, ':')
+		}
+		switch field {
+		case "status_code":
+			b = strconv.AppendInt(b, int64(r.statusCode), 10)
+		case "duration_ms":
+			b = strconv.AppendInt(b, r.duration.Milliseconds(), 10)
+		case "bytes_written":
+			b = strconv.AppendInt(b, r.bytesWritten, 10)
+		default:
+			b = al.appendString(b, r.stringField(field))
+		}
+	}
+	if !al.tsv {
+		b = append(b, '}')
+	}
+	return append(b, '\n')
+}
+
+func (r *auditRecord) stringField(field string) string {
+	switch field {
+	case "timestamp":
+		return r.timestamp.UTC().Format(time.RFC3339Nano)
+	case "scope_id":
+		return r.scopeID.String()
+	case "remote_addr":
+		return r.remoteAddr
+	case "user":
+		return r.user
+	case "cluster_user":
+		return r.clusterUser
+	case "cluster_node":
+		return r.clusterNode
+	case "http_method":
+		return r.method
+	case "query_digest":
+		h := sha256.Sum256([]byte(r.query))
+		return hex.EncodeToString(h[:])
+	case auditLogQueryField:
+		return r.query
+	}
+	panic(fmt.Sprintf("BUG: unexpected audit log field %q", field))
+}
+
+// tsvEscaper escapes values the same way as ClickHouse TabSeparated format,
+// so the audit log may be inserted into ClickHouse as is.
+var tsvEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+
+func (al *auditLogger) appendString(b []byte, s string) []byte {
+	if al.tsv {
+		return append(b, tsvEscaper.Replace(s)...)
+	}
+	v, err := json.Marshal(s)
+	if err != nil {
+		panic(fmt.Sprintf("BUG: cannot marshal string: %s", err))
+	}
+	return append(b, v...)
+}
+
+// reopen closes the file and opens it again, so the audit log may be rotated
+// by moving the file. The current file is kept if the new one cannot be opened.
+func (al *auditLogger) reopen() error {
+	f, err := openAuditLog(al.cfg.Path)
+	if err != nil {
+		return err
+	}
+	al.mu.Lock()
+	old := al.f
+	al.f = f
+	al.mu.Unlock()
+	return old.Close()
+}
+
+// close writes the queued records and closes the file.
+func (al *auditLogger) close() {
+	close(al.done)
+	<-al.stopped
+}
+
+func setupReopenAuditLogWatch() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	go func() {
+		for range c {
+			al := proxy.snapshot.Load().auditLog
+			if al == nil {
+				log.Infof("SIGUSR1 received, but `audit_log` isn't configured. Nothing to reopen")
+				continue
+			}
+			log.Infof("SIGUSR1 received. Going to reopen audit log %s ...", al.cfg.Path)
+			if err := al.reopen(); err != nil {
+				log.Errorf("error while reopening audit log: %s", err)
+				continue
+			}
+			log.Infof("Reopening audit log %s: successful", al.cfg.Path)
+		}
+	}()
+}
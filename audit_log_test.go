@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/contentsquare/chproxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func newAuditLogProxy(t *testing.T, al *config.AuditLog) *reverseProxy {
+	t.Helper()
+	chServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, okResponse)
+	}))
+	t.Cleanup(chServer.Close)
+	chAddr, err := url.Parse(chServer.URL)
+	checkErr(t, err)
+	proxy, err := newConfiguredProxy(&config.Config{
+		Clusters: []config.Cluster{
+			{
+				Name:         "cluster",
+				Scheme:       "http",
+				Nodes:        []string{chAddr.Host},
+				ClusterUsers: []config.ClusterUser{{Name: "web"}},
+			},
+		},
+		Users: []config.User{
+			{
+				Name:      defaultUsername,
+				ToCluster: "cluster",
+				ToUser:    "web",
+			},
+		},
+		AuditLog: al,
+	})
+	checkErr(t, err)
+	stopProxy(t, proxy)
+	return proxy
+}
+
+// readAuditLog waits until the file contains n records and returns them.
+func readAuditLog(t *testing.T, path string, n int) []string {
+	t.Helper()
+	var lines []string
+	assert.Eventually(t, func() bool {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return false
+		}
+		lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		return len(data) > 0 && len(lines) == n
+	}, 5*time.Second, 10*time.Millisecond)
+	return lines
+}
+
+func TestReverseProxy_AuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	proxy := newAuditLogProxy(t, &config.AuditLog{Path: path})
+
+	q := "SELECT secret"
+	req := httptest.NewRequest(http.MethodPost, "http://localhost:9090/", strings.NewReader(q))
+	req.RemoteAddr = "10.0.0.1:12345"
+	resp := makeCustomRequest(proxy, req)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	lines := readAuditLog(t, path, 1)
+	assert.NotContains(t, lines[0], "secret", "the query must not be logged by default")
+	var record map[string]interface{}
+	checkErr(t, json.Unmarshal([]byte(lines[0]), &record))
+	digest := sha256.Sum256([]byte(q))
+	assert.Equal(t, hex.EncodeToString(digest[:]), record["query_digest"])
+	assert.Equal(t, defaultUsername, record["user"])
+	assert.Equal(t, "web", record["cluster_user"])
+	assert.Equal(t, "10.0.0.1:12345", record["remote_addr"])
+	assert.Equal(t, http.MethodPost, record["http_method"])
+	assert.Equal(t, float64(http.StatusOK), record["status_code"])
+	assert.Equal(t, float64(len(okResponse)), record["bytes_written"])
+	for _, field := range config.AuditLogFields {
+		assert.Contains(t, record, field)
+	}
+	_, err := time.Parse(time.RFC3339Nano, record["timestamp"].(string))
+	assert.NoError(t, err)
+}
+
+func TestReverseProxy_AuditLogTSV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	proxy := newAuditLogProxy(t, &config.AuditLog{
+		Path:         path,
+		Format:       "tsv",
+		Fields:       []string{"user", "status_code"},
+		LogFullQuery: true,
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost:9090/", strings.NewReader("SELECT\t'a\\b'\nFROM t"))
+	resp := makeCustomRequest(proxy, req)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	lines := readAuditLog(t, path, 1)
+	assert.Equal(t, `default	200	SELECT\t'a\\b'\nFROM t`, lines[0])
+}
+
+func TestReverseProxy_AuditLogReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	proxy := newAuditLogProxy(t, &config.AuditLog{Path: path})
+	makeAuditedRequest := func() {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost:9090/?query="+url.QueryEscape("SELECT 1"), nil)
+		resp := makeCustomRequest(proxy, req)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	makeAuditedRequest()
+	readAuditLog(t, path, 1)
+	rotated := filepath.Join(dir, "audit.log.1")
+	checkErr(t, os.Rename(path, rotated))
+	checkErr(t, proxy.snapshot.Load().auditLog.reopen())
+
+	makeAuditedRequest()
+	readAuditLog(t, path, 1)
+	readAuditLog(t, rotated, 1)
+}
+
+func TestAuditLoggerDropPolicy(t *testing.T) {
+	record := func(user string) *auditRecord {
+		return &auditRecord{user: user}
+	}
+	queued := func(al *auditLogger) []string {
+		var users []string
+		for len(al.records) > 0 {
+			users = append(users, (<-al.records).user)
+		}
+		return users
+	}
+
+	// The logger isn't started, so records stay in the queue.
+	al := &auditLogger{records: make(chan *auditRecord, 2)}
+	for _, user := range []string{"a", "b", "c"} {
+		al.log(record(user))
+	}
+	assert.Equal(t, []string{"a", "b"}, queued(al))
+
+	al.dropOldest = true
+	for _, user := range []string{"a", "b", "c"} {
+		al.log(record(user))
+	}
+	assert.Equal(t, []string{"b", "c"}, queued(al))
+}
@@ -1,12 +1,17 @@
 package cache
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"sync"
 	"time"
 
 	"github.com/contentsquare/chproxy/clients"
 	"github.com/contentsquare/chproxy/config"
 	"github.com/contentsquare/chproxy/log"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/redis/go-redis/v9"
 )
 
@@ -20,11 +25,63 @@ type AsyncCache struct {
 
 	graceTime time.Duration
 
+	// redisClient is nil unless the cache is in redis mode.
+	redisClient redis.UniversalClient
+	// redisMonitor pings redis in background.
+	// It is nil unless the cache is in redis mode.
+	redisMonitor *redisMonitor
+
 	MaxPayloadSize     config.ByteSize
 	SharedWithAllUsers bool
+	NormalizeQueries   bool
+	TranscodeResponses bool
+	CachedHeaders      []string
+
+	AsyncWrites              bool
+	FinishWritesOnDisconnect bool
+
+	// janitorStop stops the goroutine completing abandoned transactions.
+	// It is nil if the goroutine isn't started.
+	janitorStop chan struct{}
+	janitorWG   sync.WaitGroup
+
+	// invalidationPublisher is the l2 cache of the layered cache,
+	// which notifies other chproxy instances about invalidations.
+	// It is nil unless l2 is a redis cache.
+	invalidationPublisher invalidationPublisher
+	invalidationsChannel  string
+	// stopInvalidations stops the subscription to invalidations
+	// published by other chproxy instances.
+	stopInvalidations context.CancelFunc
 }
 
+const (
+	// transactionJanitorInterval is the interval between checks
+	// for abandoned transactions.
+	transactionJanitorInterval = 10 * time.Second
+
+	// abandonedTransactionMargin is added to the grace time to find out
+	// transactions abandoned by crashed chproxy instances. Queries cannot run
+	// for longer than the grace time, which is `max_execution_time` by default.
+	abandonedTransactionMargin = 10 * time.Second
+)
+
 func (c *AsyncCache) Close() error {
+	if c.stopInvalidations != nil {
+		c.stopInvalidations()
+	}
+	if _, ok := c.Cache.(*layeredCache); ok {
+		// The levels and the transaction registry
+		// are closed by the caches they belong to.
+		return nil
+	}
+	if c.janitorStop != nil {
+		close(c.janitorStop)
+		c.janitorWG.Wait()
+	}
+	if c.redisMonitor != nil {
+		c.redisMonitor.Close()
+	}
 	if c.TransactionRegistry != nil {
 		c.TransactionRegistry.Close()
 	}
@@ -34,6 +91,33 @@ func (c *AsyncCache) Close() error {
 	return nil
 }
 
+// RedisClient returns the client of the redis cache.
+// It returns nil if the cache isn't in redis mode.
+func (c *AsyncCache) RedisClient() redis.UniversalClient {
+	return c.redisClient
+}
+
+// Levels returns the l1 and l2 caches of the layered cache.
+// It returns nil if the cache isn't in layered mode.
+func (c *AsyncCache) Levels() []Cache {
+	lc, ok := c.Cache.(*layeredCache)
+	if !ok {
+		return nil
+	}
+	return []Cache{lc.l1, lc.l2}
+}
+
+// Put puts the response into the underlying cache
+// and tracks the size of the cached payload.
+func (c *AsyncCache) Put(r io.Reader, contentMetadata ContentMetadata, key *Key) (time.Duration, error) {
+	expiration, err := c.Cache.Put(r, contentMetadata, key)
+	if err != nil {
+		return expiration, err
+	}
+	PayloadBytes.With(prometheus.Labels{"cache": c.Name()}).Observe(float64(contentMetadata.Length))
+	return expiration, nil
+}
+
 func (c *AsyncCache) AwaitForConcurrentTransaction(key *Key) (TransactionStatus, error) {
 	startTime := time.Now()
 	seenState := transactionAbsent
@@ -68,7 +152,62 @@ func (c *AsyncCache) AwaitForConcurrentTransaction(key *Key) (TransactionStatus,
 	}
 }
 
-func NewAsyncCache(cfg config.Cache, maxExecutionTime time.Duration) (*AsyncCache, error) {
+// startTransactionJanitor starts the goroutine completing transactions
+// pending for longer than maxAge every interval.
+func (c *AsyncCache) startTransactionJanitor(interval, maxAge time.Duration) {
+	c.janitorStop = make(chan struct{})
+	c.janitorWG.Add(1)
+	go func() {
+		defer c.janitorWG.Done()
+		for {
+			select {
+			case <-time.After(interval):
+				c.completeAbandonedTransactions(maxAge)
+			case <-c.janitorStop:
+				return
+			}
+		}
+	}()
+}
+
+// completeAbandonedTransactions completes transactions pending for longer
+// than maxAge, so concurrent queries don't await the results of queries
+// which are never going to complete, e.g. because chproxy crashed.
+// The transactions are completed instead of being failed,
+// so awaiting queries are proxied to ClickHouse instead of failing.
+// It returns the number of completed transactions.
+func (c *AsyncCache) completeAbandonedTransactions(maxAge time.Duration) int {
+	transactions, err := c.TransactionRegistry.List()
+	if err != nil {
+		log.Errorf("cannot list transactions of cache %q: %s", c.Name(), err)
+		return 0
+	}
+	deadline := time.Now().Add(-maxAge)
+	completed := 0
+	for _, t := range transactions {
+		// Transactions created by older versions of chproxy
+		// have no creation time. They expire on their own.
+		if t.Created.IsZero() || t.Created.After(deadline) {
+			continue
+		}
+		err := c.TransactionRegistry.Resolve(t.KeyHash, "")
+		if errors.Is(err, ErrTransactionNotPending) {
+			// The transaction has been ended meanwhile.
+			continue
+		}
+		if err != nil {
+			log.Errorf("cannot complete abandoned transaction %s of cache %q: %s", t.KeyHash, c.Name(), err)
+			continue
+		}
+		log.Debugf("completed transaction %s of user %q abandoned for %s in cache %q",
+			t.KeyHash, t.User, time.Since(t.Created), c.Name())
+		AbandonedTransactions.With(prometheus.Labels{"cache": c.Name()}).Inc()
+		completed++
+	}
+	return completed
+}
+
+func getGraceTime(cfg config.Cache, maxExecutionTime time.Duration) time.Duration {
 	graceTime := time.Duration(cfg.GraceTime)
 	if graceTime > 0 {
 		log.Errorf("[DEPRECATED] detected grace time configuration %s. It will be removed in the new version",
@@ -82,22 +221,73 @@ func NewAsyncCache(cfg config.Cache, maxExecutionTime time.Duration) (*AsyncCach
 		// Disable protection from `dogpile effect`.
 		graceTime = 0
 	}
+	return graceTime
+}
+
+func NewAsyncCache(cfg config.Cache, maxExecutionTime time.Duration) (*AsyncCache, error) {
+	return newAsyncCache(cfg, maxExecutionTime, false)
+}
+
+// NewAsyncCacheDryRun checks the cache may be created from cfg.
+// Unlike NewAsyncCache it doesn't dial redis, create the cache dir
+// or start background goroutines, so the returned cache cannot be used
+// for caching responses.
+func NewAsyncCacheDryRun(cfg config.Cache, maxExecutionTime time.Duration) (*AsyncCache, error) {
+	return newAsyncCache(cfg, maxExecutionTime, true)
+}
+
+func newAsyncCache(cfg config.Cache, maxExecutionTime time.Duration, dryRun bool) (*AsyncCache, error) {
+	graceTime := getGraceTime(cfg, maxExecutionTime)
 
 	var cache Cache
 	var transaction TransactionRegistry
+	var redisClient redis.UniversalClient
 	var err error
 	// transaction will be kept until we're sure there's no possible concurrent query running
 	transactionDeadline := 2 * graceTime
 
 	switch cfg.Mode {
 	case "file_system":
+		if dryRun {
+			err = checkFilesSystemConfig(cfg)
+			break
+		}
 		cache, err = newFilesSystemCache(cfg, graceTime)
 		transaction = newInMemoryTransactionRegistry(transactionDeadline, transactionEndedTTL)
 	case "redis":
-		var redisClient redis.UniversalClient
+		if dryRun {
+			err = clients.CheckRedisConfig(cfg.Redis)
+			break
+		}
 		redisClient, err = clients.NewRedisClient(cfg.Redis)
-		cache = newRedisCache(redisClient, cfg)
-		transaction = newRedisTransactionRegistry(redisClient, transactionDeadline, transactionEndedTTL)
+		if err != nil {
+			break
+		}
+		redisClient.AddHook(&reconnectionsHook{cache: cfg.Name})
+		redisCache := newRedisCache(redisClient, cfg)
+		cache = redisCache
+		if cfg.Redis.PipelineWindow > 0 {
+			cache = newPipelinedRedisCache(redisCache, time.Duration(cfg.Redis.PipelineWindow), cfg.Redis.PipelineMaxCmds)
+		}
+		transaction = newRedisTransactionRegistry(redisClient, transactionDeadline, transactionEndedTTL, cfg.KeyPrefix)
+	case "memory":
+		if dryRun {
+			err = checkMemoryCacheConfig(cfg)
+			break
+		}
+		var mc *memoryCache
+		if mc, err = newMemoryCache(cfg, graceTime); err != nil {
+			break
+		}
+		// Larger responses cannot fit into the shards of the cache,
+		// so they aren't cached.
+		if maxEntrySize := config.ByteSize(mc.maxEntrySize()); cfg.MaxPayloadSize > maxEntrySize {
+			cfg.MaxPayloadSize = maxEntrySize
+		}
+		cache = mc
+		transaction = newInMemoryTransactionRegistry(transactionDeadline, transactionEndedTTL)
+	case "layered":
+		return nil, fmt.Errorf("layered cache %q must be created via NewLayeredAsyncCache", cfg.Name)
 	default:
 		return nil, fmt.Errorf("unknown config mode")
 	}
@@ -108,11 +298,57 @@ func NewAsyncCache(cfg config.Cache, maxExecutionTime time.Duration) (*AsyncCach
 
 	maxPayloadSize := cfg.MaxPayloadSize
 
-	return &AsyncCache{
+	c := &AsyncCache{
 		Cache:               cache,
 		TransactionRegistry: transaction,
 		graceTime:           graceTime,
+		redisClient:         redisClient,
 		MaxPayloadSize:      maxPayloadSize,
 		SharedWithAllUsers:  cfg.SharedWithAllUsers,
-	}, nil
+		NormalizeQueries:    cfg.NormalizeQueries,
+		TranscodeResponses:  cfg.TranscodeResponses,
+		CachedHeaders:       cfg.CachedHeaders,
+
+		AsyncWrites:              cfg.AsyncWrites,
+		FinishWritesOnDisconnect: cfg.FinishWritesOnDisconnect,
+	}
+	if graceTime > 0 && !dryRun {
+		c.startTransactionJanitor(transactionJanitorInterval, graceTime+abandonedTransactionMargin)
+	}
+	if redisClient != nil {
+		c.redisMonitor = startRedisMonitor(cfg.Name, redisClient, redisPingInterval)
+	}
+	return c, nil
+}
+
+// NewLayeredAsyncCache returns the cache looking up entries in l1 and then in l2.
+//
+// The transaction registry of l2 is used, so concurrent queries are awaited
+// by all the chproxy instances sharing l2.
+//
+// If l2 is a redis cache, the cache subscribes to invalidations published
+// by the chproxy instances sharing l2, so l1 entries invalidated via
+// other instances are removed as well.
+func NewLayeredAsyncCache(cfg config.Cache, l1, l2 *AsyncCache, maxExecutionTime time.Duration) (*AsyncCache, error) {
+	if l1.Levels() != nil || l2.Levels() != nil {
+		return nil, fmt.Errorf("layered cache %q cannot contain layered caches", cfg.Name)
+	}
+	c := &AsyncCache{
+		Cache:               newLayeredCache(cfg.Name, l1.Cache, l2.Cache),
+		TransactionRegistry: l2.TransactionRegistry,
+		graceTime:           getGraceTime(cfg, maxExecutionTime),
+		redisClient:         l2.redisClient,
+		MaxPayloadSize:      cfg.MaxPayloadSize,
+		SharedWithAllUsers:  cfg.SharedWithAllUsers,
+		NormalizeQueries:    cfg.NormalizeQueries,
+		TranscodeResponses:  cfg.TranscodeResponses,
+		CachedHeaders:       cfg.CachedHeaders,
+
+		AsyncWrites:              cfg.AsyncWrites,
+		FinishWritesOnDisconnect: cfg.FinishWritesOnDisconnect,
+	}
+	if err := c.subscribeInvalidations(l1.Cache, l2.Cache); err != nil {
+		return nil, fmt.Errorf("layered cache %q: %w", cfg.Name, err)
+	}
+	return c, nil
 }
@@ -30,7 +30,7 @@ func TestAsyncCache_Cleanup_Of_Expired_Transactions(t *testing.T) {
 		t.Fatalf("unexpected behaviour: transaction isnt done while it wasnt even started")
 	}
 
-	if err := asyncCache.Create(key); err != nil {
+	if err := asyncCache.Create(key, "default"); err != nil {
 		t.Fatalf("unexpected error: %s failed to register transaction", err)
 	}
 
@@ -68,7 +68,7 @@ func TestAsyncCache_AwaitForConcurrentTransaction_GraceTimeWithoutTransactionCom
 		t.Fatalf("unexpected behaviour: transaction isnt done while it wasnt even started")
 	}
 
-	if err := asyncCache.Create(key); err != nil {
+	if err := asyncCache.Create(key, "default"); err != nil {
 		t.Fatalf("unexpected error: %s failed to register transaction", err)
 	}
 
@@ -104,7 +104,7 @@ func TestAsyncCache_AwaitForConcurrentTransaction_TransactionCompletedWhileAwait
 		Query: []byte("SELECT async cache AwaitForConcurrentTransactionCompleted"),
 	}
 
-	if err := asyncCache.Create(key); err != nil {
+	if err := asyncCache.Create(key, "default"); err != nil {
 		t.Fatalf("unexpected error: %s failed to register transaction", err)
 	}
 
@@ -149,7 +149,7 @@ func TestAsyncCache_AwaitForConcurrentTransaction_TransactionFailedWhileAwaiting
 		Query: []byte("SELECT async cache AwaitForConcurrentTransactionCompleted"),
 	}
 
-	if err := asyncCache.Create(key); err != nil {
+	if err := asyncCache.Create(key, "default"); err != nil {
 		t.Fatalf("unexpected error: %s failed to register transaction", err)
 	}
 
@@ -328,3 +328,44 @@ func TestAsyncCache_Unknown_instantiation(t *testing.T) {
 		t.Fatalf("The instanciation should have crash")
 	}
 }
+
+func TestAsyncCache_CompleteAbandonedTransactions(t *testing.T) {
+	graceTime := 5 * time.Second
+	asyncCache := newAsyncTestCache(t, graceTime, graceTime)
+	defer func() {
+		asyncCache.Close()
+		os.RemoveAll(asyncTestDir)
+	}()
+
+	abandoned := &Key{Query: []byte("SELECT abandoned transaction")}
+	running := &Key{Query: []byte("SELECT running transaction")}
+	for _, key := range []*Key{abandoned, running} {
+		if err := asyncCache.Create(key, "default"); err != nil {
+			t.Fatalf("unexpected error: %s failed to register transaction", err)
+		}
+	}
+	// Pretend the transaction has been created by the crashed instance long ago.
+	registry := asyncCache.TransactionRegistry.(*inMemoryTransactionRegistry)
+	registry.pendingEntriesLock.Lock()
+	entry := registry.pendingEntries[abandoned.String()]
+	entry.created = entry.created.Add(-time.Hour)
+	registry.pendingEntries[abandoned.String()] = entry
+	registry.pendingEntriesLock.Unlock()
+
+	awaited := make(chan TransactionStatus)
+	go func() {
+		status, err := asyncCache.AwaitForConcurrentTransaction(abandoned)
+		assert.NoError(t, err)
+		awaited <- status
+	}()
+
+	startTime := time.Now()
+	asyncCache.startTransactionJanitor(10*time.Millisecond, time.Minute)
+	status := <-awaited
+	assert.True(t, status.State.IsCompleted(), "the abandoned transaction must be completed")
+	assert.Less(t, time.Since(startTime), graceTime, "the awaiting query must proceed before the grace time")
+
+	status, err := asyncCache.Status(running)
+	assert.NoError(t, err)
+	assert.True(t, status.State.IsPending(), "running transactions must be kept")
+}
@@ -2,7 +2,10 @@ package cache
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"net/http"
+	"sort"
 	"time"
 )
 
@@ -20,13 +23,83 @@ type ContentMetadata struct {
 	Length   int64
 	Type     string
 	Encoding string
+
+	// Headers are the response headers replayed on cache hits,
+	// e.g. X-ClickHouse-Summary. See config.Cache.CachedHeaders.
+	Headers http.Header
 }
 
 type CachedData struct {
 	ContentMetadata
 	Data io.ReadCloser // we need a ReadCloser because the reader is used oustide the scope where it was created and need to be closed by the function using it.
 	Ttl  time.Duration
+	// Stale is set for the expired entries served during the
+	// `stale_while_revalidate` period. They must be refreshed.
+	Stale bool
 }
 
 // ErrMissing is returned when the entry isn't found in the cache.
 var ErrMissing = errors.New("missing cache entry")
+
+// encodeHeaders encodes h as a sequence of length-prefixed header names and values:
+// length(name)|name|length(value)|value|...
+//
+// Headers with multiple values are encoded once per value.
+func encodeHeaders(h http.Header) []byte {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b []byte
+	for _, name := range names {
+		for _, value := range h[name] {
+			b = appendString(b, name)
+			b = appendString(b, value)
+		}
+	}
+	return b
+}
+
+// errCorruptedHeaders is returned if the cached headers cannot be decoded.
+var errCorruptedHeaders = errors.New("cached headers are corrupted")
+
+// decodeHeaders decodes headers encoded by encodeHeaders.
+func decodeHeaders(b []byte) (http.Header, error) {
+	h := make(http.Header)
+	for len(b) > 0 {
+		name, n, ok := decodeString(b)
+		if !ok {
+			return nil, errCorruptedHeaders
+		}
+		b = b[n:]
+		value, n, ok := decodeString(b)
+		if !ok {
+			return nil, fmt.Errorf("cannot decode value of header %q: %w", name, errCorruptedHeaders)
+		}
+		b = b[n:]
+		h[name] = append(h[name], value)
+	}
+	return h, nil
+}
+
+// appendString appends s prefixed by its big endian length to b.
+func appendString(b []byte, s string) []byte {
+	n := uint32(len(s))
+	b = append(b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	return append(b, s...)
+}
+
+// decodeString decodes the string encoded by appendString.
+// It returns the string and the number of bytes it occupies in b.
+func decodeString(b []byte) (string, int, bool) {
+	if len(b) < 4 {
+		return "", 0, false
+	}
+	n := uint32(b[3]) | (uint32(b[2]) << 8) | (uint32(b[1]) << 16) | (uint32(b[0]) << 24)
+	if uint64(len(b)) < 4+uint64(n) {
+		return "", 0, false
+	}
+	return string(b[4 : 4+n]), int(4 + n), true
+}
@@ -0,0 +1,123 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressedMarker prefixes files with compressed data. It is followed
+// by the 1-byte compression version, so the algorithm may be changed
+// without breaking existing files.
+// It cannot be the length of the content type in legacy files.
+const compressedMarker = ^uint32(0) - 1
+
+// Compression versions stored after compressedMarker.
+const (
+	compressionNone byte = 0
+	compressionZstd byte = 1
+)
+
+// compressionVersions maps `compress` values to compression versions.
+var compressionVersions = map[string]byte{
+	"":     compressionNone,
+	"zstd": compressionZstd,
+}
+
+var (
+	zstdEncoderPool = sync.Pool{
+		New: func() interface{} {
+			// NewWriter fails only on invalid options.
+			enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+			return enc
+		},
+	}
+	zstdDecoderPool = sync.Pool{
+		New: func() interface{} {
+			dec, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+			return dec
+		},
+	}
+)
+
+// writeCompressionHeader writes compressedMarker and the compression version to w.
+func writeCompressionHeader(w io.Writer, version byte) error {
+	m := compressedMarker
+	_, err := w.Write([]byte{byte(m >> 24), byte(m >> 16), byte(m >> 8), byte(m), version})
+	return err
+}
+
+// readCompressionHeader returns the compression version of file.
+// The file is rewound to the start if it isn't compressed.
+func readCompressionHeader(file *os.File) (byte, error) {
+	n, err := readHeaderLength(file)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read compression header: %w", err)
+	}
+	if n != compressedMarker {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		return compressionNone, nil
+	}
+	var version [1]byte
+	if _, err := io.ReadFull(file, version[:]); err != nil {
+		return 0, fmt.Errorf("cannot read compression version: %w", err)
+	}
+	if version[0] != compressionZstd {
+		return 0, fmt.Errorf("unsupported compression version %d", version[0])
+	}
+	return version[0], nil
+}
+
+// compressTo copies r to w compressed according to version.
+func compressTo(w io.Writer, r io.Reader, version byte) error {
+	if version == compressionNone {
+		_, err := io.Copy(w, r)
+		return err
+	}
+	enc := zstdEncoderPool.Get().(*zstd.Encoder)
+	defer zstdEncoderPool.Put(enc)
+	enc.Reset(w)
+	if _, err := io.Copy(enc, r); err != nil {
+		enc.Close()
+		return err
+	}
+	return enc.Close()
+}
+
+// zstdReadCloser decompresses the data of the cached file.
+// The file is closed on Close.
+type zstdReadCloser struct {
+	dec  *zstd.Decoder
+	file io.Closer
+}
+
+func newZstdReadCloser(file io.ReadCloser) (*zstdReadCloser, error) {
+	dec := zstdDecoderPool.Get().(*zstd.Decoder)
+	if err := dec.Reset(file); err != nil {
+		zstdDecoderPool.Put(dec)
+		return nil, fmt.Errorf("cannot decompress cached data: %w", err)
+	}
+	return &zstdReadCloser{
+		dec:  dec,
+		file: file,
+	}, nil
+}
+
+func (rc *zstdReadCloser) Read(p []byte) (int, error) {
+	return rc.dec.Read(p)
+}
+
+func (rc *zstdReadCloser) Close() error {
+	if rc.dec != nil {
+		// Drop the reference to the file.
+		_ = rc.dec.Reset(nil)
+		zstdDecoderPool.Put(rc.dec)
+		rc.dec = nil
+	}
+	return rc.file.Close()
+}
@@ -1,19 +1,21 @@
 package cache
 
 import (
+	"errors"
 	"fmt"
 	"io"
-	"math/rand"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/contentsquare/chproxy/config"
 	"github.com/contentsquare/chproxy/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
 )
 
 var cachefileRegexp = regexp.MustCompile(`^[0-9a-f]{32}$`)
@@ -27,7 +29,18 @@ type fileSystemCache struct {
 	maxSize uint64
 	expire  time.Duration
 	grace   time.Duration
-	stats   Stats
+	stale   time.Duration
+	jitter  time.Duration
+
+	cleanupInterval time.Duration
+	cleanupScanRate int
+
+	// compression is the version of the compression applied
+	// to the data of new files.
+	compression byte
+
+	// index tracks the cached files in LRU order.
+	index *fileIndex
 
 	wg     sync.WaitGroup
 	stopCh chan struct{}
@@ -35,24 +48,31 @@ type fileSystemCache struct {
 
 // newFilesSystemCache returns new cache for the given cfg.
 func newFilesSystemCache(cfg config.Cache, graceTime time.Duration) (*fileSystemCache, error) {
-	if len(cfg.FileSystem.Dir) == 0 {
-		return nil, fmt.Errorf("`dir` cannot be empty")
-	}
-	if cfg.FileSystem.MaxSize <= 0 {
-		return nil, fmt.Errorf("`max_size` must be positive")
-	}
-	if cfg.Expire <= 0 {
-		return nil, fmt.Errorf("`expire` must be positive")
+	if err := checkFilesSystemConfig(cfg); err != nil {
+		return nil, err
 	}
 
 	c := &fileSystemCache{
 		name: cfg.Name,
 
-		dir:     cfg.FileSystem.Dir,
+		dir:     filepath.Join(cfg.FileSystem.Dir, cfg.KeyPrefix),
 		maxSize: uint64(cfg.FileSystem.MaxSize),
 		expire:  time.Duration(cfg.Expire),
 		grace:   graceTime,
+		stale:   time.Duration(cfg.StaleWhileRevalidate),
+		jitter:  time.Duration(cfg.ExpireJitter),
+		index:   newFileIndex(),
 		stopCh:  make(chan struct{}),
+
+		cleanupInterval: time.Duration(cfg.FileSystem.CleanupInterval),
+		cleanupScanRate: cfg.FileSystem.CleanupScanRate,
+		compression:     compressionVersions[cfg.FileSystem.Compress],
+	}
+	if c.cleanupInterval == 0 {
+		c.cleanupInterval = defaultCleanupInterval
+	}
+	if c.cleanupScanRate == 0 {
+		c.cleanupScanRate = defaultCleanupScanRate
 	}
 
 	if err := os.MkdirAll(c.dir, 0700); err != nil {
@@ -61,15 +81,32 @@ func newFilesSystemCache(cfg config.Cache, graceTime time.Duration) (*fileSystem
 
 	c.wg.Add(1)
 	go func() {
-		log.Debugf("cache %q: cleaner start", c.Name())
-		c.cleaner()
-		log.Debugf("cache %q: cleaner stop", c.Name())
+		log.Debugf("cache %q: janitor start", c.Name())
+		c.janitor()
+		log.Debugf("cache %q: janitor stop", c.Name())
 		c.wg.Done()
 	}()
 
 	return c, nil
 }
 
+// checkFilesSystemConfig checks the file system cache may be created from cfg.
+func checkFilesSystemConfig(cfg config.Cache) error {
+	if len(cfg.FileSystem.Dir) == 0 {
+		return fmt.Errorf("`dir` cannot be empty")
+	}
+	if cfg.FileSystem.MaxSize <= 0 {
+		return fmt.Errorf("`max_size` must be positive")
+	}
+	if cfg.Expire <= 0 {
+		return fmt.Errorf("`expire` must be positive")
+	}
+	if _, ok := compressionVersions[cfg.FileSystem.Compress]; !ok {
+		return fmt.Errorf("unknown `compress` %q", cfg.FileSystem.Compress)
+	}
+	return nil
+}
+
 func (f *fileSystemCache) Name() string {
 	return f.name
 }
@@ -84,8 +121,7 @@ func (f *fileSystemCache) Close() error {
 
 func (f *fileSystemCache) Stats() Stats {
 	var s Stats
-	s.Size = atomic.LoadUint64(&f.stats.Size)
-	s.Items = atomic.LoadUint64(&f.stats.Items)
+	s.Size, s.Items = f.index.stats()
 	return s
 }
 
@@ -93,6 +129,7 @@ func (f *fileSystemCache) Get(key *Key) (*CachedData, error) {
 	fp := key.filePath(f.dir)
 	file, err := os.Open(fp)
 	if err != nil {
+		f.index.remove(key.String())
 		return nil, ErrMissing
 	}
 
@@ -100,13 +137,14 @@ func (f *fileSystemCache) Get(key *Key) (*CachedData, error) {
 	// This  ReaderCloser is stored in the returned CachedData
 	fi, err := file.Stat()
 	if err != nil {
+		file.Close()
 		return nil, fmt.Errorf("cache %q: cannot stat %q: %w", f.Name(), fp, err)
 	}
 	mt := fi.ModTime()
 	age := time.Since(mt)
 	if age > f.expire {
 		// check if file exceeded expiration time + grace time
-		if age > f.expire+f.grace {
+		if age > f.expire+f.keepTime() {
 			file.Close()
 			return nil, ErrMissing
 		}
@@ -119,24 +157,61 @@ func (f *fileSystemCache) Get(key *Key) (*CachedData, error) {
 		return nil, fmt.Errorf("failed to read file content from %q: %w", f.Name(), err)
 	}
 
+	// Files are decompressed regardless of `compress`,
+	// so they remain readable once it is changed.
+	compression, err := readCompressionHeader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("cache %q: %w", f.Name(), err)
+	}
 	metadata, err := decodeHeader(file)
 	if err != nil {
+		file.Close()
 		return nil, err
 	}
+	var data io.ReadCloser = file
+	if compression == compressionZstd {
+		if data, err = newZstdReadCloser(file); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("cache %q: %w", f.Name(), err)
+		}
+	}
+	f.index.put(key.String(), uint64(fi.Size()), mt)
 
 	value := &CachedData{
 		ContentMetadata: *metadata,
-		Data:            file,
+		Data:            data,
 		Ttl:             f.expire - age,
+		Stale:           age > f.expire && age <= f.expire+f.stale,
 	}
 
 	return value, nil
 }
 
+// headersMarker prefixes files containing response headers.
+// It cannot be the length of the content type in legacy files.
+const headersMarker = ^uint32(0)
+
 // decodeHeader decodes header from raw byte stream. Data is encoded as follows:
-// length(contentType)|contentType|length(contentEncoding)|contentEncoding|length(contentLength)|contentLength|cachedData
+// [compressedMarker|version|][headersMarker|]length(contentType)|contentType|length(contentEncoding)|contentEncoding|length(contentLength)|contentLength[|length(headers)|headers]|cachedData
+//
+// Response headers are present only if the header starts with headersMarker.
+// cachedData is compressed according to version if the data starts
+// with compressedMarker, which is read by readCompressionHeader.
+// contentEncoding is the encoding of the response sent by ClickHouse
+// regardless of the compression.
 func decodeHeader(reader io.Reader) (*ContentMetadata, error) {
-	contentType, err := readHeader(reader)
+	n, err := readHeaderLength(reader)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read Content-Type from provided reader: %w", err)
+	}
+	hasHeaders := n == headersMarker
+	if hasHeaders {
+		if n, err = readHeaderLength(reader); err != nil {
+			return nil, fmt.Errorf("cannot read Content-Type from provided reader: %w", err)
+		}
+	}
+	contentType, err := readHeaderValue(reader, n)
 	if err != nil {
 		return nil, fmt.Errorf("cannot read Content-Type from provided reader: %w", err)
 	}
@@ -157,11 +232,21 @@ func decodeHeader(reader io.Reader) (*ContentMetadata, error) {
 		contentLength = 0
 	}
 
-	return &ContentMetadata{
+	metadata := &ContentMetadata{
 		Length:   int64(contentLength),
 		Type:     contentType,
 		Encoding: contentEncoding,
-	}, nil
+	}
+	if hasHeaders {
+		headers, err := readHeader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read response headers from provided reader: %w", err)
+		}
+		if metadata.Headers, err = decodeHeaders([]byte(headers)); err != nil {
+			return nil, fmt.Errorf("cannot decode response headers: %w", err)
+		}
+	}
+	return metadata, nil
 }
 
 func (f *fileSystemCache) Put(r io.Reader, contentMetadata ContentMetadata, key *Key) (time.Duration, error) {
@@ -171,6 +256,23 @@ func (f *fileSystemCache) Put(r io.Reader, contentMetadata ContentMetadata, key
 	if err != nil {
 		return 0, fmt.Errorf("cache %q: cannot create file: %s : %w", f.Name(), key, err)
 	}
+	defer file.Close()
+
+	if f.compression != compressionNone {
+		if err := writeCompressionHeader(file, f.compression); err != nil {
+			fn := file.Name()
+			return 0, fmt.Errorf("cannot write compression header to %q: %w", fn, err)
+		}
+	}
+
+	hasHeaders := len(contentMetadata.Headers) > 0
+	if hasHeaders {
+		m := headersMarker
+		if _, err := file.Write([]byte{byte(m >> 24), byte(m >> 16), byte(m >> 8), byte(m)}); err != nil {
+			fn := file.Name()
+			return 0, fmt.Errorf("cannot write headers marker to %q: %w", fn, err)
+		}
+	}
 
 	if err := writeHeader(file, contentMetadata.Type); err != nil {
 		fn := file.Name()
@@ -187,133 +289,214 @@ func (f *fileSystemCache) Put(r io.Reader, contentMetadata ContentMetadata, key
 		return 0, fmt.Errorf("cannot write Content-Encoding to %q: %w", fn, err)
 	}
 
-	cnt, err := io.Copy(file, r)
-	if err != nil {
-		return 0, fmt.Errorf("cache %q: cannot write results to file: %s : %w", f.Name(), key, err)
+	if hasHeaders {
+		if err := writeHeader(file, string(encodeHeaders(contentMetadata.Headers))); err != nil {
+			fn := file.Name()
+			return 0, fmt.Errorf("cannot write response headers to %q: %w", fn, err)
+		}
 	}
 
-	atomic.AddUint64(&f.stats.Size, uint64(cnt))
-	atomic.AddUint64(&f.stats.Items, 1)
-	return f.expire, nil
-}
+	if err := compressTo(file, r, f.compression); err != nil {
+		return 0, fmt.Errorf("cache %q: cannot write results to file: %s : %w", f.Name(), key, err)
+	}
 
-func (f *fileSystemCache) cleaner() {
-	d := f.expire / 2
-	if d < time.Minute {
-		d = time.Minute
+	// The file age is counted from its modification time,
+	// so the jitter is applied by moving it to the future.
+	jitter := expireJitter(f.jitter)
+	if jitter > 0 {
+		mt := time.Now().Add(jitter)
+		if err := os.Chtimes(fp, mt, mt); err != nil {
+			return 0, fmt.Errorf("cache %q: cannot change modification time of %q: %w", f.Name(), fp, err)
+		}
 	}
-	if d > time.Hour {
-		d = time.Hour
+
+	fi, err := file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("cache %q: cannot stat %q: %w", f.Name(), fp, err)
 	}
-	forceCleanCh := time.After(d)
+	f.index.put(key.String(), uint64(fi.Size()), fi.ModTime())
+	f.evict()
+
+	return f.expire + jitter, nil
+}
 
-	f.clean()
+// reconcileInterval is the interval between reconciliations
+// of the index with the cache dir.
+const reconcileInterval = 6 * time.Hour
+
+const (
+	// defaultCleanupInterval is used if `cleanup_interval` isn't set.
+	defaultCleanupInterval = time.Hour
+
+	// defaultCleanupScanRate is used if `cleanup_scan_rate` isn't set.
+	defaultCleanupScanRate = 1000
+)
+
+// janitor removes expired files from the cache and periodically
+// reconciles the index with the cache dir.
+//
+// The index is populated from the cache dir on start,
+// while max_size is enforced by Put.
+func (f *fileSystemCache) janitor() {
+	cleanupCh := time.After(f.cleanupInterval)
+	reconcileCh := time.After(reconcileInterval)
+
+	f.reconcile()
 	for {
 		select {
-		case <-time.After(time.Second):
-			// Clean cache only on cache size overflow.
-			stats := f.Stats()
-			if stats.Size > f.maxSize {
-				f.clean()
-			}
-		case <-forceCleanCh:
-			// Forcibly clean cache from expired items.
-			f.clean()
-			forceCleanCh = time.After(d)
+		case <-cleanupCh:
+			f.cleanup()
+			cleanupCh = time.After(f.cleanupInterval)
+		case <-reconcileCh:
+			f.reconcile()
+			reconcileCh = time.After(reconcileInterval)
 		case <-f.stopCh:
 			return
 		}
 	}
 }
 
-func (f *fileSystemCache) fileInfoPath(fi os.FileInfo) string {
-	return filepath.Join(f.dir, fi.Name())
+// cleanup scans the cache dir and removes files after a deadline
+// from their expiration, including files missing in the index,
+// e.g. put by another cache instance sharing the dir.
+//
+// Files are checked at `cleanup_scan_rate` per second, so the scan
+// doesn't cause I/O spikes. The scan is interrupted by Close.
+func (f *fileSystemCache) cleanup() {
+	log.Debugf("cache %q: start cleaning up dir %q", f.Name(), f.dir)
+
+	labels := prometheus.Labels{"cache": f.Name()}
+	limiter := rate.NewLimiter(rate.Limit(f.cleanupScanRate), f.cleanupScanRate)
+	deadline := time.Now().Add(-f.expire - f.keepTime())
+	removed := 0
+	stopped := false
+	err := walkDir(f.dir, func(fi os.FileInfo) {
+		if stopped {
+			return
+		}
+		if d := limiter.Reserve().Delay(); d > 0 {
+			select {
+			case <-time.After(d):
+			case <-f.stopCh:
+				stopped = true
+				return
+			}
+		}
+		if !fi.ModTime().Before(deadline) {
+			return
+		}
+		name := fi.Name()
+		fn := filepath.Join(f.dir, name)
+		// The file may be substituted with the fresh one since the dir was read.
+		if fi, err := os.Stat(fn); err != nil || !fi.ModTime().Before(deadline) {
+			return
+		}
+		if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+			log.Errorf("cache %q: cannot remove file %q: %s", f.Name(), fn, err)
+			CleanupErrors.With(labels).Inc()
+			return
+		}
+		f.index.remove(name)
+		removed++
+	})
+	if err != nil {
+		log.Errorf("cache %q: %s", f.Name(), err)
+		CleanupErrors.With(labels).Inc()
+	}
+	CleanupFilesRemoved.With(labels).Add(float64(removed))
+	f.reportIndexEntries()
+
+	log.Debugf("cache %q: finish cleaning up dir %q; removed %d expired files", f.Name(), f.dir, removed)
+}
+
+// keepTime returns the duration expired files are kept for.
+func (f *fileSystemCache) keepTime() time.Duration {
+	if f.stale > f.grace {
+		return f.stale
+	}
+	return f.grace
 }
 
-func (f *fileSystemCache) clean() {
-	currentTime := time.Now()
+// evict removes the least recently used files while the cache exceeds max_size.
+func (f *fileSystemCache) evict() {
+	names := f.index.evict(f.maxSize)
+	f.removeFiles(names)
+	if len(names) > 0 {
+		Evictions.With(prometheus.Labels{"cache": f.Name()}).Add(float64(len(names)))
+	}
+	f.reportIndexEntries()
+}
 
-	log.Debugf("cache %q: start cleaning dir %q", f.Name(), f.dir)
+// removeExpired removes cached files after a deadline from their expiration,
+// so they may be served until they are substituted with fresh files.
+func (f *fileSystemCache) removeExpired() {
+	names := f.index.expire(time.Now().Add(-f.expire - f.keepTime()))
+	f.removeFiles(names)
+	f.reportIndexEntries()
 
-	// Remove cached files after a deadline from their expiration,
-	// so they may be served until they are substituted with fresh files.
-	expire := f.expire + f.grace
+	log.Debugf("cache %q: removed %d expired items", f.Name(), len(names))
+}
 
-	// Calculate total cache size and remove expired files.
-	var totalSize uint64
-	var totalItems uint64
-	var removedSize uint64
-	var removedItems uint64
+// reconcile syncs the index with the files in the cache dir,
+// which may be modified externally or by another cache instance
+// sharing the dir during config reload.
+func (f *fileSystemCache) reconcile() {
+	log.Debugf("cache %q: start reconciling index with dir %q", f.Name(), f.dir)
+
+	startTime := time.Now()
+	files := make(map[string]os.FileInfo)
 	err := walkDir(f.dir, func(fi os.FileInfo) {
-		mt := fi.ModTime()
-		fs := uint64(fi.Size())
-		if currentTime.Sub(mt) > expire {
-			fn := f.fileInfoPath(fi)
-			err := os.Remove(fn)
-			if err == nil {
-				removedSize += fs
-				removedItems++
-				return
-			}
-			log.Errorf("cache %q: cannot remove file %q: %s", f.Name(), fn, err)
-			// Return skipped intentionally.
-		}
-		totalSize += fs
-		totalItems++
+		files[fi.Name()] = fi
 	})
 	if err != nil {
 		log.Errorf("cache %q: %s", f.Name(), err)
 		return
 	}
+	f.index.reconcile(files, startTime)
+	f.removeExpired()
+	f.evict()
 
-	loopsCount := 0
-
-	// Use dedicated random generator instead of global one from math/rand,
-	// since the global generator is slow due to locking.
-	//
-	// Seed the generator with the current time in order to randomize
-	// set of files to be removed below.
-	// nolint:gosec // not security sensitve, only used internally.
-	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
-
-	for totalSize > f.maxSize && loopsCount < 3 {
-		// Remove some files in order to reduce cache size.
-		excessSize := totalSize - f.maxSize
-		p := int32(float64(excessSize) / float64(totalSize) * 100)
-		// Remove +10% over totalSize.
-		p += 10
-		err := walkDir(f.dir, func(fi os.FileInfo) {
-			if rnd.Int31n(100) > p {
-				return
-			}
+	size, items := f.index.stats()
+	log.Debugf("cache %q: finish reconciling index with dir %q; size %d; items %d", f.Name(), f.dir, size, items)
+}
 
-			fs := uint64(fi.Size())
-			fn := f.fileInfoPath(fi)
-			if err := os.Remove(fn); err != nil {
-				log.Errorf("cache %q: cannot remove file %q: %s", f.Name(), fn, err)
-				return
-			}
-			removedSize += fs
-			removedItems++
-			totalSize -= fs
-			totalItems--
-		})
-		if err != nil {
-			log.Errorf("cache %q: %s", f.Name(), err)
+// invalidate removes the files of the entries with key hashes starting
+// with prefix and returns the number of removed files.
+func (f *fileSystemCache) invalidate(prefix string) (int, error) {
+	removed := 0
+	var errs []error
+	err := walkDir(f.dir, func(fi os.FileInfo) {
+		name := fi.Name()
+		if !strings.HasPrefix(name, prefix) {
 			return
 		}
-
-		// This should protect from infinite loop.
-		loopsCount++
+		fn := filepath.Join(f.dir, name)
+		if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("cannot remove file %q: %w", fn, err))
+			return
+		}
+		f.index.remove(name)
+		removed++
+	})
+	if err != nil {
+		errs = append(errs, err)
 	}
+	f.reportIndexEntries()
+	return removed, errors.Join(errs...)
+}
 
-	atomic.StoreUint64(&f.stats.Size, totalSize)
-	atomic.StoreUint64(&f.stats.Items, totalItems)
-
-	log.Debugf("cache %q: final size %d; final items %d; removed size %d; removed items %d",
-		f.Name(), totalSize, totalItems, removedSize, removedItems)
+func (f *fileSystemCache) removeFiles(names []string) {
+	for _, name := range names {
+		fn := filepath.Join(f.dir, name)
+		if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+			log.Errorf("cache %q: cannot remove file %q: %s", f.Name(), fn, err)
+		}
+	}
+}
 
-	log.Debugf("cache %q: finish cleaning dir %q", f.Name(), f.dir)
+func (f *fileSystemCache) reportIndexEntries() {
+	_, items := f.index.stats()
+	IndexEntries.With(prometheus.Labels{"cache": f.Name()}).Set(float64(items))
 }
 
 // writeHeader encodes headers in little endian
@@ -329,11 +512,22 @@ func writeHeader(w io.Writer, s string) error {
 
 // readHeader decodes headers to big endian
 func readHeader(r io.Reader) (string, error) {
+	n, err := readHeaderLength(r)
+	if err != nil {
+		return "", err
+	}
+	return readHeaderValue(r, n)
+}
+
+func readHeaderLength(r io.Reader) (uint32, error) {
 	b := make([]byte, 4)
 	if _, err := io.ReadFull(r, b); err != nil {
-		return "", fmt.Errorf("cannot read header length: %w", err)
+		return 0, fmt.Errorf("cannot read header length: %w", err)
 	}
-	n := uint32(b[3]) | (uint32(b[2]) << 8) | (uint32(b[1]) << 16) | (uint32(b[0]) << 24)
+	return uint32(b[3]) | (uint32(b[2]) << 8) | (uint32(b[1]) << 16) | (uint32(b[0]) << 24), nil
+}
+
+func readHeaderValue(r io.Reader, n uint32) (string, error) {
 	s := make([]byte, n)
 	if _, err := io.ReadFull(r, s); err != nil {
 		return "", fmt.Errorf("cannot read header value with length %d: %w", n, err)
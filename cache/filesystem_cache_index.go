@@ -0,0 +1,159 @@
+package cache
+
+import (
+	"container/list"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// fileIndex tracks the files of the file system cache in LRU order,
+// so `max_size` is enforced without walking the cache dir.
+type fileIndex struct {
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+	size  uint64
+}
+
+type fileEntry struct {
+	name    string
+	size    uint64
+	modTime time.Time
+
+	// lastAccess is the time the file was last put or got.
+	lastAccess time.Time
+}
+
+func newFileIndex() *fileIndex {
+	return &fileIndex{
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// put marks the file with the given name as the most recently used one.
+// The file is added to the index if it isn't indexed yet.
+func (idx *fileIndex) put(name string, size uint64, modTime time.Time) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if e, ok := idx.items[name]; ok {
+		// nolint:forcetypeassert // Only *fileEntry is stored in the list.
+		fe := e.Value.(*fileEntry)
+		idx.size += size - fe.size
+		fe.size = size
+		fe.modTime = modTime
+		fe.lastAccess = time.Now()
+		idx.ll.MoveToFront(e)
+		return
+	}
+
+	idx.items[name] = idx.ll.PushFront(&fileEntry{
+		name:       name,
+		size:       size,
+		modTime:    modTime,
+		lastAccess: time.Now(),
+	})
+	idx.size += size
+}
+
+// remove removes the file with the given name from the index.
+func (idx *fileIndex) remove(name string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if e, ok := idx.items[name]; ok {
+		idx.removeElement(e)
+	}
+}
+
+// evict removes the least recently used files from the index
+// until their total size fits maxSize and returns their names.
+// The most recently used file is never evicted, since it has just been put.
+func (idx *fileIndex) evict(maxSize uint64) []string {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	var names []string
+	for idx.size > maxSize && idx.ll.Len() > 1 {
+		e := idx.ll.Back()
+		names = append(names, idx.removeElement(e).name)
+	}
+	return names
+}
+
+// expire removes the files modified before deadline from the index
+// and returns their names.
+func (idx *fileIndex) expire(deadline time.Time) []string {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	var names []string
+	for e := idx.ll.Front(); e != nil; {
+		next := e.Next()
+		// nolint:forcetypeassert // Only *fileEntry is stored in the list.
+		if fe := e.Value.(*fileEntry); fe.modTime.Before(deadline) {
+			names = append(names, idx.removeElement(e).name)
+		}
+		e = next
+	}
+	return names
+}
+
+// reconcile syncs the index with files found in the cache dir.
+//
+// Indexed files missing in the dir are removed unless they are accessed
+// after since, i.e. they could be put while the dir was read.
+// Files missing in the index are added as the least recently used ones.
+func (idx *fileIndex) reconcile(files map[string]os.FileInfo, since time.Time) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	for e := idx.ll.Front(); e != nil; {
+		next := e.Next()
+		// nolint:forcetypeassert // Only *fileEntry is stored in the list.
+		fe := e.Value.(*fileEntry)
+		if _, ok := files[fe.name]; !ok && fe.lastAccess.Before(since) {
+			idx.removeElement(e)
+		}
+		e = next
+	}
+
+	var missing []os.FileInfo
+	for name, info := range files {
+		if _, ok := idx.items[name]; !ok {
+			missing = append(missing, info)
+		}
+	}
+	// The oldest files are pushed last, so they are evicted first.
+	sort.Slice(missing, func(i, j int) bool {
+		return missing[i].ModTime().After(missing[j].ModTime())
+	})
+	for _, info := range missing {
+		size := uint64(info.Size())
+		idx.items[info.Name()] = idx.ll.PushBack(&fileEntry{
+			name:       info.Name(),
+			size:       size,
+			modTime:    info.ModTime(),
+			lastAccess: info.ModTime(),
+		})
+		idx.size += size
+	}
+}
+
+// stats returns the total size and the number of the indexed files.
+func (idx *fileIndex) stats() (uint64, uint64) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.size, uint64(idx.ll.Len())
+}
+
+func (idx *fileIndex) removeElement(e *list.Element) *fileEntry {
+	// nolint:forcetypeassert // Only *fileEntry is stored in the list.
+	fe := idx.ll.Remove(e).(*fileEntry)
+	delete(idx.items, fe.name)
+	idx.size -= fe.size
+	return fe
+}
@@ -0,0 +1,90 @@
+package cache
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFileIndexEvict(t *testing.T) {
+	idx := newFileIndex()
+	now := time.Now()
+	for _, name := range []string{"a", "b", "c"} {
+		idx.put(name, 10, now)
+	}
+	// Touch the least recently used file, so it isn't evicted.
+	idx.put("a", 10, now)
+
+	names := idx.evict(15)
+	if !reflect.DeepEqual(names, []string{"b", "c"}) {
+		t.Fatalf("unexpected evicted files; expected: %q; got: %q", []string{"b", "c"}, names)
+	}
+	if size, items := idx.stats(); size != 10 || items != 1 {
+		t.Fatalf("unexpected stats; expected: size %d, items %d; got: size %d, items %d", 10, 1, size, items)
+	}
+
+	// The most recently used file is kept even if it exceeds maxSize.
+	idx.put("d", 100, now)
+	if names := idx.evict(50); !reflect.DeepEqual(names, []string{"a"}) {
+		t.Fatalf("unexpected evicted files; expected: %q; got: %q", []string{"a"}, names)
+	}
+	if size, items := idx.stats(); size != 100 || items != 1 {
+		t.Fatalf("unexpected stats; expected: size %d, items %d; got: size %d, items %d", 100, 1, size, items)
+	}
+}
+
+func TestFileIndexExpire(t *testing.T) {
+	idx := newFileIndex()
+	now := time.Now()
+	idx.put("old", 10, now.Add(-time.Hour))
+	idx.put("new", 20, now)
+
+	if names := idx.expire(now.Add(-time.Minute)); !reflect.DeepEqual(names, []string{"old"}) {
+		t.Fatalf("unexpected expired files; expected: %q; got: %q", []string{"old"}, names)
+	}
+	if size, items := idx.stats(); size != 20 || items != 1 {
+		t.Fatalf("unexpected stats; expected: size %d, items %d; got: size %d, items %d", 20, 1, size, items)
+	}
+}
+
+func TestFileIndexReconcile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, size int, mt time.Time) os.FileInfo {
+		t.Helper()
+		fn := dir + "/" + name
+		if err := os.WriteFile(fn, make([]byte, size), 0600); err != nil {
+			t.Fatalf("cannot write %q: %s", fn, err)
+		}
+		if err := os.Chtimes(fn, mt, mt); err != nil {
+			t.Fatalf("cannot change modification time: %s", err)
+		}
+		fi, err := os.Stat(fn)
+		if err != nil {
+			t.Fatalf("cannot stat %q: %s", fn, err)
+		}
+		return fi
+	}
+
+	now := time.Now()
+	idx := newFileIndex()
+	idx.put("indexed", 1, now)
+	idx.put("removed", 2, now)
+	since := time.Now()
+	idx.put("put-while-reading", 4, now)
+
+	files := map[string]os.FileInfo{
+		"indexed": write("indexed", 1, now),
+		"older":   write("older", 8, now.Add(-2*time.Hour)),
+		"newer":   write("newer", 16, now.Add(-time.Hour)),
+	}
+	idx.reconcile(files, since)
+
+	if size, items := idx.stats(); size != 1+4+8+16 || items != 4 {
+		t.Fatalf("unexpected stats; expected: size %d, items %d; got: size %d, items %d", 1+4+8+16, 4, size, items)
+	}
+	// Files found in the dir are evicted first, the oldest one first.
+	if names := idx.evict(5); !reflect.DeepEqual(names, []string{"older", "newer"}) {
+		t.Fatalf("unexpected evicted files; expected: %q; got: %q", []string{"older", "newer"}, names)
+	}
+}
@@ -7,16 +7,21 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/contentsquare/chproxy/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 const testDir = "./test-data"
 
 func TestMain(m *testing.M) {
+	initMetrics(&config.Config{})
 	retCode := m.Run()
 	if err := os.RemoveAll(testDir); err != nil {
 		log.Fatalf("cannot remove %q: %s", testDir, err)
@@ -173,6 +178,304 @@ func cacheMissHelper(t *testing.T, c Cache) {
 	}
 }
 
+func TestFilesystemCacheHeaders(t *testing.T) {
+	c := newTestCache(t)
+	defer c.Close()
+	cacheHeadersHelper(t, c)
+}
+
+// metatest used for both filesystem and redis Cache
+func cacheHeadersHelper(t *testing.T, c Cache) {
+	for i, headers := range []http.Header{
+		nil,
+		{
+			"X-Clickhouse-Summary":  {`{"read_rows":"1","read_bytes":"1"}`},
+			"X-Clickhouse-Query-Id": {"query-id"},
+			"X-Multi":               {"a", "b"},
+			"X-Empty":               {""},
+		},
+	} {
+		key := &Key{
+			Query: []byte(fmt.Sprintf("SELECT %d cache headers", i)),
+		}
+		value := "value"
+		metadata := ContentMetadata{
+			Length:   int64(len(value)),
+			Type:     "text/tab-separated-values",
+			Encoding: "gzip",
+			Headers:  headers,
+		}
+		if _, err := c.Put(strings.NewReader(value), metadata, key); err != nil {
+			t.Fatalf("failed to put it to cache: %s", err)
+		}
+
+		cachedData, err := c.Get(key)
+		if err != nil {
+			t.Fatalf("failed to get data from cache: %s", err)
+		}
+		b, err := io.ReadAll(cachedData.Data)
+		cachedData.Data.Close()
+		if err != nil {
+			t.Fatalf("cannot read cached data: %s", err)
+		}
+		if string(b) != value {
+			t.Fatalf("unexpected value %q; expecting %q", b, value)
+		}
+		if !reflect.DeepEqual(cachedData.ContentMetadata, metadata) {
+			t.Fatalf("unexpected metadata %+v; expecting %+v", cachedData.ContentMetadata, metadata)
+		}
+	}
+}
+
+func TestFilesystemCacheLegacyEntry(t *testing.T) {
+	c := newTestCache(t)
+	defer c.Close()
+
+	// Entries written before headers were cached have no headers marker.
+	key := &Key{Query: []byte("SELECT legacy entry")}
+	bb := &bytes.Buffer{}
+	for _, h := range []string{"text/plain", "gzip", "5"} {
+		if err := writeHeader(bb, h); err != nil {
+			t.Fatalf("cannot write header: %s", err)
+		}
+	}
+	bb.WriteString("value")
+	if err := os.WriteFile(key.filePath(c.dir), bb.Bytes(), 0o600); err != nil {
+		t.Fatalf("cannot write legacy entry: %s", err)
+	}
+
+	cachedData, err := c.Get(key)
+	if err != nil {
+		t.Fatalf("failed to get data from cache: %s", err)
+	}
+	defer cachedData.Data.Close()
+	expected := ContentMetadata{Length: 5, Type: "text/plain", Encoding: "gzip"}
+	if !reflect.DeepEqual(cachedData.ContentMetadata, expected) {
+		t.Fatalf("unexpected metadata %+v; expecting %+v", cachedData.ContentMetadata, expected)
+	}
+	b, err := io.ReadAll(cachedData.Data)
+	if err != nil {
+		t.Fatalf("cannot read cached data: %s", err)
+	}
+	if string(b) != "value" {
+		t.Fatalf("unexpected value %q; expecting %q", b, "value")
+	}
+
+	// Entries without headers are written in the legacy format.
+	if _, err := c.Put(strings.NewReader("value"), expected, key); err != nil {
+		t.Fatalf("failed to put it to cache: %s", err)
+	}
+	b, err = os.ReadFile(key.filePath(c.dir))
+	if err != nil {
+		t.Fatalf("cannot read cache file: %s", err)
+	}
+	if !bytes.Equal(b, bb.Bytes()) {
+		t.Fatalf("unexpected cache file %q; expecting %q", b, bb.Bytes())
+	}
+}
+
+func TestFilesystemCacheCompress(t *testing.T) {
+	cfg := config.Cache{
+		Name: "compressed",
+		FileSystem: config.FileSystemCacheConfig{
+			Dir:      t.TempDir(),
+			MaxSize:  1e8,
+			Compress: "zstd",
+		},
+		Expire: config.Duration(time.Minute),
+	}
+	c, err := newFilesSystemCache(cfg, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	cacheAddGetHelper(t, c)
+	cacheHeadersHelper(t, c)
+
+	// The 4MB entry put by cacheAddGetHelper is stored compressed.
+	key := &Key{Query: []byte("SELECT 0")}
+	fi, err := os.Stat(key.filePath(c.dir))
+	if err != nil {
+		t.Fatalf("cannot stat cache file: %s", err)
+	}
+	if fi.Size() > 1024*1024 {
+		t.Fatalf("unexpected cache file size %d; expecting compressed data", fi.Size())
+	}
+
+	// Entries remain readable once `compress` is changed.
+	cfg.FileSystem.Compress = ""
+	uc, err := newFilesSystemCache(cfg, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	uncompressedKey := &Key{Query: []byte("SELECT uncompressed")}
+	metadata := ContentMetadata{Length: 5, Type: "text/plain", Encoding: "gzip"}
+	if _, err := uc.Put(strings.NewReader("value"), metadata, uncompressedKey); err != nil {
+		t.Fatalf("failed to put it to cache: %s", err)
+	}
+	for _, tc := range []struct {
+		c     *fileSystemCache
+		key   *Key
+		value string
+	}{
+		{c: uc, key: &Key{Query: []byte("SELECT 1")}, value: "value 1"},
+		{c: c, key: uncompressedKey, value: "value"},
+	} {
+		cachedData, err := tc.c.Get(tc.key)
+		if err != nil {
+			t.Fatalf("failed to get data from cache: %s", err)
+		}
+		b, err := io.ReadAll(cachedData.Data)
+		cachedData.Data.Close()
+		if err != nil {
+			t.Fatalf("cannot read cached data: %s", err)
+		}
+		if string(b) != tc.value {
+			t.Fatalf("unexpected value %q; expecting %q", b, tc.value)
+		}
+	}
+
+	// Unknown compression versions aren't decoded as legacy entries.
+	fp := key.filePath(c.dir)
+	b, err := os.ReadFile(fp)
+	if err != nil {
+		t.Fatalf("cannot read cache file: %s", err)
+	}
+	b[4] = 42
+	if err := os.WriteFile(fp, b, 0o600); err != nil {
+		t.Fatalf("cannot write cache file: %s", err)
+	}
+	if _, err := c.Get(key); err == nil || !strings.Contains(err.Error(), "unsupported compression version 42") {
+		t.Fatalf("unexpected error %v; expecting unsupported compression version", err)
+	}
+}
+
+func TestFilesystemCacheStale(t *testing.T) {
+	cfg := config.Cache{
+		Name: "foobar",
+		FileSystem: config.FileSystemCacheConfig{
+			Dir:     testDir,
+			MaxSize: 1e6,
+		},
+		Expire:               config.Duration(time.Minute),
+		StaleWhileRevalidate: config.Duration(time.Minute),
+	}
+	c, err := newFilesSystemCache(cfg, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	key := &Key{Query: []byte("SELECT stale")}
+	if _, err := c.Put(strings.NewReader("an object"), ContentMetadata{Length: 9}, key); err != nil {
+		t.Fatalf("failed to put it to cache: %s", err)
+	}
+	cachedData, err := c.Get(key)
+	if err != nil {
+		t.Fatalf("failed to get data from cache: %s", err)
+	}
+	cachedData.Data.Close()
+	if cachedData.Stale {
+		t.Fatalf("unexpected stale entry with ttl %s", cachedData.Ttl)
+	}
+
+	age := func(d time.Duration) {
+		mt := time.Now().Add(-d)
+		if err := os.Chtimes(key.filePath(testDir), mt, mt); err != nil {
+			t.Fatalf("cannot change modification time: %s", err)
+		}
+	}
+
+	age(90 * time.Second)
+	cachedData, err = c.Get(key)
+	if err != nil {
+		t.Fatalf("failed to get stale data from cache: %s", err)
+	}
+	cachedData.Data.Close()
+	if !cachedData.Stale {
+		t.Fatalf("expecting stale entry; got ttl %s", cachedData.Ttl)
+	}
+
+	age(3 * time.Minute)
+	if _, err = c.Get(key); err != ErrMissing {
+		t.Fatalf("unexpected error: %v; expecting %s", err, ErrMissing)
+	}
+}
+
+func TestFilesystemCacheKeyPrefix(t *testing.T) {
+	newCache := func(keyPrefix string) *fileSystemCache {
+		cfg := config.Cache{
+			Name: "foobar",
+			FileSystem: config.FileSystemCacheConfig{
+				Dir:     testDir,
+				MaxSize: 1e6,
+			},
+			Expire:    config.Duration(time.Minute),
+			KeyPrefix: keyPrefix,
+		}
+		c, err := newFilesSystemCache(cfg, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	dev, prod := newCache("dev"), newCache("prod")
+	defer dev.Close()
+	defer prod.Close()
+
+	key := &Key{Query: []byte("SELECT key prefix")}
+	if _, err := dev.Put(strings.NewReader("an object"), ContentMetadata{Length: 9}, key); err != nil {
+		t.Fatalf("failed to put it to cache: %s", err)
+	}
+	if _, err := os.Stat(key.filePath(filepath.Join(testDir, "dev"))); err != nil {
+		t.Fatalf("expecting the entry in the prefix subdirectory: %s", err)
+	}
+	cachedData, err := dev.Get(key)
+	if err != nil {
+		t.Fatalf("failed to get data from cache: %s", err)
+	}
+	cachedData.Data.Close()
+	if _, err := prod.Get(key); err != ErrMissing {
+		t.Fatalf("unexpected error: %v; expecting %s", err, ErrMissing)
+	}
+}
+
+func TestFilesystemCacheExpireJitter(t *testing.T) {
+	cfg := config.Cache{
+		Name: "foobar",
+		FileSystem: config.FileSystemCacheConfig{
+			Dir:     testDir,
+			MaxSize: 1e6,
+		},
+		Expire:       config.Duration(time.Minute),
+		ExpireJitter: config.Duration(time.Minute),
+	}
+	c, err := newFilesSystemCache(cfg, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	key := &Key{Query: []byte("SELECT jitter")}
+	ttl, err := c.Put(strings.NewReader("an object"), ContentMetadata{Length: 9}, key)
+	if err != nil {
+		t.Fatalf("failed to put it to cache: %s", err)
+	}
+	if ttl < time.Minute || ttl >= 2*time.Minute {
+		t.Fatalf("unexpected ttl %s; expecting it in range [%s, %s)", ttl, time.Minute, 2*time.Minute)
+	}
+
+	cachedData, err := c.Get(key)
+	if err != nil {
+		t.Fatalf("failed to get data from cache: %s", err)
+	}
+	cachedData.Data.Close()
+	if cachedData.Ttl > ttl || cachedData.Ttl < ttl-time.Second {
+		t.Fatalf("unexpected ttl %s; expecting %s", cachedData.Ttl, ttl)
+	}
+}
+
 func TestCacheClean(t *testing.T) {
 	cfg := config.Cache{
 		Name: "foobar",
@@ -215,10 +518,8 @@ func TestCacheClean(t *testing.T) {
 		}
 	}
 
-	// Forcibly clean the cache
-	c.clean()
-
 	// Make sure the total cache size doesnt exceed MaxSize
+	// without waiting for the janitor
 	stats := c.Stats()
 	if stats.Size <= 0 {
 		t.Fatalf("cache size must be greater than 0; got %d", stats.Size)
@@ -235,6 +536,228 @@ func TestCacheClean(t *testing.T) {
 	}
 }
 
+func TestFilesystemCacheEvictLRU(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Cache{
+		Name: "lru",
+		FileSystem: config.FileSystemCacheConfig{
+			Dir: dir,
+			// Fits 3 entries of 115 bytes including headers.
+			MaxSize: 350,
+		},
+		Expire: config.Duration(time.Minute),
+	}
+	c, err := newFilesSystemCache(cfg, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	evictions := prometheus.Labels{"cache": cfg.Name}
+	evictionsBefore := testutil.ToFloat64(Evictions.With(evictions))
+
+	keys := make([]*Key, 4)
+	put := func(i int) {
+		t.Helper()
+		keys[i] = &Key{Query: []byte(fmt.Sprintf("SELECT %d lru", i))}
+		if _, err := c.Put(strings.NewReader(strings.Repeat("a", 100)), ContentMetadata{Length: 100}, keys[i]); err != nil {
+			t.Fatalf("failed to put it to cache: %s", err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		put(i)
+	}
+
+	// Get the least recently used entry, so it isn't evicted.
+	cachedData, err := c.Get(keys[0])
+	if err != nil {
+		t.Fatalf("failed to get data from cache: %s", err)
+	}
+	cachedData.Data.Close()
+
+	// Put evicts the least recently used entry at once.
+	put(3)
+	if _, err := os.Stat(keys[1].filePath(dir)); !os.IsNotExist(err) {
+		t.Fatalf("expected the least recently used entry to be removed; got: %v", err)
+	}
+	for _, i := range []int{0, 2, 3} {
+		if _, err := os.Stat(keys[i].filePath(dir)); err != nil {
+			t.Fatalf("expected entry %d to be kept; got: %s", i, err)
+		}
+	}
+	if stats := c.Stats(); stats.Items != 3 || stats.Size > c.maxSize {
+		t.Fatalf("unexpected stats: %+v; expecting 3 items within %d bytes", stats, c.maxSize)
+	}
+	if n := testutil.ToFloat64(Evictions.With(evictions)) - evictionsBefore; n != 1 {
+		t.Fatalf("unexpected number of evictions; expected: %d; got: %v", 1, n)
+	}
+	if _, err := c.Get(keys[1]); err != ErrMissing {
+		t.Fatalf("unexpected error: %v; expecting %s", err, ErrMissing)
+	}
+}
+
+func TestFilesystemCacheReconcile(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Cache{
+		Name: "reconcile",
+		FileSystem: config.FileSystemCacheConfig{
+			Dir:     dir,
+			MaxSize: 1e6,
+		},
+		Expire: config.Duration(time.Minute),
+	}
+	c, err := newFilesSystemCache(cfg, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	key := &Key{Query: []byte("SELECT reconcile")}
+	if _, err := c.Put(strings.NewReader("an object"), ContentMetadata{Length: 9}, key); err != nil {
+		t.Fatalf("failed to put it to cache: %s", err)
+	}
+
+	// Files may be put by another cache instance sharing the dir.
+	external := &Key{Query: []byte("SELECT external")}
+	if err := os.WriteFile(external.filePath(dir), make([]byte, 100), 0600); err != nil {
+		t.Fatalf("cannot write file: %s", err)
+	}
+	if err := os.Remove(key.filePath(dir)); err != nil {
+		t.Fatalf("cannot remove file: %s", err)
+	}
+
+	c.reconcile()
+	if stats := c.Stats(); stats.Items != 1 || stats.Size != 100 {
+		t.Fatalf("unexpected stats: %+v; expecting a single item of 100 bytes", stats)
+	}
+}
+
+func TestFilesystemCacheCleanup(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Cache{
+		Name: "cleanup",
+		FileSystem: config.FileSystemCacheConfig{
+			Dir:             dir,
+			MaxSize:         1e6,
+			CleanupScanRate: 10,
+		},
+		Expire: config.Duration(time.Minute),
+	}
+	c, err := newFilesSystemCache(cfg, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	removed := prometheus.Labels{"cache": cfg.Name}
+	removedBefore := testutil.ToFloat64(CleanupFilesRemoved.With(removed))
+
+	fresh := &Key{Query: []byte("SELECT fresh")}
+	if _, err := c.Put(strings.NewReader("an object"), ContentMetadata{Length: 9}, fresh); err != nil {
+		t.Fatalf("failed to put it to cache: %s", err)
+	}
+	expired := &Key{Query: []byte("SELECT expired")}
+	if _, err := c.Put(strings.NewReader("an object"), ContentMetadata{Length: 9}, expired); err != nil {
+		t.Fatalf("failed to put it to cache: %s", err)
+	}
+	// Expired files missing in the index are removed as well.
+	external := &Key{Query: []byte("SELECT external")}
+	if err := os.WriteFile(external.filePath(dir), make([]byte, 100), 0600); err != nil {
+		t.Fatalf("cannot write file: %s", err)
+	}
+	mt := time.Now().Add(-time.Hour)
+	for _, key := range []*Key{expired, external} {
+		if err := os.Chtimes(key.filePath(dir), mt, mt); err != nil {
+			t.Fatalf("cannot change modification time: %s", err)
+		}
+	}
+
+	c.cleanup()
+	for _, key := range []*Key{expired, external} {
+		if _, err := os.Stat(key.filePath(dir)); !os.IsNotExist(err) {
+			t.Fatalf("expected expired file %q to be removed; got: %v", key, err)
+		}
+	}
+	if _, err := os.Stat(fresh.filePath(dir)); err != nil {
+		t.Fatalf("expected fresh file to be kept; got: %s", err)
+	}
+	if stats := c.Stats(); stats.Items != 1 {
+		t.Fatalf("unexpected stats: %+v; expecting a single item", stats)
+	}
+	if n := testutil.ToFloat64(CleanupFilesRemoved.With(removed)) - removedBefore; n != 2 {
+		t.Fatalf("unexpected number of removed files; expected: %d; got: %v", 2, n)
+	}
+}
+
+func TestFilesystemCacheCleanupStop(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 10; i++ {
+		key := &Key{Query: []byte(fmt.Sprintf("SELECT %d existing", i))}
+		if err := os.WriteFile(key.filePath(dir), make([]byte, 100), 0600); err != nil {
+			t.Fatalf("cannot write file: %s", err)
+		}
+	}
+	cfg := config.Cache{
+		Name: "cleanup_stop",
+		FileSystem: config.FileSystemCacheConfig{
+			Dir:             dir,
+			MaxSize:         1e6,
+			CleanupScanRate: 1,
+		},
+		Expire: config.Duration(time.Minute),
+	}
+	c, err := newFilesSystemCache(cfg, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The scan of 10 files at 1 file per second is interrupted on close.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		c.Close()
+	}()
+	start := time.Now()
+	c.cleanup()
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("cleanup wasn't interrupted; took %s", d)
+	}
+}
+
+// BenchmarkFilesystemCachePut measures Put into a cache dir with many files.
+// Put mustn't depend on the number of files, since it doesn't walk the dir.
+func BenchmarkFilesystemCachePut(b *testing.B) {
+	dir := b.TempDir()
+	for i := 0; i < 10000; i++ {
+		key := &Key{Query: []byte(fmt.Sprintf("SELECT %d existing", i))}
+		if err := os.WriteFile(key.filePath(dir), make([]byte, 100), 0600); err != nil {
+			b.Fatalf("cannot write file: %s", err)
+		}
+	}
+	cfg := config.Cache{
+		Name: "bench",
+		FileSystem: config.FileSystemCacheConfig{
+			Dir:     dir,
+			MaxSize: 1e6,
+		},
+		Expire: config.Duration(time.Minute),
+	}
+	c, err := newFilesSystemCache(cfg, time.Second)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+	c.reconcile()
+
+	value := strings.Repeat("a", 100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := &Key{Query: []byte(fmt.Sprintf("SELECT %d", i))}
+		if _, err := c.Put(strings.NewReader(value), ContentMetadata{Length: int64(len(value))}, key); err != nil {
+			b.Fatalf("failed to put it to cache: %s", err)
+		}
+	}
+}
+
 type testResponseWriter struct {
 	h http.Header
 	b []byte
@@ -264,8 +787,10 @@ func newTestCache(t *testing.T) *fileSystemCache {
 	cfg := config.Cache{
 		Name: "foobar",
 		FileSystem: config.FileSystemCacheConfig{
-			Dir:     testDir,
-			MaxSize: 1e6,
+			Dir: testDir,
+			// The cache must fit all the test entries, otherwise
+			// the cleaner may evict them in the middle of a test.
+			MaxSize: 1e8,
 		},
 		Expire: config.Duration(time.Minute),
 	}
@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/contentsquare/chproxy/log"
+)
+
+// InvalidationsChannel is the redis channel chproxy instances publish
+// invalidated key prefixes to. It is prefixed with `key_prefix` of the cache.
+const InvalidationsChannel = "chproxy:cache:invalidations"
+
+// publishInvalidationTimeout limits the time spent on notifying
+// other chproxy instances about the invalidation.
+const publishInvalidationTimeout = time.Second
+
+// ErrInvalidPrefix is returned by Invalidate for prefixes which cannot
+// match key hashes.
+var ErrInvalidPrefix = errors.New("prefix must consist of 1 to 32 lowercase hex digits")
+
+var keyHashPrefixRegexp = regexp.MustCompile(`^[0-9a-f]{1,32}$`)
+
+// invalidator is implemented by caches able to remove entries
+// by the prefix of their key hashes.
+type invalidator interface {
+	invalidate(prefix string) (int, error)
+}
+
+// invalidationPublisher is implemented by caches shared between
+// chproxy instances, which notify each other about invalidations.
+type invalidationPublisher interface {
+	invalidationsChannel() string
+	PublishInvalidation(ctx context.Context, channel, prefix string) error
+	SubscribeInvalidations(ctx context.Context, channel string, handler func(prefix string)) error
+}
+
+// Invalidate removes the entries with key hashes starting with prefix
+// and returns the number of removed entries.
+//
+// Invalidations of layered caches are published to the other chproxy
+// instances sharing l2, so they remove the entries from their l1 as well.
+func (c *AsyncCache) Invalidate(prefix string) (int, error) {
+	if !keyHashPrefixRegexp.MatchString(prefix) {
+		return 0, ErrInvalidPrefix
+	}
+	inv, ok := c.Cache.(invalidator)
+	if !ok {
+		return 0, fmt.Errorf("cache %q doesn't support invalidation", c.Name())
+	}
+	removed, err := inv.invalidate(prefix)
+	if c.invalidationPublisher == nil {
+		return removed, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), publishInvalidationTimeout)
+	defer cancel()
+	if perr := c.invalidationPublisher.PublishInvalidation(ctx, c.invalidationsChannel, prefix); perr != nil {
+		err = errors.Join(err, fmt.Errorf("cannot publish invalidation: %w", perr))
+	}
+	return removed, err
+}
+
+// subscribeInvalidations removes l1 entries invalidated via other chproxy
+// instances sharing l2. It does nothing unless l2 is a redis cache.
+//
+// The instance receives its own invalidations as well,
+// which is harmless, since the entries are already removed.
+func (c *AsyncCache) subscribeInvalidations(l1, l2 Cache) error {
+	pub, ok := l2.(invalidationPublisher)
+	if !ok {
+		return nil
+	}
+	inv, ok := l1.(invalidator)
+	if !ok {
+		return nil
+	}
+
+	name := c.Name()
+	channel := pub.invalidationsChannel()
+	ctx, cancel := context.WithCancel(context.Background())
+	err := pub.SubscribeInvalidations(ctx, channel, func(prefix string) {
+		if !keyHashPrefixRegexp.MatchString(prefix) {
+			log.Errorf("cache %q: ignoring invalidation of invalid prefix %q", name, prefix)
+			return
+		}
+		n, err := inv.invalidate(prefix)
+		if err != nil {
+			log.Errorf("cache %q: cannot invalidate prefix %q: %s", name, prefix, err)
+		}
+		log.Debugf("cache %q: removed %d entries of invalidated prefix %q", name, n, prefix)
+	})
+	if err != nil {
+		cancel()
+		return err
+	}
+	c.invalidationPublisher = pub
+	c.invalidationsChannel = channel
+	c.stopInvalidations = cancel
+	return nil
+}
@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/contentsquare/chproxy/config"
+)
+
+func newTestLayeredAsyncCache(t *testing.T, s *miniredis.Miniredis, dir string) *AsyncCache {
+	t.Helper()
+
+	l1, err := NewAsyncCache(config.Cache{
+		Name: dir,
+		Mode: "file_system",
+		FileSystem: config.FileSystemCacheConfig{
+			Dir:     testDir + "/" + dir,
+			MaxSize: 1e8,
+		},
+		Expire: config.Duration(time.Minute),
+	}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l2, err := NewAsyncCache(config.Cache{
+		Name: "redis",
+		Mode: "redis",
+		Redis: config.RedisCacheConfig{
+			Addresses: []string{s.Addr()},
+		},
+		Expire: config.Duration(time.Minute),
+	}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewLayeredAsyncCache(config.Cache{Name: "layered", Mode: "layered"}, l1, l2, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		l1.Close()
+		l2.Close()
+	})
+	return c
+}
+
+func TestAsyncCache_InvalidateAcrossInstances(t *testing.T) {
+	s := miniredis.RunT(t)
+	c1 := newTestLayeredAsyncCache(t, s, "invalidate1")
+	c2 := newTestLayeredAsyncCache(t, s, "invalidate2")
+
+	invalidated := &Key{Query: []byte("SELECT invalidated")}
+	kept := &Key{Query: []byte("SELECT kept")}
+	prefix := invalidated.String()[:4]
+	if strings.HasPrefix(kept.String(), prefix) {
+		t.Fatalf("the keys must have distinct prefixes")
+	}
+	for _, key := range []*Key{invalidated, kept} {
+		value := key.String()
+		if _, err := c1.Put(strings.NewReader(value), ContentMetadata{Length: int64(len(value))}, key); err != nil {
+			t.Fatalf("failed to put it to cache: %s", err)
+		}
+		// Promote the entry to l1 of the second instance.
+		if got := readCachedValue(t, c2, key); got != value {
+			t.Fatalf("unexpected value: %q; expecting %q", got, value)
+		}
+	}
+	l1 := c2.Levels()[0]
+	readCachedValue(t, l1, invalidated)
+
+	n, err := c1.Invalidate(prefix)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// The entry is removed from l1 of the first instance and from l2.
+	if n != 2 {
+		t.Fatalf("unexpected number of removed entries: %d; expecting 2", n)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, err := l1.Get(invalidated)
+		if err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the entry must be removed from l1 of the other instance")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, c := range []*AsyncCache{c1, c2} {
+		if _, err := c.Get(invalidated); err == nil {
+			t.Fatalf("the invalidated entry must be missing in %q", c.Name())
+		}
+		if got := readCachedValue(t, c, kept); got != kept.String() {
+			t.Fatalf("unexpected value: %q; expecting %q", got, kept.String())
+		}
+	}
+}
+
+func TestAsyncCache_InvalidateInvalidPrefix(t *testing.T) {
+	s := miniredis.RunT(t)
+	c := newTestLayeredAsyncCache(t, s, "invalidate3")
+	for _, prefix := range []string{"", "chproxy", "ABC", strings.Repeat("a", 33)} {
+		if _, err := c.Invalidate(prefix); !errors.Is(err, ErrInvalidPrefix) {
+			t.Fatalf("unexpected error for prefix %q: %v", prefix, err)
+		}
+	}
+}
@@ -10,7 +10,7 @@ import (
 
 // Version must be increased with each backward-incompatible change
 // in the cache storage.
-const Version = 5
+const Version = 6
 
 // Key is the key for use in the cache.
 type Key struct {
@@ -47,6 +47,9 @@ type Key struct {
 	// UserParamsHash must contain hashed value of users params
 	UserParamsHash uint32
 
+	// ForcedParamsHash must contain hashed value of users forced params
+	ForcedParamsHash uint32
+
 	// Version represents data encoding version number
 	Version int
 
@@ -58,7 +61,7 @@ type Key struct {
 }
 
 // NewKey construct cache key from provided parameters with default version number
-func NewKey(query []byte, originParams url.Values, acceptEncoding string, userParamsHash uint32, queryParamsHash uint32, userCredentialHash uint32) *Key {
+func NewKey(query []byte, originParams url.Values, acceptEncoding string, userParamsHash uint32, forcedParamsHash uint32, queryParamsHash uint32, userCredentialHash uint32) *Key {
 	return &Key{
 		Query:                 query,
 		AcceptEncoding:        acceptEncoding,
@@ -71,6 +74,7 @@ func NewKey(query []byte, originParams url.Values, acceptEncoding string, userPa
 		MaxResultRows:         originParams.Get("max_result_rows"),
 		ResultOverflowMode:    originParams.Get("result_overflow_mode"),
 		UserParamsHash:        userParamsHash,
+		ForcedParamsHash:      forcedParamsHash,
 		Version:               Version,
 		QueryParamsHash:       queryParamsHash,
 		UserCredentialHash:    userCredentialHash,
@@ -86,6 +90,10 @@ func (k *Key) String() string {
 	s := fmt.Sprintf("V%d; Query=%q; AcceptEncoding=%q; DefaultFormat=%q; Database=%q; Compress=%q; EnableHTTPCompression=%q; Namespace=%q; MaxResultRows=%q; Extremes=%q; ResultOverflowMode=%q; UserParams=%d; QueryParams=%d; UserCredentialHash=%d",
 		k.Version, k.Query, k.AcceptEncoding, k.DefaultFormat, k.Database, k.Compress, k.EnableHTTPCompression, k.Namespace,
 		k.MaxResultRows, k.Extremes, k.ResultOverflowMode, k.UserParamsHash, k.QueryParamsHash, k.UserCredentialHash)
+	if k.ForcedParamsHash != 0 {
+		// Appended only if set, so keys of users without forced params are kept.
+		s += fmt.Sprintf("; ForcedParams=%d", k.ForcedParamsHash)
+	}
 	h := sha256.Sum256([]byte(s))
 
 	// The first 16 bytes of the hash should be enough
@@ -92,6 +92,16 @@ func TestKeyString(t *testing.T) {
 			},
 			expected: "c5b58ecb4ff026e62ee846dc63c749d5",
 		},
+		{
+			key: &Key{
+				Query:              []byte("SELECT * FROM {table_name:Identifier} LIMIT 10"),
+				QueryParamsHash:    3825710,
+				ForcedParamsHash:   1734531,
+				Version:            3,
+				UserCredentialHash: 234324,
+			},
+			expected: "5071298b006768ac0828d19d8bf95aeb",
+		},
 	}
 
 	for _, tc := range testCases {
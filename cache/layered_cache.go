@@ -0,0 +1,142 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/contentsquare/chproxy/log"
+)
+
+// layeredCache looks up entries in the l1 cache first and then in the l2 cache.
+//
+// It is meant to be used with a fast local l1 cache, e.g. a file system cache,
+// and a l2 cache shared between chproxy instances, e.g. a redis cache.
+// The levels are owned by their own AsyncCache, so they aren't closed by layeredCache.
+type layeredCache struct {
+	name string
+	l1   Cache
+	l2   Cache
+}
+
+func newLayeredCache(name string, l1, l2 Cache) *layeredCache {
+	return &layeredCache{
+		name: name,
+		l1:   l1,
+		l2:   l2,
+	}
+}
+
+func (c *layeredCache) Name() string {
+	return c.name
+}
+
+func (c *layeredCache) Close() error {
+	return nil
+}
+
+// Stats returns the sum of the stats of both levels.
+func (c *layeredCache) Stats() Stats {
+	s1 := c.l1.Stats()
+	s2 := c.l2.Stats()
+	return Stats{
+		Size:  s1.Size + s2.Size,
+		Items: s1.Items + s2.Items,
+	}
+}
+
+// Get returns the entry from l1 if it is there.
+// Otherwise the entry is taken from l2 and promoted to l1.
+func (c *layeredCache) Get(key *Key) (*CachedData, error) {
+	if value, err := c.l1.Get(key); err == nil {
+		return value, nil
+	}
+	value, err := c.l2.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if value.Stale {
+		// Stale entries are refreshed via the layered cache,
+		// so there is no need to promote them.
+		return value, nil
+	}
+	return c.promote(key, value)
+}
+
+// promote puts the value taken from l2 into l1 and returns the value from l1.
+// The value is fetched from l2 again if it cannot be promoted.
+func (c *layeredCache) promote(key *Key, value *CachedData) (*CachedData, error) {
+	_, err := c.l1.Put(value.Data, value.ContentMetadata, key)
+	value.Data.Close()
+	if err != nil {
+		log.Errorf("cache %q: cannot promote key %s to %q: %s", c.name, key, c.l1.Name(), err)
+		return c.l2.Get(key)
+	}
+	if v, err := c.l1.Get(key); err == nil {
+		return v, nil
+	}
+	return c.l2.Get(key)
+}
+
+// Put puts the entry into l2 first, since it is shared, and then into l1.
+// The entry is put into l1 even if it cannot be put into l2.
+func (c *layeredCache) Put(r io.Reader, contentMetadata ContentMetadata, key *Key) (time.Duration, error) {
+	rs, ok := r.(io.ReadSeeker)
+	if !ok {
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return 0, fmt.Errorf("cache %q: cannot read entry: %w", c.name, err)
+		}
+		rs = bytes.NewReader(b)
+	}
+	offset, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, fmt.Errorf("cache %q: cannot get entry offset: %w", c.name, err)
+	}
+
+	expiration2, err2 := c.l2.Put(rs, contentMetadata, key)
+	if err2 != nil {
+		log.Errorf("cache %q: cannot put key %s to %q: %s", c.name, key, c.l2.Name(), err2)
+	}
+
+	if _, err := rs.Seek(offset, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("cache %q: cannot reset entry offset: %w", c.name, err)
+	}
+	expiration1, err1 := c.l1.Put(rs, contentMetadata, key)
+	switch {
+	case err1 != nil && err2 != nil:
+		return 0, fmt.Errorf("cache %q: cannot put entry to any level: %w", c.name, err1)
+	case err1 != nil:
+		log.Errorf("cache %q: cannot put key %s to %q: %s", c.name, key, c.l1.Name(), err1)
+		return expiration2, nil
+	case err2 != nil:
+		return expiration1, nil
+	}
+	if expiration2 < expiration1 {
+		return expiration2, nil
+	}
+	return expiration1, nil
+}
+
+// invalidate removes the entries with key hashes starting with prefix
+// from both levels and returns the number of removed entries.
+//
+// l2 is invalidated first, so the entries cannot be promoted to l1 again.
+func (c *layeredCache) invalidate(prefix string) (int, error) {
+	var errs []error
+	removed := 0
+	for _, level := range []Cache{c.l2, c.l1} {
+		inv, ok := level.(invalidator)
+		if !ok {
+			continue
+		}
+		n, err := inv.invalidate(prefix)
+		removed += n
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cache %q: %w", level.Name(), err))
+		}
+	}
+	return removed, errors.Join(errs...)
+}
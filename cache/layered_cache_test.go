@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/contentsquare/chproxy/config"
+)
+
+func newTestLayeredCache(t *testing.T) *layeredCache {
+	t.Helper()
+
+	cfg := config.Cache{
+		Name: "l1",
+		FileSystem: config.FileSystemCacheConfig{
+			Dir:     testDir + "/layered",
+			MaxSize: 1e8,
+		},
+		Expire: config.Duration(time.Minute),
+	}
+	l1, err := newFilesSystemCache(cfg, 1*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l1.Close() })
+
+	return newLayeredCache("layered", l1, getRedisCache(t))
+}
+
+func TestLayeredCacheAddGet(t *testing.T) {
+	c := newTestLayeredCache(t)
+	cacheAddGetHelper(t, c)
+}
+
+func TestLayeredCacheMiss(t *testing.T) {
+	c := newTestLayeredCache(t)
+	cacheMissHelper(t, c)
+}
+
+func TestLayeredCachePutBothLevels(t *testing.T) {
+	c := newTestLayeredCache(t)
+	key := &Key{Query: []byte("SELECT put")}
+	value := "both levels"
+
+	// Use a reader which cannot seek, so the entry must be buffered.
+	r := io.MultiReader(strings.NewReader(value))
+	expiration, err := c.Put(r, ContentMetadata{Length: int64(len(value))}, key)
+	if err != nil {
+		t.Fatalf("failed to put it to cache: %s", err)
+	}
+	if expiration != cacheTTL {
+		t.Fatalf("unexpected expiration: %s; expecting the shortest one: %s", expiration, cacheTTL)
+	}
+
+	for _, level := range []Cache{c.l1, c.l2} {
+		if got := readCachedValue(t, level, key); got != value {
+			t.Fatalf("unexpected value in %q: %q; expecting %q", level.Name(), got, value)
+		}
+	}
+}
+
+func TestLayeredCachePromote(t *testing.T) {
+	c := newTestLayeredCache(t)
+	key := &Key{Query: []byte("SELECT promote")}
+	value := "promoted value"
+
+	if _, err := c.l2.Put(strings.NewReader(value), ContentMetadata{Length: int64(len(value))}, key); err != nil {
+		t.Fatalf("failed to put it to l2: %s", err)
+	}
+	if _, err := c.l1.Get(key); err != ErrMissing {
+		t.Fatalf("expecting ErrMissing from l1; got %v", err)
+	}
+
+	if got := readCachedValue(t, c, key); got != value {
+		t.Fatalf("unexpected value: %q; expecting %q", got, value)
+	}
+	if got := readCachedValue(t, c.l1, key); got != value {
+		t.Fatalf("unexpected value promoted to l1: %q; expecting %q", got, value)
+	}
+}
+
+func readCachedValue(t *testing.T, c Cache, key *Key) string {
+	t.Helper()
+
+	cachedData, err := c.Get(key)
+	if err != nil {
+		t.Fatalf("failed to get data from %q: %s", c.Name(), err)
+	}
+	defer cachedData.Data.Close()
+
+	b, err := io.ReadAll(cachedData.Data)
+	if err != nil {
+		t.Fatalf("failed to read data from %q: %s", c.Name(), err)
+	}
+	return string(b)
+}
@@ -0,0 +1,275 @@
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/contentsquare/chproxy/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// memoryCacheShards is the maximum number of shards of the memory cache.
+	memoryCacheShards = 16
+
+	// memoryCacheMinShardSize is the minimum size of shards,
+	// so responses of small caches aren't limited by too small shards.
+	memoryCacheMinShardSize = 4 << 20
+)
+
+// memoryCache keeps cached responses in memory.
+//
+// Responses are spread among shards by their keys, so lookups of distinct
+// keys don't compete for the same lock. Every shard evicts the least
+// recently used responses once it exceeds its share of max_size or max_items.
+type memoryCache struct {
+	name string
+
+	expire time.Duration
+	grace  time.Duration
+	stale  time.Duration
+	jitter time.Duration
+
+	shards []*memoryCacheShard
+}
+
+type memoryCacheShard struct {
+	mu sync.Mutex
+
+	maxSize  uint64
+	maxItems int
+
+	size uint64
+	// lru contains *memoryCacheEntry, the most recently used first.
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type memoryCacheEntry struct {
+	key      string
+	metadata ContentMetadata
+	data     []byte
+	// expireAt includes the jitter of the entry.
+	expireAt time.Time
+}
+
+// size returns the approximate memory occupied by the entry.
+func (e *memoryCacheEntry) size() uint64 {
+	n := len(e.key) + len(e.data) + len(e.metadata.Type) + len(e.metadata.Encoding)
+	for name, values := range e.metadata.Headers {
+		for _, v := range values {
+			n += len(name) + len(v)
+		}
+	}
+	return uint64(n)
+}
+
+func newMemoryCache(cfg config.Cache, graceTime time.Duration) (*memoryCache, error) {
+	if err := checkMemoryCacheConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	maxSize := uint64(cfg.Memory.MaxSize)
+	n := memoryCacheShards
+	for n > 1 && maxSize/uint64(n) < memoryCacheMinShardSize {
+		n /= 2
+	}
+	maxItems := cfg.Memory.MaxItems
+	if maxItems > 0 && maxItems < n {
+		n = maxItems
+	}
+
+	c := &memoryCache{
+		name:   cfg.Name,
+		expire: time.Duration(cfg.Expire),
+		grace:  graceTime,
+		stale:  time.Duration(cfg.StaleWhileRevalidate),
+		jitter: time.Duration(cfg.ExpireJitter),
+		shards: make([]*memoryCacheShard, n),
+	}
+	for i := range c.shards {
+		// The remainder of max_items is spread across the first shards,
+		// so the shards hold max_items in total.
+		shardItems := maxItems / n
+		if i < maxItems%n {
+			shardItems++
+		}
+		c.shards[i] = &memoryCacheShard{
+			maxSize:  maxSize / uint64(n),
+			maxItems: shardItems,
+			lru:      list.New(),
+			entries:  make(map[string]*list.Element),
+		}
+	}
+	return c, nil
+}
+
+// checkMemoryCacheConfig checks the memory cache may be created from cfg.
+func checkMemoryCacheConfig(cfg config.Cache) error {
+	if cfg.Memory.MaxSize <= 0 {
+		return fmt.Errorf("`max_size` must be positive")
+	}
+	if cfg.Memory.MaxItems < 0 {
+		return fmt.Errorf("`max_items` cannot be negative")
+	}
+	if cfg.Expire <= 0 {
+		return fmt.Errorf("`expire` must be positive")
+	}
+	return nil
+}
+
+// maxEntrySize returns the size of the largest response fitting into the cache.
+func (c *memoryCache) maxEntrySize() uint64 {
+	return c.shards[0].maxSize
+}
+
+func (c *memoryCache) shard(key string) *memoryCacheShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return c.shards[h.Sum32()%uint32(len(c.shards))]
+}
+
+func (c *memoryCache) Name() string {
+	return c.name
+}
+
+func (c *memoryCache) Close() error {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		s.lru.Init()
+		s.entries = make(map[string]*list.Element)
+		s.size = 0
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+func (c *memoryCache) Stats() Stats {
+	var st Stats
+	for _, s := range c.shards {
+		s.mu.Lock()
+		st.Size += s.size
+		st.Items += uint64(len(s.entries))
+		s.mu.Unlock()
+	}
+	return st
+}
+
+// keepTime returns the duration expired responses are kept for.
+func (c *memoryCache) keepTime() time.Duration {
+	if c.stale > c.grace {
+		return c.stale
+	}
+	return c.grace
+}
+
+func (c *memoryCache) Get(key *Key) (*CachedData, error) {
+	k := key.String()
+	s := c.shard(k)
+	now := time.Now()
+
+	s.mu.Lock()
+	el, ok := s.entries[k]
+	if !ok {
+		s.mu.Unlock()
+		return nil, ErrMissing
+	}
+	// nolint:forcetypeassert // Only *memoryCacheEntry is stored in lru.
+	e := el.Value.(*memoryCacheEntry)
+	if now.After(e.expireAt.Add(c.keepTime())) {
+		s.remove(el)
+		s.mu.Unlock()
+		return nil, ErrMissing
+	}
+	s.lru.MoveToFront(el)
+	s.mu.Unlock()
+
+	// The entry is immutable, so it is read without the lock.
+	metadata := e.metadata
+	metadata.Headers = e.metadata.Headers.Clone()
+	return &CachedData{
+		ContentMetadata: metadata,
+		Data:            io.NopCloser(bytes.NewReader(e.data)),
+		Ttl:             e.expireAt.Sub(now),
+		Stale:           now.After(e.expireAt) && !now.After(e.expireAt.Add(c.stale)),
+	}, nil
+}
+
+func (c *memoryCache) Put(r io.Reader, contentMetadata ContentMetadata, key *Key) (time.Duration, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, fmt.Errorf("cache %q: cannot read response: %s : %w", c.Name(), key, err)
+	}
+	jitter := expireJitter(c.jitter)
+	contentMetadata.Headers = contentMetadata.Headers.Clone()
+	e := &memoryCacheEntry{
+		key:      key.String(),
+		metadata: contentMetadata,
+		data:     data,
+		expireAt: time.Now().Add(c.expire + jitter),
+	}
+	s := c.shard(e.key)
+	if e.size() > s.maxSize {
+		return 0, fmt.Errorf("cache %q: response of %d bytes exceeds the maximum size of %d bytes: %s", c.Name(), e.size(), s.maxSize, key)
+	}
+
+	s.mu.Lock()
+	if el, ok := s.entries[e.key]; ok {
+		s.remove(el)
+	}
+	s.entries[e.key] = s.lru.PushFront(e)
+	s.size += e.size()
+	evicted := s.evict()
+	s.mu.Unlock()
+
+	if evicted > 0 {
+		Evictions.With(prometheus.Labels{"cache": c.Name()}).Add(float64(evicted))
+	}
+	return c.expire + jitter, nil
+}
+
+// invalidate removes the entries with key hashes starting with prefix
+// and returns the number of removed entries.
+func (c *memoryCache) invalidate(prefix string) (int, error) {
+	removed := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for k, el := range s.entries {
+			if strings.HasPrefix(k, prefix) {
+				s.remove(el)
+				removed++
+			}
+		}
+		s.mu.Unlock()
+	}
+	return removed, nil
+}
+
+// evict removes the least recently used entries while the shard exceeds
+// its limits and returns the number of removed entries.
+//
+// It must be called with the lock held.
+func (s *memoryCacheShard) evict() int {
+	evicted := 0
+	for s.size > s.maxSize || (s.maxItems > 0 && len(s.entries) > s.maxItems) {
+		s.remove(s.lru.Back())
+		evicted++
+	}
+	return evicted
+}
+
+// remove removes the entry from the shard.
+//
+// It must be called with the lock held.
+func (s *memoryCacheShard) remove(el *list.Element) {
+	// nolint:forcetypeassert // Only *memoryCacheEntry is stored in lru.
+	e := s.lru.Remove(el).(*memoryCacheEntry)
+	delete(s.entries, e.key)
+	s.size -= e.size()
+}
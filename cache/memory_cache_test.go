@@ -0,0 +1,276 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/contentsquare/chproxy/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestMemoryCache(t *testing.T, memCfg config.MemoryCacheConfig) *memoryCache {
+	t.Helper()
+	c, err := newMemoryCache(config.Cache{
+		Name:                 "memory",
+		Memory:               memCfg,
+		Expire:               config.Duration(time.Minute),
+		StaleWhileRevalidate: config.Duration(time.Minute),
+	}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestMemoryCacheAddGet(t *testing.T) {
+	// The helper puts responses of up to 4MB.
+	c := newTestMemoryCache(t, config.MemoryCacheConfig{MaxSize: 5 << 20})
+	defer c.Close()
+	cacheAddGetHelper(t, c)
+}
+
+func TestMemoryCacheMiss(t *testing.T) {
+	c := newTestMemoryCache(t, config.MemoryCacheConfig{MaxSize: 1 << 20})
+	defer c.Close()
+	cacheMissHelper(t, c)
+}
+
+func TestMemoryCacheHeaders(t *testing.T) {
+	c := newTestMemoryCache(t, config.MemoryCacheConfig{MaxSize: 1 << 20})
+	defer c.Close()
+	cacheHeadersHelper(t, c)
+}
+
+func TestMemoryCacheShards(t *testing.T) {
+	c := newTestMemoryCache(t, config.MemoryCacheConfig{MaxSize: 1 << 30})
+	assert.Len(t, c.shards, memoryCacheShards)
+	assert.Equal(t, uint64(1<<30/memoryCacheShards), c.maxEntrySize())
+
+	// Small caches keep shards large enough for their responses.
+	c = newTestMemoryCache(t, config.MemoryCacheConfig{MaxSize: 10 << 20})
+	assert.Len(t, c.shards, 2)
+
+	c = newTestMemoryCache(t, config.MemoryCacheConfig{MaxSize: 1 << 30, MaxItems: 3})
+	assert.Len(t, c.shards, 3)
+	assert.Equal(t, 1, c.shards[0].maxItems)
+}
+
+func TestMemoryCacheStale(t *testing.T) {
+	c := newTestMemoryCache(t, config.MemoryCacheConfig{MaxSize: 1 << 20})
+	defer c.Close()
+
+	key := &Key{Query: []byte("SELECT stale")}
+	if _, err := c.Put(strings.NewReader("an object"), ContentMetadata{Length: 9}, key); err != nil {
+		t.Fatalf("failed to put it to cache: %s", err)
+	}
+	cachedData, err := c.Get(key)
+	if err != nil {
+		t.Fatalf("failed to get data from cache: %s", err)
+	}
+	if cachedData.Stale {
+		t.Fatalf("unexpected stale entry with ttl %s", cachedData.Ttl)
+	}
+	b, err := io.ReadAll(cachedData.Data)
+	if err != nil {
+		t.Fatalf("cannot read cached data: %s", err)
+	}
+	assert.Equal(t, "an object", string(b))
+
+	age := func(d time.Duration) {
+		s := c.shard(key.String())
+		s.mu.Lock()
+		// nolint:forcetypeassert // Only *memoryCacheEntry is stored in lru.
+		e := s.entries[key.String()].Value.(*memoryCacheEntry)
+		e.expireAt = time.Now().Add(time.Minute - d)
+		s.mu.Unlock()
+	}
+
+	age(90 * time.Second)
+	cachedData, err = c.Get(key)
+	if err != nil {
+		t.Fatalf("failed to get stale data from cache: %s", err)
+	}
+	if !cachedData.Stale {
+		t.Fatalf("expecting stale entry; got ttl %s", cachedData.Ttl)
+	}
+
+	age(3 * time.Minute)
+	if _, err = c.Get(key); err != ErrMissing {
+		t.Fatalf("unexpected error: %v; expecting %s", err, ErrMissing)
+	}
+	assert.Equal(t, uint64(0), c.Stats().Items, "expired entries must be removed")
+}
+
+func TestMemoryCacheEvictLRU(t *testing.T) {
+	// Fits 3 entries of 100 bytes plus 32 bytes of their keys.
+	c := newTestMemoryCache(t, config.MemoryCacheConfig{MaxSize: 400})
+	defer c.Close()
+
+	evictions := prometheus.Labels{"cache": c.Name()}
+	evictionsBefore := testutil.ToFloat64(Evictions.With(evictions))
+
+	keys := make([]*Key, 4)
+	put := func(i int) {
+		t.Helper()
+		keys[i] = &Key{Query: []byte(fmt.Sprintf("SELECT %d lru", i))}
+		if _, err := c.Put(strings.NewReader(strings.Repeat("a", 100)), ContentMetadata{Length: 100}, keys[i]); err != nil {
+			t.Fatalf("failed to put it to cache: %s", err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		put(i)
+	}
+
+	// Get the least recently used entry, so it isn't evicted.
+	if _, err := c.Get(keys[0]); err != nil {
+		t.Fatalf("failed to get data from cache: %s", err)
+	}
+
+	put(3)
+	if _, err := c.Get(keys[1]); err != ErrMissing {
+		t.Fatalf("expected the least recently used entry to be evicted; got: %v", err)
+	}
+	for _, i := range []int{0, 2, 3} {
+		if _, err := c.Get(keys[i]); err != nil {
+			t.Fatalf("expected entry %d to be kept; got: %s", i, err)
+		}
+	}
+	assert.Equal(t, Stats{Items: 3, Size: 3 * 132}, c.Stats())
+	assert.Equal(t, 1.0, testutil.ToFloat64(Evictions.With(evictions))-evictionsBefore)
+
+	// Responses larger than the cache aren't cached.
+	key := &Key{Query: []byte("SELECT huge")}
+	if _, err := c.Put(strings.NewReader(strings.Repeat("a", 400)), ContentMetadata{Length: 400}, key); err == nil {
+		t.Fatalf("expected error for the response exceeding max_size")
+	}
+	assert.Equal(t, uint64(3), c.Stats().Items)
+}
+
+func TestMemoryCacheMaxItems(t *testing.T) {
+	c := newTestMemoryCache(t, config.MemoryCacheConfig{MaxSize: 1 << 20, MaxItems: 2})
+	defer c.Close()
+
+	for i := 0; i < 10; i++ {
+		key := &Key{Query: []byte(fmt.Sprintf("SELECT %d", i))}
+		if _, err := c.Put(strings.NewReader("an object"), ContentMetadata{Length: 9}, key); err != nil {
+			t.Fatalf("failed to put it to cache: %s", err)
+		}
+	}
+	assert.LessOrEqual(t, c.Stats().Items, uint64(2))
+}
+
+func TestMemoryCacheMaxItemsRemainder(t *testing.T) {
+	// max_items isn't divisible by the number of shards.
+	c := newTestMemoryCache(t, config.MemoryCacheConfig{MaxSize: 1 << 30, MaxItems: 31})
+	defer c.Close()
+
+	total := 0
+	for _, s := range c.shards {
+		total += s.maxItems
+	}
+	assert.Equal(t, 31, total)
+
+	evictions := prometheus.Labels{"cache": c.Name()}
+	evictionsBefore := testutil.ToFloat64(Evictions.With(evictions))
+	const n = 1000
+	for i := 0; i < n; i++ {
+		key := &Key{Query: []byte(fmt.Sprintf("SELECT %d remainder", i))}
+		if _, err := c.Put(strings.NewReader("an object"), ContentMetadata{Length: 9}, key); err != nil {
+			t.Fatalf("failed to put it to cache: %s", err)
+		}
+	}
+	assert.Equal(t, uint64(31), c.Stats().Items)
+	assert.Equal(t, float64(n-31), testutil.ToFloat64(Evictions.With(evictions))-evictionsBefore)
+}
+
+func TestMemoryCacheInvalidate(t *testing.T) {
+	c := newTestMemoryCache(t, config.MemoryCacheConfig{MaxSize: 1 << 20})
+	defer c.Close()
+
+	keys := make([]*Key, 20)
+	for i := range keys {
+		keys[i] = &Key{Query: []byte(fmt.Sprintf("SELECT %d", i))}
+		if _, err := c.Put(strings.NewReader("an object"), ContentMetadata{Length: 9}, keys[i]); err != nil {
+			t.Fatalf("failed to put it to cache: %s", err)
+		}
+	}
+	prefix := keys[0].String()[:1]
+	removed, err := c.invalidate(prefix)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assert.Positive(t, removed)
+	for _, key := range keys {
+		_, err := c.Get(key)
+		if strings.HasPrefix(key.String(), prefix) {
+			assert.Equal(t, ErrMissing, err)
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+	assert.Equal(t, uint64(len(keys)-removed), c.Stats().Items)
+}
+
+func TestMemoryCacheConcurrent(t *testing.T) {
+	c := newTestMemoryCache(t, config.MemoryCacheConfig{MaxSize: 64 << 10, MaxItems: 100})
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				key := &Key{Query: []byte(fmt.Sprintf("SELECT %d", i%150))}
+				value := strings.Repeat(key.String(), 10)
+				if cachedData, err := c.Get(key); err == nil {
+					b, err := io.ReadAll(cachedData.Data)
+					if err != nil || string(b) != value {
+						t.Errorf("unexpected cached data %q for %s; error: %v", b, key, err)
+						return
+					}
+					continue
+				}
+				if _, err := c.Put(strings.NewReader(value), ContentMetadata{Length: int64(len(value))}, key); err != nil {
+					t.Errorf("failed to put it to cache: %s", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats := c.Stats()
+	assert.LessOrEqual(t, stats.Items, uint64(100))
+	assert.LessOrEqual(t, stats.Size, uint64(64<<10))
+}
+
+func TestAsyncCache_MemoryCache_instantiation(t *testing.T) {
+	cfg := config.Cache{
+		Name: "test",
+		Mode: "memory",
+		Memory: config.MemoryCacheConfig{
+			MaxSize: 1 << 30,
+		},
+		Expire:         config.Duration(time.Minute),
+		MaxPayloadSize: config.ByteSize(1 << 40),
+	}
+	c, err := NewAsyncCache(cfg, time.Second)
+	if err != nil {
+		t.Fatalf("could not instantiate memory async cache: %s", err)
+	}
+	defer c.Close()
+	// Responses larger than the shards aren't cached.
+	assert.Equal(t, config.ByteSize(1<<30/memoryCacheShards), c.MaxPayloadSize)
+
+	cfg.Memory.MaxSize = 0
+	if _, err := NewAsyncCache(cfg, time.Second); err == nil {
+		t.Fatalf("expected error for memory cache without max_size")
+	}
+}
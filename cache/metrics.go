@@ -0,0 +1,136 @@
+package cache
+
+import (
+	"github.com/contentsquare/chproxy/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	PayloadBytes *prometheus.HistogramVec
+	ServedBytes  *prometheus.HistogramVec
+	Evictions    *prometheus.CounterVec
+	IndexEntries *prometheus.GaugeVec
+
+	CleanupFilesRemoved *prometheus.CounterVec
+	CleanupErrors       *prometheus.CounterVec
+
+	AbandonedTransactions *prometheus.CounterVec
+
+	CacheAlive         *prometheus.GaugeVec
+	CacheAliveDuration *prometheus.GaugeVec
+	RedisPingDuration  *prometheus.HistogramVec
+	RedisReconnections *prometheus.CounterVec
+	RedisErrors        *prometheus.CounterVec
+)
+
+// sizeBuckets cover payloads from 1KiB to 1GiB.
+var sizeBuckets = prometheus.ExponentialBuckets(1024, 4, 11)
+
+func initMetrics(cfg *config.Config) {
+	namespace := cfg.Server.Metrics.Namespace
+	PayloadBytes = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "cache_payload_bytes",
+			Help:      "Size of responses put into the cache",
+			Buckets:   sizeBuckets,
+		},
+		[]string{"cache"},
+	)
+	ServedBytes = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "cache_served_bytes",
+			Help:      "Size of responses served from the cache",
+			Buckets:   sizeBuckets,
+		},
+		[]string{"cache"},
+	)
+	Evictions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cache_evictions_total",
+			Help:      "The number of entries evicted from the file system or memory cache due to max_size or max_items",
+		},
+		[]string{"cache"},
+	)
+	IndexEntries = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "cache_index_entries",
+			Help:      "The number of entries in the in-memory index of the file system cache",
+		},
+		[]string{"cache"},
+	)
+	CleanupFilesRemoved = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cache_cleanup_files_removed_total",
+			Help:      "The number of expired files removed by background scans of the file system cache dir",
+		},
+		[]string{"cache"},
+	)
+	CleanupErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cache_cleanup_errors_total",
+			Help:      "The number of errors during background scans of the file system cache dir",
+		},
+		[]string{"cache"},
+	)
+	AbandonedTransactions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cache_abandoned_transactions_total",
+			Help:      "The number of transactions completed by the janitor because they have been pending for longer than the grace time",
+		},
+		[]string{"cache"},
+	)
+	CacheAlive = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "cache_alive",
+			Help:      "Whether the redis cache responds to background pings",
+		},
+		[]string{"cache"},
+	)
+	CacheAliveDuration = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "cache_alive_duration_seconds",
+			Help:      "The duration the redis cache has been in its current cache_alive state for",
+		},
+		[]string{"cache"},
+	)
+	RedisPingDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "redis_ping_duration_seconds",
+			Help:      "Latency of background pings of the redis cache",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"cache"},
+	)
+	RedisReconnections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "redis_reconnections_total",
+			Help:      "The number of connections to redis established after connection failures",
+		},
+		[]string{"cache"},
+	)
+	RedisErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "redis_errors_total",
+			Help:      "The number of failed redis operations of the cache",
+		},
+		[]string{"cache", "operation"},
+	)
+}
+
+func RegisterMetrics(cfg *config.Config) {
+	initMetrics(cfg)
+	prometheus.MustRegister(PayloadBytes, ServedBytes, Evictions, IndexEntries, CleanupFilesRemoved, CleanupErrors,
+		AbandonedTransactions, CacheAlive, CacheAliveDuration, RedisPingDuration, RedisReconnections, RedisErrors)
+}
@@ -3,13 +3,15 @@ package cache
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"math/rand"
-	"os"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/contentsquare/chproxy/config"
@@ -21,31 +23,72 @@ type redisCache struct {
 	name   string
 	client redis.UniversalClient
 	expire time.Duration
+	// stale is the period expired entries are kept for in redis.
+	stale time.Duration
+	// jitter is the upper bound of the random duration added to expire.
+	jitter time.Duration
+	// keyPrefix is prepended to the keys of cached responses.
+	keyPrefix string
+
+	// streamingMinTTL is the TTL below which values may expire while they are streamed.
+	streamingMinTTL time.Duration
+	// versionCheck is true if values with TTL below streamingMinTTL are streamed
+	// with the version check instead of extending their TTL.
+	versionCheck bool
+
+	getTimeout    time.Duration
+	putTimeout    time.Duration
+	removeTimeout time.Duration
+	renameTimeout time.Duration
+	statsTimeout  time.Duration
 }
 
-const getTimeout = 2 * time.Second
-const removeTimeout = 1 * time.Second
-const renameTimeout = 1 * time.Second
-const putTimeout = 2 * time.Second
-const statsTimeout = 500 * time.Millisecond
+// Default timeouts of redis operations, used unless they are set in the config.
+const defaultGetTimeout = 2 * time.Second
+const defaultRemoveTimeout = 1 * time.Second
+const defaultRenameTimeout = 1 * time.Second
+const defaultPutTimeout = 2 * time.Second
+const defaultStatsTimeout = 500 * time.Millisecond
 
-// this variable is key to select whether the result should be streamed
-// from redis to the http response or if chproxy should first put the
-// result from redis in a temporary files before sending it to the http response
-const minTTLForRedisStreamingReader = 15 * time.Second
+// defaultStreamingMinTTL is used if `streaming_min_ttl` isn't set.
+// Values with TTL below it may expire while they are streamed
+// from redis to the http response.
+const defaultStreamingMinTTL = 15 * time.Second
 
-const redisTmpFilePrefix = "chproxyRedisTmp"
+// nbBytesToFetch is the number of bytes fetched by the first GETRANGE
+// of the cached value.
+const nbBytesToFetch = int64(100 * 1024)
 
 func newRedisCache(client redis.UniversalClient, cfg config.Cache) *redisCache {
 	redisCache := &redisCache{
 		name:   cfg.Name,
 		expire: time.Duration(cfg.Expire),
+		stale:  time.Duration(cfg.StaleWhileRevalidate),
+		jitter: time.Duration(cfg.ExpireJitter),
 		client: client,
+
+		keyPrefix: cfg.KeyPrefix,
+
+		streamingMinTTL: timeoutOrDefault(cfg.Redis.StreamingMinTTL, defaultStreamingMinTTL),
+		versionCheck:    cfg.Redis.ShortTTLStreaming == "version_check",
+
+		getTimeout:    timeoutOrDefault(cfg.Redis.GetTimeout, defaultGetTimeout),
+		putTimeout:    timeoutOrDefault(cfg.Redis.PutTimeout, defaultPutTimeout),
+		removeTimeout: timeoutOrDefault(cfg.Redis.RemoveTimeout, defaultRemoveTimeout),
+		renameTimeout: timeoutOrDefault(cfg.Redis.RenameTimeout, defaultRenameTimeout),
+		statsTimeout:  timeoutOrDefault(cfg.Redis.StatsTimeout, defaultStatsTimeout),
 	}
 
 	return redisCache
 }
 
+func timeoutOrDefault(timeout config.Duration, defaultTimeout time.Duration) time.Duration {
+	if timeout > 0 {
+		return time.Duration(timeout)
+	}
+	return defaultTimeout
+}
+
 func (r *redisCache) Close() error {
 	return r.client.Close()
 }
@@ -64,7 +107,7 @@ func (r *redisCache) Stats() Stats {
 }
 
 func (r *redisCache) nbOfKeys() uint64 {
-	ctx, cancelFunc := context.WithTimeout(context.Background(), statsTimeout)
+	ctx, cancelFunc := context.WithTimeout(context.Background(), r.statsTimeout)
 	defer cancelFunc()
 	nbOfKeys, err := r.client.DBSize(ctx).Result()
 	if err != nil {
@@ -74,7 +117,7 @@ func (r *redisCache) nbOfKeys() uint64 {
 }
 
 func (r *redisCache) nbOfBytes() uint64 {
-	ctx, cancelFunc := context.WithTimeout(context.Background(), statsTimeout)
+	ctx, cancelFunc := context.WithTimeout(context.Background(), r.statsTimeout)
 	defer cancelFunc()
 	memoryInfo, err := r.client.Info(ctx, "memory").Result()
 	if err != nil {
@@ -95,16 +138,16 @@ func (r *redisCache) nbOfBytes() uint64 {
 }
 
 func (r *redisCache) Get(key *Key) (*CachedData, error) {
-	ctx, cancelFunc := context.WithTimeout(context.Background(), getTimeout)
+	ctx, cancelFunc := context.WithTimeout(context.Background(), r.getTimeout)
 	defer cancelFunc()
-	nbBytesToFetch := int64(100 * 1024)
-	stringKey := key.String()
+	stringKey := prefixedKey(r.keyPrefix, key.String())
 	// fetching 100kBytes from redis to be sure to have the full metadata and,
 	//  for most of the queries that fetch a few data, the cached results
 	val, err := r.client.GetRange(ctx, stringKey, 0, nbBytesToFetch).Result()
 
 	// errors, such as timeouts
 	if err != nil {
+		r.countError(redisOperationGet)
 		log.Errorf("failed to get key %s with error: %s", stringKey, err)
 		return nil, ErrMissing
 	}
@@ -115,8 +158,17 @@ func (r *redisCache) Get(key *Key) (*CachedData, error) {
 
 	ttl, err := r.client.TTL(ctx, stringKey).Result()
 	if err != nil {
-		return nil, fmt.Errorf("failed to ttl of key %s with error: %w", stringKey, err)
+		r.countError(redisOperationGet)
+		log.Errorf("failed to ttl of key %s with error: %s", stringKey, err)
+		return nil, ErrMissing
 	}
+	return r.decodeValue(stringKey, val, ttl)
+}
+
+// decodeValue returns the cached data from the first bytes val of the value
+// stored under stringKey. The remaining bytes are read from redis
+// if val doesn't contain the whole cached response.
+func (r *redisCache) decodeValue(stringKey, val string, ttl time.Duration) (*CachedData, error) {
 	b := []byte(val)
 	metadata, offset, err := r.decodeMetadata(b)
 	if err != nil {
@@ -136,46 +188,50 @@ func (r *redisCache) Get(key *Key) (*CachedData, error) {
 			Ttl:             ttl,
 		}
 
-		return value, nil
+		return r.markStale(value), nil
+	}
+
+	value, err := r.readResultsAboveLimit(b[:offset], stringKey, metadata, ttl)
+	if err != nil {
+		return nil, err
 	}
+	return r.markStale(value), nil
+}
 
-	return r.readResultsAboveLimit(offset, stringKey, metadata, ttl)
+// markStale turns the redis TTL of the value into the time left
+// before its expiration, since entries are kept in redis during
+// the `stale_while_revalidate` period after they expire.
+func (r *redisCache) markStale(value *CachedData) *CachedData {
+	if r.stale <= 0 {
+		return value
+	}
+	value.Ttl -= r.stale
+	value.Stale = value.Ttl <= 0
+	return value
 }
 
-func (r *redisCache) readResultsAboveLimit(offset int, stringKey string, metadata *ContentMetadata, ttl time.Duration) (*CachedData, error) {
+func (r *redisCache) readResultsAboveLimit(metadataPrefix []byte, stringKey string, metadata *ContentMetadata, ttl time.Duration) (*CachedData, error) {
+	offset := len(metadataPrefix)
 	// since the cached results in redis are too big, we can't fetch all of them because of the memory overhead.
 	// We will create an io.reader that will fetch redis bulk by bulk to reduce the memory usage.
-	redisStreamreader := newRedisStreamReader(uint64(offset), r.client, stringKey, metadata.Length)
+	redisStreamreader := newRedisStreamReader(uint64(offset), r.client, stringKey, metadata.Length, r.getTimeout)
 
 	// But before that, since the usage of the reader could take time and the object in redis could disappear btw 2 fetches
-	// we need to make sure the TTL will be long enough to avoid nasty side effects
-	// if the TTL is too short we will put all the data into a file and use it as a streamer
+	// we need to make sure the TTL will be long enough to avoid nasty side effects.
+	// Values expiring or replaced while they are read are detected by the reader
+	// and surfaced as RedisCacheError.
 	// nb: it would be better to retry the flow if such a failure happened but this requires a huge refactoring of proxy.go
-
-	if ttl <= minTTLForRedisStreamingReader {
-		fileStream, err := newFileWriterReader(os.TempDir())
-		if err != nil {
-			return nil, err
-		}
-		_, err = io.Copy(fileStream, redisStreamreader)
-		if err != nil {
-			return nil, err
-		}
-		err = fileStream.resetOffset()
-		if err != nil {
+	if ttl <= r.streamingMinTTL {
+		if r.versionCheck {
+			redisStreamreader.checkVersion(metadataPrefix)
+		} else if err := redisStreamreader.extendTTL(r.streamingMinTTL); err != nil {
 			return nil, err
 		}
-		value := &CachedData{
-			ContentMetadata: *metadata,
-			Data:            fileStream,
-			Ttl:             ttl,
-		}
-		return value, nil
 	}
 
 	value := &CachedData{
 		ContentMetadata: *metadata,
-		Data:            &ioReaderDecorator{Reader: redisStreamreader},
+		Data:            redisStreamreader,
 		Ttl:             ttl,
 	}
 
@@ -192,35 +248,51 @@ func (m ioReaderDecorator) Close() error {
 	return nil
 }
 func (r *redisCache) encodeString(s string) []byte {
-	n := uint32(len(s))
-
-	b := make([]byte, 0, n+4)
-	b = append(b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
-	b = append(b, s...)
-	return b
+	return appendString(nil, s)
 }
 
 func (r *redisCache) decodeString(bytes []byte) (string, int, error) {
-	if len(bytes) < 4 {
-		return "", 0, &RedisCacheCorruptionError{}
-	}
-	b := bytes[:4]
-	n := uint32(b[3]) | (uint32(b[2]) << 8) | (uint32(b[1]) << 16) | (uint32(b[0]) << 24)
-	if len(bytes) < int(4+n) {
+	s, n, ok := decodeString(bytes)
+	if !ok {
 		return "", 0, &RedisCacheCorruptionError{}
 	}
-	s := bytes[4 : 4+n]
-	return string(s), int(4 + n), nil
+	return s, n, nil
 }
 
-func (r *redisCache) encodeMetadata(contentMetadata *ContentMetadata) []byte {
-	cLength := contentMetadata.Length
+// metadataHeadersFlag is set in the encoded content length of entries
+// containing headers. The content length of legacy entries has no such bit,
+// since it is never negative.
+const metadataHeadersFlag = uint64(1) << 63
+
+// metadataVersionFlag is set in the encoded content length of entries
+// containing the version, which is unique for every Put of the entry.
+const metadataVersionFlag = uint64(1) << 62
+
+// encodeMetadata encodes contentMetadata as follows:
+// contentLength|length(contentType)|contentType|length(contentEncoding)|contentEncoding[|length(headers)|headers][|version]
+//
+// Headers are encoded only if there are any, and metadataHeadersFlag is set in contentLength then.
+// The version is encoded only if it isn't zero, and metadataVersionFlag is set in contentLength then.
+func (r *redisCache) encodeMetadata(contentMetadata *ContentMetadata, version uint64) []byte {
+	cLength := uint64(contentMetadata.Length)
+	var headers []byte
+	if len(contentMetadata.Headers) > 0 {
+		headers = r.encodeString(string(encodeHeaders(contentMetadata.Headers)))
+		cLength |= metadataHeadersFlag
+	}
+	if version != 0 {
+		cLength |= metadataVersionFlag
+	}
 	cType := r.encodeString(contentMetadata.Type)
 	cEncoding := r.encodeString(contentMetadata.Encoding)
-	b := make([]byte, 0, len(cEncoding)+len(cType)+8)
-	b = append(b, byte(cLength>>56), byte(cLength>>48), byte(cLength>>40), byte(cLength>>32), byte(cLength>>24), byte(cLength>>16), byte(cLength>>8), byte(cLength))
+	b := make([]byte, 0, len(cEncoding)+len(cType)+len(headers)+16)
+	b = binary.BigEndian.AppendUint64(b, cLength)
 	b = append(b, cType...)
 	b = append(b, cEncoding...)
+	b = append(b, headers...)
+	if version != 0 {
+		b = binary.BigEndian.AppendUint64(b, version)
+	}
 	return b
 }
 
@@ -229,6 +301,9 @@ func (r *redisCache) decodeMetadata(b []byte) (*ContentMetadata, int, error) {
 		return nil, 0, &RedisCacheCorruptionError{}
 	}
 	cLength := uint64(b[7]) | (uint64(b[6]) << 8) | (uint64(b[5]) << 16) | (uint64(b[4]) << 24) | uint64(b[3])<<32 | (uint64(b[2]) << 40) | (uint64(b[1]) << 48) | (uint64(b[0]) << 56)
+	hasHeaders := cLength&metadataHeadersFlag != 0
+	hasVersion := cLength&metadataVersionFlag != 0
+	cLength &^= metadataHeadersFlag | metadataVersionFlag
 	offset := 8
 	cType, sizeCType, err := r.decodeString(b[offset:])
 	if err != nil {
@@ -245,13 +320,31 @@ func (r *redisCache) decodeMetadata(b []byte) (*ContentMetadata, int, error) {
 		Type:     cType,
 		Encoding: cEncoding,
 	}
+	if hasHeaders {
+		headers, sizeHeaders, err := r.decodeString(b[offset:])
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += sizeHeaders
+		if metadata.Headers, err = decodeHeaders([]byte(headers)); err != nil {
+			return nil, 0, &RedisCacheCorruptionError{}
+		}
+	}
+	if hasVersion {
+		// The version is only used to detect the entry replaced while it is read.
+		if len(b) < offset+8 {
+			return nil, 0, &RedisCacheCorruptionError{}
+		}
+		offset += 8
+	}
 	return metadata, offset, nil
 }
 
 func (r *redisCache) Put(reader io.Reader, contentMetadata ContentMetadata, key *Key) (time.Duration, error) {
-	medatadata := r.encodeMetadata(&contentMetadata)
+	// nolint:gosec // not security sensitve, only used to detect replaced entries.
+	medatadata := r.encodeMetadata(&contentMetadata, rand.Uint64()|1)
 
-	stringKey := key.String()
+	stringKey := prefixedKey(r.keyPrefix, key.String())
 	// in order to make the streaming operation atomic, chproxy streams into a temporary key (only known by the current goroutine)
 	// then it switches the full result to the "real" stringKey available for other goroutines
 	// nolint:gosec // not security sensitve, only used internally.
@@ -264,10 +357,12 @@ func (r *redisCache) Put(reader io.Reader, contentMetadata ContentMetadata, key
 	// Refer the hash tags section of Redis documentation here: https://redis.io/docs/reference/cluster-spec/#hash-tags
 	stringKeyTmp := "{" + stringKey + "}" + random + "_tmp"
 
-	ctxSet, cancelFuncSet := context.WithTimeout(context.Background(), putTimeout)
+	expire := r.expire + expireJitter(r.jitter)
+	ctxSet, cancelFuncSet := context.WithTimeout(context.Background(), r.putTimeout)
 	defer cancelFuncSet()
-	err := r.client.Set(ctxSet, stringKeyTmp, medatadata, r.expire).Err()
+	err := r.client.Set(ctxSet, stringKeyTmp, medatadata, expire+r.stale).Err()
 	if err != nil {
+		r.countError(redisOperationPut)
 		return 0, err
 	}
 	// we don't fetch all the reader content bulks by bulks to from redis to avoid memory issue
@@ -286,10 +381,11 @@ func (r *redisCache) Put(reader io.Reader, contentMetadata ContentMetadata, key
 		if err != nil && !errors.Is(err, io.EOF) {
 			return 0, err
 		}
-		ctxAppend, cancelFuncAppend := context.WithTimeout(context.Background(), putTimeout)
+		ctxAppend, cancelFuncAppend := context.WithTimeout(context.Background(), r.putTimeout)
 		defer cancelFuncAppend()
 		totalByteWritten, err := r.client.Append(ctxAppend, stringKeyTmp, string(buffer[:n])).Result()
 		if err != nil {
+			r.countError(redisOperationPut)
 			// trying to clean redis from this partially inserted item
 			r.clean(stringKeyTmp)
 			return 0, err
@@ -306,17 +402,20 @@ func (r *redisCache) Put(reader io.Reader, contentMetadata ContentMetadata, key
 	}
 	// at this step we know that the item stored in stringKeyTmp is fully written
 	// so we can put it to its final stringKey
-	ctxRename, cancelFuncRename := context.WithTimeout(context.Background(), renameTimeout)
+	ctxRename, cancelFuncRename := context.WithTimeout(context.Background(), r.renameTimeout)
 	defer cancelFuncRename()
-	r.client.Rename(ctxRename, stringKeyTmp, stringKey)
-	return r.expire, nil
+	if err := r.client.Rename(ctxRename, stringKeyTmp, stringKey).Err(); err != nil {
+		r.countError(redisOperationPut)
+	}
+	return expire, nil
 }
 
 func (r *redisCache) clean(stringKey string) {
-	delCtx, cancelFunc := context.WithTimeout(context.Background(), removeTimeout)
+	delCtx, cancelFunc := context.WithTimeout(context.Background(), r.removeTimeout)
 	defer cancelFunc()
 	delErr := r.client.Del(delCtx, stringKey).Err()
 	if delErr != nil {
+		r.countError(redisOperationDel)
 		log.Debugf("redis item was only partially inserted and chproxy couldn't remove the partial result because of %s", delErr)
 	} else {
 		log.Debugf("redis item was only partially inserted, chproxy was able to remove it")
@@ -327,6 +426,90 @@ func (r *redisCache) Name() string {
 	return r.name
 }
 
+// invalidate removes the entries with key hashes starting with prefix
+// and returns the number of removed entries.
+//
+// Other keys, e.g. transactions, are kept, so queries awaiting them aren't affected.
+func (r *redisCache) invalidate(prefix string) (int, error) {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), r.removeTimeout)
+	defer cancelFunc()
+
+	pattern := prefixedKey(r.keyPrefix, prefix) + "*"
+	keyPrefix := prefixedKey(r.keyPrefix, "")
+	var removed atomic.Int64
+	scan := func(ctx context.Context, client redis.Cmdable) error {
+		iter := client.Scan(ctx, 0, pattern, 1000).Iterator()
+		for iter.Next(ctx) {
+			key := iter.Val()
+			if !cachefileRegexp.MatchString(strings.TrimPrefix(key, keyPrefix)) {
+				continue
+			}
+			n, err := client.Del(ctx, key).Result()
+			if err != nil {
+				return err
+			}
+			removed.Add(n)
+		}
+		return iter.Err()
+	}
+
+	var err error
+	if cc, ok := r.client.(*redis.ClusterClient); ok {
+		err = cc.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+			return scan(ctx, client)
+		})
+	} else {
+		err = scan(ctx, r.client)
+	}
+	if err != nil {
+		r.countError(redisOperationDel)
+	}
+	return int(removed.Load()), err
+}
+
+// invalidationsChannel returns the channel of invalidations of the caches
+// sharing redis with the same `key_prefix`.
+func (r *redisCache) invalidationsChannel() string {
+	return prefixedKey(r.keyPrefix, InvalidationsChannel)
+}
+
+// PublishInvalidation notifies the chproxy instances subscribed to channel
+// that the entries with key hashes starting with prefix are invalidated.
+func (r *redisCache) PublishInvalidation(ctx context.Context, channel, prefix string) error {
+	return r.client.Publish(ctx, channel, prefix).Err()
+}
+
+// SubscribeInvalidations calls handler with the prefixes published to channel
+// via PublishInvalidation until ctx is canceled.
+//
+// It returns once the subscription is confirmed by redis, so invalidations
+// published after the call aren't missed.
+func (r *redisCache) SubscribeInvalidations(ctx context.Context, channel string, handler func(prefix string)) error {
+	sub := r.client.Subscribe(ctx, channel)
+	receiveCtx, cancelFunc := context.WithTimeout(ctx, r.getTimeout)
+	defer cancelFunc()
+	if _, err := sub.Receive(receiveCtx); err != nil {
+		sub.Close()
+		return fmt.Errorf("cannot subscribe to %q: %w", channel, err)
+	}
+	go func() {
+		defer sub.Close()
+		ch := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+				handler(msg.Payload)
+			}
+		}
+	}()
+	return nil
+}
+
 type redisStreamReader struct {
 	isRedisEOF          bool
 	redisOffset         uint64                // the redisOffset that gives the beginning of the next bulk to fetch
@@ -336,9 +519,15 @@ type redisStreamReader struct {
 	client              redis.UniversalClient // the redis client
 	expectedPayloadSize int                   // the size of the object the streamer is supposed to read.
 	readPayloadSize     int                   // the size of the object currently written by the reader
+	getTimeout          time.Duration         // the timeout of every fetch from redis
+
+	// metadataPrefix is set if the metadata and the length of the value are fetched
+	// along with every bulk, so the value expiring or replaced while it is read is detected.
+	// The metadata of the value contains the version unique for every Put of the value.
+	metadataPrefix []byte
 }
 
-func newRedisStreamReader(offset uint64, client redis.UniversalClient, key string, payloadSize int64) *redisStreamReader {
+func newRedisStreamReader(offset uint64, client redis.UniversalClient, key string, payloadSize int64, getTimeout time.Duration) *redisStreamReader {
 	bufferSize := uint64(2 * 1024 * 1024)
 	return &redisStreamReader{
 		isRedisEOF:          false,
@@ -348,7 +537,37 @@ func newRedisStreamReader(offset uint64, client redis.UniversalClient, key strin
 		buffer:              make([]byte, bufferSize),
 		client:              client,
 		expectedPayloadSize: int(payloadSize),
+		getTimeout:          getTimeout,
+	}
+}
+
+// extendTTL extends the TTL of the value to minTTL, so it doesn't expire while it is read.
+//
+// The extended TTL isn't restored once the value is read, since other readers
+// may still read the value then. So the value may be served for up to minTTL
+// after it should have expired.
+func (r *redisStreamReader) extendTTL(minTTL time.Duration) error {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), r.getTimeout)
+	defer cancelFunc()
+	ok, err := r.client.PExpire(ctx, r.key, minTTL).Result()
+	if err != nil {
+		return &RedisCacheError{key: r.key, expectedPayloadSize: r.expectedPayloadSize, rootcause: err}
 	}
+	if !ok {
+		// The value has expired since it was fetched.
+		return ErrMissing
+	}
+	return nil
+}
+
+// checkVersion makes the reader fail once the value with the given
+// metadataPrefix expires or is replaced while it is read.
+func (r *redisStreamReader) checkVersion(metadataPrefix []byte) {
+	r.metadataPrefix = metadataPrefix
+}
+
+func (r *redisStreamReader) Close() error {
+	return nil
 }
 
 func (r *redisStreamReader) Read(destBuf []byte) (n int, err error) {
@@ -386,9 +605,25 @@ func (r *redisStreamReader) Read(destBuf []byte) (n int, err error) {
 }
 
 func (r *redisStreamReader) readRangeFromRedis(bufSize int) error {
-	ctx, cancelFunc := context.WithTimeout(context.Background(), getTimeout)
+	ctx, cancelFunc := context.WithTimeout(context.Background(), r.getTimeout)
 	defer cancelFunc()
-	newBuf, err := r.client.GetRange(ctx, r.key, int64(r.redisOffset), int64(r.redisOffset+uint64(bufSize))).Result()
+	start, end := int64(r.redisOffset), int64(r.redisOffset+uint64(bufSize))
+	var (
+		newBuf   string
+		metadata string
+		length   int64
+		err      error
+	)
+	if r.metadataPrefix != nil {
+		pipe := r.client.Pipeline()
+		getRange := pipe.GetRange(ctx, r.key, start, end)
+		getMetadata := pipe.GetRange(ctx, r.key, 0, int64(len(r.metadataPrefix))-1)
+		strLen := pipe.StrLen(ctx, r.key)
+		_, err = pipe.Exec(ctx)
+		newBuf, metadata, length = getRange.Val(), getMetadata.Val(), strLen.Val()
+	} else {
+		newBuf, err = r.client.GetRange(ctx, r.key, start, end).Result()
+	}
 	r.redisOffset += uint64(len(newBuf))
 	if errors.Is(err, redis.Nil) || len(newBuf) == 0 {
 		r.isRedisEOF = true
@@ -406,47 +641,26 @@ func (r *redisStreamReader) readRangeFromRedis(bufSize int) error {
 		return err2
 	}
 
+	if r.metadataPrefix != nil {
+		// The metadata of the missing value is empty, and the metadata
+		// of the replaced value has another version. Legacy values without
+		// the version are replaced by values of other lengths at least.
+		expectedLength := int64(len(r.metadataPrefix) + r.expectedPayloadSize)
+		if metadata != string(r.metadataPrefix) || length != expectedLength {
+			log.Debugf("redis key %s has expired or has been replaced while it was read", r.key)
+			return &RedisCacheError{key: r.key, readPayloadSize: r.readPayloadSize,
+				expectedPayloadSize: r.expectedPayloadSize, rootcause: errRedisValueChanged}
+		}
+	}
+
 	r.bufferOffset = 0
 	r.buffer = []byte(newBuf)
 	return nil
 }
 
-type fileWriterReader struct {
-	f *os.File
-}
-
-func newFileWriterReader(dir string) (*fileWriterReader, error) {
-	f, err := os.CreateTemp(dir, redisTmpFilePrefix)
-	if err != nil {
-		return nil, fmt.Errorf("cannot create temporary file in %q: %w", dir, err)
-	}
-	return &fileWriterReader{
-		f: f,
-	}, nil
-}
-
-func (r *fileWriterReader) Close() error {
-	err := r.f.Close()
-	if err != nil {
-		return err
-	}
-	return os.Remove(r.f.Name())
-}
-
-func (r *fileWriterReader) Read(destBuf []byte) (n int, err error) {
-	return r.f.Read(destBuf)
-}
-
-func (r *fileWriterReader) Write(p []byte) (n int, err error) {
-	return r.f.Write(p)
-}
-
-func (r *fileWriterReader) resetOffset() error {
-	if _, err := r.f.Seek(0, io.SeekStart); err != nil {
-		return fmt.Errorf("cannot reset offset in: %w", err)
-	}
-	return nil
-}
+// errRedisValueChanged is the root cause of RedisCacheError
+// for values expiring or replaced while they are read.
+var errRedisValueChanged = errors.New("the value has expired or has been replaced while it was read")
 
 type RedisCacheError struct {
 	key                 string
@@ -1,10 +1,13 @@
 package cache
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
-	"os"
+	"net"
+	"net/http"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -82,6 +85,138 @@ func TestRedisCacheMiss(t *testing.T) {
 	c := getRedisCache(t)
 	cacheMissHelper(t, c)
 }
+func TestRedisCacheStale(t *testing.T) {
+	s := miniredis.RunT(t)
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs: []string{s.Addr()},
+	})
+	cfg := redisConf
+	cfg.StaleWhileRevalidate = config.Duration(time.Minute)
+	c := newRedisCache(redisClient, cfg)
+	defer c.Close()
+
+	key := &Key{Query: []byte("SELECT stale")}
+	if _, err := c.Put(strings.NewReader("an object"), ContentMetadata{Length: 9}, key); err != nil {
+		t.Fatalf("failed to put it to cache: %s", err)
+	}
+
+	cachedData, err := c.Get(key)
+	if err != nil {
+		t.Fatalf("failed to get data from redis cache: %s", err)
+	}
+	if cachedData.Stale || cachedData.Ttl != cacheTTL {
+		t.Fatalf("expecting fresh entry with ttl %s; got stale=%v, ttl %s", cacheTTL, cachedData.Stale, cachedData.Ttl)
+	}
+
+	s.FastForward(cacheTTL + time.Second)
+	cachedData, err = c.Get(key)
+	if err != nil {
+		t.Fatalf("failed to get stale data from redis cache: %s", err)
+	}
+	if !cachedData.Stale {
+		t.Fatalf("expecting stale entry; got ttl %s", cachedData.Ttl)
+	}
+
+	s.FastForward(time.Minute)
+	if _, err = c.Get(key); err != ErrMissing {
+		t.Fatalf("unexpected error: %v; expecting %s", err, ErrMissing)
+	}
+}
+
+func TestRedisCacheKeyPrefix(t *testing.T) {
+	s := miniredis.RunT(t)
+	newCache := func(keyPrefix string) *redisCache {
+		redisClient := redis.NewUniversalClient(&redis.UniversalOptions{
+			Addrs: []string{s.Addr()},
+		})
+		cfg := redisConf
+		cfg.KeyPrefix = keyPrefix
+		return newRedisCache(redisClient, cfg)
+	}
+	dev, prod := newCache("dev"), newCache("prod")
+	defer dev.Close()
+	defer prod.Close()
+
+	key := &Key{Query: []byte("SELECT key prefix")}
+	if _, err := dev.Put(strings.NewReader("an object"), ContentMetadata{Length: 9}, key); err != nil {
+		t.Fatalf("failed to put it to cache: %s", err)
+	}
+	if !s.Exists("dev:" + key.String()) {
+		t.Fatalf("expecting the entry under the prefixed key; got keys %v", s.Keys())
+	}
+	cachedData, err := dev.Get(key)
+	if err != nil {
+		t.Fatalf("failed to get data from redis cache: %s", err)
+	}
+	cachedData.Data.Close()
+	if _, err := prod.Get(key); err != ErrMissing {
+		t.Fatalf("unexpected error: %v; expecting %s", err, ErrMissing)
+	}
+}
+
+func TestRedisCacheExpireJitter(t *testing.T) {
+	s := miniredis.RunT(t)
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs: []string{s.Addr()},
+	})
+	cfg := redisConf
+	cfg.ExpireJitter = config.Duration(time.Minute)
+	c := newRedisCache(redisClient, cfg)
+	defer c.Close()
+
+	for i := 0; i < 10; i++ {
+		key := &Key{Query: []byte(fmt.Sprintf("SELECT %d", i))}
+		ttl, err := c.Put(strings.NewReader("an object"), ContentMetadata{Length: 9}, key)
+		if err != nil {
+			t.Fatalf("failed to put it to cache: %s", err)
+		}
+		if ttl < cacheTTL || ttl >= cacheTTL+time.Minute {
+			t.Fatalf("unexpected ttl %s; expecting it in range [%s, %s)", ttl, cacheTTL, cacheTTL+time.Minute)
+		}
+		// redis stores ttl with millisecond precision.
+		if redisTTL := s.TTL(key.String()); redisTTL != ttl.Truncate(time.Millisecond) {
+			t.Fatalf("unexpected redis ttl %s; expecting %s", redisTTL, ttl.Truncate(time.Millisecond))
+		}
+	}
+}
+
+func TestRedisCacheGetTimeout(t *testing.T) {
+	// The listener accepts connections but never responds,
+	// so every redis command is timed out.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs:                 []string{ln.Addr().String()},
+		ContextTimeoutEnabled: true,
+	})
+	cfg := redisConf
+	cfg.Redis.GetTimeout = config.Duration(100 * time.Millisecond)
+	c := newRedisCache(redisClient, cfg)
+	defer c.Close()
+
+	start := time.Now()
+	_, err = c.Get(&Key{Query: []byte("SELECT timeout")})
+	if !errors.Is(err, ErrMissing) {
+		t.Fatalf("expecting cache miss; got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("expecting Get to be timed out after get_timeout; took %s", d)
+	}
+}
+
 func TestStringFromToByte(t *testing.T) {
 	c := getRedisCache(t)
 	b := c.encodeString("test")
@@ -102,7 +237,7 @@ func TestMetadataFromToByte(t *testing.T) {
 		Encoding: "gzip",
 	}
 
-	b := c.encodeMetadata(expectedMetadata)
+	b := c.encodeMetadata(expectedMetadata, 0)
 
 	metadata, size, _ := c.decodeMetadata(b)
 	if metadata.Encoding != expectedMetadata.Encoding {
@@ -118,7 +253,61 @@ func TestMetadataFromToByte(t *testing.T) {
 		t.Fatalf("got: %d, expected %d", size, 24)
 	}
 
+	// The version follows the rest of the metadata.
+	b = c.encodeMetadata(expectedMetadata, 42)
+	metadata, size, err := c.decodeMetadata(b)
+	if err != nil {
+		t.Fatalf("cannot decode metadata with version: %s", err)
+	}
+	if !reflect.DeepEqual(metadata, expectedMetadata) {
+		t.Fatalf("got: %+v, expected %+v", *metadata, *expectedMetadata)
+	}
+	if size != 32 {
+		t.Fatalf("got: %d, expected %d", size, 32)
+	}
+	if _, _, err := c.decodeMetadata(b[:len(b)-1]); !errors.Is(err, &RedisCacheCorruptionError{}) {
+		t.Fatalf("expected a corruption error, err=%s", err)
+	}
+}
+func TestRedisCacheHeaders(t *testing.T) {
+	c := getRedisCache(t)
+	defer c.Close()
+	cacheHeadersHelper(t, c)
+}
+
+func TestDecodingLegacyMetadata(t *testing.T) {
+	c := getRedisCache(t)
+
+	// Metadata written before headers were cached has no metadataHeadersFlag.
+	b := []byte{0, 0, 0, 0, 0, 0, 0, 12}
+	b = append(b, c.encodeString("json")...)
+	b = append(b, c.encodeString("gzip")...)
+	metadata, size, err := c.decodeMetadata(b)
+	if err != nil {
+		t.Fatalf("cannot decode legacy metadata: %s", err)
+	}
+	expected := ContentMetadata{Length: 12, Type: "json", Encoding: "gzip"}
+	if !reflect.DeepEqual(*metadata, expected) {
+		t.Fatalf("got: %+v, expected %+v", *metadata, expected)
+	}
+	if size != len(b) {
+		t.Fatalf("got: %d, expected %d", size, len(b))
+	}
+
+	// Metadata without headers is encoded in the legacy format.
+	if encoded := c.encodeMetadata(&expected, 0); !bytes.Equal(encoded, b) {
+		t.Fatalf("got: %v, expected %v", encoded, b)
+	}
+
+	// Corrupted headers are reported.
+	expected.Headers = http.Header{"X-Clickhouse-Summary": {"{}"}}
+	encoded := c.encodeMetadata(&expected, 0)
+	_, _, err = c.decodeMetadata(encoded[:len(encoded)-1])
+	if !errors.Is(err, &RedisCacheCorruptionError{}) {
+		t.Fatalf("expected a corruption error, err=%s", err)
+	}
 }
+
 func TestDecodingCorruptedMetadata(t *testing.T) {
 	c := getRedisCache(t)
 
@@ -199,16 +388,21 @@ func TestCorruptedPayloadWhileFetchtingRedis(t *testing.T) {
 	//simulate a value almost expired
 	redis.SetTTL(key.String(), 2*time.Second)
 
-	_, err = cache.Get(key)
+	cachedData, err := cache.Get(key)
+	if err != nil {
+		t.Fatalf("failed to get data from redis cache: %s", err)
+	}
+	_, err = io.ReadAll(cachedData.Data)
 	_, isRedisCacheError := err.(*RedisCacheError)
 	if err == nil || !isRedisCacheError {
 		t.Fatalf("expecting an error of type RedisCacheError, err=%s", err)
 	}
+	cachedData.Data.Close()
 
 	//simulate a value that will not expire soon
 	redis.SetTTL(key.String(), 500*time.Second)
 
-	cachedData, err := cache.Get(key)
+	cachedData, err = cache.Get(key)
 	if err != nil {
 		t.Fatalf("failed to get data from redis cache: %s", err)
 	}
@@ -220,67 +414,156 @@ func TestCorruptedPayloadWhileFetchtingRedis(t *testing.T) {
 	}
 }
 
-func TestSmallTTLOnBigPayloadAreCacheWithFile(t *testing.T) {
+// putBigPayload puts the value, which cannot be fetched by the first GETRANGE, to c.
+func putBigPayload(t *testing.T, c *redisCache, key *Key) string {
+	t.Helper()
+	payloadSize := 4 * 1024 * 1024
+	value := strings.Repeat("a", payloadSize)
+	if _, err := c.Put(strings.NewReader(value), ContentMetadata{Encoding: "ce", Type: "ct", Length: int64(payloadSize)}, key); err != nil {
+		t.Fatalf("failed to put it to cache: %s", err)
+	}
+	return value
+}
+
+func TestSmallTTLOnBigPayloadExtendsTTL(t *testing.T) {
 	cache, redis := getRedisCacheAndServer(t)
 	defer cache.Close()
 	key := &Key{
-		Query: []byte(fmt.Sprintf("SELECT test")),
-	}
-	payloadSize := 4 * 1024 * 1024
-	expectedValue := strings.Repeat("a", payloadSize)
-	reader := strings.NewReader(expectedValue)
-
-	if _, err := cache.Put(reader, ContentMetadata{Encoding: "ce", Type: "ct", Length: int64(payloadSize)}, key); err != nil {
-		t.Fatalf("failed to put it to cache: %s", err)
+		Query: []byte("SELECT test"),
 	}
+	expectedValue := putBigPayload(t, cache, key)
 
 	//simulate a value almost expired
 	redis.SetTTL(key.String(), 2*time.Second)
-	nbFileCacheBeforeGet, err := countFilesWithPrefix(os.TempDir(), redisTmpFilePrefix)
+
+	cachedData, err := cache.Get(key)
 	if err != nil {
-		t.Fatalf("could not read directory %s", err)
+		t.Fatalf("expected cached to have the value")
+	}
+	if ttl := redis.TTL(key.String()); ttl != defaultStreamingMinTTL {
+		t.Fatalf("expected TTL to be extended to %s while the value is read; got %s", defaultStreamingMinTTL, ttl)
 	}
 
-	cachedData, err := cache.Get(key)
+	// The value would have expired while it is read without the extended TTL.
+	redis.FastForward(5 * time.Second)
+	cachedValue, err := io.ReadAll(cachedData.Data)
+	if err != nil {
+		t.Fatalf("could not read data from redis, err=%s", err)
+	}
+	if string(cachedValue) != expectedValue {
+		t.Fatalf("got a value different than the expected one len(value)=%d vs len(expectedValue)=%d", len(cachedValue), len(expectedValue))
+	}
+
+	if err := cachedData.Data.Close(); err != nil {
+		t.Fatalf("cannot close the value: %s", err)
+	}
+	// The extended TTL isn't restored, since the value may still be read by others.
+	if ttl := redis.TTL(key.String()); ttl != defaultStreamingMinTTL-5*time.Second {
+		t.Fatalf("expected the extended TTL to lapse after the value is read; got %s", ttl)
+	}
+}
+
+func TestSmallTTLOnBigPayloadConcurrentReaders(t *testing.T) {
+	cache, redis := getRedisCacheAndServer(t)
+	defer cache.Close()
+	key := &Key{
+		Query: []byte("SELECT test"),
+	}
+	expectedValue := putBigPayload(t, cache, key)
+	redis.SetTTL(key.String(), 2*time.Second)
+
+	first, err := cache.Get(key)
 	if err != nil {
 		t.Fatalf("expected cached to have the value")
 	}
-	nbFileCacheAfterGet, err := countFilesWithPrefix(os.TempDir(), redisTmpFilePrefix)
+	second, err := cache.Get(key)
 	if err != nil {
-		t.Fatalf("could not read directory %s", err)
+		t.Fatalf("expected cached to have the value")
+	}
+	if _, err := io.ReadAll(first.Data); err != nil {
+		t.Fatalf("could not read data from redis, err=%s", err)
+	}
+	if err := first.Data.Close(); err != nil {
+		t.Fatalf("cannot close the value: %s", err)
+	}
+
+	// The value doesn't expire under the second reader once the first one is done.
+	redis.FastForward(5 * time.Second)
+	cachedValue, err := io.ReadAll(second.Data)
+	if err != nil {
+		t.Fatalf("could not read data from redis, err=%s", err)
 	}
-	if nbFileCacheBeforeGet+1 != nbFileCacheAfterGet {
-		t.Fatalf("expected a file to be stored by redisFileCache ")
+	if string(cachedValue) != expectedValue {
+		t.Fatalf("got a value different than the expected one len(value)=%d vs len(expectedValue)=%d", len(cachedValue), len(expectedValue))
 	}
+}
 
+func TestSmallTTLOnBigPayloadVersionCheck(t *testing.T) {
+	s := miniredis.RunT(t)
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs: []string{s.Addr()},
+	})
+	cfg := redisConf
+	cfg.Redis.ShortTTLStreaming = "version_check"
+	cache := newRedisCache(redisClient, cfg)
+	defer cache.Close()
+	key := &Key{
+		Query: []byte("SELECT test"),
+	}
+	expectedValue := putBigPayload(t, cache, key)
+
+	s.SetTTL(key.String(), 2*time.Second)
+	cachedData, err := cache.Get(key)
+	if err != nil {
+		t.Fatalf("expected cached to have the value")
+	}
+	if ttl := s.TTL(key.String()); ttl != 2*time.Second {
+		t.Fatalf("expected TTL to be kept while the value is read; got %s", ttl)
+	}
 	cachedValue, err := io.ReadAll(cachedData.Data)
 	if err != nil {
-		t.Fatalf("could not read data from redisFileCache, err=%s", err)
+		t.Fatalf("could not read data from redis, err=%s", err)
 	}
 	if string(cachedValue) != expectedValue {
-		t.Fatalf("got a value different than the expected one len(value)=%d vs len(expectedValue)=%d", len(string(cachedValue)), len(expectedValue))
+		t.Fatalf("got a value different than the expected one len(value)=%d vs len(expectedValue)=%d", len(cachedValue), len(expectedValue))
 	}
-	cachedData.Data.Close()
-	nbFileCacheAfterClose, err := countFilesWithPrefix(os.TempDir(), redisTmpFilePrefix)
+
+	// The value expires while it is read.
+	cachedData, err = cache.Get(key)
 	if err != nil {
-		t.Fatalf("could not read directory %s", err)
+		t.Fatalf("expected cached to have the value")
+	}
+	s.FastForward(3 * time.Second)
+	_, err = io.ReadAll(cachedData.Data)
+	var redisErr *RedisCacheError
+	if !errors.As(err, &redisErr) {
+		t.Fatalf("expecting an error of type RedisCacheError, err=%s", err)
 	}
 
-	if nbFileCacheBeforeGet != nbFileCacheAfterClose {
-		t.Fatalf("expected the file stored by redisFileCache to be removed: nbFileCacheBeforeGet=%d | nbFileCacheAfterClose=%d", nbFileCacheBeforeGet, nbFileCacheAfterClose)
+	// The value is replaced while it is read.
+	putBigPayload(t, cache, key)
+	s.SetTTL(key.String(), 2*time.Second)
+	cachedData, err = cache.Get(key)
+	if err != nil {
+		t.Fatalf("expected cached to have the value")
+	}
+	putBigPayload(t, cache, key)
+	_, err = io.ReadAll(cachedData.Data)
+	if !errors.As(err, &redisErr) {
+		t.Fatalf("expecting an error of type RedisCacheError, err=%s", err)
 	}
-}
 
-func countFilesWithPrefix(dir, prefix string) (int, error) {
-	count := 0
-	files, err := os.ReadDir(dir)
+	// The value is replaced by the value with the same length and a shorter TTL.
+	putBigPayload(t, cache, key)
+	s.SetTTL(key.String(), 2*time.Second)
+	cachedData, err = cache.Get(key)
 	if err != nil {
-		return 0, err
+		t.Fatalf("expected cached to have the value")
 	}
-	for _, file := range files {
-		if strings.HasPrefix(file.Name(), prefix) {
-			count++
-		}
+	putBigPayload(t, cache, key)
+	s.SetTTL(key.String(), time.Second)
+	_, err = io.ReadAll(cachedData.Data)
+	if !errors.As(err, &redisErr) {
+		t.Fatalf("expecting an error of type RedisCacheError, err=%s", err)
 	}
-	return count, nil
 }
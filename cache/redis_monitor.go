@@ -0,0 +1,159 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/contentsquare/chproxy/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// redisPingInterval is the interval between background pings of redis caches.
+	redisPingInterval = 5 * time.Second
+
+	// redisPingTimeout is the timeout of background pings.
+	redisPingTimeout = time.Second
+)
+
+// Operations of redis_errors_total.
+const (
+	redisOperationGet = "get"
+	redisOperationPut = "put"
+	redisOperationDel = "del"
+)
+
+// redisMonitor pings the redis cache in background and exposes
+// whether it is alive and for how long it has been in this state.
+type redisMonitor struct {
+	cache  string
+	client redis.UniversalClient
+
+	alive bool
+	// since is the time the cache has entered its current state.
+	since time.Time
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// startRedisMonitor starts pinging the redis cache every interval.
+// The cache is considered alive initially, since the client
+// has pinged redis on creation.
+func startRedisMonitor(cache string, client redis.UniversalClient, interval time.Duration) *redisMonitor {
+	m := &redisMonitor{
+		cache:  cache,
+		client: client,
+		alive:  true,
+		since:  time.Now(),
+		stop:   make(chan struct{}),
+	}
+	m.setState(m.since)
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		for {
+			select {
+			case <-time.After(interval):
+				m.check()
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+	return m
+}
+
+func (m *redisMonitor) Close() {
+	close(m.stop)
+	m.wg.Wait()
+}
+
+// check pings redis and updates the state of the cache.
+func (m *redisMonitor) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), redisPingTimeout)
+	defer cancel()
+	start := time.Now()
+	err := m.client.Ping(ctx).Err()
+	now := time.Now()
+	RedisPingDuration.With(prometheus.Labels{"cache": m.cache}).Observe(now.Sub(start).Seconds())
+
+	alive := err == nil
+	if alive != m.alive {
+		if alive {
+			log.Warnf("redis cache %q is alive again after being dead for %s", m.cache, now.Sub(m.since))
+		} else {
+			log.Warnf("redis cache %q is dead after being alive for %s: %s", m.cache, now.Sub(m.since), err)
+		}
+		m.alive = alive
+		m.since = now
+	}
+	m.setState(now)
+}
+
+func (m *redisMonitor) setState(now time.Time) {
+	labels := prometheus.Labels{"cache": m.cache}
+	alive := 0.0
+	if m.alive {
+		alive = 1
+	}
+	CacheAlive.With(labels).Set(alive)
+	CacheAliveDuration.With(labels).Set(now.Sub(m.since).Seconds())
+}
+
+// reconnectionsHook counts the connections to redis established
+// after connection failures.
+type reconnectionsHook struct {
+	cache string
+	// broken is set once a connection fails until a new one is established.
+	broken atomic.Bool
+}
+
+func (h *reconnectionsHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := next(ctx, network, addr)
+		if err != nil {
+			h.broken.Store(true)
+			return nil, err
+		}
+		if h.broken.CompareAndSwap(true, false) {
+			RedisReconnections.With(prometheus.Labels{"cache": h.cache}).Inc()
+		}
+		return conn, nil
+	}
+}
+
+func (h *reconnectionsHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := next(ctx, cmd)
+		h.checkErr(err)
+		return err
+	}
+}
+
+func (h *reconnectionsHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		err := next(ctx, cmds)
+		h.checkErr(err)
+		return err
+	}
+}
+
+// checkErr marks the connection as broken if err isn't a reply of redis.
+func (h *reconnectionsHook) checkErr(err error) {
+	var redisErr redis.Error
+	if err == nil || errors.Is(err, redis.Nil) || errors.As(err, &redisErr) {
+		return
+	}
+	h.broken.Store(true)
+}
+
+// countError counts the failed redis operation of the cache.
+func (r *redisCache) countError(operation string) {
+	RedisErrors.With(prometheus.Labels{"cache": r.name, "operation": operation}).Inc()
+}
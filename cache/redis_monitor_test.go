@@ -0,0 +1,78 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisMonitor(t *testing.T) {
+	s := miniredis.RunT(t)
+	client := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs:      []string{s.Addr()},
+		MaxRetries: -1,
+	})
+	t.Cleanup(func() { client.Close() })
+
+	labels := prometheus.Labels{"cache": "monitored"}
+	m := startRedisMonitor("monitored", client, time.Millisecond)
+	defer m.Close()
+	alive := func(v float64) func() bool {
+		return func() bool { return testutil.ToFloat64(CacheAlive.With(labels)) == v }
+	}
+	assert.True(t, alive(1)())
+
+	s.Close()
+	assert.Eventually(t, alive(0), 5*time.Second, time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(CacheAliveDuration.With(labels)) > 0
+	}, 5*time.Second, time.Millisecond)
+
+	if err := s.Restart(); err != nil {
+		t.Fatalf("cannot restart redis: %s", err)
+	}
+	assert.Eventually(t, alive(1), 5*time.Second, time.Millisecond)
+	assert.Positive(t, testutil.CollectAndCount(RedisPingDuration, "redis_ping_duration_seconds"))
+}
+
+func TestRedisReconnectionsAndErrors(t *testing.T) {
+	s := miniredis.RunT(t)
+	client := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs:      []string{s.Addr()},
+		MaxRetries: -1,
+	})
+	client.AddHook(&reconnectionsHook{cache: redisConf.Name})
+	c := newRedisCache(client, redisConf)
+	defer c.Close()
+
+	reconnections := RedisReconnections.With(prometheus.Labels{"cache": redisConf.Name})
+	getErrors := RedisErrors.With(prometheus.Labels{"cache": redisConf.Name, "operation": redisOperationGet})
+	reconnectionsBefore := testutil.ToFloat64(reconnections)
+	getErrorsBefore := testutil.ToFloat64(getErrors)
+
+	key := &Key{Query: []byte("SELECT reconnect")}
+	if _, err := c.Get(key); err != ErrMissing {
+		t.Fatalf("expected ErrMissing; got %v", err)
+	}
+	assert.Equal(t, getErrorsBefore, testutil.ToFloat64(getErrors), "missing keys aren't errors")
+
+	s.Close()
+	if _, err := c.Get(key); err != ErrMissing {
+		t.Fatalf("expected ErrMissing; got %v", err)
+	}
+	assert.Equal(t, getErrorsBefore+1, testutil.ToFloat64(getErrors))
+	assert.Equal(t, reconnectionsBefore, testutil.ToFloat64(reconnections))
+
+	if err := s.Restart(); err != nil {
+		t.Fatalf("cannot restart redis: %s", err)
+	}
+	if _, err := c.Get(key); err != ErrMissing {
+		t.Fatalf("expected ErrMissing; got %v", err)
+	}
+	assert.Equal(t, reconnectionsBefore+1, testutil.ToFloat64(reconnections))
+}
@@ -0,0 +1,150 @@
+package cache
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/contentsquare/chproxy/log"
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultPipelineMaxCmds is the maximum number of reads sent in a single
+// pipeline, used unless `pipeline_max_cmds` is set in the config.
+const defaultPipelineMaxCmds = 100
+
+// pipelinedRedisCache is the redis cache batching concurrent reads.
+//
+// Reads issued during pipelineWindow are sent to redis in a single
+// MULTI/EXEC pipeline, so bursts of cache lookups cost a single round trip.
+type pipelinedRedisCache struct {
+	*redisCache
+
+	window  time.Duration
+	maxCmds int
+
+	gets chan *pipelinedGet
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// pipelinedGet is the read waiting to be sent in the pipeline.
+type pipelinedGet struct {
+	key    string
+	result chan pipelinedGetResult
+}
+
+type pipelinedGetResult struct {
+	val string
+	ttl time.Duration
+	err error
+}
+
+func newPipelinedRedisCache(r *redisCache, window time.Duration, maxCmds int) *pipelinedRedisCache {
+	if maxCmds <= 0 {
+		maxCmds = defaultPipelineMaxCmds
+	}
+	p := &pipelinedRedisCache{
+		redisCache: r,
+		window:     window,
+		maxCmds:    maxCmds,
+		gets:       make(chan *pipelinedGet),
+		stop:       make(chan struct{}),
+	}
+	p.wg.Add(1)
+	go p.run()
+	return p
+}
+
+func (p *pipelinedRedisCache) Close() error {
+	close(p.stop)
+	p.wg.Wait()
+	return p.redisCache.Close()
+}
+
+func (p *pipelinedRedisCache) Get(key *Key) (*CachedData, error) {
+	stringKey := prefixedKey(p.keyPrefix, key.String())
+	g := &pipelinedGet{
+		key:    stringKey,
+		result: make(chan pipelinedGetResult, 1),
+	}
+	select {
+	case p.gets <- g:
+	case <-p.stop:
+		return nil, ErrMissing
+	}
+	res := <-g.result
+
+	// errors, such as timeouts
+	if res.err != nil {
+		p.countError(redisOperationGet)
+		log.Errorf("failed to get key %s with error: %s", stringKey, res.err)
+		return nil, ErrMissing
+	}
+	// if key not found in cache
+	if len(res.val) == 0 {
+		return nil, ErrMissing
+	}
+	return p.decodeValue(stringKey, res.val, res.ttl)
+}
+
+// run accumulates the reads until the window elapses or maxCmds reads
+// are collected, and then sends them to redis.
+func (p *pipelinedRedisCache) run() {
+	defer p.wg.Done()
+	for {
+		var batch []*pipelinedGet
+		select {
+		case g := <-p.gets:
+			batch = append(batch, g)
+		case <-p.stop:
+			return
+		}
+
+		timer := time.NewTimer(p.window)
+	collect:
+		for len(batch) < p.maxCmds {
+			select {
+			case g := <-p.gets:
+				batch = append(batch, g)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		// The batch is sent in background, so the next batch
+		// is accumulated while waiting for the response.
+		p.wg.Add(1)
+		go p.exec(batch)
+	}
+}
+
+// exec sends the batch of reads in a single pipeline
+// and fans the results back to the waiting reads.
+func (p *pipelinedRedisCache) exec(batch []*pipelinedGet) {
+	defer p.wg.Done()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), p.getTimeout)
+	defer cancelFunc()
+
+	getRanges := make([]*redis.StringCmd, len(batch))
+	ttls := make([]*redis.DurationCmd, len(batch))
+	// The error is ignored, since it is the error of the first failed
+	// command, while the errors of all the commands are checked below.
+	_, _ = p.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, g := range batch {
+			getRanges[i] = pipe.GetRange(ctx, g.key, 0, nbBytesToFetch)
+			ttls[i] = pipe.TTL(ctx, g.key)
+		}
+		return nil
+	})
+
+	for i, g := range batch {
+		var res pipelinedGetResult
+		res.val, res.err = getRanges[i].Result()
+		if res.err == nil {
+			res.ttl, res.err = ttls[i].Result()
+		}
+		g.result <- res
+	}
+}
@@ -0,0 +1,156 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// roundTripsHook counts the round trips to redis.
+type roundTripsHook struct {
+	roundTrips atomic.Int64
+}
+
+func (h *roundTripsHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h *roundTripsHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		h.roundTrips.Add(1)
+		return next(ctx, cmd)
+	}
+}
+
+func (h *roundTripsHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		h.roundTrips.Add(1)
+		return next(ctx, cmds)
+	}
+}
+
+func getPipelinedRedisCache(t testing.TB, s *miniredis.Miniredis, window time.Duration) (Cache, *roundTripsHook) {
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs: []string{s.Addr()},
+	})
+	hook := &roundTripsHook{}
+	redisClient.AddHook(hook)
+	var c Cache = newRedisCache(redisClient, redisConf)
+	if window > 0 {
+		c = newPipelinedRedisCache(c.(*redisCache), window, 0)
+	}
+	return c, hook
+}
+
+func TestPipelinedRedisCacheAddGet(t *testing.T) {
+	c, _ := getPipelinedRedisCache(t, miniredis.RunT(t), time.Millisecond)
+	defer c.Close()
+	cacheAddGetHelper(t, c)
+}
+
+func TestPipelinedRedisCacheMiss(t *testing.T) {
+	c, _ := getPipelinedRedisCache(t, miniredis.RunT(t), time.Millisecond)
+	defer c.Close()
+	cacheMissHelper(t, c)
+}
+
+func TestPipelinedRedisCacheGetAfterClose(t *testing.T) {
+	c, _ := getPipelinedRedisCache(t, miniredis.RunT(t), time.Millisecond)
+	c.Close()
+	if _, err := c.Get(&Key{Query: []byte("SELECT closed")}); err != ErrMissing {
+		t.Fatalf("unexpected error: %v; expecting %s", err, ErrMissing)
+	}
+}
+
+func TestPipelinedRedisCacheConcurrentGet(t *testing.T) {
+	const concurrency = 50
+
+	s := miniredis.RunT(t)
+	var durations [2]time.Duration
+	var roundTrips [2]int64
+	for i, window := range []time.Duration{0, 10 * time.Millisecond} {
+		c, hook := getPipelinedRedisCache(t, s, window)
+		for j := 0; j < concurrency; j++ {
+			key := &Key{Query: []byte(fmt.Sprintf("SELECT %d", j))}
+			value := fmt.Sprintf("value %d", j)
+			if _, err := c.Put(strings.NewReader(value), ContentMetadata{Length: int64(len(value))}, key); err != nil {
+				t.Fatalf("failed to put it to cache: %s", err)
+			}
+		}
+		hook.roundTrips.Store(0)
+
+		var wg sync.WaitGroup
+		errs := make(chan error, concurrency)
+		start := time.Now()
+		for j := 0; j < concurrency; j++ {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				key := &Key{Query: []byte(fmt.Sprintf("SELECT %d", j))}
+				cachedData, err := c.Get(key)
+				if err != nil {
+					errs <- fmt.Errorf("failed to get data from cache: %w", err)
+					return
+				}
+				defer cachedData.Data.Close()
+				value, err := io.ReadAll(cachedData.Data)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if expected := fmt.Sprintf("value %d", j); string(value) != expected {
+					errs <- fmt.Errorf("unexpected value %q; expecting %q", value, expected)
+				}
+			}(j)
+		}
+		wg.Wait()
+		durations[i] = time.Since(start)
+		roundTrips[i] = hook.roundTrips.Load()
+		close(errs)
+		for err := range errs {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+
+	t.Logf("%d concurrent reads without pipelining: %s, %d round trips", concurrency, durations[0], roundTrips[0])
+	t.Logf("%d concurrent reads with pipelining: %s, %d round trips", concurrency, durations[1], roundTrips[1])
+	if roundTrips[0] != 2*concurrency {
+		t.Fatalf("unexpected number of round trips without pipelining: %d; expecting %d", roundTrips[0], 2*concurrency)
+	}
+	if roundTrips[1] >= concurrency {
+		t.Fatalf("expecting pipelining to batch the reads; got %d round trips for %d reads", roundTrips[1], concurrency)
+	}
+}
+
+func BenchmarkRedisCacheConcurrentGet(b *testing.B) {
+	s := miniredis.RunT(b)
+	for _, window := range []time.Duration{0, time.Millisecond} {
+		b.Run(fmt.Sprintf("pipeline_window=%s", window), func(b *testing.B) {
+			c, _ := getPipelinedRedisCache(b, s, window)
+			defer c.Close()
+			key := &Key{Query: []byte("SELECT 1")}
+			if _, err := c.Put(strings.NewReader("value"), ContentMetadata{Length: 5}, key); err != nil {
+				b.Fatalf("failed to put it to cache: %s", err)
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					cachedData, err := c.Get(key)
+					if err != nil {
+						b.Fatalf("failed to get data from cache: %s", err)
+					}
+					cachedData.Data.Close()
+				}
+			})
+		})
+	}
+}
@@ -2,6 +2,7 @@ package cache
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -19,12 +20,23 @@ type TmpFileResponseWriter struct {
 	contentType     string
 	contentEncoding string
 	headersCaptured bool
-	statusCode      int
+	// cachedHeaders are the names of the response headers to capture.
+	cachedHeaders []string
+	headers       http.Header
+	statusCode    int
 
 	tmpFile *os.File      // temporary file for response streaming
 	bw      *bufio.Writer // buffered writer for the temporary file
+
+	maxSize      int64 // maximum size of the response, zero means no limit
+	written      int64 // the amount of bytes written to the temporary file
+	sizeExceeded bool
 }
 
+// ErrResponseTooLarge is returned by TmpFileResponseWriter.Write
+// when the response exceeds the size set via SetMaxSize.
+var ErrResponseTooLarge = errors.New("response size limit exceeded")
+
 func NewTmpFileResponseWriter(rw http.ResponseWriter, dir string) (*TmpFileResponseWriter, error) {
 	_, ok := rw.(http.CloseNotifier)
 	if !ok {
@@ -99,9 +111,32 @@ func (rw *TmpFileResponseWriter) captureHeaders() error {
 	rw.contentEncoding = ce
 	rw.contentType = ct
 	// nb: the Content-Length http header is not set by CH so we can't get it
+
+	for _, name := range rw.cachedHeaders {
+		values := h.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+		if rw.headers == nil {
+			rw.headers = make(http.Header, len(rw.cachedHeaders))
+		}
+		rw.headers[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+	}
 	return nil
 }
 
+// SetCachedHeaders sets the names of the response headers
+// captured along with the response.
+func (rw *TmpFileResponseWriter) SetCachedHeaders(names []string) {
+	rw.cachedHeaders = names
+}
+
+// GetCapturedHeaders returns the response headers set via SetCachedHeaders.
+// It returns nil if none of them is present in the response.
+func (rw *TmpFileResponseWriter) GetCapturedHeaders() http.Header {
+	return rw.headers
+}
+
 func (rw *TmpFileResponseWriter) GetCapturedContentType() string {
 	return rw.contentType
 }
@@ -152,10 +187,26 @@ func (rw *TmpFileResponseWriter) StatusCode() int {
 	return rw.statusCode
 }
 
+// SetMaxSize limits the size of the response written into rw.
+func (rw *TmpFileResponseWriter) SetMaxSize(maxSize int64) {
+	rw.maxSize = maxSize
+}
+
+// SizeExceeded returns true if the response exceeded the size set via SetMaxSize.
+func (rw *TmpFileResponseWriter) SizeExceeded() bool {
+	return rw.sizeExceeded
+}
+
 // Write writes b into rw.
 func (rw *TmpFileResponseWriter) Write(b []byte) (int, error) {
 	if err := rw.captureHeaders(); err != nil {
 		return 0, err
 	}
-	return rw.bw.Write(b)
+	if rw.maxSize > 0 && rw.written+int64(len(b)) > rw.maxSize {
+		rw.sizeExceeded = true
+		return 0, ErrResponseTooLarge
+	}
+	n, err := rw.bw.Write(b)
+	rw.written += int64(n)
+	return n, err
 }
@@ -1,10 +1,12 @@
 package cache
 
 import (
+	"errors"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"reflect"
 	"testing"
 )
 
@@ -126,6 +128,25 @@ func TestWriteThenReadHeader(t *testing.T) {
 
 }
 
+func TestWriteThenReadCachedHeaders(t *testing.T) {
+	srw := newFakeResponse()
+	srw.headers.Set("X-ClickHouse-Summary", "summary")
+	srw.headers.Set("X-ClickHouse-Server-Display-Name", "node")
+
+	tmpFileRespWriter, err := NewTmpFileResponseWriter(srw, testTmpWriterDir)
+	if err != nil {
+		t.Fatalf("could not initate TmpFileResponseWriter error:%s", err)
+	}
+	defer tmpFileRespWriter.Close()
+	tmpFileRespWriter.SetCachedHeaders([]string{"x-clickhouse-summary", "X-ClickHouse-Format"})
+	tmpFileRespWriter.Write([]byte("test"))
+
+	expected := http.Header{"X-Clickhouse-Summary": {"summary"}}
+	if h := tmpFileRespWriter.GetCapturedHeaders(); !reflect.DeepEqual(h, expected) {
+		t.Fatalf("wrong value for captured headers, got %v, expected %v", h, expected)
+	}
+}
+
 func TestWriteThenReadContent(t *testing.T) {
 	srw := newFakeResponse()
 
@@ -188,3 +209,34 @@ func TestWriteThenReadStatusCode(t *testing.T) {
 	}
 
 }
+
+func TestWriteMaxSize(t *testing.T) {
+	srw := newFakeResponse()
+
+	tmpFileRespWriter, err := NewTmpFileResponseWriter(srw, testTmpWriterDir)
+	if err != nil {
+		t.Fatalf("could not initate TmpFileResponseWriter error:%s", err)
+	}
+	defer tmpFileRespWriter.Close()
+	tmpFileRespWriter.SetMaxSize(10)
+
+	if _, err := tmpFileRespWriter.Write([]byte("0123456789")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if tmpFileRespWriter.SizeExceeded() {
+		t.Fatalf("the size mustn't be exceeded")
+	}
+	if _, err := tmpFileRespWriter.Write([]byte("a")); !errors.Is(err, ErrResponseTooLarge) {
+		t.Fatalf("expecting error %q; got %v", ErrResponseTooLarge, err)
+	}
+	if !tmpFileRespWriter.SizeExceeded() {
+		t.Fatalf("the size must be exceeded")
+	}
+	cLength, err := tmpFileRespWriter.GetCapturedContentLength()
+	if err != nil {
+		t.Fatalf("could not get ContentLength error:%s", err)
+	}
+	if cLength != 10 {
+		t.Fatalf("wrong value for contentLength, got %d, expected %d", cLength, 10)
+	}
+}
@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"errors"
 	"io"
 	"time"
 )
@@ -9,8 +10,8 @@ import (
 type TransactionRegistry interface {
 	io.Closer
 
-	// Create creates a new transaction record
-	Create(key *Key) error
+	// Create creates a new transaction record of the given user
+	Create(key *Key, user string) error
 
 	// Complete completes a transaction for given key
 	Complete(key *Key) error
@@ -20,6 +21,31 @@ type TransactionRegistry interface {
 
 	// Status checks the status of the transaction
 	Status(key *Key) (TransactionStatus, error)
+
+	// List returns pending transactions
+	List() ([]PendingTransaction, error)
+
+	// Resolve completes the pending transaction with the given key hash
+	// or fails it if failReason isn't empty.
+	// ErrTransactionNotPending is returned if there is no such pending transaction.
+	Resolve(keyHash, failReason string) error
+}
+
+// ErrTransactionNotPending is returned by Resolve for transactions,
+// which are absent or have been already ended.
+var ErrTransactionNotPending = errors.New("transaction isn't pending")
+
+// PendingTransaction describes the transaction of the query running at the moment.
+type PendingTransaction struct {
+	// KeyHash is the hash of the Key of the query, see Key.String
+	KeyHash string
+
+	// User is the user the query is run by
+	User string
+
+	// Created is the time the transaction is created at.
+	// It is zero for transactions created by older versions of chproxy.
+	Created time.Time
 }
 
 // transactionEndedTTL amount of time transaction record is kept after being updated
@@ -11,6 +11,8 @@ type pendingEntry struct {
 	deadline     time.Time
 	state        TransactionState
 	failedReason string
+	user         string
+	created      time.Time
 }
 
 type inMemoryTransactionRegistry struct {
@@ -43,15 +45,19 @@ func newInMemoryTransactionRegistry(deadline, transactionEndedDeadline time.Dura
 	return transaction
 }
 
-func (i *inMemoryTransactionRegistry) Create(key *Key) error {
+func (i *inMemoryTransactionRegistry) Create(key *Key, user string) error {
 	i.pendingEntriesLock.Lock()
 	defer i.pendingEntriesLock.Unlock()
 	k := key.String()
-	_, exists := i.pendingEntries[k]
-	if !exists {
+	// Ended transactions are kept for a while, so they are replaced
+	// by the new one, as the redis registry does.
+	if entry, exists := i.pendingEntries[k]; !exists || !entry.state.IsPending() {
+		now := time.Now()
 		i.pendingEntries[k] = pendingEntry{
-			deadline: time.Now().Add(i.deadline),
+			deadline: now.Add(i.deadline),
 			state:    transactionCreated,
+			user:     user,
+			created:  now,
 		}
 	}
 	return nil
@@ -96,6 +102,39 @@ func (i *inMemoryTransactionRegistry) Status(key *Key) (TransactionStatus, error
 	return TransactionStatus{State: transactionAbsent}, nil
 }
 
+func (i *inMemoryTransactionRegistry) List() ([]PendingTransaction, error) {
+	i.pendingEntriesLock.Lock()
+	defer i.pendingEntriesLock.Unlock()
+	var transactions []PendingTransaction
+	for k, entry := range i.pendingEntries {
+		if entry.state.IsPending() {
+			transactions = append(transactions, PendingTransaction{
+				KeyHash: k,
+				User:    entry.user,
+				Created: entry.created,
+			})
+		}
+	}
+	return transactions, nil
+}
+
+func (i *inMemoryTransactionRegistry) Resolve(keyHash, failReason string) error {
+	i.pendingEntriesLock.Lock()
+	defer i.pendingEntriesLock.Unlock()
+	entry, ok := i.pendingEntries[keyHash]
+	if !ok || !entry.state.IsPending() {
+		return ErrTransactionNotPending
+	}
+	entry.state = transactionCompleted
+	if len(failReason) > 0 {
+		entry.state = transactionFailed
+		entry.failedReason = failReason
+	}
+	entry.deadline = time.Now().Add(i.transactionEndedDeadline)
+	i.pendingEntries[keyHash] = entry
+	return nil
+}
+
 func (i *inMemoryTransactionRegistry) Close() error {
 	close(i.stopCh)
 	i.wg.Wait()
@@ -2,10 +2,12 @@ package cache
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
-	"time"
-
 	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/contentsquare/chproxy/log"
 	"github.com/redis/go-redis/v9"
@@ -19,20 +21,33 @@ type redisTransactionRegistry struct {
 
 	// transactionEndedDeadline specifies TTL of the record to be kept that has been ended (either completed or failed)
 	transactionEndedDeadline time.Duration
+
+	// keyPrefix is prepended to the keys of the records
+	keyPrefix string
 }
 
 func newRedisTransactionRegistry(redisClient redis.UniversalClient, deadline time.Duration,
-	endedDeadline time.Duration) *redisTransactionRegistry {
+	endedDeadline time.Duration, keyPrefix string) *redisTransactionRegistry {
 	return &redisTransactionRegistry{
 		redisClient:              redisClient,
 		deadline:                 deadline,
 		transactionEndedDeadline: endedDeadline,
+		keyPrefix:                keyPrefix,
 	}
 }
 
-func (r *redisTransactionRegistry) Create(key *Key) error {
-	return r.redisClient.Set(context.Background(), toTransactionKey(key),
-		[]byte{uint8(transactionCreated)}, r.deadline).Err()
+// transactionKeySuffix is appended to the hash of keys of transaction records.
+const transactionKeySuffix = "-transaction"
+
+// Create stores the record of the pending transaction as the state
+// followed by the creation time in unix nanoseconds and the user.
+// Older versions of chproxy store the state only.
+func (r *redisTransactionRegistry) Create(key *Key, user string) error {
+	b := make([]byte, 9, 9+len(user))
+	b[0] = byte(transactionCreated)
+	binary.BigEndian.PutUint64(b[1:], uint64(time.Now().UnixNano()))
+	b = append(b, user...)
+	return r.redisClient.Set(context.Background(), r.transactionKey(key), b, r.deadline).Err()
 }
 
 func (r *redisTransactionRegistry) Complete(key *Key) error {
@@ -47,11 +62,15 @@ func (r *redisTransactionRegistry) Fail(key *Key, reason string) error {
 }
 
 func (r *redisTransactionRegistry) updateTransactionState(key *Key, value []byte) error {
-	return r.redisClient.Set(context.Background(), toTransactionKey(key), value, r.transactionEndedDeadline).Err()
+	return r.setEnded(context.Background(), r.transactionKey(key), value)
+}
+
+func (r *redisTransactionRegistry) setEnded(ctx context.Context, transactionKey string, value []byte) error {
+	return r.redisClient.Set(ctx, transactionKey, value, r.transactionEndedDeadline).Err()
 }
 
 func (r *redisTransactionRegistry) Status(key *Key) (TransactionStatus, error) {
-	raw, err := r.redisClient.Get(context.Background(), toTransactionKey(key)).Bytes()
+	raw, err := r.redisClient.Get(context.Background(), r.transactionKey(key)).Bytes()
 	if errors.Is(err, redis.Nil) {
 		return TransactionStatus{State: transactionAbsent}, nil
 	}
@@ -74,10 +93,99 @@ func (r *redisTransactionRegistry) Status(key *Key) (TransactionStatus, error) {
 	return TransactionStatus{State: state, FailReason: reason}, nil
 }
 
+// List scans all the masters of redis for pending transactions
+// of caches with the same `key_prefix`.
+func (r *redisTransactionRegistry) List() ([]PendingTransaction, error) {
+	ctx := context.Background()
+	pattern := r.hashTransactionKey("*")
+	keyPrefix := prefixedKey(r.keyPrefix, "")
+	var (
+		mu           sync.Mutex
+		transactions []PendingTransaction
+	)
+	scan := func(ctx context.Context, client redis.Cmdable) error {
+		iter := client.Scan(ctx, 0, pattern, 1000).Iterator()
+		for iter.Next(ctx) {
+			transactionKey := iter.Val()
+			raw, err := client.Get(ctx, transactionKey).Bytes()
+			if errors.Is(err, redis.Nil) {
+				// The transaction has been expired since the scan.
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			pt, ok := parsePendingTransaction(raw)
+			if !ok {
+				continue
+			}
+			pt.KeyHash = strings.TrimSuffix(strings.TrimPrefix(transactionKey, keyPrefix), transactionKeySuffix)
+			mu.Lock()
+			transactions = append(transactions, pt)
+			mu.Unlock()
+		}
+		return iter.Err()
+	}
+
+	var err error
+	if cc, ok := r.redisClient.(*redis.ClusterClient); ok {
+		err = cc.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+			return scan(ctx, client)
+		})
+	} else {
+		err = scan(ctx, r.redisClient)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot list transactions: %w", err)
+	}
+	return transactions, nil
+}
+
+// parsePendingTransaction parses the record stored by Create.
+// It returns false if the transaction isn't pending.
+func parsePendingTransaction(raw []byte) (PendingTransaction, bool) {
+	if len(raw) == 0 {
+		return PendingTransaction{}, false
+	}
+	if state := TransactionState(raw[0]); !state.IsPending() {
+		return PendingTransaction{}, false
+	}
+	var pt PendingTransaction
+	if len(raw) >= 9 {
+		pt.Created = time.Unix(0, int64(binary.BigEndian.Uint64(raw[1:9])))
+		pt.User = string(raw[9:])
+	}
+	return pt, true
+}
+
+func (r *redisTransactionRegistry) Resolve(keyHash, failReason string) error {
+	ctx := context.Background()
+	transactionKey := r.hashTransactionKey(keyHash)
+	raw, err := r.redisClient.Get(ctx, transactionKey).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return ErrTransactionNotPending
+	}
+	if err != nil {
+		return err
+	}
+	if _, ok := parsePendingTransaction(raw); !ok {
+		return ErrTransactionNotPending
+	}
+	value := []byte{uint8(transactionCompleted)}
+	if len(failReason) > 0 {
+		value = append([]byte{uint8(transactionFailed)}, failReason...)
+	}
+	return r.setEnded(ctx, transactionKey, value)
+}
+
 func (r *redisTransactionRegistry) Close() error {
 	return r.redisClient.Close()
 }
 
-func toTransactionKey(key *Key) string {
-	return fmt.Sprintf("%s-transaction", key.String())
+func (r *redisTransactionRegistry) transactionKey(key *Key) string {
+	return r.hashTransactionKey(key.String())
+}
+
+func (r *redisTransactionRegistry) hashTransactionKey(keyHash string) string {
+	return prefixedKey(r.keyPrefix, keyHash+transactionKeySuffix)
 }
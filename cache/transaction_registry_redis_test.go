@@ -20,9 +20,9 @@ func TestRedisTransaction(t *testing.T) {
 		Query: []byte("SELECT pending entries"),
 	}
 
-	redisTransaction := newRedisTransactionRegistry(redisClient, graceTime, graceTime)
+	redisTransaction := newRedisTransactionRegistry(redisClient, graceTime, graceTime, "")
 
-	if err := redisTransaction.Create(key); err != nil {
+	if err := redisTransaction.Create(key, "default"); err != nil {
 		t.Fatalf("unexpected error: %s while registering new transaction", err)
 	}
 
@@ -53,9 +53,9 @@ func TestFailRedisTransaction(t *testing.T) {
 		Query: []byte("SELECT pending entries"),
 	}
 
-	redisTransaction := newRedisTransactionRegistry(redisClient, graceTime, graceTime)
+	redisTransaction := newRedisTransactionRegistry(redisClient, graceTime, graceTime, "")
 
-	if err := redisTransaction.Create(key); err != nil {
+	if err := redisTransaction.Create(key, "default"); err != nil {
 		t.Fatalf("unexpected error: %s while registering new transaction", err)
 	}
 
@@ -93,9 +93,9 @@ func TestCleanupFailedRedisTransaction(t *testing.T) {
 		Query: []byte("SELECT pending entries"),
 	}
 
-	redisTransaction := newRedisTransactionRegistry(redisClient, graceTime, updatedTTL)
+	redisTransaction := newRedisTransactionRegistry(redisClient, graceTime, updatedTTL, "")
 
-	if err := redisTransaction.Create(key); err != nil {
+	if err := redisTransaction.Create(key, "default"); err != nil {
 		t.Fatalf("unexpected error: %s while registering new transaction", err)
 	}
 
@@ -141,9 +141,9 @@ func TestCleanupCompletedRedisTransaction(t *testing.T) {
 		Query: []byte("SELECT pending entries"),
 	}
 
-	redisTransaction := newRedisTransactionRegistry(redisClient, graceTime, updatedTTL)
+	redisTransaction := newRedisTransactionRegistry(redisClient, graceTime, updatedTTL, "")
 
-	if err := redisTransaction.Create(key); err != nil {
+	if err := redisTransaction.Create(key, "default"); err != nil {
 		t.Fatalf("unexpected error: %s while registering new transaction", err)
 	}
 
@@ -169,3 +169,101 @@ func TestCleanupCompletedRedisTransaction(t *testing.T) {
 		t.Fatalf("unexpected: transaction should be cleaned up")
 	}
 }
+
+func TestRedisTransactionKeyPrefix(t *testing.T) {
+	s := miniredis.RunT(t)
+
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs: []string{s.Addr()},
+	})
+
+	graceTime := 10 * time.Second
+	key := &Key{
+		Query: []byte("SELECT key prefix"),
+	}
+
+	dev := newRedisTransactionRegistry(redisClient, graceTime, graceTime, "dev")
+	prod := newRedisTransactionRegistry(redisClient, graceTime, graceTime, "prod")
+
+	if err := dev.Create(key, "default"); err != nil {
+		t.Fatalf("unexpected error: %s while registering new transaction", err)
+	}
+	if !s.Exists("dev:" + key.String() + "-transaction") {
+		t.Fatalf("expecting the transaction under the prefixed key; got keys %v", s.Keys())
+	}
+	status, err := prod.Status(key)
+	if err != nil || status.State != transactionAbsent {
+		t.Fatalf("unexpected status: %v, err: %s; expecting absent transaction", status, err)
+	}
+}
+
+func TestRedisTransactionListAndResolve(t *testing.T) {
+	s := miniredis.RunT(t)
+
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs: []string{s.Addr()},
+	})
+
+	graceTime := 10 * time.Second
+	registry := newRedisTransactionRegistry(redisClient, graceTime, graceTime, "prefix")
+	otherRegistry := newRedisTransactionRegistry(redisClient, graceTime, graceTime, "other")
+
+	pending := &Key{Query: []byte("SELECT pending")}
+	completed := &Key{Query: []byte("SELECT completed")}
+	for _, key := range []*Key{pending, completed} {
+		if err := registry.Create(key, "alice"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if err := registry.Complete(completed); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := otherRegistry.Create(pending, "bob"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// Transactions created by older versions contain the state only.
+	legacy := &Key{Query: []byte("SELECT legacy")}
+	s.Set(registry.transactionKey(legacy), string([]byte{uint8(transactionCreated)}))
+
+	transactions, err := registry.List()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(transactions) != 2 {
+		t.Fatalf("unexpected pending transactions: %+v", transactions)
+	}
+	for _, pt := range transactions {
+		switch pt.KeyHash {
+		case pending.String():
+			if pt.User != "alice" || time.Since(pt.Created) > graceTime {
+				t.Fatalf("unexpected pending transaction: %+v", pt)
+			}
+		case legacy.String():
+			if pt.User != "" || !pt.Created.IsZero() {
+				t.Fatalf("unexpected legacy transaction: %+v", pt)
+			}
+		default:
+			t.Fatalf("unexpected transaction: %+v", pt)
+		}
+	}
+
+	if err := registry.Resolve(pending.String(), ""); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	status, err := registry.Status(pending)
+	if err != nil || !status.State.IsCompleted() {
+		t.Fatalf("unexpected: transaction should be completed; got %+v", status)
+	}
+	if err := registry.Resolve(pending.String(), ""); err != ErrTransactionNotPending {
+		t.Fatalf("unexpected error: %v; expected %v", err, ErrTransactionNotPending)
+	}
+	if err := registry.Resolve(completed.String(), "failed"); err != ErrTransactionNotPending {
+		t.Fatalf("unexpected error: %v; expected %v", err, ErrTransactionNotPending)
+	}
+
+	// Transactions of caches with other key prefix aren't affected.
+	status, err = otherRegistry.Status(pending)
+	if err != nil || !status.State.IsPending() {
+		t.Fatalf("unexpected: transaction should be pending; got %+v", status)
+	}
+}
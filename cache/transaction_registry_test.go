@@ -12,7 +12,7 @@ func TestInMemoryTransaction(t *testing.T) {
 	}
 	inMemoryTransaction := newInMemoryTransactionRegistry(graceTime, graceTime)
 
-	if err := inMemoryTransaction.Create(key); err != nil {
+	if err := inMemoryTransaction.Create(key, "default"); err != nil {
 		t.Fatalf("unexpected error: %s while registering new transaction", err)
 	}
 
@@ -31,3 +31,43 @@ func TestInMemoryTransaction(t *testing.T) {
 	}
 
 }
+
+func TestInMemoryTransactionListAndResolve(t *testing.T) {
+	graceTime := 10 * time.Second
+	registry := newInMemoryTransactionRegistry(graceTime, graceTime)
+	defer registry.Close()
+
+	pending := &Key{Query: []byte("SELECT pending")}
+	completed := &Key{Query: []byte("SELECT completed")}
+	if err := registry.Create(pending, "alice"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := registry.Create(completed, "bob"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := registry.Complete(completed); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	transactions, err := registry.List()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(transactions) != 1 || transactions[0].KeyHash != pending.String() || transactions[0].User != "alice" {
+		t.Fatalf("unexpected pending transactions: %+v", transactions)
+	}
+	if time.Since(transactions[0].Created) > graceTime {
+		t.Fatalf("unexpected creation time of the transaction: %s", transactions[0].Created)
+	}
+
+	if err := registry.Resolve(pending.String(), "killed"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	status, err := registry.Status(pending)
+	if err != nil || !status.State.IsFailed() || status.FailReason != "killed" {
+		t.Fatalf("unexpected: transaction should be failed; got %+v", status)
+	}
+	if err := registry.Resolve(pending.String(), ""); err != ErrTransactionNotPending {
+		t.Fatalf("unexpected error: %v; expected %v", err, ErrTransactionNotPending)
+	}
+}
@@ -3,9 +3,22 @@ package cache
 import (
 	"fmt"
 	"io"
+	"math/rand"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// prefixedKey returns stringKey prefixed with keyPrefix,
+// so caches with distinct prefixes may share redis.
+func prefixedKey(keyPrefix, stringKey string) string {
+	if len(keyPrefix) == 0 {
+		return stringKey
+	}
+	return keyPrefix + ":" + stringKey
+}
+
 // walkDir calls f on all the cache files in the given dir.
 func walkDir(dir string, f func(fi os.FileInfo)) error {
 	// Do not use filepath.Walk, since it is inefficient
@@ -39,3 +52,31 @@ func walkDir(dir string, f func(fi os.FileInfo)) error {
 		}
 	}
 }
+
+var (
+	// jitterSeed is the seed of the last created jitter source.
+	jitterSeed = time.Now().UnixNano()
+
+	// jitterRands contains jitter sources, so concurrent Puts don't contend
+	// on a single source. Each source is seeded with the process start time
+	// plus a sequence number to avoid correlated jitters between sources.
+	jitterRands = sync.Pool{
+		New: func() interface{} {
+			// nolint:gosec // not security sensitive, only used to spread expirations.
+			return rand.New(rand.NewSource(atomic.AddInt64(&jitterSeed, 1)))
+		},
+	}
+)
+
+// expireJitter returns a random duration in the range [0, jitter).
+// It returns 0 if jitter isn't positive.
+func expireJitter(jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return 0
+	}
+	// nolint:forcetypeassert // Only *rand.Rand is stored in the pool.
+	r := jitterRands.Get().(*rand.Rand)
+	d := time.Duration(r.Int63n(int64(jitter)))
+	jitterRands.Put(r)
+	return d
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/contentsquare/chproxy/cache"
+	"github.com/contentsquare/chproxy/log"
+)
+
+// cacheInvalidateEndpoint removes cached responses by the prefix of their key hashes:
+//
+//	POST /cache/invalidate?cache={cache}&prefix={key_hash_prefix}
+const cacheInvalidateEndpoint = "/cache/invalidate"
+
+// cacheInvalidation describes the result of POST /cache/invalidate.
+type cacheInvalidation struct {
+	Cache   string `json:"cache"`
+	Prefix  string `json:"prefix"`
+	Removed int    `json:"removed"`
+}
+
+// serveCacheInvalidate serves POST /cache/invalidate.
+//
+// Invalidations of layered caches with redis l2 are published to other chproxy
+// instances, so they remove the entries from their l1 caches as well.
+func (rp *reverseProxy) serveCacheInvalidate(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		err := fmt.Errorf("%q: unsupported method %q for %q", r.RemoteAddr, r.Method, r.URL.Path)
+		respondWith(rw, err, http.StatusMethodNotAllowed)
+		return
+	}
+	params := r.URL.Query()
+	name := params.Get("cache")
+	c, ok := rp.snapshot.Load().caches[name]
+	if !ok {
+		err := fmt.Errorf("%q: unknown cache %q", r.RemoteAddr, name)
+		respondWith(rw, err, http.StatusNotFound)
+		return
+	}
+	ci := cacheInvalidation{
+		Cache:  name,
+		Prefix: params.Get("prefix"),
+	}
+	n, err := c.Invalidate(ci.Prefix)
+	if errors.Is(err, cache.ErrInvalidPrefix) {
+		badRequest.Inc()
+		err = fmt.Errorf("%q: invalid `prefix` %q: %w", r.RemoteAddr, ci.Prefix, err)
+		respondWith(rw, err, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("%q: cannot invalidate prefix %q of cache %q: %w", r.RemoteAddr, ci.Prefix, name, err)
+		respondWith(rw, err, http.StatusBadGateway)
+		return
+	}
+	ci.Removed = n
+	log.Infof("%q: invalidated %d entries with prefix %q of cache %q via %s", r.RemoteAddr, n, ci.Prefix, name, cacheInvalidateEndpoint)
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(ci); err != nil {
+		log.Errorf("cannot send cache invalidation to %s: %s", r.RemoteAddr, err)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/contentsquare/chproxy/cache"
+	"github.com/contentsquare/chproxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReverseProxy_ServeCacheInvalidate(t *testing.T) {
+	cc := goodCfgWithCache.Caches[0]
+	cc.FileSystem.Dir = testCacheDir + "/invalidate"
+	cc.Expire = config.Duration(time.Minute)
+	os.RemoveAll(cc.FileSystem.Dir)
+	cfg := *goodCfgWithCache
+	cfg.Caches = []config.Cache{cc}
+	proxy, err := newConfiguredProxy(&cfg)
+	checkErr(t, err)
+	stopProxy(t, proxy)
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		proxy.serveCacheInvalidate(rw, httptest.NewRequest(method, path, nil))
+		return rw
+	}
+
+	userCache := proxy.snapshot.Load().caches[fileSystemCache]
+	key := &cache.Key{Query: []byte("SELECT invalidated")}
+	_, err = userCache.Put(strings.NewReader("1"), cache.ContentMetadata{Length: 1}, key)
+	checkErr(t, err)
+	prefix := key.String()[:8]
+
+	rw := serve(http.MethodPost, cacheInvalidateEndpoint+"?cache="+fileSystemCache+"&prefix="+prefix)
+	assert.Equal(t, http.StatusOK, rw.Code, rw.Body.String())
+	assert.JSONEq(t, `{"cache":"`+fileSystemCache+`","prefix":"`+prefix+`","removed":1}`, rw.Body.String())
+	_, err = userCache.Get(key)
+	assert.Error(t, err)
+
+	rw = serve(http.MethodPost, cacheInvalidateEndpoint+"?cache="+fileSystemCache+"&prefix="+prefix)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Contains(t, rw.Body.String(), `"removed":0`)
+
+	rw = serve(http.MethodPost, cacheInvalidateEndpoint+"?cache="+fileSystemCache)
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+	rw = serve(http.MethodPost, cacheInvalidateEndpoint+"?cache=unknown&prefix="+prefix)
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+	rw = serve(http.MethodGet, cacheInvalidateEndpoint+"?cache="+fileSystemCache+"&prefix="+prefix)
+	assert.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/contentsquare/chproxy/cache"
+	"github.com/contentsquare/chproxy/log"
+)
+
+const (
+	// cacheTransactionsEndpoint lists pending transactions of caches.
+	cacheTransactionsEndpoint = "/cache/transactions"
+
+	// cacheTransactionsPrefix is the prefix of endpoints managing pending transactions:
+	//   DELETE /cache/transactions/{cache}/{key_hash}
+	cacheTransactionsPrefix = "/cache/transactions/"
+)
+
+// cacheTransactionInfo describes the pending transaction in /cache/transactions responses.
+type cacheTransactionInfo struct {
+	Cache   string `json:"cache"`
+	KeyHash string `json:"key_hash"`
+	User    string `json:"user"`
+	// Created and Age are zero for transactions created by older versions of chproxy.
+	Created    time.Time `json:"created"`
+	AgeSeconds float64   `json:"age_seconds"`
+}
+
+// resolvedCacheTransaction describes the transaction ended via DELETE /cache/transactions/...
+type resolvedCacheTransaction struct {
+	Cache      string `json:"cache"`
+	KeyHash    string `json:"key_hash"`
+	State      string `json:"state"`
+	FailReason string `json:"fail_reason,omitempty"`
+}
+
+// listCacheTransactions returns pending transactions of all the caches
+// ordered by their creation time.
+func (rp *reverseProxy) listCacheTransactions() ([]cacheTransactionInfo, error) {
+	transactions := []cacheTransactionInfo{}
+	now := time.Now()
+	for name, c := range rp.snapshot.Load().caches {
+		if c.Levels() != nil {
+			// Layered caches share the transactions of their l2 cache.
+			continue
+		}
+		pending, err := c.List()
+		if err != nil {
+			return nil, fmt.Errorf("cache %q: %w", name, err)
+		}
+		for _, pt := range pending {
+			info := cacheTransactionInfo{
+				Cache:   name,
+				KeyHash: pt.KeyHash,
+				User:    pt.User,
+				Created: pt.Created,
+			}
+			if !pt.Created.IsZero() {
+				info.AgeSeconds = now.Sub(pt.Created).Seconds()
+			}
+			transactions = append(transactions, info)
+		}
+	}
+	sort.Slice(transactions, func(i, j int) bool {
+		return transactions[i].Created.Before(transactions[j].Created)
+	})
+	return transactions, nil
+}
+
+// serveCacheTransactions serves /cache/transactions and DELETE /cache/transactions/{cache}/{key_hash}.
+//
+// Deleted transactions are completed, so queries awaiting them are proxied
+// to ClickHouse. They are failed with the `fail_reason` query arg if it is set,
+// so awaiting queries receive the error.
+func (rp *reverseProxy) serveCacheTransactions(rw http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == cacheTransactionsEndpoint {
+		if r.Method != http.MethodGet {
+			err := fmt.Errorf("%q: unsupported method %q for %q", r.RemoteAddr, r.Method, r.URL.Path)
+			respondWith(rw, err, http.StatusMethodNotAllowed)
+			return
+		}
+		transactions, err := rp.listCacheTransactions()
+		if err != nil {
+			err = fmt.Errorf("%q: cannot list cache transactions: %w", r.RemoteAddr, err)
+			respondWith(rw, err, http.StatusBadGateway)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(rw).Encode(transactions); err != nil {
+			log.Errorf("cannot send cache transactions to %s: %s", r.RemoteAddr, err)
+		}
+		return
+	}
+
+	// The path is {cache}/{key_hash}.
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, cacheTransactionsPrefix), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		badRequest.Inc()
+		err := fmt.Errorf("%q: unsupported path: %q", r.RemoteAddr, r.URL.Path)
+		respondWith(rw, err, http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		err := fmt.Errorf("%q: unsupported method %q for %q", r.RemoteAddr, r.Method, r.URL.Path)
+		respondWith(rw, err, http.StatusMethodNotAllowed)
+		return
+	}
+	c, ok := rp.snapshot.Load().caches[parts[0]]
+	if !ok {
+		err := fmt.Errorf("%q: unknown cache %q", r.RemoteAddr, parts[0])
+		respondWith(rw, err, http.StatusNotFound)
+		return
+	}
+	resolved := resolvedCacheTransaction{
+		Cache:      parts[0],
+		KeyHash:    parts[1],
+		State:      "completed",
+		FailReason: r.URL.Query().Get("fail_reason"),
+	}
+	if len(resolved.FailReason) > 0 {
+		resolved.State = "failed"
+	}
+	err := c.Resolve(resolved.KeyHash, resolved.FailReason)
+	if errors.Is(err, cache.ErrTransactionNotPending) {
+		err = fmt.Errorf("%q: transaction %q of cache %q isn't pending", r.RemoteAddr, resolved.KeyHash, resolved.Cache)
+		respondWith(rw, err, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("%q: cannot end transaction %q of cache %q: %w", r.RemoteAddr, resolved.KeyHash, resolved.Cache, err)
+		respondWith(rw, err, http.StatusBadGateway)
+		return
+	}
+	log.Infof("%q: transaction %s of cache %q is %s via %s", r.RemoteAddr, resolved.KeyHash, resolved.Cache, resolved.State, cacheTransactionsEndpoint)
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(resolved); err != nil {
+		log.Errorf("cannot send resolved cache transaction to %s: %s", r.RemoteAddr, err)
+	}
+}
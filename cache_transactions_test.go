@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/contentsquare/chproxy/cache"
+	"github.com/contentsquare/chproxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReverseProxy_ServeCacheTransactions(t *testing.T) {
+	os.RemoveAll(testCacheDir)
+	cfg := *goodCfgWithCache
+	cfg.Caches = []config.Cache{goodCfgWithCache.Caches[0]}
+	// Transactions expire right away without max_execution_time,
+	// since it is used as the grace time of the cache.
+	u := goodCfgWithCache.Users[0]
+	u.MaxExecutionTime = config.Duration(time.Minute)
+	cfg.Users = []config.User{u}
+	proxy, err := newConfiguredProxy(&cfg)
+	checkErr(t, err)
+	stopProxy(t, proxy)
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		proxy.serveCacheTransactions(rw, httptest.NewRequest(method, path, nil))
+		return rw
+	}
+	listTransactions := func() []cacheTransactionInfo {
+		t.Helper()
+		rw := serve(http.MethodGet, cacheTransactionsEndpoint)
+		if rw.Code != http.StatusOK {
+			t.Fatalf("unexpected status code: %d; body: %s", rw.Code, rw.Body)
+		}
+		var transactions []cacheTransactionInfo
+		checkErr(t, json.NewDecoder(rw.Body).Decode(&transactions))
+		return transactions
+	}
+	assert.Empty(t, listTransactions())
+
+	// The transaction of the query, which is never going to complete.
+	userCache := proxy.snapshot.Load().caches[fileSystemCache]
+	key := &cache.Key{Query: []byte("SELECT dangling")}
+	checkErr(t, userCache.Create(key, defaultUsername))
+
+	transactions := listTransactions()
+	if assert.Len(t, transactions, 1) {
+		assert.Equal(t, fileSystemCache, transactions[0].Cache)
+		assert.Equal(t, key.String(), transactions[0].KeyHash)
+		assert.Equal(t, defaultUsername, transactions[0].User)
+		assert.GreaterOrEqual(t, transactions[0].AgeSeconds, float64(0))
+	}
+
+	rw := serve(http.MethodDelete, cacheTransactionsPrefix+fileSystemCache+"/"+key.String()+"?fail_reason=killed")
+	assert.Equal(t, http.StatusOK, rw.Code, rw.Body.String())
+	assert.JSONEq(t, `{"cache":"`+fileSystemCache+`","key_hash":"`+key.String()+`","state":"failed","fail_reason":"killed"}`, rw.Body.String())
+	status, err := userCache.Status(key)
+	checkErr(t, err)
+	assert.True(t, status.State.IsFailed())
+	assert.Equal(t, "killed", status.FailReason)
+	assert.Empty(t, listTransactions())
+
+	rw = serve(http.MethodDelete, cacheTransactionsPrefix+fileSystemCache+"/"+key.String())
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+	rw = serve(http.MethodDelete, cacheTransactionsPrefix+"unknown/"+key.String())
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+	rw = serve(http.MethodPost, cacheTransactionsPrefix+fileSystemCache+"/"+key.String())
+	assert.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+	rw = serve(http.MethodDelete, cacheTransactionsPrefix+fileSystemCache)
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+}
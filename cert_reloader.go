@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/contentsquare/chproxy/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// certReloader serves the TLS certificate loaded from `cert_file` and `key_file`,
+// so it may be reloaded on SIGUSR2 without restarting chproxy.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	cert atomic.Pointer[tls.Certificate]
+}
+
+// tlsCertReloader is set if https is served with the certificate from `cert_file`.
+var tlsCertReloader atomic.Pointer[certReloader]
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// reload loads the certificate from the files again.
+// The previous certificate is kept if the new one cannot be loaded.
+func (cr *certReloader) reload() error {
+	if err := cr.load(); err != nil {
+		tlsCertificateReloads.With(prometheus.Labels{"result": "failure"}).Inc()
+		return err
+	}
+	tlsCertificateReloads.With(prometheus.Labels{"result": "success"}).Inc()
+	return nil
+}
+
+func (cr *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("cannot load cert for `cert_file`=%q, `key_file`=%q: %w",
+			cr.certFile, cr.keyFile, err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("cannot parse cert from `cert_file`=%q: %w", cr.certFile, err)
+		}
+	}
+	cr.cert.Store(&cert)
+	tlsCertificateExpiry.Set(float64(cert.Leaf.NotAfter.Unix()))
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return cr.cert.Load(), nil
+}
+
+func setupReloadCertWatch() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR2)
+	go func() {
+		for range c {
+			cr := tlsCertReloader.Load()
+			if cr == nil {
+				log.Infof("SIGUSR2 received, but https isn't served with `cert_file`. Nothing to reload")
+				continue
+			}
+			log.Infof("SIGUSR2 received. Going to reload TLS certificate %s ...", cr.certFile)
+			if err := cr.reload(); err != nil {
+				log.Errorf("error while reloading TLS certificate: %s", err)
+				continue
+			}
+			log.Infof("Reloading TLS certificate %s: successful", cr.certFile)
+		}
+	}()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	notAfter := time.Now().Add(time.Hour).Truncate(time.Second)
+	writeTestCert(t, certFile, keyFile, notAfter)
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	cert, err := cr.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assert.Equal(t, notAfter.UTC(), cert.Leaf.NotAfter)
+	assert.Equal(t, float64(notAfter.Unix()), testutil.ToFloat64(tlsCertificateExpiry))
+
+	successes := counterSum(t, tlsCertificateReloads, prometheus.Labels{"result": "success"})
+	failures := counterSum(t, tlsCertificateReloads, prometheus.Labels{"result": "failure"})
+
+	// The renewed certificate is served after reload.
+	renewedNotAfter := notAfter.Add(24 * time.Hour)
+	writeTestCert(t, certFile, keyFile, renewedNotAfter)
+	assert.NoError(t, cr.reload())
+	cert, err = cr.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assert.Equal(t, renewedNotAfter.UTC(), cert.Leaf.NotAfter)
+	assert.Equal(t, float64(renewedNotAfter.Unix()), testutil.ToFloat64(tlsCertificateExpiry))
+	assert.Equal(t, successes+1, counterSum(t, tlsCertificateReloads, prometheus.Labels{"result": "success"}))
+
+	// The previous certificate is kept if the new one is broken.
+	if err := os.WriteFile(certFile, []byte("broken"), 0o600); err != nil {
+		t.Fatalf("cannot write %q: %s", certFile, err)
+	}
+	assert.Error(t, cr.reload())
+	cert, err = cr.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assert.Equal(t, renewedNotAfter.UTC(), cert.Leaf.NotAfter)
+	assert.Equal(t, failures+1, counterSum(t, tlsCertificateReloads, prometheus.Labels{"result": "failure"}))
+}
+
+// writeTestCert writes a self-signed certificate expiring at notAfter and its key.
+func writeTestCert(t *testing.T, certFile, keyFile string, notAfter time.Time) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("cannot create certificate: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("cannot marshal key: %s", err)
+	}
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("cannot write %q: %s", certFile, err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("cannot write %q: %s", keyFile, err)
+	}
+}
@@ -3,12 +3,38 @@ package clients
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/contentsquare/chproxy/config"
 	"github.com/redis/go-redis/v9"
 )
 
 func NewRedisClient(cfg config.RedisCacheConfig) (redis.UniversalClient, error) {
+	options, err := newRedisOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// A failover client is returned if options.MasterName is set.
+	r := redis.NewUniversalClient(options)
+
+	err = r.Ping(context.Background()).Err()
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach redis: %w", err)
+	}
+
+	return r, nil
+}
+
+// CheckRedisConfig checks the redis client may be created from cfg
+// without dialing redis.
+func CheckRedisConfig(cfg config.RedisCacheConfig) error {
+	_, err := newRedisOptions(cfg)
+	return err
+}
+
+func newRedisOptions(cfg config.RedisCacheConfig) (*redis.UniversalOptions, error) {
 	options := &redis.UniversalOptions{
 		Addrs:      cfg.Addresses,
 		Username:   cfg.Username,
@@ -16,9 +42,20 @@ func NewRedisClient(cfg config.RedisCacheConfig) (redis.UniversalClient, error)
 		PoolSize:   cfg.PoolSize,
 		MaxRetries: 7, // default value = 3, since MinRetryBackoff = 8 msec & MinRetryBackoff = 512 msec
 		// the redis client will wait up to 1016 msec btw the 7 tries
+		MinIdleConns:    cfg.MinIdleConns,
+		ConnMaxLifetime: time.Duration(cfg.ConnMaxLifetime),
+		// the timeouts of cache operations are passed via contexts
+		ContextTimeoutEnabled: true,
 	}
 
-	if len(cfg.Addresses) == 1 {
+	if cfg.IsSentinel() {
+		// Addrs are treated as sentinel addresses if MasterName is set.
+		options.Addrs = cfg.SentinelAddresses
+		options.MasterName = cfg.MasterName
+		options.SentinelUsername = cfg.SentinelUsername
+		options.SentinelPassword = cfg.SentinelPassword
+		options.DB = cfg.DBIndex
+	} else if len(cfg.Addresses) == 1 {
 		options.DB = cfg.DBIndex
 	}
 
@@ -30,13 +67,5 @@ func NewRedisClient(cfg config.RedisCacheConfig) (redis.UniversalClient, error)
 		options.TLSConfig = tlsConfig
 	}
 
-	r := redis.NewUniversalClient(options)
-
-	err := r.Ping(context.Background()).Err()
-
-	if err != nil {
-		return nil, fmt.Errorf("failed to reach redis: %w", err)
-	}
-
-	return r, nil
+	return options, nil
 }
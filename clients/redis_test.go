@@ -0,0 +1,130 @@
+package clients
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/contentsquare/chproxy/config"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRedisClient(t *testing.T) {
+	s := miniredis.RunT(t)
+
+	r, err := NewRedisClient(config.RedisCacheConfig{
+		Addresses: []string{s.Addr()},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer r.Close()
+
+	if _, ok := r.(*redis.Client); !ok {
+		t.Fatalf("expected standalone client; got %T", r)
+	}
+	if err := r.Set(context.Background(), "foo", "bar", 0).Err(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	v, err := s.Get("foo")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assert.Equal(t, "bar", v)
+}
+
+func TestNewRedisOptions(t *testing.T) {
+	testCases := []struct {
+		name     string
+		cfg      config.RedisCacheConfig
+		expected *redis.UniversalOptions
+	}{
+		{
+			name: "standalone",
+			cfg: config.RedisCacheConfig{
+				Username:  "user",
+				Password:  "password",
+				Addresses: []string{"127.0.0.1:6379"},
+				DBIndex:   2,
+				PoolSize:  10,
+			},
+			expected: &redis.UniversalOptions{
+				Addrs:      []string{"127.0.0.1:6379"},
+				Username:   "user",
+				Password:   "password",
+				DB:         2,
+				PoolSize:   10,
+				MaxRetries: 7,
+
+				ContextTimeoutEnabled: true,
+			},
+		},
+		{
+			name: "connection pool",
+			cfg: config.RedisCacheConfig{
+				Addresses:       []string{"127.0.0.1:6379"},
+				PoolSize:        10,
+				MinIdleConns:    2,
+				ConnMaxLifetime: config.Duration(time.Hour),
+			},
+			expected: &redis.UniversalOptions{
+				Addrs:           []string{"127.0.0.1:6379"},
+				PoolSize:        10,
+				MinIdleConns:    2,
+				ConnMaxLifetime: time.Hour,
+				MaxRetries:      7,
+
+				ContextTimeoutEnabled: true,
+			},
+		},
+		{
+			name: "cluster",
+			cfg: config.RedisCacheConfig{
+				Addresses: []string{"127.0.0.1:6379", "127.0.0.2:6379"},
+				DBIndex:   2,
+			},
+			expected: &redis.UniversalOptions{
+				Addrs:      []string{"127.0.0.1:6379", "127.0.0.2:6379"},
+				MaxRetries: 7,
+
+				ContextTimeoutEnabled: true,
+			},
+		},
+		{
+			name: "sentinel",
+			cfg: config.RedisCacheConfig{
+				Username:          "user",
+				Password:          "password",
+				DBIndex:           2,
+				MasterName:        "mymaster",
+				SentinelAddresses: []string{"127.0.0.1:26379", "127.0.0.2:26379"},
+				SentinelUsername:  "sentinel_user",
+				SentinelPassword:  "sentinel_password",
+			},
+			expected: &redis.UniversalOptions{
+				Addrs:            []string{"127.0.0.1:26379", "127.0.0.2:26379"},
+				Username:         "user",
+				Password:         "password",
+				DB:               2,
+				MaxRetries:       7,
+				MasterName:       "mymaster",
+				SentinelUsername: "sentinel_user",
+				SentinelPassword: "sentinel_password",
+
+				ContextTimeoutEnabled: true,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			options, err := newRedisOptions(tc.cfg)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			assert.Equal(t, tc.expected, options)
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/contentsquare/chproxy/cache"
+)
+
+// responseEncoding returns the encoding responses are re-encoded to
+// according to `response_compression`. It returns an empty string
+// if responses must be sent as is.
+func responseEncoding(compression string) string {
+	switch compression {
+	case "gzip":
+		return encodingGzip
+	case "brotli":
+		return encodingBrotli
+	default:
+		return ""
+	}
+}
+
+// acceptsEncoding returns true if encoding is acceptable according to acceptEncoding.
+func acceptsEncoding(acceptEncoding, encoding string) bool {
+	weights := parseAcceptEncoding(acceptEncoding)
+	if q, ok := weights[encoding]; ok {
+		return q > 0
+	}
+	return weights["*"] > 0
+}
+
+// needsReencoding returns true if the response encoded with from
+// must be re-encoded to the encoding to.
+func needsReencoding(from, to, acceptEncoding string) bool {
+	if from == "" {
+		from = encodingIdentity
+	}
+	return to != "" && from != to && isSupportedEncoding(from) && acceptsEncoding(acceptEncoding, to)
+}
+
+// compressResponse re-encodes the response read from the cache or from
+// the temporary file to the encoding of `response_compression`
+// if the client accepts it.
+//
+// The response is returned as is if it doesn't need re-encoding
+// or exceeds maxTranscodeSize.
+func compressResponse(s *scope, req *http.Request, data io.Reader, metadata cache.ContentMetadata) (io.Reader, cache.ContentMetadata, error) {
+	to := s.user.responseEncoding
+	if !needsReencoding(metadata.Encoding, to, req.Header.Get("Accept-Encoding")) || metadata.Length > maxTranscodeSize {
+		return data, metadata, nil
+	}
+	from := metadata.Encoding
+	if from == "" {
+		from = encodingIdentity
+	}
+	return reencodeResponse(data, metadata, from, to)
+}
+
+type responseEncodingKey struct{}
+
+// withResponseEncoding returns ctx for requests, which responses
+// are re-encoded to encoding by compressProxiedResponse.
+func withResponseEncoding(ctx context.Context, encoding string) context.Context {
+	if encoding == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, responseEncodingKey{}, encoding)
+}
+
+// compressProxiedResponse re-encodes the body of the successful response
+// proxied from ClickHouse on the fly to the encoding set by withResponseEncoding
+// if the client accepts it.
+func compressProxiedResponse(resp *http.Response) error {
+	to, _ := resp.Request.Context().Value(responseEncodingKey{}).(string)
+	from := resp.Header.Get("Content-Encoding")
+	if resp.StatusCode != http.StatusOK || !needsReencoding(from, to, resp.Request.Header.Get("Accept-Encoding")) {
+		return nil
+	}
+	if from == "" {
+		from = encodingIdentity
+	}
+
+	resp.Body = newReencodingBody(resp.Body, from, to)
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	resp.Header.Set("Content-Encoding", to)
+	return nil
+}
+
+// reencodingBody re-encodes the wrapped body in a separate goroutine.
+type reencodingBody struct {
+	*io.PipeReader
+
+	src io.ReadCloser
+}
+
+func newReencodingBody(src io.ReadCloser, from, to string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(transcode(pw, src, from, to))
+	}()
+	return &reencodingBody{
+		PipeReader: pr,
+		src:        src,
+	}
+}
+
+// Close closes the source body, so the re-encoding goroutine stops.
+func (b *reencodingBody) Close() error {
+	b.PipeReader.Close()
+	return b.src.Close()
+}
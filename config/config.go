@@ -1,12 +1,14 @@
 package config
 
 import (
-	"bytes"
 	"crypto/tls"
 	"fmt"
+	"net/url"
 	"os"
 	"regexp"
+	"slices"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/mohae/deepcopy"
@@ -50,9 +52,23 @@ var (
 
 	defaultMaxErrorReasonSize = ByteSize(1 << 50)
 
+	defaultCachedHeaders = []string{"X-ClickHouse-Summary", "X-ClickHouse-Query-Id", "X-ClickHouse-Format", "X-ClickHouse-Timezone"}
+
+	defaultMaxDiffLogSize = ByteSize(64 << 10)
+
+	defaultSlowQueryLogSize = 256
+
 	defaultRetryNumber = 0
 )
 
+const (
+	// DefaultQueuePriority is the priority of users without `queue_priority`
+	DefaultQueuePriority uint32 = 5
+
+	// MaxQueuePriority is the lowest allowed `queue_priority`
+	MaxQueuePriority uint32 = 10
+)
+
 // Config describes server configuration, access and proxy rules
 type Config struct {
 	Server Server `yaml:"server,omitempty"`
@@ -76,11 +92,31 @@ type Config struct {
 
 	ParamGroups []ParamGroup `yaml:"param_groups,omitempty"`
 
+	// External backend authenticating users missing in `users`
+	AuthBackend *AuthBackend `yaml:"auth_backend,omitempty"`
+
+	// Alternative ways of authenticating users from `users`
+	Auth *Auth `yaml:"auth,omitempty"`
+
+	// Log of requests of authenticated users
+	AuditLog *AuditLog `yaml:"audit_log,omitempty"`
+
 	ConnectionPool ConnectionPool `yaml:"connection_pool,omitempty"`
 
 	// Allow to proxy ping requests
 	AllowPing bool `yaml:"allow_ping,omitempty"`
 
+	// Whether to reload the config once the config file
+	// or files referenced by it change
+	ReloadOnChange bool `yaml:"reload_on_change,omitempty"`
+
+	// Maximum size of the config diff logged on reloads
+	MaxDiffLogSize ByteSize `yaml:"max_diff_log_size,omitempty"`
+
+	// Maximum number of requests kept in the slow query log
+	// if omitted or zero - 256 is used
+	SlowQueryLogSize int `yaml:"slow_query_log_size,omitempty"`
+
 	networkReg map[string]Networks
 
 	// Catches all undefined fields
@@ -104,6 +140,12 @@ func withoutSensitiveInfo(config *Config) *Config {
 	for i := range c.Users {
 		c.Users[i].Password = pswPlaceHolder
 	}
+	if len(c.Server.Metrics.Password) > 0 {
+		c.Server.Metrics.Password = pswPlaceHolder
+	}
+	if c.AuthBackend != nil && len(c.AuthBackend.BindPassword) > 0 {
+		c.AuthBackend.BindPassword = pswPlaceHolder
+	}
 	for i := range c.Clusters {
 		if len(c.Clusters[i].KillQueryUser.Name) > 0 {
 			c.Clusters[i].KillQueryUser.Password = pswPlaceHolder
@@ -111,11 +153,20 @@ func withoutSensitiveInfo(config *Config) *Config {
 		for j := range c.Clusters[i].ClusterUsers {
 			c.Clusters[i].ClusterUsers[j].Password = pswPlaceHolder
 		}
+		if u, err := url.Parse(c.Clusters[i].HTTPProxy); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), pswPlaceHolder)
+				c.Clusters[i].HTTPProxy = u.String()
+			}
+		}
 	}
 	for i := range c.Caches {
 		if len(c.Caches[i].Redis.Password) > 0 {
 			c.Caches[i].Redis.Password = pswPlaceHolder
 		}
+		if len(c.Caches[i].Redis.SentinelPassword) > 0 {
+			c.Caches[i].Redis.SentinelPassword = pswPlaceHolder
+		}
 	}
 	return c
 }
@@ -149,6 +200,14 @@ func (c *Config) validate() error {
 		return fmt.Errorf("neither HTTP nor HTTPS not configured")
 	}
 
+	addrs := make(map[string]struct{}, len(c.Server.HTTP.ListenAddr)+len(c.Server.HTTPS.ListenAddr))
+	for _, la := range append(append(ListenAddrs{}, c.Server.HTTP.ListenAddr...), c.Server.HTTPS.ListenAddr...) {
+		if _, ok := addrs[la.Addr]; ok {
+			return fmt.Errorf("duplicate `listen_addr` %q", la.Addr)
+		}
+		addrs[la.Addr] = struct{}{}
+	}
+
 	if len(c.Server.HTTPS.ListenAddr) > 0 {
 		if len(c.Server.HTTPS.Autocert.CacheDir) == 0 && len(c.Server.HTTPS.CertFile) == 0 && len(c.Server.HTTPS.KeyFile) == 0 {
 			return fmt.Errorf("configuration `https` is missing. " +
@@ -159,6 +218,87 @@ func (c *Config) validate() error {
 			c.Server.HTTP.ForceAutocertHandler = true
 		}
 	}
+
+	if err := c.validateLayeredCaches(); err != nil {
+		return err
+	}
+
+	if err := c.validateAuthBackend(); err != nil {
+		return err
+	}
+
+	if err := c.validateSegmentRouting(); err != nil {
+		return err
+	}
+
+	return c.validateDistributedRateLimit()
+}
+
+func (c *Config) validateSegmentRouting() error {
+	segmentRouting := make(map[string]bool, len(c.Clusters))
+	for _, cl := range c.Clusters {
+		segmentRouting[cl.Name] = cl.SegmentRouting
+	}
+	for _, u := range c.Users {
+		if u.MaxSessions > 0 && segmentRouting[u.ToCluster] {
+			return fmt.Errorf("`cluster.segment_routing` of %q doesn't support sessions, so `max_sessions` cannot be set for %q", u.ToCluster, u.Name)
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateAuthBackend() error {
+	if c.AuthBackend == nil {
+		return nil
+	}
+	for _, u := range c.Users {
+		if u.Name != c.AuthBackend.LDAPUserTemplate {
+			continue
+		}
+		if u.IsWildcarded {
+			return fmt.Errorf("`auth_backend.ldap_user_template` cannot reference wildcarded user %q", u.Name)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown user %q in `auth_backend.ldap_user_template`", c.AuthBackend.LDAPUserTemplate)
+}
+
+func (c *Config) validateLayeredCaches() error {
+	modes := make(map[string]string, len(c.Caches))
+	for _, cc := range c.Caches {
+		modes[cc.Name] = cc.Mode
+	}
+	for _, cc := range c.Caches {
+		if cc.Mode != "layered" {
+			continue
+		}
+		for _, level := range []string{cc.L1, cc.L2} {
+			mode, ok := modes[level]
+			if !ok {
+				return fmt.Errorf("unknown cache %q in layered cache %q", level, cc.Name)
+			}
+			if mode == "layered" {
+				return fmt.Errorf("layered cache %q cannot contain layered cache %q", cc.Name, level)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateDistributedRateLimit() error {
+	for _, u := range c.Users {
+		for _, cc := range c.Caches {
+			if cc.Name != u.Cache || cc.Mode == "redis" {
+				continue
+			}
+			if u.DistributedRateLimit {
+				return fmt.Errorf("`distributed_rate_limit` requires `cache` %q to be in `redis` mode for %q", cc.Name, u.Name)
+			}
+			if u.DistributedDailyBudget {
+				return fmt.Errorf("`distributed_daily_budget` requires `cache` %q to be in `redis` mode for %q", cc.Name, u.Name)
+			}
+		}
+	}
 	return nil
 }
 
@@ -200,6 +340,14 @@ func (cfg *Config) setDefaults() error {
 		cfg.MaxErrorReasonSize = defaultMaxErrorReasonSize
 	}
 
+	if cfg.MaxDiffLogSize <= 0 {
+		cfg.MaxDiffLogSize = defaultMaxDiffLogSize
+	}
+
+	if cfg.SlowQueryLogSize <= 0 {
+		cfg.SlowQueryLogSize = defaultSlowQueryLogSize
+	}
+
 	cfg.setServerMaxResponseTime(maxResponseTime)
 
 	return nil
@@ -258,6 +406,35 @@ type Server struct {
 	// Optional Proxy configuration
 	Proxy Proxy `yaml:"proxy,omitempty"`
 
+	// Optional admin endpoints configuration
+	Admin Admin `yaml:"admin,omitempty"`
+
+	// Optional /healthz endpoint configuration
+	Healthz Healthz `yaml:"healthz,omitempty"`
+
+	// Optional CORS preflight requests configuration
+	CORS CORS `yaml:"cors,omitempty"`
+
+	// Optional rate limiting of requests per client IP,
+	// applied before users are authenticated
+	PerIPRateLimit PerIPRateLimit `yaml:"per_ip_rate_limit,omitempty"`
+
+	// Optional proxying of ClickHouse native protocol connections
+	NativeProxy NativeProxy `yaml:"native_proxy,omitempty"`
+
+	// Maximum size of request bodies for users without `max_request_body_size`
+	// if omitted or zero - no limits would be applied
+	MaxRequestBodySize ByteSize `yaml:"max_request_body_size,omitempty"`
+
+	// ShutdownDrainTimeout is the maximum duration in-flight requests
+	// may take to complete after SIGTERM is received.
+	// Default value is 30s
+	ShutdownDrainTimeout Duration `yaml:"shutdown_drain_timeout,omitempty"`
+
+	// Whether errors generated by chproxy are formatted as ClickHouse exceptions
+	// with X-ClickHouse-Exception-Code header
+	ClickHouseExceptions bool `yaml:"clickhouse_exceptions,omitempty"`
+
 	// Catches all undefined fields
 	XXX map[string]interface{} `yaml:",inline"`
 }
@@ -289,8 +466,8 @@ type TimeoutCfg struct {
 
 // HTTP describes configuration for server to listen HTTP connections
 type HTTP struct {
-	// TCP address to listen to for http
-	ListenAddr string `yaml:"listen_addr"`
+	// TCP addresses to listen to for http
+	ListenAddr ListenAddrs `yaml:"listen_addr"`
 
 	NetworksOrGroups NetworksOrGroups `yaml:"allowed_networks,omitempty"`
 
@@ -334,6 +511,95 @@ func (c *HTTP) validate() error {
 	return nil
 }
 
+// ListenAddrs is a list of TCP addresses to listen to.
+// It may be set either as a single address or as a list of addresses.
+type ListenAddrs []ListenAddr
+
+// ListenAddr describes a TCP address to listen to.
+// It may be set either as a plain address or as a mapping.
+type ListenAddr struct {
+	// TCP address to listen to
+	Addr string `yaml:"addr"`
+
+	NetworksOrGroups NetworksOrGroups `yaml:"allowed_networks,omitempty"`
+
+	// List of networks that access is allowed from via this address.
+	// Overrides the `allowed_networks` of the protocol if set
+	AllowedNetworks Networks `yaml:"-"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (l *ListenAddrs) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var addr string
+	if err := unmarshal(&addr); err == nil {
+		*l = nil
+		if len(addr) > 0 {
+			*l = ListenAddrs{{Addr: addr}}
+		}
+		return nil
+	}
+	type plain ListenAddrs
+	return unmarshal((*plain)(l))
+}
+
+// MarshalYAML implements the yaml.Marshaler interface.
+func (l ListenAddrs) MarshalYAML() (interface{}, error) {
+	if len(l) == 1 && len(l[0].NetworksOrGroups) == 0 {
+		return l[0].Addr, nil
+	}
+	return []ListenAddr(l), nil
+}
+
+// hasNetworks returns true if any of the addresses overrides `allowed_networks`.
+func (l ListenAddrs) hasNetworks() bool {
+	for _, la := range l {
+		if len(la.NetworksOrGroups) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// isRestricted returns true if access via all the addresses is limited
+// either by their own networks or by the networks of the protocol.
+func (l ListenAddrs) isRestricted(networks NetworksOrGroups) bool {
+	for _, la := range l {
+		if len(la.NetworksOrGroups) == 0 && len(networks) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (la *ListenAddr) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var addr string
+	if err := unmarshal(&addr); err == nil {
+		la.Addr = addr
+		return nil
+	}
+	type plain ListenAddr
+	if err := unmarshal((*plain)(la)); err != nil {
+		return err
+	}
+	if len(la.Addr) == 0 {
+		return fmt.Errorf("`listen_addr.addr` cannot be empty")
+	}
+	return checkOverflow(la.XXX, fmt.Sprintf("listen_addr %q", la.Addr))
+}
+
+// MarshalYAML implements the yaml.Marshaler interface.
+func (la ListenAddr) MarshalYAML() (interface{}, error) {
+	if len(la.NetworksOrGroups) == 0 {
+		return la.Addr, nil
+	}
+	type plain ListenAddr
+	return plain(la), nil
+}
+
 // TLS describes generic configuration for TLS connections,
 // it can be used for both HTTPS and Redis TLS.
 type TLS struct {
@@ -375,9 +641,9 @@ func (c *TLS) BuildTLSConfig(acm *autocert.Manager) (*tls.Config, error) {
 // It can be autocert with letsencrypt
 // or custom certificate
 type HTTPS struct {
-	// TCP address to listen to for https
+	// TCP addresses to listen to for https
 	// Default is `:443`
-	ListenAddr string `yaml:"listen_addr,omitempty"`
+	ListenAddr ListenAddrs `yaml:"listen_addr,omitempty"`
 
 	// TLS configuration
 	TLS `yaml:",inline"`
@@ -419,7 +685,7 @@ func (c *HTTPS) validate() error {
 	}
 
 	if len(c.ListenAddr) == 0 {
-		c.ListenAddr = ":443"
+		c.ListenAddr = ListenAddrs{{Addr: ":443"}}
 	}
 
 	if err := c.validateCertConfig(); err != nil {
@@ -434,7 +700,7 @@ func (c *HTTPS) validateCertConfig() error {
 		if len(c.CertFile) > 0 || len(c.KeyFile) > 0 {
 			return fmt.Errorf("it is forbidden to specify certificate and `https.autocert` at the same time. Choose one way")
 		}
-		if len(c.NetworksOrGroups) > 0 {
+		if len(c.NetworksOrGroups) > 0 || c.ListenAddr.hasNetworks() {
 			return fmt.Errorf("`letsencrypt` specification requires https server to be without `allowed_networks` limits. " +
 				"Otherwise, certificates will be impossible to generate")
 		}
@@ -487,6 +753,23 @@ type Metrics struct {
 	// Prometheus metric namespace
 	Namespace string `yaml:"namespace,omitempty"`
 
+	// Buckets of duration metrics exposed as histograms
+	Histograms Histograms `yaml:"histograms,omitempty"`
+
+	// User name required via basic auth for scraping metrics
+	// if omitted - metrics are scraped without credentials
+	User string `yaml:"user,omitempty"`
+
+	// Password required via basic auth for scraping metrics
+	Password string `yaml:"password,omitempty"`
+
+	// Whether to label request metrics by the fingerprint of the query
+	EnableQueryFingerprintLabel bool `yaml:"enable_query_fingerprint_label,omitempty"`
+
+	// Maximum number of distinct query fingerprints used as labels
+	// if omitted or zero - 1000 is used
+	MaxFingerprintLabels int `yaml:"max_fingerprint_labels,omitempty"`
+
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline"`
 }
@@ -497,9 +780,237 @@ func (c *Metrics) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err := unmarshal((*plain)(c)); err != nil {
 		return err
 	}
+	if len(c.Password) > 0 && len(c.User) == 0 {
+		return fmt.Errorf("`metrics.password` cannot be set without `metrics.user`")
+	}
+	if c.MaxFingerprintLabels < 0 {
+		return fmt.Errorf("`metrics.max_fingerprint_labels` cannot be negative")
+	}
 	return checkOverflow(c.XXX, "metrics")
 }
 
+// Histograms describes buckets of duration metrics.
+// Metrics without buckets are exposed as summaries.
+type Histograms struct {
+	// Buckets of the `request_duration_seconds` metric
+	RequestDurationBuckets []float64 `yaml:"request_duration_buckets,omitempty"`
+
+	// Buckets of the `proxied_response_duration_seconds` metric
+	ProxiedResponseDurationBuckets []float64 `yaml:"proxied_response_duration_buckets,omitempty"`
+
+	// Buckets of the `cached_response_duration_seconds` metric
+	CachedResponseDurationBuckets []float64 `yaml:"cached_response_duration_buckets,omitempty"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (h *Histograms) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Histograms
+	if err := unmarshal((*plain)(h)); err != nil {
+		return err
+	}
+	buckets := []struct {
+		name    string
+		buckets []float64
+	}{
+		{"request_duration_buckets", h.RequestDurationBuckets},
+		{"proxied_response_duration_buckets", h.ProxiedResponseDurationBuckets},
+		{"cached_response_duration_buckets", h.CachedResponseDurationBuckets},
+	}
+	for _, b := range buckets {
+		if err := validateBuckets(b.buckets); err != nil {
+			return fmt.Errorf("invalid `%s`: %w", b.name, err)
+		}
+	}
+	return checkOverflow(h.XXX, "histograms")
+}
+
+func validateBuckets(buckets []float64) error {
+	if buckets == nil {
+		return nil
+	}
+	if len(buckets) == 0 {
+		return fmt.Errorf("buckets cannot be empty")
+	}
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] <= buckets[i-1] {
+			return fmt.Errorf("buckets must be in increasing order, got %v after %v", buckets[i], buckets[i-1])
+		}
+	}
+	return nil
+}
+
+// Admin describes configuration to access /admin/* endpoints
+type Admin struct {
+	// Whether to enable admin endpoints
+	Enable bool `yaml:"enable,omitempty"`
+
+	NetworksOrGroups NetworksOrGroups `yaml:"allowed_networks,omitempty"`
+
+	// List of networks that access is allowed from
+	// Each list item could be IP address or subnet mask
+	AllowedNetworks Networks `yaml:"-"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *Admin) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Admin
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	return checkOverflow(c.XXX, "admin")
+}
+
+// NativeProxy describes configuration for proxying connections
+// of the ClickHouse native protocol
+type NativeProxy struct {
+	// TCP address to listen to for native protocol connections
+	// Native protocol connections aren't accepted if empty
+	ListenAddr string `yaml:"listen_addr,omitempty"`
+
+	NetworksOrGroups NetworksOrGroups `yaml:"allowed_networks,omitempty"`
+
+	// List of networks that access is allowed from
+	// Each list item could be IP address or subnet mask
+	// if omitted or zero - no limits would be applied
+	AllowedNetworks Networks `yaml:"-"`
+
+	// Port of the native protocol on cluster nodes
+	// Hosts of `nodes` are used with this port
+	// Default value is 9000
+	NodePort int `yaml:"node_port,omitempty"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *NativeProxy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain NativeProxy
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.NodePort < 0 || c.NodePort > 65535 {
+		return fmt.Errorf("`native_proxy.node_port` must be in the range [0..65535]; got %d", c.NodePort)
+	}
+	return checkOverflow(c.XXX, "native_proxy")
+}
+
+// PerIPRateLimit describes rate limiting of requests per client IP
+type PerIPRateLimit struct {
+	// Maximum number of requests per minute from a single IP.
+	// Requests aren't limited if zero
+	ReqPerMin int `yaml:"requests_per_minute,omitempty"`
+
+	// Maximum number of requests from a single IP at once.
+	// Default value is `requests_per_minute`
+	Burst int `yaml:"burst,omitempty"`
+
+	// EvictionTTL is the duration of inactivity after which
+	// the limiter of the IP is dropped.
+	// Default value is 10m
+	EvictionTTL Duration `yaml:"eviction_ttl,omitempty"`
+
+	ExemptNetworksOrGroups NetworksOrGroups `yaml:"exempt_networks,omitempty"`
+
+	// List of networks requests from which aren't limited
+	// Each list item could be IP address or subnet mask
+	ExemptNetworks Networks `yaml:"-"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *PerIPRateLimit) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain PerIPRateLimit
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.ReqPerMin < 0 {
+		return fmt.Errorf("`per_ip_rate_limit.requests_per_minute` cannot be negative")
+	}
+	if c.Burst < 0 {
+		return fmt.Errorf("`per_ip_rate_limit.burst` cannot be negative")
+	}
+	if c.EvictionTTL < 0 {
+		return fmt.Errorf("`per_ip_rate_limit.eviction_ttl` cannot be negative")
+	}
+	return checkOverflow(c.XXX, "per_ip_rate_limit")
+}
+
+// Healthz describes configuration of the /healthz endpoint
+type Healthz struct {
+	// CheckTimeout is the maximum duration of each dependency check.
+	// Default value is 1s
+	CheckTimeout Duration `yaml:"check_timeout,omitempty"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *Healthz) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Healthz
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	return checkOverflow(c.XXX, "healthz")
+}
+
+// CORS describes configuration of responses to CORS preflight requests.
+//
+// Preflight requests carry no credentials, so they are answered
+// the same way for all the users.
+type CORS struct {
+	// Whether to respond to CORS preflight requests
+	Enable bool `yaml:"enable,omitempty"`
+
+	// Methods sent in Access-Control-Allow-Methods
+	// Default value is GET, POST
+	AllowedMethods []string `yaml:"allowed_methods,omitempty"`
+
+	// Headers sent in Access-Control-Allow-Headers
+	// Default value is Authorization, Content-Type, X-ClickHouse-User, X-ClickHouse-Key
+	AllowedHeaders []string `yaml:"allowed_headers,omitempty"`
+
+	// MaxAge is the duration preflight responses may be cached for
+	// Default value is 10m
+	MaxAge Duration `yaml:"max_age,omitempty"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *CORS) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain CORS
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	for _, m := range c.AllowedMethods {
+		if len(m) == 0 || strings.ContainsAny(m, " \t\r\n,") {
+			return fmt.Errorf("invalid `cors.allowed_methods` item %q", m)
+		}
+	}
+	for _, h := range c.AllowedHeaders {
+		if len(h) == 0 || strings.ContainsAny(h, " \t\r\n:,") {
+			return fmt.Errorf("invalid `cors.allowed_headers` item %q", h)
+		}
+	}
+	if c.MaxAge < 0 {
+		return fmt.Errorf("`cors.max_age` cannot be negative")
+	}
+
+	return checkOverflow(c.XXX, "cors")
+}
+
 type Proxy struct {
 	// Enable enables parsing proxy headers. In proxy mode, CHProxy will try to
 	// parse the X-Forwarded-For, X-Real-IP or Forwarded header to extract the IP. If an other header is configured
@@ -511,6 +1022,11 @@ type Proxy struct {
 	// will be ignored.
 	Header string `yaml:"header,omitempty"`
 
+	// TrustedProxies is the list of networks of the proxies in front of CHProxy.
+	// If set, proxy headers are used only for requests from these networks,
+	// and the trusted hops are skipped in the headers to find the client address.
+	TrustedProxies Networks `yaml:"trusted_proxies,omitempty"`
+
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline"`
 }
@@ -526,6 +1042,10 @@ func (c *Proxy) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return fmt.Errorf("`proxy_header` cannot be set without enabling proxy settings")
 	}
 
+	if !c.Enable && len(c.TrustedProxies) > 0 {
+		return fmt.Errorf("`trusted_proxies` cannot be set without enabling proxy settings")
+	}
+
 	return checkOverflow(c.XXX, "proxy")
 }
 
@@ -547,6 +1067,11 @@ type Cluster struct {
 	// Either Nodes or Replicas must be set, but not both.
 	Nodes []string `yaml:"nodes,omitempty"`
 
+	// NodeWeights maps Nodes to their weights. Nodes with higher weights
+	// receive proportionally more queries. See MaxWeight
+	// if omitted - the weight of nodes is 1
+	NodeWeights map[string]uint32 `yaml:"node_weights,omitempty"`
+
 	// Replicas contains replicas.
 	//
 	// Either Replicas or Nodes must be set, but not both.
@@ -567,21 +1092,94 @@ type Cluster struct {
 
 	// Retry number for query - how many times a query can retry after receiving a recoverable but failed response from Clickhouse node
 	RetryNumber int `yaml:"retry_number,omitempty"`
-}
 
-// UnmarshalYAML implements the yaml.Unmarshaler interface.
-func (c *Cluster) UnmarshalYAML(unmarshal func(interface{}) error) error {
-	*c = defaultCluster
-	type plain Cluster
-	if err := unmarshal((*plain)(c)); err != nil {
-		return err
-	}
+	// RetryDelay is the delay before the first retry of the query
+	// By default queries are retried immediately
+	RetryDelay Duration `yaml:"retry_delay,omitempty"`
 
-	if err := c.validate(); err != nil {
-		return err
-	}
+	// RetryBackoffMultiplier is the factor the retry delay is multiplied by after every retry
+	// Default value is 1, i.e. the delay is constant
+	RetryBackoffMultiplier float64 `yaml:"retry_backoff_multiplier,omitempty"`
 
-	return checkOverflow(c.XXX, fmt.Sprintf("cluster %q", c.Name))
+	// MaxRetryDelay caps the retry delay growing with RetryBackoffMultiplier
+	// if omitted or zero - the delay isn't capped
+	MaxRetryDelay Duration `yaml:"max_retry_delay,omitempty"`
+
+	// KillQueryTimeout is the maximum duration of requests killing timed out queries
+	KillQueryTimeout Duration `yaml:"kill_query_timeout,omitempty"`
+
+	// KillQueryRetries is the number of retries of failed requests killing queries
+	KillQueryRetries int `yaml:"kill_query_retries,omitempty"`
+
+	// KillQueryOnCluster is the name of the cluster in ClickHouse
+	// timed out queries are killed on with `KILL QUERY ON CLUSTER`.
+	// By default queries are killed only on the node they are sent to.
+	KillQueryOnCluster string `yaml:"kill_query_on_cluster,omitempty"`
+
+	// KillQueryTemplate is the statement killing timed out queries
+	// with the KillQueryIDPlaceholder substituted by the query id.
+	KillQueryTemplate string `yaml:"kill_query_template,omitempty"`
+
+	// TLS configuration for connections to `https` nodes
+	TLS ClusterTLS `yaml:"tls,omitempty"`
+
+	// HTTPProxy is the URL of the HTTP proxy connections to the nodes are sent via.
+	// By default the proxy is taken from HTTP_PROXY, HTTPS_PROXY and NO_PROXY env vars.
+	HTTPProxy string `yaml:"http_proxy,omitempty"`
+
+	// HTTP2 enforces HTTP/2 for connections to `https` nodes.
+	HTTP2 bool `yaml:"http2,omitempty"`
+
+	// H2C enforces HTTP/2 without TLS (h2c) for connections to `http` nodes.
+	H2C bool `yaml:"h2c,omitempty"`
+
+	// MaxConcurrentQueriesPerNode is the maximum number of concurrently
+	// running queries on every node of the cluster.
+	// By default there are no limits.
+	MaxConcurrentQueriesPerNode uint32 `yaml:"max_concurrent_queries_per_node,omitempty"`
+
+	// LoadBalancing is the strategy of choosing nodes for requests without session_id:
+	// LoadBalancingLeastLoaded or LoadBalancingConsistentHash.
+	// By default the least loaded node is chosen.
+	LoadBalancing string `yaml:"load_balancing,omitempty"`
+
+	// PenaltySize is the load added to nodes on every failed or timed out query.
+	// if omitted or zero - the default penalty size is used
+	PenaltySize uint32 `yaml:"penalty_size,omitempty"`
+
+	// PenaltyDuration is the duration the penalty is removed after.
+	// if omitted or zero - the default penalty duration is used
+	PenaltyDuration Duration `yaml:"penalty_duration,omitempty"`
+
+	// SegmentRouting enables choosing replicas for requests in round-robin
+	// order instead of the least loaded replica, so identical queries
+	// are evenly spread among replicas.
+	// Requests with session_id aren't supported by such clusters.
+	SegmentRouting bool `yaml:"segment_routing,omitempty"`
+}
+
+const (
+	// LoadBalancingLeastLoaded chooses the least loaded node in round-robin fashion.
+	LoadBalancingLeastLoaded = "least_loaded"
+
+	// LoadBalancingConsistentHash chooses the node by the hash of the query,
+	// so the same query is always proxied to the same node while it is available.
+	LoadBalancingConsistentHash = "consistent_hash"
+)
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *Cluster) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = defaultCluster
+	type plain Cluster
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	if err := c.validate(); err != nil {
+		return err
+	}
+
+	return checkOverflow(c.XXX, fmt.Sprintf("cluster %q", c.Name))
 }
 
 func (c *Cluster) validate() error {
@@ -601,6 +1199,83 @@ func (c *Cluster) validate() error {
 		return fmt.Errorf("`cluster.heartbeat` cannot be unset for %q", c.Name)
 	}
 
+	for _, r := range c.Replicas {
+		if r.HeartBeat == nil {
+			continue
+		}
+		if r.HeartBeat.MaxConcurrent != 0 {
+			return fmt.Errorf("`heartbeat.max_concurrent` cannot be set for replica %q of %q; set it for the cluster", r.Name, c.Name)
+		}
+		r.HeartBeat.inherit(c.HeartBeat)
+		if err := r.HeartBeat.validate(); err != nil {
+			return fmt.Errorf("invalid heartbeat for replica %q of %q: %w", r.Name, c.Name, err)
+		}
+	}
+
+	if err := c.validateNodeWeights(); err != nil {
+		return err
+	}
+
+	if c.KillQueryRetries < 0 {
+		return fmt.Errorf("`cluster.kill_query_retries` cannot be negative for %q", c.Name)
+	}
+
+	if c.RetryDelay < 0 || c.MaxRetryDelay < 0 {
+		return fmt.Errorf("`cluster.retry_delay` and `cluster.max_retry_delay` cannot be negative for %q", c.Name)
+	}
+
+	if c.RetryBackoffMultiplier != 0 && c.RetryBackoffMultiplier < 1 {
+		return fmt.Errorf("`cluster.retry_backoff_multiplier` cannot be less than 1 for %q", c.Name)
+	}
+
+	if len(c.KillQueryOnCluster) > 0 && len(c.KillQueryTemplate) > 0 {
+		return fmt.Errorf("`cluster.kill_query_on_cluster` cannot be simultaneously set with `cluster.kill_query_template` for %q", c.Name)
+	}
+
+	if strings.ContainsAny(c.KillQueryOnCluster, "`\\") {
+		return fmt.Errorf("`cluster.kill_query_on_cluster` cannot contain backticks or backslashes for %q", c.Name)
+	}
+
+	if len(c.KillQueryTemplate) > 0 && !strings.Contains(c.KillQueryTemplate, KillQueryIDPlaceholder) {
+		return fmt.Errorf("`cluster.kill_query_template` must contain %s for %q", KillQueryIDPlaceholder, c.Name)
+	}
+
+	if len(c.HTTPProxy) > 0 {
+		u, err := url.Parse(c.HTTPProxy)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return fmt.Errorf("`cluster.http_proxy` must be an `http` or `https` URL, got %q instead for %q", c.HTTPProxy, c.Name)
+		}
+	}
+
+	if c.HTTP2 && c.Scheme != "https" {
+		return fmt.Errorf("`cluster.http2` requires `https` scheme for %q", c.Name)
+	}
+
+	if c.H2C && c.Scheme != "http" {
+		return fmt.Errorf("`cluster.h2c` requires `http` scheme for %q", c.Name)
+	}
+
+	switch c.LoadBalancing {
+	case "", LoadBalancingLeastLoaded, LoadBalancingConsistentHash:
+	default:
+		return fmt.Errorf("`cluster.load_balancing` must be %q or %q, got %q instead for %q",
+			LoadBalancingLeastLoaded, LoadBalancingConsistentHash, c.LoadBalancing, c.Name)
+	}
+
+	if c.SegmentRouting && c.LoadBalancing == LoadBalancingConsistentHash {
+		return fmt.Errorf("`cluster.segment_routing` cannot be simultaneously set with `cluster.load_balancing: %s` for %q", LoadBalancingConsistentHash, c.Name)
+	}
+
+	for _, cu := range c.ClusterUsers {
+		if c.SegmentRouting && cu.MaxSessions > 0 {
+			return fmt.Errorf("`cluster.segment_routing` doesn't support sessions, so `max_sessions` cannot be set for cluster user %q of %q", cu.Name, c.Name)
+		}
+	}
+
+	if (c.HTTP2 || c.H2C) && len(c.HTTPProxy) > 0 {
+		return fmt.Errorf("`cluster.http_proxy` cannot be simultaneously set with `cluster.http2` or `cluster.h2c` for %q", c.Name)
+	}
+
 	return nil
 }
 
@@ -628,10 +1303,37 @@ type Replica struct {
 	// Nodes contains replica nodes.
 	Nodes []string `yaml:"nodes"`
 
+	// HeartBeat overrides the heartbeat config of the cluster for replica nodes.
+	// Unset fields are inherited from the cluster.
+	HeartBeat *HeartBeat `yaml:"heartbeat,omitempty"`
+
+	// Weight of the replica. Replicas with higher weights
+	// receive proportionally more queries. See MaxWeight
+	// if omitted or zero - 1 is used
+	Weight uint32 `yaml:"weight,omitempty"`
+
 	// Catches all undefined fields
 	XXX map[string]interface{} `yaml:",inline"`
 }
 
+// MaxWeight is the maximum weight of replicas and nodes.
+const MaxWeight = 100
+
+func (c *Cluster) validateNodeWeights() error {
+	if len(c.NodeWeights) > 0 && len(c.Nodes) == 0 {
+		return fmt.Errorf("`cluster.node_weights` may be set only with `cluster.nodes` for %q; set `weight` of replicas instead", c.Name)
+	}
+	for node, w := range c.NodeWeights {
+		if !slices.Contains(c.Nodes, node) {
+			return fmt.Errorf("unknown node %q in `cluster.node_weights` for %q", node, c.Name)
+		}
+		if w == 0 || w > MaxWeight {
+			return fmt.Errorf("`cluster.node_weights` must be in the range [1..%d]; got %d for node %q of %q", MaxWeight, w, node, c.Name)
+		}
+	}
+	return nil
+}
+
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
 func (r *Replica) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	type plain Replica
@@ -644,9 +1346,46 @@ func (r *Replica) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if len(r.Nodes) == 0 {
 		return fmt.Errorf("`replica.nodes` cannot be empty for %q", r.Name)
 	}
+	if r.Weight > MaxWeight {
+		return fmt.Errorf("`replica.weight` cannot exceed %d for %q", MaxWeight, r.Name)
+	}
 	return checkOverflow(r.XXX, fmt.Sprintf("replica %q", r.Name))
 }
 
+// ClusterTLS describes TLS configuration for connections to cluster nodes.
+type ClusterTLS struct {
+	// Certificate and key files of the client certificate
+	// presented to nodes requiring mutual TLS
+	CertFile string `yaml:"cert_file,omitempty"`
+	KeyFile  string `yaml:"key_file,omitempty"`
+
+	// File with CA certificates node certificates are verified with
+	// if omitted - system CA certificates are used
+	CAFile string `yaml:"ca_file,omitempty"`
+
+	// Whether to skip verification of node certificates
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify,omitempty"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *ClusterTLS) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ClusterTLS
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if (len(c.CertFile) > 0) != (len(c.KeyFile) > 0) {
+		return fmt.Errorf("`tls.cert_file` and `tls.key_file` must be set together")
+	}
+	return checkOverflow(c.XXX, "tls")
+}
+
+// KillQueryIDPlaceholder is substituted by the id of the killed query
+// in `kill_query_template`.
+const KillQueryIDPlaceholder = "{{query_id}}"
+
 // KillQueryUser - user configuration for killing timed out queries.
 type KillQueryUser struct {
 	// User name
@@ -690,12 +1429,28 @@ type HeartBeat struct {
 	// default value is `Ok.\n`
 	Response string `yaml:"response,omitempty"`
 
+	// Match is the way the response is compared with the reference one.
+	// It is either `exact`, `contains` or `regex`.
+	// if omitted - `exact` is used
+	Match string `yaml:"match,omitempty"`
+
 	// Credentials to send heartbeat requests
 	// for anything except '/ping'.
 	// If not specified, the first cluster user' creadentials are used
 	User     string `yaml:"user,omitempty"`
 	Password string `yaml:"password,omitempty"`
 
+	// MaxHealthyLatency is the heartbeat latency the health score
+	// of cluster nodes is normalised over.
+	// if omitted or zero - timeout is used
+	MaxHealthyLatency Duration `yaml:"max_healthy_latency,omitempty"`
+
+	// MaxConcurrent is the maximum number of heartbeats
+	// running simultaneously against the cluster nodes.
+	// It may be set only for the cluster.
+	// if omitted or zero - no limits
+	MaxConcurrent int `yaml:"max_concurrent,omitempty"`
+
 	// Catches all undefined fields
 	XXX map[string]interface{} `yaml:",inline"`
 }
@@ -706,9 +1461,62 @@ func (h *HeartBeat) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err := unmarshal((*plain)(h)); err != nil {
 		return err
 	}
+	if err := h.validate(); err != nil {
+		return err
+	}
 	return checkOverflow(h.XXX, "heartbeat")
 }
 
+func (h *HeartBeat) validate() error {
+	switch h.Match {
+	case "", HeartBeatMatchExact, HeartBeatMatchContains:
+	case HeartBeatMatchRegex:
+		if _, err := regexp.Compile(h.Response); err != nil {
+			return fmt.Errorf("cannot compile `heartbeat.response` regexp %q: %w", h.Response, err)
+		}
+	default:
+		return fmt.Errorf("`heartbeat.match` must be one of %q, %q or %q; got %q",
+			HeartBeatMatchExact, HeartBeatMatchContains, HeartBeatMatchRegex, h.Match)
+	}
+	if h.MaxConcurrent < 0 {
+		return fmt.Errorf("`heartbeat.max_concurrent` cannot be negative")
+	}
+	return nil
+}
+
+// Ways of comparing heartbeat responses with the reference one.
+const (
+	HeartBeatMatchExact    = "exact"
+	HeartBeatMatchContains = "contains"
+	HeartBeatMatchRegex    = "regex"
+)
+
+// inherit sets the unset fields of h to the values of parent.
+func (h *HeartBeat) inherit(parent HeartBeat) {
+	if h.Interval == 0 {
+		h.Interval = parent.Interval
+	}
+	if h.Timeout == 0 {
+		h.Timeout = parent.Timeout
+	}
+	if h.Request == "" {
+		h.Request = parent.Request
+	}
+	if h.Response == "" {
+		h.Response = parent.Response
+	}
+	if h.Match == "" {
+		h.Match = parent.Match
+	}
+	if h.User == "" {
+		h.User = parent.User
+		h.Password = parent.Password
+	}
+	if h.MaxHealthyLatency == 0 {
+		h.MaxHealthyLatency = parent.MaxHealthyLatency
+	}
+}
+
 // User describes list of allowed users
 // which requests will be proxied to ClickHouse
 type User struct {
@@ -726,19 +1534,83 @@ type User struct {
 	// whom credentials will be used for proxying request to CH
 	ToUser string `yaml:"to_user"`
 
+	// WriteCluster is the name of cluster where write queries
+	// (INSERT, CREATE, ALTER, DROP, TRUNCATE) will be proxied
+	// if omitted - write queries are proxied to ToCluster
+	WriteCluster string `yaml:"write_cluster,omitempty"`
+
+	// FallbackCluster is the name of cluster where requests are proxied
+	// if all the nodes of the cluster chosen for the request are inactive
+	// if omitted - requests are proxied to the inactive cluster
+	FallbackCluster string `yaml:"fallback_cluster,omitempty"`
+
+	// FallbackToUser is the name of cluster_user from FallbackCluster
+	// whom credentials will be used for proxying requests to FallbackCluster
+	// if omitted - ToUser is used
+	FallbackToUser string `yaml:"fallback_to_user,omitempty"`
+
+	// MirrorToCluster is the name of cluster where copies of requests
+	// will be sent to in background. Responses of the cluster are discarded
+	// if omitted - requests aren't mirrored
+	MirrorToCluster string `yaml:"mirror_to_cluster,omitempty"`
+
 	// Maximum number of concurrently running queries for user
 	// if omitted or zero - no limits would be applied
 	MaxConcurrentQueries uint32 `yaml:"max_concurrent_queries,omitempty"`
 
+	// Maximum number of active sessions for user
+	// if omitted or zero - no limits would be applied
+	MaxSessions uint32 `yaml:"max_sessions,omitempty"`
+
 	// Maximum duration of query execution for user
 	// if omitted or zero - limit is set to 120 seconds
 	MaxExecutionTime Duration `yaml:"max_execution_time,omitempty"`
 
+	// Requests of the user taking longer than the threshold
+	// are recorded in the slow query log
+	// if omitted or zero - requests of the user aren't recorded
+	SlowQueryThreshold Duration `yaml:"slow_query_threshold,omitempty"`
+
 	// Maximum number of requests per minute for user
 	// if omitted or zero - no limits would be applied
 	// if negative - the user is effectively blocked
 	ReqPerMin int32 `yaml:"requests_per_minute,omitempty"`
 
+	// Maximum sum of query durations per hour for user
+	// if omitted or zero - no limits would be applied
+	MaxExecutionTotalPerHour Duration `yaml:"max_execution_total_per_hour,omitempty"`
+
+	// Maximum sum of response sizes per hour for user
+	// if omitted or zero - no limits would be applied
+	MaxBytesTransferredPerHour ByteSize `yaml:"max_bytes_transferred_per_hour,omitempty"`
+
+	// Maximum sum of query durations per day for user, reset at UTC midnight
+	// if omitted or zero - no limits would be applied
+	DailyExecutionBudget Duration `yaml:"daily_execution_budget,omitempty"`
+
+	// Maximum size of a single response for user
+	// if omitted or zero - no limits would be applied
+	MaxResponseSize ByteSize `yaml:"max_response_size,omitempty"`
+
+	// Maximum size of request bodies for user. Compressed bodies are limited
+	// on their compressed size.
+	// if omitted - `server.max_request_body_size` is used
+	// if zero - no limits would be applied
+	MaxRequestBodySize *ByteSize `yaml:"max_request_body_size,omitempty"`
+
+	// Maximum size of POST request bodies buffered in memory for user.
+	// Larger bodies are streamed to ClickHouse and their responses aren't cached.
+	// if omitted or zero - request bodies are always buffered
+	MaxBufferSize ByteSize `yaml:"max_buffer_size,omitempty"`
+
+	// Whether to share the requests_per_minute limit between chproxy instances
+	// via the redis cache of the user
+	DistributedRateLimit bool `yaml:"distributed_rate_limit,omitempty"`
+
+	// Whether to share the daily_execution_budget consumption between chproxy instances
+	// via the redis cache of the user
+	DistributedDailyBudget bool `yaml:"distributed_daily_budget,omitempty"`
+
 	// The burst of request packet size token bucket for user
 	// if omitted or zero - no limits would be applied
 	ReqPacketSizeTokensBurst ByteSize `yaml:"request_packet_size_tokens_burst,omitempty"`
@@ -756,6 +1628,10 @@ type User struct {
 	// if omitted or zero - 10s duration is used
 	MaxQueueTime Duration `yaml:"max_queue_time,omitempty"`
 
+	// Priority of the user's queries waiting for a free slot, from 1 (highest) to 10 (lowest)
+	// if omitted or zero - 5 is used
+	QueuePriority uint32 `yaml:"queue_priority,omitempty"`
+
 	NetworksOrGroups NetworksOrGroups `yaml:"allowed_networks,omitempty"`
 
 	// List of networks that access is allowed from
@@ -775,16 +1651,168 @@ type User struct {
 	// Name of Cache configuration to use for responses of this user
 	Cache string `yaml:"cache,omitempty"`
 
+	// List of regular expressions matched against the normalized query.
+	// The matching queries are neither served from nor stored in Cache
+	// if omitted or empty - all the cacheable queries are cached
+	CacheBypassPatterns []string `yaml:"cache_bypass_patterns,omitempty"`
+
 	// Name of ParamGroup to use
 	Params string `yaml:"params,omitempty"`
 
+	// Name of ParamGroup which params cannot be overridden by clients
+	ForcedParams string `yaml:"forced_params,omitempty"`
+
 	// prefix_*
 	IsWildcarded bool `yaml:"is_wildcarded,omitempty"`
 
+	// Whether to apply max_concurrent_queries to every concrete user
+	// matching the wildcarded user instead of all of them at once
+	PerIdentityLimits bool `yaml:"per_identity_limits,omitempty"`
+
+	// List of rules applied in order to the query before proxying it
+	// if omitted or empty - queries are proxied as is
+	RewriteRules []RewriteRule `yaml:"rewrite_rules,omitempty"`
+
+	// List of rules routing the matching queries to other clusters.
+	// The first matching rule is applied
+	// if omitted or empty - queries are proxied to ToCluster or WriteCluster
+	RoutingRules []RoutingRule `yaml:"routing_rules,omitempty"`
+
+	// List of statement types the user is allowed to run
+	// if omitted or empty - all the statement types are allowed
+	AllowedStatements []string `yaml:"allowed_statements,omitempty"`
+
+	// List of statement types the user isn't allowed to run
+	// if omitted or empty - no statement types are denied
+	DeniedStatements []string `yaml:"denied_statements,omitempty"`
+
+	// List of databases the user is allowed to access
+	// if omitted or empty - all the databases are allowed
+	AllowedDatabases []string `yaml:"allowed_databases,omitempty"`
+
+	// Whether `db.table` references in queries must belong to AllowedDatabases
+	CheckQueryDatabases bool `yaml:"check_query_databases,omitempty"`
+
+	// Format of query results if the client doesn't set one
+	// via `default_format` param or X-ClickHouse-Format header
+	DefaultFormat string `yaml:"default_format,omitempty"`
+
+	// List of result formats the user is allowed to request
+	// if omitted or empty - all the formats are allowed
+	AllowedFormats []string `yaml:"allowed_formats,omitempty"`
+
+	// List of result formats the user is allowed to request via `default_format` param
+	// or X-ClickHouse-Format header
+	// if omitted or empty - AllowedFormats are used
+	AllowedDefaultFormats []string `yaml:"allowed_default_formats,omitempty"`
+
+	// List of request headers passed to ClickHouse
+	// if omitted or empty - all the headers are passed
+	AllowedRequestHeaders []string `yaml:"allowed_request_headers,omitempty"`
+
+	// Headers added to responses, keyed by header name
+	ResponseHeaders map[string]ResponseHeader `yaml:"response_headers,omitempty"`
+
+	// Headers sent to ClickHouse, keyed by header name.
+	// They override headers with the same names sent by the client.
+	// Values may contain HeaderUserPlaceholder
+	Headers map[string]string `yaml:"headers,omitempty"`
+
+	// Template of the User-Agent header sent to ClickHouse
+	// if omitted - the original User-Agent prefixed with chproxy metadata is sent
+	// if empty - the User-Agent header isn't sent
+	UserAgentTemplate *string `yaml:"user_agent_template,omitempty"`
+
+	// Name of the request header carrying the name of the person
+	// the request is sent on behalf of, e.g. by BI tools sharing the user.
+	// The name is appended to the User-Agent sent to ClickHouse.
+	// if omitted - the header is ignored
+	AllowImpersonationHeader string `yaml:"allow_impersonation_header,omitempty"`
+
+	// Whether to set the `log_comment` param to the name
+	// from AllowImpersonationHeader
+	ImpersonationLogComment bool `yaml:"impersonation_log_comment,omitempty"`
+
+	// Whether to send queries with the query_id set by the client
+	// instead of the one generated by chproxy
+	KeepClientQueryID bool `yaml:"keep_client_query_id,omitempty"`
+
+	// Encoding responses are re-encoded to if the client accepts it.
+	// See ResponseCompressions for possible values
+	// if omitted - responses are sent as is
+	ResponseCompression string `yaml:"response_compression,omitempty"`
+
+	// List of encodings the client may request via Accept-Encoding.
+	// The first encoding is requested if none of the encodings
+	// requested by the client is allowed.
+	// if omitted or empty - all the encodings are allowed
+	AllowedEncodings []string `yaml:"allowed_encodings,omitempty"`
+
+	// Buffering of small INSERTs, which are flushed as a single INSERT
+	// if omitted - INSERTs are proxied as is
+	InsertBatching *InsertBatching `yaml:"insert_batching,omitempty"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// InsertBatchingAcks contains values which may be set in `insert_batching.ack`.
+var InsertBatchingAcks = []string{"spooled", "flushed"}
+
+// InsertBatching describes buffering of INSERTs with the same statement,
+// so many tiny INSERTs don't create many parts in ClickHouse.
+type InsertBatching struct {
+	// Maximum size of the buffered data, which triggers the flush
+	// if omitted or zero - 1MB is used
+	MaxBytes ByteSize `yaml:"max_bytes,omitempty"`
+
+	// Maximum duration the data is buffered for
+	// if omitted or zero - 1s is used
+	MaxInterval Duration `yaml:"max_interval,omitempty"`
+
+	// Formats of INSERTs, which may be buffered.
+	// Only row-based formats may be concatenated safely
+	// if omitted or empty - JSONEachRow, TabSeparated, TSV and CSV are used
+	Formats []string `yaml:"formats,omitempty"`
+
+	// When the client is responded: either once the data is spooled to disk
+	// or once it is flushed to ClickHouse. See InsertBatchingAcks
+	// if omitted - spooled is used
+	Ack string `yaml:"ack,omitempty"`
+
+	// Dir the data is spooled to until it is flushed
+	// if omitted - chproxy-insert-batches in the system temporary dir is used
+	SpoolDir string `yaml:"spool_dir,omitempty"`
+
 	// Catches all undefined fields
 	XXX map[string]interface{} `yaml:",inline"`
 }
 
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (ib *InsertBatching) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain InsertBatching
+	if err := unmarshal((*plain)(ib)); err != nil {
+		return err
+	}
+	if ib.MaxInterval < 0 {
+		return fmt.Errorf("`insert_batching.max_interval` cannot be negative")
+	}
+	for _, f := range ib.Formats {
+		if len(f) == 0 {
+			return fmt.Errorf("`insert_batching.formats` cannot contain empty names")
+		}
+	}
+	if len(ib.Ack) > 0 && !slices.Contains(InsertBatchingAcks, ib.Ack) {
+		return fmt.Errorf("unknown `insert_batching.ack` %q; supported values: %s",
+			ib.Ack, strings.Join(InsertBatchingAcks, ", "))
+	}
+	return checkOverflow(ib.XXX, "insert_batching")
+}
+
+// StatementTypes contains statement types which may be
+// set in `allowed_statements` and `denied_statements`.
+var StatementTypes = []string{"SELECT", "INSERT", "ALTER", "DROP", "TRUNCATE", "CREATE", "SYSTEM"}
+
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
 func (u *User) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	type plain User
@@ -816,6 +1844,14 @@ func (u *User) validate() error {
 		return fmt.Errorf("`deny_http` and `deny_https` cannot be simultaneously set to `true` for %q", u.Name)
 	}
 
+	if len(u.FallbackToUser) > 0 && len(u.FallbackCluster) == 0 {
+		return fmt.Errorf("`fallback_to_user` requires `fallback_cluster` to be set for %q", u.Name)
+	}
+
+	if len(u.FallbackCluster) > 0 && u.FallbackCluster == u.ToCluster {
+		return fmt.Errorf("`fallback_cluster` cannot be the same as `to_cluster` for %q", u.Name)
+	}
+
 	if err := u.validateWildcarded(); err != nil {
 		return err
 	}
@@ -824,9 +1860,164 @@ func (u *User) validate() error {
 		return err
 	}
 
+	if err := u.validateStatements(); err != nil {
+		return err
+	}
+
+	if err := u.validateDatabases(); err != nil {
+		return err
+	}
+
+	if err := u.validateFormats(); err != nil {
+		return err
+	}
+
+	if len(u.CacheBypassPatterns) > 0 && len(u.Cache) == 0 {
+		return fmt.Errorf("`cache_bypass_patterns` requires `cache` to be set for %q", u.Name)
+	}
+	for _, p := range u.CacheBypassPatterns {
+		if _, err := regexp.Compile(p); err != nil {
+			return fmt.Errorf("cannot compile `cache_bypass_patterns` %q for %q: %w", p, u.Name, err)
+		}
+	}
+
+	for _, h := range u.AllowedRequestHeaders {
+		if len(strings.TrimSpace(h)) == 0 {
+			return fmt.Errorf("`allowed_request_headers` cannot contain empty names for %q", u.Name)
+		}
+	}
+
+	if strings.ContainsAny(u.AllowImpersonationHeader, " \t\r\n:") {
+		return fmt.Errorf("invalid `allow_impersonation_header` %q for %q", u.AllowImpersonationHeader, u.Name)
+	}
+
+	if u.ImpersonationLogComment && len(u.AllowImpersonationHeader) == 0 {
+		return fmt.Errorf("`impersonation_log_comment` requires `allow_impersonation_header` to be set for %q", u.Name)
+	}
+
+	if u.UserAgentTemplate != nil {
+		if _, err := template.New("").Parse(*u.UserAgentTemplate); err != nil {
+			return fmt.Errorf("cannot parse `user_agent_template` for %q: %w", u.Name, err)
+		}
+	}
+
+	for name := range u.ResponseHeaders {
+		if len(name) == 0 || strings.ContainsAny(name, " \t\r\n:") {
+			return fmt.Errorf("invalid `response_headers` name %q for %q", name, u.Name)
+		}
+	}
+
+	if len(u.ResponseCompression) > 0 && !slices.Contains(ResponseCompressions, u.ResponseCompression) {
+		return fmt.Errorf("unknown `response_compression` %q for %q; supported values: %s",
+			u.ResponseCompression, u.Name, strings.Join(ResponseCompressions, ", "))
+	}
+
+	for _, e := range u.AllowedEncodings {
+		if len(e) == 0 || strings.ContainsAny(e, " \t,;") {
+			return fmt.Errorf("invalid `allowed_encodings` value %q for %q", e, u.Name)
+		}
+	}
+
+	return u.validateHeaders()
+}
+
+// ResponseCompressions contains values which may be set in `response_compression`.
+var ResponseCompressions = []string{"passthrough", "gzip", "brotli"}
+
+// HeaderUserPlaceholder is substituted by the name of the user
+// in `headers` values.
+const HeaderUserPlaceholder = "{{user}}"
+
+// authHeaders are the headers carrying credentials of the cluster user,
+// so they cannot be set via `headers`.
+var authHeaders = []string{"Authorization", "X-ClickHouse-User", "X-ClickHouse-Key"}
+
+func (u *User) validateHeaders() error {
+	for name, value := range u.Headers {
+		if len(name) == 0 || strings.ContainsAny(name, " \t\r\n:") {
+			return fmt.Errorf("invalid `headers` name %q for %q", name, u.Name)
+		}
+		for _, h := range authHeaders {
+			if strings.EqualFold(name, h) {
+				return fmt.Errorf("`headers` cannot contain %q for %q", name, u.Name)
+			}
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("`headers` value %q cannot contain line breaks for %q", value, u.Name)
+		}
+	}
 	return nil
 }
 
+func (u *User) validateStatements() error {
+	if len(u.AllowedStatements) > 0 && len(u.DeniedStatements) > 0 {
+		return fmt.Errorf("`allowed_statements` and `denied_statements` cannot be simultaneously set for %q", u.Name)
+	}
+	for _, statements := range [][]string{u.AllowedStatements, u.DeniedStatements} {
+		for _, st := range statements {
+			if !isStatementType(st) {
+				return fmt.Errorf("unknown statement type %q for %q; supported types: %s", st, u.Name, strings.Join(StatementTypes, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+func (u *User) validateDatabases() error {
+	if u.CheckQueryDatabases && len(u.AllowedDatabases) == 0 {
+		return fmt.Errorf("`check_query_databases` requires `allowed_databases` to be set for %q", u.Name)
+	}
+	for _, db := range u.AllowedDatabases {
+		if len(db) == 0 {
+			return fmt.Errorf("`allowed_databases` cannot contain empty names for %q", u.Name)
+		}
+	}
+	return nil
+}
+
+func (u *User) validateFormats() error {
+	for _, f := range u.AllowedFormats {
+		if len(f) == 0 {
+			return fmt.Errorf("`allowed_formats` cannot contain empty names for %q", u.Name)
+		}
+	}
+	for _, f := range u.AllowedDefaultFormats {
+		if len(f) == 0 {
+			return fmt.Errorf("`allowed_default_formats` cannot contain empty names for %q", u.Name)
+		}
+	}
+	if len(u.DefaultFormat) == 0 {
+		return nil
+	}
+	// `default_format` of the user is sent as the `default_format` param,
+	// so it must pass the same checks as the formats of clients.
+	if len(u.AllowedFormats) > 0 && !containsFold(u.AllowedFormats, u.DefaultFormat) {
+		return fmt.Errorf("`default_format` %q must be in `allowed_formats` for %q", u.DefaultFormat, u.Name)
+	}
+	if len(u.AllowedDefaultFormats) > 0 && !containsFold(u.AllowedDefaultFormats, u.DefaultFormat) {
+		return fmt.Errorf("`default_format` %q must be in `allowed_default_formats` for %q", u.DefaultFormat, u.Name)
+	}
+	return nil
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(s, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func isStatementType(st string) bool {
+	for _, t := range StatementTypes {
+		if strings.EqualFold(st, t) {
+			return true
+		}
+	}
+	return false
+}
+
 func (u *User) validateWildcarded() error {
 	if u.IsWildcarded {
 		if s := strings.Split(u.Name, "*"); !(len(s) == 2 && (s[0] == "" || s[1] == "")) {
@@ -834,6 +2025,16 @@ func (u *User) validateWildcarded() error {
 		}
 	}
 
+	if u.PerIdentityLimits && !u.IsWildcarded {
+		return fmt.Errorf("`per_identity_limits` cannot be set for %q, since it isn't marked `is_wildcarded`", u.Name)
+	}
+
+	// Batches are flushed in background, while the credentials
+	// of wildcarded users are taken from requests.
+	if u.InsertBatching != nil && u.IsWildcarded {
+		return fmt.Errorf("`insert_batching` cannot be set for wildcarded user %q", u.Name)
+	}
+
 	return nil
 }
 
@@ -842,6 +2043,28 @@ func (u *User) validateRateLimitConfig() error {
 		return fmt.Errorf("`max_queue_size` must be set if `max_queue_time` is set for %q", u.Name)
 	}
 
+	if u.DistributedRateLimit {
+		if u.ReqPerMin <= 0 {
+			return fmt.Errorf("`requests_per_minute` must be set if `distributed_rate_limit` is set for %q", u.Name)
+		}
+		if len(u.Cache) == 0 {
+			return fmt.Errorf("`cache` must be set if `distributed_rate_limit` is set for %q", u.Name)
+		}
+	}
+
+	if u.DistributedDailyBudget {
+		if u.DailyExecutionBudget <= 0 {
+			return fmt.Errorf("`daily_execution_budget` must be set if `distributed_daily_budget` is set for %q", u.Name)
+		}
+		if len(u.Cache) == 0 {
+			return fmt.Errorf("`cache` must be set if `distributed_daily_budget` is set for %q", u.Name)
+		}
+	}
+
+	if u.QueuePriority > MaxQueuePriority {
+		return fmt.Errorf("`queue_priority` must be in range [1..%d] for %q", MaxQueuePriority, u.Name)
+	}
+
 	if u.ReqPacketSizeTokensBurst > 0 && u.ReqPacketSizeTokensRate == 0 {
 		return fmt.Errorf("`request_packet_size_tokens_rate` must be set if `request_packet_size_tokens_burst` is set for %q", u.Name)
 	}
@@ -874,6 +2097,109 @@ func (u *User) setDefaults() {
 	}
 }
 
+// RewriteRule describes a regexp-based rewrite of the query text
+type RewriteRule struct {
+	// Match is a regular expression the query is matched against
+	Match string `yaml:"match"`
+
+	// Replace is a replacement for the matched text.
+	// It may reference capture groups from Match via $1, ${name}, etc.
+	Replace string `yaml:"replace"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (rr *RewriteRule) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain RewriteRule
+	if err := unmarshal((*plain)(rr)); err != nil {
+		return err
+	}
+	if len(rr.Match) == 0 {
+		return fmt.Errorf("`rewrite_rules.match` cannot be empty")
+	}
+	if _, err := regexp.Compile(rr.Match); err != nil {
+		return fmt.Errorf("cannot compile `rewrite_rules.match` %q: %w", rr.Match, err)
+	}
+	return checkOverflow(rr.XXX, fmt.Sprintf("rewrite_rule %q", rr.Match))
+}
+
+// RoutingRule describes a regexp-based routing of queries to a cluster
+type RoutingRule struct {
+	// Name of the rule used in metrics.
+	// The index of the rule is used if it is empty
+	Name string `yaml:"name,omitempty"`
+
+	// Match is a regular expression the query is matched against
+	Match string `yaml:"match"`
+
+	// ToCluster is the name of cluster where the matching queries
+	// will be proxied
+	ToCluster string `yaml:"to_cluster"`
+
+	// ToUser is the name of cluster_user from ToCluster
+	// whom credentials will be used for proxying the matching queries
+	// if omitted - the user's ToUser is used
+	ToUser string `yaml:"to_user,omitempty"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (rr *RoutingRule) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain RoutingRule
+	if err := unmarshal((*plain)(rr)); err != nil {
+		return err
+	}
+	if len(rr.Match) == 0 {
+		return fmt.Errorf("`routing_rules.match` cannot be empty")
+	}
+	if _, err := regexp.Compile(rr.Match); err != nil {
+		return fmt.Errorf("cannot compile `routing_rules.match` %q: %w", rr.Match, err)
+	}
+	if len(rr.ToCluster) == 0 {
+		return fmt.Errorf("`routing_rules.to_cluster` must be specified for %q", rr.Match)
+	}
+	return checkOverflow(rr.XXX, fmt.Sprintf("routing_rule %q", rr.Match))
+}
+
+// ResponseHeader describes a header added to responses.
+// It may be set either as a plain value or as a mapping.
+type ResponseHeader struct {
+	// Value of the header
+	Value string `yaml:"value"`
+
+	// Whether to override the header if it is sent by ClickHouse
+	Override bool `yaml:"override,omitempty"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (rh *ResponseHeader) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&rh.Value); err == nil {
+		return rh.validate()
+	}
+	type plain ResponseHeader
+	if err := unmarshal((*plain)(rh)); err != nil {
+		return err
+	}
+	if err := rh.validate(); err != nil {
+		return err
+	}
+	return checkOverflow(rh.XXX, "response_header")
+}
+
+func (rh *ResponseHeader) validate() error {
+	if strings.ContainsAny(rh.Value, "\r\n") {
+		return fmt.Errorf("`response_headers` value %q cannot contain line breaks", rh.Value)
+	}
+	return nil
+}
+
 // NetworkGroups describes a named Networks lists
 type NetworkGroups struct {
 	// Name of the group
@@ -909,7 +2235,7 @@ type NetworksOrGroups []string
 // Cache describes configuration options for caching
 // responses from CH clusters
 type Cache struct {
-	// Mode of cache (file_system, redis)
+	// Mode of cache (file_system, redis, memory, layered)
 	// todo make it an enum
 	Mode string `yaml:"mode"`
 
@@ -921,15 +2247,33 @@ type Cache struct {
 	// on new request and re-cached
 	Expire Duration `yaml:"expire,omitempty"`
 
+	// Upper bound of the random duration added to Expire of each cached response,
+	// so responses cached at the same time don't expire at the same time
+	ExpireJitter Duration `yaml:"expire_jitter,omitempty"`
+
 	// Deprecated: GraceTime duration before the expired entry is deleted from the cache.
 	// It's deprecated and in future versions it'll be replaced by user's MaxExecutionTime.
 	// It's already the case today if value of GraceTime is omitted.
 	GraceTime Duration `yaml:"grace_time,omitempty"`
 
+	// Period after expiration during which the expired response is still
+	// served, while it is refreshed in background
+	StaleWhileRevalidate Duration `yaml:"stale_while_revalidate,omitempty"`
+
 	FileSystem FileSystemCacheConfig `yaml:"file_system,omitempty"`
 
 	Redis RedisCacheConfig `yaml:"redis,omitempty"`
 
+	Memory MemoryCacheConfig `yaml:"memory,omitempty"`
+
+	// Prefix of the keys in redis or the name of the subdirectory of
+	// `file_system.dir`, so multiple deployments may share the storage
+	KeyPrefix string `yaml:"key_prefix,omitempty"`
+
+	// Names of the caches looked up first and second in layered mode
+	L1 string `yaml:"l1,omitempty"`
+	L2 string `yaml:"l2,omitempty"`
+
 	// Catches all undefined fields
 	XXX map[string]interface{} `yaml:",inline"`
 
@@ -938,12 +2282,34 @@ type Cache struct {
 
 	// Whether a query cached by a user could be used by another user
 	SharedWithAllUsers bool `yaml:"shared_with_all_users,omitempty"`
+
+	// Whether queries are normalized before building cache keys
+	NormalizeQueries bool `yaml:"normalize_queries,omitempty"`
+
+	// Whether cached responses are re-encoded to the encoding accepted by clients
+	TranscodeResponses bool `yaml:"transcode_responses,omitempty"`
+
+	// Whether responses missing in the cache are streamed to clients
+	// while being written into the cache
+	AsyncWrites bool `yaml:"async_writes,omitempty"`
+
+	// Whether async writes are finished if the client disconnects
+	// before the response is complete
+	FinishWritesOnDisconnect bool `yaml:"finish_writes_on_disconnect,omitempty"`
+
+	// Headers of ClickHouse responses stored along with cached responses
+	// and replayed on cache hits.
+	// if omitted - defaultCachedHeaders are used
+	CachedHeaders []string `yaml:"cached_headers,omitempty"`
 }
 
 func (c *Cache) setDefaults() {
 	if c.MaxPayloadSize <= 0 {
 		c.MaxPayloadSize = defaultMaxPayloadSize
 	}
+	if c.CachedHeaders == nil {
+		c.CachedHeaders = append([]string(nil), defaultCachedHeaders...)
+	}
 }
 
 type FileSystemCacheConfig struct {
@@ -954,17 +2320,99 @@ type FileSystemCacheConfig struct {
 	// If size is exceeded - the oldest files in Dir will be deleted
 	// until total size becomes normal
 	MaxSize ByteSize `yaml:"max_size"`
+
+	// Interval between scans of Dir removing expired files
+	// if omitted or zero - 1h is used
+	CleanupInterval Duration `yaml:"cleanup_interval,omitempty"`
+
+	// Maximum number of files checked per second during the scan
+	// if omitted or zero - 1000 is used
+	CleanupScanRate int `yaml:"cleanup_scan_rate,omitempty"`
+
+	// Compression of the cached data. See FileSystemCacheCompressions
+	// if omitted or empty - the data is stored uncompressed
+	Compress string `yaml:"compress,omitempty"`
 }
 
+type MemoryCacheConfig struct {
+	// Maximum total size of the cached responses
+	// If size is exceeded - the least recently used responses are evicted
+	MaxSize ByteSize `yaml:"max_size"`
+
+	// Maximum number of the cached responses
+	// if omitted or zero - the number isn't limited
+	MaxItems int `yaml:"max_items,omitempty"`
+}
+
+// FileSystemCacheCompressions contains values which may be set in `compress`.
+var FileSystemCacheCompressions = []string{"zstd"}
+
 type RedisCacheConfig struct {
 	TLS `yaml:",inline"`
 
-	Username  string                 `yaml:"username,omitempty"`
-	Password  string                 `yaml:"password,omitempty"`
-	Addresses []string               `yaml:"addresses"`
-	DBIndex   int                    `yaml:"db_index,omitempty"`
-	PoolSize  int                    `yaml:"pool_size,omitempty"`
-	XXX       map[string]interface{} `yaml:",inline"`
+	Username  string   `yaml:"username,omitempty"`
+	Password  string   `yaml:"password,omitempty"`
+	Addresses []string `yaml:"addresses,omitempty"`
+	DBIndex   int      `yaml:"db_index,omitempty"`
+	PoolSize  int      `yaml:"pool_size,omitempty"`
+
+	// Name of the master to obtain from sentinels.
+	// Must be set along with SentinelAddresses to use redis sentinel
+	MasterName string `yaml:"master_name,omitempty"`
+
+	// Addresses of redis sentinels
+	// Cannot be used with Addresses
+	SentinelAddresses []string `yaml:"sentinel_addresses,omitempty"`
+
+	// Credentials to access redis sentinels
+	SentinelUsername string `yaml:"sentinel_username,omitempty"`
+	SentinelPassword string `yaml:"sentinel_password,omitempty"`
+
+	// Minimum number of idle connections kept in the pool
+	MinIdleConns int `yaml:"min_idle_conns,omitempty"`
+
+	// Maximum amount of time a connection may be reused
+	ConnMaxLifetime Duration `yaml:"conn_max_lifetime,omitempty"`
+
+	// Timeouts of redis operations.
+	// Default values are used if they aren't set
+	GetTimeout    Duration `yaml:"get_timeout,omitempty"`
+	PutTimeout    Duration `yaml:"put_timeout,omitempty"`
+	RemoveTimeout Duration `yaml:"remove_timeout,omitempty"`
+	RenameTimeout Duration `yaml:"rename_timeout,omitempty"`
+	StatsTimeout  Duration `yaml:"stats_timeout,omitempty"`
+
+	// Reads issued during the window are sent in a single pipeline.
+	// Pipelining is disabled if the window isn't set
+	PipelineWindow Duration `yaml:"pipeline_window,omitempty"`
+
+	// Maximum number of reads sent in a single pipeline
+	PipelineMaxCmds int `yaml:"pipeline_max_cmds,omitempty"`
+
+	// Cached responses with TTL below the threshold may expire while they are streamed,
+	// so they are streamed according to ShortTTLStreaming.
+	// Default value is 15s
+	StreamingMinTTL Duration `yaml:"streaming_min_ttl,omitempty"`
+
+	// Strategy of streaming cached responses with TTL below StreamingMinTTL.
+	// See RedisShortTTLStreamings for supported values.
+	// Default value is `extend_ttl`
+	ShortTTLStreaming string `yaml:"short_ttl_streaming,omitempty"`
+
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// RedisShortTTLStreamings are the supported values of `cache.redis.short_ttl_streaming`.
+//
+// `extend_ttl` extends the TTL of the value while it is read and lets the extension lapse afterwards.
+// `version_check` reads the value as is and fails the read once the value
+// expires or is replaced while it is read.
+var RedisShortTTLStreamings = []string{"extend_ttl", "version_check"}
+
+// IsSentinel returns true if redis must be accessed via sentinels.
+func (c RedisCacheConfig) IsSentinel() bool {
+	return len(c.MasterName) > 0 || len(c.SentinelAddresses) > 0 ||
+		len(c.SentinelUsername) > 0 || len(c.SentinelPassword) > 0
 }
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
@@ -977,13 +2425,30 @@ func (c *Cache) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
 		return fmt.Errorf("`cache.name` must be specified")
 	}
 
+	if c.FinishWritesOnDisconnect && !c.AsyncWrites {
+		return fmt.Errorf("`cache.finish_writes_on_disconnect` requires `cache.async_writes` for %q", c.Name)
+	}
+
+	// Braces would break redis cluster hash tags of temporary keys,
+	// while slashes would nest file system subdirectories.
+	if strings.ContainsAny(c.KeyPrefix, "{}/") || c.KeyPrefix == ".." {
+		return fmt.Errorf("invalid `cache.key_prefix` %q for %q", c.KeyPrefix, c.Name)
+	}
+	if len(c.KeyPrefix) > 0 && c.Mode == "layered" {
+		return fmt.Errorf("`cache.key_prefix` must be set on `cache.l1` and `cache.l2` instead of %q", c.Name)
+	}
+
 	switch c.Mode {
 	case "file_system":
 		err = c.checkFileSystemConfig()
 	case "redis":
 		err = c.checkRedisConfig()
+	case "memory":
+		err = c.checkMemoryConfig()
+	case "layered":
+		err = c.checkLayeredConfig()
 	default:
-		err = fmt.Errorf("not supported cache type %v. Supported types: [file_system]", c.Mode)
+		err = fmt.Errorf("not supported cache type %v. Supported types: [file_system, redis, memory, layered]", c.Mode)
 	}
 
 	if err != nil {
@@ -1000,16 +2465,290 @@ func (c *Cache) checkFileSystemConfig() error {
 	if c.FileSystem.MaxSize <= 0 {
 		return fmt.Errorf("`cache.filesystem.max_size` must be specified for %q", c.Name)
 	}
+	if c.FileSystem.CleanupInterval < 0 {
+		return fmt.Errorf("`cache.filesystem.cleanup_interval` cannot be negative for %q", c.Name)
+	}
+	if c.FileSystem.CleanupScanRate < 0 {
+		return fmt.Errorf("`cache.filesystem.cleanup_scan_rate` cannot be negative for %q", c.Name)
+	}
+	if len(c.FileSystem.Compress) > 0 && !slices.Contains(FileSystemCacheCompressions, c.FileSystem.Compress) {
+		return fmt.Errorf("unknown `cache.filesystem.compress` %q for %q; supported values: %s",
+			c.FileSystem.Compress, c.Name, strings.Join(FileSystemCacheCompressions, ", "))
+	}
 	return nil
 }
 
 func (c *Cache) checkRedisConfig() error {
+	if c.Redis.PipelineMaxCmds < 0 {
+		return fmt.Errorf("`cache.redis.pipeline_max_cmds` cannot be negative for %q", c.Name)
+	}
+	if c.Redis.StreamingMinTTL < 0 {
+		return fmt.Errorf("`cache.redis.streaming_min_ttl` cannot be negative for %q", c.Name)
+	}
+	if len(c.Redis.ShortTTLStreaming) > 0 && !slices.Contains(RedisShortTTLStreamings, c.Redis.ShortTTLStreaming) {
+		return fmt.Errorf("unknown `cache.redis.short_ttl_streaming` %q for %q; supported values: %s",
+			c.Redis.ShortTTLStreaming, c.Name, strings.Join(RedisShortTTLStreamings, ", "))
+	}
+	if c.Redis.IsSentinel() {
+		if len(c.Redis.Addresses) > 0 {
+			return fmt.Errorf("`cache.redis.addresses` cannot be mixed with sentinel options for %q", c.Name)
+		}
+		if len(c.Redis.MasterName) == 0 {
+			return fmt.Errorf("`cache.redis.master_name` must be specified for %q", c.Name)
+		}
+		if len(c.Redis.SentinelAddresses) == 0 {
+			return fmt.Errorf("`cache.redis.sentinel_addresses` must be specified for %q", c.Name)
+		}
+		return nil
+	}
 	if len(c.Redis.Addresses) == 0 {
 		return fmt.Errorf("`cache.redis.addresses` must be specified for %q", c.Name)
 	}
 	return nil
 }
 
+func (c *Cache) checkMemoryConfig() error {
+	if c.Memory.MaxSize <= 0 {
+		return fmt.Errorf("`cache.memory.max_size` must be specified for %q", c.Name)
+	}
+	if c.Memory.MaxItems < 0 {
+		return fmt.Errorf("`cache.memory.max_items` cannot be negative for %q", c.Name)
+	}
+	return nil
+}
+
+func (c *Cache) checkLayeredConfig() error {
+	if len(c.L1) == 0 || len(c.L2) == 0 {
+		return fmt.Errorf("`cache.l1` and `cache.l2` must be specified for %q", c.Name)
+	}
+	if c.L1 == c.L2 || c.L1 == c.Name || c.L2 == c.Name {
+		return fmt.Errorf("`cache.l1` and `cache.l2` must refer to distinct caches for %q", c.Name)
+	}
+	return nil
+}
+
+// LDAPUserPlaceholder is substituted by the escaped user name
+// in `auth_backend.user_search_filter`.
+const LDAPUserPlaceholder = "{{user}}"
+
+// AuthBackend describes an external backend authenticating users
+// missing in `users`. Only `ldap` type is supported.
+type AuthBackend struct {
+	// Type of the backend
+	Type string `yaml:"type"`
+
+	// URL of the LDAP server, e.g. ldaps://ldap.example.com:636
+	LDAPURL string `yaml:"ldap_url"`
+
+	// Credentials used to search users
+	// if omitted - users are searched via anonymous bind
+	BindDN       string `yaml:"bind_dn,omitempty"`
+	BindPassword string `yaml:"bind_password,omitempty"`
+
+	// Base DN and filter used to search users.
+	// The filter must contain LDAPUserPlaceholder
+	UserSearchBase   string `yaml:"user_search_base"`
+	UserSearchFilter string `yaml:"user_search_filter"`
+
+	// Name of the user from `users`, whose settings are applied
+	// to the users authenticated via LDAP
+	LDAPUserTemplate string `yaml:"ldap_user_template"`
+
+	// Period successful authentications are cached for
+	// if omitted or zero - 1m is used
+	LDAPCacheTTL Duration `yaml:"ldap_cache_ttl,omitempty"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (ab *AuthBackend) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain AuthBackend
+	if err := unmarshal((*plain)(ab)); err != nil {
+		return err
+	}
+	if ab.Type != "ldap" {
+		return fmt.Errorf("not supported `auth_backend.type` %q. Supported types: [ldap]", ab.Type)
+	}
+	u, err := url.Parse(ab.LDAPURL)
+	if err != nil {
+		return fmt.Errorf("cannot parse `auth_backend.ldap_url` %q: %w", ab.LDAPURL, err)
+	}
+	if u.Scheme != "ldap" && u.Scheme != "ldaps" {
+		return fmt.Errorf("`auth_backend.ldap_url` %q must have ldap or ldaps scheme", ab.LDAPURL)
+	}
+	if len(ab.UserSearchBase) == 0 {
+		return fmt.Errorf("`auth_backend.user_search_base` must be specified")
+	}
+	if !strings.Contains(ab.UserSearchFilter, LDAPUserPlaceholder) {
+		return fmt.Errorf("`auth_backend.user_search_filter` must contain %s", LDAPUserPlaceholder)
+	}
+	if len(ab.LDAPUserTemplate) == 0 {
+		return fmt.Errorf("`auth_backend.ldap_user_template` must be specified")
+	}
+	if len(ab.BindPassword) > 0 && len(ab.BindDN) == 0 {
+		return fmt.Errorf("`auth_backend.bind_password` cannot be set without `auth_backend.bind_dn`")
+	}
+	return checkOverflow(ab.XXX, "auth_backend")
+}
+
+// Auth describes alternative ways of authenticating users from `users`
+// besides their passwords.
+type Auth struct {
+	// Bearer tokens issued by an SSO
+	JWT *JWTAuth `yaml:"jwt,omitempty"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (a *Auth) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Auth
+	if err := unmarshal((*plain)(a)); err != nil {
+		return err
+	}
+	return checkOverflow(a.XXX, "auth")
+}
+
+// AuditLogFormats contains values which may be set in `audit_log.format`.
+var AuditLogFormats = []string{"json", "tsv"}
+
+// AuditLogFields contains values which may be set in `audit_log.fields`.
+var AuditLogFields = []string{
+	"timestamp", "scope_id", "remote_addr", "user", "cluster_user", "cluster_node",
+	"http_method", "query_digest", "status_code", "duration_ms", "bytes_written",
+}
+
+// AuditLogDropPolicies contains values which may be set in `audit_log.drop_policy`.
+var AuditLogDropPolicies = []string{"drop_newest", "drop_oldest"}
+
+// AuditLog describes the log of requests of authenticated users,
+// so it may be found out who ran what query and when.
+type AuditLog struct {
+	// Path to the file records are appended to
+	Path string `yaml:"path"`
+
+	// Format of records. See AuditLogFormats
+	// if omitted - json is used
+	Format string `yaml:"format,omitempty"`
+
+	// Fields of records. See AuditLogFields
+	// if omitted or empty - all the fields are logged
+	Fields []string `yaml:"fields,omitempty"`
+
+	// Whether to log the query text in addition to its SHA-256 digest
+	LogFullQuery bool `yaml:"log_full_query,omitempty"`
+
+	// Maximum number of records waiting to be written
+	// if omitted or zero - 1024 is used
+	QueueSize int `yaml:"queue_size,omitempty"`
+
+	// Records dropped once the queue is full. See AuditLogDropPolicies
+	// if omitted - drop_newest is used
+	DropPolicy string `yaml:"drop_policy,omitempty"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (al *AuditLog) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain AuditLog
+	if err := unmarshal((*plain)(al)); err != nil {
+		return err
+	}
+	if len(al.Path) == 0 {
+		return fmt.Errorf("`audit_log.path` must be specified")
+	}
+	if len(al.Format) > 0 && !slices.Contains(AuditLogFormats, al.Format) {
+		return fmt.Errorf("unknown `audit_log.format` %q; supported values: %s",
+			al.Format, strings.Join(AuditLogFormats, ", "))
+	}
+	for _, f := range al.Fields {
+		if !slices.Contains(AuditLogFields, f) {
+			return fmt.Errorf("unknown `audit_log.fields` item %q; supported values: %s",
+				f, strings.Join(AuditLogFields, ", "))
+		}
+	}
+	if al.QueueSize < 0 {
+		return fmt.Errorf("`audit_log.queue_size` cannot be negative")
+	}
+	if len(al.DropPolicy) > 0 && !slices.Contains(AuditLogDropPolicies, al.DropPolicy) {
+		return fmt.Errorf("unknown `audit_log.drop_policy` %q; supported values: %s",
+			al.DropPolicy, strings.Join(AuditLogDropPolicies, ", "))
+	}
+	return checkOverflow(al.XXX, "audit_log")
+}
+
+// JWTAuth describes verification of JWT bearer tokens.
+// Requests with valid tokens are proxied as the user from `users`
+// named by UserClaim without checking its password.
+type JWTAuth struct {
+	// URL of the JWKS containing keys the tokens are signed with
+	JWKSURL string `yaml:"jwks_url,omitempty"`
+
+	// Path to the PEM-encoded RSA public key the tokens are signed with
+	// Cannot be used with JWKSURL
+	PublicKeyFile string `yaml:"public_key_file,omitempty"`
+
+	// Required `iss` and `aud` claims of the tokens
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"`
+
+	// Claim containing the name of the user from `users`
+	// if omitted - preferred_username is used
+	UserClaim string `yaml:"user_claim,omitempty"`
+
+	// Period verified tokens are cached for
+	// if omitted or zero - 1m is used
+	CacheTTL Duration `yaml:"cache_ttl,omitempty"`
+
+	// Interval between refreshes of keys from JWKSURL
+	// if omitted or zero - 1h is used
+	JWKSRefreshInterval Duration `yaml:"jwks_refresh_interval,omitempty"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (ja *JWTAuth) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain JWTAuth
+	if err := unmarshal((*plain)(ja)); err != nil {
+		return err
+	}
+	if len(ja.JWKSURL) == 0 && len(ja.PublicKeyFile) == 0 {
+		return fmt.Errorf("either `auth.jwt.jwks_url` or `auth.jwt.public_key_file` must be specified")
+	}
+	if len(ja.JWKSURL) > 0 && len(ja.PublicKeyFile) > 0 {
+		return fmt.Errorf("`auth.jwt.jwks_url` cannot be mixed with `auth.jwt.public_key_file`")
+	}
+	if len(ja.JWKSURL) > 0 {
+		u, err := url.Parse(ja.JWKSURL)
+		if err != nil {
+			return fmt.Errorf("cannot parse `auth.jwt.jwks_url` %q: %w", ja.JWKSURL, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("`auth.jwt.jwks_url` %q must have http or https scheme", ja.JWKSURL)
+		}
+	}
+	if len(ja.Issuer) == 0 {
+		return fmt.Errorf("`auth.jwt.issuer` must be specified")
+	}
+	if len(ja.Audience) == 0 {
+		return fmt.Errorf("`auth.jwt.audience` must be specified")
+	}
+	if ja.CacheTTL < 0 {
+		return fmt.Errorf("`auth.jwt.cache_ttl` cannot be negative")
+	}
+	if ja.JWKSRefreshInterval < 0 {
+		return fmt.Errorf("`auth.jwt.jwks_refresh_interval` cannot be negative")
+	}
+	return checkOverflow(ja.XXX, "auth.jwt")
+}
+
 // ParamGroup describes named group of GET params
 // for sending with each query
 type ParamGroup struct {
@@ -1084,6 +2823,10 @@ type ClusterUser struct {
 	// if omitted or zero - no limits would be applied
 	MaxConcurrentQueries uint32 `yaml:"max_concurrent_queries,omitempty"`
 
+	// Maximum number of active sessions for user
+	// if omitted or zero - no limits would be applied
+	MaxSessions uint32 `yaml:"max_sessions,omitempty"`
+
 	// Maximum duration of query execution for user
 	// if omitted or zero - limit is set to 120 seconds
 	MaxExecutionTime Duration `yaml:"max_execution_time,omitempty"`
@@ -1150,7 +2893,10 @@ func LoadFile(filename string) (*Config, error) {
 		return nil, err
 	}
 
-	content = findAndReplacePlaceholders(content)
+	content, err = findAndReplacePlaceholders(content)
+	if err != nil {
+		return nil, err
+	}
 
 	cfg := &Config{}
 	if err := yaml.Unmarshal(content, cfg); err != nil {
@@ -1169,9 +2915,25 @@ func LoadFile(filename string) (*Config, error) {
 	if cfg.Server.HTTPS.AllowedNetworks, err = cfg.groupToNetwork(cfg.Server.HTTPS.NetworksOrGroups); err != nil {
 		return nil, err
 	}
+	for _, addrs := range []ListenAddrs{cfg.Server.HTTP.ListenAddr, cfg.Server.HTTPS.ListenAddr} {
+		for i := range addrs {
+			if addrs[i].AllowedNetworks, err = cfg.groupToNetwork(addrs[i].NetworksOrGroups); err != nil {
+				return nil, err
+			}
+		}
+	}
 	if cfg.Server.Metrics.AllowedNetworks, err = cfg.groupToNetwork(cfg.Server.Metrics.NetworksOrGroups); err != nil {
 		return nil, err
 	}
+	if cfg.Server.Admin.AllowedNetworks, err = cfg.groupToNetwork(cfg.Server.Admin.NetworksOrGroups); err != nil {
+		return nil, err
+	}
+	if cfg.Server.PerIPRateLimit.ExemptNetworks, err = cfg.groupToNetwork(cfg.Server.PerIPRateLimit.ExemptNetworksOrGroups); err != nil {
+		return nil, err
+	}
+	if cfg.Server.NativeProxy.AllowedNetworks, err = cfg.groupToNetwork(cfg.Server.NativeProxy.NetworksOrGroups); err != nil {
+		return nil, err
+	}
 
 	if err := cfg.setDefaults(); err != nil {
 		return nil, err
@@ -1183,29 +2945,17 @@ func LoadFile(filename string) (*Config, error) {
 	return cfg, nil
 }
 
-var envVarRegex = regexp.MustCompile(`\${([a-zA-Z_][a-zA-Z0-9_]*)}`)
-
-// findAndReplacePlaceholders finds all environment variables placeholders in the config.
-// Each placeholder is a string like ${VAR_NAME}. They will be replaced with the value of the
-// corresponding environment variable. It returns the new content with replaced placeholders.
-func findAndReplacePlaceholders(content []byte) []byte {
-	for _, match := range envVarRegex.FindAllSubmatch(content, -1) {
-		envVar := os.Getenv(string(match[1]))
-		if envVar != "" {
-			content = bytes.ReplaceAll(content, match[0], []byte(envVar))
-		}
-	}
-
-	return content
-}
-
 func (c Config) checkVulnerabilities() error {
 	if c.HackMePlease {
 		return nil
 	}
 
-	hasHTTPS := len(c.Server.HTTPS.ListenAddr) > 0 && len(c.Server.HTTPS.NetworksOrGroups) == 0
-	hasHTTP := len(c.Server.HTTP.ListenAddr) > 0 && len(c.Server.HTTP.NetworksOrGroups) == 0
+	if c.Server.Admin.Enable && len(c.Server.Admin.NetworksOrGroups) == 0 {
+		return fmt.Errorf("`server.admin` is enabled, but not limited by `allowed_networks`")
+	}
+
+	hasHTTPS := len(c.Server.HTTPS.ListenAddr) > 0 && !c.Server.HTTPS.ListenAddr.isRestricted(c.Server.HTTPS.NetworksOrGroups)
+	hasHTTP := len(c.Server.HTTP.ListenAddr) > 0 && !c.Server.HTTP.ListenAddr.isRestricted(c.Server.HTTP.NetworksOrGroups)
 	for _, u := range c.Users {
 		if len(u.NetworksOrGroups) != 0 {
 			continue
@@ -1213,6 +2963,11 @@ func (c Config) checkVulnerabilities() error {
 		if err := u.validateSecurity(hasHTTP, hasHTTPS); err != nil {
 			return err
 		}
+		// Native protocol connections aren't encrypted, so passwords are sent in clear text.
+		if len(c.Server.NativeProxy.ListenAddr) > 0 && len(c.Server.NativeProxy.NetworksOrGroups) == 0 && !u.DenyHTTP {
+			return fmt.Errorf("native_proxy: user %q is allowed to connect via native protocol, but not limited by `allowed_networks` "+
+				"on `user` or `server.native_proxy` level", u.Name)
+		}
 	}
 	return nil
 }
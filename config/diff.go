@@ -0,0 +1,111 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Diff describes the difference between two configs.
+// Keys are paths to the config options, e.g. `users[web].max_concurrent_queries`.
+// List items are identified by their names if they have any
+// and by their indexes otherwise.
+type Diff struct {
+	// Options which are present only in the new config
+	Added map[string]interface{} `json:"added"`
+
+	// Options which are present only in the old config
+	Removed map[string]interface{} `json:"removed"`
+
+	// Options which values differ between configs
+	Changed map[string]Change `json:"changed"`
+}
+
+// Change describes the old and the new values of a config option
+type Change struct {
+	Old interface{} `json:"old"`
+	New interface{} `json:"new"`
+}
+
+// NewDiff returns the difference between oldCfg and newCfg.
+// Sensitive info is masked on both sides.
+func NewDiff(oldCfg, newCfg *Config) (*Diff, error) {
+	oldOpts, err := flattenConfig(oldCfg)
+	if err != nil {
+		return nil, fmt.Errorf("cannot flatten old config: %w", err)
+	}
+	newOpts, err := flattenConfig(newCfg)
+	if err != nil {
+		return nil, fmt.Errorf("cannot flatten new config: %w", err)
+	}
+
+	d := &Diff{
+		Added:   make(map[string]interface{}),
+		Removed: make(map[string]interface{}),
+		Changed: make(map[string]Change),
+	}
+	for k, newV := range newOpts {
+		oldV, ok := oldOpts[k]
+		if !ok {
+			d.Added[k] = newV
+			continue
+		}
+		if fmt.Sprint(oldV) != fmt.Sprint(newV) {
+			d.Changed[k] = Change{Old: oldV, New: newV}
+		}
+	}
+	for k, oldV := range oldOpts {
+		if _, ok := newOpts[k]; !ok {
+			d.Removed[k] = oldV
+		}
+	}
+	return d, nil
+}
+
+// IsEmpty returns true if configs are equal.
+func (d *Diff) IsEmpty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+func flattenConfig(c *Config) (map[string]interface{}, error) {
+	b, err := yaml.Marshal(withoutSensitiveInfo(c))
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := yaml.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	opts := make(map[string]interface{})
+	flatten("", v, opts)
+	return opts, nil
+}
+
+func flatten(path string, v interface{}, opts map[string]interface{}) {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		for k, item := range t {
+			key := fmt.Sprint(k)
+			if len(path) > 0 {
+				key = path + "." + key
+			}
+			flatten(key, item, opts)
+		}
+	case []interface{}:
+		for i, item := range t {
+			flatten(fmt.Sprintf("%s[%s]", path, listItemKey(item, i)), item, opts)
+		}
+	default:
+		opts[path] = t
+	}
+}
+
+func listItemKey(item interface{}, idx int) string {
+	if m, ok := item.(map[interface{}]interface{}); ok {
+		if name, ok := m["name"].(string); ok && len(name) > 0 {
+			return name
+		}
+	}
+	return strconv.Itoa(idx)
+}
@@ -0,0 +1,203 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var envVarRegex = regexp.MustCompile(`^\${([a-zA-Z_][a-zA-Z0-9_]*)(?:(:-|:\?)([^}]*))?}`)
+
+// findAndReplacePlaceholders finds all environment variables placeholders in the config.
+// Each placeholder is a string like ${VAR_NAME}. They will be replaced with the value of the
+// corresponding environment variable. It returns the new content with replaced placeholders.
+//
+// Placeholders like ${VAR_NAME:-default} are replaced with the default value
+// if the variable is unset or empty. An error listing all the missing variables
+// is returned if variables of placeholders like ${VAR_NAME} are unset or if
+// variables of placeholders like ${VAR_NAME:?message} are unset or empty.
+//
+// Placeholders in comments are left as is. Values substituted into quoted
+// strings are escaped, while values which would change the structure
+// of the config otherwise are quoted.
+func findAndReplacePlaceholders(content []byte) ([]byte, error) {
+	r := &placeholderReplacer{
+		seen: make(map[string]bool),
+	}
+	for _, line := range bytes.SplitAfter(content, []byte("\n")) {
+		r.replaceLine(line)
+	}
+	if len(r.missing) > 0 {
+		return nil, fmt.Errorf("environment variables are not set: %s", strings.Join(r.missing, ", "))
+	}
+
+	return r.out.Bytes(), nil
+}
+
+type placeholderReplacer struct {
+	out bytes.Buffer
+
+	// quote is the quote character of the quoted string
+	// the replacer is in. It is zero outside quoted strings.
+	quote byte
+
+	missing []string
+	seen    map[string]bool
+}
+
+func (r *placeholderReplacer) replaceLine(line []byte) {
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case r.quote == 0 && c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			// The rest of the line is a comment.
+			r.out.Write(line[i:])
+			return
+		case c == '$':
+			m := envVarRegex.FindSubmatch(line[i:])
+			if m == nil {
+				break
+			}
+			value, ok := r.lookup(string(m[1]), string(m[2]), string(m[3]))
+			if !ok {
+				r.out.Write(m[0])
+			} else {
+				standalone := r.quote == 0 && isScalarStart(line, i) && isScalarEnd(line, i+len(m[0]))
+				r.out.WriteString(r.escape(value, standalone))
+			}
+			i += len(m[0]) - 1
+			continue
+		case r.quote == 0 && (c == '"' || c == '\'') && isScalarStart(line, i):
+			r.quote = c
+		case r.quote == '"' && c == '\\' && i+1 < len(line):
+			// Keep escaped characters as is.
+			r.out.Write(line[i : i+2])
+			i++
+			continue
+		case r.quote == '\'' && c == '\'' && i+1 < len(line) && line[i+1] == '\'':
+			// Keep escaped single quotes as is.
+			r.out.Write(line[i : i+2])
+			i++
+			continue
+		case c == r.quote:
+			r.quote = 0
+		}
+		r.out.WriteByte(c)
+	}
+}
+
+// lookup returns the value of the placeholder for the given variable.
+// It returns false if the variable is missing.
+func (r *placeholderReplacer) lookup(name, op, arg string) (string, bool) {
+	value, ok := os.LookupEnv(name)
+	switch op {
+	case ":-":
+		if value == "" {
+			return arg, true
+		}
+	case ":?":
+		if value == "" {
+			r.addMissing(name, arg)
+			return "", false
+		}
+	default:
+		if !ok {
+			r.addMissing(name, "")
+			return "", false
+		}
+	}
+	return value, true
+}
+
+func (r *placeholderReplacer) addMissing(name, message string) {
+	if r.seen[name] {
+		return
+	}
+	r.seen[name] = true
+	if message != "" {
+		name = fmt.Sprintf("%q (%s)", name, message)
+	} else {
+		name = fmt.Sprintf("%q", name)
+	}
+	r.missing = append(r.missing, name)
+}
+
+// escape prepares the value to be substituted at the current position.
+// Standalone values are the whole unquoted scalars.
+func (r *placeholderReplacer) escape(value string, standalone bool) string {
+	switch {
+	case r.quote == '\'':
+		return strings.ReplaceAll(value, "'", "''")
+	case r.quote == '"':
+		return escapeDoubleQuoted(value)
+	case standalone && needsQuoting(value):
+		return `"` + escapeDoubleQuoted(value) + `"`
+	}
+	return value
+}
+
+func escapeDoubleQuoted(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return strings.ReplaceAll(s, "\n", `\n`)
+}
+
+// needsQuoting reports whether the unquoted value would be parsed
+// as something other than a plain string, number or bool.
+func needsQuoting(s string) bool {
+	if s == "" {
+		return false
+	}
+	if strings.ContainsAny(s, ":#,[]{}\"'\\\n\t") {
+		return true
+	}
+	if strings.TrimSpace(s) != s {
+		return true
+	}
+	switch s[0] {
+	case '!', '&', '*', '|', '>', '%', '@', '`':
+		return true
+	case '-', '?':
+		return len(s) == 1 || s[1] == ' '
+	}
+	return false
+}
+
+// isScalarStart reports whether a scalar may start at line[i],
+// i.e. whether it is preceded by indentation, a key or a list item indicator
+// or a flow collection separator.
+func isScalarStart(line []byte, i int) bool {
+	k := i - 1
+	for k >= 0 && (line[k] == ' ' || line[k] == '\t') {
+		k--
+	}
+	if k < 0 {
+		return true
+	}
+	switch line[k] {
+	case '[', '{', ',':
+		return true
+	case ':', '-', '?':
+		return k < i-1
+	}
+	return false
+}
+
+// isScalarEnd reports whether a scalar may end at line[i].
+func isScalarEnd(line []byte, i int) bool {
+	for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+		i++
+	}
+	if i == len(line) {
+		return true
+	}
+	switch line[i] {
+	case '\r', '\n', ',', ']', '}':
+		return true
+	case '#':
+		return line[i-1] == ' ' || line[i-1] == '\t'
+	}
+	return false
+}
@@ -30,7 +30,7 @@ func (bs *ByteSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 
-	if value <= 0 {
+	if value < 0 {
 		return fmt.Errorf("byte size %q must be positive", s)
 	}
 
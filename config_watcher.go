@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/contentsquare/chproxy/config"
+	"github.com/contentsquare/chproxy/log"
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadDebounce is the time to wait for subsequent changes of watched files
+// before reloading the config, since files are usually changed in multiple steps.
+const reloadDebounce = time.Second
+
+// configWatcher reloads the config once the config file
+// or files referenced by it change.
+type configWatcher struct {
+	w        *fsnotify.Watcher
+	debounce time.Duration
+
+	// files are the watched files.
+	files []string
+}
+
+func newConfigWatcher(cfg *config.Config, debounce time.Duration) (*configWatcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("cannot create watcher: %w", err)
+	}
+	cw := &configWatcher{
+		w:        w,
+		debounce: debounce,
+	}
+	if err := cw.watch(cfg); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return cw, nil
+}
+
+func setupReloadOnChangeWatch(cfg *config.Config) {
+	if !cfg.ReloadOnChange {
+		return
+	}
+	cw, err := newConfigWatcher(cfg, reloadDebounce)
+	if err != nil {
+		log.Errorf("cannot watch config %s for changes: %s", *configFile, err)
+		return
+	}
+	go cw.run()
+}
+
+// watchedFiles returns the config file and the files referenced by cfg,
+// which require the config to be reloaded once changed.
+func watchedFiles(cfg *config.Config) []string {
+	files := []string{*configFile}
+	if len(cfg.Server.HTTPS.CertFile) > 0 {
+		files = append(files, cfg.Server.HTTPS.CertFile)
+	}
+	if len(cfg.Server.HTTPS.KeyFile) > 0 {
+		files = append(files, cfg.Server.HTTPS.KeyFile)
+	}
+	if cfg.Auth != nil && cfg.Auth.JWT != nil && len(cfg.Auth.JWT.PublicKeyFile) > 0 {
+		files = append(files, cfg.Auth.JWT.PublicKeyFile)
+	}
+	for _, c := range cfg.Clusters {
+		for _, f := range []string{c.TLS.CertFile, c.TLS.KeyFile, c.TLS.CAFile} {
+			if len(f) > 0 && !slices.Contains(files, f) {
+				files = append(files, f)
+			}
+		}
+	}
+	return files
+}
+
+// watch starts watching files referenced by cfg
+// and stops watching files not referenced anymore.
+func (cw *configWatcher) watch(cfg *config.Config) error {
+	files := watchedFiles(cfg)
+	for _, f := range cw.files {
+		if !slices.Contains(files, f) {
+			// The error is ignored, since the watch may be already dropped.
+			_ = cw.w.Remove(f)
+		}
+	}
+	var err error
+	for _, f := range files {
+		if slices.Contains(cw.files, f) {
+			continue
+		}
+		if err = cw.w.Add(f); err != nil {
+			err = fmt.Errorf("cannot watch %q: %w", f, err)
+			break
+		}
+	}
+	// Files are remembered even on error, so rewatch retries them.
+	cw.files = files
+	return err
+}
+
+// rewatch adds watches of all the watched files again.
+//
+// Files are watched by their inodes, so watches are dropped once files
+// are removed or renamed, e.g. when Kubernetes swaps symlinks of ConfigMap files.
+// Watches of symlinks follow the new targets after rewatch.
+func (cw *configWatcher) rewatch() error {
+	for _, f := range cw.files {
+		if err := cw.w.Add(f); err != nil {
+			return fmt.Errorf("cannot watch %q: %w", f, err)
+		}
+	}
+	return nil
+}
+
+// run reloads the config after changes of watched files
+// until the watcher is closed.
+func (cw *configWatcher) run() {
+	var reload <-chan time.Time
+	changed := make(map[string]struct{})
+	for {
+		select {
+		case ev, ok := <-cw.w.Events:
+			if !ok {
+				return
+			}
+			if ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) == 0 {
+				continue
+			}
+			changed[ev.Name] = struct{}{}
+			reload = time.After(cw.debounce)
+		case err, ok := <-cw.w.Errors:
+			if !ok {
+				return
+			}
+			log.Errorf("error while watching config %s: %s", *configFile, err)
+		case <-reload:
+			reload = nil
+			if !cw.reload(changed) {
+				// Some files are missing at the moment, so try again later.
+				reload = time.After(cw.debounce)
+				continue
+			}
+			clear(changed)
+		}
+	}
+}
+
+// reload reloads the config and the TLS certificate if its files are changed.
+//
+// Returns false if files cannot be watched anymore.
+func (cw *configWatcher) reload(changed map[string]struct{}) bool {
+	// Watches are re-added before reading the files,
+	// so changes made during the reload aren't missed.
+	if err := cw.rewatch(); err != nil {
+		log.Errorf("cannot watch config %s for changes: %s", *configFile, err)
+		return false
+	}
+
+	log.Infof("Config %s or files referenced by it changed. Going to reload config ...", *configFile)
+	if err := reloadConfig(); err != nil {
+		log.Errorf("error while reloading config: %s", err)
+	} else {
+		log.Infof("Reloading config %s: successful", *configFile)
+		// The new config may reference other files. Files watched already
+		// aren't re-added, since symlinks may point to unread files by now.
+		// nolint:forcetypeassert // We will cover this by tests as we control what is stored.
+		if err := cw.watch(currentConfig.Load().(*config.Config)); err != nil {
+			log.Errorf("cannot watch config %s for changes: %s", *configFile, err)
+			return false
+		}
+	}
+
+	if cr := tlsCertReloader.Load(); cr != nil {
+		_, certChanged := changed[cr.certFile]
+		_, keyChanged := changed[cr.keyFile]
+		if certChanged || keyChanged {
+			log.Infof("Going to reload TLS certificate %s ...", cr.certFile)
+			if err := cr.reload(); err != nil {
+				log.Errorf("error while reloading TLS certificate: %s", err)
+			} else {
+				log.Infof("Reloading TLS certificate %s: successful", cr.certFile)
+			}
+		}
+	}
+	return true
+}
+
+func (cw *configWatcher) close() error {
+	return cw.w.Close()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/contentsquare/chproxy/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigWatcher(t *testing.T) {
+	cfg, err := os.ReadFile("testdata/http.yml")
+	checkErr(t, err)
+	withUser := func(name string) []byte {
+		user := "  - name: \"" + name + "\"\n    to_cluster: \"default\"\n    to_user: \"default\"\n\n"
+		return []byte(strings.Replace(string(cfg), "\nclusters:", user+"clusters:", 1))
+	}
+	hasUser := func(name string) func() bool {
+		return func() bool {
+			_, ok := proxy.snapshot.Load().users[name]
+			return ok
+		}
+	}
+
+	// The config is mounted the same way as Kubernetes mounts ConfigMaps:
+	// config.yml -> ..data/config.yml, ..data -> ..v1
+	dir := t.TempDir()
+	writeVersion := func(version string, data []byte) {
+		checkErr(t, os.Mkdir(filepath.Join(dir, version), 0o755))
+		checkErr(t, os.WriteFile(filepath.Join(dir, version, "config.yml"), data, 0o600))
+	}
+	swapVersion := func(version string) {
+		tmp := filepath.Join(dir, "..data_tmp")
+		checkErr(t, os.Symlink(version, tmp))
+		checkErr(t, os.Rename(tmp, filepath.Join(dir, "..data")))
+	}
+	writeVersion("..v1", cfg)
+	checkErr(t, os.Symlink("..v1", filepath.Join(dir, "..data")))
+	checkErr(t, os.Symlink(filepath.Join("..data", "config.yml"), filepath.Join(dir, "config.yml")))
+
+	oldConfigFile := *configFile
+	defer func() { *configFile = oldConfigFile }()
+	*configFile = filepath.Join(dir, "config.yml")
+	checkErr(t, reloadConfig())
+
+	cw, err := newConfigWatcher(currentConfig.Load().(*config.Config), 10*time.Millisecond)
+	checkErr(t, err)
+	done := make(chan struct{})
+	go func() {
+		cw.run()
+		close(done)
+	}()
+	defer func() {
+		checkErr(t, cw.close())
+		<-done
+	}()
+
+	// The config is reloaded once the file is rewritten.
+	checkErr(t, os.WriteFile(*configFile, withUser("rewritten"), 0o600))
+	assert.Eventually(t, hasUser("rewritten"), 5*time.Second, 10*time.Millisecond)
+
+	// The old config is kept if the new one is invalid.
+	checkErr(t, os.WriteFile(*configFile, []byte("foobar"), 0o600))
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(configSuccess) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, hasUser("rewritten")())
+
+	// The config is reloaded once symlinks are swapped, even multiple times.
+	writeVersion("..v2", withUser("swapped"))
+	swapVersion("..v2")
+	checkErr(t, os.RemoveAll(filepath.Join(dir, "..v1")))
+	assert.Eventually(t, hasUser("swapped"), 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(configSuccess) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	writeVersion("..v3", withUser("swapped_again"))
+	swapVersion("..v3")
+	checkErr(t, os.RemoveAll(filepath.Join(dir, "..v2")))
+	assert.Eventually(t, hasUser("swapped_again"), 5*time.Second, 10*time.Millisecond)
+	assert.False(t, hasUser("swapped")())
+}
+
+func TestWatchedFiles(t *testing.T) {
+	cfg := &config.Config{
+		Clusters: []config.Cluster{
+			{Name: "first", TLS: config.ClusterTLS{CertFile: "client.crt", KeyFile: "client.key", CAFile: "ca.crt"}},
+			{Name: "second", TLS: config.ClusterTLS{CAFile: "ca.crt"}},
+		},
+	}
+	assert.Equal(t, []string{*configFile, "client.crt", "client.key", "ca.crt"}, watchedFiles(cfg))
+}
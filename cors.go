@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/contentsquare/chproxy/config"
+)
+
+var (
+	// defaultCORSAllowedMethods are used if `cors.allowed_methods` isn't set.
+	defaultCORSAllowedMethods = []string{http.MethodGet, http.MethodPost}
+
+	// defaultCORSAllowedHeaders are used if `cors.allowed_headers` isn't set.
+	defaultCORSAllowedHeaders = []string{"Authorization", "Content-Type", "X-ClickHouse-User", "X-ClickHouse-Key"}
+)
+
+// defaultCORSMaxAge is used if `cors.max_age` isn't set.
+const defaultCORSMaxAge = 10 * time.Minute
+
+// isCORSPreflight returns true if r is a CORS preflight request.
+func isCORSPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions &&
+		len(r.Header.Get("Origin")) > 0 &&
+		len(r.Header.Get("Access-Control-Request-Method")) > 0
+}
+
+// serveCORSPreflight responds to the CORS preflight request r.
+//
+// Access-Control-Allow-* headers are omitted if the requested method isn't allowed,
+// so the browser blocks the actual request.
+func serveCORSPreflight(rw http.ResponseWriter, r *http.Request, cfg config.CORS) {
+	methods := cfg.AllowedMethods
+	if len(methods) == 0 {
+		methods = defaultCORSAllowedMethods
+	}
+	headers := cfg.AllowedHeaders
+	if len(headers) == 0 {
+		headers = defaultCORSAllowedHeaders
+	}
+	maxAge := time.Duration(cfg.MaxAge)
+	if maxAge == 0 {
+		maxAge = defaultCORSMaxAge
+	}
+
+	h := rw.Header()
+	h.Set("Vary", "Origin")
+	method := r.Header.Get("Access-Control-Request-Method")
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			h.Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
+			h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+			h.Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(maxAge/time.Second)))
+			break
+		}
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// dropCORSHeaders removes CORS headers of ClickHouse responses,
+// since CORS is handled by chproxy for users with `allow_cors`.
+// Otherwise responses could contain multiple Access-Control-Allow-Origin values.
+func dropCORSHeaders(h http.Header) {
+	for name := range h {
+		if strings.HasPrefix(name, "Access-Control-") {
+			h.Del(name)
+		}
+	}
+}
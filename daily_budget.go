@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/contentsquare/chproxy/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+// dailyBudget tracks the sum of query durations of the user
+// during the current UTC day.
+//
+// It is passed to the user with the same name on config reload,
+// so the consumption isn't reset by reloads.
+type dailyBudget struct {
+	user string
+
+	// limit is the budget of the user in nanoseconds.
+	// It is updated on config reload.
+	limit atomic.Int64
+
+	// used is the sum of query durations in nanoseconds
+	used atomic.Int64
+
+	// resetAt is the time of the next reset in unix nanoseconds
+	resetAt atomic.Int64
+}
+
+func newDailyBudget(user string, limit time.Duration, now time.Time) *dailyBudget {
+	b := &dailyBudget{user: user}
+	b.limit.Store(int64(limit))
+	b.resetAt.Store(nextMidnight(now).UnixNano())
+	return b
+}
+
+// nextMidnight returns the start of the next UTC day.
+func nextMidnight(now time.Time) time.Time {
+	y, m, d := now.UTC().Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+}
+
+// timeToReset returns the duration until the consumption is reset.
+func (b *dailyBudget) timeToReset(now time.Time) time.Duration {
+	return time.Unix(0, b.resetAt.Load()).Sub(now)
+}
+
+// remaining returns the budget left if used nanoseconds are consumed.
+func (b *dailyBudget) remaining(used int64) time.Duration {
+	r := time.Duration(b.limit.Load() - used)
+	if r < 0 {
+		return 0
+	}
+	return r
+}
+
+func (b *dailyBudget) updateRemaining(used int64) {
+	dailyBudgetRemaining.With(prometheus.Labels{"user": b.user}).Set(b.remaining(used).Seconds())
+}
+
+func (b *dailyBudget) consume(d time.Duration) int64 {
+	n := b.used.Add(int64(d))
+	b.updateRemaining(n)
+	return n
+}
+
+func (b *dailyBudget) reset(now time.Time) {
+	b.used.Store(0)
+	b.resetAt.Store(nextMidnight(now).UnixNano())
+	b.updateRemaining(0)
+}
+
+func (b *dailyBudget) run(done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(b.timeToReset(time.Now())):
+			b.reset(time.Now())
+		}
+	}
+}
+
+// distributedBudgetCounter sums query durations of the user per UTC day in redis,
+// so the consumption is shared between chproxy instances.
+type distributedBudgetCounter struct {
+	client redis.UniversalClient
+	user   string
+}
+
+func (c *distributedBudgetCounter) key(now time.Time) string {
+	return fmt.Sprintf("chproxy:budget:%s:%s", c.user, now.UTC().Format("2006-01-02"))
+}
+
+// load returns the sum of query durations during the current day in nanoseconds.
+func (c *distributedBudgetCounter) load(now time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), distributedRateLimitTimeout)
+	defer cancel()
+
+	n, err := c.client.Get(ctx, c.key(now)).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return n, err
+}
+
+// add adds d to the sum of query durations during the current day
+// and returns the new sum in nanoseconds.
+func (c *distributedBudgetCounter) add(now time.Time, d time.Duration) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), distributedRateLimitTimeout)
+	defer cancel()
+
+	key := c.key(now)
+	var incr *redis.IntCmd
+	_, err := c.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.IncrBy(ctx, key, int64(d))
+		// Keep the counter a bit longer than the day,
+		// so instances with skewed clocks still see it.
+		pipe.Expire(ctx, key, 25*time.Hour)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+// hasDailyBudget returns true if the user has `daily_execution_budget` configured.
+func (u *user) hasDailyBudget() bool {
+	return u.dailyExecutionBudget > 0
+}
+
+// checkDailyBudget returns an error and the time until the budget is reset
+// if the user has exhausted its daily execution budget.
+//
+// The shared counter is authoritative if it is reachable,
+// otherwise the local one is used.
+func (u *user) checkDailyBudget() (time.Duration, error) {
+	if !u.hasDailyBudget() {
+		return 0, nil
+	}
+
+	now := time.Now()
+	used := u.dailyBudget.used.Load()
+	if u.budgetCounter != nil {
+		n, err := u.budgetCounter.load(now)
+		if err != nil {
+			log.Debugf("cannot load distributed daily budget of user %q, falling back to the local one: %s", u.name, err)
+		} else {
+			used = n
+		}
+	}
+	if used < int64(u.dailyExecutionBudget) {
+		return 0, nil
+	}
+
+	ttr := u.dailyBudget.timeToReset(now)
+	return ttr, fmt.Errorf("daily execution budget for user %q is exhausted: daily_execution_budget limit: %s; resets in %s",
+		u.name, u.dailyExecutionBudget, ttr.Round(time.Second))
+}
+
+// consumeDailyBudget adds d to the daily consumption of the user.
+func (u *user) consumeDailyBudget(d time.Duration) {
+	n := u.dailyBudget.consume(d)
+	if u.budgetCounter == nil {
+		return
+	}
+	sn, err := u.budgetCounter.add(time.Now(), d)
+	if err != nil {
+		log.Debugf("cannot update distributed daily budget of user %q: %s", u.name, err)
+		return
+	}
+	if sn != n {
+		u.dailyBudget.updateRemaining(sn)
+	}
+}
+
+// preserveDailyBudgets passes the daily consumption of the users from oldUsers
+// to the users with the same names from users.
+func preserveDailyBudgets(users, oldUsers map[string]*user) {
+	for name, u := range users {
+		old, ok := oldUsers[name]
+		if !ok || !u.hasDailyBudget() || !old.hasDailyBudget() {
+			continue
+		}
+		old.dailyBudget.limit.Store(int64(u.dailyExecutionBudget))
+		u.dailyBudget = old.dailyBudget
+	}
+}
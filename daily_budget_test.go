@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNextMidnight(t *testing.T) {
+	now := time.Date(2024, 2, 29, 23, 30, 0, 0, time.FixedZone("UTC-2", -2*3600))
+	assert.Equal(t, time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC), nextMidnight(now))
+
+	now = time.Date(2024, 12, 31, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), nextMidnight(now))
+}
+
+func TestDailyBudget(t *testing.T) {
+	now := time.Now()
+	u := &user{
+		name:                 "dev",
+		dailyExecutionBudget: time.Second,
+		dailyBudget:          newDailyBudget("dev", time.Second, now),
+	}
+	assert.Equal(t, nextMidnight(now).Sub(now), u.dailyBudget.timeToReset(now))
+
+	u.consumeDailyBudget(400 * time.Millisecond)
+	if _, err := u.checkDailyBudget(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assert.Equal(t, 0.6, testutil.ToFloat64(dailyBudgetRemaining.WithLabelValues("dev")))
+
+	u.consumeDailyBudget(700 * time.Millisecond)
+	ttr, err := u.checkDailyBudget()
+	assert.EqualError(t, err, "daily execution budget for user \"dev\" is exhausted: daily_execution_budget limit: 1s; resets in "+ttr.Round(time.Second).String())
+	assert.Greater(t, ttr, time.Duration(0))
+	assert.Equal(t, 0.0, testutil.ToFloat64(dailyBudgetRemaining.WithLabelValues("dev")))
+
+	u.dailyBudget.reset(now)
+	if _, err := u.checkDailyBudget(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assert.Equal(t, 1.0, testutil.ToFloat64(dailyBudgetRemaining.WithLabelValues("dev")))
+}
+
+func TestDistributedDailyBudget(t *testing.T) {
+	s := miniredis.RunT(t)
+	client := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs: []string{s.Addr()},
+	})
+	t.Cleanup(func() { client.Close() })
+	c := &distributedBudgetCounter{client: client, user: "dev"}
+
+	now := time.Date(2024, 1, 1, 18, 0, 0, 0, time.UTC)
+	if _, err := c.add(now, time.Second); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !s.Exists("chproxy:budget:dev:2024-01-01") {
+		t.Fatalf("expected the counter of the current day to be stored")
+	}
+	assert.Equal(t, 25*time.Hour, s.TTL("chproxy:budget:dev:2024-01-01"))
+	n, err := c.load(now)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assert.Equal(t, int64(time.Second), n)
+
+	n, err = c.load(now.Add(6 * time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assert.Equal(t, int64(0), n, "the counter of the next day must be empty")
+
+	u := &user{
+		name:                 "dev",
+		dailyExecutionBudget: 2 * time.Second,
+		dailyBudget:          newDailyBudget("dev", 2*time.Second, time.Now()),
+		budgetCounter:        c,
+	}
+	// Other instances have consumed the budget.
+	if _, err := c.add(time.Now(), 2*time.Second); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := u.checkDailyBudget(); err == nil {
+		t.Fatalf("expected the shared counter to be used")
+	}
+
+	s.Close()
+	if _, err := u.checkDailyBudget(); err != nil {
+		t.Fatalf("expected the local counter to be used; got error: %s", err)
+	}
+}
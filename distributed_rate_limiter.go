@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// distributedRateLimitTimeout limits the time spent on the shared counter,
+// so an unreachable redis doesn't stall requests.
+const distributedRateLimitTimeout = 500 * time.Millisecond
+
+// distributedRateCounter counts requests of the user per minute in redis,
+// so the counter is shared between chproxy instances.
+type distributedRateCounter struct {
+	client redis.UniversalClient
+	user   string
+}
+
+func (c *distributedRateCounter) key(bucket int64) string {
+	return fmt.Sprintf("chproxy:ratelimit:%s:%d", c.user, bucket)
+}
+
+// inc increments the counter of the current minute and returns the number
+// of requests during the last minute.
+//
+// The number is estimated with a sliding window: requests from the previous
+// minute are weighted by the part of the window they still overlap.
+func (c *distributedRateCounter) inc(now time.Time) (uint32, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), distributedRateLimitTimeout)
+	defer cancel()
+
+	bucket := now.Unix() / 60
+	var cur *redis.IntCmd
+	var prev *redis.StringCmd
+	_, err := c.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		cur = pipe.Incr(ctx, c.key(bucket))
+		// The counter is still needed during the next minute
+		// for the sliding window.
+		pipe.Expire(ctx, c.key(bucket), 2*time.Minute)
+		prev = pipe.Get(ctx, c.key(bucket-1))
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return 0, err
+	}
+
+	prevN, err := prev.Int64()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			return 0, err
+		}
+		prevN = 0
+	}
+
+	elapsed := now.Sub(time.Unix(bucket*60, 0)).Seconds() / 60
+	n := float64(cur.Val()) + float64(prevN)*(1-elapsed)
+	return uint32(n), nil
+}
+
+// dec decrements the counter of the current minute.
+func (c *distributedRateCounter) dec(now time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), distributedRateLimitTimeout)
+	defer cancel()
+
+	key := c.key(now.Unix() / 60)
+	_, err := c.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Decr(ctx, key)
+		pipe.Expire(ctx, key, 2*time.Minute)
+		return nil
+	})
+	return err
+}
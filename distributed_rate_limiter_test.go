@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestDistributedRateCounter(t *testing.T) (*distributedRateCounter, *miniredis.Miniredis) {
+	s := miniredis.RunT(t)
+	client := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs: []string{s.Addr()},
+	})
+	t.Cleanup(func() { client.Close() })
+	return &distributedRateCounter{client: client, user: "dev"}, s
+}
+
+func TestDistributedRateCounter(t *testing.T) {
+	c, s := newTestDistributedRateCounter(t)
+
+	now := time.Unix(6000, 0)
+	for i := 1; i <= 3; i++ {
+		n, err := c.inc(now)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if n != uint32(i) {
+			t.Fatalf("unexpected number of requests; expected: %d; got: %d", i, n)
+		}
+	}
+	if !s.Exists("chproxy:ratelimit:dev:100") {
+		t.Fatalf("expected the counter of the current minute to be stored")
+	}
+	if ttl := s.TTL("chproxy:ratelimit:dev:100"); ttl != 2*time.Minute {
+		t.Fatalf("unexpected ttl of the counter; expected: %s; got: %s", 2*time.Minute, ttl)
+	}
+
+	if err := c.dec(now); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Half of the window overlaps the previous minute with 2 requests.
+	n, err := c.inc(now.Add(90 * time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n != 2 {
+		t.Fatalf("unexpected number of requests; expected: %d; got: %d", 2, n)
+	}
+}
+
+func TestRateLimiterFallback(t *testing.T) {
+	c, s := newTestDistributedRateCounter(t)
+	rl := rateLimiter{shared: c}
+
+	for i := 0; i < 3; i++ {
+		rl.inc()
+	}
+	// Other instances have sent requests too.
+	for i := 0; i < 10; i++ {
+		if _, err := c.inc(time.Now()); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if n := rl.inc(); n <= 10 {
+		t.Fatalf("expected the shared counter to be used; got: %d", n)
+	}
+
+	s.Close()
+	if n := rl.inc(); n != 5 {
+		t.Fatalf("expected the local counter to be used; got: %d", n)
+	}
+	rl.dec()
+	if n := rl.load(); n != 4 {
+		t.Fatalf("unexpected local counter; expected: %d; got: %d", 4, n)
+	}
+}
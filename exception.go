@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// exceptionCodeHeader contains the code of the exception
+// in ClickHouse error responses.
+const exceptionCodeHeader = "X-ClickHouse-Exception-Code"
+
+// clickhouseException describes the ClickHouse error code.
+// See https://github.com/ClickHouse/ClickHouse/blob/master/src/Common/ErrorCodes.cpp
+type clickhouseException struct {
+	code int
+	name string
+}
+
+// exceptionsByStatus maps status codes of errors generated by chproxy
+// to the ClickHouse exceptions with the closest meaning,
+// so ClickHouse clients may handle them.
+var exceptionsByStatus = map[int]clickhouseException{
+	http.StatusBadRequest:            {36, "BAD_ARGUMENTS"},
+	http.StatusUnauthorized:          {516, "AUTHENTICATION_FAILED"},
+	http.StatusForbidden:             {497, "ACCESS_DENIED"},
+	http.StatusRequestEntityTooLarge: {396, "TOO_MANY_ROWS_OR_BYTES"},
+	http.StatusTooManyRequests:       {202, "TOO_MANY_SIMULTANEOUS_QUERIES"},
+	http.StatusInternalServerError:   {1002, "UNKNOWN_EXCEPTION"},
+	http.StatusBadGateway:            {210, "NETWORK_ERROR"},
+	http.StatusServiceUnavailable:    {279, "ALL_CONNECTION_TRIES_FAILED"},
+	http.StatusGatewayTimeout:        {159, "TIMEOUT_EXCEEDED"},
+}
+
+// exceptionCodeRegexp matches the code of the ClickHouse exception
+// in failure reasons of concurrent queries.
+var exceptionCodeRegexp = regexp.MustCompile(`^(?:` + regexp.QuoteMeta(failedTransactionPrefix) + ` )?Code: (\d+)\.`)
+
+// withExceptionCode adds the code of the ClickHouse exception to failReason
+// of the concurrent query, so the waiting queries respond with the same code.
+// failReason is returned as is if it already contains the code.
+func withExceptionCode(failReason, code string) string {
+	if code == "" || exceptionCodeRegexp.MatchString(failReason) {
+		return failReason
+	}
+	msg := strings.TrimPrefix(failReason, failedTransactionPrefix+" ")
+	return fmt.Sprintf("%s Code: %s. %s", failedTransactionPrefix, code, msg)
+}
+
+// writeException writes err with the given status formatted as a ClickHouse exception.
+//
+// The code of the original exception is kept if rw already contains
+// exceptionCodeHeader, e.g. from the proxied response, or if err contains
+// the ClickHouse exception, e.g. the failure reason of a concurrent query.
+func writeException(rw http.ResponseWriter, err error, status int) {
+	msg := err.Error()
+	h := rw.Header()
+	m := exceptionCodeRegexp.FindStringSubmatch(msg)
+	switch {
+	case len(h.Get(exceptionCodeHeader)) > 0:
+		// The exception of the proxied response is kept as is.
+	case m != nil:
+		h.Set(exceptionCodeHeader, m[1])
+	default:
+		if e, ok := exceptionsByStatus[status]; ok {
+			h.Set(exceptionCodeHeader, strconv.Itoa(e.code))
+			msg = fmt.Sprintf("Code: %d. DB::Exception: %s. (%s)", e.code, msg, e.name)
+		}
+	}
+	rw.WriteHeader(status)
+	fmt.Fprintf(rw, "%s\n", msg)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteException(t *testing.T) {
+	testCases := []struct {
+		name      string
+		err       error
+		status    int
+		header    string
+		expCode   string
+		expResult string
+	}{
+		{
+			name:      "bad request",
+			err:       errors.New("cannot parse query"),
+			status:    http.StatusBadRequest,
+			expCode:   "36",
+			expResult: "Code: 36. DB::Exception: cannot parse query. (BAD_ARGUMENTS)\n",
+		},
+		{
+			name:      "unauthorized",
+			err:       errors.New("invalid username or password"),
+			status:    http.StatusUnauthorized,
+			expCode:   "516",
+			expResult: "Code: 516. DB::Exception: invalid username or password. (AUTHENTICATION_FAILED)\n",
+		},
+		{
+			name:      "forbidden",
+			err:       errors.New("not allowed"),
+			status:    http.StatusForbidden,
+			expCode:   "497",
+			expResult: "Code: 497. DB::Exception: not allowed. (ACCESS_DENIED)\n",
+		},
+		{
+			name:      "request entity too large",
+			err:       errors.New("request body is too large"),
+			status:    http.StatusRequestEntityTooLarge,
+			expCode:   "396",
+			expResult: "Code: 396. DB::Exception: request body is too large. (TOO_MANY_ROWS_OR_BYTES)\n",
+		},
+		{
+			name:      "too many requests",
+			err:       errors.New("max_concurrent_queries limit: 1"),
+			status:    http.StatusTooManyRequests,
+			expCode:   "202",
+			expResult: "Code: 202. DB::Exception: max_concurrent_queries limit: 1. (TOO_MANY_SIMULTANEOUS_QUERIES)\n",
+		},
+		{
+			name:      "internal server error",
+			err:       errors.New("cannot create tmp file"),
+			status:    http.StatusInternalServerError,
+			expCode:   "1002",
+			expResult: "Code: 1002. DB::Exception: cannot create tmp file. (UNKNOWN_EXCEPTION)\n",
+		},
+		{
+			name:      "bad gateway",
+			err:       errors.New("cannot reach 127.0.0.1:8123"),
+			status:    http.StatusBadGateway,
+			expCode:   "210",
+			expResult: "Code: 210. DB::Exception: cannot reach 127.0.0.1:8123. (NETWORK_ERROR)\n",
+		},
+		{
+			name:      "service unavailable",
+			err:       errors.New("no active hosts"),
+			status:    http.StatusServiceUnavailable,
+			expCode:   "279",
+			expResult: "Code: 279. DB::Exception: no active hosts. (ALL_CONNECTION_TRIES_FAILED)\n",
+		},
+		{
+			name:      "gateway timeout",
+			err:       errors.New("timeout for user \"default\" exceeded: 10ms"),
+			status:    http.StatusGatewayTimeout,
+			expCode:   "159",
+			expResult: "Code: 159. DB::Exception: timeout for user \"default\" exceeded: 10ms. (TIMEOUT_EXCEEDED)\n",
+		},
+		{
+			name:      "unmapped status",
+			err:       errors.New("teapot"),
+			status:    http.StatusTeapot,
+			expCode:   "",
+			expResult: "teapot\n",
+		},
+		{
+			name:      "proxied exception",
+			err:       errors.New("Code: 241. DB::Exception: Memory limit exceeded"),
+			status:    http.StatusInternalServerError,
+			header:    "241",
+			expCode:   "241",
+			expResult: "Code: 241. DB::Exception: Memory limit exceeded\n",
+		},
+		{
+			name:      "concurrent query failure",
+			err:       errors.New(failedTransactionPrefix + " Code: 241. DB::Exception: Memory limit exceeded"),
+			status:    http.StatusInternalServerError,
+			expCode:   "241",
+			expResult: failedTransactionPrefix + " Code: 241. DB::Exception: Memory limit exceeded\n",
+		},
+		{
+			name:      "concurrent query failure without exception",
+			err:       errors.New(failedTransactionPrefix + " unknown error reason"),
+			status:    http.StatusInternalServerError,
+			expCode:   "1002",
+			expResult: "Code: 1002. DB::Exception: " + failedTransactionPrefix + " unknown error reason. (UNKNOWN_EXCEPTION)\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			if len(tc.header) > 0 {
+				rw.Header().Set(exceptionCodeHeader, tc.header)
+			}
+			writeException(rw, tc.err, tc.status)
+			assert.Equal(t, tc.status, rw.Code)
+			assert.Equal(t, tc.expCode, rw.Header().Get(exceptionCodeHeader))
+			assert.Equal(t, tc.expResult, rw.Body.String())
+		})
+	}
+}
+
+func TestWithExceptionCode(t *testing.T) {
+	testCases := []struct {
+		name      string
+		reason    string
+		code      string
+		expReason string
+	}{
+		{
+			name:      "no code",
+			reason:    failedTransactionPrefix + " unknown error reason",
+			expReason: failedTransactionPrefix + " unknown error reason",
+		},
+		{
+			name:      "code is added",
+			reason:    failedTransactionPrefix + " unknown error reason",
+			code:      "241",
+			expReason: failedTransactionPrefix + " Code: 241. unknown error reason",
+		},
+		{
+			name:      "code is kept",
+			reason:    failedTransactionPrefix + " Code: 241. DB::Exception: Memory limit exceeded",
+			code:      "241",
+			expReason: failedTransactionPrefix + " Code: 241. DB::Exception: Memory limit exceeded",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			reason := withExceptionCode(tc.reason, tc.code)
+			assert.Equal(t, tc.expReason, reason)
+			if tc.code != "" {
+				// The waiting queries respond with the code of the exception.
+				rw := httptest.NewRecorder()
+				writeException(rw, errors.New(reason), http.StatusInternalServerError)
+				assert.Equal(t, tc.code, rw.Header().Get(exceptionCodeHeader))
+			}
+		})
+	}
+}
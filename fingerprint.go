@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/contentsquare/chproxy/config"
+)
+
+// defaultMaxFingerprintLabels is used if `metrics.max_fingerprint_labels` isn't set.
+const defaultMaxFingerprintLabels = 1000
+
+// otherFingerprintLabel is the `query_fingerprint` label of queries
+// exceeding `metrics.max_fingerprint_labels`.
+const otherFingerprintLabel = "other"
+
+// literalRegexp matches string literals and numeric constants.
+var literalRegexp = regexp.MustCompile(`'(?:[^'\\]|\\.|'')*'|\b(?:0[xX][0-9a-fA-F]+|[0-9]+(?:\.[0-9]+)?(?:[eE][-+]?[0-9]+)?)\b`)
+
+// queryFingerprint returns the FNV-32 hash of q with string literals
+// and numeric constants replaced by placeholders, so queries differing
+// only by literals have the same fingerprint.
+func queryFingerprint(q []byte) string {
+	fp := literalRegexp.ReplaceAll(normalizeQuery(q), []byte("?"))
+	return fmt.Sprintf("%08x", hash(string(fp)))
+}
+
+// fingerprintLabels bounds the cardinality of the `query_fingerprint` label.
+type fingerprintLabels struct {
+	mu    sync.RWMutex
+	seen  map[string]struct{}
+	limit int
+}
+
+// queryFingerprints is set if `metrics.enable_query_fingerprint_label` is enabled.
+var queryFingerprints *fingerprintLabels
+
+func newFingerprintLabels(cfg config.Metrics) *fingerprintLabels {
+	if !cfg.EnableQueryFingerprintLabel {
+		return nil
+	}
+	limit := cfg.MaxFingerprintLabels
+	if limit == 0 {
+		limit = defaultMaxFingerprintLabels
+	}
+	return &fingerprintLabels{
+		seen:  make(map[string]struct{}),
+		limit: limit,
+	}
+}
+
+// label returns the `query_fingerprint` label of q.
+// Fingerprints seen after the first limit ones are labelled as "other".
+func (fl *fingerprintLabels) label(q []byte) string {
+	fp := queryFingerprint(q)
+
+	fl.mu.RLock()
+	_, ok := fl.seen[fp]
+	fl.mu.RUnlock()
+	if ok {
+		return fp
+	}
+
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	if _, ok := fl.seen[fp]; ok {
+		return fp
+	}
+	if len(fl.seen) >= fl.limit {
+		return otherFingerprintLabel
+	}
+	fl.seen[fp] = struct{}{}
+	return fp
+}
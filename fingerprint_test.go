@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/contentsquare/chproxy/config"
+)
+
+func TestQueryFingerprint(t *testing.T) {
+	testCases := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{
+			name:     "numeric constant",
+			query:    "SELECT 1",
+			expected: "SELECT ?",
+		},
+		{
+			name:     "numeric constants in condition",
+			query:    "SELECT * FROM t WHERE id = 42 AND x > 1.5e3 OR y = 0xFF",
+			expected: "SELECT * FROM t WHERE id = ? AND x > ? OR y = ?",
+		},
+		{
+			name:     "string literals",
+			query:    `SELECT * FROM t WHERE s = 'it''s' OR s = 'a\'b'`,
+			expected: "SELECT * FROM t WHERE s = ? OR s = ?",
+		},
+		{
+			name:     "identifiers with digits",
+			query:    "SELECT col1 FROM t2 LIMIT 10",
+			expected: "SELECT col1 FROM t2 LIMIT ?",
+		},
+		{
+			name:     "formatting",
+			query:    "select  42\n FROM t;",
+			expected: "SELECT ? FROM t",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := queryFingerprint([]byte(tc.query))
+			expected := queryFingerprint([]byte(tc.expected))
+			if got != expected {
+				t.Fatalf("unexpected fingerprint of %q: %s; expected the fingerprint of %q: %s", tc.query, got, tc.expected, expected)
+			}
+		})
+	}
+
+	if queryFingerprint([]byte("SELECT a FROM t")) == queryFingerprint([]byte("SELECT b FROM t")) {
+		t.Fatalf("queries selecting different columns must have different fingerprints")
+	}
+}
+
+func TestFingerprintLabels(t *testing.T) {
+	if fl := newFingerprintLabels(config.Metrics{}); fl != nil {
+		t.Fatalf("fingerprint labels must be disabled by default")
+	}
+
+	fl := newFingerprintLabels(config.Metrics{EnableQueryFingerprintLabel: true})
+	if fl.limit != defaultMaxFingerprintLabels {
+		t.Fatalf("unexpected limit: %d; expected: %d", fl.limit, defaultMaxFingerprintLabels)
+	}
+
+	fl = newFingerprintLabels(config.Metrics{EnableQueryFingerprintLabel: true, MaxFingerprintLabels: 2})
+	first := fl.label([]byte("SELECT 1"))
+	second := fl.label([]byte("SELECT 1 FROM t"))
+	if first == otherFingerprintLabel || second == otherFingerprintLabel {
+		t.Fatalf("fingerprints within the limit must be used as labels; got %q and %q", first, second)
+	}
+	if got := fl.label([]byte("SELECT 1 FROM t2")); got != otherFingerprintLabel {
+		t.Fatalf("unexpected label: %q; expected: %q", got, otherFingerprintLabel)
+	}
+	if got := fl.label([]byte("SELECT 2")); got != first {
+		t.Fatalf("unexpected label: %q; expected: %q", got, first)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/contentsquare/chproxy/config"
+	"github.com/contentsquare/chproxy/log"
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultHealthzCheckTimeout is used if `check_timeout` isn't set.
+const defaultHealthzCheckTimeout = time.Second
+
+const (
+	healthStatusOK           = "ok"
+	healthStatusDegraded     = "degraded"
+	healthStatusShuttingDown = "shutting_down"
+)
+
+type healthzResponse struct {
+	Status       string            `json:"status"`
+	Dependencies map[string]string `json:"dependencies"`
+}
+
+// serveHealthz reports whether chproxy and its dependencies are able
+// to serve requests, so load balancers may stop sending traffic to it.
+func serveHealthz(rw http.ResponseWriter, _ *http.Request) {
+	resp := healthzResponse{
+		Status:       healthStatusOK,
+		Dependencies: map[string]string{},
+	}
+	statusCode := http.StatusOK
+	if shuttingDown.Load() {
+		rw.Header().Set("Connection", "close")
+		resp.Status = healthStatusShuttingDown
+		statusCode = http.StatusServiceUnavailable
+	} else {
+		// nolint:forcetypeassert // We will cover this by tests as we control what is stored.
+		cfg := currentConfig.Load().(*config.Config)
+		timeout := time.Duration(cfg.Server.Healthz.CheckTimeout)
+		if timeout == 0 {
+			timeout = defaultHealthzCheckTimeout
+		}
+		resp.Dependencies = proxy.checkHealth(timeout)
+		for _, status := range resp.Dependencies {
+			if status != healthStatusOK {
+				resp.Status = healthStatusDegraded
+				statusCode = http.StatusServiceUnavailable
+			}
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(statusCode)
+	if err := json.NewEncoder(rw).Encode(resp); err != nil {
+		log.Errorf("cannot send healthz response: %s", err)
+	}
+}
+
+// checkHealth returns statuses of the clusters and the redis caches.
+// The clusters are healthy if they have at least one active host according
+// to the heartbeat, while the redis caches are pinged for up to timeout.
+func (rp *reverseProxy) checkHealth(timeout time.Duration) map[string]string {
+	deps := make(map[string]string)
+	ps := rp.snapshot.Load()
+	for name, c := range ps.clusters {
+		deps["cluster:"+name] = c.health()
+	}
+	type probe struct {
+		client redis.UniversalClient
+		err    error
+	}
+	caches := make(map[string]*probe, len(ps.caches))
+	for name, cc := range ps.caches {
+		if client := cc.RedisClient(); client != nil {
+			caches[name] = &probe{client: client}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range caches {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			c.err = c.client.Ping(ctx).Err()
+		}()
+	}
+	wg.Wait()
+
+	for name, c := range caches {
+		status := healthStatusOK
+		if c.err != nil {
+			status = c.err.Error()
+		}
+		deps["cache:"+name] = status
+	}
+	return deps
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/contentsquare/chproxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReverseProxy_CheckHealth(t *testing.T) {
+	redis := miniredis.RunT(t)
+	cfg := *goodCfg
+	cfg.Clusters = []config.Cluster{goodCfg.Clusters[0]}
+	cfg.Clusters[0].Replicas = nil
+	cfg.Clusters[0].HeartBeat = config.HeartBeat{
+		Interval: config.Duration(time.Minute),
+		Timeout:  config.Duration(time.Second),
+		Request:  "/ping",
+		Response: okResponse + "\n",
+	}
+	cfg.Caches = []config.Cache{
+		{
+			Name: "redis-cache",
+			Mode: "redis",
+			Redis: config.RedisCacheConfig{
+				Addresses: []string{redis.Addr()},
+			},
+			Expire: config.Duration(time.Minute),
+		},
+	}
+	proxy, err := getProxy(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The hosts become active after the first heartbeat.
+	assert.Eventually(t, func() bool {
+		return proxy.checkHealth(time.Second)["cluster:cluster"] == healthStatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+	expected := map[string]string{
+		"cluster:cluster":   healthStatusOK,
+		"cache:redis-cache": healthStatusOK,
+	}
+	assert.Equal(t, expected, proxy.checkHealth(time.Second))
+
+	for _, r := range proxy.snapshot.Load().clusters["cluster"].replicas {
+		for _, h := range r.hosts {
+			h.SetIsActive(false)
+		}
+	}
+	redis.Close()
+	deps := proxy.checkHealth(100 * time.Millisecond)
+	assert.Equal(t, "no active hosts", deps["cluster:cluster"])
+	assert.NotEqual(t, healthStatusOK, deps["cache:redis-cache"])
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// maxIdentities bounds the number of idle counters kept
+// per wildcarded user with `per_identity_limits`.
+const maxIdentities = 10000
+
+// identityCounters holds running query counters for concrete users
+// matching a wildcarded user.
+//
+// Idle counters are evicted in LRU order once there are more than max
+// of them. Counters with running queries are never evicted, so their
+// limits hold.
+type identityCounters struct {
+	mu    sync.Mutex
+	max   int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type identityCounter struct {
+	name string
+	counter
+}
+
+func newIdentityCounters(max int) *identityCounters {
+	return &identityCounters{
+		max:   max,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// get returns the counter of the given identity.
+func (ic *identityCounters) get(name string) *counter {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	if e, ok := ic.items[name]; ok {
+		ic.ll.MoveToFront(e)
+		// nolint:forcetypeassert // Only *identityCounter is stored in the list.
+		return &e.Value.(*identityCounter).counter
+	}
+
+	c := &identityCounter{name: name}
+	ic.items[name] = ic.ll.PushFront(c)
+	ic.evict()
+	return &c.counter
+}
+
+// evict removes the least recently used idle counters above the limit.
+// The front counter has just been requested, so it is kept.
+func (ic *identityCounters) evict() {
+	e := ic.ll.Back()
+	for ic.ll.Len() > ic.max && e != ic.ll.Front() {
+		prev := e.Prev()
+		// nolint:forcetypeassert // Only *identityCounter is stored in the list.
+		c := e.Value.(*identityCounter)
+		if c.load() == 0 {
+			ic.ll.Remove(e)
+			delete(ic.items, c.name)
+		}
+		e = prev
+	}
+}
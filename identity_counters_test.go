@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestIdentityCounters(t *testing.T) {
+	ic := newIdentityCounters(2)
+
+	a := ic.get("analyst_a")
+	if a != ic.get("analyst_a") {
+		t.Fatalf("expected the same counter for the same identity")
+	}
+	a.inc()
+
+	for i := 0; i < 10; i++ {
+		ic.get(strconv.Itoa(i))
+	}
+	if n := ic.ll.Len(); n != 2 {
+		t.Fatalf("unexpected number of counters; expected: %d; got: %d", 2, n)
+	}
+	if _, ok := ic.items["9"]; !ok {
+		t.Fatalf("expected the most recently used counter to be kept")
+	}
+	// The counter with running queries must survive eviction.
+	if a != ic.get("analyst_a") {
+		t.Fatalf("expected the busy counter to be kept")
+	}
+
+	a.dec()
+	for i := 0; i < 10; i++ {
+		ic.get(strconv.Itoa(i))
+	}
+	if _, ok := ic.items["analyst_a"]; ok {
+		t.Fatalf("expected the idle counter to be evicted")
+	}
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/contentsquare/chproxy/config"
+	"github.com/contentsquare/chproxy/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// defaultInsertBatchMaxBytes is used if `insert_batching.max_bytes` isn't set.
+	defaultInsertBatchMaxBytes = 1 << 20
+
+	// defaultInsertBatchMaxInterval is used if `insert_batching.max_interval` isn't set.
+	defaultInsertBatchMaxInterval = time.Second
+
+	// insertBatchExt is the extension of files batches are spooled to.
+	// Files of batches which failed to be flushed are renamed to insertBatchFailedExt.
+	insertBatchExt       = ".batch"
+	insertBatchFailedExt = ".failed"
+
+	// maxInsertBatchErrorSize limits the size of the ClickHouse error
+	// reported for failed flushes.
+	maxInsertBatchErrorSize = 1024
+)
+
+// defaultInsertBatchFormats is used if `insert_batching.formats` isn't set.
+// Data in these formats may be concatenated row by row.
+var defaultInsertBatchFormats = []string{"JSONEachRow", "TabSeparated", "TSV", "CSV"}
+
+// defaultInsertBatchSpoolDir is used if `insert_batching.spool_dir` isn't set.
+// The spool dir contains files batches are spooled to until they are flushed,
+// so the data acknowledged to clients survives restarts.
+var defaultInsertBatchSpoolDir = filepath.Join(os.TempDir(), "chproxy-insert-batches")
+
+// batchableInsertRe matches the statement of INSERTs with the data
+// in the given FORMAT. The data follows the statement.
+var batchableInsertRe = regexp.MustCompile(`(?is)^(INSERT\s+INTO\s+[^;]+?\s+FORMAT\s+([a-z0-9_]+))[ \t]*(?:\r?\n)?`)
+
+// insertWithQueryRe matches INSERTs, which take data from queries
+// instead of the request.
+var insertWithQueryRe = regexp.MustCompile(`(?i)\b(SELECT|VALUES)\b`)
+
+// insertBatcher buffers small INSERTs of the user with the same statement
+// and params, so they are flushed to ClickHouse as a single INSERT.
+type insertBatcher struct {
+	cfg config.InsertBatching
+
+	maxBytes    int64
+	maxInterval time.Duration
+	formats     []string
+	waitFlush   bool
+	spoolDir    string
+
+	// mu protects batches. The batch is taken from batches under mu
+	// before it is flushed, so no INSERTs are added to it afterwards.
+	// The data is appended to the batch without holding mu.
+	mu sync.Mutex
+	// batches holds pending batches keyed by insertBatchKey.
+	batches map[string]*insertBatch
+}
+
+// newInsertBatcher returns the batcher for cfg
+// or nil if INSERTs aren't batched.
+func newInsertBatcher(cfg *config.InsertBatching) *insertBatcher {
+	if cfg == nil {
+		return nil
+	}
+	ib := &insertBatcher{
+		cfg:         *cfg,
+		maxBytes:    int64(cfg.MaxBytes),
+		maxInterval: time.Duration(cfg.MaxInterval),
+		formats:     cfg.Formats,
+		waitFlush:   cfg.Ack == "flushed",
+		spoolDir:    cfg.SpoolDir,
+		batches:     make(map[string]*insertBatch),
+	}
+	if ib.maxBytes == 0 {
+		ib.maxBytes = defaultInsertBatchMaxBytes
+	}
+	if ib.maxInterval == 0 {
+		ib.maxInterval = defaultInsertBatchMaxInterval
+	}
+	if len(ib.formats) == 0 {
+		ib.formats = defaultInsertBatchFormats
+	}
+	if len(ib.spoolDir) == 0 {
+		ib.spoolDir = defaultInsertBatchSpoolDir
+	}
+	return ib
+}
+
+func (ib *insertBatcher) isFormatAllowed(format string) bool {
+	for _, f := range ib.formats {
+		if strings.EqualFold(f, format) {
+			return true
+		}
+	}
+	return false
+}
+
+// insertBatch is the data of INSERTs spooled to file until it is flushed.
+type insertBatch struct {
+	// s and req belong to the first INSERT of the batch.
+	// They are used as templates for the flushed INSERT.
+	s   *scope
+	req *http.Request
+
+	// statement is the INSERT statement without the data.
+	statement string
+
+	// mu serializes appending to file.
+	mu   sync.Mutex
+	file *os.File
+	// dataOffset is the offset of the data in file.
+	dataOffset int64
+	size       int64
+
+	// reserved is the size of the data added to the batch,
+	// including the data being appended. It is protected by insertBatcher.mu.
+	reserved int64
+	// appending counts INSERTs being appended to the batch,
+	// so the batch is flushed only after they are spooled.
+	appending sync.WaitGroup
+
+	timer *time.Timer
+
+	// done is closed once the batch is flushed.
+	// err is set if the flush fails.
+	done chan struct{}
+	err  error
+}
+
+// insertBatchHeader is the first line of the spooled batch, which allows
+// flushing the batch after restart.
+type insertBatchHeader struct {
+	User      string `json:"user"`
+	Statement string `json:"statement"`
+	Params    string `json:"params"`
+	Database  string `json:"database,omitempty"`
+}
+
+// parseBatchableInsert returns the statement, the format and the data
+// of the INSERT with data in q. ok is false if q isn't such an INSERT.
+func parseBatchableInsert(q []byte) (statement, format string, data []byte, ok bool) {
+	q = skipLeadingComments(q)
+	m := batchableInsertRe.FindSubmatchIndex(q)
+	if m == nil {
+		return "", "", nil, false
+	}
+	statement = string(q[m[2]:m[3]])
+	if insertWithQueryRe.MatchString(statement) {
+		return "", "", nil, false
+	}
+	data = q[m[1]:]
+	if len(bytes.TrimSpace(data)) == 0 {
+		return "", "", nil, false
+	}
+	return statement, string(q[m[4]:m[5]]), data, true
+}
+
+// insertBatchKey returns the key of the batch the INSERT with statement
+// from the decorated req belongs to. INSERTs are batched only if
+// they are sent with the same params, since params may change
+// how the data is parsed.
+func insertBatchKey(s *scope, req *http.Request, statement string) string {
+	params := req.URL.Query()
+	params.Del("query")
+	params.Del("query_id")
+	params.Del("session_timeout")
+	params.Del("decompress")
+	return strings.Join([]string{
+		s.clusterUser.name,
+		strings.Join(strings.Fields(statement), " "),
+		params.Encode(),
+		req.Header.Get("X-ClickHouse-Database"),
+	}, "\x00")
+}
+
+// batchInsert spools the INSERT from the decorated req to the batch of the user.
+//
+// It returns false if the INSERT cannot be batched,
+// so req must be proxied as is.
+func (rp *reverseProxy) batchInsert(s *scope, srw *statResponseWriter, req *http.Request) bool {
+	ib := s.user.insertBatcher
+	if ib == nil || len(s.sessionId) > 0 || s.operationType != operationWrite {
+		return false
+	}
+	// Unknown and large bodies aren't read in memory.
+	if req.ContentLength < 0 || req.ContentLength > ib.maxBytes || s.streamedBody {
+		return false
+	}
+	q, err := getFullQuery(req)
+	if err != nil {
+		// The error is reported once req is proxied.
+		return false
+	}
+	statement, format, data, ok := parseBatchableInsert(q)
+	if !ok || !ib.isFormatAllowed(format) || int64(len(data)) > ib.maxBytes {
+		return false
+	}
+
+	b, err := ib.add(rp, s, req, statement, data)
+	if err != nil {
+		err = fmt.Errorf("%s: cannot spool INSERT: %w", s, err)
+		respondWith(srw, err, http.StatusInternalServerError)
+		return true
+	}
+	if ib.waitFlush {
+		<-b.done
+		if b.err != nil {
+			err = fmt.Errorf("%s: cannot flush batched INSERT: %w", s, b.err)
+			respondWith(srw, err, http.StatusBadGateway)
+			return true
+		}
+	}
+	log.Debugf("%s: INSERT of %d bytes is batched; query: %q", s, len(data), statement)
+	srw.WriteHeader(http.StatusOK)
+	return true
+}
+
+// add appends data to the batch for statement and returns the batch.
+// The batch is flushed once it reaches maxBytes or maxInterval elapses.
+func (ib *insertBatcher) add(rp *reverseProxy, s *scope, req *http.Request, statement string, data []byte) (*insertBatch, error) {
+	key := insertBatchKey(s, req, statement)
+
+	ib.mu.Lock()
+	b, ok := ib.batches[key]
+	if !ok {
+		var err error
+		b, err = newInsertBatch(ib.spoolDir, s, req, statement)
+		if err != nil {
+			ib.mu.Unlock()
+			return nil, err
+		}
+		ib.batches[key] = b
+		b.timer = time.AfterFunc(ib.maxInterval, func() {
+			// The batch may have been flushed on reaching maxBytes.
+			if ib.take(key, b) {
+				rp.flushInsertBatch(b)
+			}
+		})
+	}
+	b.appending.Add(1)
+	b.reserved += int64(len(data))
+	full := b.reserved >= ib.maxBytes
+	if full {
+		delete(ib.batches, key)
+		b.timer.Stop()
+	}
+	ib.mu.Unlock()
+
+	err := b.append(data)
+	b.appending.Done()
+	if err != nil {
+		// The batch is flushed without the data of the failed INSERT,
+		// since the file may be unusable.
+		if full || ib.take(key, b) {
+			go rp.flushInsertBatch(b)
+		}
+		return nil, err
+	}
+	if full {
+		go rp.flushInsertBatch(b)
+	}
+	return b, nil
+}
+
+// take removes b from pending batches, so it may be flushed.
+// It returns false if b has been already taken.
+func (ib *insertBatcher) take(key string, b *insertBatch) bool {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+	if ib.batches[key] != b {
+		return false
+	}
+	delete(ib.batches, key)
+	b.timer.Stop()
+	return true
+}
+
+// newInsertBatch creates the spool file in spoolDir for the batch of the decorated req.
+// The file stays locked until the batch is flushed.
+func newInsertBatch(spoolDir string, s *scope, req *http.Request, statement string) (*insertBatch, error) {
+	if err := os.MkdirAll(spoolDir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(spoolDir, "*"+insertBatchExt)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockInsertBatchFile(f); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("cannot lock batch file: %w", err)
+	}
+	header, err := json.Marshal(insertBatchHeader{
+		User:      s.user.name,
+		Statement: statement,
+		Params:    req.URL.RawQuery,
+		Database:  req.Header.Get("X-ClickHouse-Database"),
+	})
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	header = append(header, '\n')
+	if _, err := f.Write(header); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	// The body has been already read, so it is dropped from the template.
+	treq := req.Clone(context.Background())
+	treq.Body = nil
+	return &insertBatch{
+		s:          s,
+		req:        treq,
+		statement:  statement,
+		file:       f,
+		dataOffset: int64(len(header)),
+		done:       make(chan struct{}),
+	}, nil
+}
+
+// append spools data to the batch file. Rows of every INSERT
+// end with a newline, so they aren't glued to the next INSERT.
+func (b *insertBatch) append(data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if data[len(data)-1] != '\n' {
+		data = append(data[:len(data):len(data)], '\n')
+	}
+	if _, err := b.file.Write(data); err != nil {
+		// Drop the partially written data.
+		if terr := b.file.Truncate(b.dataOffset + b.size); terr != nil {
+			return fmt.Errorf("%w; cannot truncate batch file: %s", err, terr)
+		}
+		return err
+	}
+	if err := b.file.Sync(); err != nil {
+		return err
+	}
+	b.size += int64(len(data))
+	return nil
+}
+
+// flushInsertBatch sends the data of b to ClickHouse as a single INSERT.
+//
+// The spool file is removed on success. Otherwise, it is kept
+// with insertBatchFailedExt, so the data may be recovered manually.
+// The file is closed, i.e. unlocked, only after that, so the batch
+// cannot be recovered and flushed twice.
+func (rp *reverseProxy) flushInsertBatch(b *insertBatch) {
+	defer close(b.done)
+	b.appending.Wait()
+
+	s := b.s
+	defer func() {
+		if err := b.file.Close(); err != nil {
+			log.Errorf("%s: cannot close batch file %q: %s", s, b.file.Name(), err)
+		}
+	}()
+	if b.size == 0 {
+		os.Remove(b.file.Name())
+		return
+	}
+	insertBatchSize.With(prometheus.Labels{"user": s.user.name}).Observe(float64(b.size))
+	b.err = rp.sendInsertBatch(b)
+	if b.err != nil {
+		insertBatchFlushErrors.With(prometheus.Labels{"user": s.user.name}).Inc()
+		failed := strings.TrimSuffix(b.file.Name(), insertBatchExt) + insertBatchFailedExt
+		log.Errorf("%s: cannot flush batch of %d bytes: %s; query: %q; the data is kept in %q",
+			s, b.size, b.err, b.statement, failed)
+		if err := os.Rename(b.file.Name(), failed); err != nil {
+			log.Errorf("%s: cannot rename batch file %q: %s", s, b.file.Name(), err)
+		}
+		return
+	}
+	log.Debugf("%s: batch of %d bytes is flushed; query: %q", s, b.size, b.statement)
+	if err := os.Remove(b.file.Name()); err != nil {
+		log.Errorf("%s: cannot remove batch file %q: %s", s, b.file.Name(), err)
+	}
+}
+
+// sendInsertBatch proxies the INSERT with the data of b
+// in background the same way cache entries are refreshed.
+func (rp *reverseProxy) sendInsertBatch(b *insertBatch) error {
+	// The flush is accounted by its own scope like any other request
+	// of the user. The data has been already acknowledged to clients,
+	// so the flush isn't rejected by the user limits.
+	s := newScope(b.req, b.s.user, b.s.cluster, b.s.clusterUser, "", 0, b.s.hashKey)
+	s.operationType = operationWrite
+
+	req := b.req.Clone(context.Background())
+	req.RequestURI = ""
+	req.Body = io.NopCloser(io.NewSectionReader(b.file, b.dataOffset, b.size))
+	req.ContentLength = b.size
+	// The data is spooled uncompressed.
+	req.Header.Del("Content-Encoding")
+	req.URL.Scheme = s.host.Scheme()
+	req.URL.Host = s.host.Host()
+	req.Host = s.host.Host()
+	params := req.URL.Query()
+	params.Del("decompress")
+	params.Set("query", b.statement)
+	params.Set("query_id", s.id.String())
+	req.URL.RawQuery = params.Encode()
+	req.SetBasicAuth(s.clusterUser.name, s.clusterUser.password)
+
+	s.incUnlimited()
+	defer s.dec()
+
+	rw := &insertBatchResponseWriter{
+		backgroundResponseWriter: backgroundResponseWriter{header: make(http.Header)},
+	}
+	srw := &statResponseWriter{
+		ResponseWriter: rw,
+		bytesWritten:   responseBodyBytes.With(s.operationLabels()),
+	}
+	rp.proxyRequest(s, srw, srw, req)
+	if statusCode := srw.StatusCode(); statusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d: %s", statusCode, bytes.TrimSpace(rw.body.Bytes()))
+	}
+	return nil
+}
+
+// insertBatchResponseWriter keeps the beginning of the response
+// to the flushed INSERT, so the ClickHouse error may be reported.
+type insertBatchResponseWriter struct {
+	backgroundResponseWriter
+	body bytes.Buffer
+}
+
+func (rw *insertBatchResponseWriter) Write(b []byte) (int, error) {
+	if n := maxInsertBatchErrorSize - rw.body.Len(); n > 0 {
+		rw.body.Write(b[:min(n, len(b))])
+	}
+	return len(b), nil
+}
+
+// preserveInsertBatchers moves batchers of users with unchanged
+// `insert_batching` from the previous config, so pending batches
+// keep growing after config reload. Batches of replaced batchers
+// are flushed on their own.
+func preserveInsertBatchers(users, oldUsers map[string]*user) {
+	for name, u := range users {
+		old, ok := oldUsers[name]
+		if !ok || u.insertBatcher == nil || old.insertBatcher == nil {
+			continue
+		}
+		if reflect.DeepEqual(u.insertBatcher.cfg, old.insertBatcher.cfg) {
+			u.insertBatcher = old.insertBatcher
+		}
+	}
+}
+
+// recoverInsertBatches flushes batches spooled before the restart
+// in background. Batches of unknown users are kept in place.
+// Live batches of other chproxy instances sharing the spool dir are skipped.
+func (rp *reverseProxy) recoverInsertBatches() {
+	for _, dir := range rp.insertBatchSpoolDirs() {
+		files, err := filepath.Glob(filepath.Join(dir, "*"+insertBatchExt))
+		if err != nil {
+			log.Errorf("cannot list spooled batches in %q: %s", dir, err)
+			continue
+		}
+		for _, filename := range files {
+			b, err := rp.loadInsertBatch(filename)
+			if err != nil {
+				log.Errorf("cannot recover spooled batch %q: %s", filename, err)
+				continue
+			}
+			if b == nil {
+				log.Debugf("skipping live batch %q", filename)
+				continue
+			}
+			log.Infof("flushing batch %q of %d bytes spooled before restart", filename, b.size)
+			go rp.flushInsertBatch(b)
+		}
+	}
+}
+
+// insertBatchSpoolDirs returns spool dirs of all the users,
+// the default one included.
+func (rp *reverseProxy) insertBatchSpoolDirs() []string {
+	dirs := []string{defaultInsertBatchSpoolDir}
+	for _, u := range rp.snapshot.Load().users {
+		if u.insertBatcher != nil && !slices.Contains(dirs, u.insertBatcher.spoolDir) {
+			dirs = append(dirs, u.insertBatcher.spoolDir)
+		}
+	}
+	return dirs
+}
+
+// loadInsertBatch opens the batch spooled to filename.
+// It returns nil batch if the batch is live.
+func (rp *reverseProxy) loadInsertBatch(filename string) (*insertBatch, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := tryLockInsertBatchFile(f)
+	if err == nil && ok {
+		// The batch may have been flushed and removed by its owner
+		// in the meantime.
+		ok, err = isSameFile(f, filename)
+	}
+	if err != nil || !ok {
+		f.Close()
+		return nil, err
+	}
+	b, err := rp.newSpooledInsertBatch(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// isSameFile returns true if filename still refers to the opened f.
+func isSameFile(f *os.File, filename string) (bool, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	fi2, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(fi, fi2), nil
+}
+
+func (rp *reverseProxy) newSpooledInsertBatch(f *os.File) (*insertBatch, error) {
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("cannot read header: %w", err)
+	}
+	var h insertBatchHeader
+	if err := json.Unmarshal(line, &h); err != nil {
+		return nil, fmt.Errorf("cannot parse header: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := rp.snapshot.Load()
+	u, ok := snapshot.users[h.User]
+	if !ok {
+		return nil, fmt.Errorf("unknown user %q", h.User)
+	}
+	c, ok := snapshot.clusters[u.toCluster]
+	if !ok {
+		return nil, fmt.Errorf("unknown cluster %q of user %q", u.toCluster, h.User)
+	}
+	cu, ok := c.users[u.toUser]
+	if !ok {
+		return nil, fmt.Errorf("unknown cluster user %q of user %q", u.toUser, h.User)
+	}
+	req, err := http.NewRequest(http.MethodPost, "/?"+h.Params, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse params: %w", err)
+	}
+	if len(h.Database) > 0 {
+		req.Header.Set("X-ClickHouse-Database", h.Database)
+	}
+	return &insertBatch{
+		s:          newScope(req, u, c, cu, "", 0, ""),
+		req:        req,
+		statement:  h.Statement,
+		file:       f,
+		dataOffset: int64(len(line)),
+		size:       fi.Size() - int64(len(line)),
+		done:       make(chan struct{}),
+	}, nil
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// Spool files aren't locked on platforms without flock,
+// so the spool dir mustn't be shared by chproxy instances there.
+func lockInsertBatchFile(*os.File) error { return nil }
+
+func tryLockInsertBatchFile(*os.File) (bool, error) { return true, nil }
@@ -0,0 +1,27 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockInsertBatchFile takes the exclusive lock on the spool file of the live batch,
+// so the batch isn't recovered by other chproxy instances sharing the spool dir.
+// The lock is released once f is closed.
+func lockInsertBatchFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
+
+// tryLockInsertBatchFile takes the exclusive lock on the spool file
+// of the recovered batch. It returns false if the batch is live,
+// i.e. its file is locked by another batcher.
+func tryLockInsertBatchFile(f *os.File) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+	return err == nil, err
+}
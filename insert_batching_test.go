@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/contentsquare/chproxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBatchableInsert(t *testing.T) {
+	testCases := []struct {
+		q         string
+		statement string
+		format    string
+		data      string
+	}{
+		{
+			q:         "INSERT INTO t FORMAT TSV\n1\tfoo\n",
+			statement: "INSERT INTO t FORMAT TSV",
+			format:    "TSV",
+			data:      "1\tfoo\n",
+		},
+		{
+			q:         "/* comment */ insert into db.t (a, b)\nformat JSONEachRow {\"a\":1}",
+			statement: "insert into db.t (a, b)\nformat JSONEachRow",
+			format:    "JSONEachRow",
+			data:      "{\"a\":1}",
+		},
+		{
+			q:         "INSERT INTO t FORMAT CSV \r\n1,2",
+			statement: "INSERT INTO t FORMAT CSV",
+			format:    "CSV",
+			data:      "1,2",
+		},
+		{q: "SELECT 1 FORMAT TSV"},
+		{q: "INSERT INTO t FORMAT TSV"},
+		{q: "INSERT INTO t VALUES (1)"},
+		{q: "INSERT INTO t SELECT * FROM t2 FORMAT TSV\n1"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.q, func(t *testing.T) {
+			statement, format, data, ok := parseBatchableInsert([]byte(tc.q))
+			assert.Equal(t, len(tc.statement) > 0, ok)
+			assert.Equal(t, tc.statement, statement)
+			assert.Equal(t, tc.format, format)
+			assert.Equal(t, tc.data, string(data))
+		})
+	}
+}
+
+// insertRecorder is the fake ClickHouse node recording INSERTs.
+// INSERTs into the `broken` table fail.
+type insertRecorder struct {
+	mu      sync.Mutex
+	inserts []string
+	// databases holds X-ClickHouse-Database headers of inserts.
+	databases []string
+}
+
+func (ir *insertRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	query := r.URL.Query().Get("query")
+	if len(query) == 0 {
+		query, body = string(body), nil
+	}
+	if !strings.HasPrefix(query, "INSERT") {
+		fmt.Fprintln(w, "Ok.")
+		return
+	}
+	if strings.Contains(query, "broken") {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Code: 60. DB::Exception: Table default.broken doesn't exist")
+		return
+	}
+	ir.mu.Lock()
+	if len(body) > 0 {
+		query += "\n" + string(body)
+	}
+	ir.inserts = append(ir.inserts, query)
+	ir.databases = append(ir.databases, r.Header.Get("X-ClickHouse-Database"))
+	ir.mu.Unlock()
+}
+
+func (ir *insertRecorder) get() []string {
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+	return append([]string(nil), ir.inserts...)
+}
+
+func (ir *insertRecorder) getDatabases() []string {
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+	return append([]string(nil), ir.databases...)
+}
+
+func newInsertBatchingProxy(t *testing.T, ib *config.InsertBatching) (*reverseProxy, *insertRecorder) {
+	t.Helper()
+	defaultInsertBatchSpoolDir = t.TempDir()
+
+	ir := &insertRecorder{}
+	srv := httptest.NewServer(ir)
+	t.Cleanup(srv.Close)
+	addr, err := url.Parse(srv.URL)
+	checkErr(t, err)
+	proxy, err := newConfiguredProxy(&config.Config{
+		Clusters: []config.Cluster{
+			{
+				Name:         "cluster",
+				Scheme:       "http",
+				Nodes:        []string{addr.Host},
+				ClusterUsers: []config.ClusterUser{{Name: "web"}},
+			},
+		},
+		Users: []config.User{
+			{
+				Name:           defaultUsername,
+				ToCluster:      "cluster",
+				ToUser:         "web",
+				InsertBatching: ib,
+			},
+		},
+	})
+	checkErr(t, err)
+	stopProxy(t, proxy)
+	return proxy, ir
+}
+
+func makeInsert(proxy *reverseProxy, q string) *http.Response {
+	req := httptest.NewRequest(http.MethodPost, "http://localhost:9090/", strings.NewReader(q))
+	return makeCustomRequest(proxy, req)
+}
+
+// makeInsertWithData sends the INSERT statement in the query param and data in the body.
+func makeInsertWithData(proxy *reverseProxy, statement, data string) *http.Response {
+	req := httptest.NewRequest(http.MethodPost, "http://localhost:9090/?query="+url.QueryEscape(statement), strings.NewReader(data))
+	return makeCustomRequest(proxy, req)
+}
+
+func TestReverseProxy_InsertBatching(t *testing.T) {
+	proxy, ir := newInsertBatchingProxy(t, &config.InsertBatching{
+		MaxInterval: config.Duration(100 * time.Millisecond),
+	})
+
+	resp := makeInsert(proxy, "INSERT INTO t FORMAT TSV\n1\tfoo")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, bbToString(t, resp.Body))
+	resp = makeInsert(proxy, "INSERT INTO t FORMAT TSV\n2\tbar\n")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, bbToString(t, resp.Body))
+	assert.Empty(t, ir.get(), "INSERTs must be spooled until the interval elapses")
+
+	files, err := filepath.Glob(filepath.Join(defaultInsertBatchSpoolDir, "*"+insertBatchExt))
+	checkErr(t, err)
+	assert.Len(t, files, 1)
+
+	assert.Eventually(t, func() bool {
+		return len(ir.get()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"INSERT INTO t FORMAT TSV\n1\tfoo\n2\tbar\n"}, ir.get())
+	assert.Eventually(t, func() bool {
+		files, err := os.ReadDir(defaultInsertBatchSpoolDir)
+		return err == nil && len(files) == 0
+	}, 5*time.Second, 10*time.Millisecond, "the flushed batch must be removed")
+
+	// INSERTs in other formats are proxied as is.
+	resp = makeInsert(proxy, "INSERT INTO t FORMAT Native\nfoo")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, bbToString(t, resp.Body))
+	assert.Len(t, ir.get(), 2)
+}
+
+func TestReverseProxy_InsertBatchingMaxBytes(t *testing.T) {
+	proxy, ir := newInsertBatchingProxy(t, &config.InsertBatching{
+		MaxBytes:    10,
+		MaxInterval: config.Duration(time.Hour),
+	})
+
+	resp := makeInsertWithData(proxy, "INSERT INTO t FORMAT CSV", "1,foo")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, bbToString(t, resp.Body))
+	resp = makeInsertWithData(proxy, "INSERT INTO t FORMAT CSV", "2,bar")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, bbToString(t, resp.Body))
+
+	assert.Eventually(t, func() bool {
+		return len(ir.get()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"INSERT INTO t FORMAT CSV\n1,foo\n2,bar\n"}, ir.get())
+}
+
+func TestReverseProxy_InsertBatchingAckFlushed(t *testing.T) {
+	proxy, ir := newInsertBatchingProxy(t, &config.InsertBatching{
+		MaxInterval: config.Duration(10 * time.Millisecond),
+		Ack:         "flushed",
+	})
+
+	resp := makeInsert(proxy, "INSERT INTO t FORMAT JSONEachRow\n{\"a\":1}")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, bbToString(t, resp.Body))
+	assert.Equal(t, []string{"INSERT INTO t FORMAT JSONEachRow\n{\"a\":1}\n"}, ir.get())
+
+	resp = makeInsert(proxy, "INSERT INTO broken FORMAT JSONEachRow\n{\"a\":1}")
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Contains(t, bbToString(t, resp.Body), "Table default.broken doesn't exist")
+
+	files, err := filepath.Glob(filepath.Join(defaultInsertBatchSpoolDir, "*"+insertBatchFailedExt))
+	checkErr(t, err)
+	if assert.Len(t, files, 1, "the failed batch must be kept") {
+		data, err := os.ReadFile(files[0])
+		checkErr(t, err)
+		assert.True(t, strings.HasSuffix(string(data), "\n{\"a\":1}\n"), string(data))
+	}
+}
+
+func TestReverseProxy_RecoverInsertBatches(t *testing.T) {
+	proxy, ir := newInsertBatchingProxy(t, &config.InsertBatching{})
+
+	spooled := `{"user":"default","statement":"INSERT INTO t FORMAT TSV","params":"database=db"}` + "\n1\n2\n"
+	filename := filepath.Join(defaultInsertBatchSpoolDir, "1"+insertBatchExt)
+	checkErr(t, os.WriteFile(filename, []byte(spooled), 0600))
+	unknown := filepath.Join(defaultInsertBatchSpoolDir, "2"+insertBatchExt)
+	checkErr(t, os.WriteFile(unknown, []byte(`{"user":"unknown"}`+"\n1\n"), 0600))
+
+	proxy.recoverInsertBatches()
+	assert.Eventually(t, func() bool {
+		return len(ir.get()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"INSERT INTO t FORMAT TSV\n1\n2\n"}, ir.get())
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(filename)
+		return os.IsNotExist(err)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, err := os.Stat(unknown)
+	assert.NoError(t, err, "batches of unknown users must be kept")
+}
+
+func TestReverseProxy_RecoverInsertBatchesDatabase(t *testing.T) {
+	spoolDir := t.TempDir()
+	proxy, ir := newInsertBatchingProxy(t, &config.InsertBatching{
+		MaxInterval: config.Duration(time.Hour),
+		SpoolDir:    spoolDir,
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost:9090/", strings.NewReader("INSERT INTO t FORMAT TSV\n1"))
+	req.Header.Set("X-ClickHouse-Database", "db")
+	resp := makeCustomRequest(proxy, req)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, bbToString(t, resp.Body))
+	files, err := filepath.Glob(filepath.Join(spoolDir, "*"+insertBatchExt))
+	checkErr(t, err)
+	if !assert.Len(t, files, 1) {
+		return
+	}
+
+	// The spooled batch is flushed into the database it was sent to after restart.
+	data, err := os.ReadFile(files[0])
+	checkErr(t, err)
+	recovered := filepath.Join(defaultInsertBatchSpoolDir, "1"+insertBatchExt)
+	checkErr(t, os.WriteFile(recovered, data, 0600))
+	proxy.recoverInsertBatches()
+	assert.Eventually(t, func() bool {
+		return len(ir.get()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"INSERT INTO t FORMAT TSV\n1\n"}, ir.get())
+	assert.Equal(t, []string{"db"}, ir.getDatabases())
+}
+
+func TestReverseProxy_InsertBatchingConcurrent(t *testing.T) {
+	proxy, ir := newInsertBatchingProxy(t, &config.InsertBatching{
+		MaxBytes:    64,
+		MaxInterval: config.Duration(100 * time.Millisecond),
+	})
+
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp := makeInsertWithData(proxy, "INSERT INTO t FORMAT CSV", fmt.Sprintf("%d,foo", i))
+			assert.Equal(t, http.StatusOK, resp.StatusCode, bbToString(t, resp.Body))
+		}(i)
+	}
+	wg.Wait()
+
+	// Every row is flushed exactly once.
+	rows := func() []string {
+		var rows []string
+		for _, insert := range ir.get() {
+			rows = append(rows, strings.Fields(strings.TrimPrefix(insert, "INSERT INTO t FORMAT CSV"))...)
+		}
+		return rows
+	}
+	assert.Eventually(t, func() bool {
+		return len(rows()) == n
+	}, 5*time.Second, 10*time.Millisecond)
+	expected := make([]string, n)
+	for i := range expected {
+		expected[i] = fmt.Sprintf("%d,foo", i)
+	}
+	assert.ElementsMatch(t, expected, rows())
+}
+
+func TestReverseProxy_RecoverInsertBatchesSkipsLive(t *testing.T) {
+	spoolDir := t.TempDir()
+	proxy, ir := newInsertBatchingProxy(t, &config.InsertBatching{
+		MaxInterval: config.Duration(time.Hour),
+		SpoolDir:    spoolDir,
+	})
+
+	resp := makeInsert(proxy, "INSERT INTO t FORMAT TSV\n1")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, bbToString(t, resp.Body))
+	files, err := filepath.Glob(filepath.Join(spoolDir, "*"+insertBatchExt))
+	checkErr(t, err)
+	assert.Len(t, files, 1, "the batch must be spooled to spool_dir")
+
+	// The batch is live, so it must not be flushed by recovery,
+	// e.g. by another instance sharing the spool dir.
+	proxy.recoverInsertBatches()
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, ir.get())
+	_, err = os.Stat(files[0])
+	assert.NoError(t, err, "the live batch must be kept")
+}
+
+func TestReverseProxy_InsertBatchingIgnoresLimits(t *testing.T) {
+	proxy, ir := newInsertBatchingProxy(t, &config.InsertBatching{
+		MaxInterval: config.Duration(200 * time.Millisecond),
+	})
+	u := proxy.snapshot.Load().users[defaultUsername]
+	u.maxConcurrentQueries = 1
+
+	resp := makeInsert(proxy, "INSERT INTO t FORMAT TSV\n1")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, bbToString(t, resp.Body))
+	// The limit is exhausted by another query until the batch is flushed.
+	u.queryCounter.inc()
+	defer u.queryCounter.dec()
+	assert.Eventually(t, func() bool {
+		return len(ir.get()) == 1
+	}, 5*time.Second, 10*time.Millisecond, "acknowledged data must be flushed regardless of the user limits")
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/contentsquare/chproxy/config"
@@ -20,6 +22,7 @@ type HeartBeat interface {
 type heartBeatOpts struct {
 	defaultUser     string
 	defaultPassword string
+	transport       http.RoundTripper
 }
 
 type Option interface {
@@ -43,15 +46,37 @@ func WithDefaultUser(user, password string) Option {
 	}
 }
 
+// WithTransport sets the transport used for sending heartbeat requests.
+// http.DefaultTransport is used by default.
+func WithTransport(transport http.RoundTripper) Option {
+	return transportOption{transport: transport}
+}
+
+type transportOption struct {
+	transport http.RoundTripper
+}
+
+func (o transportOption) apply(opts *heartBeatOpts) {
+	opts.transport = o.transport
+}
+
 type heartBeat struct {
+	client   *http.Client
 	interval time.Duration
 	timeout  time.Duration
 	request  string
 	response string
-	user     string
-	password string
+	match    string
+	// responseRegexp is set if responses are matched by regex
+	responseRegexp *regexp.Regexp
+	user           string
+	password       string
 }
 
+// maxResponseSnippetSize is the maximum size of unexpected responses
+// included in errors.
+const maxResponseSnippetSize = 256
+
 // User credentials are not needed
 const defaultEndpoint string = "/ping"
 
@@ -62,10 +87,16 @@ func NewHeartbeat(c config.HeartBeat, options ...Option) HeartBeat {
 	}
 
 	newHB := &heartBeat{
+		client:   &http.Client{Transport: opts.transport},
 		interval: time.Duration(c.Interval),
 		timeout:  time.Duration(c.Timeout),
 		request:  c.Request,
 		response: c.Response,
+		match:    c.Match,
+	}
+	if newHB.match == config.HeartBeatMatchRegex {
+		// The regexp is validated while parsing the config.
+		newHB.responseRegexp = regexp.MustCompile(c.Response)
 	}
 
 	if c.Request != defaultEndpoint {
@@ -98,26 +129,45 @@ func (hb *heartBeat) IsHealthy(ctx context.Context, addr string) error {
 	req = req.WithContext(ctx)
 
 	startTime := time.Now()
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := hb.client.Do(req)
 	if err != nil {
 		return fmt.Errorf("cannot send request in %s: %w", time.Since(startTime), err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("non-200 status code: %s", resp.Status)
-	}
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return fmt.Errorf("cannot read response in %s: %w", time.Since(startTime), err)
 	}
 	r := string(body)
-	if r != hb.response {
-		return fmt.Errorf("%w: %s", errUnexpectedResponse, r)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("non-200 status code: %s; response: %q", resp.Status, responseSnippet(r))
+	}
+	if !hb.matches(r) {
+		return fmt.Errorf("%w: %q", errUnexpectedResponse, responseSnippet(r))
 	}
 	return nil
 }
 
+// matches reports whether the response matches the reference one.
+func (hb *heartBeat) matches(r string) bool {
+	switch hb.match {
+	case config.HeartBeatMatchContains:
+		return strings.Contains(r, hb.response)
+	case config.HeartBeatMatchRegex:
+		return hb.responseRegexp.MatchString(r)
+	default:
+		return r == hb.response
+	}
+}
+
+func responseSnippet(r string) string {
+	if len(r) > maxResponseSnippetSize {
+		return r[:maxResponseSnippetSize] + "..."
+	}
+	return r
+}
+
 func (hb *heartBeat) Interval() time.Duration {
 	return hb.interval
 }
@@ -122,3 +122,41 @@ func TestNewHeartBeat(t *testing.T) {
 		})
 	}
 }
+
+func TestHeartBeatMatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "Ok. replica lag: 3")
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		match    string
+		response string
+		healthy  bool
+	}{
+		{"", "Ok. replica lag: 3\n", true},
+		{"", "Ok.\n", false},
+		{config.HeartBeatMatchExact, "Ok. replica lag: 3\n", true},
+		{config.HeartBeatMatchExact, "Ok.", false},
+		{config.HeartBeatMatchContains, "Ok.", true},
+		{config.HeartBeatMatchContains, "Fail.", false},
+		{config.HeartBeatMatchRegex, `lag: [0-5]\n$`, true},
+		{config.HeartBeatMatchRegex, `lag: [0-2]\n$`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %q", tt.match, tt.response), func(t *testing.T) {
+			cfg := heartBeatDefaultCfg
+			cfg.Match = tt.match
+			cfg.Response = tt.response
+			hb := NewHeartbeat(cfg)
+			err := hb.IsHealthy(context.TODO(), srv.URL)
+			if tt.healthy {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, errUnexpectedResponse)
+			assert.ErrorContains(t, err, `"Ok. replica lag: 3\n"`)
+		})
+	}
+}
@@ -7,8 +7,10 @@ import (
 )
 
 var (
-	HostHealth    *prometheus.GaugeVec
-	HostPenalties *prometheus.CounterVec
+	HostHealth      *prometheus.GaugeVec
+	HostPenalties   *prometheus.CounterVec
+	HostPenalty     *prometheus.GaugeVec
+	NodeHealthScore *prometheus.GaugeVec
 )
 
 func initMetrics(cfg *config.Config) {
@@ -29,11 +31,27 @@ func initMetrics(cfg *config.Config) {
 		},
 		[]string{"cluster", "replica", "cluster_node"},
 	)
+	HostPenalty = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "host_penalty",
+			Help:      "Current penalty added to the load of hosts until it decays",
+		},
+		[]string{"cluster", "replica", "cluster_node"},
+	)
+	NodeHealthScore = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "node_health_score",
+			Help:      "Health score of hosts computed by heartbeats. The lower the healthier",
+		},
+		[]string{"cluster", "replica", "cluster_node"},
+	)
 }
 
 func RegisterMetrics(cfg *config.Config) {
 	initMetrics(cfg)
-	prometheus.MustRegister(HostHealth, HostPenalties)
+	prometheus.MustRegister(HostHealth, HostPenalties, HostPenalty, NodeHealthScore)
 }
 
 func reportNodeHealthMetric(clusterName, replicaName, nodeName string, active bool) {
@@ -59,3 +77,35 @@ func incrementPenaltiesMetric(clusterName, replicaName, nodeName string) {
 
 	HostPenalties.With(label).Inc()
 }
+
+func reportNodePenaltyMetric(clusterName, replicaName, nodeName string, penalty uint32) {
+	label := prometheus.Labels{
+		"cluster":      clusterName,
+		"replica":      replicaName,
+		"cluster_node": nodeName,
+	}
+
+	HostPenalty.With(label).Set(float64(penalty))
+}
+
+func reportNodeHealthScoreMetric(clusterName, replicaName, nodeName string, score float64) {
+	label := prometheus.Labels{
+		"cluster":      clusterName,
+		"replica":      replicaName,
+		"cluster_node": nodeName,
+	}
+
+	NodeHealthScore.With(label).Set(score)
+}
+
+func deleteNodeMetrics(clusterName, replicaName, nodeName string) {
+	label := prometheus.Labels{
+		"cluster":      clusterName,
+		"replica":      replicaName,
+		"cluster_node": nodeName,
+	}
+
+	HostHealth.Delete(label)
+	HostPenalty.Delete(label)
+	NodeHealthScore.Delete(label)
+}
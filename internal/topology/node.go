@@ -2,7 +2,9 @@ package topology
 
 import (
 	"context"
+	"math"
 	"net/url"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -19,10 +21,13 @@ const (
 )
 
 type nodeOpts struct {
-	defaultActive   bool
-	penaltySize     uint32
-	penaltyMaxSize  uint32
-	penaltyDuration time.Duration
+	defaultActive     bool
+	penaltySize       uint32
+	penaltyMaxSize    uint32
+	penaltyDuration   time.Duration
+	maxHealthyLatency time.Duration
+	heartbeatSem      chan struct{}
+	weight            uint32
 }
 
 func defaultNodeOpts() nodeOpts {
@@ -30,6 +35,7 @@ func defaultNodeOpts() nodeOpts {
 		penaltySize:     DefaultPenaltySize,
 		penaltyMaxSize:  DefaultMaxSize,
 		penaltyDuration: DefaultPenaltyDuration,
+		weight:          1,
 	}
 }
 
@@ -51,19 +57,116 @@ func WithDefaultActiveState(active bool) NodeOption {
 	}
 }
 
+type maxHealthyLatency struct {
+	latency time.Duration
+}
+
+func (o maxHealthyLatency) apply(opts *nodeOpts) {
+	opts.maxHealthyLatency = o.latency
+}
+
+// WithMaxHealthyLatency sets the heartbeat latency the health score
+// of the node is normalised over. The latency doesn't affect
+// the health score if it is zero.
+func WithMaxHealthyLatency(latency time.Duration) NodeOption {
+	return maxHealthyLatency{
+		latency: latency,
+	}
+}
+
+type heartbeatSemaphore struct {
+	sem chan struct{}
+}
+
+func (o heartbeatSemaphore) apply(opts *nodeOpts) {
+	opts.heartbeatSem = o.sem
+}
+
+// WithHeartbeatSemaphore limits the number of simultaneous heartbeats
+// of the nodes sharing sem by its capacity.
+// Heartbeats aren't limited if sem is nil.
+func WithHeartbeatSemaphore(sem chan struct{}) NodeOption {
+	return heartbeatSemaphore{
+		sem: sem,
+	}
+}
+
+type penalty struct {
+	size     uint32
+	duration time.Duration
+}
+
+func (o penalty) apply(opts *nodeOpts) {
+	if o.size > 0 {
+		opts.penaltySize = o.size
+	}
+	if o.duration > 0 {
+		opts.penaltyDuration = o.duration
+	}
+}
+
+// WithPenalty sets the load added to the node by every penalty and
+// the duration the penalty is removed after. Zero values keep
+// DefaultPenaltySize and DefaultPenaltyDuration.
+func WithPenalty(size uint32, duration time.Duration) NodeOption {
+	return penalty{
+		size:     size,
+		duration: duration,
+	}
+}
+
+type weight struct {
+	weight uint32
+}
+
+func (o weight) apply(opts *nodeOpts) {
+	if o.weight > 0 {
+		opts.weight = o.weight
+	}
+}
+
+// WithWeight sets the weight of the node. Nodes with higher weights
+// receive proportionally more queries. The weight is 1 if it is zero.
+func WithWeight(w uint32) NodeOption {
+	return weight{
+		weight: w,
+	}
+}
+
 type Node struct {
-	// Node Address.
-	addr *url.URL
+	// Node Address. It is replaced on scheme changes.
+	addr atomic.Pointer[url.URL]
 
 	// Whether this node is alive.
 	active atomic.Bool
 
+	// Whether active has been set by the heartbeat or explicitly.
+	// Nodes are inactive until their first heartbeat completes.
+	stateKnown atomic.Bool
+
 	// Counter of currently running connections.
 	connections counter.Counter
 
 	// Counter of unsuccesfull request to decrease host priority.
 	penalty atomic.Uint32
 
+	// penaltyMetricLock orders updates of the penalty metric,
+	// so it isn't overwritten by stale values of concurrent decays.
+	// It also guards retiring the node, so the metric
+	// isn't reported once it is deleted for the retired node.
+	penaltyMetricLock sync.Mutex
+
+	// Bits of the float64 health score updated by the heartbeat.
+	healthScore atomic.Uint64
+
+	// Number of recent heartbeat failures.
+	// It is decremented on every successful heartbeat.
+	failures atomic.Uint32
+
+	// Whether the node has been removed from its replica.
+	// Retired nodes are inactive and aren't health-checked.
+	retired atomic.Bool
+
 	// Heartbeat function
 	hb heartbeat.HeartBeat
 
@@ -84,12 +187,13 @@ func NewNode(addr *url.URL, hb heartbeat.HeartBeat, clusterName, replicaName str
 	}
 
 	n := &Node{
-		addr:        addr,
 		hb:          hb,
 		clusterName: clusterName,
 		replicaName: replicaName,
 		opts:        nodeOpts,
 	}
+	n.addr.Store(addr)
+	n.healthScore.Store(math.Float64bits(1))
 
 	if n.opts.defaultActive {
 		n.SetIsActive(true)
@@ -99,38 +203,113 @@ func NewNode(addr *url.URL, hb heartbeat.HeartBeat, clusterName, replicaName str
 }
 
 func (n *Node) IsActive() bool {
-	return n.active.Load()
+	return n.active.Load() && !n.retired.Load()
+}
+
+// Retire marks the node as removed from its replica.
+// The node becomes inactive and its heartbeat stops.
+func (n *Node) Retire() {
+	n.penaltyMetricLock.Lock()
+	defer n.penaltyMetricLock.Unlock()
+	n.retired.Store(true)
+}
+
+func (n *Node) IsRetired() bool {
+	return n.retired.Load()
 }
 
 func (n *Node) SetIsActive(active bool) {
 	n.active.Store(active)
+	n.stateKnown.Store(true)
+}
+
+// IsStateKnown returns true if the node state has been determined
+// by the heartbeat or set explicitly, so inactive nodes are really down
+// instead of waiting for their first heartbeat.
+func (n *Node) IsStateKnown() bool {
+	return n.stateKnown.Load()
 }
 
 // StartHeartbeat runs the heartbeat healthcheck against the node
-// until the done channel is closed.
+// until the done channel is closed or the node is retired.
 // If the heartbeat fails, the active status of the node is changed.
 func (n *Node) StartHeartbeat(done <-chan struct{}) {
 	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	for {
+		if n.retired.Load() {
+			deleteNodeMetrics(n.clusterName, n.replicaName, n.Host())
+			return
+		}
+		if !n.acquireHeartbeat(done) {
+			return
+		}
 		n.heartbeat(ctx)
+		n.releaseHeartbeat()
 		select {
 		case <-done:
-			cancel()
 			return
 		case <-time.After(n.hb.Interval()):
 		}
 	}
 }
 
+// acquireHeartbeat waits for a free slot of the heartbeat semaphore.
+// It returns false if the done channel is closed while waiting.
+func (n *Node) acquireHeartbeat(done <-chan struct{}) bool {
+	if n.opts.heartbeatSem == nil {
+		return true
+	}
+	select {
+	case n.opts.heartbeatSem <- struct{}{}:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+func (n *Node) releaseHeartbeat() {
+	if n.opts.heartbeatSem != nil {
+		<-n.opts.heartbeatSem
+	}
+}
+
 func (n *Node) heartbeat(ctx context.Context) {
-	if err := n.hb.IsHealthy(ctx, n.addr.String()); err == nil {
+	startTime := time.Now()
+	defer n.stateKnown.Store(true)
+	if err := n.hb.IsHealthy(ctx, n.String()); err == nil {
 		n.active.Store(true)
 		reportNodeHealthMetric(n.clusterName, n.replicaName, n.Host(), true)
+		if f := n.failures.Load(); f > 0 {
+			n.failures.Store(f - 1)
+		}
 	} else {
 		log.Errorf("error while health-checking %q host: %s", n.Host(), err)
 		n.active.Store(false)
 		reportNodeHealthMetric(n.clusterName, n.replicaName, n.Host(), false)
+		n.failures.Add(1)
+	}
+	n.updateHealthScore(time.Since(startTime))
+}
+
+// updateHealthScore computes the health score of the node
+// from the latency of the last heartbeat and the number of recent failures.
+//
+// The score is 1 for healthy nodes. It grows by the heartbeat latency
+// normalised over maxHealthyLatency and by the number of recent failures.
+func (n *Node) updateHealthScore(latency time.Duration) {
+	score := 1 + float64(n.failures.Load())
+	if n.opts.maxHealthyLatency > 0 {
+		score += float64(latency) / float64(n.opts.maxHealthyLatency)
 	}
+	n.healthScore.Store(math.Float64bits(score))
+	reportNodeHealthScoreMetric(n.clusterName, n.replicaName, n.Host(), score)
+}
+
+// HealthScore returns the health score of the node.
+// The lower the score the healthier the node. Healthy nodes have score 1.
+func (n *Node) HealthScore() float64 {
+	return math.Float64frombits(n.healthScore.Load())
 }
 
 // Penalize a node if a request failed to decrease it's priority.
@@ -147,12 +326,25 @@ func (n *Node) Penalize() {
 	incrementPenaltiesMetric(n.clusterName, n.replicaName, n.Host())
 
 	n.penalty.Add(n.opts.penaltySize)
+	n.reportPenalty()
 
 	time.AfterFunc(n.opts.penaltyDuration, func() {
 		n.penalty.Add(^uint32(n.opts.penaltySize - 1))
+		n.reportPenalty()
 	})
 }
 
+// reportPenalty updates the penalty metric unless the node is retired,
+// since metrics of retired nodes are deleted.
+func (n *Node) reportPenalty() {
+	n.penaltyMetricLock.Lock()
+	defer n.penaltyMetricLock.Unlock()
+	if n.retired.Load() {
+		return
+	}
+	reportNodePenaltyMetric(n.clusterName, n.replicaName, n.Host(), n.penalty.Load())
+}
+
 // CurrentLoad returns the current node returns the number of open connections
 // plus the penalty.
 func (n *Node) CurrentLoad() uint32 {
@@ -161,6 +353,17 @@ func (n *Node) CurrentLoad() uint32 {
 	return c + p
 }
 
+// WeightedLoad returns the current load of the node weighted by its health score.
+// Idle nodes are weighted too, so the healthiest of them is preferred.
+func (n *Node) WeightedLoad() float64 {
+	return n.HealthScore() * float64(n.CurrentLoad()+1)
+}
+
+// Weight returns the weight of the node. It is at least 1.
+func (n *Node) Weight() uint32 {
+	return n.opts.weight
+}
+
 func (n *Node) CurrentConnections() uint32 {
 	return n.connections.Load()
 }
@@ -178,11 +381,19 @@ func (n *Node) DecrementConnections() {
 }
 
 func (n *Node) Scheme() string {
-	return n.addr.Scheme
+	return n.addr.Load().Scheme
+}
+
+// SetScheme changes the scheme of the node.
+// Queries started after the change are sent with the new scheme.
+func (n *Node) SetScheme(scheme string) {
+	addr := *n.addr.Load()
+	addr.Scheme = scheme
+	n.addr.Store(&addr)
 }
 
 func (n *Node) Host() string {
-	return n.addr.Host
+	return n.addr.Load().Host
 }
 
 func (n *Node) ReplicaName() string {
@@ -190,5 +401,5 @@ func (n *Node) ReplicaName() string {
 }
 
 func (n *Node) String() string {
-	return n.addr.String()
+	return n.addr.Load().String()
 }
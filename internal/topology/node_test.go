@@ -3,11 +3,15 @@ package topology
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/contentsquare/chproxy/internal/heartbeat"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -50,6 +54,42 @@ func TestPenalize(t *testing.T) {
 	assert.Equal(t, expectedLoad, node.CurrentLoad(), "got running queries %d; expected %d", node.CurrentLoad(), expectedLoad)
 }
 
+func TestPenaltyDecay(t *testing.T) {
+	node := NewNode(&url.URL{Host: "127.0.0.1"}, nil, "test", "decay", WithPenalty(7, 20*time.Millisecond))
+	node.IncrementConnections()
+	penalty := HostPenalty.WithLabelValues("test", "decay", "127.0.0.1")
+
+	node.Penalize()
+	node.Penalize()
+	assert.Equal(t, uint32(15), node.CurrentLoad())
+	assert.Equal(t, uint32(14), node.CurrentPenalty())
+	assert.Equal(t, 14.0, testutil.ToFloat64(penalty))
+
+	// The load returns to the running queries once the penalties decay.
+	assert.Eventually(t, func() bool {
+		return node.CurrentLoad() == 1
+	}, time.Second, time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(penalty) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestPenaltyDecayRetired(t *testing.T) {
+	node := NewNode(&url.URL{Host: "127.0.0.1"}, nil, "test", "decay-retired", WithPenalty(7, 20*time.Millisecond))
+	node.Penalize()
+
+	node.Retire()
+	deleteNodeMetrics("test", "decay-retired", "127.0.0.1")
+	series := testutil.CollectAndCount(HostPenalty)
+	node.Penalize()
+	assert.Eventually(t, func() bool {
+		return node.CurrentPenalty() == 0
+	}, time.Second, time.Millisecond)
+
+	// Neither penalties nor their decays may report the metric of the retired node.
+	assert.Equal(t, series, testutil.CollectAndCount(HostPenalty))
+}
+
 func TestStartHeartbeat(t *testing.T) {
 	hb := &mockHeartbeat{
 		interval: 10 * time.Millisecond,
@@ -82,3 +122,137 @@ func TestStartHeartbeat(t *testing.T) {
 		return node.IsActive()
 	}, time.Second, 100*time.Millisecond)
 }
+
+func TestIsStateKnown(t *testing.T) {
+	node := NewNode(&url.URL{Host: "127.0.0.1"}, &mockHeartbeat{err: errors.New("down")}, "test", "test")
+	assert.False(t, node.IsActive())
+	assert.False(t, node.IsStateKnown())
+
+	node.heartbeat(context.Background())
+	assert.False(t, node.IsActive())
+	assert.True(t, node.IsStateKnown())
+
+	node = NewNode(&url.URL{Host: "127.0.0.1"}, nil, "test", "test", WithDefaultActiveState(true))
+	assert.True(t, node.IsStateKnown())
+}
+
+func TestSetScheme(t *testing.T) {
+	addr := &url.URL{Scheme: "http", Host: "127.0.0.1:8123"}
+	node := NewNode(addr, nil, "test", "test", WithDefaultActiveState(true))
+	node.IncrementConnections()
+
+	node.SetScheme("https")
+	assert.Equal(t, "https", node.Scheme())
+	assert.Equal(t, "127.0.0.1:8123", node.Host())
+	assert.Equal(t, "https://127.0.0.1:8123", node.String())
+	assert.Equal(t, "http", addr.Scheme, "the initial address must be kept intact")
+	assert.True(t, node.IsActive())
+	assert.Equal(t, uint32(1), node.CurrentConnections())
+}
+
+func TestRetire(t *testing.T) {
+	hb := &mockHeartbeat{
+		interval: 10 * time.Millisecond,
+	}
+	node := NewNode(&url.URL{Host: "127.0.0.1"}, hb, "test", "test")
+
+	stopped := make(chan struct{})
+	go func() {
+		node.StartHeartbeat(make(chan struct{}))
+		close(stopped)
+	}()
+	assert.Eventually(t, func() bool {
+		return node.IsActive()
+	}, time.Second, 10*time.Millisecond)
+
+	// Retired node is inactive and its heartbeat stops.
+	node.Retire()
+	assert.False(t, node.IsActive())
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("heartbeat of the retired node hasn't stopped")
+	}
+	assert.False(t, node.IsActive())
+}
+
+// concurrentHeartbeat tracks the maximum number of simultaneous health checks.
+type concurrentHeartbeat struct {
+	running    atomic.Int32
+	maxRunning atomic.Int32
+	checks     atomic.Int32
+}
+
+func (hb *concurrentHeartbeat) Interval() time.Duration {
+	return time.Millisecond
+}
+
+func (hb *concurrentHeartbeat) IsHealthy(ctx context.Context, addr string) error {
+	n := hb.running.Add(1)
+	defer hb.running.Add(-1)
+	for {
+		max := hb.maxRunning.Load()
+		if n <= max || hb.maxRunning.CompareAndSwap(max, n) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	hb.checks.Add(1)
+	return nil
+}
+
+func TestHeartbeatSemaphore(t *testing.T) {
+	const nodes = 10
+	hb := &concurrentHeartbeat{}
+	sem := make(chan struct{}, 2)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < nodes; i++ {
+		node := NewNode(&url.URL{Host: fmt.Sprintf("127.0.0.%d", i)}, hb, "test", "test", WithHeartbeatSemaphore(sem))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			node.StartHeartbeat(done)
+		}()
+	}
+	assert.Eventually(t, func() bool {
+		return hb.checks.Load() >= 2*nodes
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Nodes waiting for the semaphore stop once done is closed.
+	close(done)
+	wg.Wait()
+	assert.Equal(t, int32(2), hb.maxRunning.Load())
+	assert.Equal(t, 0, len(sem))
+}
+
+func TestHealthScore(t *testing.T) {
+	hb := &mockHeartbeat{
+		interval: 10 * time.Millisecond,
+		err:      errors.New("failed connection"),
+	}
+	node := NewNode(&url.URL{Host: "127.0.0.1"}, hb, "test", "test", WithMaxHealthyLatency(100*time.Millisecond))
+	assert.Equal(t, 1.0, node.HealthScore())
+
+	// Failures increase the score.
+	node.heartbeat(context.Background())
+	node.heartbeat(context.Background())
+	assert.GreaterOrEqual(t, node.HealthScore(), 3.0)
+
+	// Successful heartbeats decrease it back.
+	hb.err = nil
+	node.heartbeat(context.Background())
+	assert.GreaterOrEqual(t, node.HealthScore(), 2.0)
+	assert.Less(t, node.HealthScore(), 3.0)
+	node.heartbeat(context.Background())
+	assert.Less(t, node.HealthScore(), 2.0)
+
+	// Latency is normalised over maxHealthyLatency.
+	node.updateHealthScore(50 * time.Millisecond)
+	assert.Equal(t, 1.5, node.HealthScore())
+	assert.Equal(t, 1.5, node.WeightedLoad())
+
+	node.IncrementConnections()
+	assert.Equal(t, 3.0, node.WeightedLoad())
+}
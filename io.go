@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -42,16 +43,30 @@ type statResponseWriter struct {
 	wroteHeader bool
 
 	bytesWritten prometheus.Counter
+
+	// written is the amount of bytes written to the original ResponseWriter
+	written int64
+
+	// responseHeaders are set right before the header is written
+	responseHeaders []responseHeader
+
+	// corsOrigin is sent in Access-Control-Allow-Origin instead of
+	// CORS headers of ClickHouse responses if it is set.
+	corsOrigin string
 }
 
 const (
-	XCacheHit  = "HIT"
-	XCacheMiss = "MISS"
-	XCacheNA   = "N/A"
+	XCacheHit   = "HIT"
+	XCacheMiss  = "MISS"
+	XCacheNA    = "N/A"
+	XCacheStale = "STALE"
 )
 
 func RespondWithData(rw http.ResponseWriter, data io.Reader, metadata cache.ContentMetadata, ttl time.Duration, cacheHit string, statusCode int, labels prometheus.Labels) error {
 	h := rw.Header()
+	for name, values := range metadata.Headers {
+		h[name] = values
+	}
 	if len(metadata.Type) > 0 {
 		h.Set("Content-Type", metadata.Type)
 	}
@@ -101,15 +116,27 @@ func (rw *statResponseWriter) Write(b []byte) (int, error) {
 		rw.statusCode = http.StatusOK
 	}
 	if !rw.wroteHeader {
+		rw.setHeaders()
 		rw.ResponseWriter.WriteHeader(rw.statusCode)
 		rw.wroteHeader = true
 	}
 	n, err := rw.ResponseWriter.Write(b)
 	rw.bytesWritten.Add(float64(n))
+	rw.written += int64(n)
 
 	return n, err
 }
 
+// setHeaders sets headers right before the header is written.
+func (rw *statResponseWriter) setHeaders() {
+	h := rw.Header()
+	if len(rw.corsOrigin) > 0 {
+		dropCORSHeaders(h)
+		h.Set("Access-Control-Allow-Origin", rw.corsOrigin)
+	}
+	setResponseHeaders(h, rw.responseHeaders)
+}
+
 func (rw *statResponseWriter) WriteHeader(statusCode int) {
 	// cache statusCode to keep the opportunity to change it in further
 	rw.statusCode = statusCode
@@ -125,6 +152,58 @@ func (rw *statResponseWriter) CloseNotify() <-chan bool {
 	return rwc.CloseNotify()
 }
 
+// sizeLimiter is implemented by response writers limiting the response size.
+type sizeLimiter interface {
+	SizeExceeded() bool
+}
+
+var _ sizeLimiter = &limitedResponseWriter{}
+var _ sizeLimiter = &cache.TmpFileResponseWriter{}
+
+var errResponseTooLarge = errors.New("response size limit exceeded")
+
+// limitedResponseWriter fails writes once the response exceeds maxSize.
+//
+// The wrapped ResponseWriter must implement http.CloseNotifier.
+type limitedResponseWriter struct {
+	ResponseWriterWithCode
+
+	maxSize      int64
+	written      int64
+	sizeExceeded bool
+}
+
+func (rw *limitedResponseWriter) Write(b []byte) (int, error) {
+	if rw.written+int64(len(b)) > rw.maxSize {
+		rw.sizeExceeded = true
+		return 0, errResponseTooLarge
+	}
+	n, err := rw.ResponseWriterWithCode.Write(b)
+	rw.written += int64(n)
+	return n, err
+}
+
+// SizeExceeded returns true if the response exceeded maxSize.
+func (rw *limitedResponseWriter) SizeExceeded() bool {
+	return rw.sizeExceeded
+}
+
+// CloseNotify implements http.CloseNotifier
+func (rw *limitedResponseWriter) CloseNotify() <-chan bool {
+	// nolint:forcetypeassert // it is guaranteed by the caller
+	return rw.ResponseWriterWithCode.(http.CloseNotifier).CloseNotify()
+}
+
+// abortResponse closes the client connection, so the client
+// may detect the response has been truncated.
+func abortResponse(rw http.ResponseWriter) error {
+	conn, _, err := http.NewResponseController(rw).Hijack()
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
 var _ io.ReadCloser = &statReadCloser{}
 
 // statReadCloser collects the amount of bytes read.
@@ -132,14 +211,59 @@ type statReadCloser struct {
 	io.ReadCloser
 
 	bytesRead prometheus.Counter
+
+	// read is the amount of bytes read from the original ReadCloser
+	read int64
 }
 
 func (src *statReadCloser) Read(p []byte) (int, error) {
 	n, err := src.ReadCloser.Read(p)
 	src.bytesRead.Add(float64(n))
+	src.read += int64(n)
 	return n, err
 }
 
+// readCloser reads from Reader and closes Closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+var _ io.ReadCloser = &limitedCachedReadCloser{}
+
+// limitedCachedReadCloser caches up to limit bytes of the wrapped ReadCloser.
+//
+// Bodies exceeding limit are read in streaming mode: the cached data is read
+// first, followed by the rest of the wrapped ReadCloser, so they aren't held
+// in memory.
+type limitedCachedReadCloser struct {
+	io.ReadCloser
+
+	// b holds up to limit+1 bytes read ahead from ReadCloser.
+	b []byte
+	r io.Reader
+
+	// streaming is true if the wrapped ReadCloser exceeds limit.
+	streaming bool
+}
+
+func newLimitedCachedReadCloser(rc io.ReadCloser, limit int64) (*limitedCachedReadCloser, error) {
+	b, err := io.ReadAll(io.LimitReader(rc, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	return &limitedCachedReadCloser{
+		ReadCloser: rc,
+		b:          b,
+		r:          io.MultiReader(bytes.NewReader(b), rc),
+		streaming:  int64(len(b)) > limit,
+	}, nil
+}
+
+func (lcrc *limitedCachedReadCloser) Read(p []byte) (int, error) {
+	return lcrc.r.Read(p)
+}
+
 var _ io.ReadCloser = &cachedReadCloser{}
 
 // cachedReadCloser caches the first 1Kb form the wrapped ReadCloser.
@@ -27,3 +27,30 @@ func TestCachedReadCloser(t *testing.T) {
 		t.Fatalf("unexpected query start read: (%d) %q; expecting (%d) %q", len(start), start, len(expectedStart), expectedStart)
 	}
 }
+
+func TestLimitedCachedReadCloser(t *testing.T) {
+	b := makeQuery(1000)
+	for _, tc := range []struct {
+		limit     int64
+		streaming bool
+	}{
+		{limit: int64(len(b)), streaming: false},
+		{limit: int64(len(b)) - 1, streaming: true},
+		{limit: 1024, streaming: true},
+	} {
+		lcrc, err := newLimitedCachedReadCloser(io.NopCloser(bytes.NewReader(b)), tc.limit)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if lcrc.streaming != tc.streaming {
+			t.Fatalf("limit %d: got streaming %v; expected %v", tc.limit, lcrc.streaming, tc.streaming)
+		}
+		res, err := io.ReadAll(lcrc)
+		if err != nil {
+			t.Fatalf("cannot read body: %s", err)
+		}
+		if !bytes.Equal(res, b) {
+			t.Fatalf("limit %d: the whole body must be read; got %d bytes; expected %d bytes", tc.limit, len(res), len(b))
+		}
+	}
+}
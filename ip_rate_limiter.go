@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/contentsquare/chproxy/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+// defaultIPRateLimitEvictionTTL is used if `eviction_ttl` isn't set.
+const defaultIPRateLimitEvictionTTL = 10 * time.Minute
+
+// ipRateLimiter limits requests per client IP before users are authenticated,
+// so floods of requests are rejected before reaching the auth layer.
+type ipRateLimiter struct {
+	cfg config.PerIPRateLimit
+
+	limit rate.Limit
+	burst int
+	ttl   time.Duration
+
+	// limiters holds *ipLimiter per client IP.
+	limiters sync.Map
+
+	// lastEviction is the unix time in nanoseconds of the last sweep
+	// of inactive limiters.
+	lastEviction atomic.Int64
+}
+
+// ipLimiter is the rate limiter of a single client IP.
+type ipLimiter struct {
+	limiter *rate.Limiter
+
+	// lastSeen is the unix time in nanoseconds of the last request.
+	lastSeen atomic.Int64
+}
+
+// newIPRateLimiter returns the limiter for cfg
+// or nil if requests per IP aren't limited.
+//
+// prev is returned if its config is the same as cfg,
+// so limits aren't reset on config reload.
+func newIPRateLimiter(cfg config.PerIPRateLimit, prev *ipRateLimiter) *ipRateLimiter {
+	if cfg.ReqPerMin == 0 {
+		return nil
+	}
+	if prev != nil && reflect.DeepEqual(prev.cfg, cfg) {
+		return prev
+	}
+	burst := cfg.Burst
+	if burst == 0 {
+		burst = cfg.ReqPerMin
+	}
+	ttl := time.Duration(cfg.EvictionTTL)
+	if ttl == 0 {
+		ttl = defaultIPRateLimitEvictionTTL
+	}
+	l := &ipRateLimiter{
+		cfg:   cfg,
+		limit: rate.Limit(float64(cfg.ReqPerMin) / 60),
+		burst: burst,
+		ttl:   ttl,
+	}
+	l.lastEviction.Store(time.Now().UnixNano())
+	return l
+}
+
+// allow checks the request from remoteAddr against the limit of its IP.
+//
+// Returns the delay after which the request would be allowed
+// if the limit is exceeded.
+func (l *ipRateLimiter) allow(remoteAddr string, now time.Time) (bool, time.Duration) {
+	if len(l.cfg.ExemptNetworks) > 0 && l.cfg.ExemptNetworks.Contains(remoteAddr) {
+		return true, 0
+	}
+	l.evict(now)
+
+	ip := remoteIP(remoteAddr)
+	v, ok := l.limiters.Load(ip)
+	if !ok {
+		v, _ = l.limiters.LoadOrStore(ip, &ipLimiter{
+			limiter: rate.NewLimiter(l.limit, l.burst),
+		})
+	}
+	// nolint:forcetypeassert // We will cover this by tests as we control what is stored.
+	il := v.(*ipLimiter)
+	il.lastSeen.Store(now.UnixNano())
+
+	r := il.limiter.ReserveN(now, 1)
+	if d := r.DelayFrom(now); d > 0 {
+		r.CancelAt(now)
+		return false, d
+	}
+	return true, 0
+}
+
+// evict drops limiters of IPs inactive for longer than ttl.
+//
+// Limiters are swept at most once per ttl by the request
+// which happens to come first.
+func (l *ipRateLimiter) evict(now time.Time) {
+	last := l.lastEviction.Load()
+	if now.UnixNano()-last < int64(l.ttl) || !l.lastEviction.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+	deadline := now.Add(-l.ttl).UnixNano()
+	l.limiters.Range(func(ip, v any) bool {
+		// nolint:forcetypeassert // We will cover this by tests as we control what is stored.
+		if v.(*ipLimiter).lastSeen.Load() < deadline {
+			l.limiters.Delete(ip)
+		}
+		return true
+	})
+}
+
+// checkIPRateLimit checks r against per_ip_rate_limit
+// and sets Retry-After of rw if the limit is exceeded.
+//
+// The remote address of r must be set by checkListenerNetworks.
+func checkIPRateLimit(rw http.ResponseWriter, r *http.Request) error {
+	l := ipRateLimit.Load()
+	if l == nil {
+		return nil
+	}
+	ok, d := l.allow(r.RemoteAddr, time.Now())
+	if ok {
+		return nil
+	}
+	ip := remoteIP(r.RemoteAddr)
+	ipRateLimitExceeded.With(prometheus.Labels{"remote_ip": ip}).Inc()
+	setRetryAfter(rw, d)
+	return fmt.Errorf("rate limit for %s is exceeded: per_ip_rate_limit.requests_per_minute limit: %d", ip, l.cfg.ReqPerMin)
+}
+
+// remoteIP returns the IP of remoteAddr, which may lack the port
+// if the remote address is taken from proxy headers.
+func remoteIP(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
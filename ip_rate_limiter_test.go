@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/contentsquare/chproxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPRateLimiterAllow(t *testing.T) {
+	l := newIPRateLimiter(config.PerIPRateLimit{ReqPerMin: 60, Burst: 2}, nil)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		ok, _ := l.allow("10.0.0.1:1234", now)
+		assert.True(t, ok, "request %d within burst must be allowed", i)
+	}
+	ok, d := l.allow("10.0.0.1:4321", now)
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, d)
+
+	// Other IPs have their own limits.
+	ok, _ = l.allow("10.0.0.2", now)
+	assert.True(t, ok)
+
+	// A token is refilled every second.
+	ok, _ = l.allow("10.0.0.1:1234", now.Add(time.Second))
+	assert.True(t, ok)
+}
+
+func TestIPRateLimiterExemptNetworks(t *testing.T) {
+	_, exempt, err := net.ParseCIDR("10.0.0.0/8")
+	assert.NoError(t, err)
+	l := newIPRateLimiter(config.PerIPRateLimit{
+		ReqPerMin:      1,
+		ExemptNetworks: config.Networks{exempt},
+	}, nil)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		ok, _ := l.allow("10.1.2.3:1234", now)
+		assert.True(t, ok)
+	}
+	ok, _ := l.allow("192.168.0.1:1234", now)
+	assert.True(t, ok)
+	ok, _ = l.allow("192.168.0.1:1234", now)
+	assert.False(t, ok)
+}
+
+func TestIPRateLimiterEviction(t *testing.T) {
+	l := newIPRateLimiter(config.PerIPRateLimit{
+		ReqPerMin:   1,
+		EvictionTTL: config.Duration(time.Minute),
+	}, nil)
+	now := time.Now()
+
+	l.allow("10.0.0.1", now)
+	l.allow("10.0.0.2", now.Add(45*time.Second))
+	l.allow("10.0.0.3", now.Add(90*time.Second))
+
+	_, ok := l.limiters.Load("10.0.0.1")
+	assert.False(t, ok, "inactive limiter must be evicted")
+	_, ok = l.limiters.Load("10.0.0.2")
+	assert.True(t, ok, "active limiter must be kept")
+}
+
+func TestNewIPRateLimiter(t *testing.T) {
+	assert.Nil(t, newIPRateLimiter(config.PerIPRateLimit{}, nil))
+
+	cfg := config.PerIPRateLimit{ReqPerMin: 120}
+	l := newIPRateLimiter(cfg, nil)
+	assert.Equal(t, 120, l.burst)
+	assert.Equal(t, defaultIPRateLimitEvictionTTL, l.ttl)
+
+	// Limits aren't reset if the config is the same.
+	assert.Same(t, l, newIPRateLimiter(cfg, l))
+	assert.NotSame(t, l, newIPRateLimiter(config.PerIPRateLimit{ReqPerMin: 60}, l))
+}
+
+func TestCheckIPRateLimit(t *testing.T) {
+	defer ipRateLimit.Store(ipRateLimit.Load())
+	ipRateLimit.Store(newIPRateLimiter(config.PerIPRateLimit{ReqPerMin: 1}, nil))
+
+	req := httptest.NewRequest(http.MethodGet, "/?query=SELECT+1", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	rw := httptest.NewRecorder()
+	assert.NoError(t, checkIPRateLimit(rw, req))
+
+	err := checkIPRateLimit(rw, req)
+	assert.EqualError(t, err, "rate limit for 192.0.2.1 is exceeded: per_ip_rate_limit.requests_per_minute limit: 1")
+	assert.Equal(t, "60", rw.Header().Get("Retry-After"))
+}
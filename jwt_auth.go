@@ -0,0 +1,367 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/contentsquare/chproxy/config"
+	"github.com/contentsquare/chproxy/log"
+)
+
+const (
+	// defaultJWTUserClaim is used if `auth.jwt.user_claim` isn't set.
+	defaultJWTUserClaim = "preferred_username"
+
+	// defaultJWTCacheTTL is used if `auth.jwt.cache_ttl` isn't set.
+	defaultJWTCacheTTL = time.Minute
+
+	// defaultJWKSRefreshInterval is used if `auth.jwt.jwks_refresh_interval` isn't set.
+	defaultJWKSRefreshInterval = time.Hour
+
+	// minJWKSRefreshInterval limits refreshes of JWKS triggered
+	// by tokens signed with unknown keys.
+	minJWKSRefreshInterval = 10 * time.Second
+
+	// jwksTimeout limits the duration of JWKS requests.
+	jwksTimeout = 5 * time.Second
+)
+
+// jwtHashes contains supported signing algorithms.
+var jwtHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+}
+
+// jwtAuth verifies JWT bearer tokens and maps them to users from `users`.
+type jwtAuth struct {
+	issuer    string
+	audience  string
+	userClaim string
+
+	// publicKey is set if tokens are verified with `public_key_file`.
+	publicKey *rsa.PublicKey
+
+	jwksURL             string
+	jwksRefreshInterval time.Duration
+	client              *http.Client
+
+	keysMu sync.Mutex
+	// keys contains keys from jwksURL keyed by kid.
+	keys          map[string]*rsa.PublicKey
+	keysFetchedAt time.Time
+
+	mu sync.Mutex
+	// verified contains user names of verified tokens
+	// keyed by the hash of tokens, so tokens aren't kept in memory.
+	verified  map[[sha256.Size]byte]verifiedToken
+	ttl       time.Duration
+	lastSweep time.Time
+}
+
+type verifiedToken struct {
+	user   string
+	expire time.Time
+}
+
+func newJWTAuth(cfg *config.Auth) (*jwtAuth, error) {
+	if cfg == nil || cfg.JWT == nil {
+		return nil, nil
+	}
+	jc := cfg.JWT
+	ja := &jwtAuth{
+		issuer:              jc.Issuer,
+		audience:            jc.Audience,
+		userClaim:           jc.UserClaim,
+		jwksURL:             jc.JWKSURL,
+		jwksRefreshInterval: time.Duration(jc.JWKSRefreshInterval),
+		client:              &http.Client{Timeout: jwksTimeout},
+		verified:            make(map[[sha256.Size]byte]verifiedToken),
+		ttl:                 time.Duration(jc.CacheTTL),
+		lastSweep:           time.Now(),
+	}
+	if len(ja.userClaim) == 0 {
+		ja.userClaim = defaultJWTUserClaim
+	}
+	if ja.ttl == 0 {
+		ja.ttl = defaultJWTCacheTTL
+	}
+	if ja.jwksRefreshInterval == 0 {
+		ja.jwksRefreshInterval = defaultJWKSRefreshInterval
+	}
+	if len(jc.PublicKeyFile) > 0 {
+		key, err := readRSAPublicKey(jc.PublicKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load `auth.jwt.public_key_file`: %w", err)
+		}
+		ja.publicKey = key
+	}
+	return ja, nil
+}
+
+func readRSAPublicKey(filename string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("cannot find PEM block in %q", filename)
+	}
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if key, ok := cert.PublicKey.(*rsa.PublicKey); ok {
+			return key, nil
+		}
+	default:
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if key, ok := key.(*rsa.PublicKey); ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("key in %q isn't an RSA public key", filename)
+}
+
+// getBearerToken returns the token from `Authorization: Bearer` header of req.
+func getBearerToken(req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(auth[len(prefix):])
+}
+
+// authenticate verifies the given token unless it has been verified
+// during the last ttl. Returns the name of the user from the token.
+func (ja *jwtAuth) authenticate(token string) (string, error) {
+	key := sha256.Sum256([]byte(token))
+	now := time.Now()
+	ja.mu.Lock()
+	vt, ok := ja.verified[key]
+	ja.mu.Unlock()
+	if ok && now.Before(vt.expire) {
+		return vt.user, nil
+	}
+
+	user, exp, err := ja.verify(token, now)
+	if err != nil {
+		return "", err
+	}
+
+	expire := now.Add(ja.ttl)
+	if exp.Before(expire) {
+		expire = exp
+	}
+	ja.mu.Lock()
+	defer ja.mu.Unlock()
+	ja.verified[key] = verifiedToken{
+		user:   user,
+		expire: expire,
+	}
+	if now.Sub(ja.lastSweep) > ja.ttl {
+		for k, vt := range ja.verified {
+			if now.After(vt.expire) {
+				delete(ja.verified, k)
+			}
+		}
+		ja.lastSweep = now
+	}
+	return user, nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// verify checks the signature and claims of the given token.
+// Returns the name of the user and the expiration time of the token.
+func (ja *jwtAuth) verify(token string, now time.Time) (string, time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", time.Time{}, errors.New("malformed token")
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", time.Time{}, fmt.Errorf("cannot decode header: %w", err)
+	}
+	hash, ok := jwtHashes[header.Alg]
+	if !ok {
+		return "", time.Time{}, fmt.Errorf("unsupported signing algorithm %q", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("cannot decode signature: %w", err)
+	}
+	key, err := ja.getKey(header.Kid, now)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, hash, h.Sum(nil), sig); err != nil {
+		return "", time.Time{}, errors.New("invalid signature")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", time.Time{}, fmt.Errorf("cannot decode claims: %w", err)
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return "", time.Time{}, errors.New("missing `exp` claim")
+	}
+	expire := time.Unix(int64(exp), 0)
+	if !now.Before(expire) {
+		return "", time.Time{}, errors.New("token is expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0)) {
+		return "", time.Time{}, errors.New("token isn't valid yet")
+	}
+	if iss, _ := claims["iss"].(string); iss != ja.issuer {
+		return "", time.Time{}, fmt.Errorf("unexpected issuer %q", iss)
+	}
+	if !hasJWTAudience(claims["aud"], ja.audience) {
+		return "", time.Time{}, fmt.Errorf("token isn't issued for audience %q", ja.audience)
+	}
+	user, _ := claims[ja.userClaim].(string)
+	if len(user) == 0 {
+		return "", time.Time{}, fmt.Errorf("missing `%s` claim", ja.userClaim)
+	}
+	return user, expire, nil
+}
+
+func decodeJWTPart(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// hasJWTAudience checks whether `aud` claim, which is either
+// a string or an array of strings, contains audience.
+func hasJWTAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// getKey returns the key the token with kid is signed with.
+//
+// Keys from JWKS are refreshed every jwksRefreshInterval
+// or once a token is signed with an unknown key.
+func (ja *jwtAuth) getKey(kid string, now time.Time) (*rsa.PublicKey, error) {
+	if ja.publicKey != nil {
+		return ja.publicKey, nil
+	}
+
+	ja.keysMu.Lock()
+	defer ja.keysMu.Unlock()
+	key, ok := ja.lookupKey(kid)
+	sinceFetch := now.Sub(ja.keysFetchedAt)
+	if (ok && sinceFetch > ja.jwksRefreshInterval) || (!ok && sinceFetch > minJWKSRefreshInterval) {
+		keys, err := ja.fetchKeys()
+		if err != nil {
+			log.Errorf("cannot refresh keys from %q: %s", ja.jwksURL, err)
+		} else {
+			ja.keys = keys
+		}
+		// Failed fetches are throttled as well, so an unavailable JWKS
+		// doesn't slow down every request.
+		ja.keysFetchedAt = now
+		key, ok = ja.lookupKey(kid)
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// lookupKey returns the key with kid. The only key is returned
+// for tokens without kid.
+func (ja *jwtAuth) lookupKey(kid string) (*rsa.PublicKey, bool) {
+	if len(kid) == 0 && len(ja.keys) == 1 {
+		for _, key := range ja.keys {
+			return key, true
+		}
+	}
+	key, ok := ja.keys[kid]
+	return key, ok
+}
+
+type jwks struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Use string `json:"use"`
+		Kid string `json:"kid"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+// fetchKeys returns RSA signing keys from jwksURL.
+func (ja *jwtAuth) fetchKeys() (map[string]*rsa.PublicKey, error) {
+	resp, err := ja.client.Get(ja.jwksURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	var set jwks
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("cannot parse JWKS: %w", err)
+	}
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (len(k.Use) > 0 && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode modulus of key %q: %w", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode exponent of key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
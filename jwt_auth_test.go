@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/contentsquare/chproxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testJWTIssuer   = "https://sso.example.com"
+	testJWTAudience = "chproxy"
+)
+
+var (
+	testJWTKeys     [2]*rsa.PrivateKey
+	testJWTKeysOnce sync.Once
+)
+
+// getTestJWTKeys returns RSA key pairs shared by tests,
+// since generating them is slow.
+func getTestJWTKeys(t *testing.T) [2]*rsa.PrivateKey {
+	t.Helper()
+	testJWTKeysOnce.Do(func() {
+		for i := range testJWTKeys {
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			if err != nil {
+				t.Fatalf("cannot generate RSA key: %s", err)
+			}
+			testJWTKeys[i] = key
+		}
+	})
+	return testJWTKeys
+}
+
+// makeJWT returns the token with the given claims signed by key via RS256.
+func makeJWT(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	encode := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		checkErr(t, err)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	header := map[string]string{"alg": "RS256", "typ": "JWT"}
+	if len(kid) > 0 {
+		header["kid"] = kid
+	}
+	signed := encode(header) + "." + encode(claims)
+	digest := crypto.SHA256.New()
+	digest.Write([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest.Sum(nil))
+	checkErr(t, err)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func jwtClaims(user string, exp time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":                testJWTIssuer,
+		"aud":                []string{"other", testJWTAudience},
+		"exp":                exp.Unix(),
+		"preferred_username": user,
+	}
+}
+
+func writePublicKey(t *testing.T, key *rsa.PrivateKey) string {
+	t.Helper()
+	b, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	checkErr(t, err)
+	filename := filepath.Join(t.TempDir(), "jwt.pem")
+	checkErr(t, os.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b}), 0600))
+	return filename
+}
+
+func TestJWTAuthAuthenticate(t *testing.T) {
+	keys := getTestJWTKeys(t)
+	ja, err := newJWTAuth(&config.Auth{
+		JWT: &config.JWTAuth{
+			PublicKeyFile: writePublicKey(t, keys[0]),
+			Issuer:        testJWTIssuer,
+			Audience:      testJWTAudience,
+		},
+	})
+	checkErr(t, err)
+
+	exp := time.Now().Add(time.Hour)
+	user, err := ja.authenticate(makeJWT(t, keys[0], "", jwtClaims("alice", exp)))
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", user)
+
+	claims := jwtClaims("alice", exp)
+	claims["aud"] = testJWTAudience
+	user, err = ja.authenticate(makeJWT(t, keys[0], "", claims))
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", user)
+
+	testCases := []struct {
+		name   string
+		key    *rsa.PrivateKey
+		modify func(claims map[string]interface{})
+		err    string
+	}{
+		{
+			name:   "expired",
+			modify: func(claims map[string]interface{}) { claims["exp"] = time.Now().Add(-time.Minute).Unix() },
+			err:    "token is expired",
+		},
+		{
+			name:   "wrong audience",
+			modify: func(claims map[string]interface{}) { claims["aud"] = "other" },
+			err:    "token isn't issued for audience \"chproxy\"",
+		},
+		{
+			name:   "wrong issuer",
+			modify: func(claims map[string]interface{}) { claims["iss"] = "https://evil.example.com" },
+			err:    "unexpected issuer \"https://evil.example.com\"",
+		},
+		{
+			name:   "not valid yet",
+			modify: func(claims map[string]interface{}) { claims["nbf"] = time.Now().Add(time.Minute).Unix() },
+			err:    "token isn't valid yet",
+		},
+		{
+			name:   "missing user claim",
+			modify: func(claims map[string]interface{}) { delete(claims, "preferred_username") },
+			err:    "missing `preferred_username` claim",
+		},
+		{
+			name: "wrong key",
+			key:  keys[1],
+			err:  "invalid signature",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			claims := jwtClaims("alice", exp)
+			if tc.modify != nil {
+				tc.modify(claims)
+			}
+			key := keys[0]
+			if tc.key != nil {
+				key = tc.key
+			}
+			_, err := ja.authenticate(makeJWT(t, key, "", claims))
+			assert.EqualError(t, err, tc.err)
+		})
+	}
+
+	t.Run("unsigned", func(t *testing.T) {
+		token := makeJWT(t, keys[0], "", jwtClaims("alice", exp))
+		header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+		_, err := ja.authenticate(header + token[len(header):])
+		assert.Error(t, err)
+	})
+}
+
+func TestJWTAuthCache(t *testing.T) {
+	keys := getTestJWTKeys(t)
+	ja, err := newJWTAuth(&config.Auth{
+		JWT: &config.JWTAuth{
+			PublicKeyFile: writePublicKey(t, keys[0]),
+			Issuer:        testJWTIssuer,
+			Audience:      testJWTAudience,
+			UserClaim:     "sub",
+			CacheTTL:      config.Duration(time.Minute),
+		},
+	})
+	checkErr(t, err)
+
+	claims := jwtClaims("alice", time.Now().Add(time.Hour))
+	claims["sub"] = "bob"
+	token := makeJWT(t, keys[0], "", claims)
+	user, err := ja.authenticate(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", user)
+	assert.Len(t, ja.verified, 1)
+
+	// Cached tokens aren't verified again.
+	ja.publicKey = &keys[1].PublicKey
+	user, err = ja.authenticate(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", user)
+
+	// Tokens are cached until their expiration.
+	claims["exp"] = time.Now().Add(time.Second).Unix()
+	token = makeJWT(t, keys[1], "", claims)
+	_, err = ja.authenticate(token)
+	assert.NoError(t, err)
+	vt := ja.verified[sha256.Sum256([]byte(token))]
+	assert.Equal(t, time.Unix(claims["exp"].(int64), 0), vt.expire)
+}
+
+func TestJWTAuthJWKS(t *testing.T) {
+	keys := getTestJWTKeys(t)
+	var (
+		fetches atomic.Int32
+		kids    atomic.Value
+	)
+	kids.Store([]string{"key-0"})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		var set jwks
+		for i, kid := range kids.Load().([]string) {
+			k := &keys[i].PublicKey
+			set.Keys = append(set.Keys, struct {
+				Kty string `json:"kty"`
+				Use string `json:"use"`
+				Kid string `json:"kid"`
+				N   string `json:"n"`
+				E   string `json:"e"`
+			}{
+				Kty: "RSA",
+				Use: "sig",
+				Kid: kid,
+				N:   base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+			})
+		}
+		checkErr(t, json.NewEncoder(w).Encode(set))
+	}))
+	defer srv.Close()
+
+	ja, err := newJWTAuth(&config.Auth{
+		JWT: &config.JWTAuth{
+			JWKSURL:  srv.URL,
+			Issuer:   testJWTIssuer,
+			Audience: testJWTAudience,
+			CacheTTL: config.Duration(time.Nanosecond),
+		},
+	})
+	checkErr(t, err)
+
+	exp := time.Now().Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		user, err := ja.authenticate(makeJWT(t, keys[0], "key-0", jwtClaims("alice", exp)))
+		assert.NoError(t, err)
+		assert.Equal(t, "alice", user)
+	}
+	assert.Equal(t, int32(1), fetches.Load(), "keys must be fetched once")
+
+	// Tokens signed with unknown keys trigger a refresh of the keys.
+	kids.Store([]string{"key-0", "key-1"})
+	ja.keysFetchedAt = time.Now().Add(-minJWKSRefreshInterval)
+	user, err := ja.authenticate(makeJWT(t, keys[1], "key-1", jwtClaims("bob", exp)))
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", user)
+	assert.Equal(t, int32(2), fetches.Load())
+
+	// Refreshes triggered by unknown keys are throttled.
+	_, err = ja.authenticate(makeJWT(t, keys[1], "key-2", jwtClaims("bob", exp)))
+	assert.EqualError(t, err, "unknown signing key \"key-2\"")
+	assert.Equal(t, int32(2), fetches.Load())
+}
+
+func TestGetBearerToken(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	assert.Empty(t, getBearerToken(req))
+
+	req.SetBasicAuth("foo", "bar")
+	assert.Empty(t, getBearerToken(req))
+
+	req.Header.Set("Authorization", "bearer abc.def.ghi")
+	assert.Equal(t, "abc.def.ghi", getBearerToken(req))
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/contentsquare/chproxy/config"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// defaultLDAPCacheTTL is used if `auth_backend.ldap_cache_ttl` isn't set.
+const defaultLDAPCacheTTL = time.Minute
+
+// ldapTimeout limits the duration of LDAP round-trips.
+const ldapTimeout = 5 * time.Second
+
+var errLDAPInvalidCredentials = errors.New("invalid credentials")
+
+// ldapConn is the subset of *ldap.Conn used for authentication.
+type ldapConn interface {
+	Bind(username, password string) error
+	Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+func dialLDAP(addr string) (ldapConn, error) {
+	conn, err := ldap.DialURL(addr, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(ldapTimeout)
+	return conn, nil
+}
+
+// ldapAuth authenticates users missing in `users` via LDAP.
+type ldapAuth struct {
+	url          string
+	bindDN       string
+	bindPassword string
+	searchBase   string
+	searchFilter string
+
+	// userTemplate is the name of the user whose settings
+	// are applied to users authenticated via LDAP.
+	userTemplate string
+
+	dial func(addr string) (ldapConn, error)
+
+	mu sync.Mutex
+	// authenticated contains expiration times of successful authentications
+	// keyed by the hash of credentials, so passwords aren't kept in memory.
+	authenticated map[[sha256.Size]byte]time.Time
+	ttl           time.Duration
+	lastSweep     time.Time
+}
+
+func newLDAPAuth(cfg *config.AuthBackend) *ldapAuth {
+	if cfg == nil {
+		return nil
+	}
+	ttl := time.Duration(cfg.LDAPCacheTTL)
+	if ttl == 0 {
+		ttl = defaultLDAPCacheTTL
+	}
+	return &ldapAuth{
+		url:           cfg.LDAPURL,
+		bindDN:        cfg.BindDN,
+		bindPassword:  cfg.BindPassword,
+		searchBase:    cfg.UserSearchBase,
+		searchFilter:  cfg.UserSearchFilter,
+		userTemplate:  cfg.LDAPUserTemplate,
+		dial:          dialLDAP,
+		authenticated: make(map[[sha256.Size]byte]time.Time),
+		ttl:           ttl,
+		lastSweep:     time.Now(),
+	}
+}
+
+// authenticate checks the given credentials against LDAP
+// unless they have been successfully checked during the last ttl.
+func (la *ldapAuth) authenticate(name, password string) error {
+	// An empty password would result in an unauthenticated bind,
+	// which succeeds on most LDAP servers.
+	if len(password) == 0 {
+		return errLDAPInvalidCredentials
+	}
+
+	key := sha256.Sum256([]byte(name + "\x00" + password))
+	now := time.Now()
+	la.mu.Lock()
+	expire, ok := la.authenticated[key]
+	la.mu.Unlock()
+	if ok && now.Before(expire) {
+		return nil
+	}
+
+	if err := la.bind(name, password); err != nil {
+		return err
+	}
+
+	la.mu.Lock()
+	defer la.mu.Unlock()
+	la.authenticated[key] = now.Add(la.ttl)
+	if now.Sub(la.lastSweep) > la.ttl {
+		for k, expire := range la.authenticated {
+			if now.After(expire) {
+				delete(la.authenticated, k)
+			}
+		}
+		la.lastSweep = now
+	}
+	return nil
+}
+
+// bind searches for the user with the given name and binds as it
+// with the given password.
+func (la *ldapAuth) bind(name, password string) error {
+	conn, err := la.dial(la.url)
+	if err != nil {
+		return fmt.Errorf("cannot connect to %q: %w", la.url, err)
+	}
+	defer conn.Close()
+
+	if len(la.bindDN) > 0 {
+		if err := conn.Bind(la.bindDN, la.bindPassword); err != nil {
+			return fmt.Errorf("cannot bind as %q: %w", la.bindDN, err)
+		}
+	}
+
+	filter := strings.ReplaceAll(la.searchFilter, config.LDAPUserPlaceholder, ldap.EscapeFilter(name))
+	res, err := conn.Search(ldap.NewSearchRequest(
+		la.searchBase, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(ldapTimeout/time.Second), false, filter, []string{"dn"}, nil,
+	))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return errLDAPInvalidCredentials
+	}
+	if err != nil {
+		return fmt.Errorf("cannot search for user %q: %w", name, err)
+	}
+	if len(res.Entries) != 1 {
+		// The user is either missing or ambiguous.
+		return errLDAPInvalidCredentials
+	}
+
+	if err := conn.Bind(res.Entries[0].DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return errLDAPInvalidCredentials
+		}
+		return fmt.Errorf("cannot bind as %q: %w", res.Entries[0].DN, err)
+	}
+	return nil
+}
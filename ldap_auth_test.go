@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/contentsquare/chproxy/config"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeLDAP imitates an LDAP server with the given users
+// under ou=users,dc=example,dc=com.
+type fakeLDAP struct {
+	// passwords are keyed by uid.
+	passwords map[string]string
+
+	dials   int
+	filters []string
+}
+
+const (
+	fakeLDAPBindDN       = "cn=chproxy,dc=example,dc=com"
+	fakeLDAPBindPassword = "bind-secret"
+)
+
+func fakeLDAPUserDN(uid string) string {
+	return "uid=" + uid + ",ou=users,dc=example,dc=com"
+}
+
+func (fl *fakeLDAP) dial(string) (ldapConn, error) {
+	fl.dials++
+	return fl, nil
+}
+
+func (fl *fakeLDAP) Bind(username, password string) error {
+	if username == fakeLDAPBindDN && password == fakeLDAPBindPassword {
+		return nil
+	}
+	for uid, p := range fl.passwords {
+		if username == fakeLDAPUserDN(uid) && password == p {
+			return nil
+		}
+	}
+	return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+}
+
+func (fl *fakeLDAP) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	fl.filters = append(fl.filters, req.Filter)
+	res := &ldap.SearchResult{}
+	for uid := range fl.passwords {
+		if req.Filter == "(uid="+ldap.EscapeFilter(uid)+")" {
+			res.Entries = append(res.Entries, ldap.NewEntry(fakeLDAPUserDN(uid), nil))
+		}
+	}
+	return res, nil
+}
+
+func (fl *fakeLDAP) Close() error { return nil }
+
+func newFakeLDAPAuth(ttl time.Duration) (*ldapAuth, *fakeLDAP) {
+	fl := &fakeLDAP{
+		passwords: map[string]string{
+			"alice": "alice-secret",
+		},
+	}
+	la := newLDAPAuth(&config.AuthBackend{
+		Type:             "ldap",
+		LDAPURL:          "ldap://127.0.0.1:389",
+		BindDN:           fakeLDAPBindDN,
+		BindPassword:     fakeLDAPBindPassword,
+		UserSearchBase:   "ou=users,dc=example,dc=com",
+		UserSearchFilter: "(uid={{user}})",
+		LDAPUserTemplate: "default",
+		LDAPCacheTTL:     config.Duration(ttl),
+	})
+	la.dial = fl.dial
+	return la, fl
+}
+
+func TestLDAPAuthAuthenticate(t *testing.T) {
+	la, fl := newFakeLDAPAuth(time.Minute)
+
+	assert.NoError(t, la.authenticate("alice", "alice-secret"))
+	assert.ErrorIs(t, la.authenticate("alice", "wrong"), errLDAPInvalidCredentials)
+	assert.ErrorIs(t, la.authenticate("bob", "alice-secret"), errLDAPInvalidCredentials)
+	assert.Equal(t, 3, fl.dials)
+
+	// An empty password isn't sent to LDAP, since it would result in an unauthenticated bind.
+	assert.ErrorIs(t, la.authenticate("alice", ""), errLDAPInvalidCredentials)
+	assert.Equal(t, 3, fl.dials)
+
+	// Special chars of user names are escaped in the search filter.
+	fl.filters = nil
+	assert.ErrorIs(t, la.authenticate("*", "alice-secret"), errLDAPInvalidCredentials)
+	assert.Equal(t, []string{`(uid=\2a)`}, fl.filters)
+}
+
+func TestLDAPAuthCache(t *testing.T) {
+	la, fl := newFakeLDAPAuth(time.Minute)
+
+	assert.NoError(t, la.authenticate("alice", "alice-secret"))
+	assert.NoError(t, la.authenticate("alice", "alice-secret"))
+	assert.Equal(t, 1, fl.dials)
+
+	// Failed authentications aren't cached.
+	assert.ErrorIs(t, la.authenticate("alice", "wrong"), errLDAPInvalidCredentials)
+	assert.ErrorIs(t, la.authenticate("alice", "wrong"), errLDAPInvalidCredentials)
+	assert.Equal(t, 3, fl.dials)
+
+	// Credentials are checked again once the cached authentication expires.
+	for k := range la.authenticated {
+		la.authenticated[k] = time.Now().Add(-time.Second)
+	}
+	assert.NoError(t, la.authenticate("alice", "alice-secret"))
+	assert.Equal(t, 4, fl.dials)
+}
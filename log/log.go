@@ -14,6 +14,7 @@ var (
 
 	debugLogger = log.New(os.Stderr, "DEBUG: ", stdLogFlags)
 	infoLogger  = log.New(os.Stderr, "INFO: ", stdLogFlags)
+	warnLogger  = log.New(os.Stderr, "WARN: ", stdLogFlags)
 	errorLogger = log.New(os.Stderr, "ERROR: ", stdLogFlags)
 	fatalLogger = log.New(os.Stderr, "FATAL: ", stdLogFlags)
 
@@ -27,10 +28,12 @@ func SuppressOutput(suppress bool) {
 	if suppress {
 		debugLogger.SetOutput(io.Discard)
 		infoLogger.SetOutput(io.Discard)
+		warnLogger.SetOutput(io.Discard)
 		errorLogger.SetOutput(io.Discard)
 	} else {
 		debugLogger.SetOutput(os.Stderr)
 		infoLogger.SetOutput(os.Stderr)
+		warnLogger.SetOutput(os.Stderr)
 		errorLogger.SetOutput(os.Stderr)
 	}
 }
@@ -61,6 +64,12 @@ func Infof(format string, args ...interface{}) {
 	infoLogger.Output(outputCallDepth, s) // nolint
 }
 
+// Warnf prints warning message according to a format
+func Warnf(format string, args ...interface{}) {
+	s := fmt.Sprintf(format, args...)
+	warnLogger.Output(outputCallDepth, s) // nolint
+}
+
 // Errorf prints warning message according to a format
 func Errorf(format string, args ...interface{}) {
 	s := fmt.Sprintf(format, args...)
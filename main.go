@@ -2,42 +2,82 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/contentsquare/chproxy/config"
 	"github.com/contentsquare/chproxy/log"
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/crypto/acme/autocert"
 )
 
-const pingEndpoint string = "/ping"
+const (
+	pingEndpoint    string = "/ping"
+	healthzEndpoint string = "/healthz"
+)
+
+// defaultShutdownDrainTimeout is used if `shutdown_drain_timeout` isn't set.
+const defaultShutdownDrainTimeout = 30 * time.Second
 
 var (
 	configFile = flag.String("config", "", "Proxy configuration filename")
 	version    = flag.Bool("version", false, "Prints current version and exits")
 	enableTCP6 = flag.Bool("enableTCP6", false, "Whether to enable listening for IPv6 TCP ports. "+
 		"By default only IPv4 TCP ports are listened")
+	validate = flag.Bool("validate", false, "Validates the config and exits without listening ports. "+
+		"Prints OK with the number of users, clusters and caches if the config is valid and all the found errors otherwise. "+
+		"Run `-validate -config=foo.yml` as the pre-deploy check")
 )
 
 var (
 	proxy *reverseProxy
 
 	// networks allow lists
-	allowedNetworksHTTP    atomic.Value
-	allowedNetworksHTTPS   atomic.Value
+	allowedNetworksHTTP  atomic.Value
+	allowedNetworksHTTPS atomic.Value
+	// allowedNetworksListen holds the networks of listen addresses
+	// overriding the networks of their protocol.
+	allowedNetworksListen  atomic.Value
 	allowedNetworksMetrics atomic.Value
+	allowedNetworksAdmin   atomic.Value
+	metricsCredentials     atomic.Pointer[credentials]
+	ipRateLimit            atomic.Pointer[ipRateLimiter]
+	nativeProxyConfig      atomic.Pointer[config.NativeProxy]
 	proxyHandler           atomic.Value
 	allowPing              atomic.Bool
+	enableAdmin            atomic.Bool
+	clickhouseExceptions   atomic.Bool
+
+	// currentConfig holds the last successfully applied config.
+	currentConfig atomic.Value
+
+	// reloadLock serializes config reloads.
+	reloadLock sync.Mutex
+
+	// servers holds the running servers, so they may be shut down.
+	servers     []*http.Server
+	serversLock sync.Mutex
+
+	// shuttingDown is set once in-flight requests are being drained.
+	shuttingDown atomic.Bool
 )
 
 func main() {
@@ -46,6 +86,9 @@ func main() {
 		fmt.Printf("%s\n", versionString())
 		os.Exit(0)
 	}
+	if *validate {
+		os.Exit(validateConfigFile(*configFile, os.Stdout, os.Stderr))
+	}
 
 	log.Infof("%s", versionString())
 	log.Infof("Loading config: %s", *configFile)
@@ -60,8 +103,12 @@ func main() {
 	configSuccess.Set(1)
 	configSuccessTime.Set(float64(time.Now().Unix()))
 	log.Infof("Loading config %q: successful", *configFile)
+	proxy.recoverInsertBatches()
 
 	setupReloadConfigWatch()
+	setupReloadCertWatch()
+	setupReopenAuditLogWatch()
+	setupReloadOnChangeWatch(cfg)
 
 	server := cfg.Server
 	if len(server.HTTP.ListenAddr) == 0 && len(server.HTTPS.ListenAddr) == 0 {
@@ -75,13 +122,19 @@ func main() {
 	notifyReady()
 
 	if len(server.HTTPS.ListenAddr) != 0 {
-		go serveTLS(server.HTTPS)
+		tlsCfg := newServerTLSConfig(server.HTTPS)
+		for _, la := range server.HTTPS.ListenAddr {
+			go serveTLS(server.HTTPS, tlsCfg, la.Addr)
+		}
+	}
+	for _, la := range server.HTTP.ListenAddr {
+		go serve(server.HTTP, la.Addr)
 	}
-	if len(server.HTTP.ListenAddr) != 0 {
-		go serve(server.HTTP)
+	if len(server.NativeProxy.ListenAddr) != 0 {
+		go serveNative(server.NativeProxy.ListenAddr)
 	}
 
-	select {}
+	waitForShutdown()
 }
 
 func notifyReady() {
@@ -110,6 +163,50 @@ func setupReloadConfigWatch() {
 	}()
 }
 
+// waitForShutdown blocks until SIGTERM is received
+// and then drains in-flight requests.
+func waitForShutdown() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM)
+	<-c
+
+	// nolint:forcetypeassert // We will cover this by tests as we control what is stored.
+	cfg := currentConfig.Load().(*config.Config)
+	timeout := time.Duration(cfg.Server.ShutdownDrainTimeout)
+	if timeout == 0 {
+		timeout = defaultShutdownDrainTimeout
+	}
+	log.Infof("SIGTERM received. Draining in-flight requests for up to %s ...", timeout)
+	shutdown(timeout)
+	log.Infof("Shutdown completed")
+}
+
+// shutdown stops accepting new connections and waits up to timeout
+// for in-flight requests to complete. Remaining connections are closed then.
+func shutdown(timeout time.Duration) {
+	shuttingDown.Store(true)
+	shutdownInProgress.Set(1)
+	defer shutdownInProgress.Set(0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	serversLock.Lock()
+	defer serversLock.Unlock()
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				log.Errorf("cannot drain in-flight requests: %s; closing remaining connections", err)
+				s.Close()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
 var autocertManager *autocert.Manager
 
 func newAutocertManager(cfg config.Autocert) *autocert.Manager {
@@ -151,27 +248,42 @@ func newListener(listenAddr string) net.Listener {
 	return ln
 }
 
-func serveTLS(cfg config.HTTPS) {
-	ln := newListener(cfg.ListenAddr)
-
-	h := http.HandlerFunc(serveHTTP)
-
+// newServerTLSConfig builds the TLS config shared by all the https listeners.
+func newServerTLSConfig(cfg config.HTTPS) *tls.Config {
 	tlsCfg, err := cfg.TLS.BuildTLSConfig(autocertManager)
 	if err != nil {
 		log.Fatalf("cannot build TLS config: %s", err)
 	}
+	if len(cfg.KeyFile) > 0 && len(cfg.CertFile) > 0 {
+		// Serve the certificate via GetCertificate, so it may be reloaded on SIGUSR2.
+		cr, err := newCertReloader(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			log.Fatalf("cannot build TLS config: %s", err)
+		}
+		tlsCertReloader.Store(cr)
+		tlsCfg.Certificates = nil
+		tlsCfg.GetCertificate = cr.GetCertificate
+	}
+	return tlsCfg
+}
+
+func serveTLS(cfg config.HTTPS, tlsCfg *tls.Config, listenAddr string) {
+	ln := newListener(listenAddr)
+
+	h := withListenAddr(listenAddr, http.HandlerFunc(serveHTTP))
+
 	tln := tls.NewListener(ln, tlsCfg)
-	log.Infof("Serving https on %q", cfg.ListenAddr)
-	if err := listenAndServe(tln, h, cfg.TimeoutCfg); err != nil {
-		log.Fatalf("TLS server error on %q: %s", cfg.ListenAddr, err)
+	log.Infof("Serving https on %q", listenAddr)
+	if err := listenAndServe(tln, h, cfg.TimeoutCfg); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("TLS server error on %q: %s", listenAddr, err)
 	}
 }
 
-func serve(cfg config.HTTP) {
+func serve(cfg config.HTTP, listenAddr string) {
 	var h http.Handler
-	ln := newListener(cfg.ListenAddr)
+	ln := newListener(listenAddr)
 
-	h = http.HandlerFunc(serveHTTP)
+	h = withListenAddr(listenAddr, http.HandlerFunc(serveHTTP))
 	if cfg.ForceAutocertHandler {
 		if autocertManager == nil {
 			panic("BUG: autocertManager is not inited")
@@ -184,12 +296,28 @@ func serve(cfg config.HTTP) {
 		}
 		h = autocertManager.HTTPHandler(h)
 	}
-	log.Infof("Serving http on %q", cfg.ListenAddr)
-	if err := listenAndServe(ln, h, cfg.TimeoutCfg); err != nil {
-		log.Fatalf("HTTP server error on %q: %s", cfg.ListenAddr, err)
+	log.Infof("Serving http on %q", listenAddr)
+	if err := listenAndServe(ln, h, cfg.TimeoutCfg); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("HTTP server error on %q: %s", listenAddr, err)
 	}
 }
 
+// listenAddrContextKey is the key of the configured listen address
+// the request is received on in the request context.
+type listenAddrContextKey struct{}
+
+// withListenAddr passes the configured listen address to h via the request context,
+// so the networks allowed for the address may be checked.
+//
+// http.LocalAddrContextKey isn't used, since it contains the address
+// of the interface the connection is accepted on instead of the configured one.
+func withListenAddr(listenAddr string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), listenAddrContextKey{}, listenAddr)
+		h.ServeHTTP(rw, r.WithContext(ctx))
+	})
+}
+
 func newServer(ln net.Listener, h http.Handler, cfg config.TimeoutCfg) *http.Server {
 	// nolint:gosec // We already configured ReadTimeout, so no need to set ReadHeaderTimeout as well.
 	return &http.Server{
@@ -206,6 +334,9 @@ func newServer(ln net.Listener, h http.Handler, cfg config.TimeoutCfg) *http.Ser
 
 func listenAndServe(ln net.Listener, h http.Handler, cfg config.TimeoutCfg) error {
 	s := newServer(ln, h, cfg)
+	serversLock.Lock()
+	servers = append(servers, s)
+	serversLock.Unlock()
 	return s.Serve(ln)
 }
 
@@ -216,7 +347,22 @@ func serveHTTP(rw http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet, http.MethodPost:
 		// Only GET and POST methods are supported.
+	case http.MethodDelete:
+		// Except for removing cluster nodes via the admin API
+		// and ending cache transactions.
+		if !strings.HasPrefix(r.URL.Path, adminClustersPrefix) && !strings.HasPrefix(r.URL.Path, cacheTransactionsPrefix) {
+			err := fmt.Errorf("%q: unsupported method %q", r.RemoteAddr, r.Method)
+			rw.Header().Set("Connection", "close")
+			respondWith(rw, err, http.StatusMethodNotAllowed)
+			return
+		}
 	case http.MethodOptions:
+		// nolint:forcetypeassert // We will cover this by tests as we control what is stored.
+		cfg := currentConfig.Load().(*config.Config)
+		if cfg.Server.CORS.Enable && isCORSPreflight(r) {
+			serveCORSPreflight(rw, r, cfg.Server.CORS)
+			return
+		}
 		// This is required for CORS shit :)
 		rw.Header().Set("Allow", "GET,POST")
 		return
@@ -230,46 +376,74 @@ func serveHTTP(rw http.ResponseWriter, r *http.Request) {
 	switch r.URL.Path {
 	case "/favicon.ico":
 	case "/metrics":
-		// nolint:forcetypeassert // We will cover this by tests as we control what is stored.
-		an := allowedNetworksMetrics.Load().(*config.Networks)
-		if !an.Contains(r.RemoteAddr) {
-			err := fmt.Errorf("connections to /metrics are not allowed from %s", r.RemoteAddr)
-			rw.Header().Set("Connection", "close")
-			respondWith(rw, err, http.StatusForbidden)
+		if !checkMetricsAccess(rw, r) {
 			return
 		}
 		proxy.refreshCacheMetrics()
 		promHandler.ServeHTTP(rw, r)
+	case queriesEndpoint:
+		if !checkMetricsAccess(rw, r) {
+			return
+		}
+		proxy.serveQueries(rw, r)
+	case cacheTransactionsEndpoint:
+		if !checkMetricsAccess(rw, r) {
+			return
+		}
+		proxy.serveCacheTransactions(rw, r)
+	case cacheInvalidateEndpoint:
+		if !checkMetricsAccess(rw, r) {
+			return
+		}
+		proxy.serveCacheInvalidate(rw, r)
+	case slowQueriesEndpoint:
+		if !checkMetricsAccess(rw, r) {
+			return
+		}
+		proxy.serveSlowQueries(rw, r)
+	case adminReloadEndpoint, adminErrorCodesEndpoint:
+		serveAdmin(rw, r)
+	case healthzEndpoint:
+		if err := checkListenerNetworks(r); err != nil {
+			rw.Header().Set("Connection", "close")
+			respondWith(rw, err, http.StatusForbidden)
+			return
+		}
+		serveHealthz(rw, r)
 	case "/", "/query", pingEndpoint:
-		var err error
-
 		if r.URL.Path == pingEndpoint && !allowPing.Load() {
-			err = fmt.Errorf("ping is not allowed")
+			err := fmt.Errorf("ping is not allowed")
 			respondWith(rw, err, http.StatusForbidden)
 			return
 		}
 
-		// nolint:forcetypeassert // We will cover this by tests as we control what is stored.
-		proxyHandler := proxyHandler.Load().(*ProxyHandler)
-		r.RemoteAddr = proxyHandler.GetRemoteAddr(r)
-
-		var an *config.Networks
-		if r.TLS != nil {
-			// nolint:forcetypeassert // We will cover this by tests as we control what is stored.
-			an = allowedNetworksHTTPS.Load().(*config.Networks)
-			err = fmt.Errorf("https connections are not allowed from %s", r.RemoteAddr)
-		} else {
-			// nolint:forcetypeassert // We will cover this by tests as we control what is stored.
-			an = allowedNetworksHTTP.Load().(*config.Networks)
-			err = fmt.Errorf("http connections are not allowed from %s", r.RemoteAddr)
-		}
-		if !an.Contains(r.RemoteAddr) {
+		if err := checkListenerNetworks(r); err != nil {
 			rw.Header().Set("Connection", "close")
 			respondWith(rw, err, http.StatusForbidden)
 			return
 		}
+		if err := checkIPRateLimit(rw, r); err != nil {
+			respondWith(rw, err, http.StatusTooManyRequests)
+			return
+		}
 		proxy.ServeHTTP(rw, r)
 	default:
+		if strings.HasPrefix(r.URL.Path, adminClustersPrefix) {
+			serveAdmin(rw, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, queriesPrefix) {
+			if checkMetricsAccess(rw, r) {
+				proxy.serveQueries(rw, r)
+			}
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, cacheTransactionsPrefix) {
+			if checkMetricsAccess(rw, r) {
+				proxy.serveCacheTransactions(rw, r)
+			}
+			return
+		}
 		badRequest.Inc()
 		err := fmt.Errorf("%q: unsupported path: %q", r.RemoteAddr, r.URL.Path)
 		rw.Header().Set("Connection", "close")
@@ -277,6 +451,126 @@ func serveHTTP(rw http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// checkMetricsAccess checks r against `allowed_networks` and credentials
+// of /metrics, which apply to /queries, /cache/* and /debug/slow_queries endpoints as well.
+// It responds with an error to rw if the access isn't allowed.
+func checkMetricsAccess(rw http.ResponseWriter, r *http.Request) bool {
+	// nolint:forcetypeassert // We will cover this by tests as we control what is stored.
+	an := allowedNetworksMetrics.Load().(*config.Networks)
+	if !an.Contains(r.RemoteAddr) {
+		err := fmt.Errorf("connections to %s are not allowed from %s", r.URL.Path, r.RemoteAddr)
+		rw.Header().Set("Connection", "close")
+		respondWith(rw, err, http.StatusForbidden)
+		return false
+	}
+	if !metricsCredentials.Load().check(r) {
+		err := fmt.Errorf("invalid credentials for %s from %s", r.URL.Path, r.RemoteAddr)
+		rw.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+		respondWith(rw, err, http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// credentials are checked against basic auth credentials of requests.
+type credentials struct {
+	user     string
+	password string
+}
+
+func newCredentials(user, password string) *credentials {
+	if len(user) == 0 {
+		return nil
+	}
+	return &credentials{
+		user:     user,
+		password: password,
+	}
+}
+
+// check reports whether r contains valid credentials.
+// Any request is valid if c is nil.
+func (c *credentials) check(r *http.Request) bool {
+	if c == nil {
+		return true
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	// Both values are compared to not reveal which one is wrong via timing.
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(c.user))
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(c.password))
+	return userOK&passwordOK == 1
+}
+
+// checkListenerNetworks sets the remote address of r according to the proxy
+// config and checks it against the allowed networks of the listener.
+func checkListenerNetworks(r *http.Request) error {
+	// nolint:forcetypeassert // We will cover this by tests as we control what is stored.
+	proxyHandler := proxyHandler.Load().(*ProxyHandler)
+	r.RemoteAddr = proxyHandler.GetRemoteAddr(r)
+
+	var an *config.Networks
+	var err error
+	if r.TLS != nil {
+		// nolint:forcetypeassert // We will cover this by tests as we control what is stored.
+		an = allowedNetworksHTTPS.Load().(*config.Networks)
+		err = fmt.Errorf("https connections are not allowed from %s", r.RemoteAddr)
+	} else {
+		// nolint:forcetypeassert // We will cover this by tests as we control what is stored.
+		an = allowedNetworksHTTP.Load().(*config.Networks)
+		err = fmt.Errorf("http connections are not allowed from %s", r.RemoteAddr)
+	}
+	if listenAddr, ok := r.Context().Value(listenAddrContextKey{}).(string); ok {
+		// nolint:forcetypeassert // We will cover this by tests as we control what is stored.
+		if lan := allowedNetworksListen.Load().(map[string]*config.Networks)[listenAddr]; lan != nil {
+			an = lan
+		}
+	}
+	if !an.Contains(r.RemoteAddr) {
+		return err
+	}
+	return nil
+}
+
+// listenNetworks returns the networks of listen addresses from cfg
+// overriding the networks of their protocol.
+func listenNetworks(cfg *config.Config) map[string]*config.Networks {
+	networks := make(map[string]*config.Networks)
+	for _, addrs := range []config.ListenAddrs{cfg.Server.HTTP.ListenAddr, cfg.Server.HTTPS.ListenAddr} {
+		for i := range addrs {
+			if len(addrs[i].NetworksOrGroups) > 0 {
+				networks[addrs[i].Addr] = &addrs[i].AllowedNetworks
+			}
+		}
+	}
+	return networks
+}
+
+// checkListenAddrs returns an error if listen addresses of cfg differ from prev,
+// since listeners are started only once and cannot be changed on config reload.
+func checkListenAddrs(prev, cfg *config.Config) error {
+	addrs := func(c *config.Config) []string {
+		var res []string
+		for _, la := range c.Server.HTTP.ListenAddr {
+			res = append(res, "http://"+la.Addr)
+		}
+		for _, la := range c.Server.HTTPS.ListenAddr {
+			res = append(res, "https://"+la.Addr)
+		}
+		if len(c.Server.NativeProxy.ListenAddr) > 0 {
+			res = append(res, "native://"+c.Server.NativeProxy.ListenAddr)
+		}
+		sort.Strings(res)
+		return res
+	}
+	if !slices.Equal(addrs(prev), addrs(cfg)) {
+		return errors.New("`listen_addr` cannot be changed on config reload; restart chproxy to apply it")
+	}
+	return nil
+}
+
 func loadConfig() (*config.Config, error) {
 	if *configFile == "" {
 		log.Fatalf("Missing -config flag")
@@ -288,6 +582,30 @@ func loadConfig() (*config.Config, error) {
 	return cfg, nil
 }
 
+// validateConfigFile checks whether the config from filename may be applied.
+// Clusters, caches and users are built the same way as by applyConfig,
+// but listeners aren't opened, heartbeats aren't started and redis isn't dialed.
+//
+// Prints OK with the summary of the config to stdout if the config is valid
+// and all the found errors to stderr otherwise. Returns the exit code.
+func validateConfigFile(filename string, stdout, stderr io.Writer) int {
+	if filename == "" {
+		fmt.Fprintln(stderr, "Missing -config flag")
+		return 1
+	}
+	cfg, err := config.LoadFile(filename)
+	if err != nil {
+		fmt.Fprintf(stderr, "can't load config %q: %s\n", filename, err)
+		return 1
+	}
+	if err := validateConfig(cfg); err != nil {
+		fmt.Fprintf(stderr, "invalid config %q:\n%s\n", filename, err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "OK: %d users, %d clusters, %d caches\n", len(cfg.Users), len(cfg.Clusters), len(cfg.Caches))
+	return 0
+}
+
 // a configuration parameter value that is used in proxy initialization
 // changed
 func proxyConfigChanged(cfgCp *config.ConnectionPool, rp *reverseProxy) bool {
@@ -304,21 +622,95 @@ func applyConfig(cfg *config.Config) error {
 	}
 	allowedNetworksHTTP.Store(&cfg.Server.HTTP.AllowedNetworks)
 	allowedNetworksHTTPS.Store(&cfg.Server.HTTPS.AllowedNetworks)
+	allowedNetworksListen.Store(listenNetworks(cfg))
 	allowedNetworksMetrics.Store(&cfg.Server.Metrics.AllowedNetworks)
+	metricsCredentials.Store(newCredentials(cfg.Server.Metrics.User, cfg.Server.Metrics.Password))
+	ipRateLimit.Store(newIPRateLimiter(cfg.Server.PerIPRateLimit, ipRateLimit.Load()))
+	nativeProxyConfig.Store(&cfg.Server.NativeProxy)
+	allowedNetworksAdmin.Store(&cfg.Server.Admin.AllowedNetworks)
 	proxyHandler.Store(NewProxyHandler(&cfg.Server.Proxy))
 	allowPing.Store(cfg.AllowPing)
+	enableAdmin.Store(cfg.Server.Admin.Enable)
+	clickhouseExceptions.Store(cfg.Server.ClickHouseExceptions)
+	currentConfig.Store(cfg)
 	log.SetDebug(cfg.LogDebug)
 	log.Infof("Loaded config:\n%s", cfg)
 
 	return nil
 }
 
+// reloadConfig validates the config file and applies it
+// if it is valid. The old config is kept otherwise.
 func reloadConfig() error {
+	_, _, err := reloadConfigWithDiff()
+	return err
+}
+
+// reloadConfigWithDiff is like reloadConfig, but it also returns
+// the difference between the old and the new configs
+// and the HTTP status code for the error.
+func reloadConfigWithDiff() (*config.Diff, int, error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	diff, status, err := loadAndApplyConfig()
+	if err != nil {
+		configSuccess.Set(0)
+		configReloads.With(prometheus.Labels{"result": "failure"}).Inc()
+		return nil, status, err
+	}
+	configSuccess.Set(1)
+	configSuccessTime.Set(float64(time.Now().Unix()))
+	configReloads.With(prometheus.Labels{"result": "success"}).Inc()
+	return diff, status, nil
+}
+
+// loadAndApplyConfig must be called under reloadLock.
+func loadAndApplyConfig() (*config.Diff, int, error) {
 	cfg, err := loadConfig()
 	if err != nil {
-		return err
+		return nil, http.StatusBadRequest, err
+	}
+	if err := validateConfig(cfg); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	var diff *config.Diff
+	prev, _ := currentConfig.Load().(*config.Config)
+	if prev != nil {
+		if err := checkListenAddrs(prev, cfg); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		if diff, err = config.NewDiff(prev, cfg); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+	}
+
+	if err := applyConfig(cfg); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if prev != nil {
+		log.Infof("Config %s changes:\n%s", *configFile, configDiff(prev, cfg))
+	}
+	return diff, http.StatusOK, nil
+}
+
+// configDiff returns the diff between the prev and cfg configs
+// without sensitive info. The diff is truncated to `max_diff_log_size`.
+func configDiff(prev, cfg *config.Config) string {
+	diff := cmp.Diff(prev.String(), cfg.String())
+	if len(diff) == 0 {
+		return "no changes"
+	}
+	if maxSize := int(cfg.MaxDiffLogSize); len(diff) > maxSize {
+		n := maxSize
+		// Do not split multi-byte chars.
+		for n > 0 && !utf8.RuneStart(diff[n]) {
+			n--
+		}
+		diff = fmt.Sprintf("%s\n... truncated to %d bytes of %d", diff[:n], maxSize, len(diff))
 	}
-	return applyConfig(cfg)
+	return diff
 }
 
 var (
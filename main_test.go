@@ -5,6 +5,7 @@ import (
 	"compress/gzip"
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
@@ -12,6 +13,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -23,7 +25,9 @@ import (
 	"github.com/contentsquare/chproxy/cache"
 	"github.com/contentsquare/chproxy/config"
 	"github.com/contentsquare/chproxy/log"
+	"github.com/google/go-cmp/cmp"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/contentsquare/chproxy/global/types"
@@ -114,7 +118,7 @@ func TestServe(t *testing.T) {
 					t.Fatalf("err while getting file %q info: %s", path, err)
 				}
 				rw := httptest.NewRecorder()
-				cc := proxy.caches["https_cache"]
+				cc := proxy.snapshot.Load().caches["https_cache"]
 
 				cachedData, err := cc.Get(key)
 
@@ -155,7 +159,7 @@ func TestServe(t *testing.T) {
 					Version:        cache.Version,
 				}
 
-				cc := proxy.caches["https_cache_max_payload_size"]
+				cc := proxy.snapshot.Load().caches["https_cache_max_payload_size"]
 				cachedData, err := cc.Get(key)
 
 				if cachedData != nil || err == nil {
@@ -194,7 +198,7 @@ func TestServe(t *testing.T) {
 
 				rw := httptest.NewRecorder()
 
-				cc := proxy.caches["https_cache_max_payload_size"]
+				cc := proxy.snapshot.Load().caches["https_cache_max_payload_size"]
 				cachedData, err := cc.Get(key)
 
 				if err != nil {
@@ -276,7 +280,7 @@ func TestServe(t *testing.T) {
 					t.Fatalf("err while getting file %q info: %s", path, err)
 				}
 				rw := httptest.NewRecorder()
-				cc := proxy.caches["https_cache"]
+				cc := proxy.snapshot.Load().caches["https_cache"]
 
 				cachedData, err := cc.Get(key)
 
@@ -416,7 +420,7 @@ func TestServe(t *testing.T) {
 			func(t *testing.T) {
 				req, err := http.NewRequest(http.MethodOptions, "http://127.0.0.1:9090?query=asd", nil)
 				checkErr(t, err)
-				resp, err := http.DefaultClient.Do(req)
+				resp, err := httpClient.Do(req)
 				checkErr(t, err)
 				expectedAllowHeader := "GET,POST"
 				if resp.Header.Get("Allow") != expectedAllowHeader {
@@ -426,7 +430,7 @@ func TestServe(t *testing.T) {
 
 				req, err = http.NewRequest(http.MethodConnect, "http://127.0.0.1:9090?query=asd", nil)
 				checkErr(t, err)
-				resp, err = http.DefaultClient.Do(req)
+				resp, err = httpClient.Do(req)
 				checkErr(t, err)
 				expected := fmt.Sprintf("unsupported method %q", http.MethodConnect)
 				checkResponse(t, resp.Body, expected)
@@ -442,6 +446,60 @@ func TestServe(t *testing.T) {
 			},
 			startHTTP,
 		},
+		{
+			"http user headers",
+			"testdata/http.headers.yml",
+			func(t *testing.T) {
+				req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:9090", strings.NewReader("SELECT HEADERS"))
+				checkErr(t, err)
+				req.Header.Set("X-ClickHouse-Format", "CSV")
+				req.Header.Set("X-Trace-Id", "abc")
+				resp, err := httpRequest(t, req, http.StatusOK)
+				checkErr(t, err)
+				// Headers of the user override the ones set by the client.
+				checkResponse(t, resp.Body, "X-ClickHouse-Quota: quota-default\nX-ClickHouse-Format: JSON\nX-Trace-Id: abc\n")
+				resp.Body.Close()
+			},
+			startHTTP,
+		},
+		{
+			"http cors",
+			"testdata/http.cors.yml",
+			func(t *testing.T) {
+				const origin = "https://dashboard.example.com"
+				req, err := http.NewRequest(http.MethodOptions, "http://127.0.0.1:9090", nil)
+				checkErr(t, err)
+				req.Header.Set("Origin", origin)
+				req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+				req.Header.Set("Access-Control-Request-Headers", "authorization, x-custom")
+				resp, err := httpRequest(t, req, http.StatusNoContent)
+				checkErr(t, err)
+				resp.Body.Close()
+				checkHeader(t, resp, "Access-Control-Allow-Origin", origin)
+				checkHeader(t, resp, "Access-Control-Allow-Methods", "GET, POST")
+				checkHeader(t, resp, "Access-Control-Allow-Headers", "Authorization, Content-Type, X-Custom")
+				checkHeader(t, resp, "Access-Control-Max-Age", "3600")
+
+				// The preflight for a method which isn't allowed is blocked.
+				req.Header.Set("Access-Control-Request-Method", http.MethodPut)
+				resp, err = httpRequest(t, req, http.StatusNoContent)
+				checkErr(t, err)
+				resp.Body.Close()
+				checkHeader(t, resp, "Access-Control-Allow-Origin", "")
+
+				// CORS headers of ClickHouse are replaced in the actual request.
+				req, err = http.NewRequest(http.MethodPost, "http://127.0.0.1:9090", strings.NewReader("SELECT CORS"))
+				checkErr(t, err)
+				req.Header.Set("Origin", origin)
+				resp, err = httpRequest(t, req, http.StatusOK)
+				checkErr(t, err)
+				checkResponse(t, resp.Body, "Ok.\n")
+				resp.Body.Close()
+				assert.Equal(t, []string{origin}, resp.Header.Values("Access-Control-Allow-Origin"))
+				checkHeader(t, resp, "Access-Control-Allow-Headers", "")
+			},
+			startHTTP,
+		},
 		{
 			"http POST request with session id",
 			"testdata/http-session-id.yml",
@@ -452,7 +510,7 @@ func TestServe(t *testing.T) {
 				req.Header.Set("Content-Type", "application/x-www-form-urlencoded;") // This makes it work
 
 				checkErr(t, err)
-				resp, err := http.DefaultClient.Do(req)
+				resp, err := httpClient.Do(req)
 				checkErr(t, err)
 
 				if resp.StatusCode != http.StatusOK || resp.StatusCode != http.StatusOK && resp.Header.Get("X-Clickhouse-Server-Session-Id") == "" {
@@ -468,6 +526,28 @@ func TestServe(t *testing.T) {
 			func(t *testing.T) {
 				httpGet(t, "http://127.0.0.1:9090?query=asd", http.StatusOK)
 				httpGet(t, "http://127.0.0.1:9090/metrics", http.StatusOK)
+				httpGet(t, "http://127.0.0.1:9090/queries", http.StatusOK)
+			},
+			startHTTP,
+		},
+		{
+			"http healthz",
+			"testdata/http.yml",
+			func(t *testing.T) {
+				resp := getHealthz(t)
+				checkHeader(t, resp, "Content-Type", "application/json")
+				checkResponse(t, resp.Body, `{"status":"ok","dependencies":{"cluster:default":"ok"}}`+"\n")
+				resp.Body.Close()
+			},
+			startHTTP,
+		},
+		{
+			"http healthz with redis cache",
+			"testdata/http.cache.redis.yml",
+			func(t *testing.T) {
+				resp := getHealthz(t)
+				checkResponse(t, resp.Body, `{"status":"ok","dependencies":{"cache:redis-cache":"ok","cluster:default":"ok"}}`+"\n")
+				resp.Body.Close()
 			},
 			startHTTP,
 		},
@@ -554,7 +634,7 @@ func TestServe(t *testing.T) {
 				req, err := http.NewRequest("POST", "http://127.0.0.1:9090", &buf)
 				checkErr(t, err)
 				req.Header.Set("Content-Encoding", "gzip")
-				resp, err := http.DefaultClient.Do(req)
+				resp, err := httpClient.Do(req)
 				checkErr(t, err)
 				body, _ := io.ReadAll(resp.Body)
 				if resp.StatusCode != http.StatusOK {
@@ -572,7 +652,7 @@ func TestServe(t *testing.T) {
 				buf := bytes.NewBufferString("SELECT * FROM system.numbers LIMIT 10")
 				req, err := http.NewRequest("POST", "http://127.0.0.1:9090", buf)
 				checkErr(t, err)
-				resp, err := http.DefaultClient.Do(req)
+				resp, err := httpClient.Do(req)
 				checkErr(t, err)
 				if resp.StatusCode != http.StatusOK {
 					t.Fatalf("unexpected status code: %d; expected: %d", resp.StatusCode, http.StatusOK)
@@ -593,7 +673,7 @@ func TestServe(t *testing.T) {
 				req, err := http.NewRequest("POST", "http://127.0.0.1:9090", &buf)
 				checkErr(t, err)
 				req.Header.Set("Content-Encoding", "gzip")
-				resp, err := http.DefaultClient.Do(req)
+				resp, err := httpClient.Do(req)
 				checkErr(t, err)
 				if resp.StatusCode != http.StatusGatewayTimeout {
 					t.Fatalf("unexpected status code: %d; expected: %d", resp.StatusCode, http.StatusGatewayTimeout)
@@ -632,6 +712,235 @@ func TestServe(t *testing.T) {
 				expected := "connections to /metrics are not allowed from 127.0.0.1"
 				checkResponse(t, resp.Body, expected)
 				resp.Body.Close()
+
+				resp = httpGet(t, "http://127.0.0.1:9090/queries", http.StatusForbidden)
+				checkResponse(t, resp.Body, "connections to /queries are not allowed from 127.0.0.1")
+				resp.Body.Close()
+			},
+			startHTTP,
+		},
+		{
+			"http metrics basic auth",
+			"testdata/http.metrics.auth.yml",
+			func(t *testing.T) {
+				resp := httpGet(t, "http://127.0.0.1:9090/metrics", http.StatusUnauthorized)
+				checkHeader(t, resp, "WWW-Authenticate", `Basic realm="metrics"`)
+				checkResponse(t, resp.Body, "invalid credentials for /metrics from 127.0.0.1")
+				resp.Body.Close()
+
+				req, err := http.NewRequest("GET", "http://127.0.0.1:9090/metrics", nil)
+				checkErr(t, err)
+				req.SetBasicAuth("prometheus", "wrong")
+				resp, err = httpRequest(t, req, http.StatusUnauthorized)
+				checkErr(t, err)
+				resp.Body.Close()
+
+				req.SetBasicAuth("prometheus", "secret")
+				resp, err = httpRequest(t, req, http.StatusOK)
+				checkErr(t, err)
+				resp.Body.Close()
+			},
+			startHTTP,
+		},
+		{
+			"http admin reload",
+			"testdata/http.admin.yml",
+			func(t *testing.T) {
+				resp := httpGet(t, "http://127.0.0.1:9090/admin/reload", http.StatusMethodNotAllowed)
+				resp.Body.Close()
+
+				cfg, err := os.ReadFile("testdata/http.admin.yml")
+				checkErr(t, err)
+				if err := os.MkdirAll(testDir, 0o755); err != nil {
+					t.Fatalf("cannot create %q: %s", testDir, err)
+				}
+				*configFile = testDir + "/http.admin.yml"
+				newCfg := strings.Replace(string(cfg), `to_user: "default"`, "to_user: \"default\"\n    max_concurrent_queries: 2", 1)
+				checkErr(t, os.WriteFile(*configFile, []byte(newCfg), 0o600))
+				reloads := func(result string) float64 {
+					return testutil.ToFloat64(configReloads.With(prometheus.Labels{"result": result}))
+				}
+				success, failure := reloads("success"), reloads("failure")
+
+				req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:9090/admin/reload", nil)
+				checkErr(t, err)
+				resp, err = httpRequest(t, req, http.StatusOK)
+				checkErr(t, err)
+				checkHeader(t, resp, "Content-Type", "application/json")
+				var diff config.Diff
+				checkErr(t, json.NewDecoder(resp.Body).Decode(&diff))
+				resp.Body.Close()
+				assert.Equal(t, map[string]interface{}{"users[default].max_concurrent_queries": float64(2)}, diff.Added)
+				assert.Empty(t, diff.Removed)
+				assert.Empty(t, diff.Changed)
+				assert.Equal(t, uint32(2), proxy.snapshot.Load().users["default"].maxConcurrentQueries)
+				assert.Equal(t, success+1, reloads("success"))
+				assert.Equal(t, float64(1), testutil.ToFloat64(configSuccess))
+
+				checkErr(t, os.WriteFile(*configFile, []byte(strings.Replace(newCfg, `to_user: "default"`, `to_user: "foobar"`, 1)), 0o600))
+				req, err = http.NewRequest(http.MethodPost, "http://127.0.0.1:9090/admin/reload", nil)
+				checkErr(t, err)
+				resp, err = httpRequest(t, req, http.StatusBadRequest)
+				checkErr(t, err)
+				checkResponse(t, resp.Body, "unknown `to_user` \"foobar\"")
+				resp.Body.Close()
+				assert.Equal(t, "default", proxy.snapshot.Load().users["default"].toUser)
+				assert.Equal(t, failure+1, reloads("failure"))
+				assert.Equal(t, float64(0), testutil.ToFloat64(configSuccess))
+
+				req = httptest.NewRequest(http.MethodGet, "/admin/foobar", nil)
+				req.RemoteAddr = "127.0.0.1:1234"
+				rw := httptest.NewRecorder()
+				serveAdmin(rw, req)
+				assert.Equal(t, http.StatusBadRequest, rw.Code)
+				assert.Contains(t, rw.Body.String(), "unsupported path: \"/admin/foobar\"")
+			},
+			startHTTP,
+		},
+		{
+			"http admin cluster nodes",
+			"testdata/http.admin.yml",
+			func(t *testing.T) {
+				hosts := func() []string {
+					var hosts []string
+					for _, h := range proxy.snapshot.Load().clusters["default"].replicas[0].getHosts() {
+						hosts = append(hosts, h.Host())
+					}
+					return hosts
+				}
+				doRequest := func(method, path, body string, statusCode int) *http.Response {
+					req, err := http.NewRequest(method, "http://127.0.0.1:9090"+path, strings.NewReader(body))
+					checkErr(t, err)
+					resp, err := httpRequest(t, req, statusCode)
+					checkErr(t, err)
+					return resp
+				}
+
+				resp := doRequest(http.MethodPost, "/admin/clusters/default/nodes", `{"node": "127.0.0.1:18125"}`, http.StatusOK)
+				checkHeader(t, resp, "Content-Type", "application/json")
+				var node adminNode
+				checkErr(t, json.NewDecoder(resp.Body).Decode(&node))
+				resp.Body.Close()
+				assert.Equal(t, adminNode{Cluster: "default", Replica: "default", Node: "127.0.0.1:18125"}, node)
+				assert.Equal(t, []string{"127.0.0.1:18124", "127.0.0.1:18125"}, hosts())
+
+				resp = doRequest(http.MethodPost, "/admin/clusters/default/nodes", `{"node": "127.0.0.1:18125"}`, http.StatusConflict)
+				checkResponse(t, resp.Body, "node \"127.0.0.1:18125\" already exists in replica \"default\"")
+				resp.Body.Close()
+
+				resp = doRequest(http.MethodPost, "/admin/clusters/foobar/nodes", `{"node": "127.0.0.1:18125"}`, http.StatusNotFound)
+				checkResponse(t, resp.Body, "unknown cluster \"foobar\"")
+				resp.Body.Close()
+
+				resp = doRequest(http.MethodDelete, "/admin/clusters/default/nodes/127.0.0.1:18125", "", http.StatusOK)
+				resp.Body.Close()
+				assert.Equal(t, []string{"127.0.0.1:18124"}, hosts())
+
+				resp = doRequest(http.MethodDelete, "/admin/clusters/default/nodes/127.0.0.1:18124", "", http.StatusConflict)
+				checkResponse(t, resp.Body, "cannot remove the last node \"127.0.0.1:18124\" of replica \"default\"")
+				resp.Body.Close()
+
+				resp = doRequest(http.MethodDelete, "/admin/clusters/default/nodes/127.0.0.1:18126", "", http.StatusNotFound)
+				resp.Body.Close()
+			},
+			startHTTP,
+		},
+		{
+			"http admin cluster scheme",
+			"testdata/http.admin.yml",
+			func(t *testing.T) {
+				doRequest := func(method, path, body string, statusCode int) *http.Response {
+					req, err := http.NewRequest(method, "http://127.0.0.1:9090"+path, strings.NewReader(body))
+					checkErr(t, err)
+					resp, err := httpRequest(t, req, statusCode)
+					checkErr(t, err)
+					return resp
+				}
+				getScheme := func() adminScheme {
+					resp := doRequest(http.MethodGet, "/admin/clusters/default/scheme", "", http.StatusOK)
+					defer resp.Body.Close()
+					checkHeader(t, resp, "Content-Type", "application/json")
+					var scheme adminScheme
+					checkErr(t, json.NewDecoder(resp.Body).Decode(&scheme))
+					return scheme
+				}
+
+				assert.Equal(t, adminScheme{Cluster: "default", Scheme: "http"}, getScheme())
+
+				resp := doRequest(http.MethodPost, "/admin/clusters/default/scheme", `{"scheme": "https"}`, http.StatusOK)
+				resp.Body.Close()
+				assert.Equal(t, adminScheme{Cluster: "default", Scheme: "https"}, getScheme())
+				for _, h := range proxy.snapshot.Load().clusters["default"].replicas[0].getHosts() {
+					assert.Equal(t, "https", h.Scheme())
+				}
+
+				resp = doRequest(http.MethodPost, "/admin/clusters/default/nodes", `{"node": "127.0.0.1:18125"}`, http.StatusOK)
+				resp.Body.Close()
+				hosts := proxy.snapshot.Load().clusters["default"].replicas[0].getHosts()
+				assert.Equal(t, "https", hosts[len(hosts)-1].Scheme(), "added nodes must use the new scheme")
+
+				resp = doRequest(http.MethodPost, "/admin/clusters/default/scheme", `{"scheme": "ftp"}`, http.StatusBadRequest)
+				checkResponse(t, resp.Body, "`scheme` must be `http` or `https`, got \"ftp\"")
+				resp.Body.Close()
+
+				resp = doRequest(http.MethodPost, "/admin/clusters/foobar/scheme", `{"scheme": "https"}`, http.StatusNotFound)
+				checkResponse(t, resp.Body, "unknown cluster \"foobar\"")
+				resp.Body.Close()
+
+				resp = doRequest(http.MethodDelete, "/admin/clusters/default/scheme", "", http.StatusMethodNotAllowed)
+				resp.Body.Close()
+			},
+			startHTTP,
+		},
+		{
+			"http admin error codes",
+			"testdata/http.admin.yml",
+			func(t *testing.T) {
+				req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:9090/admin/error_codes", nil)
+				checkErr(t, err)
+				resp, err := httpRequest(t, req, http.StatusMethodNotAllowed)
+				checkErr(t, err)
+				resp.Body.Close()
+
+				resp = httpGet(t, "http://127.0.0.1:9090/admin/error_codes?limit=foo", http.StatusBadRequest)
+				checkResponse(t, resp.Body, "`limit` must be a positive integer")
+				resp.Body.Close()
+
+				clickhouseErrorCodes.With(prometheus.Labels{"cluster": "default", "error_code": "60"}).Add(3)
+				clickhouseErrorCodes.With(prometheus.Labels{"cluster": "default", "error_code": "62"}).Add(1)
+				resp = httpGet(t, "http://127.0.0.1:9090/admin/error_codes?limit=1", http.StatusOK)
+				checkHeader(t, resp, "Content-Type", "application/json")
+				var codes []adminErrorCode
+				checkErr(t, json.NewDecoder(resp.Body).Decode(&codes))
+				resp.Body.Close()
+				assert.Len(t, codes, 1)
+				assert.Equal(t, "60", codes[0].ErrorCode)
+			},
+			startHTTP,
+		},
+		{
+			"http admin networks",
+			"testdata/http.admin.networks.yml",
+			func(t *testing.T) {
+				req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:9090/admin/reload", nil)
+				checkErr(t, err)
+				resp, err := httpRequest(t, req, http.StatusForbidden)
+				checkErr(t, err)
+				checkResponse(t, resp.Body, "connections to /admin/reload are not allowed from 127.0.0.1")
+				resp.Body.Close()
+			},
+			startHTTP,
+		},
+		{
+			"http admin disabled",
+			"testdata/http.yml",
+			func(t *testing.T) {
+				req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:9090/admin/reload", nil)
+				checkErr(t, err)
+				resp, err := httpRequest(t, req, http.StatusBadRequest)
+				checkErr(t, err)
+				checkResponse(t, resp.Body, "unsupported path")
+				resp.Body.Close()
 			},
 			startHTTP,
 		},
@@ -775,7 +1084,7 @@ func TestServe(t *testing.T) {
 				ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(100*time.Millisecond))
 				defer cancel()
 				req = req.WithContext(ctx)
-				_, err = http.DefaultClient.Do(req)
+				_, err = httpClient.Do(req)
 				expErr := "context deadline exceeded"
 				if err == nil {
 					t.Fatal("expected deadline error")
@@ -928,7 +1237,7 @@ func TestServe(t *testing.T) {
 			}()
 
 			var c *cluster
-			for _, cluster := range proxy.clusters {
+			for _, cluster := range proxy.snapshot.Load().clusters {
 				c = cluster
 				break
 			}
@@ -949,6 +1258,28 @@ func TestServe(t *testing.T) {
 	}
 }
 
+// getHealthz waits until the hosts become active after the first heartbeat
+// and returns the successful /healthz response.
+func getHealthz(t *testing.T) *http.Response {
+	var resp *http.Response
+	assert.Eventually(t, func() bool {
+		r, err := httpClient.Get("http://127.0.0.1:9090/healthz")
+		if err != nil {
+			return false
+		}
+		if r.StatusCode != http.StatusOK {
+			r.Body.Close()
+			return false
+		}
+		resp = r
+		return true
+	}, 5*time.Second, 50*time.Millisecond)
+	if resp == nil {
+		t.Fatalf("/healthz didn't respond with %d", http.StatusOK)
+	}
+	return resp
+}
+
 func checkFilesCount(t *testing.T, dir string, expectedLen int) {
 	files, err := os.ReadDir(dir)
 	if err != nil {
@@ -959,8 +1290,15 @@ func checkFilesCount(t *testing.T, dir string, expectedLen int) {
 	}
 }
 
+// Servers of all the test cases listen on the same addresses, so test clients
+// don't keep connections alive, which would be reused by the next test case.
+var httpClient = &http.Client{Transport: &http.Transport{
+	DisableKeepAlives: true,
+}}
+
 var tlsClient = &http.Client{Transport: &http.Transport{
-	TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+	DisableKeepAlives: true,
 }}
 
 func startTLS() (*http.Server, chan struct{}) {
@@ -972,9 +1310,9 @@ func startTLS() (*http.Server, chan struct{}) {
 		panic(fmt.Sprintf("error while applying config: %s", err))
 	}
 	done := make(chan struct{})
-	ln, err := net.Listen("tcp4", cfg.Server.HTTPS.ListenAddr)
+	ln, err := net.Listen("tcp4", cfg.Server.HTTPS.ListenAddr[0].Addr)
 	if err != nil {
-		panic(fmt.Sprintf("cannot listen for %q: %s", cfg.Server.HTTPS.ListenAddr, err))
+		panic(fmt.Sprintf("cannot listen for %q: %s", cfg.Server.HTTPS.ListenAddr[0].Addr, err))
 	}
 	tlsCfg, err := cfg.Server.HTTPS.TLS.BuildTLSConfig(autocertManager)
 	if err != nil {
@@ -999,9 +1337,9 @@ func startHTTP() (*http.Server, chan struct{}) {
 		panic(fmt.Sprintf("error while applying config: %s", err))
 	}
 	done := make(chan struct{})
-	ln, err := net.Listen("tcp4", cfg.Server.HTTP.ListenAddr)
+	ln, err := net.Listen("tcp4", cfg.Server.HTTP.ListenAddr[0].Addr)
 	if err != nil {
-		panic(fmt.Sprintf("cannot listen for %q: %s", cfg.Server.HTTP.ListenAddr, err))
+		panic(fmt.Sprintf("cannot listen for %q: %s", cfg.Server.HTTP.ListenAddr[0].Addr, err))
 	}
 	h := http.HandlerFunc(serveHTTP)
 	s := newServer(ln, h, config.TimeoutCfg{})
@@ -1080,6 +1418,16 @@ func fakeCHHandler(w http.ResponseWriter, r *http.Request) {
 	case q == "SELECT 1 FORMAT TabSeparatedWithNamesAndTypes":
 		w.WriteHeader(http.StatusOK)
 		w.Write(bytesWithInvalidUTFPairs)
+	case q == "SELECT CORS":
+		// ClickHouse sends CORS headers with `add_http_cors_header` setting.
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Headers", "origin, x-requested-with")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "Ok.\n")
+	case q == "SELECT HEADERS":
+		for _, name := range []string{"X-ClickHouse-Quota", "X-ClickHouse-Format", "X-Trace-Id"} {
+			fmt.Fprintf(w, "%s: %s\n", name, r.Header.Get(name))
+		}
 	case q == "SELECT MaxPayloadSize":
 		w.WriteHeader(http.StatusOK)
 
@@ -1237,8 +1585,33 @@ func TestNewTLSConfig(t *testing.T) {
 	}
 }
 
+func TestServeListenAddrs(t *testing.T) {
+	oldConfigFile := *configFile
+	defer func() { *configFile = oldConfigFile }()
+	*configFile = "testdata/http.listen-addrs.yml"
+	applyTestConfig(t)
+
+	// nolint:forcetypeassert // We will cover this by tests as we control what is stored.
+	cfg := currentConfig.Load().(*config.Config)
+	for _, la := range cfg.Server.HTTP.ListenAddr {
+		ln, err := net.Listen("tcp4", la.Addr)
+		checkErr(t, err)
+		s := newServer(ln, withListenAddr(la.Addr, http.HandlerFunc(serveHTTP)), config.TimeoutCfg{})
+		go s.Serve(ln)
+		defer s.Close()
+	}
+
+	resp := httpGet(t, "http://127.0.0.1:9090?query=asd", http.StatusOK)
+	resp.Body.Close()
+
+	resp = httpGet(t, "http://127.0.0.1:9091?query=asd", http.StatusForbidden)
+	checkResponse(t, resp.Body, "http connections are not allowed from 127.0.0.1")
+	resp.Body.Close()
+}
+
 func TestReloadConfig(t *testing.T) {
 	*configFile = "testdata/http.yml"
+	applyTestConfig(t)
 	if err := reloadConfig(); err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
@@ -1249,6 +1622,193 @@ func TestReloadConfig(t *testing.T) {
 	}
 }
 
+func TestReloadConfigListenAddr(t *testing.T) {
+	oldConfigFile := *configFile
+	defer func() { *configFile = oldConfigFile }()
+	*configFile = "testdata/http.yml"
+	applyTestConfig(t)
+
+	*configFile = "testdata/http.listen-addrs.yml"
+	err := reloadConfig()
+	if err == nil {
+		t.Fatal("error expected; got nil")
+	}
+	expected := "`listen_addr` cannot be changed on config reload; restart chproxy to apply it"
+	if err.Error() != expected {
+		t.Fatalf("unexpected error %q; expecting %q", err, expected)
+	}
+}
+
+// applyTestConfig applies the config file as on startup,
+// so it is the previous config for the reloads.
+func applyTestConfig(t *testing.T) {
+	cfg, err := loadConfig()
+	checkErr(t, err)
+	checkErr(t, applyConfig(cfg))
+}
+
+func TestReloadConfigMetrics(t *testing.T) {
+	oldConfigFile := *configFile
+	defer func() { *configFile = oldConfigFile }()
+	success := testutil.ToFloat64(configReloads.With(prometheus.Labels{"result": "success"}))
+	failure := testutil.ToFloat64(configReloads.With(prometheus.Labels{"result": "failure"}))
+
+	*configFile = "testdata/http.yml"
+	applyTestConfig(t)
+	checkErr(t, reloadConfig())
+	*configFile = "testdata/foobar.yml"
+	assert.Error(t, reloadConfig())
+
+	assert.Equal(t, success+1, testutil.ToFloat64(configReloads.With(prometheus.Labels{"result": "success"})))
+	assert.Equal(t, failure+1, testutil.ToFloat64(configReloads.With(prometheus.Labels{"result": "failure"})))
+}
+
+func TestValidateConfigFile(t *testing.T) {
+	badFiles, err := filepath.Glob("config/testdata/bad.*.yml")
+	checkErr(t, err)
+	if len(badFiles) == 0 {
+		t.Fatal("no bad config files found")
+	}
+	for _, filename := range badFiles {
+		t.Run(filename, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			assert.Equal(t, 1, validateConfigFile(filename, &stdout, &stderr))
+			assert.Empty(t, stdout.String())
+			assert.NotEmpty(t, stderr.String())
+		})
+	}
+
+	t.Run("valid config", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		assert.Equal(t, 0, validateConfigFile("testdata/http.cache.redis.yml", &stdout, &stderr))
+		assert.Equal(t, "OK: 1 users, 1 clusters, 1 caches\n", stdout.String())
+		assert.Empty(t, stderr.String())
+	})
+
+	t.Run("missing config", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		assert.Equal(t, 1, validateConfigFile("testdata/foobar.yml", &stdout, &stderr))
+		assert.Contains(t, stderr.String(), "can't load config")
+	})
+
+	t.Run("all errors are reported", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		assert.Equal(t, 1, validateConfigFile("testdata/bad.validate.yml", &stdout, &stderr))
+		assert.Empty(t, stdout.String())
+		assert.Contains(t, stderr.String(), "cannot initialize user \"unknown-cluster\": unknown `to_cluster` \"unknown\"")
+		assert.Contains(t, stderr.String(), "cannot initialize user \"unknown-cache\": unknown `cache` \"unknown\"")
+	})
+}
+
+func TestConfigDiff(t *testing.T) {
+	prev, err := config.LoadFile("testdata/http.yml")
+	checkErr(t, err)
+	cfg, err := config.LoadFile("testdata/http.yml")
+	checkErr(t, err)
+	assert.Equal(t, "no changes", configDiff(prev, cfg))
+
+	cfg.Users[0].Password = "new-secret"
+	cfg.Users[0].MaxConcurrentQueries = 42
+	diff := configDiff(prev, cfg)
+	assert.Contains(t, diff, "max_concurrent_queries: 42")
+	assert.NotContains(t, diff, "new-secret")
+
+	cfg.MaxDiffLogSize = 10
+	diff = configDiff(prev, cfg)
+	assert.True(t, strings.HasSuffix(diff, "\n... truncated to 10 bytes of "+strconv.Itoa(len(cmp.Diff(prev.String(), cfg.String())))), diff)
+}
+
+func TestShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		fmt.Fprintln(w, "done")
+	})
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	checkErr(t, err)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- listenAndServe(ln, h, config.TimeoutCfg{})
+	}()
+	defer func() {
+		shuttingDown.Store(false)
+		serversLock.Lock()
+		servers = nil
+		serversLock.Unlock()
+	}()
+
+	respCh := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			respCh <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		respCh <- getStringFromResponse(t, resp.Body)
+	}()
+	<-started
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		shutdown(5 * time.Second)
+		close(shutdownDone)
+	}()
+
+	assert.Eventually(t, shuttingDown.Load, time.Second, 10*time.Millisecond)
+	assert.Equal(t, float64(1), testutil.ToFloat64(shutdownInProgress))
+	rw := httptest.NewRecorder()
+	serveHealthz(rw, httptest.NewRequest("GET", healthzEndpoint, nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+
+	// The in-flight request completes during the drain.
+	close(release)
+	assert.Equal(t, "done\n", <-respCh)
+	<-shutdownDone
+	assert.ErrorIs(t, <-serveErr, http.ErrServerClosed)
+	assert.Equal(t, float64(0), testutil.ToFloat64(shutdownInProgress))
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	checkErr(t, err)
+	go listenAndServe(ln, h, config.TimeoutCfg{})
+	defer func() {
+		shuttingDown.Store(false)
+		serversLock.Lock()
+		servers = nil
+		serversLock.Unlock()
+	}()
+
+	errCh := make(chan error, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err == nil {
+			resp.Body.Close()
+		}
+		errCh <- err
+	}()
+	<-started
+
+	// The remaining connection is closed once the timeout expires.
+	shutdown(100 * time.Millisecond)
+	select {
+	case err := <-errCh:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatalf("the remaining connection hasn't been closed")
+	}
+}
+
 func checkErr(t *testing.T, err error) {
 	if err != nil {
 		t.Fatalf("unexpected error: %s", err)
@@ -1274,7 +1834,7 @@ func checkResponse(t *testing.T, r io.Reader, expected string) {
 }
 
 func httpGet(t *testing.T, url string, statusCode int) *http.Response {
-	resp, err := http.Get(url)
+	resp, err := httpClient.Get(url)
 	if err != nil {
 		t.Fatalf("unexpected erorr while doing GET request: %s", err)
 	}
@@ -1297,8 +1857,7 @@ func checkHeader(t *testing.T, resp *http.Response, header string, expected stri
 
 func httpRequest(t *testing.T, request *http.Request, statusCode int) (*http.Response, error) {
 	t.Helper()
-	client := http.Client{}
-	resp, err := client.Do(request)
+	resp, err := httpClient.Do(request)
 	if err != nil {
 		return resp, fmt.Errorf("unexpected erorr while doing GET request: %s", err)
 	}
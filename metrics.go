@@ -1,53 +1,92 @@
 package main
 
 import (
+	"github.com/contentsquare/chproxy/cache"
 	"github.com/contentsquare/chproxy/config"
 	"github.com/contentsquare/chproxy/internal/topology"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 var (
 	statusCodes                    *prometheus.CounterVec
 	statusCodesClickhouse          *prometheus.CounterVec
+	clickhouseErrorCodes           *prometheus.CounterVec
 	requestSum                     *prometheus.CounterVec
 	requestSuccess                 *prometheus.CounterVec
 	limitExcess                    *prometheus.CounterVec
 	concurrentQueries              *prometheus.GaugeVec
+	distributedRateLimitHits       *prometheus.CounterVec
+	userQuotaExecution             *prometheus.GaugeVec
+	mirroredRequests               *prometheus.CounterVec
+	userQuotaTransferredBytes      *prometheus.GaugeVec
+	dailyBudgetRemaining           *prometheus.GaugeVec
+	slowQueries                    *prometheus.CounterVec
+	streamedInsertRequests         *prometheus.CounterVec
 	requestQueueSize               *prometheus.GaugeVec
+	requestQueueDepth              *prometheus.GaugeVec
 	userQueueOverflow              *prometheus.CounterVec
 	clusterUserQueueOverflow       *prometheus.CounterVec
 	requestBodyBytes               *prometheus.CounterVec
 	responseBodyBytes              *prometheus.CounterVec
+	requestSize                    *prometheus.SummaryVec
+	responseSize                   *prometheus.SummaryVec
 	cacheFailedInsert              *prometheus.CounterVec
 	cacheCorruptedFetch            *prometheus.CounterVec
 	cacheHit                       *prometheus.CounterVec
 	cacheMiss                      *prometheus.CounterVec
+	cacheBypassed                  *prometheus.CounterVec
 	cacheSize                      *prometheus.GaugeVec
 	cacheItems                     *prometheus.GaugeVec
+	cacheHitRatio                  *prometheus.GaugeVec
 	cacheSkipped                   *prometheus.CounterVec
-	requestDuration                *prometheus.SummaryVec
-	proxiedResponseDuration        *prometheus.SummaryVec
-	cachedResponseDuration         *prometheus.SummaryVec
+	cacheStale                     *prometheus.CounterVec
+	requestDuration                prometheus.ObserverVec
+	proxiedResponseDuration        prometheus.ObserverVec
+	cachedResponseDuration         prometheus.ObserverVec
 	canceledRequest                *prometheus.CounterVec
 	cacheHitFromConcurrentQueries  *prometheus.CounterVec
 	cacheMissFromConcurrentQueries *prometheus.CounterVec
+	killQueryFailures              *prometheus.CounterVec
+	killQuerySuccesses             *prometheus.CounterVec
 	killedRequests                 *prometheus.CounterVec
 	timeoutRequest                 *prometheus.CounterVec
 	configSuccess                  prometheus.Gauge
 	configSuccessTime              prometheus.Gauge
+	configReloads                  *prometheus.CounterVec
+	shutdownInProgress             prometheus.Gauge
 	badRequest                     prometheus.Counter
 	retryRequest                   *prometheus.CounterVec
+	retryDelayMs                   *prometheus.CounterVec
+	rewrittenQueries               *prometheus.CounterVec
+	routedRequests                 *prometheus.CounterVec
+	ipRateLimitExceeded            *prometheus.CounterVec
+	activeSessions                 *prometheus.GaugeVec
+	fallbackRequests               *prometheus.CounterVec
+	hostWeight                     *prometheus.GaugeVec
+	responseSizeLimitExceeded      *prometheus.CounterVec
+	tlsCertificateReloads          *prometheus.CounterVec
+	tlsCertificateExpiry           prometheus.Gauge
+	insertBatchSize                *prometheus.HistogramVec
+	insertBatchFlushErrors         *prometheus.CounterVec
+	auditLogRecords                *prometheus.CounterVec
+	nativeConnections              *prometheus.CounterVec
 )
 
 func initMetrics(cfg *config.Config) {
 	namespace := cfg.Server.Metrics.Namespace
+	queryFingerprints = newFingerprintLabels(cfg.Server.Metrics)
+	requestLabels := []string{"user", "cluster", "cluster_user", "replica", "cluster_node", "operation_type"}
+	if queryFingerprints != nil {
+		requestLabels = append(requestLabels, "query_fingerprint")
+	}
 	statusCodes = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: namespace,
 			Name:      "status_codes_total",
 			Help:      "Distribution by status codes",
 		},
-		[]string{"user", "cluster", "cluster_user", "replica", "cluster_node", "code"},
+		[]string{"user", "cluster", "cluster_user", "replica", "cluster_node", "code", "error_code"},
 	)
 	statusCodesClickhouse = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -57,13 +96,21 @@ func initMetrics(cfg *config.Config) {
 		},
 		[]string{"cluster", "replica", "cluster_node", "code"},
 	)
+	clickhouseErrorCodes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "clickhouse_error_codes_total",
+			Help:      "Distribution by codes of ClickHouse exceptions in proxied responses",
+		},
+		[]string{"cluster", "error_code"},
+	)
 	requestSum = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: namespace,
 			Name:      "request_sum_total",
 			Help:      "Total number of sent requests",
 		},
-		[]string{"user", "cluster", "cluster_user", "replica", "cluster_node"},
+		requestLabels,
 	)
 	requestSuccess = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -71,7 +118,7 @@ func initMetrics(cfg *config.Config) {
 			Name:      "request_success_total",
 			Help:      "Total number of sent success requests",
 		},
-		[]string{"user", "cluster", "cluster_user", "replica", "cluster_node"},
+		requestLabels,
 	)
 	limitExcess = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -79,7 +126,7 @@ func initMetrics(cfg *config.Config) {
 			Name:      "concurrent_limit_excess_total",
 			Help:      "Total number of max_concurrent_queries excess",
 		},
-		[]string{"user", "cluster", "cluster_user", "replica", "cluster_node"},
+		[]string{"user", "cluster", "cluster_user", "replica", "cluster_node", "priority"},
 	)
 	concurrentQueries = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -87,7 +134,47 @@ func initMetrics(cfg *config.Config) {
 			Name:      "concurrent_queries",
 			Help:      "The number of concurrent queries at current time",
 		},
-		[]string{"user", "cluster", "cluster_user", "replica", "cluster_node"},
+		[]string{"user", "cluster", "cluster_user", "replica", "cluster_node", "priority"},
+	)
+	distributedRateLimitHits = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "distributed_rate_limit_hits_total",
+			Help:      "The number of requests_per_minute checks against the shared redis counter",
+		},
+		[]string{"user", "result"},
+	)
+	userQuotaExecution = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "user_quota_execution_seconds",
+			Help:      "Sum of query durations of the user during the current quota interval",
+		},
+		[]string{"user"},
+	)
+	userQuotaTransferredBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "user_quota_transferred_bytes",
+			Help:      "Sum of response sizes of the user during the current quota interval",
+		},
+		[]string{"user"},
+	)
+	dailyBudgetRemaining = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "daily_budget_remaining_seconds",
+			Help:      "Remaining daily execution budget of the user until the next UTC midnight",
+		},
+		[]string{"user"},
+	)
+	mirroredRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "mirrored_requests_total",
+			Help:      "The number of requests mirrored to mirror clusters",
+		},
+		[]string{"user", "cluster", "result"},
 	)
 	requestQueueSize = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -97,6 +184,14 @@ func initMetrics(cfg *config.Config) {
 		},
 		[]string{"user", "cluster", "cluster_user"},
 	)
+	requestQueueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "request_queue_depth",
+			Help:      "The number of requests waiting in the queues of users at the current time",
+		},
+		[]string{"user", "cluster_user"},
+	)
 	userQueueOverflow = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: namespace,
@@ -119,7 +214,7 @@ func initMetrics(cfg *config.Config) {
 			Name:      "request_body_bytes_total",
 			Help:      "The amount of bytes read from request bodies",
 		},
-		[]string{"user", "cluster", "cluster_user", "replica", "cluster_node"},
+		[]string{"user", "cluster", "cluster_user", "replica", "cluster_node", "operation_type"},
 	)
 	responseBodyBytes = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -127,7 +222,25 @@ func initMetrics(cfg *config.Config) {
 			Name:      "response_body_bytes_total",
 			Help:      "The amount of bytes written to response bodies",
 		},
-		[]string{"user", "cluster", "cluster_user", "replica", "cluster_node"},
+		[]string{"user", "cluster", "cluster_user", "replica", "cluster_node", "operation_type"},
+	)
+	requestSize = prometheus.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Namespace:  namespace,
+			Name:       "request_size_bytes",
+			Help:       "Request body size. The source is either proxy or cache",
+			Objectives: map[float64]float64{0.5: 1e-1, 0.9: 1e-2, 0.99: 1e-3, 0.999: 1e-4, 1: 1e-5},
+		},
+		[]string{"user", "cluster", "cluster_user", "replica", "cluster_node", "operation_type", "source", "status_class"},
+	)
+	responseSize = prometheus.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Namespace:  namespace,
+			Name:       "response_size_bytes",
+			Help:       "Response body size. The source is either proxy or cache",
+			Objectives: map[float64]float64{0.5: 1e-1, 0.9: 1e-2, 0.99: 1e-3, 0.999: 1e-4, 1: 1e-5},
+		},
+		[]string{"user", "cluster", "cluster_user", "replica", "cluster_node", "operation_type", "source", "status_class"},
 	)
 	cacheFailedInsert = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -161,13 +274,21 @@ func initMetrics(cfg *config.Config) {
 		},
 		[]string{"cache", "user", "cluster", "cluster_user"},
 	)
+	cacheBypassed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cache_bypassed_total",
+			Help:      "The amount of queries matching `cache_bypass_patterns`, which bypass the cache",
+		},
+		[]string{"cache", "user", "cluster", "cluster_user"},
+	)
 	cacheSize = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: namespace,
 			Name:      "cache_size",
 			Help:      "Cache size at the current time",
 		},
-		[]string{"cache"},
+		[]string{"cache", "level"},
 	)
 	cacheItems = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -175,6 +296,14 @@ func initMetrics(cfg *config.Config) {
 			Name:      "cache_items",
 			Help:      "Cache items at the current time",
 		},
+		[]string{"cache", "level"},
+	)
+	cacheHitRatio = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "cache_hit_ratio",
+			Help:      "Ratio of cache hits to all the cacheable requests since the start",
+		},
 		[]string{"cache"},
 	)
 	cacheSkipped = prometheus.NewCounterVec(
@@ -185,31 +314,40 @@ func initMetrics(cfg *config.Config) {
 		},
 		[]string{"cache", "user", "cluster", "cluster_user"},
 	)
-	requestDuration = prometheus.NewSummaryVec(
+	cacheStale = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cache_stale_total",
+			Help:      "The amount of expired responses served while they are refreshed in background",
+		},
+		[]string{"cache", "user", "cluster", "cluster_user"},
+	)
+	histograms := cfg.Server.Metrics.Histograms
+	requestDuration = newDurationVec(
 		prometheus.SummaryOpts{
-			Namespace:  namespace,
-			Name:       "request_duration_seconds",
-			Help:       "Request duration. Includes possible wait time in the queue",
-			Objectives: map[float64]float64{0.5: 1e-1, 0.9: 1e-2, 0.99: 1e-3, 0.999: 1e-4, 1: 1e-5},
+			Namespace: namespace,
+			Name:      "request_duration_seconds",
+			Help:      "Request duration. Includes possible wait time in the queue",
 		},
-		[]string{"user", "cluster", "cluster_user", "replica", "cluster_node"},
+		histograms.RequestDurationBuckets,
+		requestLabels,
 	)
-	proxiedResponseDuration = prometheus.NewSummaryVec(
+	proxiedResponseDuration = newDurationVec(
 		prometheus.SummaryOpts{
-			Namespace:  namespace,
-			Name:       "proxied_response_duration_seconds",
-			Help:       "Response duration proxied from clickhouse",
-			Objectives: map[float64]float64{0.5: 1e-1, 0.9: 1e-2, 0.99: 1e-3, 0.999: 1e-4, 1: 1e-5},
+			Namespace: namespace,
+			Name:      "proxied_response_duration_seconds",
+			Help:      "Response duration proxied from clickhouse",
 		},
+		histograms.ProxiedResponseDurationBuckets,
 		[]string{"user", "cluster", "cluster_user", "replica", "cluster_node"},
 	)
-	cachedResponseDuration = prometheus.NewSummaryVec(
+	cachedResponseDuration = newDurationVec(
 		prometheus.SummaryOpts{
-			Namespace:  namespace,
-			Name:       "cached_response_duration_seconds",
-			Help:       "Response duration served from the cache",
-			Objectives: map[float64]float64{0.5: 1e-1, 0.9: 1e-2, 0.99: 1e-3, 0.999: 1e-4, 1: 1e-5},
+			Namespace: namespace,
+			Name:      "cached_response_duration_seconds",
+			Help:      "Response duration served from the cache",
 		},
+		histograms.CachedResponseDurationBuckets,
 		[]string{"cache", "user", "cluster", "cluster_user"},
 	)
 	canceledRequest = prometheus.NewCounterVec(
@@ -237,6 +375,22 @@ func initMetrics(cfg *config.Config) {
 		},
 		[]string{"cache", "user", "cluster", "cluster_user"},
 	)
+	killQueryFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "kill_query_failure_total",
+			Help:      "The number of queries which couldn't be killed, including retries",
+		},
+		[]string{"cluster"},
+	)
+	killQuerySuccesses = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "kill_query_success_total",
+			Help:      "The number of successfully killed queries",
+		},
+		[]string{"cluster"},
+	)
 	killedRequests = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: namespace,
@@ -263,6 +417,19 @@ func initMetrics(cfg *config.Config) {
 		Name:      "config_last_reload_success_timestamp_seconds",
 		Help:      "Timestamp of the last successful configuration reload.",
 	})
+	configReloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "config_reload_total",
+			Help:      "The number of configuration reloads by result: success or failure",
+		},
+		[]string{"result"},
+	)
+	shutdownInProgress = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "shutdown_in_progress",
+		Help:      "Whether in-flight requests are being drained before shutdown.",
+	})
 	badRequest = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: namespace,
 		Name:      "bad_requests_total",
@@ -276,18 +443,190 @@ func initMetrics(cfg *config.Config) {
 		},
 		[]string{"user", "cluster", "cluster_user", "replica", "cluster_node"},
 	)
+	retryDelayMs = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "retry_delay_ms_total",
+			Help:      "The total delay in milliseconds before retries of failed requests",
+		},
+		[]string{"cluster"},
+	)
+	rewrittenQueries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rewritten_queries_total",
+			Help:      "The number of queries modified by user rewrite rules",
+		},
+		[]string{"user"},
+	)
+	routedRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "routed_requests_total",
+			Help:      "The number of requests routed by user routing rules",
+		},
+		[]string{"user", "routing_rule", "cluster"},
+	)
+	ipRateLimitExceeded = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "ip_rate_limit_exceeded_total",
+			Help:      "The number of requests rejected because of the exceeded per_ip_rate_limit",
+		},
+		[]string{"remote_ip"},
+	)
+	slowQueries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "slow_queries_total",
+			Help:      "The number of requests taking longer than slow_query_threshold",
+		},
+		[]string{"user"},
+	)
+	streamedInsertRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "streamed_insert_requests_total",
+			Help:      "The number of requests with bodies exceeding max_buffer_size streamed to ClickHouse without buffering",
+		},
+		[]string{"user"},
+	)
+	activeSessions = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "active_sessions",
+			Help:      "The number of active sessions of users with max_sessions",
+		},
+		[]string{"user"},
+	)
+	fallbackRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "fallback_requests_total",
+			Help:      "The number of requests proxied to `fallback_cluster` since all the nodes of the chosen cluster are inactive",
+		},
+		[]string{"user", "cluster", "fallback_cluster"},
+	)
+	hostWeight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "host_weight",
+			Help:      "The effective weight of hosts: the weight of the replica multiplied by the weight of the node",
+		},
+		[]string{"cluster", "replica", "cluster_node"},
+	)
+	responseSizeLimitExceeded = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "response_size_limit_exceeded_total",
+			Help:      "The number of queries killed because of responses exceeding max_response_size",
+		},
+		[]string{"user"},
+	)
+	tlsCertificateReloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tls_certificate_reload_total",
+			Help:      "The number of TLS certificate reloads on SIGUSR2, by result",
+		},
+		[]string{"result"},
+	)
+	tlsCertificateExpiry = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "tls_certificate_expiry_seconds",
+		Help:      "Expiration timestamp of the TLS certificate loaded from cert_file.",
+	})
+	insertBatchSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "insert_batch_size_bytes",
+			Help:      "Size of the data of INSERTs flushed by insert_batching",
+			// From 1KiB to 1GiB.
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 11),
+		},
+		[]string{"user"},
+	)
+	insertBatchFlushErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "insert_batch_flush_errors_total",
+			Help:      "The number of batches of INSERTs which failed to be flushed by insert_batching",
+		},
+		[]string{"user"},
+	)
+	auditLogRecords = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "audit_log_records_total",
+			Help:      "The number of audit log records, by result: written, failed or dropped because of the full queue",
+		},
+		[]string{"result"},
+	)
+	nativeConnections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "native_proxy_connections_total",
+			Help:      "The number of native protocol connections, by result: proxied, unauthorized, forbidden, limited or failed",
+		},
+		[]string{"result"},
+	)
+}
+
+// newDurationVec returns a histogram with the given buckets
+// or a summary if no buckets are configured.
+func newDurationVec(opts prometheus.SummaryOpts, buckets []float64, labelNames []string) prometheus.ObserverVec {
+	if len(buckets) > 0 {
+		return prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: opts.Namespace,
+				Name:      opts.Name,
+				Help:      opts.Help,
+				Buckets:   buckets,
+			},
+			labelNames,
+		)
+	}
+	opts.Objectives = map[float64]float64{0.5: 1e-1, 0.9: 1e-2, 0.99: 1e-3, 0.999: 1e-4, 1: 1e-5}
+	return prometheus.NewSummaryVec(opts, labelNames)
 }
 
 func registerMetrics(cfg *config.Config) {
 	topology.RegisterMetrics(cfg)
+	cache.RegisterMetrics(cfg)
 
 	initMetrics(cfg)
-	prometheus.MustRegister(statusCodes, statusCodesClickhouse, requestSum, requestSuccess,
-		limitExcess, concurrentQueries,
-		requestQueueSize, userQueueOverflow, clusterUserQueueOverflow,
-		requestBodyBytes, responseBodyBytes, cacheFailedInsert, cacheCorruptedFetch,
-		cacheHit, cacheMiss, cacheSize, cacheItems, cacheSkipped,
-		requestDuration, proxiedResponseDuration, cachedResponseDuration,
-		canceledRequest, timeoutRequest,
-		configSuccess, configSuccessTime, badRequest, retryRequest)
+	prometheus.MustRegister(statusCodes, statusCodesClickhouse, clickhouseErrorCodes, requestSum, requestSuccess,
+		limitExcess, concurrentQueries, distributedRateLimitHits,
+		userQuotaExecution, userQuotaTransferredBytes, dailyBudgetRemaining, mirroredRequests,
+		requestQueueSize, requestQueueDepth, userQueueOverflow, clusterUserQueueOverflow,
+		requestBodyBytes, responseBodyBytes, requestSize, responseSize, cacheFailedInsert, cacheCorruptedFetch,
+		cacheHit, cacheMiss, cacheBypassed, cacheSize, cacheItems, cacheHitRatio, cacheSkipped,
+		cacheStale, requestDuration, proxiedResponseDuration, cachedResponseDuration,
+		canceledRequest, timeoutRequest, killQueryFailures, killQuerySuccesses,
+		configSuccess, configSuccessTime, configReloads, shutdownInProgress, badRequest, retryRequest, retryDelayMs, rewrittenQueries, routedRequests,
+		ipRateLimitExceeded, slowQueries, streamedInsertRequests, activeSessions, hostWeight, fallbackRequests, responseSizeLimitExceeded, tlsCertificateReloads, tlsCertificateExpiry,
+		insertBatchSize, insertBatchFlushErrors, auditLogRecords, nativeConnections)
+}
+
+// sumByLabel returns the sum of counters from vec grouped by the given label.
+func sumByLabel(vec *prometheus.CounterVec, label string) map[string]float64 {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		vec.Collect(ch)
+		close(ch)
+	}()
+
+	res := make(map[string]float64)
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			continue
+		}
+		for _, lp := range pb.GetLabel() {
+			if lp.GetName() == label {
+				res[lp.GetValue()] += pb.GetCounter().GetValue()
+			}
+		}
+	}
+	return res
 }
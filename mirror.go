@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/contentsquare/chproxy/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// mirrorRequest sends a copy of the decorated req to the mirror cluster
+// of the user in background. The response is discarded, so the mirror
+// doesn't affect the response to the client.
+func (rp *reverseProxy) mirrorRequest(s *scope, req *http.Request) {
+	labels := prometheus.Labels{
+		"user":    s.user.name,
+		"cluster": s.user.mirrorToCluster,
+	}
+	fail := func(err error) {
+		labels["result"] = "failure"
+		mirroredRequests.With(labels).Inc()
+		log.Debugf("%s: cannot mirror request to cluster %q: %s", s, s.user.mirrorToCluster, err)
+	}
+
+	if s.streamedBody {
+		fail(fmt.Errorf("request body exceeds `max_buffer_size`"))
+		return
+	}
+
+	body, err := readAndRestoreRequestBody(req)
+	if err != nil {
+		fail(fmt.Errorf("cannot read request body: %w", err))
+		return
+	}
+
+	c := rp.snapshot.Load().clusters[s.user.mirrorToCluster]
+	if c == nil {
+		// The config has been reloaded without the mirror cluster.
+		fail(fmt.Errorf("unknown cluster"))
+		return
+	}
+	h := c.pickHost("", s.hashKey)
+
+	// The mirrored request must not be canceled with the original one,
+	// but it is limited by the same execution time.
+	ctx := context.Background()
+	timeout, _ := s.getTimeoutWithErrMsg()
+	cancel := func() {}
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+
+	mreq := req.Clone(withClusterTransport(ctx, c))
+	mreq.RequestURI = ""
+	mreq.Body = io.NopCloser(bytes.NewReader(body))
+	mreq.ContentLength = int64(len(body))
+	mreq.URL.Scheme = h.Scheme()
+	mreq.URL.Host = h.Host()
+	mreq.Host = h.Host()
+	params := mreq.URL.Query()
+	params.Set("query_id", s.id.String()+"-mirror")
+	mreq.URL.RawQuery = params.Encode()
+
+	go func() {
+		defer cancel()
+
+		h.IncrementConnections()
+		defer h.DecrementConnections()
+
+		resp, err := rp.rp.Transport.RoundTrip(mreq)
+		if err != nil {
+			fail(err)
+			return
+		}
+		_, err = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			fail(fmt.Errorf("cannot read response: %w", err))
+			return
+		}
+		if resp.StatusCode != http.StatusOK {
+			fail(fmt.Errorf("unexpected status code %d", resp.StatusCode))
+			return
+		}
+		labels["result"] = "success"
+		mirroredRequests.With(labels).Inc()
+	}()
+}
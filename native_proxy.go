@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/contentsquare/chproxy/config"
+	"github.com/contentsquare/chproxy/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// nativeHelloPacket is the type of the first packet sent by native protocol clients.
+	nativeHelloPacket = 0
+	// nativeExceptionPacket is the type of the packet with the server exception.
+	nativeExceptionPacket = 2
+
+	// defaultNativeNodePort is used if `native_proxy.node_port` isn't set.
+	defaultNativeNodePort = 9000
+
+	// nativeHelloTimeout is the maximum duration for receiving the Hello packet.
+	nativeHelloTimeout = 10 * time.Second
+	// nativeDialTimeout is the maximum duration for connecting to cluster nodes.
+	nativeDialTimeout = 10 * time.Second
+
+	// maxNativeStringSize limits strings of the Hello packet,
+	// so clients cannot make chproxy allocate arbitrary amounts of memory.
+	maxNativeStringSize = 64 * 1024
+)
+
+// nativeHello is the Hello packet of the ClickHouse native protocol.
+// See https://clickhouse.com/docs/en/native-protocol/client#hello
+type nativeHello struct {
+	clientName      string
+	versionMajor    uint64
+	versionMinor    uint64
+	protocolVersion uint64
+	database        string
+	user            string
+	password        string
+}
+
+func readNativeHello(r *bufio.Reader) (*nativeHello, error) {
+	packet, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if packet != nativeHelloPacket {
+		return nil, fmt.Errorf("unexpected packet %d; expecting Hello", packet)
+	}
+	var h nativeHello
+	if h.clientName, err = readNativeString(r); err != nil {
+		return nil, fmt.Errorf("cannot read client name: %w", err)
+	}
+	for _, v := range []*uint64{&h.versionMajor, &h.versionMinor, &h.protocolVersion} {
+		if *v, err = binary.ReadUvarint(r); err != nil {
+			return nil, fmt.Errorf("cannot read client version: %w", err)
+		}
+	}
+	if h.database, err = readNativeString(r); err != nil {
+		return nil, fmt.Errorf("cannot read database: %w", err)
+	}
+	if h.user, err = readNativeString(r); err != nil {
+		return nil, fmt.Errorf("cannot read user: %w", err)
+	}
+	if h.password, err = readNativeString(r); err != nil {
+		return nil, fmt.Errorf("cannot read password: %w", err)
+	}
+	return &h, nil
+}
+
+// appendTo appends the packet in wire format to b.
+func (h *nativeHello) appendTo(b []byte) []byte {
+	b = binary.AppendUvarint(b, nativeHelloPacket)
+	b = appendNativeString(b, h.clientName)
+	b = binary.AppendUvarint(b, h.versionMajor)
+	b = binary.AppendUvarint(b, h.versionMinor)
+	b = binary.AppendUvarint(b, h.protocolVersion)
+	b = appendNativeString(b, h.database)
+	b = appendNativeString(b, h.user)
+	return appendNativeString(b, h.password)
+}
+
+func readNativeString(r *bufio.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if n > maxNativeStringSize {
+		return "", fmt.Errorf("string size %d exceeds %d bytes", n, maxNativeStringSize)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func appendNativeString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// writeNativeException sends err to the client as the Exception packet.
+// The exception code is chosen by status the same way as for http responses.
+func writeNativeException(w io.Writer, err error, status int) {
+	e, ok := exceptionsByStatus[status]
+	if !ok {
+		e = exceptionsByStatus[http.StatusInternalServerError]
+	}
+	b := binary.AppendUvarint(nil, nativeExceptionPacket)
+	b = binary.LittleEndian.AppendUint32(b, uint32(e.code))
+	b = appendNativeString(b, "DB::Exception")
+	b = appendNativeString(b, fmt.Sprintf("DB::Exception: %s. (%s)", err, e.name))
+	// Stack trace
+	b = appendNativeString(b, "")
+	// has_nested
+	b = append(b, 0)
+	if _, err := w.Write(b); err != nil {
+		log.Debugf("cannot send native protocol exception: %s", err)
+	}
+}
+
+// serveNative accepts native protocol connections on listenAddr.
+func serveNative(listenAddr string) {
+	ln := newListener(listenAddr)
+	log.Infof("Serving native protocol on %q", listenAddr)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Errorf("native protocol listener error on %q: %s", listenAddr, err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if shuttingDown.Load() {
+			conn.Close()
+			continue
+		}
+		go proxy.serveNativeConn(conn, nativeProxyConfig.Load())
+	}
+}
+
+// serveNativeConn authenticates the client by its Hello packet and then
+// forwards the connection to the node of the user cluster.
+//
+// The connection counts as a single running query of the user
+// during its lifetime, so the user limits apply to native connections
+// and the connection is closed once `max_execution_time` elapses.
+func (rp *reverseProxy) serveNativeConn(conn net.Conn, cfg *config.NativeProxy) {
+	defer conn.Close()
+	remoteAddr := conn.RemoteAddr().String()
+	// Packets following the Hello packet may be buffered by br.
+	br := bufio.NewReader(conn)
+	s, nodeConn, status, err := rp.openNativeConn(conn, br, cfg)
+	if err != nil {
+		result := "failed"
+		switch status {
+		case http.StatusUnauthorized:
+			result = "unauthorized"
+		case http.StatusForbidden:
+			result = "forbidden"
+		case http.StatusTooManyRequests:
+			result = "limited"
+		}
+		nativeConnections.With(prometheus.Labels{"result": result}).Inc()
+		log.Errorf("native connection from %q: %s", remoteAddr, err)
+		writeNativeException(conn, err, status)
+		return
+	}
+	defer s.dec()
+	defer nodeConn.Close()
+	nativeConnections.With(prometheus.Labels{"result": "proxied"}).Inc()
+	log.Debugf("%s: native connection is proxied to %s", s, nodeConn.RemoteAddr())
+
+	// Both connections are closed once either side closes its connection,
+	// since the native protocol doesn't use half-closed connections.
+	done := make(chan struct{}, 2)
+	go func() {
+		// nolint:errcheck // Errors mean the connection is closed.
+		io.Copy(conn, nodeConn)
+		done <- struct{}{}
+	}()
+	go func() {
+		// nolint:errcheck // Errors mean the connection is closed.
+		io.Copy(nodeConn, br)
+		done <- struct{}{}
+	}()
+	var timeoutCh <-chan time.Time
+	timeout, timeoutErr := s.getTimeoutWithErrMsg()
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		timeoutCh = t.C
+	}
+	pending := 2
+	select {
+	case <-done:
+		pending--
+	case <-timeoutCh:
+		log.Errorf("%s: native connection is closed: %s", s, timeoutErr)
+	}
+	conn.Close()
+	nodeConn.Close()
+	for ; pending > 0; pending-- {
+		<-done
+	}
+	log.Debugf("%s: native connection is closed", s)
+}
+
+// openNativeConn reads the Hello packet from br, applies the limits
+// and connects to the cluster node. The Hello packet is sent to the node
+// with the credentials of the cluster user.
+//
+// The returned scope must be released via s.dec.
+func (rp *reverseProxy) openNativeConn(conn net.Conn, br *bufio.Reader, cfg *config.NativeProxy) (*scope, net.Conn, int, error) {
+	remoteAddr := conn.RemoteAddr().String()
+	if err := conn.SetReadDeadline(time.Now().Add(nativeHelloTimeout)); err != nil {
+		return nil, nil, http.StatusInternalServerError, err
+	}
+	hello, err := readNativeHello(br)
+	if err != nil {
+		return nil, nil, http.StatusBadRequest, fmt.Errorf("cannot read Hello packet: %w", err)
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, nil, http.StatusInternalServerError, err
+	}
+
+	if !cfg.AllowedNetworks.Contains(remoteAddr) {
+		return nil, nil, http.StatusForbidden, fmt.Errorf("native connections are not allowed from %s", remoteAddr)
+	}
+	if l := ipRateLimit.Load(); l != nil {
+		if ok, _ := l.allow(remoteAddr, time.Now()); !ok {
+			ip := remoteIP(remoteAddr)
+			ipRateLimitExceeded.With(prometheus.Labels{"remote_ip": ip}).Inc()
+			return nil, nil, http.StatusTooManyRequests,
+				fmt.Errorf("rate limit for %s is exceeded: per_ip_rate_limit.requests_per_minute limit: %d", ip, l.cfg.ReqPerMin)
+		}
+	}
+
+	found, u, c, cu := rp.getUser(hello.user, hello.password)
+	if !found && u == nil {
+		found, u, c, cu = rp.getLDAPUser(hello.user, hello.password)
+	}
+	if !found {
+		return nil, nil, http.StatusUnauthorized, fmt.Errorf("invalid username or password for user %q", hello.user)
+	}
+	// Native connections aren't encrypted.
+	if u.denyHTTP {
+		return nil, nil, http.StatusForbidden, fmt.Errorf("user %q is not allowed to access via native protocol", u.name)
+	}
+	if !u.allowedNetworks.Contains(remoteAddr) {
+		return nil, nil, http.StatusForbidden, fmt.Errorf("user %q is not allowed to access", u.name)
+	}
+	if !cu.allowedNetworks.Contains(remoteAddr) {
+		return nil, nil, http.StatusForbidden, fmt.Errorf("cluster user %q is not allowed to access", cu.name)
+	}
+	if name := nativeUnsupportedSetting(u); len(name) > 0 {
+		return nil, nil, http.StatusForbidden,
+			fmt.Errorf("user %q is not allowed to access via native protocol: `%s` cannot be enforced on native connections", u.name, name)
+	}
+	if len(u.allowedDatabases) > 0 {
+		if len(hello.database) == 0 {
+			hello.database = u.allowedDatabases[0]
+		} else if !u.isDatabaseAllowed(hello.database) {
+			return nil, nil, http.StatusForbidden, fmt.Errorf("user %q is not allowed to access database %q", u.name, hello.database)
+		}
+	}
+
+	s := newConnScope(u, c, cu, "", 0, "", remoteAddr, conn.LocalAddr().String())
+	if u.identities != nil {
+		s.identityCounter = u.identities.get(hello.user)
+	}
+	if err := s.incQueued(); err != nil {
+		limitExcess.With(s.priorityLabels()).Inc()
+		return nil, nil, http.StatusTooManyRequests, err
+	}
+
+	addr := nativeNodeAddr(s.host.Host(), cfg.NodePort)
+	nodeConn, err := net.DialTimeout("tcp", addr, nativeDialTimeout)
+	if err != nil {
+		s.dec()
+		return nil, nil, http.StatusBadGateway, fmt.Errorf("cannot connect to %s: %w", addr, err)
+	}
+	hello.user = cu.name
+	hello.password = cu.password
+	if _, err := nodeConn.Write(hello.appendTo(nil)); err != nil {
+		nodeConn.Close()
+		s.dec()
+		return nil, nil, http.StatusBadGateway, fmt.Errorf("cannot send Hello packet to %s: %w", addr, err)
+	}
+	return s, nodeConn, 0, nil
+}
+
+// nativeUnsupportedSetting returns the name of the setting of u,
+// which cannot be enforced on native connections, since queries and
+// responses are forwarded without parsing. It returns an empty string
+// if u may connect via native protocol.
+func nativeUnsupportedSetting(u *user) string {
+	switch {
+	case len(u.allowedStatements) > 0:
+		return "allowed_statements"
+	case len(u.deniedStatements) > 0:
+		return "denied_statements"
+	case u.checkQueryDatabases:
+		return "check_query_databases"
+	case len(u.allowedFormats) > 0:
+		return "allowed_formats"
+	case len(u.allowedDefaultFormats) > 0:
+		return "allowed_default_formats"
+	case u.params != nil:
+		return "params"
+	case u.forcedParams != nil:
+		return "forced_params"
+	case u.maxExecutionTotal > 0:
+		return "max_execution_total_per_hour"
+	case u.maxBytesTransferred > 0:
+		return "max_bytes_transferred_per_hour"
+	case u.dailyExecutionBudget > 0:
+		return "daily_execution_budget"
+	case u.maxResponseSize > 0:
+		return "max_response_size"
+	}
+	return ""
+}
+
+// nativeNodeAddr returns the address of the native protocol
+// on the node with the given http address.
+func nativeNodeAddr(nodeAddr string, port int) string {
+	if port == 0 {
+		port = defaultNativeNodePort
+	}
+	host, _, err := net.SplitHostPort(nodeAddr)
+	if err != nil {
+		// The port is missing.
+		host = nodeAddr
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
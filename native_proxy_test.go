@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/contentsquare/chproxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// startFakeNativeNode accepts native protocol connections, sends the received
+// Hello packets to hellos and then echoes the received data.
+func startFakeNativeNode(t *testing.T, hellos chan<- *nativeHello) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	checkErr(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				h, err := readNativeHello(br)
+				if err != nil {
+					return
+				}
+				hellos <- h
+				// nolint:errcheck // The connection is closed by the client.
+				io.Copy(conn, br)
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func newNativeTestProxy(t *testing.T, u config.User) *reverseProxy {
+	t.Helper()
+	chServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, okResponse)
+	}))
+	t.Cleanup(chServer.Close)
+	chAddr, err := url.Parse(chServer.URL)
+	checkErr(t, err)
+	u.ToCluster = "cluster"
+	u.ToUser = "web"
+	proxy, err := newConfiguredProxy(&config.Config{
+		Clusters: []config.Cluster{
+			{
+				Name:         "cluster",
+				Scheme:       "http",
+				Nodes:        []string{chAddr.Host},
+				ClusterUsers: []config.ClusterUser{{Name: "web", Password: "web-password"}},
+			},
+		},
+		Users: []config.User{u},
+	})
+	checkErr(t, err)
+	stopProxy(t, proxy)
+	return proxy
+}
+
+// dialNativeProxy returns the client connection served by proxy.
+func dialNativeProxy(t *testing.T, proxy *reverseProxy, cfg *config.NativeProxy) net.Conn {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	checkErr(t, err)
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	checkErr(t, err)
+	server, err := ln.Accept()
+	checkErr(t, err)
+	go proxy.serveNativeConn(server, cfg)
+	return client
+}
+
+func sendNativeHello(t *testing.T, conn net.Conn, user, password string, data string) {
+	t.Helper()
+	sendNativeHelloTo(t, conn, "default", user, password, data)
+}
+
+func sendNativeHelloTo(t *testing.T, conn net.Conn, database, user, password string, data string) {
+	t.Helper()
+	h := &nativeHello{
+		clientName:      "test client",
+		versionMajor:    24,
+		versionMinor:    3,
+		protocolVersion: 54467,
+		database:        database,
+		user:            user,
+		password:        password,
+	}
+	_, err := conn.Write(append(h.appendTo(nil), data...))
+	checkErr(t, err)
+}
+
+// readNativeException returns the code and the message of the Exception packet.
+func readNativeException(t *testing.T, conn net.Conn) (int, string) {
+	t.Helper()
+	checkErr(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	br := bufio.NewReader(conn)
+	packet, err := binary.ReadUvarint(br)
+	checkErr(t, err)
+	assert.Equal(t, uint64(nativeExceptionPacket), packet)
+	var code int32
+	checkErr(t, binary.Read(br, binary.LittleEndian, &code))
+	name, err := readNativeString(br)
+	checkErr(t, err)
+	assert.Equal(t, "DB::Exception", name)
+	msg, err := readNativeString(br)
+	checkErr(t, err)
+	return int(code), msg
+}
+
+func TestReverseProxy_ServeNativeConn(t *testing.T) {
+	hellos := make(chan *nativeHello, 1)
+	cfg := &config.NativeProxy{NodePort: startFakeNativeNode(t, hellos)}
+	proxy := newNativeTestProxy(t, config.User{Name: defaultUsername})
+
+	conn := dialNativeProxy(t, proxy, cfg)
+	defer conn.Close()
+	sendNativeHello(t, conn, defaultUsername, "", "ping")
+
+	h := <-hellos
+	assert.Equal(t, "web", h.user)
+	assert.Equal(t, "web-password", h.password)
+	assert.Equal(t, "test client", h.clientName)
+	assert.Equal(t, uint64(54467), h.protocolVersion)
+	assert.Equal(t, "default", h.database)
+
+	// Data following the Hello packet is forwarded to the node.
+	buf := make([]byte, 4)
+	checkErr(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err := io.ReadFull(conn, buf)
+	checkErr(t, err)
+	assert.Equal(t, "ping", string(buf))
+}
+
+func TestReverseProxy_ServeNativeConnErrors(t *testing.T) {
+	hellos := make(chan *nativeHello, 1)
+	cfg := &config.NativeProxy{NodePort: startFakeNativeNode(t, hellos)}
+	proxy := newNativeTestProxy(t, config.User{
+		Name:                 defaultUsername,
+		Password:             "secret",
+		MaxConcurrentQueries: 1,
+	})
+
+	conn := dialNativeProxy(t, proxy, cfg)
+	defer conn.Close()
+	sendNativeHello(t, conn, defaultUsername, "wrong", "")
+	code, msg := readNativeException(t, conn)
+	assert.Equal(t, 516, code)
+	assert.Contains(t, msg, `invalid username or password for user "default"`)
+
+	// The open connection counts as a running query of the user.
+	conn = dialNativeProxy(t, proxy, cfg)
+	defer conn.Close()
+	sendNativeHello(t, conn, defaultUsername, "secret", "")
+	<-hellos
+	conn2 := dialNativeProxy(t, proxy, cfg)
+	defer conn2.Close()
+	sendNativeHello(t, conn2, defaultUsername, "secret", "")
+	code, msg = readNativeException(t, conn2)
+	assert.Equal(t, 202, code)
+	assert.Contains(t, msg, "max_concurrent_queries limit: 1")
+
+	_, ipnet, err := net.ParseCIDR("10.0.0.0/8")
+	checkErr(t, err)
+	conn3 := dialNativeProxy(t, proxy, &config.NativeProxy{AllowedNetworks: config.Networks{ipnet}, NodePort: cfg.NodePort})
+	defer conn3.Close()
+	sendNativeHello(t, conn3, defaultUsername, "secret", "")
+	code, _ = readNativeException(t, conn3)
+	assert.Equal(t, 497, code)
+}
+
+func TestReverseProxy_ServeNativeConnRestrictions(t *testing.T) {
+	hellos := make(chan *nativeHello, 1)
+	cfg := &config.NativeProxy{NodePort: startFakeNativeNode(t, hellos)}
+
+	// Queries aren't parsed on native connections, so statement restrictions cannot be enforced.
+	proxy := newNativeTestProxy(t, config.User{Name: defaultUsername, AllowedStatements: []string{"SELECT"}})
+	conn := dialNativeProxy(t, proxy, cfg)
+	defer conn.Close()
+	sendNativeHello(t, conn, defaultUsername, "", "")
+	code, msg := readNativeException(t, conn)
+	assert.Equal(t, 497, code)
+	assert.Contains(t, msg, "`allowed_statements` cannot be enforced on native connections")
+
+	proxy = newNativeTestProxy(t, config.User{Name: defaultUsername, AllowedDatabases: []string{"db1", "db2"}})
+	conn = dialNativeProxy(t, proxy, cfg)
+	defer conn.Close()
+	sendNativeHelloTo(t, conn, "secret", defaultUsername, "", "")
+	code, msg = readNativeException(t, conn)
+	assert.Equal(t, 497, code)
+	assert.Contains(t, msg, `user "default" is not allowed to access database "secret"`)
+
+	conn = dialNativeProxy(t, proxy, cfg)
+	defer conn.Close()
+	sendNativeHelloTo(t, conn, "db2", defaultUsername, "", "")
+	assert.Equal(t, "db2", (<-hellos).database)
+
+	// The first allowed database is used if the client doesn't set one.
+	conn = dialNativeProxy(t, proxy, cfg)
+	defer conn.Close()
+	sendNativeHelloTo(t, conn, "", defaultUsername, "", "")
+	assert.Equal(t, "db1", (<-hellos).database)
+}
+
+func TestReverseProxy_ServeNativeConnTimeout(t *testing.T) {
+	hellos := make(chan *nativeHello, 1)
+	cfg := &config.NativeProxy{NodePort: startFakeNativeNode(t, hellos)}
+	proxy := newNativeTestProxy(t, config.User{
+		Name:             defaultUsername,
+		MaxExecutionTime: config.Duration(100 * time.Millisecond),
+	})
+
+	conn := dialNativeProxy(t, proxy, cfg)
+	defer conn.Close()
+	sendNativeHello(t, conn, defaultUsername, "", "")
+	<-hellos
+
+	// The connection is closed once max_execution_time elapses.
+	checkErr(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err := conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestNativeNodeAddr(t *testing.T) {
+	assert.Equal(t, "127.0.0.1:9000", nativeNodeAddr("127.0.0.1:8123", 0))
+	assert.Equal(t, "[::1]:9001", nativeNodeAddr("[::1]:8123", 9001))
+	assert.Equal(t, "shard1:"+strconv.Itoa(defaultNativeNodePort), nativeNodeAddr("shard1", 0))
+}
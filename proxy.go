@@ -14,6 +14,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/contentsquare/chproxy/cache"
@@ -29,6 +30,9 @@ const failedTransactionPrefix = "[concurrent query failed]"
 type reverseProxy struct {
 	rp *httputil.ReverseProxy
 
+	// transports provides transports for clusters
+	transports *clusterTransports
+
 	// configLock serializes access to applyConfig.
 	// It protects reload* fields.
 	configLock sync.Mutex
@@ -36,19 +40,39 @@ type reverseProxy struct {
 	reloadSignal chan struct{}
 	reloadWG     sync.WaitGroup
 
-	// lock protects users, clusters and caches.
-	// RWMutex enables concurrent access to getScope.
-	lock sync.RWMutex
+	// snapshot holds users, clusters and caches of the applied config.
+	// It is swapped as a whole on config reload, so getScope
+	// needs a single atomic load instead of a lock.
+	snapshot atomic.Pointer[proxySnapshot]
+
+	// queries holds queries proxied at the moment.
+	queries runningQueries
+
+	// slowQueries holds the most recent slow queries.
+	slowQueries *slowQueryLog
+
+	// asyncCacheWrites tracks responses of cache misses served
+	// with `async_writes` until their transactions are completed.
+	asyncCacheWrites sync.WaitGroup
 
-	users               map[string]*user
-	clusters            map[string]*cluster
-	caches              map[string]*cache.AsyncCache
-	hasWildcarded       bool
 	maxIdleConns        int
 	maxIdleConnsPerHost int
 	maxErrorReasonSize  int64
 }
 
+// proxySnapshot is the immutable state of reverseProxy built from the config.
+//
+// The maps mustn't be modified after the snapshot is stored in reverseProxy.
+type proxySnapshot struct {
+	users         map[string]*user
+	clusters      map[string]*cluster
+	caches        map[string]*cache.AsyncCache
+	ldapAuth      *ldapAuth
+	jwtAuth       *jwtAuth
+	auditLog      *auditLogger
+	hasWildcarded bool
+}
+
 func newReverseProxy(cfgCp *config.ConnectionPool) *reverseProxy {
 	transport := &http.Transport{
 		Proxy: http.ProxyFromEnvironment,
@@ -67,20 +91,25 @@ func newReverseProxy(cfgCp *config.ConnectionPool) *reverseProxy {
 		ExpectContinueTimeout: 1 * time.Second,
 	}
 
-	return &reverseProxy{
+	rp := &reverseProxy{
 		rp: &httputil.ReverseProxy{
-			Director:  func(*http.Request) {},
-			Transport: transport,
+			Director:       func(*http.Request) {},
+			Transport:      &clusterRoundTripper{base: transport},
+			ModifyResponse: compressProxiedResponse,
 
 			// Suppress error logging in ReverseProxy, since all the errors
 			// are handled and logged in the code below.
 			ErrorLog: log.NilLogger,
 		},
+		transports:          newClusterTransports(transport),
 		reloadSignal:        make(chan struct{}),
 		reloadWG:            sync.WaitGroup{},
+		slowQueries:         newSlowQueryLog(0),
 		maxIdleConns:        cfgCp.MaxIdleConnsPerHost,
 		maxIdleConnsPerHost: cfgCp.MaxIdleConnsPerHost,
 	}
+	rp.snapshot.Store(&proxySnapshot{})
+	return rp
 }
 
 func (rp *reverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
@@ -93,38 +122,87 @@ func (rp *reverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if err := s.user.checkQuota(); err != nil {
+		limitExcess.With(s.priorityLabels()).Inc()
+		q := getQuerySnippet(req)
+		err = fmt.Errorf("%s: %w; query: %q", s, err, q)
+		respondWith(rw, err, http.StatusTooManyRequests)
+		rp.auditRequest(s, req, http.StatusTooManyRequests, 0, startTime)
+		return
+	}
+
+	if ttr, err := s.user.checkDailyBudget(); err != nil {
+		limitExcess.With(s.priorityLabels()).Inc()
+		q := getQuerySnippet(req)
+		err = fmt.Errorf("%s: %w; query: %q", s, err, q)
+		setRetryAfter(rw, ttr)
+		respondWith(rw, err, http.StatusTooManyRequests)
+		rp.auditRequest(s, req, http.StatusTooManyRequests, 0, startTime)
+		return
+	}
+
 	// WARNING: don't use s.labels before s.incQueued,
 	// since `replica` and `cluster_node` may change inside incQueued.
 	if err := s.incQueued(); err != nil {
-		limitExcess.With(s.labels).Inc()
+		limitExcess.With(s.priorityLabels()).Inc()
 		q := getQuerySnippet(req)
 		err = fmt.Errorf("%s: %w; query: %q", s, err, q)
+		setRetryAfter(rw, retryAfter(s))
 		respondWith(rw, err, http.StatusTooManyRequests)
+		rp.auditRequest(s, req, http.StatusTooManyRequests, 0, startTime)
 		return
 	}
 	defer s.dec()
 
-	log.Debugf("%s: request start", s)
-	requestSum.With(s.labels).Inc()
-
-	if s.user.allowCORS {
-		origin := req.Header.Get("Origin")
-		if len(origin) == 0 {
-			origin = "*"
+	// The session is opened once the request passes the limits,
+	// so rejected requests don't occupy `max_sessions` slots.
+	if len(s.sessionId) > 0 {
+		if err := s.openSession(); err != nil {
+			q := getQuerySnippet(req)
+			err = fmt.Errorf("%s: %w; query: %q", s, err, q)
+			respondWith(rw, err, http.StatusTooManyRequests)
+			rp.auditRequest(s, req, http.StatusTooManyRequests, 0, startTime)
+			return
 		}
-		rw.Header().Set("Access-Control-Allow-Origin", origin)
 	}
+	if s.sessionClose {
+		defer s.closeSession()
+	}
+
+	log.Debugf("%s: request start", s)
+	requestSum.With(s.requestLabels()).Inc()
 
-	req.Body = &statReadCloser{
+	src := &statReadCloser{
 		ReadCloser: req.Body,
-		bytesRead:  requestBodyBytes.With(s.labels),
+		bytesRead:  requestBodyBytes.With(s.operationLabels()),
 	}
+	req.Body = src
 	srw := &statResponseWriter{
-		ResponseWriter: rw,
-		bytesWritten:   responseBodyBytes.With(s.labels),
+		ResponseWriter:  rw,
+		bytesWritten:    responseBodyBytes.With(s.operationLabels()),
+		responseHeaders: s.user.responseHeaders,
+	}
+	if s.user.allowCORS {
+		srw.corsOrigin = req.Header.Get("Origin")
+		if len(srw.corsOrigin) == 0 {
+			srw.corsOrigin = "*"
+		}
 	}
+	defer func() {
+		rp.auditRequest(s, req, srw.StatusCode(), srw.written, startTime)
+	}()
 
-	req, origParams := s.decorateRequest(req)
+	req, origParams, err := s.decorateRequest(req)
+	if err != nil {
+		err = fmt.Errorf("%s: %w", s, err)
+		respondWith(srw, err, http.StatusBadRequest)
+		return
+	}
+	if s.streamedBody {
+		streamedInsertRequests.With(prometheus.Labels{"user": s.user.name}).Inc()
+		// The cache key cannot be computed without reading the whole body.
+		origParams.Set("no_cache", "1")
+	}
 
 	// wrap body into cachedReadCloser, so we could obtain the original
 	// request on error.
@@ -136,27 +214,51 @@ func (rp *reverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	if s.sessionId != "" {
 		rw.Header().Set("X-ClickHouse-Server-Session-Id", s.sessionId)
 	}
+	rw.Header().Set(requestIDHeader, s.requestID)
+	if s.fallback {
+		rw.Header().Set(fallbackHeader, "true")
+	}
 
-	q, shouldReturnFromCache, err := shouldRespondFromCache(s, origParams, req)
+	q, shouldReturnFromCache, err := shouldRespondFromCache(s, srw, origParams, req)
 	if err != nil {
 		respondWith(srw, err, http.StatusBadRequest)
 		return
 	}
 
+	rp.queries.register(s, peekQuerySnippet(req))
+	defer rp.queries.unregister(s)
+
+	execStartTime := time.Now()
 	if shouldReturnFromCache {
 		rp.serveFromCache(s, srw, req, origParams, q)
-	} else {
+	} else if !rp.batchInsert(s, srw, req) {
 		rp.proxyRequest(s, srw, srw, req)
 	}
+	execDuration := time.Since(execStartTime)
+	if !s.servedFromCache {
+		s.user.queryDurations.add(execDuration)
+	}
+	if s.user.hasQuota() {
+		s.user.quota.consume(execDuration, srw.written)
+	}
+	if s.user.hasDailyBudget() {
+		s.user.consumeDailyBudget(execDuration)
+	}
+	if !srw.wroteHeader {
+		// The response has no body, so the header
+		// is written once the handler returns.
+		srw.setHeaders()
+	}
 
 	// It is safe calling getQuerySnippet here, since the request
 	// has been already read in proxyRequest or serveFromCache.
 	query := getQuerySnippet(req)
 	if srw.statusCode == http.StatusOK {
-		requestSuccess.With(s.labels).Inc()
+		requestSuccess.With(s.requestLabels()).Inc()
 		log.Debugf("%s: request success; query: %q; Method: %s; URL: %q", s, query, req.Method, req.URL.String())
 	} else {
-		log.Debugf("%s: request failure: non-200 status code %d; query: %q; Method: %s; URL: %q", s, srw.statusCode, query, req.Method, req.URL.String())
+		log.Debugf("%s: request failure: non-200 status code %d; exception code: %q; query: %q; Method: %s; URL: %q",
+			s, srw.statusCode, s.exceptionCode, query, req.Method, req.URL.String())
 	}
 
 	statusCodes.With(
@@ -167,19 +269,26 @@ func (rp *reverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 			"replica":      s.host.ReplicaName(),
 			"cluster_node": s.host.Host(),
 			"code":         strconv.Itoa(srw.statusCode),
+			"error_code":   s.exceptionCode,
 		},
 	).Inc()
 	since := time.Since(startTime).Seconds()
-	requestDuration.With(s.labels).Observe(since)
+	requestDuration.With(s.requestLabels()).Observe(since)
+
+	sizeLabels := s.sizeLabels(srw.statusCode)
+	requestSize.With(sizeLabels).Observe(float64(src.read))
+	responseSize.With(sizeLabels).Observe(float64(srw.written))
+
+	rp.recordSlowQuery(s, srw, query, startTime)
 }
 
-func shouldRespondFromCache(s *scope, origParams url.Values, req *http.Request) ([]byte, bool, error) {
+func shouldRespondFromCache(s *scope, rw http.ResponseWriter, origParams url.Values, req *http.Request) ([]byte, bool, error) {
 	if s.user.cache == nil || s.user.cache.Cache == nil {
 		return nil, false, nil
 	}
 
-	noCache := origParams.Get("no_cache")
-	if noCache == "1" || noCache == "true" {
+	if isCacheBypassed(origParams, req) {
+		rw.Header().Set("X-Cache", XCacheNA)
 		return nil, false, nil
 	}
 
@@ -188,7 +297,57 @@ func shouldRespondFromCache(s *scope, origParams url.Values, req *http.Request)
 		return nil, false, fmt.Errorf("%s: cannot read query: %w", s, err)
 	}
 
-	return q, canCacheQuery(q), nil
+	if !canCacheQuery(q) {
+		return q, false, nil
+	}
+	if s.user.matchesCacheBypassPattern(q) {
+		// The query is proxied without storing the response in the cache.
+		cacheBypassed.With(makeCacheLabels(s)).Inc()
+		rw.Header().Set("X-Cache", XCacheMiss)
+		return q, false, nil
+	}
+	return q, true, nil
+}
+
+// matchesCacheBypassPattern returns true if the normalized q matches
+// any of `cache_bypass_patterns` of the user.
+func (u *user) matchesCacheBypassPattern(q []byte) bool {
+	if len(u.cacheBypassPatterns) == 0 {
+		return false
+	}
+	nq := normalizeQuery(skipLeadingComments(q))
+	for _, re := range u.cacheBypassPatterns {
+		if re.Match(nq) {
+			return true
+		}
+	}
+	return false
+}
+
+// isCacheBypassed returns true if the client asks to bypass the cache via:
+//   - `no_cache=1` or `no_cache=true` query param;
+//   - `X-No-Cache: 1` or `X-No-Cache: true` header, which may be set
+//     by clients unable to modify the URL;
+//   - `Cache-Control: no-cache` or `Cache-Control: no-store` header
+//     according to the standard HTTP caching semantics.
+func isCacheBypassed(origParams url.Values, req *http.Request) bool {
+	noCache := origParams.Get("no_cache")
+	if noCache == "1" || noCache == "true" {
+		return true
+	}
+	noCache = req.Header.Get("X-No-Cache")
+	if noCache == "1" || noCache == "true" {
+		return true
+	}
+	for _, v := range req.Header.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			if directive == "no-cache" || directive == "no-store" {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func executeWithRetry(
@@ -207,10 +366,15 @@ func executeWithRetry(
 
 	// Use readAndRestoreRequestBody to read the entire request body into a byte slice,
 	// and to restore req.Body so that it can be reused later in the code.
-	body, err := readAndRestoreRequestBody(req)
-	if err != nil {
-		since := time.Since(startTime).Seconds()
-		return since, err
+	// Streamed bodies cannot be reused, so such requests aren't retried.
+	var body []byte
+	if !s.streamedBody {
+		var err error
+		body, err = readAndRestoreRequestBody(req)
+		if err != nil {
+			since := time.Since(startTime).Seconds()
+			return since, err
+		}
 	}
 
 	numRetry := 0
@@ -218,7 +382,9 @@ func executeWithRetry(
 		rp(rw, req)
 
 		// Restore req.Body after it's consumed by 'rp' for potential reuse.
-		req.Body = io.NopCloser(bytes.NewBuffer(body))
+		if !s.streamedBody {
+			req.Body = io.NopCloser(bytes.NewBuffer(body))
+		}
 
 		err := ctx.Err()
 		if err != nil {
@@ -237,9 +403,17 @@ func executeWithRetry(
 			// comment s.host.dec() line to avoid double increment; issue #322
 			// s.host.dec()
 			s.host.SetIsActive(false)
-			nextHost := s.cluster.getHost()
+			nextHost := s.cluster.pickHost("", s.hashKey)
 			// The query could be retried if it has no stickiness to a certain server
-			if numRetry < maxRetry && nextHost.IsActive() && s.sessionId == "" {
+			canRetry := numRetry < maxRetry && nextHost.IsActive() && s.sessionId == "" && !s.streamedBody
+			if canRetry && !waitRetryDelay(ctx, s.cluster, numRetry) {
+				if err := ctx.Err(); err != nil {
+					since = time.Since(startTime).Seconds()
+					return since, err
+				}
+				canRetry = false
+			}
+			if canRetry {
 				// the query execution has been failed
 				monitorRetryRequestInc(s.labels)
 				currentHost := s.host
@@ -274,6 +448,29 @@ func executeWithRetry(
 	return since, nil
 }
 
+// waitRetryDelay sleeps for the delay before the retry with the given number.
+// It returns false without sleeping if the retry would exceed the deadline
+// of ctx, i.e. the max_execution_time of the query, or if ctx is done
+// while sleeping.
+func waitRetryDelay(ctx context.Context, c *cluster, numRetry int) bool {
+	d := c.retryBackoff(numRetry)
+	if d <= 0 {
+		return true
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= d {
+		return false
+	}
+	retryDelayMs.With(prometheus.Labels{"cluster": c.name}).Add(float64(d.Milliseconds()))
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
 // proxyRequest proxies the given request to clickhouse and sends response
 // to rw.
 //
@@ -288,6 +485,16 @@ func (rp *reverseProxy) proxyRequest(s *scope, rw ResponseWriterWithCode, srw *s
 		}
 	}
 
+	// Responses captured into temporary files are limited
+	// by cache.TmpFileResponseWriter and re-encoded on serving.
+	direct := rw == ResponseWriterWithCode(srw)
+	if s.user.maxResponseSize > 0 && direct {
+		rw = &limitedResponseWriter{
+			ResponseWriterWithCode: rw,
+			maxSize:                s.user.maxResponseSize,
+		}
+	}
+
 	timeout, timeoutErrMsg := s.getTimeoutWithErrMsg()
 	ctx := context.Background()
 	if timeout > 0 {
@@ -300,15 +507,37 @@ func (rp *reverseProxy) proxyRequest(s *scope, rw ResponseWriterWithCode, srw *s
 	// so the proxied query may be killed instantly.
 	ctx, ctxCancel := listenToCloseNotify(ctx, rw)
 	defer ctxCancel()
+	// Cancel the ctx if the query is killed via /queries.
+	ctx, killCancel := context.WithCancelCause(ctx)
+	defer killCancel(nil)
+	rp.queries.setCancel(s, killCancel)
+	ctx = withClusterTransport(ctx, s.cluster)
+	if direct {
+		ctx = withResponseEncoding(ctx, s.user.responseEncoding)
+	}
 
 	req = req.WithContext(ctx)
 
+	if len(s.user.mirrorToCluster) > 0 {
+		rp.mirrorRequest(s, req)
+	}
+
 	startTime := time.Now()
 
 	executeDuration, err := executeWithRetry(ctx, s, s.cluster.retryNumber, rp.rp.ServeHTTP, rw, srw, req, func(duration float64) {
 		proxiedResponseDuration.With(s.labels).Observe(duration)
 	}, func(labels prometheus.Labels) { retryRequest.With(labels).Inc() })
 
+	if code := rw.Header().Get(exceptionCodeHeader); code != "" {
+		s.exceptionCode = code
+		clickhouseErrorCodes.With(
+			prometheus.Labels{
+				"cluster":    s.cluster.name,
+				"error_code": code,
+			},
+		).Inc()
+	}
+
 	statusCodesClickhouse.With(
 		prometheus.Labels{
 			"cluster":      s.cluster.name,
@@ -317,6 +546,10 @@ func (rp *reverseProxy) proxyRequest(s *scope, rw ResponseWriterWithCode, srw *s
 			"code":         strconv.Itoa(rw.StatusCode()),
 		},
 	).Inc()
+	if sl, ok := rw.(sizeLimiter); ok && sl.SizeExceeded() {
+		rp.handleResponseSizeExceeded(s, srw, req)
+		return
+	}
 	switch {
 	case err == nil:
 		return
@@ -324,10 +557,19 @@ func (rp *reverseProxy) proxyRequest(s *scope, rw ResponseWriterWithCode, srw *s
 		canceledRequest.With(s.labels).Inc()
 
 		q := getQuerySnippet(req)
-		log.Debugf("%s: remote client closed the connection in %s; query: %q", s, time.Since(startTime), q)
+		killed := errors.Is(context.Cause(ctx), errQueryKilled)
+		if killed {
+			log.Debugf("%s: query killed in %s; query: %q", s, time.Since(startTime), q)
+		} else {
+			log.Debugf("%s: remote client closed the connection in %s; query: %q", s, time.Since(startTime), q)
+		}
 		if err := s.killQuery(); err != nil {
 			log.Errorf("%s: cannot kill query: %s; query: %q", s, err, q)
 		}
+		if killed {
+			err = fmt.Errorf("%s: %w; query: %q", s, errQueryKilled, q)
+			respondWith(rw, err, 499)
+		}
 		srw.statusCode = 499 // See https://httpstatuses.com/499 .
 	case errors.Is(err, context.DeadlineExceeded):
 		timeoutRequest.With(s.labels).Inc()
@@ -371,6 +613,32 @@ func listenToCloseNotify(ctx context.Context, rw ResponseWriterWithCode) (contex
 	return ctx, ctxCancel
 }
 
+// handleResponseSizeExceeded kills the query with the response exceeding
+// max_response_size. The client is responded with 413 unless the response
+// has been partially sent. The connection is closed in the latter case,
+// since the status code cannot be changed anymore.
+func (rp *reverseProxy) handleResponseSizeExceeded(s *scope, srw *statResponseWriter, req *http.Request) {
+	responseSizeLimitExceeded.With(prometheus.Labels{"user": s.user.name}).Inc()
+
+	q := getQuerySnippet(req)
+	if err := s.killQuery(); err != nil {
+		log.Errorf("%s: cannot kill query: %s; query: %q", s, err, q)
+	}
+	err := fmt.Errorf("%s: response exceeds max_response_size limit: %d; query: %q", s, s.user.maxResponseSize, q)
+	if srw.written == 0 {
+		// Drop the headers of the proxied response describing its body.
+		srw.Header().Del("Content-Encoding")
+		srw.Header().Del("Content-Length")
+		respondWith(srw, err, http.StatusRequestEntityTooLarge)
+		return
+	}
+	log.Errorf("%s", err)
+	srw.statusCode = http.StatusRequestEntityTooLarge
+	if err := abortResponse(srw.ResponseWriter); err != nil {
+		log.Debugf("%s: cannot close client connection: %s", s, err)
+	}
+}
+
 //nolint:cyclop //TODO refactor this method, most likely requires some work.
 func (rp *reverseProxy) serveFromCache(s *scope, srw *statResponseWriter, req *http.Request, origParams url.Values, q []byte) {
 	labels := makeCacheLabels(s)
@@ -384,9 +652,19 @@ func (rp *reverseProxy) serveFromCache(s *scope, srw *statResponseWriter, req *h
 		// The response has been successfully served from cache.
 		defer cachedData.Data.Close()
 		cacheHit.With(labels).Inc()
+		cache.ServedBytes.With(prometheus.Labels{"cache": userCache.Name()}).Observe(float64(cachedData.Length))
 		cachedResponseDuration.With(labels).Observe(time.Since(startTime).Seconds())
+		if cachedData.Stale {
+			cacheStale.With(labels).Inc()
+			log.Debugf("%s: stale cache hit", s)
+			rp.revalidateCache(s, req, key, q)
+			s.servedFromCache = true
+			respondWithCachedData(s, srw, req, cachedData, 0, XCacheStale, labels)
+			return
+		}
 		log.Debugf("%s: cache hit", s)
-		_ = RespondWithData(srw, cachedData.Data, cachedData.ContentMetadata, cachedData.Ttl, XCacheHit, http.StatusOK, labels)
+		s.servedFromCache = true
+		respondWithCachedData(s, srw, req, cachedData, cachedData.Ttl, XCacheHit, labels)
 		return
 	}
 	// Await for potential result from concurrent query
@@ -399,8 +677,10 @@ func (rp *reverseProxy) serveFromCache(s *scope, srw *statResponseWriter, req *h
 			cachedData, err := userCache.Get(key)
 			if err == nil {
 				defer cachedData.Data.Close()
-				_ = RespondWithData(srw, cachedData.Data, cachedData.ContentMetadata, cachedData.Ttl, XCacheHit, http.StatusOK, labels)
+				s.servedFromCache = true
+				respondWithCachedData(s, srw, req, cachedData, cachedData.Ttl, XCacheHit, labels)
 				cacheHitFromConcurrentQueries.With(labels).Inc()
+				cache.ServedBytes.With(prometheus.Labels{"cache": userCache.Name()}).Observe(float64(cachedData.Length))
 				log.Debugf("%s: cache hit after awaiting concurrent query", s)
 				return
 			} else {
@@ -415,6 +695,12 @@ func (rp *reverseProxy) serveFromCache(s *scope, srw *statResponseWriter, req *h
 
 	// The response wasn't found in the cache.
 	// Request it from clickhouse.
+	if userCache.AsyncWrites && len(s.user.responseEncoding) == 0 {
+		// Responses re-encoded according to `response_compression`
+		// are captured before being sent, so they aren't streamed.
+		rp.serveCacheMissAsync(s, srw, req, key, q, labels)
+		return
+	}
 	tmpFileRespWriter, err := cache.NewTmpFileResponseWriter(srw, os.TempDir())
 	if err != nil {
 		err = fmt.Errorf("%s: %w; query: %q", s, err, q)
@@ -422,15 +708,23 @@ func (rp *reverseProxy) serveFromCache(s *scope, srw *statResponseWriter, req *h
 		return
 	}
 	defer tmpFileRespWriter.Close()
+	tmpFileRespWriter.SetMaxSize(s.user.maxResponseSize)
+	tmpFileRespWriter.SetCachedHeaders(userCache.CachedHeaders)
 
 	// Initialise transaction
-	err = userCache.Create(key)
+	err = userCache.Create(key, s.user.name)
 	if err != nil {
 		log.Errorf("%s: %s; query: %q - failed to register transaction", s, err, q)
 	}
 
 	// proxy request and capture response along with headers to [[TmpFileResponseWriter]]
 	rp.proxyRequest(s, tmpFileRespWriter, srw, req)
+	if tmpFileRespWriter.SizeExceeded() {
+		// The client has been already responded by proxyRequest.
+		rp.completeTransaction(s, http.StatusRequestEntityTooLarge, userCache, key, q,
+			fmt.Sprintf("%s response exceeds max_response_size limit: %d", failedTransactionPrefix, s.user.maxResponseSize))
+		return
+	}
 
 	contentEncoding := tmpFileRespWriter.GetCapturedContentEncoding()
 	contentType := tmpFileRespWriter.GetCapturedContentType()
@@ -446,7 +740,12 @@ func (rp *reverseProxy) serveFromCache(s *scope, srw *statResponseWriter, req *h
 		respondWith(srw, err, http.StatusInternalServerError)
 		return
 	}
-	contentMetadata := cache.ContentMetadata{Length: contentLength, Encoding: contentEncoding, Type: contentType}
+	contentMetadata := cache.ContentMetadata{
+		Length:   contentLength,
+		Encoding: contentEncoding,
+		Type:     contentType,
+		Headers:  tmpFileRespWriter.GetCapturedHeaders(),
+	}
 
 	statusCode := tmpFileRespWriter.StatusCode()
 	if statusCode != http.StatusOK || s.canceled {
@@ -492,7 +791,10 @@ func (rp *reverseProxy) serveFromCache(s *scope, srw *statResponseWriter, req *h
 
 			rp.completeTransaction(s, statusCode, userCache, key, q, "")
 
-			err = RespondWithData(srw, reader, contentMetadata, 0*time.Second, XCacheNA, tmpFileRespWriter.StatusCode(), labels)
+			data, metadata, err := compressResponse(s, req, reader, contentMetadata)
+			if err == nil {
+				err = RespondWithData(srw, data, metadata, 0*time.Second, XCacheNA, tmpFileRespWriter.StatusCode(), labels)
+			}
 			if err != nil {
 				err = fmt.Errorf("%s: %w; query: %q", s, err, q)
 				respondWith(srw, err, http.StatusInternalServerError)
@@ -516,7 +818,11 @@ func (rp *reverseProxy) serveFromCache(s *scope, srw *statResponseWriter, req *h
 			respondWith(srw, err, http.StatusInternalServerError)
 			return
 		}
-		err = RespondWithData(srw, reader, contentMetadata, expiration, XCacheMiss, statusCode, labels)
+		// The response is cached as sent by ClickHouse and re-encoded on serving.
+		data, metadata, err := compressResponse(s, req, reader, contentMetadata)
+		if err == nil {
+			err = RespondWithData(srw, data, metadata, expiration, XCacheMiss, statusCode, labels)
+		}
 		if err != nil {
 			err = fmt.Errorf("%s: %w; query: %q", s, err, q)
 			respondWith(srw, err, http.StatusInternalServerError)
@@ -525,6 +831,26 @@ func (rp *reverseProxy) serveFromCache(s *scope, srw *statResponseWriter, req *h
 	}
 }
 
+// respondWithCachedData sends the cached response to the client.
+// The response is re-encoded to the encoding accepted by the client
+// if the cache transcodes responses or the user has `response_compression`.
+func respondWithCachedData(s *scope, srw *statResponseWriter, req *http.Request, cachedData *cache.CachedData, ttl time.Duration, cacheHit string, labels prometheus.Labels) {
+	var data io.Reader = cachedData.Data
+	metadata := cachedData.ContentMetadata
+	// The response re-encoded according to `response_compression`
+	// isn't transcoded, since its encoding is accepted by the client.
+	data, metadata, err := compressResponse(s, req, data, metadata)
+	if err == nil && s.user.cache.TranscodeResponses {
+		data, metadata, err = transcodeResponse(data, metadata, req.Header.Get("Accept-Encoding"))
+	}
+	if err != nil {
+		err = fmt.Errorf("%s: %w", s, err)
+		respondWith(srw, err, http.StatusInternalServerError)
+		return
+	}
+	_ = RespondWithData(srw, data, metadata, ttl, cacheHit, http.StatusOK, labels)
+}
+
 func makeCacheLabels(s *scope) prometheus.Labels {
 	// Do not store `replica` and `cluster_node` in labels, since they have
 	// no sense for cache metrics.
@@ -541,11 +867,17 @@ func newCacheKey(s *scope, origParams url.Values, q []byte, req *http.Request) *
 	if s.user.params != nil {
 		userParamsHash = s.user.params.key
 	}
+	var forcedParamsHash uint32
+	if s.user.forcedParams != nil {
+		forcedParamsHash = s.user.forcedParams.key
+	}
 
 	queryParamsHash := calcQueryParamsHash(origParams)
 	credHash, err := uint32(0), error(nil)
 
 	if !s.user.cache.SharedWithAllUsers {
+		// The cluster user of wildcarded users carries the original credentials,
+		// so every concrete user has its own cache entries.
 		credHash, err = calcCredentialHash(s.clusterUser.name, s.clusterUser.password)
 	}
 	if err != nil {
@@ -553,11 +885,24 @@ func newCacheKey(s *scope, origParams url.Values, q []byte, req *http.Request) *
 		credHash = 0
 	}
 
+	q = skipLeadingComments(q)
+	if s.user.cache.NormalizeQueries {
+		q = normalizeQuery(q)
+	}
+
+	acceptEncoding := sortHeader(req.Header.Get("Accept-Encoding"))
+	if s.user.cache.TranscodeResponses {
+		// Cached responses are re-encoded to the encoding accepted
+		// by the client, so they are shared between all the encodings.
+		acceptEncoding = ""
+	}
+
 	return cache.NewKey(
-		skipLeadingComments(q),
+		q,
 		origParams,
-		sortHeader(req.Header.Get("Accept-Encoding")),
+		acceptEncoding,
 		userParamsHash,
+		forcedParamsHash,
 		queryParamsHash,
 		credHash,
 	)
@@ -596,6 +941,7 @@ func (rp *reverseProxy) completeTransaction(s *scope, statusCode int, userCache
 			log.Errorf("%s: %s; query: %q", s, err, q)
 		}
 	} else {
+		failReason = withExceptionCode(failReason, s.exceptionCode)
 		if err := userCache.Fail(key, failReason); err != nil {
 			log.Errorf("%s: %s; query: %q", s, err, q)
 		}
@@ -628,17 +974,18 @@ func (rp *reverseProxy) applyConfig(cfg *config.Config) error {
 	rp.configLock.Lock()
 	defer rp.configLock.Unlock()
 
-	clusters, err := newClusters(cfg.Clusters)
+	clusters, err := newClusters(cfg.Clusters, rp.transports)
 	if err != nil {
 		return err
 	}
 
 	rp.maxErrorReasonSize = int64(cfg.MaxErrorReasonSize)
+	rp.slowQueries.resize(cfg.SlowQueryLogSize)
 
 	caches := make(map[string]*cache.AsyncCache, len(cfg.Caches))
 	defer func() {
-		// caches is swapped with old caches from rp.caches
-		// on successful config reload - see the end of reloadConfig.
+		// caches is swapped with old caches from rp.snapshot
+		// on successful config reload - see the end of applyConfig.
 		for _, tmpCache := range caches {
 			// Speed up applyConfig by closing caches in background,
 			// since the process of cache closing may be lengthy
@@ -647,20 +994,7 @@ func (rp *reverseProxy) applyConfig(cfg *config.Config) error {
 		}
 	}()
 
-	// transactionsTimeout used for creation of transactions registry inside async cache.
-	// It is set to the highest configured execution time of all users to avoid setups were users use the same cache and have configured different maxExecutionTime.
-	// This would provoke undesired behaviour of `dogpile effect`
-	transactionsTimeout := config.Duration(0)
-	for _, user := range cfg.Users {
-		if user.MaxExecutionTime > transactionsTimeout {
-			transactionsTimeout = user.MaxExecutionTime
-		}
-		if user.IsWildcarded {
-			rp.hasWildcarded = true
-		}
-	}
-
-	if err := initTempCaches(caches, transactionsTimeout, cfg.Caches); err != nil {
+	if err := initTempCaches(caches, transactionsTimeout(cfg.Users), cfg.Caches, cache.NewAsyncCache); err != nil {
 		return err
 	}
 
@@ -670,10 +1004,11 @@ func (rp *reverseProxy) applyConfig(cfg *config.Config) error {
 	}
 
 	profile := &usersProfile{
-		cfg:      cfg.Users,
-		clusters: clusters,
-		caches:   caches,
-		params:   params,
+		cfg:                cfg.Users,
+		clusters:           clusters,
+		caches:             caches,
+		params:             params,
+		maxRequestBodySize: cfg.Server.MaxRequestBodySize,
 	}
 	users, err := profile.newUsers()
 	if err != nil {
@@ -684,6 +1019,17 @@ func (rp *reverseProxy) applyConfig(cfg *config.Config) error {
 		return err
 	}
 
+	ja, err := newJWTAuth(cfg.Auth)
+	if err != nil {
+		return err
+	}
+
+	prevAuditLog := rp.snapshot.Load().auditLog
+	auditLog, err := reuseAuditLogger(cfg.AuditLog, prevAuditLog)
+	if err != nil {
+		return err
+	}
+
 	// New configs have been successfully prepared.
 	// Restart service goroutines with new configs.
 
@@ -691,36 +1037,137 @@ func (rp *reverseProxy) applyConfig(cfg *config.Config) error {
 	close(rp.reloadSignal)
 	rp.reloadWG.Wait()
 	rp.reloadSignal = make(chan struct{})
+	old := rp.snapshot.Load()
+	preserveQuotas(users, old.users)
+	preserveDailyBudgets(users, old.users)
+	preserveSessions(users, old.users, clusters, old.clusters)
+	preserveInsertBatchers(users, old.users)
 	rp.restartWithNewConfig(caches, clusters, users)
 
+	snapshot := &proxySnapshot{
+		users:    users,
+		clusters: clusters,
+		caches:   caches,
+		ldapAuth: newLDAPAuth(cfg.AuthBackend),
+		jwtAuth:  ja,
+		auditLog: auditLog,
+	}
+	for _, user := range cfg.Users {
+		if user.IsWildcarded {
+			snapshot.hasWildcarded = true
+		}
+	}
+
 	// Substitute old configs with the new configs in rp.
 	// All the currently running requests will continue with old configs,
 	// while all the new requests will use new configs.
-	rp.lock.Lock()
-	rp.clusters = clusters
-	rp.users = users
-	// Swap is needed for deferred closing of old caches.
+	old = rp.snapshot.Swap(snapshot)
+	// Old caches are closed by the deferred code above.
 	// See the code above where new caches are created.
-	caches, rp.caches = rp.caches, caches
-	rp.lock.Unlock()
+	caches = old.caches
+	if prevAuditLog != nil && prevAuditLog != auditLog {
+		// Records of requests running with the old config
+		// are dropped after the old audit log is closed.
+		go prevAuditLog.close()
+	}
 
 	return nil
 }
 
-func initTempCaches(caches map[string]*cache.AsyncCache, transactionsTimeout config.Duration, cfg []config.Cache) error {
+// validateConfig checks whether cfg may be applied via applyConfig
+// without applying it. The errors of all the checks are returned.
+// Caches are created in dry-run mode, so the validation has no side effects.
+func validateConfig(cfg *config.Config) error {
+	var errs []error
+	clusters, err := newClusters(cfg.Clusters, newClusterTransports(&http.Transport{}))
+	errs = append(errs, err)
+
+	caches := make(map[string]*cache.AsyncCache, len(cfg.Caches))
+	errs = append(errs, initTempCaches(caches, transactionsTimeout(cfg.Users), cfg.Caches, cache.NewAsyncCacheDryRun))
+
+	params, err := paramsFromConfig(cfg.ParamGroups)
+	errs = append(errs, err)
+
+	profile := &usersProfile{
+		cfg:                cfg.Users,
+		clusters:           clusters,
+		caches:             caches,
+		params:             params,
+		maxRequestBodySize: cfg.Server.MaxRequestBodySize,
+	}
+	_, err = profile.newUsers()
+	errs = append(errs, err)
+
+	errs = append(errs, validateNoWildcardedUserForHeartbeat(clusters, cfg.Clusters))
+
+	_, err = newJWTAuth(cfg.Auth)
+	errs = append(errs, err)
+	return errors.Join(errs...)
+}
+
+// transactionsTimeout returns the timeout used for creation of transactions registry inside async cache.
+// It is set to the highest configured execution time of all users to avoid setups were users use the same cache and have configured different maxExecutionTime.
+// This would provoke undesired behaviour of `dogpile effect`
+func transactionsTimeout(users []config.User) config.Duration {
+	timeout := config.Duration(0)
+	for _, user := range users {
+		if user.MaxExecutionTime > timeout {
+			timeout = user.MaxExecutionTime
+		}
+	}
+	return timeout
+}
+
+// initTempCaches initializes caches from cfg via newCache.
+// The errors of all the caches are returned.
+func initTempCaches(caches map[string]*cache.AsyncCache, transactionsTimeout config.Duration, cfg []config.Cache,
+	newCache func(config.Cache, time.Duration) (*cache.AsyncCache, error)) error {
+	var errs []error
 	for _, cc := range cfg {
 		if _, ok := caches[cc.Name]; ok {
-			return fmt.Errorf("duplicate config for cache %q", cc.Name)
+			errs = append(errs, fmt.Errorf("duplicate config for cache %q", cc.Name))
+			continue
+		}
+		if cc.Mode == "layered" {
+			continue
 		}
 
-		tmpCache, err := cache.NewAsyncCache(cc, time.Duration(transactionsTimeout))
+		tmpCache, err := newCache(cc, time.Duration(transactionsTimeout))
 		if err != nil {
-			return err
+			errs = append(errs, err)
+			continue
 		}
 		caches[cc.Name] = tmpCache
 	}
 
-	return nil
+	// Layered caches are initialized once the caches they consist of are ready.
+	for _, cc := range cfg {
+		if cc.Mode != "layered" {
+			continue
+		}
+		if _, ok := caches[cc.Name]; ok {
+			errs = append(errs, fmt.Errorf("duplicate config for cache %q", cc.Name))
+			continue
+		}
+		l1, ok := caches[cc.L1]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown cache %q in layered cache %q", cc.L1, cc.Name))
+			continue
+		}
+		l2, ok := caches[cc.L2]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown cache %q in layered cache %q", cc.L2, cc.Name))
+			continue
+		}
+		tmpCache, err := cache.NewLayeredAsyncCache(cc, l1, l2, time.Duration(transactionsTimeout))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		caches[cc.Name] = tmpCache
+	}
+
+	return errors.Join(errs...)
 }
 
 func paramsFromConfig(cfg []config.ParamGroup) (map[string]*paramsRegistry, error) {
@@ -741,25 +1188,30 @@ func paramsFromConfig(cfg []config.ParamGroup) (map[string]*paramsRegistry, erro
 }
 
 func validateNoWildcardedUserForHeartbeat(clusters map[string]*cluster, cfg []config.Cluster) error {
+	var errs []error
 	for c := range cfg {
 		cfgcl := cfg[c]
 		clname := cfgcl.Name
 		cuname := cfgcl.ClusterUsers[0].Name
 		heartbeat := cfg[c].HeartBeat
-		cl := clusters[clname]
+		cl, ok := clusters[clname]
+		if !ok {
+			// The cluster failed to initialize.
+			continue
+		}
 		cu := cl.users[cuname]
 
 		if cu.isWildcarded {
 			if heartbeat.Request != "/ping" && len(heartbeat.User) == 0 {
-				return fmt.Errorf(
+				errs = append(errs, fmt.Errorf(
 					"`cluster.heartbeat.user ` cannot be unset for %q because a wildcarded user cannot send heartbeat",
 					clname,
-				)
+				))
 			}
 		}
 	}
 
-	return nil
+	return errors.Join(errs...)
 }
 
 func (rp *reverseProxy) restartWithNewConfig(caches map[string]*cache.AsyncCache, clusters map[string]*cluster, users map[string]*user) {
@@ -769,13 +1221,26 @@ func (rp *reverseProxy) restartWithNewConfig(caches map[string]*cache.AsyncCache
 	// Gauge metrics may become irrelevant if they may freeze at non-zero
 	// value after config reload.
 	topology.HostHealth.Reset()
+	hostWeight.Reset()
 	cacheSize.Reset()
 	cacheItems.Reset()
+	cacheHitRatio.Reset()
+	activeSessions.Reset()
+	dailyBudgetRemaining.Reset()
+	for _, u := range users {
+		if u.sessions != nil {
+			u.sessions.updateMetric()
+		}
+		if u.hasDailyBudget() {
+			u.dailyBudget.updateRemaining(u.dailyBudget.used.Load())
+		}
+	}
 
 	// Start service goroutines with new configs.
 	for _, c := range clusters {
 		for _, r := range c.replicas {
 			for _, h := range r.hosts {
+				r.updateHostWeightMetric(h)
 				rp.reloadWG.Add(1)
 				go func(h *topology.Node) {
 					h.StartHeartbeat(rp.reloadSignal)
@@ -797,67 +1262,144 @@ func (rp *reverseProxy) restartWithNewConfig(caches map[string]*cache.AsyncCache
 			u.rateLimiter.run(rp.reloadSignal)
 			rp.reloadWG.Done()
 		}(u)
+		if u.hasQuota() {
+			rp.reloadWG.Add(1)
+			go func(u *user) {
+				u.quota.run(rp.reloadSignal)
+				rp.reloadWG.Done()
+			}(u)
+		}
+		if u.hasDailyBudget() {
+			rp.reloadWG.Add(1)
+			go func(u *user) {
+				u.dailyBudget.run(rp.reloadSignal)
+				rp.reloadWG.Done()
+			}(u)
+		}
 	}
 }
 
-// refreshCacheMetrics refreshes cacheSize and cacheItems metrics.
+// refreshCacheMetrics refreshes cacheSize, cacheItems and cacheHitRatio metrics.
 func (rp *reverseProxy) refreshCacheMetrics() {
-	rp.lock.RLock()
-	defer rp.lock.RUnlock()
+	hits := sumByLabel(cacheHit, "cache")
+	misses := sumByLabel(cacheMiss, "cache")
+	for _, c := range rp.snapshot.Load().caches {
+		// Stats of layered caches are reported per level.
+		levels := map[string]cache.Cache{"": c}
+		if l := c.Levels(); l != nil {
+			levels = map[string]cache.Cache{"l1": l[0], "l2": l[1]}
+		}
+		for level, lc := range levels {
+			stats := lc.Stats()
+			levelLabels := prometheus.Labels{
+				"cache": c.Name(),
+				"level": level,
+			}
+			cacheSize.With(levelLabels).Set(float64(stats.Size))
+			cacheItems.With(levelLabels).Set(float64(stats.Items))
+		}
 
-	for _, c := range rp.caches {
-		stats := c.Stats()
 		labels := prometheus.Labels{
 			"cache": c.Name(),
 		}
-		cacheSize.With(labels).Set(float64(stats.Size))
-		cacheItems.With(labels).Set(float64(stats.Items))
+		if total := hits[c.Name()] + misses[c.Name()]; total > 0 {
+			cacheHitRatio.With(labels).Set(hits[c.Name()] / total)
+		}
 	}
 }
 
 // find user, cluster and clusterUser
 // in case of wildcarded user, cluster user is crafted to use original credentials
 func (rp *reverseProxy) getUser(name string, password string) (found bool, u *user, c *cluster, cu *clusterUser) {
-	rp.lock.RLock()
-	defer rp.lock.RUnlock()
+	ps := rp.snapshot.Load()
 	found = false
-	u = rp.users[name]
+	u = ps.users[name]
 	switch {
 	case u != nil:
 		found = (u.password == password)
 		// existence of c and cu for toCluster is guaranteed by applyConfig
-		c = rp.clusters[u.toCluster]
+		c = ps.clusters[u.toCluster]
 		cu = c.users[u.toUser]
 	case name == "" || name == defaultUser:
 		// default user can't work with the wildcarded feature for security reasons
 		found = false
-	case rp.hasWildcarded:
+	case ps.hasWildcarded:
 		// checking if we have wildcarded users and if username matches one 3 possibles patterns
-		found, u, c, cu = rp.findWildcardedUserInformation(name, password)
+		found, u, c, cu = ps.findWildcardedUserInformation(name, password)
 	}
 	return found, u, c, cu
 }
 
-func (rp *reverseProxy) findWildcardedUserInformation(name string, password string) (found bool, u *user, c *cluster, cu *clusterUser) {
+// getLDAPUser authenticates the user missing in `users` via LDAP.
+// The user authenticated via LDAP gets settings of `ldap_user_template`.
+func (rp *reverseProxy) getLDAPUser(name string, password string) (found bool, u *user, c *cluster, cu *clusterUser) {
+	la := rp.snapshot.Load().ldapAuth
+	// default user can't be authenticated via LDAP for security reasons
+	if la == nil || name == "" || name == defaultUser {
+		return false, nil, nil, nil
+	}
+
+	if err := la.authenticate(name, password); err != nil {
+		if !errors.Is(err, errLDAPInvalidCredentials) {
+			log.Errorf("cannot authenticate user %q via LDAP: %s", name, err)
+		}
+		return false, nil, nil, nil
+	}
+
+	// The config may have been reloaded since la was loaded.
+	ps := rp.snapshot.Load()
+	u = ps.users[la.userTemplate]
+	if u == nil {
+		return false, nil, nil, nil
+	}
+	// existence of c and cu for toCluster is guaranteed by applyConfig
+	c = ps.clusters[u.toCluster]
+	cu = c.users[u.toUser]
+	return true, u, c, cu
+}
+
+// getJWTUser verifies the bearer token and returns the user from `users`
+// named by the token. The password of the user isn't checked.
+func (rp *reverseProxy) getJWTUser(token string) (string, *user, *cluster, *clusterUser, error) {
+	ja := rp.snapshot.Load().jwtAuth
+	name, err := ja.authenticate(token)
+	if err != nil {
+		return "", nil, nil, nil, err
+	}
+
+	// The config may have been reloaded since ja was loaded.
+	ps := rp.snapshot.Load()
+	u := ps.users[name]
+	// Wildcarded users proxy the credentials of requests, which are missing.
+	if u == nil || u.isWildcarded {
+		return "", nil, nil, nil, fmt.Errorf("unknown user %q in `%s` claim", name, ja.userClaim)
+	}
+	// existence of c and cu for toCluster is guaranteed by applyConfig
+	c := ps.clusters[u.toCluster]
+	cu := c.users[u.toUser]
+	return name, u, c, cu, nil
+}
+
+func (ps *proxySnapshot) findWildcardedUserInformation(name string, password string) (found bool, u *user, c *cluster, cu *clusterUser) {
 	// cf a validation in config.go, the names must contains either a prefix, a suffix or a wildcard
 	// the wildcarded user is "*"
 	// the wildcarded user is "*[suffix]"
 	// the wildcarded user is "[prefix]*"
-	for _, user := range rp.users {
+	for _, user := range ps.users {
 		if user.isWildcarded {
 			s := strings.Split(user.name, "*")
 			switch {
 			case s[0] == "" && s[1] == "":
-				return rp.generateWildcardedUserInformation(user, name, password)
+				return ps.generateWildcardedUserInformation(user, name, password)
 			case s[0] == "":
 				suffix := s[1]
 				if strings.HasSuffix(name, suffix) {
-					return rp.generateWildcardedUserInformation(user, name, password)
+					return ps.generateWildcardedUserInformation(user, name, password)
 				}
 			case s[1] == "":
 				prefix := s[0]
 				if strings.HasPrefix(name, prefix) {
-					return rp.generateWildcardedUserInformation(user, name, password)
+					return ps.generateWildcardedUserInformation(user, name, password)
 				}
 			}
 		}
@@ -865,9 +1407,9 @@ func (rp *reverseProxy) findWildcardedUserInformation(name string, password stri
 	return false, nil, nil, nil
 }
 
-func (rp *reverseProxy) generateWildcardedUserInformation(user *user, name string, password string) (found bool, u *user, c *cluster, cu *clusterUser) {
+func (ps *proxySnapshot) generateWildcardedUserInformation(user *user, name string, password string) (found bool, u *user, c *cluster, cu *clusterUser) {
 	found = false
-	c = rp.clusters[user.toCluster]
+	c = ps.clusters[user.toCluster]
 	wildcardedCu := c.users[user.toUser]
 	if wildcardedCu != nil {
 		newCU := deepCopy(wildcardedCu)
@@ -897,9 +1439,20 @@ func (rp *reverseProxy) getScope(req *http.Request) (*scope, int, error) {
 		cu *clusterUser
 	)
 
-	found, u, c, cu := rp.getUser(name, password)
-	if !found {
-		return nil, http.StatusUnauthorized, fmt.Errorf("invalid username or password for user %q", name)
+	if token := getBearerToken(req); len(token) > 0 && rp.snapshot.Load().jwtAuth != nil {
+		var err error
+		if name, u, c, cu, err = rp.getJWTUser(token); err != nil {
+			return nil, http.StatusUnauthorized, fmt.Errorf("invalid bearer token: %w", err)
+		}
+	} else {
+		var found bool
+		found, u, c, cu = rp.getUser(name, password)
+		if !found && u == nil {
+			found, u, c, cu = rp.getLDAPUser(name, password)
+		}
+		if !found {
+			return nil, http.StatusUnauthorized, fmt.Errorf("invalid username or password for user %q", name)
+		}
 	}
 	if u.denyHTTP && req.TLS == nil {
 		return nil, http.StatusForbidden, fmt.Errorf("user %q is not allowed to access via http", u.name)
@@ -910,16 +1463,153 @@ func (rp *reverseProxy) getScope(req *http.Request) (*scope, int, error) {
 	if !u.allowedNetworks.Contains(req.RemoteAddr) {
 		return nil, http.StatusForbidden, fmt.Errorf("user %q is not allowed to access", u.name)
 	}
+
+	if u.maxRequestBodySize > 0 && req.Body != nil {
+		if req.ContentLength > u.maxRequestBodySize {
+			return nil, http.StatusRequestEntityTooLarge, u.errRequestBodyTooLarge()
+		}
+		req.Body = http.MaxBytesReader(nil, req.Body, u.maxRequestBodySize)
+	}
+
+	q, streamedBody, err := u.readQuery(req)
+	if err != nil {
+		var mbErr *http.MaxBytesError
+		if errors.As(err, &mbErr) {
+			return nil, http.StatusRequestEntityTooLarge, u.errRequestBodyTooLarge()
+		}
+		return nil, http.StatusBadRequest, fmt.Errorf("user %q: cannot read query: %w", u.name, err)
+	}
+	if streamedBody {
+		if err := u.checkStreamedBody(q); err != nil {
+			return nil, http.StatusForbidden, err
+		}
+	}
+	if err := u.checkStatements(q); err != nil {
+		return nil, http.StatusForbidden, err
+	}
+	if err := u.checkDatabases(req, q); err != nil {
+		return nil, http.StatusForbidden, err
+	}
+	if err := u.checkFormats(req, q); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	operationType := operationRead
+	if isWriteQuery(q) {
+		operationType = operationWrite
+	}
+	if r := u.matchRoutingRule(q); r != nil {
+		// Routing rules take precedence over `write_cluster`.
+		if c, cu, err = rp.getClusterFor(u, cu, r.toCluster, r.toUser, "routing_rules.to_cluster"); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		routedRequests.With(prometheus.Labels{
+			"user":         u.name,
+			"routing_rule": r.name,
+			"cluster":      r.toCluster,
+		}).Inc()
+	} else if operationType == operationWrite && len(u.writeCluster) > 0 {
+		if c, cu, err = rp.getClusterFor(u, cu, u.writeCluster, u.toUser, "write_cluster"); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+	}
+
+	// Sessions exist only at their host, so requests with `session_check=1`
+	// aren't proxied to other hosts or clusters.
+	sessionCheck := sessionId != "" && getSessionCheck(req)
+	fallback := false
+	if len(u.fallbackCluster) > 0 && u.fallbackCluster != c.name && !sessionCheck && c.isDown() {
+		fc, fcu, err := rp.getClusterFor(u, cu, u.fallbackCluster, u.fallbackToUser, "fallback_cluster")
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		// Requests stay at the chosen cluster if the fallback cluster
+		// is inactive too, so they are proxied as soon as any node recovers.
+		if fc.isActive() {
+			fallbackRequests.With(prometheus.Labels{
+				"user":             u.name,
+				"cluster":          c.name,
+				"fallback_cluster": fc.name,
+			}).Inc()
+			c, cu, fallback = fc, fcu, true
+		}
+	}
+
 	if !cu.allowedNetworks.Contains(req.RemoteAddr) {
 		return nil, http.StatusForbidden, fmt.Errorf("cluster user %q is not allowed to access", cu.name)
 	}
 
-	s := newScope(req, u, c, cu, sessionId, sessionTimeout)
+	if sessionId != "" && c.segmentRouting {
+		return nil, http.StatusBadRequest, fmt.Errorf("`session_id` isn't supported by cluster %q with `segment_routing`", c.name)
+	}
 
-	q, err := getFullQuery(req)
-	if err != nil {
-		return nil, http.StatusBadRequest, fmt.Errorf("%s: cannot read query: %w", s, err)
+	if sessionCheck {
+		if h := c.stickyHost(sessionId); !h.IsActive() {
+			return nil, http.StatusServiceUnavailable, fmt.Errorf("host %s of session %q is unavailable", h, sessionId)
+		}
 	}
+
+	// The key is computed regardless of the `load_balancing` of c,
+	// since it is used for the mirror cluster as well.
+	hashKey := strconv.FormatUint(uint64(hash(string(q))), 16)
+	s := newScope(req, u, c, cu, sessionId, sessionTimeout, hashKey)
+	s.sessionClose = sessionId != "" && getSessionClose(req)
+	s.sessionCheck = sessionCheck
+	s.fallback = fallback
 	s.requestPacketSize = len(q)
+	s.streamedBody = streamedBody
+	if streamedBody && req.ContentLength > int64(len(q)) {
+		// q contains only the beginning of the body.
+		s.requestPacketSize = int(req.ContentLength)
+	}
+	s.operationType = operationType
+	if queryFingerprints != nil {
+		s.queryFingerprint = queryFingerprints.label(q)
+	}
+	if u.identities != nil {
+		s.identityCounter = u.identities.get(name)
+	}
 	return s, 0, nil
 }
+
+// readQuery returns the query of req and whether its body is streamed.
+//
+// POST bodies exceeding `max_buffer_size` of u are streamed,
+// so only their beginning is returned.
+func (u *user) readQuery(req *http.Request) ([]byte, bool, error) {
+	var streamedBody bool
+	if u.maxBufferSize > 0 && req.Method == http.MethodPost && req.Body != nil {
+		lcrc, err := newLimitedCachedReadCloser(req.Body, u.maxBufferSize)
+		if err != nil {
+			return nil, false, err
+		}
+		req.Body = lcrc
+		streamedBody = lcrc.streaming
+	}
+	q, err := getFullQuery(req)
+	return q, streamedBody, err
+}
+
+// getClusterFor returns the cluster clusterName and its cluster user toUser
+// queries of u are proxied to instead of its `to_cluster`.
+// cu is the cluster user u is mapped to in its `to_cluster`.
+// option is the name of the config option referencing the cluster.
+func (rp *reverseProxy) getClusterFor(u *user, cu *clusterUser, clusterName, toUser, option string) (*cluster, *clusterUser, error) {
+	// The config may have been reloaded since u was found.
+	c := rp.snapshot.Load().clusters[clusterName]
+	if c == nil {
+		return nil, nil, fmt.Errorf("unknown `%s` %q for user %q", option, clusterName, u.name)
+	}
+	wcu := c.users[toUser]
+	if wcu == nil {
+		return nil, nil, fmt.Errorf("unknown `to_user` %q in cluster %q for user %q", toUser, clusterName, u.name)
+	}
+	if u.isWildcarded {
+		// Use the original credentials as for the `to_cluster`,
+		// see generateWildcardedUserInformation.
+		wcu = deepCopy(wcu)
+		wcu.name = cu.name
+		wcu.password = cu.password
+	}
+	return c, wcu, nil
+}
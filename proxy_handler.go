@@ -25,12 +25,12 @@ func NewProxyHandler(proxy *config.Proxy) *ProxyHandler {
 }
 
 func (m *ProxyHandler) GetRemoteAddr(r *http.Request) string {
-	if m.proxy.Enable {
+	if m.proxy.Enable && m.isTrustedPeer(r.RemoteAddr) {
 		var addr string
 		if m.proxy.Header != "" {
 			addr = r.Header.Get(m.proxy.Header)
 		} else {
-			addr = parseDefaultProxyHeaders(r)
+			addr = m.parseDefaultProxyHeaders(r)
 		}
 
 		if isValidAddr(addr) {
@@ -41,6 +41,20 @@ func (m *ProxyHandler) GetRemoteAddr(r *http.Request) string {
 	return r.RemoteAddr
 }
 
+// isTrustedPeer returns true if proxy headers of requests from addr may be used.
+// Headers of all the peers are used if `trusted_proxies` isn't set.
+func (m *ProxyHandler) isTrustedPeer(addr string) bool {
+	if len(m.proxy.TrustedProxies) == 0 {
+		return true
+	}
+	return m.isTrustedProxy(addr)
+}
+
+func (m *ProxyHandler) isTrustedProxy(addr string) bool {
+	// Networks.Contains panics on invalid addresses.
+	return isValidAddr(addr) && m.proxy.TrustedProxies.Contains(addr)
+}
+
 // isValidAddr checks if the Addr is a valid IP or IP:port.
 func isValidAddr(addr string) bool {
 	if addr == "" {
@@ -55,21 +69,68 @@ func isValidAddr(addr string) bool {
 	return net.ParseIP(ip) != nil
 }
 
-func parseDefaultProxyHeaders(r *http.Request) string {
+func (m *ProxyHandler) parseDefaultProxyHeaders(r *http.Request) string {
 	var addr string
 
-	if fwd := r.Header.Get(xForwardedForHeader); fwd != "" {
-		addr = extractFirstMatchFromIPList(fwd)
+	if fwd := r.Header.Values(xForwardedForHeader); len(fwd) > 0 && fwd[0] != "" {
+		addr = m.clientAddr(splitIPList(fwd))
 	} else if fwd := r.Header.Get(xRealIPHeader); fwd != "" {
 		addr = extractFirstMatchFromIPList(fwd)
-	} else if fwd := r.Header.Get(forwardedHeader); fwd != "" {
+	} else if fwd := r.Header.Values(forwardedHeader); len(fwd) > 0 && fwd[0] != "" {
 		// See: https://tools.ietf.org/html/rfc7239.
-		addr = parseForwardedHeader(fwd)
+		elements := parseForwardedHeader(fwd)
+		hops := make([]string, 0, len(elements))
+		for _, e := range elements {
+			hops = append(hops, e.forAddr)
+		}
+		addr = m.clientAddr(hops)
 	}
 
 	return addr
 }
 
+// clientAddr returns the client address from the hops of proxy headers.
+//
+// Every proxy appends the address of its peer to the hops, so only the hops
+// appended by trusted proxies are reliable. The hops are walked from right
+// to left until the first hop which isn't a trusted proxy, i.e. the client.
+// The first hop is the client if `trusted_proxies` isn't set.
+//
+// An empty string is returned if a hop is malformed, so the address
+// of the peer is used instead of the address of a trusted proxy.
+func (m *ProxyHandler) clientAddr(hops []string) string {
+	if len(hops) == 0 {
+		return ""
+	}
+	if len(m.proxy.TrustedProxies) == 0 {
+		return hops[0]
+	}
+
+	var addr string
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr = hops[i]
+		if !isValidAddr(addr) {
+			// Hops before the invalid one cannot be trusted.
+			return ""
+		}
+		if !m.isTrustedProxy(addr) {
+			break
+		}
+	}
+	return addr
+}
+
+// splitIPList returns the addresses of comma-separated lists in values.
+func splitIPList(values []string) []string {
+	var ips []string
+	for _, v := range values {
+		for _, ip := range strings.Split(v, ",") {
+			ips = append(ips, strings.TrimSpace(ip))
+		}
+	}
+	return ips
+}
+
 func extractFirstMatchFromIPList(ipList string) string {
 	if ipList == "" {
 		return ""
@@ -82,28 +143,99 @@ func extractFirstMatchFromIPList(ipList string) string {
 	return ipList[:s]
 }
 
-func parseForwardedHeader(fwd string) string {
-	splits := strings.Split(fwd, ";")
-	if len(splits) == 0 {
-		return ""
-	}
+// forwardedElement is the element of the Forwarded header describing a single hop.
+type forwardedElement struct {
+	// forAddr is the address of the client of the hop
+	// as IP or IP:port, or an empty string if it is unknown.
+	forAddr string
 
-	for _, split := range splits {
-		trimmed := strings.TrimSpace(split)
-		if strings.HasPrefix(strings.ToLower(trimmed), "for=") {
-			forSplits := strings.Split(trimmed, ",")
-			if len(forSplits) == 0 {
-				return ""
+	// proto is the lowercased protocol of the request to the hop.
+	proto string
+}
+
+// parseForwardedHeader parses the elements of Forwarded header values
+// according to RFC 7239. Parameters other than `for` and `proto` are ignored.
+func parseForwardedHeader(values []string) []forwardedElement {
+	var elements []forwardedElement
+	for _, v := range values {
+		for _, element := range splitQuoted(v, ',') {
+			var fe forwardedElement
+			for _, pair := range splitQuoted(element, ';') {
+				k, v, ok := strings.Cut(pair, "=")
+				if !ok {
+					continue
+				}
+				v = unquote(strings.TrimSpace(v))
+				switch strings.ToLower(strings.TrimSpace(k)) {
+				case "for":
+					fe.forAddr = parseForwardedNode(v)
+				case "proto":
+					fe.proto = strings.ToLower(v)
+				}
 			}
+			elements = append(elements, fe)
+		}
+	}
+	return elements
+}
 
-			addr := forSplits[0][4:]
-			trimmedAddr := strings.
-				NewReplacer("\"", "", "[", "", "]", "").
-				Replace(addr) // If IpV6, remove brackets and quotes.
+// splitQuoted splits s by sep outside of quoted strings.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	inQuotes := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && inQuotes:
+			i++
+		case c == '"':
+			inQuotes = !inQuotes
+		case c == sep && !inQuotes:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
 
-			return trimmedAddr
+// unquote returns the value of the quoted string s.
+// s is returned as is if it isn't quoted.
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	s = s[1 : len(s)-1]
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
 		}
+		b.WriteByte(s[i])
 	}
+	return b.String()
+}
 
-	return ""
+// parseForwardedNode returns the address of the node of the Forwarded header,
+// e.g. `192.0.2.43`, `192.0.2.43:47011` or `[2001:db8:cafe::17]:4711`.
+// Obfuscated ports are dropped. Unknown and obfuscated nodes
+// are returned as is, so they are rejected by isValidAddr.
+//
+// The port is split off only if the IPv6 address is bracketed,
+// so unbracketed IPv6 addresses, e.g. `2001:db8::1`, are kept whole.
+func parseForwardedNode(node string) string {
+	host, port := node, ""
+	if strings.HasPrefix(node, "[") {
+		end := strings.IndexByte(node, ']')
+		if end < 0 {
+			return node
+		}
+		host = node[1:end]
+		port, _ = strings.CutPrefix(node[end+1:], ":")
+	} else if strings.Count(node, ":") == 1 {
+		host, port, _ = strings.Cut(node, ":")
+	}
+	if port == "" || strings.Trim(port, "0123456789") != "" {
+		return host
+	}
+	return net.JoinHostPort(host, port)
 }
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"net"
 	"net/http"
+	"reflect"
 	"testing"
 
 	"github.com/contentsquare/chproxy/config"
@@ -137,7 +139,7 @@ func TestProxyHandler(t *testing.T) {
 					"Forwarded": []string{"for=\"[2001:db8:cafe::17]:4711\""},
 				},
 			},
-			expectedAddr: "2001:db8:cafe::17:4711",
+			expectedAddr: "[2001:db8:cafe::17]:4711",
 		},
 		{
 			name: "proxy should forward custom proxy header if set",
@@ -167,3 +169,125 @@ func TestProxyHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestProxyHandler_TrustedProxies(t *testing.T) {
+	mustNetworks := func(cidrs ...string) config.Networks {
+		var n config.Networks
+		for _, cidr := range cidrs {
+			_, ipnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			n = append(n, ipnet)
+		}
+		return n
+	}
+	proxy := &config.Proxy{
+		Enable:         true,
+		TrustedProxies: mustNetworks("10.0.0.0/8", "fd00::/8"),
+	}
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		header       http.Header
+		expectedAddr string
+	}{
+		{
+			name:         "spoofed X-Forwarded-For from untrusted peer is ignored",
+			remoteAddr:   "192.0.2.1:1234",
+			header:       http.Header{"X-Forwarded-For": []string{"10.1.1.1"}},
+			expectedAddr: "192.0.2.1:1234",
+		},
+		{
+			name:         "spoofed Forwarded from untrusted peer is ignored",
+			remoteAddr:   "192.0.2.1:1234",
+			header:       http.Header{"Forwarded": []string{"for=10.1.1.1"}},
+			expectedAddr: "192.0.2.1:1234",
+		},
+		{
+			name:         "X-Forwarded-For from trusted peer",
+			remoteAddr:   "10.0.0.1:1234",
+			header:       http.Header{"X-Forwarded-For": []string{"192.0.2.7"}},
+			expectedAddr: "192.0.2.7",
+		},
+		{
+			name:       "multi-hop X-Forwarded-For skips trusted hops",
+			remoteAddr: "10.0.0.1:1234",
+			header: http.Header{"X-Forwarded-For": []string{
+				// The client has prepended the spoofed address.
+				"203.0.113.9, 192.0.2.7",
+				"10.2.0.1",
+			}},
+			expectedAddr: "192.0.2.7",
+		},
+		{
+			name:         "X-Forwarded-For with only trusted hops",
+			remoteAddr:   "10.0.0.1:1234",
+			header:       http.Header{"X-Forwarded-For": []string{"10.3.0.1, 10.2.0.1"}},
+			expectedAddr: "10.3.0.1",
+		},
+		{
+			name:         "X-Forwarded-For with invalid hop",
+			remoteAddr:   "10.0.0.1:1234",
+			header:       http.Header{"X-Forwarded-For": []string{"192.0.2.7, nonsense, 10.2.0.1"}},
+			expectedAddr: "10.0.0.1:1234",
+		},
+		{
+			name:       "multi-hop Forwarded skips trusted hops",
+			remoteAddr: "10.0.0.1:1234",
+			header: http.Header{"Forwarded": []string{
+				`for=203.0.113.9;proto=https, for="[2001:db8:cafe::17]:4711";proto=https`,
+				`for="[fd00::1]";by=10.0.0.1`,
+			}},
+			expectedAddr: "[2001:db8:cafe::17]:4711",
+		},
+		{
+			name:         "Forwarded from trusted IPv6 peer",
+			remoteAddr:   "[fd00::2]:1234",
+			header:       http.Header{"Forwarded": []string{`For="192.0.2.60:8080"`}},
+			expectedAddr: "192.0.2.60:8080",
+		},
+		{
+			name:         "Forwarded with unbracketed IPv6 client",
+			remoteAddr:   "10.0.0.1:1234",
+			header:       http.Header{"Forwarded": []string{"for=2001:db8::1;proto=https, for=10.2.0.1"}},
+			expectedAddr: "2001:db8::1",
+		},
+		{
+			name:         "Forwarded with unknown client",
+			remoteAddr:   "10.0.0.1:1234",
+			header:       http.Header{"Forwarded": []string{"for=unknown, for=10.2.0.1"}},
+			expectedAddr: "10.0.0.1:1234",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &http.Request{RemoteAddr: tt.remoteAddr, Header: tt.header}
+			remoteAddr := NewProxyHandler(proxy).GetRemoteAddr(r)
+			if remoteAddr != tt.expectedAddr {
+				t.Errorf("Expected %s, got %s", tt.expectedAddr, remoteAddr)
+			}
+		})
+	}
+}
+
+func TestParseForwardedHeader(t *testing.T) {
+	elements := parseForwardedHeader([]string{
+		`for="_gazonk";Proto=HTTPS, for="[2001:db8:cafe::17]";proto=http;by="x;y,z"`,
+		`for=192.0.2.43:_hidden, for="[2001:db8::1]:80", proto=https`,
+		`for=2001:db8::1;proto=http, for=192.0.2.43:47011`,
+	})
+	expected := []forwardedElement{
+		{forAddr: "_gazonk", proto: "https"},
+		{forAddr: "2001:db8:cafe::17", proto: "http"},
+		{forAddr: "192.0.2.43"},
+		{forAddr: "[2001:db8::1]:80"},
+		{proto: "https"},
+		{forAddr: "2001:db8::1", proto: "http"},
+		{forAddr: "192.0.2.43:47011"},
+	}
+	if !reflect.DeepEqual(elements, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, elements)
+	}
+}
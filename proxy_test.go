@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"crypto/tls"
 	"fmt"
 	"hash/fnv"
@@ -11,6 +12,7 @@ import (
 	"os"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -25,8 +27,15 @@ import (
 	"net/http/httptest"
 	"net/url"
 
+	"github.com/andybalholm/brotli"
 	"github.com/contentsquare/chproxy/config"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 var nbHeavyRequestsInflight int64 = 0
@@ -168,6 +177,16 @@ func newConfiguredProxy(cfg *config.Config) (*reverseProxy, error) {
 	}
 	return p, nil
 }
+
+// stopProxy stops service goroutines of p once the test completes,
+// so heartbeats of finished tests don't compete with other tests for CPU.
+func stopProxy(t testing.TB, p *reverseProxy) {
+	t.Cleanup(func() {
+		close(p.reloadSignal)
+		p.reloadWG.Wait()
+	})
+}
+
 func init() {
 	// we need to initiliaze prometheus metrics
 	// otherwise the calls the proxy.applyConfig will fail
@@ -180,10 +199,10 @@ func TestNewReverseProxy(t *testing.T) {
 	if err := proxy.applyConfig(goodCfg); err != nil {
 		t.Fatalf("error while loading config: %s", err)
 	}
-	if len(proxy.clusters) != 1 {
-		t.Fatalf("got %d hosts; expResponse: %d", len(proxy.clusters), 1)
+	if len(proxy.snapshot.Load().clusters) != 1 {
+		t.Fatalf("got %d hosts; expResponse: %d", len(proxy.snapshot.Load().clusters), 1)
 	}
-	c := proxy.clusters["cluster"]
+	c := proxy.snapshot.Load().clusters["cluster"]
 	r := c.replicas[0]
 	if len(r.hosts) != 1 {
 		t.Fatalf("got %d hosts; expResponse: %d", len(r.hosts), 1)
@@ -191,10 +210,10 @@ func TestNewReverseProxy(t *testing.T) {
 	if r.hosts[0].Host() != "localhost:8123" {
 		t.Fatalf("got %s host; expResponse: %s", r.hosts[0].Host(), "localhost:8123")
 	}
-	if len(proxy.users) != 1 {
-		t.Fatalf("got %d users; expResponse: %d", len(proxy.users), 1)
+	if len(proxy.snapshot.Load().users) != 1 {
+		t.Fatalf("got %d users; expResponse: %d", len(proxy.snapshot.Load().users), 1)
 	}
-	if _, ok := proxy.users[defaultUsername]; !ok {
+	if _, ok := proxy.snapshot.Load().users[defaultUsername]; !ok {
 		t.Fatalf("expected user %q to be present in users", defaultUsername)
 	}
 }
@@ -255,117 +274,3307 @@ func TestApplyConfig(t *testing.T) {
 	if err = proxy.applyConfig(badCfg); err == nil {
 		t.Fatalf("error expected; got nil")
 	}
-	if _, ok := proxy.clusters["badCfg"]; ok {
-		t.Fatalf("bad config applied; expected previous config")
+	if _, ok := proxy.snapshot.Load().clusters["badCfg"]; ok {
+		t.Fatalf("bad config applied; expected previous config")
+	}
+	if err := proxy.applyConfig(badCfgWithNoHeartBeatUser); err == nil {
+		t.Fatalf("error expected; got nil")
+	} else if err.Error() != "`cluster.heartbeat.user ` cannot be unset for \"badCfgWithNoHeartBeatUser\" because a wildcarded user cannot send heartbeat" {
+		t.Fatalf("unexpected error %s", err.Error())
+	}
+	if _, ok := proxy.snapshot.Load().clusters["badCfgWithNoHeartBeatUser"]; ok {
+		t.Fatalf("bad config applied; expected previous config")
+	}
+}
+
+var authCfg = &config.Config{
+	Clusters: []config.Cluster{
+		{
+			Name:   "cluster",
+			Scheme: "http",
+			Nodes:  []string{"localhost:8123"},
+			ClusterUsers: []config.ClusterUser{
+				{
+					Name:     "web",
+					Password: "webpass",
+				},
+			},
+		},
+	},
+	Users: []config.User{
+		{
+			Name:      "foo",
+			Password:  "bar",
+			ToCluster: "cluster",
+			ToUser:    "web",
+		},
+	},
+}
+
+var wildcardedCfg = &config.Config{
+	Clusters: []config.Cluster{
+		{
+			Name:   "cluster",
+			Scheme: "http",
+			Nodes:  []string{"localhost:8123"},
+			ClusterUsers: []config.ClusterUser{
+				{
+					Name:     "web",
+					Password: "webpass",
+				},
+				{
+					Name: "analyst_*",
+				},
+				{
+					Name: "*-UK",
+				},
+			},
+		},
+	},
+	Users: []config.User{
+		{
+			Name:         "analyst_*",
+			ToCluster:    "cluster",
+			ToUser:       "analyst_*",
+			IsWildcarded: true,
+		},
+		{
+			Name:         "*-UK",
+			ToCluster:    "cluster",
+			ToUser:       "*-UK",
+			IsWildcarded: true,
+		},
+	},
+}
+
+var fullWildcardedCfg = &config.Config{
+	Clusters: []config.Cluster{
+		{
+			Name:   "cluster",
+			Scheme: "http",
+			Nodes:  []string{"localhost:8123"},
+			ClusterUsers: []config.ClusterUser{
+				{
+					Name:     "web",
+					Password: "webpass",
+				},
+				{
+					Name: "*",
+				},
+			},
+		},
+	},
+	Users: []config.User{
+		{
+			Name:         "*",
+			ToCluster:    "cluster",
+			ToUser:       "*",
+			IsWildcarded: true,
+		},
+	},
+}
+
+func compareTransactionFailReason(t *testing.T, p *reverseProxy, user config.ClusterUser, query string, failReason string) {
+	h := fnv.New32a()
+	h.Write([]byte(user.Name + user.Password))
+	transactionKey := cache.NewKey([]byte(query), url.Values{"query": []string{query}}, "", 0, 0, 0, h.Sum32())
+	transactionStatus, err := p.snapshot.Load().caches[fileSystemCache].TransactionRegistry.Status(transactionKey)
+	assert.Nil(t, err)
+	assert.Equal(t, failReason, transactionStatus.FailReason)
+}
+
+func TestReverseProxy_CacheMetrics(t *testing.T) {
+	os.RemoveAll(testCacheDir)
+	cfg := *goodCfgWithCache
+	cfg.Caches = []config.Cache{goodCfgWithCache.Caches[0]}
+	cfg.Caches[0].MaxPayloadSize = config.ByteSize(1 << 20)
+	cfg.Caches[0].Expire = config.Duration(time.Minute)
+	proxy, err := getProxy(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	labels := prometheus.Labels{"cache": fileSystemCache}
+	payloadSamples := histogramSampleCount(t, cache.PayloadBytes.With(labels))
+	servedSamples := histogramSampleCount(t, cache.ServedBytes.With(labels))
+
+	// The first request puts the response into the cache,
+	// while the second one is served from the cache.
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", fmt.Sprintf("%s?query=%s", fakeServer.URL, url.QueryEscape("SELECT cache metrics")), nil)
+		resp := makeCustomRequest(proxy, req)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		resp.Body.Close()
+	}
+
+	assert.Equal(t, payloadSamples+1, histogramSampleCount(t, cache.PayloadBytes.With(labels)))
+	assert.Equal(t, servedSamples+1, histogramSampleCount(t, cache.ServedBytes.With(labels)))
+
+	proxy.refreshCacheMetrics()
+	ratio := testutil.ToFloat64(cacheHitRatio.With(labels))
+	assert.Greater(t, ratio, float64(0))
+	assert.LessOrEqual(t, ratio, float64(1))
+}
+
+func TestReverseProxy_LayeredCache(t *testing.T) {
+	os.RemoveAll(testCacheDir)
+	level := func(name, dir string) config.Cache {
+		c := goodCfgWithCache.Caches[0]
+		c.Name = name
+		c.FileSystem.Dir = testCacheDir + "/" + dir
+		c.Expire = config.Duration(time.Minute)
+		return c
+	}
+	cfg := *goodCfgWithCache
+	cfg.Caches = []config.Cache{
+		{
+			Name:           fileSystemCache,
+			Mode:           "layered",
+			L1:             "local",
+			L2:             "shared",
+			MaxPayloadSize: config.ByteSize(1 << 20),
+		},
+		level("local", "l1"),
+		level("shared", "l2"),
+	}
+	proxy, err := getProxy(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for i, expected := range []string{"MISS", "HIT"} {
+		req := httptest.NewRequest("GET", fmt.Sprintf("%s?query=%s", fakeServer.URL, url.QueryEscape("SELECT layered cache")), nil)
+		resp := makeCustomRequest(proxy, req)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "request %d", i)
+		assert.Equal(t, expected, resp.Header.Get("X-Cache"), "request %d", i)
+		resp.Body.Close()
+	}
+
+	proxy.refreshCacheMetrics()
+	for _, l := range []string{"l1", "l2"} {
+		labels := prometheus.Labels{"cache": fileSystemCache, "level": l}
+		assert.Equal(t, float64(1), testutil.ToFloat64(cacheItems.With(labels)), "level %s", l)
+	}
+}
+
+func TestReverseProxy_NormalizeQueries(t *testing.T) {
+	os.RemoveAll(testCacheDir)
+	cfg := *goodCfgWithCache
+	cfg.Caches = []config.Cache{goodCfgWithCache.Caches[0]}
+	cfg.Caches[0].MaxPayloadSize = config.ByteSize(1 << 20)
+	cfg.Caches[0].Expire = config.Duration(time.Minute)
+	cfg.Caches[0].NormalizeQueries = true
+	proxy, err := getProxy(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	testCases := []struct {
+		query    string
+		expected string
+	}{
+		{"SELECT normalized FROM t", "MISS"},
+		{"select  normalized\nfrom t;\n", "HIT"},
+		{"SELECT Normalized FROM t", "MISS"},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", fmt.Sprintf("%s?query=%s", fakeServer.URL, url.QueryEscape(tc.query)), nil)
+		resp := makeCustomRequest(proxy, req)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "query: %q", tc.query)
+		assert.Equal(t, tc.expected, resp.Header.Get("X-Cache"), "query: %q", tc.query)
+		resp.Body.Close()
+	}
+}
+
+func TestReverseProxy_CacheBypass(t *testing.T) {
+	chServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, okResponse)
+	}))
+	defer chServer.Close()
+	chAddr, err := url.Parse(chServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	os.RemoveAll(testCacheDir)
+	cfg := *goodCfgWithCache
+	cfg.Clusters = []config.Cluster{goodCfgWithCache.Clusters[0]}
+	cfg.Clusters[0].Nodes = []string{chAddr.Host}
+	cfg.Clusters[0].Replicas = nil
+	cfg.Caches = []config.Cache{goodCfgWithCache.Caches[0]}
+	cfg.Caches[0].MaxPayloadSize = config.ByteSize(1 << 20)
+	cfg.Caches[0].Expire = config.Duration(time.Minute)
+	proxy, err := newConfiguredProxy(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	stopProxy(t, proxy)
+
+	makeRequest := func(header, value string) *http.Response {
+		req := httptest.NewRequest("POST", chServer.URL, strings.NewReader("SELECT cache bypass"))
+		if len(header) > 0 {
+			req.Header.Set(header, value)
+		}
+		return makeCustomRequest(proxy, req)
+	}
+	for i, expected := range []string{"MISS", "HIT"} {
+		resp := makeRequest("", "")
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "request %d", i)
+		assert.Equal(t, expected, resp.Header.Get("X-Cache"), "request %d", i)
+		resp.Body.Close()
+	}
+
+	testCases := []struct {
+		header   string
+		value    string
+		expected string
+	}{
+		{"Cache-Control", "no-cache", XCacheNA},
+		{"Cache-Control", "max-age=0, No-Store", XCacheNA},
+		{"X-No-Cache", "1", XCacheNA},
+		{"Cache-Control", "max-age=0", XCacheHit},
+		{"X-No-Cache", "0", XCacheHit},
+	}
+	for _, tc := range testCases {
+		resp := makeRequest(tc.header, tc.value)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "%s: %s", tc.header, tc.value)
+		assert.Equal(t, tc.expected, resp.Header.Get("X-Cache"), "%s: %s", tc.header, tc.value)
+		checkResponse(t, resp.Body, okResponse)
+		resp.Body.Close()
+	}
+}
+
+func TestReverseProxy_CacheBypassPatterns(t *testing.T) {
+	var requests atomic.Int32
+	chServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		fmt.Fprintln(w, okResponse)
+	}))
+	defer chServer.Close()
+	chAddr, err := url.Parse(chServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	os.RemoveAll(testCacheDir)
+	cfg := *goodCfgWithCache
+	cfg.Clusters = []config.Cluster{goodCfgWithCache.Clusters[0]}
+	cfg.Clusters[0].Nodes = []string{chAddr.Host}
+	cfg.Clusters[0].Replicas = nil
+	cfg.Caches = []config.Cache{goodCfgWithCache.Caches[0]}
+	cfg.Caches[0].MaxPayloadSize = config.ByteSize(1 << 20)
+	cfg.Caches[0].Expire = config.Duration(time.Minute)
+	cfg.Users = []config.User{goodCfgWithCache.Users[0]}
+	cfg.Users[0].CacheBypassPatterns = []string{`\bnow\(`, `\bsystem\.`}
+	proxy, err := newConfiguredProxy(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	stopProxy(t, proxy)
+
+	makeRequest := func(query string) *http.Response {
+		req := httptest.NewRequest("POST", chServer.URL, strings.NewReader(query))
+		return makeCustomRequest(proxy, req)
+	}
+	bypassed := cacheBypassed.With(prometheus.Labels{
+		"cache":        cfg.Caches[0].Name,
+		"user":         cfg.Users[0].Name,
+		"cluster":      cfg.Clusters[0].Name,
+		"cluster_user": cfg.Users[0].ToUser,
+	})
+	before := testutil.ToFloat64(bypassed)
+
+	// Queries with nondeterministic functions are always proxied
+	// and their responses aren't stored in the cache.
+	for i, query := range []string{"SELECT now()", "select\n\tnow() - 1;", "/* comment */ SELECT count() FROM system.parts"} {
+		requests.Store(0)
+		for j := 0; j < 2; j++ {
+			resp := makeRequest(query)
+			assert.Equal(t, http.StatusOK, resp.StatusCode, "query %d", i)
+			assert.Equal(t, XCacheMiss, resp.Header.Get("X-Cache"), "query %d", i)
+			checkResponse(t, resp.Body, okResponse)
+			resp.Body.Close()
+		}
+		assert.Equal(t, int32(2), requests.Load(), "query %d", i)
+	}
+	assert.Equal(t, before+6, testutil.ToFloat64(bypassed))
+
+	// Other queries are cached as usual.
+	requests.Store(0)
+	for i, expected := range []string{XCacheMiss, XCacheHit} {
+		resp := makeRequest("SELECT nowhere()")
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "request %d", i)
+		assert.Equal(t, expected, resp.Header.Get("X-Cache"), "request %d", i)
+		resp.Body.Close()
+	}
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func TestReverseProxy_CachedHeaders(t *testing.T) {
+	const summary = `{"read_rows":"1","read_bytes":"1","written_rows":"0"}`
+	chServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-ClickHouse-Summary", summary)
+		w.Header().Set("X-ClickHouse-Server-Display-Name", "node")
+		fmt.Fprintln(w, okResponse)
+	}))
+	defer chServer.Close()
+	chAddr, err := url.Parse(chServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	os.RemoveAll(testCacheDir)
+	cfg := *goodCfgWithCache
+	cfg.Clusters = []config.Cluster{goodCfgWithCache.Clusters[0]}
+	cfg.Clusters[0].Nodes = []string{chAddr.Host}
+	cfg.Clusters[0].Replicas = nil
+	cfg.Caches = []config.Cache{goodCfgWithCache.Caches[0]}
+	cfg.Caches[0].MaxPayloadSize = config.ByteSize(1 << 20)
+	cfg.Caches[0].Expire = config.Duration(time.Minute)
+	cfg.Caches[0].CachedHeaders = []string{"X-ClickHouse-Summary"}
+	proxy, err := newConfiguredProxy(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	stopProxy(t, proxy)
+
+	for i, expected := range []string{"MISS", "HIT"} {
+		req := httptest.NewRequest("GET", fmt.Sprintf("%s?query=%s", chServer.URL, url.QueryEscape("SELECT cached headers")), nil)
+		resp := makeCustomRequest(proxy, req)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "request %d", i)
+		assert.Equal(t, expected, resp.Header.Get("X-Cache"), "request %d", i)
+		assert.Equal(t, summary, resp.Header.Get("X-ClickHouse-Summary"), "request %d", i)
+		resp.Body.Close()
+	}
+
+	// Headers missing in `cached_headers` aren't replayed.
+	req := httptest.NewRequest("GET", fmt.Sprintf("%s?query=%s", chServer.URL, url.QueryEscape("SELECT cached headers")), nil)
+	resp := makeCustomRequest(proxy, req)
+	defer resp.Body.Close()
+	assert.Equal(t, "HIT", resp.Header.Get("X-Cache"))
+	assert.Empty(t, resp.Header.Get("X-ClickHouse-Server-Display-Name"))
+}
+
+func TestReverseProxy_TranscodeResponses(t *testing.T) {
+	const body = "transcoded result\n"
+	chServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			t.Errorf("unexpected Accept-Encoding: %q", r.Header.Get("Accept-Encoding"))
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		fmt.Fprint(zw, body)
+		zw.Close()
+	}))
+	defer chServer.Close()
+	chAddr, err := url.Parse(chServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	os.RemoveAll(testCacheDir)
+	cfg := *goodCfgWithCache
+	cfg.Clusters = []config.Cluster{goodCfgWithCache.Clusters[0]}
+	cfg.Clusters[0].Nodes = []string{chAddr.Host}
+	cfg.Clusters[0].Replicas = nil
+	cfg.Caches = []config.Cache{goodCfgWithCache.Caches[0]}
+	cfg.Caches[0].MaxPayloadSize = config.ByteSize(1 << 20)
+	cfg.Caches[0].Expire = config.Duration(time.Minute)
+	cfg.Caches[0].TranscodeResponses = true
+	proxy, err := newConfiguredProxy(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	makeRequest := func(acceptEncoding string) *http.Response {
+		req := httptest.NewRequest("GET", fmt.Sprintf("%s?query=%s", chServer.URL, url.QueryEscape("SELECT transcoded")), nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		return makeCustomRequest(proxy, req)
+	}
+
+	resp := makeRequest("gzip")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "MISS", resp.Header.Get("X-Cache"))
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	resp.Body.Close()
+
+	resp = makeRequest("zstd")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "HIT", resp.Header.Get("X-Cache"))
+	assert.Equal(t, "zstd", resp.Header.Get("Content-Encoding"))
+
+	encoded, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assert.Equal(t, strconv.Itoa(len(encoded)), resp.Header.Get("Content-Length"))
+	dec, err := zstd.NewReader(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer dec.Close()
+	decoded, err := io.ReadAll(dec)
+	if err != nil {
+		t.Fatalf("cannot decode zstd response: %s", err)
+	}
+	assert.Equal(t, body, string(decoded))
+}
+
+func TestReverseProxy_ResponseCompression(t *testing.T) {
+	const body = "compressed result\n"
+	chServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/tab-separated-values; charset=UTF-8")
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			fmt.Fprint(w, body)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		fmt.Fprint(zw, body)
+		zw.Close()
+	}))
+	defer chServer.Close()
+	chAddr, err := url.Parse(chServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	os.RemoveAll(testCacheDir)
+	cfg := *goodCfgWithCache
+	cfg.Clusters = []config.Cluster{goodCfgWithCache.Clusters[0]}
+	cfg.Clusters[0].Nodes = []string{chAddr.Host}
+	cfg.Clusters[0].Replicas = nil
+	cfg.Caches = []config.Cache{goodCfgWithCache.Caches[0]}
+	cfg.Caches[0].MaxPayloadSize = config.ByteSize(1 << 20)
+	cfg.Caches[0].Expire = config.Duration(time.Minute)
+	cfg.Caches[0].SharedWithAllUsers = true
+	cfg.Users = []config.User{
+		{
+			Name:                defaultUsername,
+			ToCluster:           "cluster",
+			ToUser:              "web",
+			ResponseCompression: "brotli",
+		},
+		{
+			Name:                "cached",
+			ToCluster:           "cluster",
+			ToUser:              "web",
+			Cache:               fileSystemCache,
+			ResponseCompression: "brotli",
+		},
+		{
+			Name:      "passthrough",
+			ToCluster: "cluster",
+			ToUser:    "web",
+			Cache:     fileSystemCache,
+		},
+	}
+	proxy, err := newConfiguredProxy(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	makeRequest := func(user, acceptEncoding string) *http.Response {
+		req := httptest.NewRequest("GET", fmt.Sprintf("%s?query=%s", chServer.URL, url.QueryEscape("SELECT compressed")), nil)
+		req.SetBasicAuth(user, "")
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		return makeCustomRequest(proxy, req)
+	}
+	readBrotli := func(resp *http.Response) string {
+		t.Helper()
+		assert.Equal(t, "br", resp.Header.Get("Content-Encoding"))
+		decoded, err := io.ReadAll(brotli.NewReader(resp.Body))
+		if err != nil {
+			t.Fatalf("cannot decode brotli response: %s", err)
+		}
+		return string(decoded)
+	}
+
+	// Proxied responses are re-encoded on the fly.
+	resp := makeRequest(defaultUsername, "gzip, br")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/tab-separated-values; charset=UTF-8", resp.Header.Get("Content-Type"))
+	assert.Equal(t, body, readBrotli(resp))
+	resp.Body.Close()
+
+	// Responses are sent as is if the client doesn't accept brotli.
+	resp = makeRequest(defaultUsername, "gzip")
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	resp.Body.Close()
+
+	// Cached responses are re-encoded on serving.
+	resp = makeRequest("cached", "gzip, br")
+	assert.Equal(t, XCacheMiss, resp.Header.Get("X-Cache"))
+	assert.Equal(t, body, readBrotli(resp))
+	resp.Body.Close()
+
+	resp = makeRequest("cached", "gzip, br")
+	assert.Equal(t, XCacheHit, resp.Header.Get("X-Cache"))
+	assert.Equal(t, "text/tab-separated-values; charset=UTF-8", resp.Header.Get("Content-Type"))
+	assert.Equal(t, body, readBrotli(resp))
+	resp.Body.Close()
+
+	// The cache contains the response encoded by ClickHouse.
+	resp = makeRequest("passthrough", "gzip, br")
+	assert.Equal(t, XCacheHit, resp.Header.Get("X-Cache"))
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	resp.Body.Close()
+}
+
+func TestReverseProxy_RetryAfter(t *testing.T) {
+	stopAllRequestsInFlight()
+	defer stopAllRequestsInFlight()
+	proxy, err := getProxy(goodCfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	u := proxy.snapshot.Load().users[defaultUsername]
+	u.maxConcurrentQueries = 1
+	runHeavyRequestInGoroutine(proxy, 1, true)
+
+	// Retry-After is a second without recent queries.
+	resp := makeRequest(proxy)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+
+	// Retry-After follows the average duration of recent queries.
+	u.queryDurations.add(3500 * time.Millisecond)
+	resp = makeRequest(proxy)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "4", resp.Header.Get("Retry-After"))
+
+	u.queryDurations.add(time.Hour)
+	resp = makeRequest(proxy)
+	resp.Body.Close()
+	assert.Equal(t, "60", resp.Header.Get("Retry-After"))
+
+	// The queue depth grows while the request waits in the queue.
+	u.queueCh = make(chan struct{}, 1)
+	u.maxQueueTime = 100 * time.Millisecond
+	queueDepth := requestQueueDepth.With(prometheus.Labels{"user": defaultUsername, "cluster_user": "web"})
+	done := make(chan *http.Response)
+	go func() {
+		done <- makeRequest(proxy)
+	}()
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(queueDepth) == 1
+	}, time.Second, time.Millisecond)
+	resp = <-done
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+	assert.Equal(t, float64(0), testutil.ToFloat64(queueDepth))
+}
+
+func TestReverseProxy_ClickHouseExceptions(t *testing.T) {
+	clickhouseExceptions.Store(true)
+	defer clickhouseExceptions.Store(false)
+
+	testCases := []struct {
+		cfg       *config.Config
+		name      string
+		expCode   string
+		expStatus int
+		f         func(p *reverseProxy) *http.Response
+	}{
+		{
+			cfg:       authCfg,
+			name:      "wrong password",
+			expCode:   "516",
+			expStatus: http.StatusUnauthorized,
+			f: func(p *reverseProxy) *http.Response {
+				req := httptest.NewRequest("POST", fakeServer.URL, nil)
+				req.SetBasicAuth("foo", "baar")
+				return makeCustomRequest(p, req)
+			},
+		},
+		{
+			cfg:       goodCfg,
+			name:      "max concurrent queries",
+			expCode:   "202",
+			expStatus: http.StatusTooManyRequests,
+			f: func(p *reverseProxy) *http.Response {
+				p.snapshot.Load().users[defaultUsername].maxConcurrentQueries = 1
+				runHeavyRequestInGoroutine(p, 1, true)
+				return makeRequest(p)
+			},
+		},
+		{
+			cfg:       goodCfg,
+			name:      "max execution time",
+			expCode:   "159",
+			expStatus: http.StatusGatewayTimeout,
+			f: func(p *reverseProxy) *http.Response {
+				p.snapshot.Load().users[defaultUsername].maxExecutionTime = time.Millisecond * 10
+				return makeHeavyRequest(p, time.Millisecond*20)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stopAllRequestsInFlight()
+			proxy, err := getProxy(tc.cfg)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			resp := tc.f(proxy)
+			b := bbToString(t, resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, tc.expStatus, resp.StatusCode)
+			assert.Equal(t, tc.expCode, resp.Header.Get(exceptionCodeHeader))
+			assert.True(t, strings.HasPrefix(b, "Code: "+tc.expCode+". DB::Exception: "), b)
+		})
+	}
+
+	t.Run("unreachable node", func(t *testing.T) {
+		cfg := *goodCfg
+		cfg.Clusters = []config.Cluster{goodCfg.Clusters[0]}
+		cfg.Clusters[0].Nodes = []string{"127.0.0.1:1"}
+		cfg.Clusters[0].Replicas = nil
+		proxy, err := newConfiguredProxy(&cfg)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		resp := makeRequest(proxy)
+		b := bbToString(t, resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		assert.Equal(t, "210", resp.Header.Get(exceptionCodeHeader))
+		assert.True(t, strings.HasPrefix(b, "Code: 210. DB::Exception: "), b)
+	})
+
+	t.Run("upstream exception", func(t *testing.T) {
+		const exception = "Code: 241. DB::Exception: Memory limit exceeded"
+		chServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(exceptionCodeHeader, "241")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, exception)
+		}))
+		defer chServer.Close()
+		chAddr, err := url.Parse(chServer.URL)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		os.RemoveAll(testCacheDir)
+		cfg := *goodCfgWithCache
+		cfg.Clusters = []config.Cluster{goodCfgWithCache.Clusters[0]}
+		cfg.Clusters[0].Nodes = []string{chAddr.Host}
+		cfg.Clusters[0].Replicas = nil
+		// Concurrent queries are awaited up to max_execution_time.
+		cfg.Users = []config.User{goodCfgWithCache.Users[0]}
+		cfg.Users[0].MaxExecutionTime = config.Duration(time.Second)
+		proxy, err := newConfiguredProxy(&cfg)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		makeRequest := func() (*http.Response, string) {
+			req := httptest.NewRequest("GET", fmt.Sprintf("%s?query=%s", chServer.URL, url.QueryEscape("SELECT memory")), nil)
+			resp := makeCustomRequest(proxy, req)
+			b := bbToString(t, resp.Body)
+			resp.Body.Close()
+			return resp, b
+		}
+
+		errorCodes := clickhouseErrorCodes.With(prometheus.Labels{"cluster": cfg.Clusters[0].Name, "error_code": "241"})
+		before := testutil.ToFloat64(errorCodes)
+
+		// The exception of the proxied response is sent as is.
+		resp, b := makeRequest()
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		assert.Equal(t, "241", resp.Header.Get(exceptionCodeHeader))
+		assert.Equal(t, exception+"\n", b)
+		assert.Equal(t, before+1, testutil.ToFloat64(errorCodes))
+		assert.Contains(t, topErrorCodes(defaultErrorCodesLimit), adminErrorCode{ErrorCode: "241", Count: before + 1})
+
+		// The code of the exception is kept for the failure of the concurrent query.
+		resp, b = makeRequest()
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		assert.Equal(t, "241", resp.Header.Get(exceptionCodeHeader))
+		assert.True(t, strings.HasPrefix(b, failedTransactionPrefix+" "+exception), b)
+	})
+}
+
+func TestReverseProxy_BodySizeMetrics(t *testing.T) {
+	chServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "size metrics result")
+	}))
+	defer chServer.Close()
+	chAddr, err := url.Parse(chServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	os.RemoveAll(testCacheDir)
+	cfg := *goodCfgWithCache
+	cfg.Clusters = []config.Cluster{goodCfgWithCache.Clusters[0]}
+	cfg.Clusters[0].Nodes = []string{chAddr.Host}
+	cfg.Clusters[0].Replicas = nil
+	cfg.Caches = []config.Cache{goodCfgWithCache.Caches[0]}
+	cfg.Caches[0].MaxPayloadSize = config.ByteSize(1 << 20)
+	cfg.Caches[0].Expire = config.Duration(time.Minute)
+	cfg.Users = []config.User{goodCfgWithCache.Users[0]}
+	cfg.Users[0].Name = "size_metrics"
+	proxy, err := newConfiguredProxy(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	labels := prometheus.Labels{"user": "size_metrics"}
+	makeRequest := func() (string, float64, float64) {
+		reqBytes := counterSum(t, requestBodyBytes, labels)
+		respBytes := counterSum(t, responseBodyBytes, labels)
+		req := httptest.NewRequest("POST", "http://localhost", strings.NewReader("SELECT size metrics"))
+		req.SetBasicAuth("size_metrics", "")
+		resp := makeCustomRequest(proxy, req)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "size metrics result\n", bbToString(t, resp.Body))
+		return resp.Header.Get("X-Cache"),
+			counterSum(t, requestBodyBytes, labels) - reqBytes,
+			counterSum(t, responseBodyBytes, labels) - respBytes
+	}
+
+	xCache, missReqBytes, missRespBytes := makeRequest()
+	assert.Equal(t, XCacheMiss, xCache)
+	assert.Equal(t, float64(len("SELECT size metrics")), missReqBytes)
+	assert.Equal(t, float64(len("size metrics result\n")), missRespBytes)
+
+	xCache, hitReqBytes, hitRespBytes := makeRequest()
+	assert.Equal(t, XCacheHit, xCache)
+	assert.Equal(t, missReqBytes, hitReqBytes)
+	assert.Equal(t, missRespBytes, hitRespBytes)
+
+	for _, source := range []string{sourceProxy, sourceCache} {
+		sourceLabels := prometheus.Labels{"user": "size_metrics", "source": source, "status_class": "2xx"}
+		for _, vec := range []*prometheus.SummaryVec{requestSize, responseSize} {
+			var count uint64
+			for _, m := range collectMetrics(t, vec, sourceLabels) {
+				count += m.GetSummary().GetSampleCount()
+			}
+			assert.Equal(t, uint64(1), count, "source %q", source)
+		}
+	}
+}
+
+// collectMetrics returns the metrics collected from c matching the given labels.
+func collectMetrics(t *testing.T, c prometheus.Collector, labels prometheus.Labels) []*dto.Metric {
+	t.Helper()
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	var metrics []*dto.Metric
+	for m := range ch {
+		var pm dto.Metric
+		if err := m.Write(&pm); err != nil {
+			t.Fatalf("cannot read metric: %s", err)
+		}
+		matched := 0
+		for _, lp := range pm.GetLabel() {
+			if v, ok := labels[lp.GetName()]; ok && v == lp.GetValue() {
+				matched++
+			}
+		}
+		if matched == len(labels) {
+			metrics = append(metrics, &pm)
+		}
+	}
+	return metrics
+}
+
+func counterSum(t *testing.T, vec *prometheus.CounterVec, labels prometheus.Labels) float64 {
+	t.Helper()
+	var sum float64
+	for _, m := range collectMetrics(t, vec, labels) {
+		sum += m.GetCounter().GetValue()
+	}
+	return sum
+}
+
+func histogramSampleCount(t *testing.T, o prometheus.Observer) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := o.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatalf("cannot read metric: %s", err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestReverseProxy_QueryFingerprintLabel(t *testing.T) {
+	cfg := *goodCfg
+	cfg.Server.Metrics.EnableQueryFingerprintLabel = true
+	cfg.Server.Metrics.MaxFingerprintLabels = 1
+	initMetrics(&cfg)
+	defer initMetrics(goodCfg)
+
+	proxy, err := getProxy(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, q := range []string{"SELECT 1", "SELECT 42", "SELECT 'foo' FROM t"} {
+		req := httptest.NewRequest("GET", fmt.Sprintf("%s?query=%s", fakeServer.URL, url.QueryEscape(q)), nil)
+		resp := makeCustomRequest(proxy, req)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status code: %d; expected: %d", resp.StatusCode, http.StatusOK)
+		}
+	}
+
+	// Queries differing only by literals share the fingerprint,
+	// while fingerprints exceeding the limit are labelled as "other".
+	fp := prometheus.Labels{"query_fingerprint": queryFingerprint([]byte("SELECT 1"))}
+	other := prometheus.Labels{"query_fingerprint": otherFingerprintLabel}
+	assert.Equal(t, float64(2), counterSum(t, requestSum, fp))
+	assert.Equal(t, float64(2), counterSum(t, requestSuccess, fp))
+	assert.Equal(t, float64(1), counterSum(t, requestSum, other))
+	assert.Equal(t, float64(1), counterSum(t, requestSuccess, other))
+	assert.Len(t, collectMetrics(t, requestDuration, fp), 1)
+}
+
+func TestReverseProxy_Quota(t *testing.T) {
+	newQuotaCfg := func(u config.User) *config.Config {
+		cfg := *goodCfg
+		u.Name = defaultUsername
+		u.ToCluster = "cluster"
+		u.ToUser = "web"
+		cfg.Users = []config.User{u}
+		return &cfg
+	}
+
+	t.Run("execution total", func(t *testing.T) {
+		const budget = 100 * time.Millisecond
+		proxy, err := getProxy(newQuotaCfg(config.User{MaxExecutionTotalPerHour: config.Duration(budget)}))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		q := proxy.snapshot.Load().users[defaultUsername].quota
+
+		rejected := 0
+		for i := 0; i < 5; i++ {
+			exhausted := q.executionTotal.Load() >= int64(budget)
+			resp := makeHeavyRequest(proxy, 40*time.Millisecond)
+			b := bbToString(t, resp.Body)
+			resp.Body.Close()
+			if !exhausted {
+				assert.Equal(t, http.StatusOK, resp.StatusCode, "query %d", i)
+				continue
+			}
+			rejected++
+			assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode, "query %d", i)
+			assert.Contains(t, b, "max_execution_total_per_hour limit: 100ms; resets in ")
+		}
+		// Each query takes at least 40ms, so the budget is exhausted by the third one.
+		assert.GreaterOrEqual(t, rejected, 2)
+
+		q.reset(time.Now())
+		resp := makeHeavyRequest(proxy, 0)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("bytes transferred", func(t *testing.T) {
+		proxy, err := getProxy(newQuotaCfg(config.User{MaxBytesTransferredPerHour: 2}))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		resp := makeRequest(proxy)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp = makeRequest(proxy)
+		b := bbToString(t, resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+		assert.Contains(t, b, "max_bytes_transferred_per_hour limit: 2; resets in ")
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		cfg := newQuotaCfg(config.User{MaxBytesTransferredPerHour: 2})
+		proxy, err := getProxy(cfg)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		resp := makeRequest(proxy)
+		resp.Body.Close()
+		q := proxy.snapshot.Load().users[defaultUsername].quota
+
+		cfg.Clusters[0].Nodes = []string{proxy.snapshot.Load().clusters["cluster"].replicas[0].hosts[0].Host()}
+		if err := proxy.applyConfig(cfg); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		assert.Same(t, q, proxy.snapshot.Load().users[defaultUsername].quota)
+		resp = makeRequest(proxy)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	})
+}
+
+func TestReverseProxy_DailyBudget(t *testing.T) {
+	const budget = 100 * time.Millisecond
+	cfg := *goodCfg
+	cfg.Users = []config.User{{
+		Name:                 defaultUsername,
+		ToCluster:            "cluster",
+		ToUser:               "web",
+		DailyExecutionBudget: config.Duration(budget),
+	}}
+	proxy, err := getProxy(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	b := proxy.snapshot.Load().users[defaultUsername].dailyBudget
+
+	resp := makeHeavyRequest(proxy, 120*time.Millisecond)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = makeHeavyRequest(proxy, 0)
+	body := bbToString(t, resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Contains(t, body, "daily_execution_budget limit: 100ms; resets in ")
+	retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil {
+		t.Fatalf("unexpected Retry-After: %s", err)
+	}
+	assert.InDelta(t, time.Until(nextMidnight(time.Now())).Seconds(), float64(retryAfter), 2)
+
+	// The consumption survives config reloads.
+	cfg.Clusters[0].Nodes = []string{proxy.snapshot.Load().clusters["cluster"].replicas[0].hosts[0].Host()}
+	if err := proxy.applyConfig(&cfg); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assert.Same(t, b, proxy.snapshot.Load().users[defaultUsername].dailyBudget)
+	resp = makeHeavyRequest(proxy, 0)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	b.reset(time.Now())
+	resp = makeHeavyRequest(proxy, 0)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestReverseProxy_StreamedBody(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		requests.Add(1)
+		fmt.Fprintf(w, "%d", len(b))
+	}))
+	defer srv.Close()
+	addr, err := url.Parse(srv.URL)
+	checkErr(t, err)
+
+	cc := goodCfgWithCache.Caches[0]
+	cc.FileSystem.Dir = testCacheDir + "/streamed"
+	cc.Expire = config.Duration(time.Minute)
+	cc.MaxPayloadSize = config.ByteSize(1 << 20)
+	os.RemoveAll(cc.FileSystem.Dir)
+	proxy, err := newConfiguredProxy(&config.Config{
+		Clusters: []config.Cluster{{
+			Name:         "cluster",
+			Scheme:       "http",
+			Nodes:        []string{addr.Host},
+			ClusterUsers: []config.ClusterUser{{Name: "web"}},
+		}},
+		Users: []config.User{{
+			Name:          defaultUsername,
+			ToCluster:     "cluster",
+			ToUser:        "web",
+			Cache:         fileSystemCache,
+			MaxBufferSize: 1024,
+		}},
+		Caches: []config.Cache{cc},
+	})
+	checkErr(t, err)
+	stopProxy(t, proxy)
+	streamed := streamedInsertRequests.WithLabelValues(defaultUsername)
+	before := testutil.ToFloat64(streamed)
+
+	send := func(body string) *http.Response {
+		t.Helper()
+		resp := makeCustomRequest(proxy, httptest.NewRequest(http.MethodPost, srv.URL, strings.NewReader(body)))
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, strconv.Itoa(len(body)), bbToString(t, resp.Body))
+		return resp
+	}
+
+	// Bodies exceeding max_buffer_size are proxied as is and aren't cached.
+	large := "SELECT 1 FROM t WHERE x IN (" + strings.Repeat("1,", 2048) + "1)"
+	for i := 0; i < 2; i++ {
+		resp := send(large)
+		assert.Equal(t, XCacheNA, resp.Header.Get("X-Cache"))
+	}
+	assert.Equal(t, int32(2), requests.Load())
+	assert.Equal(t, before+2, testutil.ToFloat64(streamed))
+
+	// Smaller bodies are buffered and cached as usual.
+	small := "SELECT 1"
+	send(small)
+	resp := send(small)
+	assert.Equal(t, XCacheHit, resp.Header.Get("X-Cache"))
+	assert.Equal(t, int32(3), requests.Load())
+	assert.Equal(t, before+2, testutil.ToFloat64(streamed))
+}
+
+func TestReverseProxy_StreamedBodyRestrictions(t *testing.T) {
+	var mu sync.Mutex
+	var queries []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.Method == http.MethodPost {
+			mu.Lock()
+			queries = append(queries, string(b))
+			mu.Unlock()
+		}
+		fmt.Fprintln(w, "Ok.")
+	}))
+	defer srv.Close()
+	addr, err := url.Parse(srv.URL)
+	checkErr(t, err)
+
+	proxy, err := newConfiguredProxy(&config.Config{
+		Clusters: []config.Cluster{{
+			Name:         "cluster",
+			Scheme:       "http",
+			Nodes:        []string{addr.Host},
+			ClusterUsers: []config.ClusterUser{{Name: "web"}},
+		}},
+		Users: []config.User{{
+			Name:              defaultUsername,
+			ToCluster:         "cluster",
+			ToUser:            "web",
+			MaxBufferSize:     32,
+			AllowedStatements: []string{"SELECT", "INSERT"},
+		}},
+	})
+	checkErr(t, err)
+	stopProxy(t, proxy)
+
+	send := func(body string) int {
+		t.Helper()
+		resp := makeCustomRequest(proxy, httptest.NewRequest(http.MethodPost, srv.URL, strings.NewReader(body)))
+		bbToString(t, resp.Body)
+		return resp.StatusCode
+	}
+
+	// The statement doesn't fit into the buffer, so it cannot be checked.
+	assert.Equal(t, http.StatusForbidden, send(strings.Repeat(" ", 64)+"DROP TABLE secret.t"))
+	assert.Equal(t, http.StatusForbidden, send("/* "+strings.Repeat("x", 64)+" */ DROP TABLE secret.t"))
+	assert.Equal(t, http.StatusForbidden, send("INSERT INTO t SELECT * FROM secret.t"))
+	mu.Lock()
+	assert.Empty(t, queries)
+	mu.Unlock()
+
+	// The statement of INSERT queries is checked before their data is streamed.
+	insert := "INSERT INTO t VALUES " + strings.Repeat("(1),", 16) + "(1)"
+	assert.Equal(t, http.StatusOK, send(insert))
+	mu.Lock()
+	assert.Equal(t, []string{insert}, queries)
+	mu.Unlock()
+}
+
+func TestReverseProxy_TraceHeaders(t *testing.T) {
+	var mu sync.Mutex
+	var upstreamHeader http.Header
+	chServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Skip health checks.
+		if r.URL.Query().Get("query_id") != "" {
+			mu.Lock()
+			upstreamHeader = r.Header.Clone()
+			mu.Unlock()
+		}
+		fmt.Fprintln(w, "Ok.")
+	}))
+	defer chServer.Close()
+	chAddr, err := url.Parse(chServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	cfg := *goodCfg
+	cfg.Clusters = []config.Cluster{goodCfg.Clusters[0]}
+	cfg.Clusters[0].Nodes = []string{chAddr.Host}
+	cfg.Clusters[0].Replicas = nil
+	proxy, err := newConfiguredProxy(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	const traceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	testCases := []struct {
+		name      string
+		requestID string
+	}{
+		{"client request id", "client-request-42"},
+		{"generated request id", ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", fmt.Sprintf("%s?query=%s", chServer.URL, url.QueryEscape("SELECT 1")), nil)
+			req.Header.Set("traceparent", traceParent)
+			if len(tc.requestID) > 0 {
+				req.Header.Set("X-Request-Id", tc.requestID)
+			}
+			resp := makeCustomRequest(proxy, req)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+			requestID := resp.Header.Get("X-Request-Id")
+			assert.NotEmpty(t, requestID)
+			if len(tc.requestID) > 0 {
+				assert.Equal(t, tc.requestID, requestID)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Equal(t, requestID, upstreamHeader.Get("X-Request-Id"))
+			assert.Equal(t, traceParent, upstreamHeader.Get("traceparent"))
+			assert.Contains(t, upstreamHeader.Get("User-Agent"), "CHProxy-RequestId: "+requestID+";")
+		})
+	}
+}
+
+func TestReverseProxy_KillQueryTLS(t *testing.T) {
+	var kills int32
+	chServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.URL.Query().Get("query_id")) == 0 {
+			// health-check or kill query
+			if b, _ := io.ReadAll(r.Body); strings.HasPrefix(string(b), "KILL QUERY") {
+				atomic.AddInt32(&kills, 1)
+			}
+			fmt.Fprintln(w, okResponse)
+			return
+		}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+		fmt.Fprintln(w, okResponse)
+	}))
+	defer chServer.Close()
+	chAddr, err := url.Parse(chServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	newProxy := func(insecureSkipVerify bool) *reverseProxy {
+		cfg := *goodCfg
+		cfg.Clusters = []config.Cluster{goodCfg.Clusters[0]}
+		cfg.Clusters[0].Scheme = "https"
+		cfg.Clusters[0].Nodes = []string{chAddr.Host}
+		cfg.Clusters[0].Replicas = nil
+		cfg.Clusters[0].KillQueryTimeout = config.Duration(time.Second)
+		cfg.Clusters[0].TLS.InsecureSkipVerify = insecureSkipVerify
+		cfg.Users = []config.User{
+			{
+				Name:             defaultUsername,
+				ToCluster:        "cluster",
+				ToUser:           "web",
+				MaxExecutionTime: config.Duration(100 * time.Millisecond),
+			},
+		}
+		proxy, err := newConfiguredProxy(&cfg)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return proxy
+	}
+	newRequest := func() *http.Request {
+		return httptest.NewRequest("GET", fmt.Sprintf("%s?query=%s", fakeServer.URL, url.QueryEscape("SELECT slow")), nil)
+	}
+	failureLabels := prometheus.Labels{"cluster": "cluster"}
+
+	t.Run("insecure skip verify", func(t *testing.T) {
+		atomic.StoreInt32(&kills, 0)
+		failures := counterSum(t, killQueryFailures, failureLabels)
+
+		resp := makeCustomRequest(newProxy(true), newRequest())
+		resp.Body.Close()
+		assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&kills))
+		assert.Equal(t, failures, counterSum(t, killQueryFailures, failureLabels))
+	})
+
+	t.Run("certificate verification", func(t *testing.T) {
+		atomic.StoreInt32(&kills, 0)
+		failures := counterSum(t, killQueryFailures, failureLabels)
+
+		s, _, err := newProxy(false).getScope(newRequest())
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		err = s.killQuery()
+		assert.ErrorContains(t, err, "certificate")
+		assert.Equal(t, int32(0), atomic.LoadInt32(&kills))
+		assert.Equal(t, failures+1, counterSum(t, killQueryFailures, failureLabels))
+	})
+}
+
+func TestReverseProxy_HTTPProxy(t *testing.T) {
+	chServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, okResponse)
+	}))
+	defer chServer.Close()
+	chAddr, err := url.Parse(chServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The proxy tunnels connections to the nodes via CONNECT.
+	var tunnels int32
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		dst, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer dst.Close()
+		w.WriteHeader(http.StatusOK)
+		src, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer src.Close()
+		atomic.AddInt32(&tunnels, 1)
+		go io.Copy(dst, src) // nolint: errcheck
+		io.Copy(src, dst)    // nolint: errcheck
+	}))
+	defer proxyServer.Close()
+
+	cfg := *goodCfg
+	cfg.Clusters = []config.Cluster{goodCfg.Clusters[0]}
+	cfg.Clusters[0].Scheme = "https"
+	cfg.Clusters[0].Nodes = []string{chAddr.Host}
+	cfg.Clusters[0].Replicas = nil
+	cfg.Clusters[0].TLS.InsecureSkipVerify = true
+	cfg.Clusters[0].HTTPProxy = proxyServer.URL
+	proxy, err := newConfiguredProxy(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	resp := makeCustomRequest(proxy, httptest.NewRequest("GET", fmt.Sprintf("%s?query=%s", chServer.URL, url.QueryEscape("SELECT 1")), nil))
+	b := bbToString(t, resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, okResponse+"\n", b)
+	assert.Greater(t, atomic.LoadInt32(&tunnels), int32(0))
+}
+
+func TestReverseProxy_HTTP2(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "%s %s", r.Proto, b)
+	})
+	newTLSServer := func() *httptest.Server {
+		s := httptest.NewUnstartedServer(handler)
+		s.EnableHTTP2 = true
+		s.StartTLS()
+		return s
+	}
+	newH2CServer := func() *httptest.Server {
+		return httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	}
+
+	testCases := []struct {
+		name      string
+		newServer func() *httptest.Server
+		configure func(c *config.Cluster)
+	}{
+		{
+			name:      "http2",
+			newServer: newTLSServer,
+			configure: func(c *config.Cluster) {
+				c.Scheme = "https"
+				c.HTTP2 = true
+				c.TLS.InsecureSkipVerify = true
+			},
+		},
+		{
+			name:      "h2c",
+			newServer: newH2CServer,
+			configure: func(c *config.Cluster) {
+				c.H2C = true
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			chServer := tc.newServer()
+			defer chServer.Close()
+			chAddr, err := url.Parse(chServer.URL)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			cfg := *goodCfg
+			cfg.Clusters = []config.Cluster{goodCfg.Clusters[0]}
+			cfg.Clusters[0].Nodes = []string{chAddr.Host}
+			cfg.Clusters[0].Replicas = nil
+			tc.configure(&cfg.Clusters[0])
+			proxy, err := newConfiguredProxy(&cfg)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			// The INSERT body is streamed to the node.
+			pr, pw := io.Pipe()
+			go func() {
+				for i := 0; i < 3; i++ {
+					fmt.Fprintf(pw, "(%d)", i)
+				}
+				pw.Close()
+			}()
+			query := url.QueryEscape("INSERT INTO t VALUES")
+			resp := makeCustomRequest(proxy, httptest.NewRequest("POST", fmt.Sprintf("%s?query=%s", chServer.URL, query), pr))
+			b := bbToString(t, resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "HTTP/2.0 (0)(1)(2)", b)
+		})
+	}
+}
+
+func TestReverseProxy_KillQueryRetries(t *testing.T) {
+	var killAttempts int32
+	var failedAttempts int32
+	chServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if b, _ := io.ReadAll(r.Body); !strings.HasPrefix(string(b), "KILL QUERY") {
+			fmt.Fprintln(w, okResponse)
+			return
+		}
+		if atomic.AddInt32(&killAttempts, 1) <= atomic.LoadInt32(&failedAttempts) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, okResponse)
+	}))
+	defer chServer.Close()
+	chAddr, err := url.Parse(chServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	testCases := []struct {
+		name             string
+		retries          int
+		failedAttempts   int32
+		expectedAttempts int32
+		expectedSuccess  bool
+	}{
+		{"no retries", 0, 1, 1, false},
+		{"successful retry", 2, 2, 3, true},
+		{"exhausted retries", 1, 3, 2, false},
+	}
+	labels := prometheus.Labels{"cluster": "cluster"}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := *goodCfg
+			cfg.Clusters = []config.Cluster{goodCfg.Clusters[0]}
+			cfg.Clusters[0].Nodes = []string{chAddr.Host}
+			cfg.Clusters[0].Replicas = nil
+			cfg.Clusters[0].KillQueryRetries = tc.retries
+			proxy, err := newConfiguredProxy(&cfg)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			req := httptest.NewRequest("GET", fmt.Sprintf("%s?query=%s", fakeServer.URL, url.QueryEscape("SELECT 1")), nil)
+			s, _, err := proxy.getScope(req)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			atomic.StoreInt32(&killAttempts, 0)
+			atomic.StoreInt32(&failedAttempts, tc.failedAttempts)
+			successes := counterSum(t, killQuerySuccesses, labels)
+			failures := counterSum(t, killQueryFailures, labels)
+
+			err = s.killQuery()
+			assert.Equal(t, tc.expectedAttempts, atomic.LoadInt32(&killAttempts))
+			if tc.expectedSuccess {
+				assert.NoError(t, err)
+				assert.Equal(t, successes+1, counterSum(t, killQuerySuccesses, labels))
+				assert.Equal(t, failures, counterSum(t, killQueryFailures, labels))
+			} else {
+				assert.Error(t, err)
+				assert.Equal(t, successes, counterSum(t, killQuerySuccesses, labels))
+				assert.Equal(t, failures+1, counterSum(t, killQueryFailures, labels))
+			}
+		})
+	}
+}
+
+func TestReverseProxy_KillQueryStatement(t *testing.T) {
+	var mu sync.Mutex
+	var killQueries []string
+	chServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if b, _ := io.ReadAll(r.Body); r.Method == http.MethodPost && len(b) > 0 {
+			mu.Lock()
+			killQueries = append(killQueries, string(b))
+			mu.Unlock()
+		}
+		fmt.Fprintln(w, okResponse)
+	}))
+	defer chServer.Close()
+	chAddr, err := url.Parse(chServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	testCases := []struct {
+		name              string
+		onCluster         string
+		template          string
+		keepClientQueryID bool
+		queryID           string
+		// expectedID is the scope id if empty
+		expectedID        string
+		expectedStatement string
+	}{
+		{
+			name:              "default",
+			expectedStatement: "KILL QUERY WHERE query_id = '%s'",
+		},
+		{
+			name:              "on cluster",
+			onCluster:         "analytics",
+			expectedStatement: "KILL QUERY ON CLUSTER `analytics` WHERE query_id = '%s'",
+		},
+		{
+			name:              "custom template",
+			template:          "KILL QUERY ON CLUSTER analytics WHERE query_id = '{{query_id}}' OR initial_query_id = '{{query_id}}' SYNC",
+			expectedStatement: "KILL QUERY ON CLUSTER analytics WHERE query_id = '%[1]s' OR initial_query_id = '%[1]s' SYNC",
+		},
+		{
+			name:              "client query_id",
+			queryID:           "report-42",
+			expectedStatement: "KILL QUERY WHERE query_id = '%s'",
+		},
+		{
+			name:              "kept client query_id",
+			keepClientQueryID: true,
+			queryID:           "report-42",
+			expectedID:        "report-42",
+			expectedStatement: "KILL QUERY WHERE query_id = '%s'",
+		},
+		{
+			name:              "escaped client query_id",
+			keepClientQueryID: true,
+			queryID:           `x' OR 1 = 1 OR '\`,
+			expectedID:        `x\' OR 1 = 1 OR \'\\`,
+			expectedStatement: "KILL QUERY WHERE query_id = '%s'",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := *goodCfg
+			cfg.Clusters = []config.Cluster{goodCfg.Clusters[0]}
+			cfg.Clusters[0].Nodes = []string{chAddr.Host}
+			cfg.Clusters[0].Replicas = nil
+			cfg.Clusters[0].KillQueryOnCluster = tc.onCluster
+			cfg.Clusters[0].KillQueryTemplate = tc.template
+			cfg.Users = []config.User{goodCfg.Users[0]}
+			cfg.Users[0].KeepClientQueryID = tc.keepClientQueryID
+			proxy, err := newConfiguredProxy(&cfg)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			params := url.Values{"query": {"SELECT 1"}}
+			if len(tc.queryID) > 0 {
+				params.Set("query_id", tc.queryID)
+			}
+			req := httptest.NewRequest("GET", fakeServer.URL+"?"+params.Encode(), nil)
+			s, _, err := proxy.getScope(req)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			mu.Lock()
+			killQueries = nil
+			mu.Unlock()
+			assert.NoError(t, s.killQuery())
+
+			mu.Lock()
+			defer mu.Unlock()
+			expectedID := tc.expectedID
+			if len(expectedID) == 0 {
+				expectedID = s.id.String()
+			}
+			assert.Equal(t, []string{fmt.Sprintf(tc.expectedStatement, expectedID)}, killQueries)
+		})
+	}
+}
+
+func TestReverseProxy_KeepClientQueryID(t *testing.T) {
+	chServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Query().Get("query_id"))
+	}))
+	defer chServer.Close()
+	chAddr, err := url.Parse(chServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	proxy, err := newConfiguredProxy(&config.Config{
+		Clusters: []config.Cluster{
+			{
+				Name:         "cluster",
+				Scheme:       "http",
+				Nodes:        []string{chAddr.Host},
+				ClusterUsers: []config.ClusterUser{{Name: "web"}},
+			},
+		},
+		Users: []config.User{
+			{
+				Name:      defaultUsername,
+				ToCluster: "cluster",
+				ToUser:    "web",
+			},
+			{
+				Name:              "report",
+				ToCluster:         "cluster",
+				ToUser:            "web",
+				KeepClientQueryID: true,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	request := func(user, params string) string {
+		req := httptest.NewRequest("GET", "http://localhost:9090/?query=SELECT+1&user="+user+params, nil)
+		resp := makeCustomRequest(proxy, req)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		return bbToString(t, resp.Body)
+	}
+
+	assert.Equal(t, "report-42", request("report", "&query_id=report-42"))
+	// The generated query_id is sent if the client doesn't set one.
+	assert.Regexp(t, "^[0-9A-F]{8,}$", request("report", ""))
+	assert.Regexp(t, "^[0-9A-F]{8,}$", request(defaultUsername, "&query_id=report-42"))
+}
+
+func TestReverseProxy_MaxRequestBodySize(t *testing.T) {
+	chServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		fmt.Fprintln(w, okResponse)
+	}))
+	defer chServer.Close()
+	chAddr, err := url.Parse(chServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	byteSize := func(n config.ByteSize) *config.ByteSize { return &n }
+	cfg := *goodCfg
+	cfg.Server.MaxRequestBodySize = 50
+	cfg.Clusters = []config.Cluster{goodCfg.Clusters[0]}
+	cfg.Clusters[0].Nodes = []string{chAddr.Host}
+	cfg.Clusters[0].Replicas = nil
+	cfg.Users = []config.User{
+		{Name: "limited", ToCluster: "cluster", ToUser: "web", MaxRequestBodySize: byteSize(100)},
+		{Name: "unlimited", ToCluster: "cluster", ToUser: "web", MaxRequestBodySize: byteSize(0)},
+		{Name: "server_limit", ToCluster: "cluster", ToUser: "web"},
+	}
+	proxy, err := newConfiguredProxy(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	query := func(size int) []byte {
+		q := "SELECT 1 "
+		return []byte(q + strings.Repeat(" ", size-len(q)))
+	}
+	// randomQuery returns a query which cannot be compressed below its size.
+	randomQuery := func(size int) []byte {
+		b := make([]byte, size)
+		for i := range b {
+			b[i] = byte('a' + rand.Intn(26))
+		}
+		return []byte(fmt.Sprintf("SELECT '%s'", b))
+	}
+	gzipped := func(b []byte) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(b)
+		zw.Close()
+		return buf.Bytes()
+	}
+
+	testCases := []struct {
+		name          string
+		user          string
+		body          []byte
+		gzip          bool
+		unknownLength bool
+		expected      int
+	}{
+		{"at the user limit", "limited", query(100), false, false, http.StatusOK},
+		{"above the user limit", "limited", query(101), false, false, http.StatusRequestEntityTooLarge},
+		{"above the user limit with unknown length", "limited", query(101), false, true, http.StatusRequestEntityTooLarge},
+		{"at the server limit", "server_limit", query(50), false, false, http.StatusOK},
+		{"above the server limit", "server_limit", query(51), false, true, http.StatusRequestEntityTooLarge},
+		{"unlimited", "unlimited", query(1000), false, false, http.StatusOK},
+		{"compressed below the limit", "limited", gzipped(query(1000)), true, false, http.StatusOK},
+		{"compressed above the limit", "limited", gzipped(randomQuery(200)), true, true, http.StatusRequestEntityTooLarge},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", chServer.URL, bytes.NewReader(tc.body))
+			req.SetBasicAuth(tc.user, "")
+			if tc.gzip {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+			if tc.unknownLength {
+				req.ContentLength = -1
+			}
+			resp := makeCustomRequest(proxy, req)
+			defer resp.Body.Close()
+			body := bbToString(t, resp.Body)
+			assert.Equal(t, tc.expected, resp.StatusCode, body)
+			if tc.expected == http.StatusRequestEntityTooLarge {
+				assert.Contains(t, body, "request body exceeds max_request_body_size limit")
+			}
+		})
+	}
+}
+
+func TestReverseProxy_ResponseHeaders(t *testing.T) {
+	chServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-ClickHouse-Format", "TabSeparated")
+		w.Header().Set("X-ClickHouse-Summary", "{}")
+		switch r.URL.Query().Get("query") {
+		case "INSERT empty":
+			return
+		case "SELECT fail":
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, "Code: 1. DB::Exception: failure")
+			return
+		}
+		fmt.Fprintln(w, okResponse)
+	}))
+	defer chServer.Close()
+	chAddr, err := url.Parse(chServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	cfg := *goodCfg
+	cfg.Clusters = []config.Cluster{goodCfg.Clusters[0]}
+	cfg.Clusters[0].Nodes = []string{chAddr.Host}
+	cfg.Clusters[0].Replicas = nil
+	cfg.Users = []config.User{
+		{
+			Name:      "grafana",
+			ToCluster: "cluster",
+			ToUser:    "web",
+			ResponseHeaders: map[string]config.ResponseHeader{
+				"strict-transport-security": {Value: "max-age=31536000"},
+				"X-ClickHouse-Format":       {Value: "JSON"},
+				"X-ClickHouse-Summary":      {Value: "hidden", Override: true},
+			},
+		},
+	}
+	proxy, err := newConfiguredProxy(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, q := range []string{"SELECT 1", "INSERT empty"} {
+		req := httptest.NewRequest("GET", fmt.Sprintf("%s?query=%s", chServer.URL, url.QueryEscape(q)), nil)
+		req.SetBasicAuth("grafana", "")
+		resp := makeCustomRequest(proxy, req)
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode, q)
+		assert.Equal(t, "max-age=31536000", resp.Header.Get("Strict-Transport-Security"), q)
+		// Headers sent by ClickHouse are kept unless overridden.
+		assert.Equal(t, []string{"TabSeparated"}, resp.Header.Values("X-ClickHouse-Format"), q)
+		assert.Equal(t, []string{"hidden"}, resp.Header.Values("X-ClickHouse-Summary"), q)
+	}
+
+	// Error responses get the headers too.
+	req := httptest.NewRequest("GET", fmt.Sprintf("%s?query=%s", chServer.URL, url.QueryEscape("SELECT fail")), nil)
+	req.SetBasicAuth("grafana", "")
+	resp := makeCustomRequest(proxy, req)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Equal(t, "max-age=31536000", resp.Header.Get("Strict-Transport-Security"))
+}
+
+func TestReverseProxy_MaxResponseSize(t *testing.T) {
+	var queries, kills int32
+	chServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.URL.Query().Get("query_id")) == 0 {
+			// health-check or kill query
+			if b, _ := io.ReadAll(r.Body); strings.HasPrefix(string(b), "KILL QUERY") {
+				atomic.AddInt32(&kills, 1)
+			}
+			fmt.Fprintln(w, okResponse)
+			return
+		}
+		atomic.AddInt32(&queries, 1)
+		switch r.URL.Query().Get("query") {
+		case "SELECT small":
+			fmt.Fprint(w, strings.Repeat("x", 100))
+		case "SELECT chunked":
+			fmt.Fprint(w, strings.Repeat("x", 512))
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+			fmt.Fprint(w, strings.Repeat("x", 1024))
+		default:
+			fmt.Fprint(w, strings.Repeat("x", 2048))
+		}
+	}))
+	defer chServer.Close()
+	chAddr, err := url.Parse(chServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	os.RemoveAll(testCacheDir)
+	cfg := *goodCfgWithCache
+	cfg.Clusters = []config.Cluster{goodCfgWithCache.Clusters[0]}
+	cfg.Clusters[0].Nodes = []string{chAddr.Host}
+	cfg.Clusters[0].Replicas = nil
+	cfg.Caches = []config.Cache{goodCfgWithCache.Caches[0]}
+	cfg.Caches[0].MaxPayloadSize = config.ByteSize(1 << 20)
+	cfg.Caches[0].Expire = config.Duration(time.Minute)
+	cfg.Users = []config.User{
+		{
+			Name:            "direct",
+			ToCluster:       "cluster",
+			ToUser:          "web",
+			MaxResponseSize: 1024,
+		},
+		{
+			Name:            "cached",
+			ToCluster:       "cluster",
+			ToUser:          "web",
+			Cache:           fileSystemCache,
+			MaxResponseSize: 1024,
+		},
+	}
+	proxy, err := newConfiguredProxy(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	makeRequest := func(user, query string) (*http.Response, string) {
+		req := httptest.NewRequest("GET", fmt.Sprintf("%s?query=%s", fakeServer.URL, url.QueryEscape(query)), nil)
+		req.SetBasicAuth(user, "")
+		resp := makeCustomRequest(proxy, req)
+		defer resp.Body.Close()
+		return resp, bbToString(t, resp.Body)
+	}
+
+	testCases := []struct {
+		name           string
+		user           string
+		query          string
+		expectedStatus int
+		expectedKills  int32
+	}{
+		{"direct small response", "direct", "SELECT small", http.StatusOK, 0},
+		{"direct large response", "direct", "SELECT large", http.StatusRequestEntityTooLarge, 1},
+		{"cached small response", "cached", "SELECT small", http.StatusOK, 0},
+		{"cached large response", "cached", "SELECT large", http.StatusRequestEntityTooLarge, 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			labels := prometheus.Labels{"user": tc.user}
+			exceeded := testutil.ToFloat64(responseSizeLimitExceeded.With(labels))
+			killsBefore := atomic.LoadInt32(&kills)
+
+			resp, body := makeRequest(tc.user, tc.query)
+			assert.Equal(t, tc.expectedStatus, resp.StatusCode)
+			assert.Equal(t, exceeded+float64(tc.expectedKills), testutil.ToFloat64(responseSizeLimitExceeded.With(labels)))
+			assert.Equal(t, killsBefore+tc.expectedKills, atomic.LoadInt32(&kills))
+			if tc.expectedStatus == http.StatusRequestEntityTooLarge {
+				assert.Contains(t, body, "response exceeds max_response_size limit: 1024")
+				assert.Empty(t, resp.Header.Get("Content-Encoding"))
+			}
+		})
+	}
+
+	t.Run("cached large response isn't cached", func(t *testing.T) {
+		queriesBefore := atomic.LoadInt32(&queries)
+		resp, _ := makeRequest("cached", "SELECT large")
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+		assert.Equal(t, queriesBefore+1, atomic.LoadInt32(&queries))
+	})
+
+	t.Run("partially sent response", func(t *testing.T) {
+		labels := prometheus.Labels{"user": "direct"}
+		exceeded := testutil.ToFloat64(responseSizeLimitExceeded.With(labels))
+
+		// The status code cannot be changed once the response is partially sent,
+		// so the response is truncated.
+		resp, body := makeRequest("direct", "SELECT chunked")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, 512, len(body))
+		assert.Equal(t, exceeded+1, testutil.ToFloat64(responseSizeLimitExceeded.With(labels)))
+	})
+}
+
+func TestReverseProxy_WriteCluster(t *testing.T) {
+	addr, err := url.Parse(fakeServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	newCluster := func(name string) config.Cluster {
+		return config.Cluster{
+			Name:         name,
+			Scheme:       "http",
+			Nodes:        []string{addr.Host},
+			ClusterUsers: []config.ClusterUser{{Name: "web"}},
+		}
+	}
+	cfg := &config.Config{
+		Clusters: []config.Cluster{newCluster("read"), newCluster("write")},
+		Users: []config.User{
+			{
+				Name:         defaultUsername,
+				ToCluster:    "read",
+				ToUser:       "web",
+				WriteCluster: "write",
+			},
+		},
+	}
+	proxy, err := newConfiguredProxy(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	testCases := []struct {
+		query           string
+		expectedCluster string
+		expectedOpType  string
+	}{
+		{"SELECT 1", "read", operationRead},
+		{"INSERT INTO t VALUES (1)", "write", operationWrite},
+		{"/* comment */ alter table t delete where 1", "write", operationWrite},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.query, func(t *testing.T) {
+			req := httptest.NewRequest("POST", fakeServer.URL, bytes.NewBufferString(tc.query))
+			s, _, err := proxy.getScope(req)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			assert.Equal(t, tc.expectedCluster, s.cluster.name)
+			assert.Equal(t, tc.expectedCluster, s.labels["cluster"])
+			assert.Equal(t, "web", s.clusterUser.name)
+			assert.Equal(t, tc.expectedOpType, s.operationType)
+		})
+	}
+
+	cfg.Users[0].WriteCluster = "unknown"
+	if err := proxy.applyConfig(cfg); err == nil {
+		t.Fatalf("error expected for unknown `write_cluster`")
+	}
+}
+
+func TestReverseProxy_FallbackCluster(t *testing.T) {
+	newServer := func(name string) *url.URL {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, _, _ := r.BasicAuth()
+			fmt.Fprintf(w, "%s: %s", name, user)
+		}))
+		t.Cleanup(srv.Close)
+		addr, err := url.Parse(srv.URL)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return addr
+	}
+	primary, fallback := newServer("primary"), newServer("fallback")
+	cfg := &config.Config{
+		Clusters: []config.Cluster{
+			{
+				Name:         "primary",
+				Scheme:       "http",
+				Nodes:        []string{primary.Host},
+				ClusterUsers: []config.ClusterUser{{Name: "web"}},
+			},
+			{
+				Name:         "fallback",
+				Scheme:       "http",
+				Nodes:        []string{fallback.Host},
+				ClusterUsers: []config.ClusterUser{{Name: "web"}, {Name: "backup"}},
+			},
+		},
+		Users: []config.User{
+			{
+				Name:            defaultUsername,
+				ToCluster:       "primary",
+				ToUser:          "web",
+				FallbackCluster: "fallback",
+				FallbackToUser:  "backup",
+			},
+		},
+	}
+	proxy, err := newConfiguredProxy(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	stopProxy(t, proxy)
+	setActive := func(cluster string, active bool) {
+		for _, r := range proxy.snapshot.Load().clusters[cluster].replicas {
+			for _, h := range r.getHosts() {
+				h.SetIsActive(active)
+			}
+		}
+	}
+	makeRequest := func() (*http.Response, string) {
+		req := httptest.NewRequest("POST", "http://127.0.0.1", strings.NewReader("SELECT 1"))
+		resp := makeCustomRequest(proxy, req)
+		b := bbToString(t, resp.Body)
+		resp.Body.Close()
+		return resp, b
+	}
+	fallbackReqs := fallbackRequests.With(prometheus.Labels{
+		"user":             defaultUsername,
+		"cluster":          "primary",
+		"fallback_cluster": "fallback",
+	})
+	before := testutil.ToFloat64(fallbackReqs)
+
+	// Nodes waiting for their first heartbeat aren't considered down.
+	resp, b := makeRequest()
+	assert.Equal(t, "primary: web", b)
+	assert.Empty(t, resp.Header.Get(fallbackHeader))
+
+	setActive("primary", false)
+	setActive("fallback", true)
+	resp, b = makeRequest()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "fallback: backup", b)
+	assert.Equal(t, "true", resp.Header.Get(fallbackHeader))
+	assert.Equal(t, before+1, testutil.ToFloat64(fallbackReqs))
+
+	// Requests stay at the primary cluster if the fallback cluster is down too.
+	setActive("fallback", false)
+	_, b = makeRequest()
+	assert.Equal(t, "primary: web", b)
+
+	setActive("primary", true)
+	setActive("fallback", true)
+	resp, b = makeRequest()
+	assert.Equal(t, "primary: web", b)
+	assert.Empty(t, resp.Header.Get(fallbackHeader))
+	assert.Equal(t, before+1, testutil.ToFloat64(fallbackReqs))
+
+	cfg.Users[0].FallbackToUser = "unknown"
+	if err := proxy.applyConfig(cfg); err == nil {
+		t.Fatalf("error expected for unknown `fallback_to_user`")
+	}
+}
+
+func TestReverseProxy_MaxSessions(t *testing.T) {
+	addr, err := url.Parse(fakeServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	cfg := &config.Config{
+		Clusters: []config.Cluster{
+			{
+				Name:         "cluster",
+				Scheme:       "http",
+				Nodes:        []string{addr.Host},
+				ClusterUsers: []config.ClusterUser{{Name: "web", MaxSessions: 3}},
+			},
+		},
+		Users: []config.User{
+			{
+				Name:        defaultUsername,
+				ToCluster:   "cluster",
+				ToUser:      "web",
+				MaxSessions: 2,
+			},
+		},
+	}
+	proxy, err := newConfiguredProxy(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	stopProxy(t, proxy)
+	request := func(params string) *http.Response {
+		req := httptest.NewRequest("GET", fakeServer.URL+"/fast?query=SELECT+1&"+params, nil)
+		return makeCustomRequest(proxy, req)
+	}
+	activeSessions := func() float64 {
+		return testutil.ToFloat64(activeSessions.With(prometheus.Labels{"user": defaultUsername}))
+	}
+
+	assert.Equal(t, http.StatusOK, request("session_id=a").StatusCode)
+	assert.Equal(t, http.StatusOK, request("session_id=b").StatusCode)
+	assert.Equal(t, float64(2), activeSessions())
+
+	resp := request("session_id=c")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	checkResponse(t, resp.Body, "user \"default\": limit for sessions is exceeded: max_sessions limit: 2")
+
+	// Active sessions and requests without sessions aren't limited.
+	assert.Equal(t, http.StatusOK, request("session_id=a").StatusCode)
+	assert.Equal(t, http.StatusOK, request("").StatusCode)
+
+	// The rejected session doesn't consume the slot of the cluster user.
+	cu := proxy.snapshot.Load().clusters["cluster"].users["web"]
+	assert.Equal(t, int64(2), cu.sessions.n.Load())
+
+	// session_close releases the session once the request completes.
+	assert.Equal(t, http.StatusOK, request("session_id=a&session_close=1").StatusCode)
+	assert.Equal(t, float64(1), activeSessions())
+	assert.Equal(t, http.StatusOK, request("session_id=c").StatusCode)
+
+	// Active sessions are kept on config reload.
+	checkErr(t, proxy.applyConfig(cfg))
+	assert.Equal(t, http.StatusTooManyRequests, request("session_id=d").StatusCode)
+}
+
+func TestReverseProxy_MaxSessionsRejectedRequests(t *testing.T) {
+	addr, err := url.Parse(fakeServer.URL)
+	checkErr(t, err)
+	proxy, err := newConfiguredProxy(&config.Config{
+		Clusters: []config.Cluster{
+			{
+				Name:         "cluster",
+				Scheme:       "http",
+				Nodes:        []string{addr.Host},
+				ClusterUsers: []config.ClusterUser{{Name: "web", MaxSessions: 1}},
+			},
+		},
+		Users: []config.User{
+			{
+				Name:        defaultUsername,
+				ToCluster:   "cluster",
+				ToUser:      "web",
+				MaxSessions: 1,
+				ReqPerMin:   1,
+			},
+		},
+	})
+	checkErr(t, err)
+	stopProxy(t, proxy)
+	request := func(params string) *http.Response {
+		req := httptest.NewRequest("GET", fakeServer.URL+"/fast?query=SELECT+1&"+params, nil)
+		return makeCustomRequest(proxy, req)
+	}
+
+	assert.Equal(t, http.StatusOK, request("").StatusCode)
+	resp := request("session_id=a")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	checkResponse(t, resp.Body, "rate limit for user \"default\" is exceeded: requests_per_minute limit: 1")
+
+	// Requests rejected by the limits mustn't occupy sessions.
+	u := proxy.snapshot.Load().users[defaultUsername]
+	assert.Equal(t, int64(0), u.sessions.n.Load())
+	cu := proxy.snapshot.Load().clusters["cluster"].users["web"]
+	assert.Equal(t, int64(0), cu.sessions.n.Load())
+}
+
+func TestReverseProxy_SessionCheck(t *testing.T) {
+	names := make(map[string]string)
+	newServer := func(name string) string {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/ping" {
+				fmt.Fprint(w, "Ok.\n")
+				return
+			}
+			fmt.Fprintf(w, "%s: session_check=%s", name, r.URL.Query().Get("session_check"))
+		}))
+		t.Cleanup(srv.Close)
+		addr, err := url.Parse(srv.URL)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		names[addr.Host] = name
+		return addr.Host
+	}
+	cfg := &config.Config{
+		Clusters: []config.Cluster{
+			{
+				Name:         "cluster",
+				Scheme:       "http",
+				Nodes:        []string{newServer("a"), newServer("b")},
+				ClusterUsers: []config.ClusterUser{{Name: "web"}},
+				HeartBeat: config.HeartBeat{
+					Interval: config.Duration(time.Minute),
+					Timeout:  config.Duration(time.Second),
+					Request:  "/ping",
+					Response: "Ok.\n",
+				},
+			},
+		},
+		Users: []config.User{
+			{
+				Name:      defaultUsername,
+				ToCluster: "cluster",
+				ToUser:    "web",
+			},
+		},
+	}
+	proxy, err := newConfiguredProxy(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	stopProxy(t, proxy)
+	request := func(params string) (int, string) {
+		req := httptest.NewRequest("GET", "http://localhost:9090/?query=SELECT+1&session_id=foo"+params, nil)
+		resp := makeCustomRequest(proxy, req)
+		return resp.StatusCode, bbToString(t, resp.Body)
+	}
+
+	// Wait for the first heartbeat, so it doesn't override the states set below.
+	c := proxy.snapshot.Load().clusters["cluster"]
+	assert.Eventually(t, func() bool {
+		for _, r := range c.replicas {
+			for _, h := range r.getHosts() {
+				if !h.IsActive() {
+					return false
+				}
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	sticky := c.stickyHost("foo")
+	other := "a"
+	if names[sticky.Host()] == "a" {
+		other = "b"
+	}
+	code, body := request("&session_check=1")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, names[sticky.Host()]+": session_check=1", body)
+
+	sticky.SetIsActive(false)
+	// Requests without session_check are proxied to other hosts.
+	code, body = request("")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, other+": session_check=", body)
+
+	code, body = request("&session_check=1")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, fmt.Sprintf("host %s of session \"foo\" is unavailable", sticky))
+
+	sticky.SetIsActive(true)
+	code, body = request("&session_check=1")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, names[sticky.Host()]+": session_check=1", body)
+}
+
+func TestReverseProxy_SegmentRouting(t *testing.T) {
+	newServer := func(name string) string {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/ping" {
+				fmt.Fprint(w, "Ok.\n")
+				return
+			}
+			fmt.Fprint(w, name)
+		}))
+		t.Cleanup(srv.Close)
+		addr, err := url.Parse(srv.URL)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return addr.Host
+	}
+	cfg := &config.Config{
+		Clusters: []config.Cluster{
+			{
+				Name:   "cluster",
+				Scheme: "http",
+				Replicas: []config.Replica{
+					{Name: "replica1", Nodes: []string{newServer("replica1")}},
+					{Name: "replica2", Nodes: []string{newServer("replica2")}},
+				},
+				ClusterUsers: []config.ClusterUser{{Name: "web"}},
+				HeartBeat: config.HeartBeat{
+					Interval: config.Duration(time.Minute),
+					Timeout:  config.Duration(time.Second),
+					Request:  "/ping",
+					Response: "Ok.\n",
+				},
+				SegmentRouting: true,
+			},
+		},
+		Users: []config.User{
+			{
+				Name:      defaultUsername,
+				ToCluster: "cluster",
+				ToUser:    "web",
+			},
+		},
+	}
+	proxy, err := newConfiguredProxy(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	stopProxy(t, proxy)
+	request := func(params string) (int, string) {
+		req := httptest.NewRequest("GET", "http://localhost:9090/?query=SELECT+1"+params, nil)
+		resp := makeCustomRequest(proxy, req)
+		return resp.StatusCode, bbToString(t, resp.Body)
+	}
+
+	// Wait for the first heartbeat, so both replicas are active.
+	c := proxy.snapshot.Load().clusters["cluster"]
+	assert.Eventually(t, func() bool {
+		return c.replicas[0].isActive() && c.replicas[1].isActive()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Identical queries are spread evenly among replicas.
+	served := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		code, body := request("")
+		assert.Equal(t, http.StatusOK, code)
+		served[body]++
+	}
+	assert.Equal(t, map[string]int{"replica1": 2, "replica2": 2}, served)
+
+	code, body := request("&session_id=foo")
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, body, "`session_id` isn't supported by cluster \"cluster\" with `segment_routing`")
+}
+
+func TestReverseProxy_RoutingRules(t *testing.T) {
+	addr, err := url.Parse(fakeServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	newCluster := func(name string, users ...string) config.Cluster {
+		c := config.Cluster{
+			Name:   name,
+			Scheme: "http",
+			Nodes:  []string{addr.Host},
+		}
+		for _, u := range users {
+			c.ClusterUsers = append(c.ClusterUsers, config.ClusterUser{Name: u})
+		}
+		return c
+	}
+	cfg := &config.Config{
+		Clusters: []config.Cluster{
+			newCluster("read", "web"),
+			newCluster("write", "web"),
+			newCluster("ingest", "web", "ingester"),
+			newCluster("reports", "web"),
+		},
+		Users: []config.User{
+			{
+				Name:         defaultUsername,
+				ToCluster:    "read",
+				ToUser:       "web",
+				WriteCluster: "write",
+				RoutingRules: []config.RoutingRule{
+					{Match: `(?i)^INSERT INTO events\b`, ToCluster: "ingest", ToUser: "ingester"},
+					{Name: "reports", Match: `\breports\.`, ToCluster: "reports"},
+				},
+			},
+		},
+	}
+	proxy, err := newConfiguredProxy(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	testCases := []struct {
+		query               string
+		expectedCluster     string
+		expectedClusterUser string
+		expectedRule        string
+	}{
+		{"SELECT 1", "read", "web", ""},
+		{"INSERT INTO t VALUES (1)", "write", "web", ""},
+		{"insert into events VALUES (1)", "ingest", "ingester", "0"},
+		{"SELECT count() FROM reports.daily", "reports", "web", "reports"},
+		{"INSERT INTO reports.daily SELECT 1", "reports", "web", "reports"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.query, func(t *testing.T) {
+			var routed float64
+			labels := prometheus.Labels{"user": defaultUsername, "routing_rule": tc.expectedRule, "cluster": tc.expectedCluster}
+			if len(tc.expectedRule) > 0 {
+				routed = testutil.ToFloat64(routedRequests.With(labels))
+			}
+
+			req := httptest.NewRequest("POST", fakeServer.URL, bytes.NewBufferString(tc.query))
+			s, _, err := proxy.getScope(req)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			assert.Equal(t, tc.expectedCluster, s.cluster.name)
+			assert.Equal(t, tc.expectedClusterUser, s.clusterUser.name)
+			if len(tc.expectedRule) > 0 {
+				assert.Equal(t, routed+1, testutil.ToFloat64(routedRequests.With(labels)))
+			}
+		})
+	}
+
+	cfg.Users[0].RoutingRules[1].ToCluster = "unknown"
+	if err := proxy.applyConfig(cfg); err == nil {
+		t.Fatalf("error expected for unknown `to_cluster` in routing rule")
+	}
+	cfg.Users[0].RoutingRules[1].ToCluster = "reports"
+	cfg.Users[0].RoutingRules[1].ToUser = "ingester"
+	if err := proxy.applyConfig(cfg); err == nil {
+		t.Fatalf("error expected for unknown `to_user` in routing rule")
+	}
+}
+
+func TestReverseProxy_Statements(t *testing.T) {
+	cfg := *goodCfg
+	cfg.Users = []config.User{
+		{
+			Name:             "grafana",
+			ToCluster:        "cluster",
+			ToUser:           "web",
+			DeniedStatements: []string{"insert", "DROP"},
+		},
+		{
+			Name:              "reader",
+			ToCluster:         "cluster",
+			ToUser:            "web",
+			AllowedStatements: []string{"SELECT"},
+		},
+	}
+	proxy, err := getProxy(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	gzipped := func(s string) *bytes.Buffer {
+		var b bytes.Buffer
+		zw := gzip.NewWriter(&b)
+		if _, err := zw.Write([]byte(s)); err != nil {
+			t.Fatalf("cannot compress query: %s", err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("cannot compress query: %s", err)
+		}
+		return &b
+	}
+
+	testCases := []struct {
+		name           string
+		user           string
+		newRequest     func() *http.Request
+		expectedStatus int
+	}{
+		{
+			name: "select in url",
+			user: "grafana",
+			newRequest: func() *http.Request {
+				return httptest.NewRequest("GET", fmt.Sprintf("%s?query=%s", fakeServer.URL, url.QueryEscape("WITH 1 AS x SELECT x")), nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "comment-prefixed drop",
+			user: "grafana",
+			newRequest: func() *http.Request {
+				return httptest.NewRequest("POST", fakeServer.URL, bytes.NewBufferString("/* cleanup */ -- old data\n drop table t"))
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name: "drop after select",
+			user: "grafana",
+			newRequest: func() *http.Request {
+				return httptest.NewRequest("POST", fakeServer.URL, bytes.NewBufferString("SELECT ';'; DROP TABLE t"))
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name: "gzipped insert",
+			user: "grafana",
+			newRequest: func() *http.Request {
+				req := httptest.NewRequest("POST", fakeServer.URL, gzipped("INSERT INTO t VALUES (1)"))
+				req.Header.Set("Content-Encoding", "gzip")
+				return req
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name: "insert in url",
+			user: "grafana",
+			newRequest: func() *http.Request {
+				return httptest.NewRequest("POST", fmt.Sprintf("%s?query=%s", fakeServer.URL, url.QueryEscape("INSERT INTO t FORMAT TSV")), bytes.NewBufferString("1"))
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name: "system for reader",
+			user: "reader",
+			newRequest: func() *http.Request {
+				return httptest.NewRequest("POST", fakeServer.URL, bytes.NewBufferString("SYSTEM RELOAD DICTIONARIES"))
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := tc.newRequest()
+			req.SetBasicAuth(tc.user, "")
+			resp := makeCustomRequest(proxy, req)
+			defer resp.Body.Close()
+			assert.Equal(t, tc.expectedStatus, resp.StatusCode)
+			if tc.expectedStatus == http.StatusForbidden {
+				assert.Contains(t, bbToString(t, resp.Body), fmt.Sprintf("user %q is not allowed to run", tc.user))
+			}
+		})
+	}
+}
+
+func TestReverseProxy_AllowedDatabases(t *testing.T) {
+	cfg := *goodCfg
+	cfg.Users = []config.User{
+		{
+			Name:             "app",
+			ToCluster:        "cluster",
+			ToUser:           "web",
+			AllowedDatabases: []string{"db1", "db2"},
+		},
+		{
+			Name:                "strict",
+			ToCluster:           "cluster",
+			ToUser:              "web",
+			AllowedDatabases:    []string{"db1", "db2"},
+			CheckQueryDatabases: true,
+		},
+	}
+	proxy, err := getProxy(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	newRequest := func(user, query string, params url.Values) *http.Request {
+		if params == nil {
+			params = make(url.Values)
+		}
+		params.Set("query", query)
+		req := httptest.NewRequest("GET", fmt.Sprintf("%s?%s", fakeServer.URL, params.Encode()), nil)
+		req.SetBasicAuth(user, "")
+		return req
+	}
+
+	t.Run("database param", func(t *testing.T) {
+		testCases := []struct {
+			name             string
+			params           url.Values
+			expectedDatabase string
+		}{
+			{"explicit", url.Values{"database": {"db2"}}, "db2"},
+			{"implicit", nil, "db1"},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				s, _, err := proxy.getScope(newRequest("app", "SELECT 1", tc.params))
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				req, _, err := s.decorateRequest(newRequest("app", "SELECT 1", tc.params))
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				assert.Equal(t, tc.expectedDatabase, req.URL.Query().Get("database"))
+			})
+		}
+	})
+
+	testCases := []struct {
+		name             string
+		req              *http.Request
+		expectedStatus   int
+		expectedDatabase string
+	}{
+		{
+			name:           "allowed database",
+			req:            newRequest("app", "SELECT 1", url.Values{"database": {"db2"}}),
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:             "denied database",
+			req:              newRequest("app", "SELECT 1", url.Values{"database": {"default"}}),
+			expectedStatus:   http.StatusForbidden,
+			expectedDatabase: "default",
+		},
+		{
+			name: "denied database in header",
+			req: func() *http.Request {
+				req := newRequest("app", "SELECT 1", nil)
+				req.Header.Set("X-ClickHouse-Database", "db3")
+				return req
+			}(),
+			expectedStatus:   http.StatusForbidden,
+			expectedDatabase: "db3",
+		},
+		{
+			name:           "unchecked query database",
+			req:            newRequest("app", "SELECT * FROM db3.t", nil),
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "allowed query database",
+			req:            newRequest("strict", "SELECT * FROM db2.t", nil),
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:             "denied query database",
+			req:              newRequest("strict", "SELECT * FROM db1.t JOIN `system`.tables USING (name)", nil),
+			expectedStatus:   http.StatusForbidden,
+			expectedDatabase: "system",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := makeCustomRequest(proxy, tc.req)
+			defer resp.Body.Close()
+			assert.Equal(t, tc.expectedStatus, resp.StatusCode)
+			if tc.expectedStatus == http.StatusForbidden {
+				assert.Contains(t, bbToString(t, resp.Body), fmt.Sprintf("is not allowed to access database %q", tc.expectedDatabase))
+			}
+		})
+	}
+}
+
+func TestReverseProxy_AllowedFormats(t *testing.T) {
+	cfg := *goodCfg
+	cfg.Users = []config.User{
+		{
+			Name:           "app",
+			ToCluster:      "cluster",
+			ToUser:         "web",
+			DefaultFormat:  "JSONEachRow",
+			AllowedFormats: []string{"JSONEachRow", "TSV"},
+		},
+	}
+	proxy, err := getProxy(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	newRequest := func(query string, params url.Values) *http.Request {
+		if params == nil {
+			params = make(url.Values)
+		}
+		params.Set("query", query)
+		req := httptest.NewRequest("GET", fmt.Sprintf("%s?%s", fakeServer.URL, params.Encode()), nil)
+		req.SetBasicAuth("app", "")
+		return req
+	}
+
+	t.Run("default format param", func(t *testing.T) {
+		testCases := []struct {
+			name           string
+			params         url.Values
+			expectedFormat string
+		}{
+			{"explicit", url.Values{"default_format": {"TSV"}}, "TSV"},
+			{"implicit", nil, "JSONEachRow"},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				s, _, err := proxy.getScope(newRequest("SELECT 1", tc.params))
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				req, origParams, err := s.decorateRequest(newRequest("SELECT 1", tc.params))
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				assert.Equal(t, tc.expectedFormat, req.URL.Query().Get("default_format"))
+				assert.Equal(t, tc.expectedFormat, origParams.Get("default_format"))
+			})
+		}
+	})
+
+	testCases := []struct {
+		name           string
+		req            *http.Request
+		expectedStatus int
+		expectedFormat string
+	}{
+		{
+			name:           "allowed format param",
+			req:            newRequest("SELECT 1", url.Values{"default_format": {"TSV"}}),
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "allowed inline format",
+			req:            newRequest("SELECT 'FORMAT CSV' FORMAT JSONEachRow -- FORMAT CSV", nil),
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "denied format param",
+			req:            newRequest("SELECT 1", url.Values{"default_format": {"CSV"}}),
+			expectedStatus: http.StatusBadRequest,
+			expectedFormat: "CSV",
+		},
+		{
+			name: "denied format header",
+			req: func() *http.Request {
+				req := newRequest("SELECT 1", nil)
+				req.Header.Set("X-ClickHouse-Format", "Native")
+				return req
+			}(),
+			expectedStatus: http.StatusBadRequest,
+			expectedFormat: "Native",
+		},
+		{
+			name:           "denied inline format",
+			req:            newRequest("SELECT 1 FORMAT CSV SETTINGS max_threads = 1", url.Values{"default_format": {"TSV"}}),
+			expectedStatus: http.StatusBadRequest,
+			expectedFormat: "CSV",
+		},
+		{
+			name:           "insert format",
+			req:            newRequest("INSERT INTO t FORMAT CSV", nil),
+			expectedStatus: http.StatusOK,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := makeCustomRequest(proxy, tc.req)
+			defer resp.Body.Close()
+			assert.Equal(t, tc.expectedStatus, resp.StatusCode)
+			if tc.expectedStatus == http.StatusBadRequest {
+				assert.Contains(t, bbToString(t, resp.Body), fmt.Sprintf("is not allowed to use format %q", tc.expectedFormat))
+			}
+		})
+	}
+
+	t.Run("allowed default formats", func(t *testing.T) {
+		cfg := *goodCfg
+		cfg.Users = []config.User{
+			{
+				Name:                  "app",
+				ToCluster:             "cluster",
+				ToUser:                "web",
+				AllowedFormats:        []string{"JSONEachRow", "Parquet"},
+				AllowedDefaultFormats: []string{"JSONEachRow"},
+			},
+		}
+		proxy, err := getProxy(&cfg)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		resp := makeCustomRequest(proxy, newRequest("SELECT 1 FORMAT Parquet", nil))
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp = makeCustomRequest(proxy, newRequest("SELECT 1", url.Values{"default_format": {"jsoneachrow"}}))
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp = makeCustomRequest(proxy, newRequest("SELECT 1", url.Values{"default_format": {"Parquet"}}))
+		b := bbToString(t, resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Contains(t, b, `is not allowed to use format "Parquet"`)
+	})
+}
+
+func TestReverseProxy_ImpersonationHeader(t *testing.T) {
+	type received struct {
+		logComment string
+		userAgent  string
+	}
+	ch := make(chan received, 1)
+	chServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.URL.Query().Get("query_id")) == 0 {
+			// health-check
+			fmt.Fprintln(w, okResponse)
+			return
+		}
+		ch <- received{
+			logComment: r.URL.Query().Get("log_comment"),
+			userAgent:  r.UserAgent(),
+		}
+		fmt.Fprintln(w, okResponse)
+	}))
+	defer chServer.Close()
+	chAddr, err := url.Parse(chServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	testCases := []struct {
+		name               string
+		header             string
+		logComment         bool
+		onBehalfOf         string
+		expectedLogComment string
+		expectedUserAgent  string
+	}{
+		{
+			name:       "disabled",
+			onBehalfOf: "alice@example.com",
+		},
+		{
+			name:              "user agent only",
+			header:            "X-ChProxy-On-Behalf-Of",
+			onBehalfOf:        "alice@example.com",
+			expectedUserAgent: "; on_behalf = alice@example.com",
+		},
+		{
+			name:               "log comment",
+			header:             "X-ChProxy-On-Behalf-Of",
+			logComment:         true,
+			onBehalfOf:         "alice@example.com",
+			expectedLogComment: "alice@example.com",
+			expectedUserAgent:  "; on_behalf = alice@example.com",
+		},
+		{
+			name:               "sanitized value",
+			header:             "X-ChProxy-On-Behalf-Of",
+			logComment:         true,
+			onBehalfOf:         "bob'; DROP TABLE t" + strings.Repeat("x", 200),
+			expectedLogComment: "bob___DROP_TABLE_t" + strings.Repeat("x", 110),
+			expectedUserAgent:  "; on_behalf = bob___DROP_TABLE_t" + strings.Repeat("x", 110),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := *goodCfg
+			cfg.Clusters = []config.Cluster{goodCfg.Clusters[0]}
+			cfg.Clusters[0].Nodes = []string{chAddr.Host}
+			cfg.Clusters[0].Replicas = nil
+			cfg.Users = []config.User{goodCfg.Users[0]}
+			cfg.Users[0].AllowImpersonationHeader = tc.header
+			cfg.Users[0].ImpersonationLogComment = tc.logComment
+			proxy, err := newConfiguredProxy(&cfg)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			req := httptest.NewRequest("GET", fmt.Sprintf("%s?query=%s", fakeServer.URL, url.QueryEscape("SELECT 1")), nil)
+			req.Header.Set("X-ChProxy-On-Behalf-Of", tc.onBehalfOf)
+			resp := makeCustomRequest(proxy, req)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+			r := <-ch
+			assert.Equal(t, tc.expectedLogComment, r.logComment)
+			if len(tc.expectedUserAgent) > 0 {
+				assert.True(t, strings.HasSuffix(r.userAgent, tc.expectedUserAgent), "unexpected User-Agent %q", r.userAgent)
+			} else {
+				assert.NotContains(t, r.userAgent, "on_behalf")
+			}
+		})
+	}
+}
+
+func TestReverseProxy_WildcardedPerIdentity(t *testing.T) {
+	os.RemoveAll(testCacheDir)
+	cfg := *wildcardedCfg
+	cfg.Users = []config.User{
+		{
+			Name:                 "analyst_*",
+			ToCluster:            "cluster",
+			ToUser:               "analyst_*",
+			IsWildcarded:         true,
+			PerIdentityLimits:    true,
+			MaxConcurrentQueries: 1,
+			Cache:                fileSystemCache,
+		},
 	}
-	if err := proxy.applyConfig(badCfgWithNoHeartBeatUser); err == nil {
-		t.Fatalf("error expected; got nil")
-	} else if err.Error() != "`cluster.heartbeat.user ` cannot be unset for \"badCfgWithNoHeartBeatUser\" because a wildcarded user cannot send heartbeat" {
-		t.Fatalf("unexpected error %s", err.Error())
+	cfg.Caches = []config.Cache{goodCfgWithCache.Caches[0]}
+	cfg.Caches[0].MaxPayloadSize = config.ByteSize(1 << 20)
+	cfg.Caches[0].Expire = config.Duration(time.Minute)
+	cfg.Clusters = []config.Cluster{wildcardedCfg.Clusters[0]}
+	cfg.Clusters[0].HeartBeat.User = "web"
+	cfg.Clusters[0].HeartBeat.Password = "webpass"
+	proxy, err := getProxy(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
 	}
-	if _, ok := proxy.clusters["badCfgWithNoHeartBeatUser"]; ok {
-		t.Fatalf("bad config applied; expected previous config")
+
+	newRequest := func(user, body string) *http.Request {
+		req := httptest.NewRequest("POST", fakeServer.URL, bytes.NewBufferString(body))
+		req.SetBasicAuth(user, "pass")
+		return req
 	}
+
+	t.Run("concurrency", func(t *testing.T) {
+		done := make(chan struct{})
+		go func() {
+			resp := makeCustomRequest(proxy, newRequest("analyst_a", heavyRequestDuration.String()))
+			resp.Body.Close()
+			close(done)
+		}()
+		waitForCounter := func() {
+			deadline := time.Now().Add(5 * time.Second)
+			for proxy.snapshot.Load().users["analyst_*"].identities.get("analyst_a").load() == 0 {
+				if time.Now().After(deadline) {
+					t.Fatalf("timeout while waiting for the heavy request")
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+		waitForCounter()
+
+		resp := makeCustomRequest(proxy, newRequest("analyst_a", "0s"))
+		b := bbToString(t, resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+		assert.Contains(t, b, `limits for user "analyst_a" are exceeded: max_concurrent_queries limit: 1`)
+
+		resp = makeCustomRequest(proxy, newRequest("analyst_b", "0s"))
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		<-done
+	})
+
+	t.Run("cache", func(t *testing.T) {
+		get := func(user string) string {
+			req := httptest.NewRequest("GET", fmt.Sprintf("%s?query=%s", fakeServer.URL, url.QueryEscape("SELECT per identity")), nil)
+			req.SetBasicAuth(user, "pass")
+			resp := makeCustomRequest(proxy, req)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			return resp.Header.Get("X-Cache")
+		}
+		assert.Equal(t, XCacheMiss, get("analyst_a"))
+		assert.Equal(t, XCacheMiss, get("analyst_b"))
+		assert.Equal(t, XCacheHit, get("analyst_a"))
+		assert.Equal(t, XCacheHit, get("analyst_b"))
+	})
 }
 
-var authCfg = &config.Config{
-	Clusters: []config.Cluster{
-		{
-			Name:   "cluster",
-			Scheme: "http",
-			Nodes:  []string{"localhost:8123"},
-			ClusterUsers: []config.ClusterUser{
-				{
-					Name:     "web",
-					Password: "webpass",
-				},
-			},
-		},
-	},
-	Users: []config.User{
+func TestReverseProxy_LDAPAuth(t *testing.T) {
+	cfg := *goodCfg
+	cfg.Users = []config.User{
+		goodCfg.Users[0],
 		{
-			Name:      "foo",
-			Password:  "bar",
+			Name:      "analyst",
+			Password:  "analyst-pass",
 			ToCluster: "cluster",
 			ToUser:    "web",
 		},
-	},
+	}
+	cfg.AuthBackend = &config.AuthBackend{
+		Type:             "ldap",
+		LDAPURL:          "ldaps://ldap.example.com:636",
+		UserSearchBase:   "ou=users,dc=example,dc=com",
+		UserSearchFilter: "(uid={{user}})",
+		LDAPUserTemplate: "analyst",
+	}
+	proxy, err := getProxy(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	fl := &fakeLDAP{
+		passwords: map[string]string{
+			"alice":   "alice-secret",
+			"default": "default-secret",
+		},
+	}
+	proxy.snapshot.Load().ldapAuth.dial = fl.dial
+
+	request := func(user, password string) *http.Response {
+		req := httptest.NewRequest("POST", fakeServer.URL, bytes.NewBufferString("0s"))
+		req.SetBasicAuth(user, password)
+		return makeCustomRequest(proxy, req)
+	}
+
+	resp := request("alice", "alice-secret")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = request("alice", "wrong")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// Users from `users` are authenticated without LDAP.
+	dials := fl.dials
+	resp = request("analyst", "analyst-pass")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, dials, fl.dials)
+
+	// default user can't be authenticated via LDAP.
+	resp = request("default", "default-secret")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, dials, fl.dials)
 }
 
-var wildcardedCfg = &config.Config{
-	Clusters: []config.Cluster{
-		{
-			Name:   "cluster",
-			Scheme: "http",
-			Nodes:  []string{"localhost:8123"},
-			ClusterUsers: []config.ClusterUser{
-				{
-					Name:     "web",
-					Password: "webpass",
-				},
-				{
-					Name: "analyst_*",
-				},
-				{
-					Name: "*-UK",
-				},
+func TestReverseProxy_JWTAuth(t *testing.T) {
+	addr, err := url.Parse(fakeServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	keys := getTestJWTKeys(t)
+	cfg := &config.Config{
+		Clusters: []config.Cluster{
+			{
+				Name:         "cluster",
+				Scheme:       "http",
+				Nodes:        []string{addr.Host},
+				ClusterUsers: []config.ClusterUser{{Name: "web"}},
 			},
 		},
-	},
-	Users: []config.User{
-		{
-			Name:         "analyst_*",
-			ToCluster:    "cluster",
-			ToUser:       "analyst_*",
-			IsWildcarded: true,
+		Users: []config.User{
+			{
+				Name:      "analyst",
+				Password:  "analyst-pass",
+				ToCluster: "cluster",
+				ToUser:    "web",
+			},
 		},
-		{
-			Name:         "*-UK",
-			ToCluster:    "cluster",
-			ToUser:       "*-UK",
-			IsWildcarded: true,
+		Auth: &config.Auth{
+			JWT: &config.JWTAuth{
+				PublicKeyFile: writePublicKey(t, keys[0]),
+				Issuer:        testJWTIssuer,
+				Audience:      testJWTAudience,
+			},
 		},
-	},
+	}
+	proxy, err := newConfiguredProxy(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	stopProxy(t, proxy)
+	request := func(claims map[string]interface{}) *http.Response {
+		req := httptest.NewRequest("GET", fakeServer.URL+"/fast?query=SELECT+1", nil)
+		req.Header.Set("Authorization", "Bearer "+makeJWT(t, keys[0], "", claims))
+		return makeCustomRequest(proxy, req)
+	}
+
+	exp := time.Now().Add(time.Hour)
+	resp := request(jwtClaims("analyst", exp))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = request(jwtClaims("analyst", time.Now().Add(-time.Minute)))
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	checkResponse(t, resp.Body, "invalid bearer token: token is expired")
+
+	claims := jwtClaims("analyst", exp)
+	claims["aud"] = "other"
+	resp = request(claims)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	checkResponse(t, resp.Body, "invalid bearer token: token isn't issued for audience \"chproxy\"")
+
+	resp = request(jwtClaims("alice", exp))
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	checkResponse(t, resp.Body, "invalid bearer token: unknown user \"alice\" in `preferred_username` claim")
+
+	// Passwords are still accepted.
+	req := httptest.NewRequest("GET", fakeServer.URL+"/fast?query=SELECT+1", nil)
+	req.SetBasicAuth("analyst", "analyst-pass")
+	resp = makeCustomRequest(proxy, req)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
 }
 
-var fullWildcardedCfg = &config.Config{
-	Clusters: []config.Cluster{
-		{
-			Name:   "cluster",
-			Scheme: "http",
-			Nodes:  []string{"localhost:8123"},
-			ClusterUsers: []config.ClusterUser{
-				{
-					Name:     "web",
-					Password: "webpass",
-				},
-				{
-					Name: "*",
-				},
-			},
-		},
-	},
-	Users: []config.User{
+func TestReverseProxy_Mirror(t *testing.T) {
+	type mirrored struct {
+		body    string
+		queryID string
+		user    string
+	}
+	mirrorCh := make(chan mirrored, 1)
+	mirrorStatus := int32(http.StatusOK)
+	mirrorServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.URL.Query().Get("query_id")) == 0 {
+			// health-check
+			fmt.Fprintln(w, okResponse)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		user, _, _ := r.BasicAuth()
+		w.WriteHeader(int(atomic.LoadInt32(&mirrorStatus)))
+		fmt.Fprintln(w, okResponse)
+		mirrorCh <- mirrored{body: string(body), queryID: r.URL.Query().Get("query_id"), user: user}
+	}))
+	defer mirrorServer.Close()
+	mirrorAddr, err := url.Parse(mirrorServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	cfg := *goodCfg
+	cfg.Clusters = []config.Cluster{goodCfg.Clusters[0], goodCfg.Clusters[0]}
+	cfg.Clusters[1].Name = "mirror"
+	cfg.Clusters[1].Nodes = []string{mirrorAddr.Host}
+	cfg.Clusters[1].Replicas = nil
+	cfg.Users = []config.User{
 		{
-			Name:         "*",
-			ToCluster:    "cluster",
-			ToUser:       "*",
-			IsWildcarded: true,
+			Name:            defaultUsername,
+			ToCluster:       "cluster",
+			ToUser:          "web",
+			MirrorToCluster: "mirror",
 		},
-	},
+	}
+	proxy, err := getProxy(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	waitForMirror := func() mirrored {
+		select {
+		case m := <-mirrorCh:
+			return m
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout while waiting for the mirrored request")
+		}
+		return mirrored{}
+	}
+
+	t.Run("success", func(t *testing.T) {
+		resp := makeHeavyRequest(proxy, time.Millisecond)
+		b := bbToString(t, resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Contains(t, b, okResponse)
+
+		m := waitForMirror()
+		assert.Equal(t, time.Millisecond.String(), m.body)
+		assert.True(t, strings.HasSuffix(m.queryID, "-mirror"), "unexpected query_id %q", m.queryID)
+		assert.Equal(t, "web", m.user)
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		atomic.StoreInt32(&mirrorStatus, http.StatusInternalServerError)
+		labels := prometheus.Labels{"user": defaultUsername, "cluster": "mirror", "result": "failure"}
+		failures := testutil.ToFloat64(mirroredRequests.With(labels))
+
+		resp := makeHeavyRequest(proxy, time.Millisecond)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		waitForMirror()
+		deadline := time.Now().Add(5 * time.Second)
+		for testutil.ToFloat64(mirroredRequests.With(labels)) == failures {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected mirror failure to be counted")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
 }
 
-func compareTransactionFailReason(t *testing.T, p *reverseProxy, user config.ClusterUser, query string, failReason string) {
-	h := fnv.New32a()
-	h.Write([]byte(user.Name + user.Password))
-	transactionKey := cache.NewKey([]byte(query), url.Values{"query": []string{query}}, "", 0, 0, h.Sum32())
-	transactionStatus, err := p.caches[fileSystemCache].TransactionRegistry.Status(transactionKey)
-	assert.Nil(t, err)
-	assert.Equal(t, failReason, transactionStatus.FailReason)
+func TestReverseProxy_StaleWhileRevalidate(t *testing.T) {
+	var queries int32
+	chServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.URL.Query().Get("query_id")) == 0 {
+			// health-check
+			fmt.Fprintln(w, okResponse)
+			return
+		}
+		n := atomic.AddInt32(&queries, 1)
+		time.Sleep(500 * time.Millisecond)
+		fmt.Fprintf(w, "version %d\n", n)
+	}))
+	defer chServer.Close()
+	chAddr, err := url.Parse(chServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	os.RemoveAll(testCacheDir)
+	cfg := *goodCfgWithCache
+	cfg.Clusters = []config.Cluster{goodCfgWithCache.Clusters[0]}
+	cfg.Clusters[0].Nodes = []string{chAddr.Host}
+	cfg.Clusters[0].Replicas = nil
+	cfg.Caches = []config.Cache{goodCfgWithCache.Caches[0]}
+	cfg.Caches[0].MaxPayloadSize = config.ByteSize(1 << 20)
+	cfg.Caches[0].Expire = config.Duration(2 * time.Second)
+	cfg.Caches[0].StaleWhileRevalidate = config.Duration(time.Minute)
+	// max_execution_time bounds the time refresh transactions remain pending.
+	cfg.Users = []config.User{goodCfgWithCache.Users[0]}
+	cfg.Users[0].MaxExecutionTime = config.Duration(10 * time.Second)
+	proxy, err := newConfiguredProxy(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	makeRequest := func() (string, string) {
+		req := httptest.NewRequest("GET", fmt.Sprintf("%s?query=%s", fakeServer.URL, url.QueryEscape("SELECT stale")), nil)
+		resp := makeCustomRequest(proxy, req)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		return resp.Header.Get("X-Cache"), bbToString(t, resp.Body)
+	}
+
+	xCache, body := makeRequest()
+	assert.Equal(t, XCacheMiss, xCache)
+	assert.Equal(t, "version 1\n", body)
+
+	time.Sleep(time.Duration(cfg.Caches[0].Expire) + 100*time.Millisecond)
+
+	// Expired response is served instantly, while only a single
+	// request refreshes it in background.
+	for i := 0; i < 3; i++ {
+		startTime := time.Now()
+		xCache, body = makeRequest()
+		assert.Equal(t, XCacheStale, xCache)
+		assert.Equal(t, "version 1\n", body)
+		assert.Less(t, time.Since(startTime), 250*time.Millisecond)
+	}
+
+	assert.Eventually(t, func() bool {
+		xCache, body = makeRequest()
+		return xCache == XCacheHit && body == "version 2\n"
+	}, 5*time.Second, 100*time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&queries))
+}
+
+func TestReverseProxy_AsyncCacheWrites(t *testing.T) {
+	const delay = time.Second
+	chunk := strings.Repeat("x", 64<<10)
+	chServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.URL.Query().Get("query_id")) == 0 {
+			// health-check
+			fmt.Fprintln(w, okResponse)
+			return
+		}
+		// The first part of the large response is sent instantly,
+		// while the rest of it takes a while.
+		fmt.Fprint(w, chunk)
+		http.NewResponseController(w).Flush() // nolint: errcheck
+		time.Sleep(delay)
+		for i := 0; i < 15; i++ {
+			fmt.Fprint(w, chunk)
+		}
+	}))
+	defer chServer.Close()
+	chAddr, err := url.Parse(chServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	newProxyServer := func(withCache, asyncWrites, finishOnDisconnect bool) (*httptest.Server, *reverseProxy) {
+		os.RemoveAll(testCacheDir)
+		cfg := *goodCfgWithCache
+		cfg.Clusters = []config.Cluster{goodCfgWithCache.Clusters[0]}
+		cfg.Clusters[0].Nodes = []string{chAddr.Host}
+		cfg.Clusters[0].Replicas = nil
+		cfg.Caches = []config.Cache{goodCfgWithCache.Caches[0]}
+		cfg.Caches[0].MaxPayloadSize = config.ByteSize(2 << 20)
+		cfg.Caches[0].FileSystem.MaxSize = config.ByteSize(10 << 20)
+		cfg.Caches[0].Expire = config.Duration(time.Minute)
+		cfg.Caches[0].AsyncWrites = asyncWrites
+		cfg.Caches[0].FinishWritesOnDisconnect = finishOnDisconnect
+		cfg.Users = []config.User{goodCfgWithCache.Users[0]}
+		if !withCache {
+			cfg.Users[0].Cache = ""
+		}
+		proxy, err := newConfiguredProxy(&cfg)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return httptest.NewServer(proxy), proxy
+	}
+
+	// timeToFirstByte returns the time until the first byte of the response
+	// is received along with its X-Cache header.
+	timeToFirstByte := func(srv *httptest.Server, query string) (time.Duration, string) {
+		startTime := time.Now()
+		resp, err := http.Get(fmt.Sprintf("%s?query=%s", srv.URL, url.QueryEscape(query)))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer resp.Body.Close()
+		if _, err := resp.Body.Read(make([]byte, 1)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		ttfb := time.Since(startTime)
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, 16*len(chunk)-1, len(b))
+		return ttfb, resp.Header.Get("X-Cache")
+	}
+
+	getCacheHit := func(srv *httptest.Server, query string) func() bool {
+		return func() bool {
+			resp, err := http.Get(fmt.Sprintf("%s?query=%s", srv.URL, url.QueryEscape(query)))
+			if err != nil {
+				return false
+			}
+			defer resp.Body.Close()
+			b, err := io.ReadAll(resp.Body)
+			return err == nil && resp.Header.Get("X-Cache") == XCacheHit && len(b) == 16*len(chunk)
+		}
+	}
+
+	t.Run("without cache", func(t *testing.T) {
+		srv, _ := newProxyServer(false, false, false)
+		defer srv.Close()
+		ttfb, _ := timeToFirstByte(srv, "SELECT no_cache")
+		assert.Less(t, ttfb, delay)
+	})
+
+	t.Run("sync writes", func(t *testing.T) {
+		srv, _ := newProxyServer(true, false, false)
+		defer srv.Close()
+		ttfb, xCache := timeToFirstByte(srv, "SELECT sync_writes")
+		assert.Equal(t, XCacheMiss, xCache)
+		assert.GreaterOrEqual(t, ttfb, delay)
+		assert.True(t, getCacheHit(srv, "SELECT sync_writes")())
+	})
+
+	t.Run("async writes", func(t *testing.T) {
+		srv, proxy := newProxyServer(true, true, false)
+		defer srv.Close()
+		ttfb, xCache := timeToFirstByte(srv, "SELECT async_writes")
+		assert.Equal(t, XCacheMiss, xCache)
+		assert.Less(t, ttfb, delay)
+		proxy.asyncCacheWrites.Wait()
+		assert.True(t, getCacheHit(srv, "SELECT async_writes")())
+	})
+
+	t.Run("finish writes on disconnect", func(t *testing.T) {
+		srv, proxy := newProxyServer(true, true, true)
+		defer srv.Close()
+		query := "SELECT finish_on_disconnect"
+		resp, err := http.Get(fmt.Sprintf("%s?query=%s", srv.URL, url.QueryEscape(query)))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := resp.Body.Read(make([]byte, 1)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		// The client disconnects before the response is complete.
+		resp.Body.Close()
+		proxy.asyncCacheWrites.Wait()
+		assert.True(t, getCacheHit(srv, query)())
+	})
 }
 
 func TestReverseProxy_ServeHTTP1(t *testing.T) {
-	query := "SELECT123456"
+	// The query must be cachable, so its transaction may be checked.
+	query := "SELECT(123456)"
 	testCases := []struct {
 		cfg                   *config.Config
 		name                  string
@@ -410,7 +3619,7 @@ func TestReverseProxy_ServeHTTP1(t *testing.T) {
 			expResponse:   "limits for cluster user \"web\" are exceeded: max_concurrent_queries limit: 1;",
 			expStatusCode: http.StatusTooManyRequests,
 			f: func(p *reverseProxy) *http.Response {
-				p.clusters["cluster"].users["web"].maxConcurrentQueries = 1
+				p.snapshot.Load().clusters["cluster"].users["web"].maxConcurrentQueries = 1
 				runHeavyRequestInGoroutine(p, 1, true)
 				return makeRequest(p)
 			},
@@ -421,7 +3630,7 @@ func TestReverseProxy_ServeHTTP1(t *testing.T) {
 			expResponse:   "rate limit for cluster user \"web\" is exceeded: requests_per_minute limit: -1",
 			expStatusCode: http.StatusTooManyRequests,
 			f: func(p *reverseProxy) *http.Response {
-				p.clusters["cluster"].users["web"].reqPerMin = -1
+				p.snapshot.Load().clusters["cluster"].users["web"].reqPerMin = -1
 				runHeavyRequestInGoroutine(p, 1, true)
 				return makeRequest(p)
 			},
@@ -432,7 +3641,7 @@ func TestReverseProxy_ServeHTTP1(t *testing.T) {
 			expResponse:   "timeout for cluster user \"web\" exceeded: 10ms",
 			expStatusCode: http.StatusGatewayTimeout,
 			f: func(p *reverseProxy) *http.Response {
-				p.clusters["cluster"].users["web"].maxExecutionTime = time.Millisecond * 10
+				p.snapshot.Load().clusters["cluster"].users["web"].maxExecutionTime = time.Millisecond * 10
 				return makeHeavyRequest(p, time.Millisecond*20)
 			},
 		},
@@ -442,8 +3651,8 @@ func TestReverseProxy_ServeHTTP1(t *testing.T) {
 			expResponse:   fmt.Sprintf("timeout for user \"%s\" exceeded: 10ms", defaultUsername),
 			expStatusCode: http.StatusGatewayTimeout,
 			f: func(p *reverseProxy) *http.Response {
-				p.users[defaultUsername].maxExecutionTime = time.Millisecond * 10
-				p.clusters["cluster"].users["web"].maxExecutionTime = time.Millisecond * 15
+				p.snapshot.Load().users[defaultUsername].maxExecutionTime = time.Millisecond * 10
+				p.snapshot.Load().clusters["cluster"].users["web"].maxExecutionTime = time.Millisecond * 15
 				return makeHeavyRequest(p, time.Millisecond*20)
 			},
 		},
@@ -453,8 +3662,8 @@ func TestReverseProxy_ServeHTTP1(t *testing.T) {
 			expResponse:   "timeout for cluster user \"web\" exceeded: 10ms",
 			expStatusCode: http.StatusGatewayTimeout,
 			f: func(p *reverseProxy) *http.Response {
-				p.users[defaultUsername].maxExecutionTime = time.Millisecond * 15
-				p.clusters["cluster"].users["web"].maxExecutionTime = time.Millisecond * 10
+				p.snapshot.Load().users[defaultUsername].maxExecutionTime = time.Millisecond * 15
+				p.snapshot.Load().clusters["cluster"].users["web"].maxExecutionTime = time.Millisecond * 10
 				return makeHeavyRequest(p, time.Millisecond*20)
 			},
 		},
@@ -464,7 +3673,7 @@ func TestReverseProxy_ServeHTTP1(t *testing.T) {
 			expResponse:   fmt.Sprintf("limits for user \"%s\" are exceeded: max_concurrent_queries limit: 1;", defaultUsername),
 			expStatusCode: http.StatusTooManyRequests,
 			f: func(p *reverseProxy) *http.Response {
-				p.users[defaultUsername].maxConcurrentQueries = 1
+				p.snapshot.Load().users[defaultUsername].maxConcurrentQueries = 1
 				runHeavyRequestInGoroutine(p, 1, true)
 				return makeRequest(p)
 			},
@@ -475,7 +3684,7 @@ func TestReverseProxy_ServeHTTP1(t *testing.T) {
 			expResponse:   fmt.Sprintf("rate limit for user %q is exceeded: requests_per_minute limit: -1", defaultUsername),
 			expStatusCode: http.StatusTooManyRequests,
 			f: func(p *reverseProxy) *http.Response {
-				p.users[defaultUsername].reqPerMin = -1
+				p.snapshot.Load().users[defaultUsername].reqPerMin = -1
 				runHeavyRequestInGoroutine(p, 1, true)
 				return makeRequest(p)
 			},
@@ -486,8 +3695,8 @@ func TestReverseProxy_ServeHTTP1(t *testing.T) {
 			expResponse:   okResponse,
 			expStatusCode: http.StatusOK,
 			f: func(p *reverseProxy) *http.Response {
-				p.users[defaultUsername].maxConcurrentQueries = 1
-				p.users[defaultUsername].queueCh = make(chan struct{}, 2)
+				p.snapshot.Load().users[defaultUsername].maxConcurrentQueries = 1
+				p.snapshot.Load().users[defaultUsername].queueCh = make(chan struct{}, 2)
 				runHeavyRequestInGoroutine(p, 1, true)
 				return makeRequest(p)
 			},
@@ -498,8 +3707,8 @@ func TestReverseProxy_ServeHTTP1(t *testing.T) {
 			expResponse:   okResponse,
 			expStatusCode: http.StatusOK,
 			f: func(p *reverseProxy) *http.Response {
-				p.users[defaultUsername].maxConcurrentQueries = 1
-				p.clusters["cluster"].users["web"].queueCh = make(chan struct{}, 2)
+				p.snapshot.Load().users[defaultUsername].maxConcurrentQueries = 1
+				p.snapshot.Load().clusters["cluster"].users["web"].queueCh = make(chan struct{}, 2)
 				runHeavyRequestInGoroutine(p, 1, true)
 				return makeRequest(p)
 			},
@@ -510,10 +3719,10 @@ func TestReverseProxy_ServeHTTP1(t *testing.T) {
 			expResponse:   okResponse,
 			expStatusCode: http.StatusOK,
 			f: func(p *reverseProxy) *http.Response {
-				p.caches["max_payload_size"] = &cache.AsyncCache{
+				p.snapshot.Load().caches["max_payload_size"] = &cache.AsyncCache{
 					MaxPayloadSize: 8 * 1024 * 1024,
 				}
-				p.users[defaultUsername].cache = p.caches["max_payload_size"]
+				p.snapshot.Load().users[defaultUsername].cache = p.snapshot.Load().caches["max_payload_size"]
 				return makeRequest(p)
 			},
 		},
@@ -523,8 +3732,8 @@ func TestReverseProxy_ServeHTTP1(t *testing.T) {
 			expResponse:   fmt.Sprintf("limits for user \"%s\" are exceeded: max_concurrent_queries limit: 1", defaultUsername),
 			expStatusCode: http.StatusTooManyRequests,
 			f: func(p *reverseProxy) *http.Response {
-				p.users[defaultUsername].maxConcurrentQueries = 1
-				p.users[defaultUsername].queueCh = make(chan struct{}, 1)
+				p.snapshot.Load().users[defaultUsername].maxConcurrentQueries = 1
+				p.snapshot.Load().users[defaultUsername].queueCh = make(chan struct{}, 1)
 				// we don't wait the requests to be handled by the fakeServer because one of them will be enqueued and not handled
 				// this is why we handle this part manually
 				nbRequest := atomic.LoadUint64(&totalNbOfRequests)
@@ -543,7 +3752,7 @@ func TestReverseProxy_ServeHTTP1(t *testing.T) {
 			expResponse:   "user \"foo\" is not allowed to access via https",
 			expStatusCode: http.StatusForbidden,
 			f: func(p *reverseProxy) *http.Response {
-				p.users["foo"].denyHTTPS = true
+				p.snapshot.Load().users["foo"].denyHTTPS = true
 				req := httptest.NewRequest("POST", fakeServer.URL, nil)
 				req.SetBasicAuth("foo", "bar")
 				req.TLS = &tls.ConnectionState{
@@ -570,7 +3779,7 @@ func TestReverseProxy_ServeHTTP1(t *testing.T) {
 			expResponse:   fmt.Sprintf("user \"%s\" is not allowed to access via http", defaultUsername),
 			expStatusCode: http.StatusForbidden,
 			f: func(p *reverseProxy) *http.Response {
-				p.users[defaultUsername].denyHTTP = true
+				p.snapshot.Load().users[defaultUsername].denyHTTP = true
 				return makeRequest(p)
 			},
 		},
@@ -673,10 +3882,10 @@ func TestReverseProxy_ServeHTTP1(t *testing.T) {
 			f: func(p *reverseProxy) *http.Response {
 				uri := fmt.Sprintf("%s?user=foo&password=bar", fakeServer.URL)
 				req := httptest.NewRequest("POST", uri, nil)
-				p.caches["max_payload_size"] = &cache.AsyncCache{
+				p.snapshot.Load().caches["max_payload_size"] = &cache.AsyncCache{
 					MaxPayloadSize: 8 * 1024 * 1024,
 				}
-				p.users["foo"].cache = p.caches["max_payload_size"]
+				p.snapshot.Load().users["foo"].cache = p.snapshot.Load().caches["max_payload_size"]
 				return makeCustomRequest(p, req)
 			},
 		},
@@ -734,8 +3943,8 @@ func TestReverseProxy_ServeHTTP1(t *testing.T) {
 			expResponse:   "limits for user \"default\" is exceeded: request_packet_size_tokens_burst limit: 4",
 			expStatusCode: http.StatusTooManyRequests,
 			f: func(p *reverseProxy) *http.Response {
-				p.users[defaultUsername].reqPacketSizeTokensBurst = 4
-				p.users[defaultUsername].reqPacketSizeTokenLimiter = rate.NewLimiter(
+				p.snapshot.Load().users[defaultUsername].reqPacketSizeTokensBurst = 4
+				p.snapshot.Load().users[defaultUsername].reqPacketSizeTokenLimiter = rate.NewLimiter(
 					rate.Limit(1), 4)
 				go makeHeavyRequest(p, time.Millisecond*20)
 				return makeHeavyRequest(p, time.Millisecond*200)
@@ -747,8 +3956,8 @@ func TestReverseProxy_ServeHTTP1(t *testing.T) {
 			expResponse:   "limits for cluster user \"web\" is exceeded: request_packet_size_tokens_burst limit: 4",
 			expStatusCode: http.StatusTooManyRequests,
 			f: func(p *reverseProxy) *http.Response {
-				p.clusters["cluster"].users["web"].reqPacketSizeTokensBurst = 4
-				p.clusters["cluster"].users["web"].reqPacketSizeTokenLimiter = rate.NewLimiter(
+				p.snapshot.Load().clusters["cluster"].users["web"].reqPacketSizeTokensBurst = 4
+				p.snapshot.Load().clusters["cluster"].users["web"].reqPacketSizeTokenLimiter = rate.NewLimiter(
 					rate.Limit(1), 4)
 				go makeHeavyRequest(p, time.Millisecond*20)
 				return makeHeavyRequest(p, time.Millisecond*200)
@@ -760,11 +3969,11 @@ func TestReverseProxy_ServeHTTP1(t *testing.T) {
 			expResponse:   okResponse,
 			expStatusCode: http.StatusOK,
 			f: func(p *reverseProxy) *http.Response {
-				p.users[defaultUsername].reqPacketSizeTokensBurst = 5
-				p.users[defaultUsername].reqPacketSizeTokenLimiter = rate.NewLimiter(
+				p.snapshot.Load().users[defaultUsername].reqPacketSizeTokensBurst = 5
+				p.snapshot.Load().users[defaultUsername].reqPacketSizeTokenLimiter = rate.NewLimiter(
 					rate.Limit(1), 5)
-				p.users[defaultUsername].queueCh = make(chan struct{}, 2)
-				p.users[defaultUsername].maxQueueTime = 10 * time.Second
+				p.snapshot.Load().users[defaultUsername].queueCh = make(chan struct{}, 2)
+				p.snapshot.Load().users[defaultUsername].maxQueueTime = 10 * time.Second
 				runHeavyRequestInGoroutine(p, 1, true)
 				return makeHeavyRequest(p, time.Millisecond*200)
 			},
@@ -775,11 +3984,11 @@ func TestReverseProxy_ServeHTTP1(t *testing.T) {
 			expResponse:   okResponse,
 			expStatusCode: http.StatusOK,
 			f: func(p *reverseProxy) *http.Response {
-				p.clusters["cluster"].users["web"].reqPacketSizeTokensBurst = 5
-				p.clusters["cluster"].users["web"].reqPacketSizeTokenLimiter = rate.NewLimiter(
+				p.snapshot.Load().clusters["cluster"].users["web"].reqPacketSizeTokensBurst = 5
+				p.snapshot.Load().clusters["cluster"].users["web"].reqPacketSizeTokenLimiter = rate.NewLimiter(
 					rate.Limit(1), 5)
-				p.clusters["cluster"].users["web"].queueCh = make(chan struct{}, 2)
-				p.clusters["cluster"].users["web"].maxQueueTime = 10 * time.Second
+				p.snapshot.Load().clusters["cluster"].users["web"].queueCh = make(chan struct{}, 2)
+				p.snapshot.Load().clusters["cluster"].users["web"].maxQueueTime = 10 * time.Second
 				runHeavyRequestInGoroutine(p, 1, true)
 				return makeHeavyRequest(p, time.Millisecond*200)
 			},
@@ -879,14 +4088,14 @@ func TestKillQuery(t *testing.T) {
 		{
 			name: "timeout user",
 			f: func(p *reverseProxy) *http.Response {
-				p.users[defaultUsername].maxExecutionTime = time.Millisecond * 5
+				p.snapshot.Load().users[defaultUsername].maxExecutionTime = time.Millisecond * 5
 				return makeHeavyRequest(p, time.Millisecond*40)
 			},
 		},
 		{
 			name: "timeout cluster user",
 			f: func(p *reverseProxy) *http.Response {
-				p.clusters["cluster"].users["web"].maxExecutionTime = time.Millisecond * 5
+				p.snapshot.Load().clusters["cluster"].users["web"].maxExecutionTime = time.Millisecond * 5
 				return makeHeavyRequest(p, time.Millisecond*40)
 			},
 		},
@@ -961,6 +4170,91 @@ func TestReverseProxy_ServeHTTPConcurrent(t *testing.T) {
 	})
 }
 
+func TestReverseProxy_GetScopeConcurrentReload(t *testing.T) {
+	addr, err := url.Parse(fakeServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	cfg := *goodCfg
+	cfg.Clusters = make([]config.Cluster, len(goodCfg.Clusters))
+	copy(cfg.Clusters, goodCfg.Clusters)
+	cfg.Clusters[0].Nodes = []string{addr.Host}
+	proxy, err := newConfiguredProxy(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	stopProxy(t, proxy)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			// Every reload builds new users and clusters.
+			if err := proxy.applyConfig(&cfg); err != nil {
+				t.Errorf("unexpected error: %s", err)
+				return
+			}
+		}
+	}()
+
+	f := func() {
+		req := httptest.NewRequest("GET", fmt.Sprintf("%s/fast", fakeServer.URL), nil)
+		for i := 0; i < 100; i++ {
+			s, _, err := proxy.getScope(req)
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+				return
+			}
+			// The user and the cluster must come from the same config.
+			if s.cluster.users[s.user.toUser] != s.clusterUser {
+				t.Errorf("cluster user %q doesn't belong to cluster %q", s.clusterUser.name, s.cluster.name)
+				return
+			}
+		}
+	}
+	err = testConcurrent(f, 10)
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("concurrent test err: %s", err)
+	}
+}
+
+func BenchmarkGetScope(b *testing.B) {
+	cfg := *goodCfg
+	cfg.Clusters = make([]config.Cluster, len(goodCfg.Clusters))
+	copy(cfg.Clusters, goodCfg.Clusters)
+	// Heartbeats mustn't compete with getScope for CPU.
+	cfg.Clusters[0].HeartBeat = config.HeartBeat{
+		Interval: config.Duration(time.Hour),
+		Timeout:  config.Duration(time.Second),
+		Request:  "/ping",
+		Response: "Ok.\n",
+	}
+	proxy, err := getProxy(&cfg)
+	if err != nil {
+		b.Fatalf("unexpected error: %s", err)
+	}
+	stopProxy(b, proxy)
+	req := httptest.NewRequest("GET", fmt.Sprintf("%s/fast", fakeServer.URL), nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, _, err := proxy.getScope(req); err != nil {
+				b.Fatalf("unexpected error: %s", err)
+			}
+		}
+	})
+}
+
 func TestReverseProxy_ServeHTTP2(t *testing.T) {
 	testCases := []struct {
 		name            string
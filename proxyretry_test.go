@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"io"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -170,6 +171,79 @@ func TestQueryWithRetrySuccess(t *testing.T) {
 	assert.Equal(t, mhs.hs, mhs.hst)
 }
 
+func TestQueryWithRetryDelay(t *testing.T) {
+	body := "foo query"
+	req := newRequest("http://localhost:8080", body)
+	mhs := &mockHosts{
+		t:  t,
+		b:  body,
+		hs: []string{"localhost:8080", "localhost:8090"},
+	}
+	s := newMockScope(mhs.hs)
+	s.cluster.retryDelay = 50 * time.Millisecond
+	s.cluster.retryBackoffMultiplier = 1
+	srw := mockStatRW(s)
+	mrw := &mockResponseWriterWithCode{}
+
+	start := time.Now()
+	_, err := executeWithRetry(context.Background(), s, 1, mhs.mockReverseProxy, mrw, srw, req,
+		func(f float64) {}, func(l prometheus.Labels) {})
+	checkErr(t, err)
+	assert.Equal(t, http.StatusOK, srw.statusCode)
+	assert.Equal(t, mhs.hs, mhs.hst)
+	assert.GreaterOrEqual(t, time.Since(start), s.cluster.retryDelay)
+}
+
+// TestQueryRetryDelayExceedsDeadline checks the query isn't retried
+// if the retry delay exceeds its max_execution_time.
+func TestQueryRetryDelayExceedsDeadline(t *testing.T) {
+	body := "foo query"
+	req := newRequest("http://localhost:8080", body)
+	mhs := &mockHosts{
+		t:  t,
+		b:  body,
+		hs: []string{"localhost:8080", "localhost:8090"},
+	}
+	s := newMockScope(mhs.hs)
+	s.cluster.retryDelay = time.Minute
+	s.cluster.retryBackoffMultiplier = 1
+	srw := mockStatRW(s)
+	mrw := &mockResponseWriterWithCode{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	_, err := executeWithRetry(ctx, s, 1, mhs.mockReverseProxy, mrw, srw, req,
+		func(f float64) {}, func(l prometheus.Labels) {})
+	checkErr(t, err)
+	assert.Equal(t, http.StatusBadGateway, srw.statusCode)
+	assert.Equal(t, []string{"localhost:8080"}, mhs.hst)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestClusterRetryBackoff(t *testing.T) {
+	c := &cluster{
+		retryDelay:             100 * time.Millisecond,
+		retryBackoffMultiplier: 2,
+		maxRetryDelay:          time.Second,
+	}
+	for numRetry, expected := range []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+	} {
+		assert.Equal(t, expected, c.retryBackoff(numRetry), "retry %d", numRetry)
+	}
+
+	c.maxRetryDelay = 0
+	assert.Equal(t, time.Duration(math.MaxInt64), c.retryBackoff(100))
+
+	c.retryDelay = 0
+	assert.Equal(t, time.Duration(0), c.retryBackoff(3))
+}
+
 func (mhs *mockHosts) mockReverseProxy(rw http.ResponseWriter, req *http.Request) {
 	if req.URL.Host != "localhost:8090" {
 		rw.WriteHeader(http.StatusBadGateway)
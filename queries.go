@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/contentsquare/chproxy/log"
+)
+
+const (
+	// queriesEndpoint lists queries proxied at the moment.
+	queriesEndpoint = "/queries"
+
+	// queriesPrefix is the prefix of endpoints managing running queries:
+	//   POST /queries/{id}/kill
+	queriesPrefix = "/queries/"
+
+	// maxRunningQuerySnippetLen is the maximum length of queries listed at /queries.
+	maxRunningQuerySnippetLen = 1024
+)
+
+// errQueryKilled is the cause of cancellation of queries killed via /queries.
+var errQueryKilled = errors.New("query killed via " + queriesEndpoint)
+
+// runningQueries is the registry of queries proxied at the moment.
+//
+// Queries are registered and unregistered by every request,
+// so the registry relies on sync.Map instead of a lock.
+type runningQueries struct {
+	// m holds *runningQuery per scopeID.
+	m sync.Map
+}
+
+// runningQuery is the query listed at /queries.
+//
+// Scope fields modified while the request is proxied
+// are copied on registration, so listing the query is race-free.
+type runningQuery struct {
+	s *scope
+
+	user        string
+	cluster     string
+	clusterUser string
+	node        string
+	query       string
+
+	// cancel cancels the proxied request. It is nil until the request
+	// is sent to the cluster node.
+	cancel atomic.Pointer[context.CancelCauseFunc]
+	killed atomic.Bool
+}
+
+// runningQueryInfo describes the running query in /queries responses.
+type runningQueryInfo struct {
+	ID          string    `json:"id"`
+	RequestID   string    `json:"request_id"`
+	User        string    `json:"user"`
+	Cluster     string    `json:"cluster"`
+	ClusterUser string    `json:"cluster_user"`
+	Node        string    `json:"node"`
+	StartTime   time.Time `json:"start_time"`
+	Query       string    `json:"query"`
+}
+
+func (rq *runningQuery) info() runningQueryInfo {
+	return runningQueryInfo{
+		ID:          rq.s.id.String(),
+		RequestID:   rq.s.requestID,
+		User:        rq.user,
+		Cluster:     rq.cluster,
+		ClusterUser: rq.clusterUser,
+		Node:        rq.node,
+		StartTime:   rq.s.startTime,
+		Query:       rq.query,
+	}
+}
+
+// register adds the query of s to the registry until unregister is called.
+func (q *runningQueries) register(s *scope, query string) *runningQuery {
+	if len(query) > maxRunningQuerySnippetLen {
+		query = query[:maxRunningQuerySnippetLen]
+	}
+	rq := &runningQuery{
+		s:           s,
+		user:        s.user.name,
+		cluster:     s.cluster.name,
+		clusterUser: s.clusterUser.name,
+		node:        s.host.Host(),
+		query:       query,
+	}
+	q.m.Store(s.id, rq)
+	return rq
+}
+
+func (q *runningQueries) unregister(s *scope) {
+	q.m.Delete(s.id)
+}
+
+// setCancel sets the function cancelling the proxied request of s.
+// The request is cancelled at once if the query has been already killed.
+func (q *runningQueries) setCancel(s *scope, cancel context.CancelCauseFunc) {
+	v, ok := q.m.Load(s.id)
+	if !ok {
+		return
+	}
+	// nolint:forcetypeassert // We will cover this by tests as we control what is stored.
+	rq := v.(*runningQuery)
+	rq.cancel.Store(&cancel)
+	if rq.killed.Load() {
+		cancel(errQueryKilled)
+	}
+}
+
+// list returns the running queries ordered by their start time.
+func (q *runningQueries) list() []runningQueryInfo {
+	queries := []runningQueryInfo{}
+	q.m.Range(func(_, v any) bool {
+		// nolint:forcetypeassert // We will cover this by tests as we control what is stored.
+		queries = append(queries, v.(*runningQuery).info())
+		return true
+	})
+	sort.Slice(queries, func(i, j int) bool {
+		return queries[i].StartTime.Before(queries[j].StartTime)
+	})
+	return queries
+}
+
+// kill cancels the proxied request of the query with the given id,
+// so the query is killed on the cluster node and the client
+// receives an error.
+func (q *runningQueries) kill(id scopeID) (runningQueryInfo, bool) {
+	v, ok := q.m.Load(id)
+	if !ok {
+		return runningQueryInfo{}, false
+	}
+	// nolint:forcetypeassert // We will cover this by tests as we control what is stored.
+	rq := v.(*runningQuery)
+	rq.killed.Store(true)
+	if cancel := rq.cancel.Load(); cancel != nil {
+		(*cancel)(errQueryKilled)
+	}
+	return rq.info(), true
+}
+
+// serveQueries serves /queries and /queries/{id}/kill.
+func (rp *reverseProxy) serveQueries(rw http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == queriesEndpoint {
+		if r.Method != http.MethodGet {
+			err := fmt.Errorf("%q: unsupported method %q for %q", r.RemoteAddr, r.Method, r.URL.Path)
+			respondWith(rw, err, http.StatusMethodNotAllowed)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(rw).Encode(rp.queries.list()); err != nil {
+			log.Errorf("cannot send running queries to %s: %s", r.RemoteAddr, err)
+		}
+		return
+	}
+
+	// The path is {id}/kill.
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, queriesPrefix), "/")
+	if len(parts) != 2 || parts[1] != "kill" {
+		badRequest.Inc()
+		err := fmt.Errorf("%q: unsupported path: %q", r.RemoteAddr, r.URL.Path)
+		respondWith(rw, err, http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodPost {
+		err := fmt.Errorf("%q: unsupported method %q for %q", r.RemoteAddr, r.Method, r.URL.Path)
+		respondWith(rw, err, http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseUint(parts[0], 16, 64)
+	if err != nil {
+		err = fmt.Errorf("%q: cannot parse query id %q: %w", r.RemoteAddr, parts[0], err)
+		respondWith(rw, err, http.StatusBadRequest)
+		return
+	}
+	info, ok := rp.queries.kill(scopeID(id))
+	if !ok {
+		err := fmt.Errorf("%q: query %q isn't running", r.RemoteAddr, parts[0])
+		respondWith(rw, err, http.StatusNotFound)
+		return
+	}
+	log.Debugf("%q: query %s of user %q is killed; query: %q", r.RemoteAddr, info.ID, info.User, info.Query)
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(info); err != nil {
+		log.Errorf("cannot send killed query info to %s: %s", r.RemoteAddr, err)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/contentsquare/chproxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReverseProxy_ServeQueries(t *testing.T) {
+	addr, err := url.Parse(fakeServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	proxy, err := newConfiguredProxy(&config.Config{
+		Clusters: []config.Cluster{
+			{
+				Name:         "cluster",
+				Scheme:       "http",
+				Nodes:        []string{addr.Host},
+				ClusterUsers: []config.ClusterUser{{Name: "web"}},
+			},
+		},
+		Users: []config.User{
+			{
+				Name:      defaultUsername,
+				ToCluster: "cluster",
+				ToUser:    "web",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	stopProxy(t, proxy)
+
+	listQueries := func() []runningQueryInfo {
+		t.Helper()
+		rw := httptest.NewRecorder()
+		proxy.serveQueries(rw, httptest.NewRequest(http.MethodGet, queriesEndpoint, nil))
+		if rw.Code != http.StatusOK {
+			t.Fatalf("unexpected status code: %d; body: %s", rw.Code, rw.Body)
+		}
+		var queries []runningQueryInfo
+		if err := json.NewDecoder(rw.Body).Decode(&queries); err != nil {
+			t.Fatalf("cannot parse running queries: %s", err)
+		}
+		return queries
+	}
+	assert.Empty(t, listQueries())
+
+	respCh := make(chan *http.Response, 1)
+	go func() {
+		respCh <- makeHeavyRequest(proxy, 5*time.Second)
+	}()
+
+	var queries []runningQueryInfo
+	if !assert.Eventually(t, func() bool {
+		queries = listQueries()
+		return len(queries) == 1
+	}, 5*time.Second, 10*time.Millisecond) {
+		t.FailNow()
+	}
+	q := queries[0]
+	assert.Equal(t, defaultUsername, q.User)
+	assert.Equal(t, "cluster", q.Cluster)
+	assert.Equal(t, "web", q.ClusterUser)
+	assert.Equal(t, "5s", q.Query)
+
+	rw := httptest.NewRecorder()
+	proxy.serveQueries(rw, httptest.NewRequest(http.MethodPost, fmt.Sprintf("%s%s/kill", queriesPrefix, q.ID), nil))
+	assert.Equal(t, http.StatusOK, rw.Code, rw.Body.String())
+
+	var resp *http.Response
+	select {
+	case resp = <-respCh:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("killed query hasn't completed")
+	}
+	assert.Equal(t, 499, resp.StatusCode)
+	b := bbToString(t, resp.Body)
+	assert.Contains(t, b, errQueryKilled.Error())
+
+	// The query is killed on the cluster node.
+	assert.Eventually(t, func() bool {
+		killed, err := registry.get(extractID(scopeIDRe, b))
+		return err == nil && killed
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Empty(t, listQueries())
+
+	rw = httptest.NewRecorder()
+	proxy.serveQueries(rw, httptest.NewRequest(http.MethodPost, fmt.Sprintf("%s%s/kill", queriesPrefix, q.ID), nil))
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+	assert.True(t, strings.Contains(rw.Body.String(), "isn't running"), rw.Body.String())
+
+	rw = httptest.NewRecorder()
+	proxy.serveQueries(rw, httptest.NewRequest(http.MethodPost, queriesPrefix+"foo/kill", nil))
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+}
+
+func TestReverseProxy_ServeQueriesLargeBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "%d", len(b))
+	}))
+	defer srv.Close()
+	addr, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	proxy, err := newConfiguredProxy(&config.Config{
+		Clusters: []config.Cluster{
+			{
+				Name:         "cluster",
+				Scheme:       "http",
+				Nodes:        []string{addr.Host},
+				ClusterUsers: []config.ClusterUser{{Name: "web"}},
+			},
+		},
+		Users: []config.User{
+			{
+				Name:      defaultUsername,
+				ToCluster: "cluster",
+				ToUser:    "web",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	stopProxy(t, proxy)
+
+	// Registering the query mustn't truncate the proxied body.
+	body := "INSERT INTO t FORMAT TSV\n" + strings.Repeat("1\n", 4096)
+	resp := makeCustomRequest(proxy, httptest.NewRequest(http.MethodPost, srv.URL, strings.NewReader(body)))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, strconv.Itoa(len(body)), bbToString(t, resp.Body))
+}
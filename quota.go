@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// quotaInterval is the interval the user's consumption is budgeted for.
+const quotaInterval = time.Hour
+
+// quota tracks the consumption of the user during the current interval.
+//
+// It is passed to the user with the same name on config reload,
+// so the consumption isn't reset by reloads.
+type quota struct {
+	user string
+
+	// executionTotal is the sum of query durations in nanoseconds
+	executionTotal atomic.Int64
+
+	// bytesTransferred is the sum of response sizes
+	bytesTransferred atomic.Int64
+
+	// resetAt is the time of the next reset in unix nanoseconds
+	resetAt atomic.Int64
+}
+
+func newQuota(user string, now time.Time) *quota {
+	q := &quota{user: user}
+	q.resetAt.Store(now.Add(quotaInterval).UnixNano())
+	return q
+}
+
+// timeToReset returns the duration until the consumption is reset.
+func (q *quota) timeToReset(now time.Time) time.Duration {
+	return time.Unix(0, q.resetAt.Load()).Sub(now)
+}
+
+func (q *quota) consume(d time.Duration, bytes int64) {
+	labels := prometheus.Labels{"user": q.user}
+	n := q.executionTotal.Add(int64(d))
+	userQuotaExecution.With(labels).Set(time.Duration(n).Seconds())
+	n = q.bytesTransferred.Add(bytes)
+	userQuotaTransferredBytes.With(labels).Set(float64(n))
+}
+
+func (q *quota) reset(now time.Time) {
+	q.executionTotal.Store(0)
+	q.bytesTransferred.Store(0)
+	q.resetAt.Store(now.Add(quotaInterval).UnixNano())
+
+	labels := prometheus.Labels{"user": q.user}
+	userQuotaExecution.With(labels).Set(0)
+	userQuotaTransferredBytes.With(labels).Set(0)
+}
+
+func (q *quota) run(done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(q.timeToReset(time.Now())):
+			q.reset(time.Now())
+		}
+	}
+}
+
+// hasQuota returns true if the user has any quota configured.
+func (u *user) hasQuota() bool {
+	return u.maxExecutionTotal > 0 || u.maxBytesTransferred > 0
+}
+
+// checkQuota returns an error if the user has exhausted any of its quotas.
+func (u *user) checkQuota() error {
+	if !u.hasQuota() {
+		return nil
+	}
+
+	ttr := u.quota.timeToReset(time.Now()).Round(time.Second)
+	if u.maxExecutionTotal > 0 && u.quota.executionTotal.Load() >= int64(u.maxExecutionTotal) {
+		return fmt.Errorf("quota for user %q is exceeded: max_execution_total_per_hour limit: %s; resets in %s",
+			u.name, u.maxExecutionTotal, ttr)
+	}
+	if u.maxBytesTransferred > 0 && u.quota.bytesTransferred.Load() >= int64(u.maxBytesTransferred) {
+		return fmt.Errorf("quota for user %q is exceeded: max_bytes_transferred_per_hour limit: %d; resets in %s",
+			u.name, u.maxBytesTransferred, ttr)
+	}
+	return nil
+}
+
+// preserveQuotas passes the consumption of the users from oldUsers
+// to the users with the same names from users.
+func preserveQuotas(users, oldUsers map[string]*user) {
+	for name, u := range users {
+		if old, ok := oldUsers[name]; ok {
+			u.quota = old.quota
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// durationsWeight is the weight of the last query duration
+	// in the moving average of query durations.
+	durationsWeight = 0.2
+
+	// minRetryAfter and maxRetryAfter limit Retry-After of responses
+	// to requests rejected due to exceeded limits.
+	minRetryAfter = time.Second
+	maxRetryAfter = time.Minute
+)
+
+// queryDurations tracks the exponentially weighted moving average
+// of durations of queries.
+type queryDurations struct {
+	mu  sync.Mutex
+	avg time.Duration
+}
+
+func (qd *queryDurations) add(d time.Duration) {
+	qd.mu.Lock()
+	defer qd.mu.Unlock()
+	if qd.avg == 0 {
+		qd.avg = d
+		return
+	}
+	qd.avg = time.Duration(durationsWeight*float64(d) + (1-durationsWeight)*float64(qd.avg))
+}
+
+func (qd *queryDurations) load() time.Duration {
+	qd.mu.Lock()
+	defer qd.mu.Unlock()
+	return qd.avg
+}
+
+// retryAfter returns the delay clients should wait before retrying requests
+// rejected due to max_concurrent_queries or the queue overflow.
+//
+// Running queries of the user are expected to complete in the average
+// duration of recent queries, so slots are likely to be freed by then.
+// The delay is limited by minRetryAfter and maxRetryAfter.
+func retryAfter(s *scope) time.Duration {
+	d := s.user.queryDurations.load()
+	if d < minRetryAfter {
+		return minRetryAfter
+	}
+	if d > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return d
+}
+
+// setRetryAfter sets Retry-After header to d rounded up to seconds.
+func setRetryAfter(rw http.ResponseWriter, d time.Duration) {
+	rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/contentsquare/chproxy/cache"
+	"github.com/contentsquare/chproxy/log"
+)
+
+// revalidateCache refreshes the stale cache entry for the given key
+// in background. Only a single refresh per key is started, since concurrent
+// requests find the pending transaction registered for the key.
+func (rp *reverseProxy) revalidateCache(s *scope, req *http.Request, key *cache.Key, q []byte) {
+	userCache := s.user.cache
+	status, err := userCache.Status(key)
+	if err != nil {
+		log.Errorf("%s: %s; query: %q - failed to get transaction status", s, err, q)
+		return
+	}
+	if status.State.IsPending() {
+		// The entry is already being refreshed.
+		return
+	}
+
+	body, err := readAndRestoreRequestBody(req)
+	if err != nil {
+		log.Errorf("%s: cannot read request body: %s; query: %q", s, err, q)
+		return
+	}
+
+	if err := userCache.Create(key, s.user.name); err != nil {
+		log.Errorf("%s: %s; query: %q - failed to register transaction", s, err, q)
+		return
+	}
+
+	// The refresh request is accounted by its own scope, so it is subject
+	// to the user limits like any other request.
+	rs := newScope(req, s.user, s.cluster, s.clusterUser, "", 0, s.hashKey)
+	rs.operationType = s.operationType
+	rs.identityCounter = s.identityCounter
+
+	rreq := req.Clone(context.Background())
+	rreq.RequestURI = ""
+	rreq.Body = io.NopCloser(bytes.NewReader(body))
+	rreq.ContentLength = int64(len(body))
+	rreq.URL.Scheme = rs.host.Scheme()
+	rreq.URL.Host = rs.host.Host()
+	rreq.Host = rs.host.Host()
+	params := rreq.URL.Query()
+	params.Set("query_id", rs.id.String())
+	rreq.URL.RawQuery = params.Encode()
+
+	go func() {
+		statusCode := rp.refreshCacheEntry(rs, rreq, userCache, key, q)
+		rp.completeTransaction(rs, statusCode, userCache, key, q, "")
+	}()
+}
+
+// refreshCacheEntry proxies req and puts the response into userCache.
+// It returns the status code of the response.
+func (rp *reverseProxy) refreshCacheEntry(s *scope, req *http.Request, userCache *cache.AsyncCache, key *cache.Key, q []byte) int {
+	if err := s.incQueued(); err != nil {
+		limitExcess.With(s.priorityLabels()).Inc()
+		log.Debugf("%s: cannot refresh stale cache entry: %s; query: %q", s, err, q)
+		return http.StatusTooManyRequests
+	}
+	defer s.dec()
+
+	rw := &backgroundResponseWriter{header: make(http.Header)}
+	tmpFileRespWriter, err := cache.NewTmpFileResponseWriter(rw, os.TempDir())
+	if err != nil {
+		log.Errorf("%s: %s; query: %q", s, err, q)
+		return http.StatusInternalServerError
+	}
+	defer tmpFileRespWriter.Close()
+	tmpFileRespWriter.SetMaxSize(s.user.maxResponseSize)
+	tmpFileRespWriter.SetCachedHeaders(userCache.CachedHeaders)
+
+	srw := &statResponseWriter{
+		ResponseWriter: rw,
+		bytesWritten:   responseBodyBytes.With(s.operationLabels()),
+	}
+	startTime := time.Now()
+	rp.proxyRequest(s, tmpFileRespWriter, srw, req)
+	if s.user.hasQuota() {
+		s.user.quota.consume(time.Since(startTime), 0)
+	}
+	if s.user.hasDailyBudget() {
+		s.user.consumeDailyBudget(time.Since(startTime))
+	}
+
+	labels := makeCacheLabels(s)
+	statusCode := tmpFileRespWriter.StatusCode()
+	if statusCode != http.StatusOK || s.canceled {
+		log.Debugf("%s: cannot refresh stale cache entry: unexpected status code %d; query: %q", s, statusCode, q)
+		return statusCode
+	}
+
+	contentLength, err := tmpFileRespWriter.GetCapturedContentLength()
+	if err != nil {
+		log.Errorf("%s: %s; query: %q - failed to get contentLength of query", s, err, q)
+		return http.StatusInternalServerError
+	}
+	if contentLength > int64(userCache.MaxPayloadSize) {
+		cacheSkipped.With(labels).Inc()
+		log.Infof("%s: Request will not be cached. Content length (%d) is greater than max payload size (%d)", s, contentLength, userCache.MaxPayloadSize)
+		return statusCode
+	}
+	reader, err := tmpFileRespWriter.Reader()
+	if err != nil {
+		log.Errorf("%s: %s; query: %q - failed to get Reader from tmp file", s, err, q)
+		return http.StatusInternalServerError
+	}
+	contentMetadata := cache.ContentMetadata{
+		Length:   contentLength,
+		Encoding: tmpFileRespWriter.GetCapturedContentEncoding(),
+		Type:     tmpFileRespWriter.GetCapturedContentType(),
+		Headers:  tmpFileRespWriter.GetCapturedHeaders(),
+	}
+	if _, err := userCache.Put(reader, contentMetadata, key); err != nil {
+		cacheFailedInsert.With(labels).Inc()
+		log.Errorf("%s: %s; query: %q - failed to put response in the cache", s, err, q)
+		return statusCode
+	}
+	log.Debugf("%s: stale cache entry refreshed", s)
+	return statusCode
+}
+
+// backgroundResponseWriter is the http.ResponseWriter for requests
+// proxied in background, which have no client to respond to.
+type backgroundResponseWriter struct {
+	header http.Header
+}
+
+func (rw *backgroundResponseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *backgroundResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (rw *backgroundResponseWriter) WriteHeader(int) {}
+
+// CloseNotify implements http.CloseNotifier.
+// The returned channel is never closed, since there is no client.
+func (rw *backgroundResponseWriter) CloseNotify() <-chan bool {
+	return nil
+}
@@ -1,16 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"text/template"
 	"time"
 
 	"github.com/contentsquare/chproxy/cache"
@@ -45,40 +51,128 @@ type scope struct {
 
 	sessionId      string
 	sessionTimeout int
+	// sessionClose is set if the session must be released
+	// once the request completes
+	sessionClose bool
+	// sessionCheck is set if the request must fail instead of
+	// being proxied to other hosts than the one of the session
+	sessionCheck bool
 
 	remoteAddr string
 	localAddr  string
 
+	// clientQueryID is the query_id set by the client. It is kept
+	// only for users with `keep_client_query_id`.
+	clientQueryID string
+
+	// requestID is taken from the X-Request-Id header of the request.
+	// It is generated from the scope id if the header is missing.
+	requestID string
+	// traceParent is the W3C traceparent header of the request.
+	traceParent string
+
 	// is true when KillQuery has been called
 	canceled bool
 
+	// is true when the request is proxied to `fallback_cluster`
+	// since all the nodes of the chosen cluster are inactive
+	fallback bool
+
+	// is true when the response has been served from the cache
+	servedFromCache bool
+
+	// is true when the request body exceeds `max_buffer_size`,
+	// so it is streamed to ClickHouse without being buffered
+	streamedBody bool
+
 	labels prometheus.Labels
 
 	requestPacketSize int
+
+	// operationType is either operationRead or operationWrite
+	operationType string
+
+	// queryFingerprint is the `query_fingerprint` label of the request.
+	queryFingerprint string
+
+	// exceptionCode is the code of the ClickHouse exception
+	// from the proxied response if the query has failed.
+	exceptionCode string
+
+	// hashKey is the key hosts are chosen by in clusters
+	// with `load_balancing: consistent_hash`.
+	hashKey string
+
+	// identityCounter counts running queries of the concrete user
+	// matching the wildcarded user with per-identity limits.
+	// The user limits are applied to s.user otherwise.
+	identityCounter *counter
 }
 
-func newScope(req *http.Request, u *user, c *cluster, cu *clusterUser, sessionId string, sessionTimeout int) *scope {
-	h := c.getHost()
-	if sessionId != "" {
-		h = c.getHostSticky(sessionId)
-	}
+const (
+	requestIDHeader   = "X-Request-Id"
+	traceParentHeader = "traceparent"
+
+	// fallbackHeader is set in responses to requests
+	// proxied to `fallback_cluster`.
+	fallbackHeader = "X-ChProxy-Fallback"
+)
+
+const (
+	sourceProxy = "proxy"
+	sourceCache = "cache"
+)
+
+const (
+	operationRead  = "read"
+	operationWrite = "write"
+)
+
+func newScope(req *http.Request, u *user, c *cluster, cu *clusterUser, sessionId string, sessionTimeout int, hashKey string) *scope {
 	var localAddr string
 	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
 		localAddr = addr.String()
 	}
+	s := newConnScope(u, c, cu, sessionId, sessionTimeout, hashKey, req.RemoteAddr, localAddr)
+	if requestID := req.Header.Get(requestIDHeader); len(requestID) > 0 {
+		s.requestID = requestID
+	}
+	s.traceParent = req.Header.Get(traceParentHeader)
+	if u.keepClientQueryID {
+		s.clientQueryID = req.URL.Query().Get("query_id")
+	}
+	return s
+}
+
+// queryID returns the query_id the query is sent to ClickHouse with.
+func (s *scope) queryID() string {
+	if len(s.clientQueryID) > 0 {
+		return s.clientQueryID
+	}
+	return s.id.String()
+}
+
+// newConnScope returns the scope of the request from remoteAddr accepted on localAddr.
+// It is used for connections without http requests, e.g. native protocol connections.
+func newConnScope(u *user, c *cluster, cu *clusterUser, sessionId string, sessionTimeout int, hashKey, remoteAddr, localAddr string) *scope {
+	h := c.pickHost(sessionId, hashKey)
+	id := newScopeID()
 	s := &scope{
 		startTime:      time.Now(),
-		id:             newScopeID(),
+		id:             id,
 		host:           h,
 		cluster:        c,
 		user:           u,
 		clusterUser:    cu,
 		sessionId:      sessionId,
 		sessionTimeout: sessionTimeout,
+		hashKey:        hashKey,
 
-		remoteAddr: req.RemoteAddr,
+		remoteAddr: remoteAddr,
 		localAddr:  localAddr,
 
+		requestID: id.String(),
+
 		labels: prometheus.Labels{
 			"user":         u.name,
 			"cluster":      c.name,
@@ -91,8 +185,12 @@ func newScope(req *http.Request, u *user, c *cluster, cu *clusterUser, sessionId
 }
 
 func (s *scope) String() string {
-	return fmt.Sprintf("[ Id: %s; User %q(%d) proxying as %q(%d) to %q(%d); RemoteAddr: %q; LocalAddr: %q; Duration: %d μs]",
-		s.id,
+	var traceParent string
+	if len(s.traceParent) > 0 {
+		traceParent = fmt.Sprintf("; TraceParent: %q", s.traceParent)
+	}
+	return fmt.Sprintf("[ Id: %s; RequestId: %q%s; User %q(%d) proxying as %q(%d) to %q(%d); RemoteAddr: %q; LocalAddr: %q; Duration: %d μs]",
+		s.id, s.requestID, traceParent,
 		s.user.name, s.user.queryCounter.load(),
 		s.clusterUser.name, s.clusterUser.queryCounter.load(),
 		s.host.Host(), s.host.CurrentLoad(),
@@ -152,6 +250,17 @@ func (s *scope) incQueued() error {
 	queueSize := requestQueueSize.With(labels)
 	queueSize.Inc()
 	defer queueSize.Dec()
+	queueDepth := requestQueueDepth.With(prometheus.Labels{
+		"user":         labels["user"],
+		"cluster_user": labels["cluster_user"],
+	})
+	queueDepth.Inc()
+	defer queueDepth.Dec()
+
+	// Make lower priority requests to the cluster yield
+	// while the request is waiting.
+	s.cluster.queue.enqueue(s.user.queuePriority)
+	defer s.cluster.queue.dequeue(s.user.queuePriority)
 
 	// Try starting the request during the given duration.
 	sleep, deadline := s.calculateQueueDeadlineAndSleep()
@@ -180,15 +289,13 @@ func (s *scope) waitUntilAllowStart(sleep time.Duration, deadline time.Time, lab
 		} else {
 			time.Sleep(sleep)
 		}
-		var h *topology.Node
-		// Choose new host, since the previous one may become obsolete
-		// after sleeping.
-		if s.sessionId == "" {
-			h = s.cluster.getHost()
-		} else {
-			// if request has session_id, set same host
-			h = s.cluster.getHostSticky(s.sessionId)
+		if s.sessionCheck {
+			// The session exists only at the chosen host.
+			continue
 		}
+		// Choose new host, since the previous one may become obsolete
+		// after sleeping. Requests with session_id keep the same host.
+		h := s.cluster.pickHost(s.sessionId, s.hashKey)
 
 		s.host = h
 		s.labels["replica"] = h.ReplicaName()
@@ -211,18 +318,28 @@ func (s *scope) calculateQueueDeadlineAndSleep() (time.Duration, time.Time) {
 }
 
 func (s *scope) inc() error {
-	uQueries := s.user.queryCounter.inc()
+	if s.cluster.queue.hasWaitingAbove(s.user.queuePriority) {
+		return fmt.Errorf("limits for user %q are exceeded: requests with higher priority than %q are waiting in the queue of cluster %q",
+			s.user.name, s.user.queuePriority, s.cluster.name)
+	}
+
+	uQueries := s.userQueryCounter().inc()
 	cQueries := s.clusterUser.queryCounter.inc()
+	s.host.IncrementConnections()
 
 	var err error
 	if s.user.maxConcurrentQueries > 0 && uQueries > s.user.maxConcurrentQueries {
 		err = fmt.Errorf("limits for user %q are exceeded: max_concurrent_queries limit: %d",
-			s.user.name, s.user.maxConcurrentQueries)
+			s.userName(), s.user.maxConcurrentQueries)
 	}
 	if s.clusterUser.maxConcurrentQueries > 0 && cQueries > s.clusterUser.maxConcurrentQueries {
 		err = fmt.Errorf("limits for cluster user %q are exceeded: max_concurrent_queries limit: %d",
 			s.clusterUser.name, s.clusterUser.maxConcurrentQueries)
 	}
+	if s.cluster.maxConcurrentQueriesPerNode > 0 && s.host.CurrentLoad() > s.cluster.maxConcurrentQueriesPerNode {
+		err = fmt.Errorf("limits for node %q of cluster %q are exceeded: max_concurrent_queries_per_node limit: %d",
+			s.host.Host(), s.cluster.name, s.cluster.maxConcurrentQueriesPerNode)
+	}
 
 	err2 := s.checkTokenFreeRateLimiters()
 	if err2 != nil {
@@ -230,8 +347,9 @@ func (s *scope) inc() error {
 	}
 
 	if err != nil {
-		s.user.queryCounter.dec()
+		s.userQueryCounter().dec()
 		s.clusterUser.queryCounter.dec()
+		s.host.DecrementConnections()
 
 		// Decrement rate limiter here, so it doesn't count requests
 		// that didn't start due to limits overflow.
@@ -240,11 +358,81 @@ func (s *scope) inc() error {
 		return err
 	}
 
-	s.host.IncrementConnections()
-	concurrentQueries.With(s.labels).Inc()
+	concurrentQueries.With(s.priorityLabels()).Inc()
 	return nil
 }
 
+// incUnlimited accounts the request like inc without applying the limits.
+// It is used for requests, which mustn't be rejected, since the data they carry
+// has been already acknowledged to clients. The request is released by dec.
+func (s *scope) incUnlimited() {
+	s.userQueryCounter().inc()
+	s.clusterUser.queryCounter.inc()
+	s.host.IncrementConnections()
+	concurrentQueries.With(s.priorityLabels()).Inc()
+}
+
+// userQueryCounter returns the counter of running queries
+// the user limits are applied to.
+func (s *scope) userQueryCounter() *counter {
+	if s.identityCounter != nil {
+		return s.identityCounter
+	}
+	return &s.user.queryCounter
+}
+
+// userName returns the name of the user the user limits are applied to.
+func (s *scope) userName() string {
+	if s.identityCounter != nil {
+		// The cluster user carries the original credentials
+		// of the wildcarded user, see generateWildcardedUserInformation.
+		return s.clusterUser.name
+	}
+	return s.user.name
+}
+
+// operationLabels returns s.labels with the operation type of the request.
+func (s *scope) operationLabels() prometheus.Labels {
+	labels := make(prometheus.Labels, len(s.labels)+1)
+	for k, v := range s.labels {
+		labels[k] = v
+	}
+	labels["operation_type"] = s.operationType
+	return labels
+}
+
+// requestLabels returns the labels of request counters and durations,
+// which contain the query fingerprint if it is enabled.
+func (s *scope) requestLabels() prometheus.Labels {
+	labels := s.operationLabels()
+	if queryFingerprints != nil {
+		labels["query_fingerprint"] = s.queryFingerprint
+	}
+	return labels
+}
+
+// sizeLabels returns the labels of request and response sizes,
+// which are split by the source of the response and its status class.
+func (s *scope) sizeLabels(statusCode int) prometheus.Labels {
+	labels := s.operationLabels()
+	labels["source"] = sourceProxy
+	if s.servedFromCache {
+		labels["source"] = sourceCache
+	}
+	labels["status_class"] = fmt.Sprintf("%dxx", statusCode/100)
+	return labels
+}
+
+// priorityLabels returns s.labels with the queue priority of the request.
+func (s *scope) priorityLabels() prometheus.Labels {
+	labels := make(prometheus.Labels, len(s.labels)+1)
+	for k, v := range s.labels {
+		labels[k] = v
+	}
+	labels["priority"] = s.user.queuePriority.String()
+	return labels
+}
+
 func (s *scope) checkTokenFreeRateLimiters() error {
 	var err error
 
@@ -299,27 +487,48 @@ func (s *scope) dec() {
 	// There is no need in ratelimiter.dec here, since the rate limiter
 	// is automatically zeroed every minute in rateLimiter.run.
 
-	s.user.queryCounter.dec()
+	s.userQueryCounter().dec()
 	s.clusterUser.queryCounter.dec()
 	s.host.DecrementConnections()
-	concurrentQueries.With(s.labels).Dec()
+	concurrentQueries.With(s.priorityLabels()).Dec()
 }
 
-const killQueryTimeout = time.Second * 30
+const defaultKillQueryTimeout = time.Second * 30
 
 func (s *scope) killQuery() error {
-	log.Debugf("killing the query with query_id=%s", s.id)
+	log.Debugf("killing the query with query_id=%s", s.queryID())
 	killedRequests.With(s.labels).Inc()
 	s.canceled = true
 
-	query := fmt.Sprintf("KILL QUERY WHERE query_id = '%s'", s.id)
+	labels := prometheus.Labels{"cluster": s.cluster.name}
+	err := s.sendKillQuery()
+	for i := 0; err != nil && i < s.cluster.killQueryRetries; i++ {
+		log.Debugf("retrying to kill the query with query_id=%s after error: %s", s.queryID(), err)
+		err = s.sendKillQuery()
+	}
+	if err != nil {
+		killQueryFailures.With(labels).Inc()
+		return err
+	}
+	killQuerySuccesses.With(labels).Inc()
+	return nil
+}
+
+var killQueryIDEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+// sendKillQuery kills the query via the transport used for proxying it,
+// so the cluster TLS config is applied.
+func (s *scope) sendKillQuery() error {
+	// The id may be set by the client, so it is escaped
+	// for the single-quoted literal of the template.
+	query := strings.ReplaceAll(s.cluster.killQueryTemplate, config.KillQueryIDPlaceholder, killQueryIDEscaper.Replace(s.queryID()))
 	r := strings.NewReader(query)
 	addr := s.host.String()
 	req, err := http.NewRequest("POST", addr, r)
 	if err != nil {
 		return fmt.Errorf("error while creating kill query request to %s: %w", addr, err)
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), killQueryTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), s.cluster.killQueryTimeout)
 	defer cancel()
 
 	req = req.WithContext(ctx)
@@ -331,7 +540,8 @@ func (s *scope) killQuery() error {
 	}
 	req.SetBasicAuth(userName, s.cluster.killQueryUserPassword)
 
-	resp, err := http.DefaultClient.Do(req)
+	client := &http.Client{Transport: s.cluster.transport}
+	resp, err := client.Do(req)
 	if err != nil {
 		return fmt.Errorf("error while executing clickhouse query %q at %q: %w", query, addr, err)
 	}
@@ -348,7 +558,7 @@ func (s *scope) killQuery() error {
 		return fmt.Errorf("cannot read response body for the query %q: %w", query, err)
 	}
 
-	log.Debugf("killed the query with query_id=%s; respBody: %q", s.id, respBody)
+	log.Debugf("killed the query with query_id=%s; respBody: %q", s.queryID(), respBody)
 	return nil
 }
 
@@ -377,6 +587,8 @@ var allowedParams = []string{
 	"session_id",
 	// session timeout
 	"session_timeout",
+	// fail if the session doesn't exist
+	"session_check",
 	// specifies the value for the log_comment field of the system.query_log table and comment text for the server log.
 	"log_comment",
 }
@@ -385,7 +597,7 @@ var allowedParams = []string{
 // @see https://clickhouse.yandex/docs/en/table_engines/external_data/
 var externalDataParams = regexp.MustCompile(`(_types|_structure|_format)$`)
 
-func (s *scope) decorateRequest(req *http.Request) (*http.Request, url.Values) {
+func (s *scope) decorateRequest(req *http.Request) (*http.Request, url.Values, error) {
 	// Make new params to purify URL.
 	params := make(url.Values)
 
@@ -393,7 +605,7 @@ func (s *scope) decorateRequest(req *http.Request) (*http.Request, url.Values) {
 	if req.RequestURI == pingEndpoint {
 		req.URL.Scheme = s.host.Scheme()
 		req.URL.Host = s.host.Host()
-		return req, req.URL.Query()
+		return req, req.URL.Query(), nil
 	}
 
 	// Set user params
@@ -412,6 +624,21 @@ func (s *scope) decorateRequest(req *http.Request) (*http.Request, url.Values) {
 		}
 	}
 
+	// Use the default database of the user unless the client sets one,
+	// so ClickHouse doesn't fall back to the `default` database.
+	if len(s.user.allowedDatabases) > 0 && len(params.Get("database")) == 0 && len(req.Header.Get("X-ClickHouse-Database")) == 0 {
+		params.Set("database", s.user.allowedDatabases[0])
+	}
+
+	// Use the default format of the user unless the client sets one.
+	// The FORMAT clause of the query takes precedence over it in ClickHouse.
+	// The format is set in origParams as well, so it becomes a part
+	// of the cache key.
+	if len(s.user.defaultFormat) > 0 && len(params.Get("default_format")) == 0 && len(req.Header.Get("X-ClickHouse-Format")) == 0 {
+		params.Set("default_format", s.user.defaultFormat)
+		origParams.Set("default_format", s.user.defaultFormat)
+	}
+
 	// Keep parametrized queries params
 	for param := range origParams {
 		if strings.HasPrefix(param, "param_") {
@@ -424,8 +651,28 @@ func (s *scope) decorateRequest(req *http.Request) (*http.Request, url.Values) {
 		s.decoratePostRequest(req, origParams, params)
 	}
 
-	// Set query_id as scope_id to have possibility to kill query if needed.
-	params.Set("query_id", s.id.String())
+	if err := s.rewriteQuery(req, params); err != nil {
+		return req, origParams, err
+	}
+
+	// Mark the query with the person it is sent on behalf of,
+	// so it may be found in system.query_log.
+	if s.user.impersonationLogComment {
+		if onBehalfOf := s.onBehalfOf(req); len(onBehalfOf) > 0 {
+			params.Set("log_comment", onBehalfOf)
+		}
+	}
+
+	// Set forced params of the user, overriding the ones set by the client.
+	if s.user.forcedParams != nil {
+		for _, param := range s.user.forcedParams.params {
+			params.Set(param.Key, param.Value)
+		}
+	}
+
+	// Set query_id as scope_id to have possibility to kill query if needed,
+	// unless the user keeps the query_id of the client.
+	params.Set("query_id", s.queryID())
 	// Set session_timeout an idle timeout for session
 	params.Set("session_timeout", strconv.Itoa(s.sessionTimeout))
 
@@ -438,6 +685,15 @@ func (s *scope) decorateRequest(req *http.Request) (*http.Request, url.Values) {
 	// it is not allowed to use X-ClickHouse HTTP headers and other authentication methods simultaneously
 	req.Header.Del("X-ClickHouse-User")
 	req.Header.Del("X-ClickHouse-Key")
+	// Restrict the encodings requested by the client. The header is used
+	// in the cache key and for re-encoding responses as well.
+	if len(s.user.allowedEncodings) > 0 {
+		req.Header.Set("Accept-Encoding", restrictAcceptEncoding(req.Header.Get("Accept-Encoding"), s.user.allowedEncodings))
+	}
+	// Pass the request id to ClickHouse even if it has been generated,
+	// so the query may be correlated with chproxy logs.
+	// The traceparent header is passed unchanged.
+	req.Header.Set(requestIDHeader, s.requestID)
 
 	// Send request to the chosen host from cluster.
 	req.URL.Scheme = s.host.Scheme()
@@ -445,11 +701,184 @@ func (s *scope) decorateRequest(req *http.Request) (*http.Request, url.Values) {
 
 	// Extend ua with additional info, so it may be queried
 	// via system.query_log.http_user_agent.
-	ua := fmt.Sprintf("RemoteAddr: %s; LocalAddr: %s; CHProxy-User: %s; CHProxy-ClusterUser: %s; %s",
-		s.remoteAddr, s.localAddr, s.user.name, s.clusterUser.name, req.UserAgent())
+	if s.user.userAgentTemplate == nil || !s.setTemplatedUserAgent(req) {
+		ua := fmt.Sprintf("RemoteAddr: %s; LocalAddr: %s; CHProxy-User: %s; CHProxy-ClusterUser: %s; CHProxy-RequestId: %s; %s",
+			s.remoteAddr, s.localAddr, s.user.name, s.clusterUser.name, s.requestID, req.UserAgent())
+		if onBehalfOf := s.onBehalfOf(req); len(onBehalfOf) > 0 {
+			ua += "; on_behalf = " + onBehalfOf
+		}
+		req.Header.Set("User-Agent", ua)
+	}
+
+	// Drop headers not allowed for the user.
+	if len(s.user.allowedRequestHeaders) > 0 {
+		for h := range req.Header {
+			if _, ok := s.user.allowedRequestHeaders[http.CanonicalHeaderKey(h)]; !ok {
+				delete(req.Header, h)
+			}
+		}
+	}
+
+	// Set headers of the user, overriding the ones set by the client.
+	if len(s.user.requestHeaders) > 0 {
+		// The cluster user of wildcarded users carries the original name.
+		name := s.user.name
+		if s.user.isWildcarded {
+			name = s.clusterUser.name
+		}
+		for _, h := range s.user.requestHeaders {
+			req.Header.Set(h.name, strings.ReplaceAll(h.value, config.HeaderUserPlaceholder, name))
+		}
+	}
+
+	return req, origParams, nil
+}
+
+// maxUserAgentSize is the maximum size of User-Agent headers
+// rendered from `user_agent_template`.
+const maxUserAgentSize = 4096
+
+// userAgentData contains variables available in `user_agent_template`.
+type userAgentData struct {
+	RemoteAddr        string
+	User              string
+	ClusterUser       string
+	OriginalUserAgent string
+	ScopeID           string
+	OnBehalfOf        string
+}
+
+func newUserAgentTemplate(text string) (*template.Template, error) {
+	t, err := template.New("user_agent_template").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse `user_agent_template`: %w", err)
+	}
+	// Detect references to unknown variables.
+	if err := t.Execute(io.Discard, userAgentData{}); err != nil {
+		return nil, fmt.Errorf("cannot execute `user_agent_template`: %w", err)
+	}
+	return t, nil
+}
+
+// setTemplatedUserAgent sets the User-Agent header rendered from
+// the user template. No User-Agent is sent if the template renders
+// to an empty string. It returns false if the template cannot be rendered.
+func (s *scope) setTemplatedUserAgent(req *http.Request) bool {
+	var b bytes.Buffer
+	err := s.user.userAgentTemplate.Execute(&b, userAgentData{
+		RemoteAddr:        s.remoteAddr,
+		User:              s.user.name,
+		ClusterUser:       s.clusterUser.name,
+		OriginalUserAgent: req.UserAgent(),
+		ScopeID:           s.id.String(),
+		OnBehalfOf:        s.onBehalfOf(req),
+	})
+	if err != nil {
+		log.Errorf("%s: cannot render `user_agent_template`: %s", s, err)
+		return false
+	}
+
+	ua := strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' {
+			return ' '
+		}
+		return r
+	}, b.String())
+	if len(ua) > maxUserAgentSize {
+		ua = ua[:maxUserAgentSize-len("...")] + "..."
+	}
+	if len(ua) == 0 {
+		// Prevent the transport from sending the default User-Agent.
+		req.Header.Set("User-Agent", "")
+		return true
+	}
 	req.Header.Set("User-Agent", ua)
+	return true
+}
+
+// maxOnBehalfOfSize is the maximum size of names
+// from `allow_impersonation_header`.
+const maxOnBehalfOfSize = 128
+
+// onBehalfOf returns the name of the person the request is sent on behalf of
+// via `allow_impersonation_header`. Chars other than letters, digits
+// and `.-_@+` are replaced with `_`, so the name is safe to pass to ClickHouse.
+// It returns an empty string if the header isn't allowed or isn't set.
+func (s *scope) onBehalfOf(req *http.Request) string {
+	if len(s.user.impersonationHeader) == 0 {
+		return ""
+	}
+	name := strings.TrimSpace(req.Header.Get(s.user.impersonationHeader))
+	if len(name) > maxOnBehalfOfSize {
+		name = name[:maxOnBehalfOfSize]
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case strings.ContainsRune(".-_@+", r):
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// rewriteQuery applies user rewrite rules to the query.
+// The query is taken from the `query` param if it is set,
+// since the request body contains data in this case.
+// Otherwise the query is taken from the request body,
+// where the data of INSERT queries isn't rewritten.
+func (s *scope) rewriteQuery(req *http.Request, params url.Values) error {
+	if len(s.user.rewriteRules) == 0 {
+		return nil
+	}
+
+	if q := params.Get("query"); len(q) > 0 {
+		rq, ok := applyRewriteRules(s.user.rewriteRules, []byte(q))
+		if !ok {
+			return nil
+		}
+		if len(bytes.TrimSpace(rq)) == 0 {
+			return fmt.Errorf("query is empty after applying rewrite rules")
+		}
+		params.Set("query", string(rq))
+		rewrittenQueries.With(prometheus.Labels{"user": s.user.name}).Inc()
+		return nil
+	}
+
+	// external data may not be rewritten
+	if strings.Contains(req.Header.Get("Content-Type"), "multipart/form-data") {
+		return nil
+	}
+
+	// streamed bodies aren't read in memory, so they may not be rewritten
+	if s.streamedBody {
+		return nil
+	}
+
+	q, err := getFullQuery(req)
+	if err != nil {
+		return fmt.Errorf("cannot read query: %w", err)
+	}
+	st, data := splitInsertData(q)
+	rst, ok := applyRewriteRules(s.user.rewriteRules, st)
+	if !ok {
+		// The body is kept intact, including its compression.
+		return nil
+	}
+	if len(bytes.TrimSpace(rst)) == 0 {
+		return fmt.Errorf("query is empty after applying rewrite rules")
+	}
+	rq := make([]byte, 0, len(rst)+len(data))
+	rq = append(append(rq, rst...), data...)
 
-	return req, origParams
+	// The rewritten query is sent uncompressed.
+	req.Header.Del("Content-Encoding")
+	params.Del("decompress")
+	req.Body = io.NopCloser(bytes.NewReader(rq))
+	req.ContentLength = int64(len(rq))
+	rewrittenQueries.With(prometheus.Labels{"user": s.user.name}).Inc()
+	return nil
 }
 
 func (s *scope) decoratePostRequest(req *http.Request, origParams, params url.Values) {
@@ -522,27 +951,93 @@ func newParamsRegistry(params []config.Param) (*paramsRegistry, error) {
 	}, nil
 }
 
+type rewriteRule struct {
+	re      *regexp.Regexp
+	replace []byte
+}
+
+// applyRewriteRules applies rules to q in order.
+// It returns the resulting query and whether it has been modified.
+func applyRewriteRules(rules []rewriteRule, q []byte) ([]byte, bool) {
+	res := q
+	for _, r := range rules {
+		res = r.re.ReplaceAll(res, r.replace)
+	}
+	return res, !bytes.Equal(res, q)
+}
+
+type routingRule struct {
+	// name is the value of the `routing_rule` metrics label.
+	name      string
+	re        *regexp.Regexp
+	toCluster string
+	toUser    string
+}
+
+// matchRoutingRule returns the first routing rule of u matching q.
+// It returns nil if none of the rules match.
+func (u *user) matchRoutingRule(q []byte) *routingRule {
+	for i := range u.routingRules {
+		if u.routingRules[i].re.Match(q) {
+			return &u.routingRules[i]
+		}
+	}
+	return nil
+}
+
 type user struct {
 	name     string
 	password string
 
-	toCluster string
-	toUser    string
+	toCluster       string
+	toUser          string
+	writeCluster    string
+	mirrorToCluster string
+
+	// fallbackCluster receives requests if all the nodes
+	// of the chosen cluster are inactive.
+	fallbackCluster string
+	fallbackToUser  string
 
 	maxConcurrentQueries uint32
 	queryCounter         counter
 
+	// sessions is set if `max_sessions` is set
+	sessions *sessions
+
+	// insertBatcher is set if `insert_batching` is set
+	insertBatcher *insertBatcher
+
 	maxExecutionTime time.Duration
 
+	// slowQueryThreshold is the minimum duration of requests recorded in the slow query log
+	slowQueryThreshold time.Duration
+
 	reqPerMin   int32
 	rateLimiter rateLimiter
 
+	maxExecutionTotal   time.Duration
+	maxBytesTransferred config.ByteSize
+	quota               *quota
+
+	dailyExecutionBudget time.Duration
+	// dailyBudget is set if `daily_execution_budget` is set
+	dailyBudget *dailyBudget
+	// budgetCounter is set if `distributed_daily_budget` is set
+	budgetCounter *distributedBudgetCounter
+
+	// queryDurations is used for Retry-After of requests rejected due to limits
+	queryDurations queryDurations
+
+	maxResponseSize int64
+
 	reqPacketSizeTokenLimiter *rate.Limiter
 	reqPacketSizeTokensBurst  config.ByteSize
 	reqPacketSizeTokensRate   config.ByteSize
 
-	queueCh      chan struct{}
-	maxQueueTime time.Duration
+	queueCh       chan struct{}
+	maxQueueTime  time.Duration
+	queuePriority queuePriority
 
 	allowedNetworks config.Networks
 
@@ -551,78 +1046,541 @@ type user struct {
 	allowCORS    bool
 	isWildcarded bool
 
+	// identities is set for wildcarded users with per-identity limits
+	identities *identityCounters
+
 	cache  *cache.AsyncCache
 	params *paramsRegistry
+
+	// cacheBypassPatterns match normalized queries, which bypass the cache.
+	cacheBypassPatterns []*regexp.Regexp
+
+	// forcedParams override params sent by the client
+	forcedParams *paramsRegistry
+
+	rewriteRules []rewriteRule
+
+	// routingRules route the matching queries to other clusters.
+	routingRules []routingRule
+
+	// allowedStatements and deniedStatements contain upper-cased
+	// statement types. They are empty if statements aren't restricted.
+	allowedStatements map[string]struct{}
+	deniedStatements  map[string]struct{}
+
+	// allowedDatabases is empty if databases aren't restricted.
+	// The first database is used if the request doesn't set one.
+	allowedDatabases    []string
+	checkQueryDatabases bool
+
+	// defaultFormat is empty if the format isn't set for the client.
+	defaultFormat string
+
+	// allowedFormats is empty if formats aren't restricted.
+	allowedFormats []string
+	// allowedDefaultFormats is empty if allowedFormats apply
+	// to `default_format` param too.
+	allowedDefaultFormats []string
+
+	// allowedRequestHeaders contains canonical names of request headers
+	// passed to ClickHouse. It is empty if headers aren't filtered.
+	allowedRequestHeaders map[string]struct{}
+
+	// maxRequestBodySize is zero if request bodies aren't limited.
+	maxRequestBodySize int64
+
+	// maxBufferSize is zero if request bodies are always buffered.
+	maxBufferSize int64
+
+	// userAgentTemplate is nil if the default User-Agent must be sent.
+	userAgentTemplate *template.Template
+
+	responseHeaders []responseHeader
+
+	// requestHeaders are sent to ClickHouse instead of the ones set by the client.
+	requestHeaders []requestHeader
+
+	// responseEncoding is empty if responses are sent as is.
+	responseEncoding string
+
+	// allowedEncodings is empty if Accept-Encoding isn't restricted.
+	allowedEncodings []string
+
+	// impersonationHeader is empty if requests cannot be sent on behalf of others.
+	impersonationHeader     string
+	impersonationLogComment bool
+
+	keepClientQueryID bool
 }
 
-type usersProfile struct {
-	cfg      []config.User
-	clusters map[string]*cluster
-	caches   map[string]*cache.AsyncCache
-	params   map[string]*paramsRegistry
+func (u *user) errRequestBodyTooLarge() error {
+	return fmt.Errorf("user %q: request body exceeds max_request_body_size limit: %d", u.name, u.maxRequestBodySize)
 }
 
-func (up usersProfile) newUsers() (map[string]*user, error) {
-	users := make(map[string]*user, len(up.cfg))
-	for _, u := range up.cfg {
-		if _, ok := users[u.Name]; ok {
-			return nil, fmt.Errorf("duplicate config for user %q", u.Name)
+// checkStreamedBody returns an error if q is the buffered prefix of a streamed
+// request body whose statement cannot be fully checked against the user's
+// statement, database and format restrictions. Only INSERT statements
+// followed by the beginning of their data may be streamed for such users.
+func (u *user) checkStreamedBody(q []byte) error {
+	if len(u.allowedStatements) == 0 && len(u.deniedStatements) == 0 &&
+		len(u.allowedDatabases) == 0 && len(u.allowedFormats) == 0 && len(u.allowedDefaultFormats) == 0 {
+		return nil
+	}
+	if !hasInsertData(q) {
+		return fmt.Errorf("user %q: the statement of a request body exceeding max_buffer_size limit %d cannot be checked", u.name, u.maxBufferSize)
+	}
+	return nil
+}
+
+// checkStatements returns an error if q contains statements
+// the user isn't allowed to run.
+func (u *user) checkStatements(q []byte) error {
+	if len(u.allowedStatements) == 0 && len(u.deniedStatements) == 0 {
+		return nil
+	}
+	for _, st := range queryStatements(q) {
+		_, allowed := u.allowedStatements[st]
+		_, denied := u.deniedStatements[st]
+		if denied || (len(u.allowedStatements) > 0 && !allowed) {
+			if len(st) == 0 {
+				st = "unknown"
+			}
+			return fmt.Errorf("user %q is not allowed to run %s statements", u.name, st)
 		}
-		tmpU, err := up.newUser(u)
-		if err != nil {
-			return nil, fmt.Errorf("cannot initialize user %q: %w", u.Name, err)
+	}
+	return nil
+}
+
+// checkDatabases returns an error if req or q refer to databases
+// the user isn't allowed to access.
+func (u *user) checkDatabases(req *http.Request, q []byte) error {
+	if len(u.allowedDatabases) == 0 {
+		return nil
+	}
+	if db := requestDatabase(req); len(db) > 0 && !u.isDatabaseAllowed(db) {
+		return fmt.Errorf("user %q is not allowed to access database %q", u.name, db)
+	}
+	if !u.checkQueryDatabases {
+		return nil
+	}
+	for _, db := range queryDatabases(q) {
+		if !u.isDatabaseAllowed(db) {
+			return fmt.Errorf("user %q is not allowed to access database %q", u.name, db)
 		}
-		users[u.Name] = tmpU
 	}
-	return users, nil
+	return nil
 }
 
-func (up usersProfile) newUser(u config.User) (*user, error) {
-	c, ok := up.clusters[u.ToCluster]
-	if !ok {
-		return nil, fmt.Errorf("unknown `to_cluster` %q", u.ToCluster)
+// defaultResultFormat is the format of query results
+// if neither the client nor the user sets one.
+const defaultResultFormat = "TabSeparated"
+
+// checkFormats returns an error if req or q request result formats
+// the user isn't allowed to use.
+func (u *user) checkFormats(req *http.Request, q []byte) error {
+	if len(u.allowedFormats) == 0 && len(u.allowedDefaultFormats) == 0 {
+		return nil
 	}
-	var cu *clusterUser
-	if cu, ok = c.users[u.ToUser]; !ok {
-		return nil, fmt.Errorf("unknown `to_user` %q in cluster %q", u.ToUser, u.ToCluster)
-	} else if u.IsWildcarded {
-		// a wildcarded user is mapped to this cluster user
-		// used to check if a proper user to send heartbeat exists
-		cu.isWildcarded = true
+	if mainStatement(q) == "INSERT" {
+		// The FORMAT clause of INSERT queries sets the format of the inserted data.
+		return nil
+	}
+	queryFmt := queryFormat(q)
+	if len(queryFmt) > 0 && !u.isFormatAllowed(queryFmt) {
+		return fmt.Errorf("user %q is not allowed to use format %q", u.name, queryFmt)
+	}
+	requestFmt := requestFormat(req)
+	if len(requestFmt) > 0 && !u.isDefaultFormatAllowed(requestFmt) {
+		return fmt.Errorf("user %q is not allowed to use format %q", u.name, requestFmt)
 	}
+	if len(queryFmt) > 0 || len(requestFmt) > 0 {
+		return nil
+	}
+	if len(u.defaultFormat) == 0 && !u.isFormatAllowed(defaultResultFormat) {
+		return fmt.Errorf("user %q is not allowed to use format %q", u.name, defaultResultFormat)
+	}
+	return nil
+}
 
-	var queueCh chan struct{}
-	if u.MaxQueueSize > 0 {
-		queueCh = make(chan struct{}, u.MaxQueueSize)
+// Format names are compared case-insensitively, so the restrictions
+// cannot be bypassed by the names ClickHouse resolves case-insensitively.
+func (u *user) isFormatAllowed(format string) bool {
+	return len(u.allowedFormats) == 0 || containsFold(u.allowedFormats, format)
+}
+
+// isDefaultFormatAllowed returns true if the user may request the format
+// via the `default_format` param or the X-ClickHouse-Format header.
+func (u *user) isDefaultFormatAllowed(format string) bool {
+	if len(u.allowedDefaultFormats) > 0 {
+		return containsFold(u.allowedDefaultFormats, format)
 	}
+	return u.isFormatAllowed(format)
+}
 
-	var cc *cache.AsyncCache
-	if len(u.Cache) > 0 {
-		cc = up.caches[u.Cache]
-		if cc == nil {
-			return nil, fmt.Errorf("unknown `cache` %q", u.Cache)
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(s, v) {
+			return true
 		}
 	}
+	return false
+}
 
-	var params *paramsRegistry
-	if len(u.Params) > 0 {
-		params = up.params[u.Params]
-		if params == nil {
-			return nil, fmt.Errorf("unknown `params` %q", u.Params)
+// requestFormat returns the result format set by the client,
+// either via the `default_format` param or via the X-ClickHouse-Format header.
+func requestFormat(req *http.Request) string {
+	if f := req.URL.Query().Get("default_format"); len(f) > 0 {
+		return f
+	}
+	return req.Header.Get("X-ClickHouse-Format")
+}
+
+func (u *user) isDatabaseAllowed(db string) bool {
+	for _, allowed := range u.allowedDatabases {
+		if db == allowed {
+			return true
 		}
 	}
+	return false
+}
 
-	return &user{
-		name:                      u.Name,
-		password:                  u.Password,
-		toCluster:                 u.ToCluster,
-		toUser:                    u.ToUser,
-		maxConcurrentQueries:      u.MaxConcurrentQueries,
-		maxExecutionTime:          time.Duration(u.MaxExecutionTime),
-		reqPerMin:                 u.ReqPerMin,
-		queueCh:                   queueCh,
-		maxQueueTime:              time.Duration(u.MaxQueueTime),
-		reqPacketSizeTokenLimiter: rate.NewLimiter(rate.Limit(u.ReqPacketSizeTokensRate), int(u.ReqPacketSizeTokensBurst)),
+// requestDatabase returns the database set by the client,
+// either via the `database` param or via the X-ClickHouse-Database header.
+func requestDatabase(req *http.Request) string {
+	if db := req.URL.Query().Get("database"); len(db) > 0 {
+		return db
+	}
+	return req.Header.Get("X-ClickHouse-Database")
+}
+
+// restrictAcceptEncoding returns the encodings of the acceptEncoding header
+// which are allowed, or the first allowed encoding if there are none.
+// Encodings explicitly rejected via `q=0` are dropped.
+func restrictAcceptEncoding(acceptEncoding string, allowed []string) string {
+	var encodings []string
+	for _, e := range strings.Split(sortHeader(acceptEncoding), ",") {
+		name, params, _ := strings.Cut(e, ";")
+		name = strings.TrimSpace(name)
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		for _, a := range allowed {
+			if strings.EqualFold(name, a) {
+				encodings = append(encodings, e)
+				break
+			}
+		}
+	}
+	if len(encodings) == 0 {
+		return allowed[0]
+	}
+	return strings.Join(encodings, ",")
+}
+
+// preservedRequestHeaders are passed to ClickHouse
+// regardless of `allowed_request_headers`.
+var preservedRequestHeaders = []string{
+	"Content-Type", "Content-Encoding", "Accept-Encoding", "User-Agent",
+	// Set by chproxy itself.
+	"Authorization", requestIDHeader,
+}
+
+func newHeaderSet(headers []string) map[string]struct{} {
+	if len(headers) == 0 {
+		return nil
+	}
+	set := make(map[string]struct{}, len(headers)+len(preservedRequestHeaders))
+	for _, h := range preservedRequestHeaders {
+		set[http.CanonicalHeaderKey(h)] = struct{}{}
+	}
+	for _, h := range headers {
+		set[http.CanonicalHeaderKey(strings.TrimSpace(h))] = struct{}{}
+	}
+	return set
+}
+
+// responseHeader is a header added to responses of the user.
+type responseHeader struct {
+	name  string
+	value string
+	// override is set if the header must replace the one sent by ClickHouse
+	override bool
+}
+
+func newResponseHeaders(cfg map[string]config.ResponseHeader) []responseHeader {
+	if len(cfg) == 0 {
+		return nil
+	}
+	headers := make([]responseHeader, 0, len(cfg))
+	for name, h := range cfg {
+		headers = append(headers, responseHeader{
+			name:     http.CanonicalHeaderKey(name),
+			value:    h.Value,
+			override: h.Override,
+		})
+	}
+	sort.Slice(headers, func(i, j int) bool { return headers[i].name < headers[j].name })
+	return headers
+}
+
+// setResponseHeaders sets headers in h.
+// Headers already present in h are kept unless they must be overridden.
+func setResponseHeaders(h http.Header, headers []responseHeader) {
+	for _, rh := range headers {
+		if rh.override || len(h.Values(rh.name)) == 0 {
+			h.Set(rh.name, rh.value)
+		}
+	}
+}
+
+// requestHeader is a header sent to ClickHouse for requests of the user.
+type requestHeader struct {
+	name  string
+	value string
+}
+
+func newRequestHeaders(cfg map[string]string) []requestHeader {
+	if len(cfg) == 0 {
+		return nil
+	}
+	headers := make([]requestHeader, 0, len(cfg))
+	for name, value := range cfg {
+		headers = append(headers, requestHeader{
+			name:  http.CanonicalHeaderKey(name),
+			value: value,
+		})
+	}
+	sort.Slice(headers, func(i, j int) bool { return headers[i].name < headers[j].name })
+	return headers
+}
+
+func newStatementSet(statements []string) map[string]struct{} {
+	if len(statements) == 0 {
+		return nil
+	}
+	set := make(map[string]struct{}, len(statements))
+	for _, st := range statements {
+		set[strings.ToUpper(st)] = struct{}{}
+	}
+	return set
+}
+
+type usersProfile struct {
+	cfg      []config.User
+	clusters map[string]*cluster
+	caches   map[string]*cache.AsyncCache
+	params   map[string]*paramsRegistry
+
+	// maxRequestBodySize is used for users without `max_request_body_size`.
+	maxRequestBodySize config.ByteSize
+}
+
+// newUsers returns the users initialized from up.cfg.
+// The errors of all the users are returned along with the users
+// initialized successfully.
+func (up usersProfile) newUsers() (map[string]*user, error) {
+	users := make(map[string]*user, len(up.cfg))
+	var errs []error
+	for _, u := range up.cfg {
+		if _, ok := users[u.Name]; ok {
+			errs = append(errs, fmt.Errorf("duplicate config for user %q", u.Name))
+			continue
+		}
+		tmpU, err := up.newUser(u)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cannot initialize user %q: %w", u.Name, err))
+			continue
+		}
+		users[u.Name] = tmpU
+	}
+	return users, errors.Join(errs...)
+}
+
+func (up usersProfile) newUser(u config.User) (*user, error) {
+	c, ok := up.clusters[u.ToCluster]
+	if !ok {
+		return nil, fmt.Errorf("unknown `to_cluster` %q", u.ToCluster)
+	}
+	var cu *clusterUser
+	if cu, ok = c.users[u.ToUser]; !ok {
+		return nil, fmt.Errorf("unknown `to_user` %q in cluster %q", u.ToUser, u.ToCluster)
+	} else if u.IsWildcarded {
+		// a wildcarded user is mapped to this cluster user
+		// used to check if a proper user to send heartbeat exists
+		cu.isWildcarded = true
+	}
+
+	if len(u.WriteCluster) > 0 {
+		wc, ok := up.clusters[u.WriteCluster]
+		if !ok {
+			return nil, fmt.Errorf("unknown `write_cluster` %q", u.WriteCluster)
+		}
+		wcu, ok := wc.users[u.ToUser]
+		if !ok {
+			return nil, fmt.Errorf("unknown `to_user` %q in cluster %q", u.ToUser, u.WriteCluster)
+		}
+		if u.IsWildcarded {
+			wcu.isWildcarded = true
+		}
+	}
+
+	maxRequestBodySize := up.maxRequestBodySize
+	if u.MaxRequestBodySize != nil {
+		maxRequestBodySize = *u.MaxRequestBodySize
+	}
+
+	var queueCh chan struct{}
+	if u.MaxQueueSize > 0 {
+		queueCh = make(chan struct{}, u.MaxQueueSize)
+	}
+
+	var cc *cache.AsyncCache
+	if len(u.Cache) > 0 {
+		cc = up.caches[u.Cache]
+		if cc == nil {
+			return nil, fmt.Errorf("unknown `cache` %q", u.Cache)
+		}
+	}
+
+	var params *paramsRegistry
+	if len(u.Params) > 0 {
+		params = up.params[u.Params]
+		if params == nil {
+			return nil, fmt.Errorf("unknown `params` %q", u.Params)
+		}
+	}
+
+	var forcedParams *paramsRegistry
+	if len(u.ForcedParams) > 0 {
+		forcedParams = up.params[u.ForcedParams]
+		if forcedParams == nil {
+			return nil, fmt.Errorf("unknown `forced_params` %q", u.ForcedParams)
+		}
+	}
+
+	fallbackToUser := u.FallbackToUser
+	if len(fallbackToUser) == 0 {
+		fallbackToUser = u.ToUser
+	}
+	if len(u.FallbackCluster) > 0 {
+		fc, ok := up.clusters[u.FallbackCluster]
+		if !ok {
+			return nil, fmt.Errorf("unknown `fallback_cluster` %q", u.FallbackCluster)
+		}
+		fcu, ok := fc.users[fallbackToUser]
+		if !ok {
+			return nil, fmt.Errorf("unknown `fallback_to_user` %q in cluster %q", fallbackToUser, u.FallbackCluster)
+		}
+		if u.IsWildcarded {
+			fcu.isWildcarded = true
+		}
+	}
+
+	if len(u.MirrorToCluster) > 0 {
+		if _, ok := up.clusters[u.MirrorToCluster]; !ok {
+			return nil, fmt.Errorf("unknown `mirror_to_cluster` %q", u.MirrorToCluster)
+		}
+	}
+
+	var identities *identityCounters
+	if u.PerIdentityLimits {
+		identities = newIdentityCounters(maxIdentities)
+	}
+
+	var rl rateLimiter
+	if u.DistributedRateLimit && cc != nil {
+		// The client is missing for caches which aren't initialized,
+		// e.g. during config validation.
+		if client := cc.RedisClient(); client != nil {
+			rl.shared = &distributedRateCounter{
+				client: client,
+				user:   u.Name,
+			}
+		}
+	}
+
+	var db *dailyBudget
+	var bc *distributedBudgetCounter
+	if u.DailyExecutionBudget > 0 {
+		db = newDailyBudget(u.Name, time.Duration(u.DailyExecutionBudget), time.Now())
+		if u.DistributedDailyBudget && cc != nil {
+			if client := cc.RedisClient(); client != nil {
+				bc = &distributedBudgetCounter{
+					client: client,
+					user:   u.Name,
+				}
+			}
+		}
+	}
+
+	rewriteRules := make([]rewriteRule, 0, len(u.RewriteRules))
+	for _, r := range u.RewriteRules {
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			return nil, fmt.Errorf("cannot compile rewrite rule %q: %w", r.Match, err)
+		}
+		rewriteRules = append(rewriteRules, rewriteRule{
+			re:      re,
+			replace: []byte(r.Replace),
+		})
+	}
+
+	var cacheBypassPatterns []*regexp.Regexp
+	for _, p := range u.CacheBypassPatterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("cannot compile cache bypass pattern %q: %w", p, err)
+		}
+		cacheBypassPatterns = append(cacheBypassPatterns, re)
+	}
+
+	routingRules := make([]routingRule, 0, len(u.RoutingRules))
+	for i, r := range u.RoutingRules {
+		rr, err := up.newRoutingRule(u, i, r)
+		if err != nil {
+			return nil, err
+		}
+		routingRules = append(routingRules, rr)
+	}
+
+	var userAgentTemplate *template.Template
+	if u.UserAgentTemplate != nil {
+		t, err := newUserAgentTemplate(*u.UserAgentTemplate)
+		if err != nil {
+			return nil, err
+		}
+		userAgentTemplate = t
+	}
+
+	return &user{
+		name:                      u.Name,
+		password:                  u.Password,
+		toCluster:                 u.ToCluster,
+		toUser:                    u.ToUser,
+		writeCluster:              u.WriteCluster,
+		mirrorToCluster:           u.MirrorToCluster,
+		fallbackCluster:           u.FallbackCluster,
+		fallbackToUser:            fallbackToUser,
+		maxConcurrentQueries:      u.MaxConcurrentQueries,
+		sessions:                  newSessions(u.MaxSessions, u.Name),
+		insertBatcher:             newInsertBatcher(u.InsertBatching),
+		maxExecutionTime:          time.Duration(u.MaxExecutionTime),
+		slowQueryThreshold:        time.Duration(u.SlowQueryThreshold),
+		reqPerMin:                 u.ReqPerMin,
+		rateLimiter:               rl,
+		maxExecutionTotal:         time.Duration(u.MaxExecutionTotalPerHour),
+		maxBytesTransferred:       u.MaxBytesTransferredPerHour,
+		maxResponseSize:           int64(u.MaxResponseSize),
+		quota:                     newQuota(u.Name, time.Now()),
+		dailyExecutionBudget:      time.Duration(u.DailyExecutionBudget),
+		dailyBudget:               db,
+		budgetCounter:             bc,
+		queueCh:                   queueCh,
+		maxQueueTime:              time.Duration(u.MaxQueueTime),
+		queuePriority:             newQueuePriority(u.QueuePriority),
+		reqPacketSizeTokenLimiter: rate.NewLimiter(rate.Limit(u.ReqPacketSizeTokensRate), int(u.ReqPacketSizeTokensBurst)),
 		reqPacketSizeTokensBurst:  u.ReqPacketSizeTokensBurst,
 		reqPacketSizeTokensRate:   u.ReqPacketSizeTokensRate,
 		allowedNetworks:           u.AllowedNetworks,
@@ -630,8 +1588,65 @@ func (up usersProfile) newUser(u config.User) (*user, error) {
 		denyHTTPS:                 u.DenyHTTPS,
 		allowCORS:                 u.AllowCORS,
 		isWildcarded:              u.IsWildcarded,
+		identities:                identities,
 		cache:                     cc,
+		cacheBypassPatterns:       cacheBypassPatterns,
 		params:                    params,
+		forcedParams:              forcedParams,
+		rewriteRules:              rewriteRules,
+		routingRules:              routingRules,
+		allowedStatements:         newStatementSet(u.AllowedStatements),
+		deniedStatements:          newStatementSet(u.DeniedStatements),
+		allowedDatabases:          u.AllowedDatabases,
+		checkQueryDatabases:       u.CheckQueryDatabases,
+		defaultFormat:             u.DefaultFormat,
+		allowedFormats:            u.AllowedFormats,
+		allowedDefaultFormats:     u.AllowedDefaultFormats,
+		allowedRequestHeaders:     newHeaderSet(u.AllowedRequestHeaders),
+		maxRequestBodySize:        int64(maxRequestBodySize),
+		maxBufferSize:             int64(u.MaxBufferSize),
+		responseHeaders:           newResponseHeaders(u.ResponseHeaders),
+		requestHeaders:            newRequestHeaders(u.Headers),
+		userAgentTemplate:         userAgentTemplate,
+		responseEncoding:          responseEncoding(u.ResponseCompression),
+		allowedEncodings:          u.AllowedEncodings,
+		impersonationHeader:       u.AllowImpersonationHeader,
+		impersonationLogComment:   u.ImpersonationLogComment,
+		keepClientQueryID:         u.KeepClientQueryID,
+	}, nil
+}
+
+// newRoutingRule returns the i-th routing rule r of u.
+// The cluster and the cluster user of the rule must exist.
+func (up usersProfile) newRoutingRule(u config.User, i int, r config.RoutingRule) (routingRule, error) {
+	re, err := regexp.Compile(r.Match)
+	if err != nil {
+		return routingRule{}, fmt.Errorf("cannot compile routing rule %q: %w", r.Match, err)
+	}
+	toUser := r.ToUser
+	if len(toUser) == 0 {
+		toUser = u.ToUser
+	}
+	c, ok := up.clusters[r.ToCluster]
+	if !ok {
+		return routingRule{}, fmt.Errorf("unknown `to_cluster` %q in routing rule %q", r.ToCluster, r.Match)
+	}
+	cu, ok := c.users[toUser]
+	if !ok {
+		return routingRule{}, fmt.Errorf("unknown `to_user` %q in cluster %q of routing rule %q", toUser, r.ToCluster, r.Match)
+	}
+	if u.IsWildcarded {
+		cu.isWildcarded = true
+	}
+	name := r.Name
+	if len(name) == 0 {
+		name = strconv.Itoa(i)
+	}
+	return routingRule{
+		name:      name,
+		re:        re,
+		toCluster: r.ToCluster,
+		toUser:    toUser,
 	}, nil
 }
 
@@ -642,6 +1657,9 @@ type clusterUser struct {
 	maxConcurrentQueries uint32
 	queryCounter         counter
 
+	// sessions is set if `max_sessions` is set
+	sessions *sessions
+
 	maxExecutionTime time.Duration
 
 	reqPerMin   int32
@@ -684,6 +1702,7 @@ func newClusterUser(cu config.ClusterUser) *clusterUser {
 		name:                      cu.Name,
 		password:                  cu.Password,
 		maxConcurrentQueries:      cu.MaxConcurrentQueries,
+		sessions:                  newSessions(cu.MaxSessions, ""),
 		maxExecutionTime:          time.Duration(cu.MaxExecutionTime),
 		reqPerMin:                 cu.ReqPerMin,
 		reqPacketSizeTokenLimiter: rate.NewLimiter(rate.Limit(cu.ReqPacketSizeTokensRate), int(cu.ReqPacketSizeTokensBurst)),
@@ -700,57 +1719,259 @@ type replica struct {
 
 	name string
 
+	// heartBeat checks the health of the replica hosts.
+	heartBeat heartbeat.HeartBeat
+
+	// maxHealthyLatency is the heartbeat latency
+	// the health score of the hosts is normalised over.
+	maxHealthyLatency time.Duration
+
+	// hostsLock protects hosts, which may be modified via the admin API.
+	// hosts are replaced on modification, so the slices returned
+	// by getHosts remain valid.
+	hostsLock   sync.RWMutex
 	hosts       []*topology.Node
 	nextHostIdx uint32
+
+	// hostSchedule contains indexes of hosts in the order getHost
+	// starts scanning hosts from, so hosts with higher weights
+	// are picked proportionally more often.
+	// It is empty if all the hosts have the same weight.
+	hostSchedule []int
+
+	// weight is the `weight` of the replica. Zero means 1.
+	weight uint32
 }
 
-func newReplicas(replicasCfg []config.Replica, nodes []string, scheme string, c *cluster) ([]*replica, error) {
+// newReplicas initializes the cluster replicas.
+// Heartbeats of the replicas are created from hb or from the replica overrides.
+func newReplicas(replicasCfg []config.Replica, nodes []string, nodeWeights map[string]uint32, scheme string, hb config.HeartBeat, hbOpts []heartbeat.Option, c *cluster) ([]*replica, error) {
 	if len(nodes) > 0 {
 		// No replicas, just flat nodes. Create default replica
 		// containing all the nodes.
-		r := &replica{
-			cluster: c,
-			name:    "default",
-		}
-		hosts, err := newNodes(nodes, scheme, r)
+		r := newReplica("default", hb, hbOpts, c)
+		hosts, err := newNodes(nodes, nodeWeights, scheme, r)
 		if err != nil {
 			return nil, err
 		}
-		r.hosts = hosts
+		r.setHosts(hosts)
 		return []*replica{r}, nil
 	}
 
 	replicas := make([]*replica, len(replicasCfg))
 	for i, rCfg := range replicasCfg {
-		r := &replica{
-			cluster: c,
-			name:    rCfg.Name,
+		rHB := hb
+		if rCfg.HeartBeat != nil {
+			rHB = *rCfg.HeartBeat
 		}
-		hosts, err := newNodes(rCfg.Nodes, scheme, r)
+		r := newReplica(rCfg.Name, rHB, hbOpts, c)
+		r.weight = rCfg.Weight
+		hosts, err := newNodes(rCfg.Nodes, nil, scheme, r)
 		if err != nil {
 			return nil, fmt.Errorf("cannot initialize replica %q: %w", rCfg.Name, err)
 		}
-		r.hosts = hosts
+		r.setHosts(hosts)
 		replicas[i] = r
 	}
 	return replicas, nil
 }
 
-func newNodes(nodes []string, scheme string, r *replica) ([]*topology.Node, error) {
+func newReplica(name string, hb config.HeartBeat, hbOpts []heartbeat.Option, c *cluster) *replica {
+	maxHealthyLatency := time.Duration(hb.MaxHealthyLatency)
+	if maxHealthyLatency <= 0 {
+		maxHealthyLatency = time.Duration(hb.Timeout)
+	}
+	return &replica{
+		cluster:           c,
+		name:              name,
+		heartBeat:         heartbeat.NewHeartbeat(hb, hbOpts...),
+		maxHealthyLatency: maxHealthyLatency,
+	}
+}
+
+// newNodes initializes the nodes of the replica. Nodes missing in weights have weight 1.
+func newNodes(nodes []string, weights map[string]uint32, scheme string, r *replica) ([]*topology.Node, error) {
 	hosts := make([]*topology.Node, len(nodes))
 	for i, node := range nodes {
 		addr, err := url.Parse(fmt.Sprintf("%s://%s", scheme, node))
 		if err != nil {
 			return nil, fmt.Errorf("cannot parse `node` %q with `scheme` %q: %w", node, scheme, err)
 		}
-		hosts[i] = topology.NewNode(addr, r.cluster.heartBeat, r.cluster.name, r.name)
+		hosts[i] = topology.NewNode(addr, r.heartBeat, r.cluster.name, r.name,
+			topology.WithMaxHealthyLatency(r.maxHealthyLatency),
+			topology.WithHeartbeatSemaphore(r.cluster.heartbeatSem),
+			topology.WithPenalty(r.cluster.penaltySize, r.cluster.penaltyDuration),
+			topology.WithWeight(weights[node]))
 	}
 	return hosts, nil
 }
 
+// getHosts returns the current hosts of the replica.
+func (r *replica) getHosts() []*topology.Node {
+	r.hostsLock.RLock()
+	defer r.hostsLock.RUnlock()
+	return r.hosts
+}
+
+// getHostsWithSchedule returns the current hosts of the replica
+// along with their schedule. See replica.hostSchedule.
+func (r *replica) getHostsWithSchedule() ([]*topology.Node, []int) {
+	r.hostsLock.RLock()
+	defer r.hostsLock.RUnlock()
+	return r.hosts, r.hostSchedule
+}
+
+// setHosts replaces the hosts of the replica.
+// r.hostsLock must be held if the replica is in use.
+func (r *replica) setHosts(hosts []*topology.Node) {
+	weights := make([]uint32, len(hosts))
+	for i, h := range hosts {
+		weights[i] = h.Weight()
+	}
+	r.hosts = hosts
+	r.hostSchedule = newWeightedSchedule(weights)
+}
+
+// updateHostWeightMetric reports the effective weight of h.
+func (r *replica) updateHostWeightMetric(h *topology.Node) {
+	hostWeight.With(prometheus.Labels{
+		"cluster":      r.cluster.name,
+		"replica":      r.name,
+		"cluster_node": h.Host(),
+	}).Set(float64(r.getWeight() * h.Weight()))
+}
+
+// getWeight returns the weight of the replica. It is at least 1.
+func (r *replica) getWeight() uint32 {
+	if r.weight == 0 {
+		return 1
+	}
+	return r.weight
+}
+
+// newWeightedSchedule returns the sequence of indexes of weights, where every
+// index appears as many times as its weight. Indexes are interleaved
+// via the smooth weighted round-robin, so the heavy items don't get
+// bursts of queries.
+//
+// Returns nil if all the weights are equal, so items are picked in turn.
+func newWeightedSchedule(weights []uint32) []int {
+	equal := true
+	var total int64
+	for _, w := range weights {
+		equal = equal && w == weights[0]
+		total += int64(w)
+	}
+	if equal {
+		return nil
+	}
+	schedule := make([]int, 0, total)
+	current := make([]int64, len(weights))
+	for len(schedule) < cap(schedule) {
+		best := 0
+		for i, w := range weights {
+			current[i] += int64(w)
+			if current[i] > current[best] {
+				best = i
+			}
+		}
+		current[best] -= total
+		schedule = append(schedule, best)
+	}
+	return schedule
+}
+
+// addHost adds h to the replica.
+// It returns an error if the replica already contains a host with the same address.
+func (r *replica) addHost(h *topology.Node) error {
+	r.hostsLock.Lock()
+	defer r.hostsLock.Unlock()
+	for _, tmpH := range r.hosts {
+		if tmpH.Host() == h.Host() {
+			return fmt.Errorf("node %q already exists in replica %q", h.Host(), r.name)
+		}
+	}
+	hosts := make([]*topology.Node, 0, len(r.hosts)+1)
+	hosts = append(hosts, r.hosts...)
+	r.setHosts(append(hosts, h))
+	return nil
+}
+
+// retireHost retires the host with the given address, so it stops
+// receiving queries before it is removed via removeHost.
+// It returns nil if the replica doesn't contain such a host.
+//
+// The last host of the replica which isn't retired cannot be retired.
+func (r *replica) retireHost(addr string) (*topology.Node, error) {
+	r.hostsLock.Lock()
+	defer r.hostsLock.Unlock()
+	var h *topology.Node
+	remaining := 0
+	for _, tmpH := range r.hosts {
+		switch {
+		case tmpH.Host() == addr:
+			h = tmpH
+		case !tmpH.IsRetired():
+			remaining++
+		}
+	}
+	if h == nil {
+		return nil, nil
+	}
+	if h.IsRetired() {
+		return nil, fmt.Errorf("node %q of replica %q is already being removed", addr, r.name)
+	}
+	if remaining == 0 {
+		return nil, fmt.Errorf("cannot remove the last node %q of replica %q", addr, r.name)
+	}
+	h.Retire()
+	return h, nil
+}
+
+// removeHost removes the host with the given address from the replica.
+func (r *replica) removeHost(addr string) error {
+	r.hostsLock.Lock()
+	defer r.hostsLock.Unlock()
+	hosts := make([]*topology.Node, 0, len(r.hosts))
+	for _, h := range r.hosts {
+		if h.Host() != addr {
+			hosts = append(hosts, h)
+		}
+	}
+	if len(hosts) == len(r.hosts) {
+		return fmt.Errorf("node %q doesn't exist in replica %q", addr, r.name)
+	}
+	r.setHosts(hosts)
+	return nil
+}
+
+// isActive returns true if at least a single host of the cluster is active.
+func (c *cluster) isActive() bool {
+	for _, r := range c.replicas {
+		if r.isActive() {
+			return true
+		}
+	}
+	return false
+}
+
+// isDown returns true if all the hosts of the cluster are known to be inactive.
+// Hosts waiting for their first heartbeat, e.g. after config reload,
+// aren't considered down.
+func (c *cluster) isDown() bool {
+	for _, r := range c.replicas {
+		for _, h := range r.getHosts() {
+			if h.IsActive() || (!h.IsStateKnown() && !h.IsRetired()) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 func (r *replica) isActive() bool {
 	// The replica is active if at least a single host is active.
-	for _, h := range r.hosts {
+	for _, h := range r.getHosts() {
 		if h.IsActive() {
 			return true
 		}
@@ -758,9 +1979,20 @@ func (r *replica) isActive() bool {
 	return false
 }
 
+// isFull returns true if every host of the replica
+// runs max_concurrent_queries_per_node queries.
+func (r *replica) isFull() bool {
+	for _, h := range r.getHosts() {
+		if !r.cluster.isNodeFull(h) {
+			return false
+		}
+	}
+	return true
+}
+
 func (r *replica) load() uint32 {
 	var reqs uint32
-	for _, h := range r.hosts {
+	for _, h := range r.getHosts() {
 		reqs += h.CurrentLoad()
 	}
 	return reqs
@@ -769,20 +2001,100 @@ func (r *replica) load() uint32 {
 type cluster struct {
 	name string
 
+	// scheme is used for nodes added via the admin API.
+	// It is changed along with the scheme of the nodes via the admin API.
+	scheme string
+
+	// fixedScheme is set if the transport of the cluster supports
+	// only its configured scheme, i.e. for `http2` and `h2c` clusters.
+	fixedScheme bool
+
 	replicas       []*replica
 	nextReplicaIdx uint32
 
+	// replicaSchedule contains indexes of replicas in the order getReplica
+	// starts scanning replicas from. See replica.hostSchedule.
+	replicaSchedule []int
+
 	users map[string]*clusterUser
 
 	killQueryUserName     string
 	killQueryUserPassword string
 
-	heartBeat heartbeat.HeartBeat
-
 	retryNumber int
+
+	// retryDelay is the delay before the first retry of failed queries.
+	// It is multiplied by retryBackoffMultiplier after every retry
+	// and is capped by maxRetryDelay if it is set.
+	retryDelay             time.Duration
+	retryBackoffMultiplier float64
+	maxRetryDelay          time.Duration
+
+	// transport is used for requests to the cluster nodes.
+	// http.DefaultTransport is used if it is nil.
+	transport http.RoundTripper
+
+	killQueryTimeout time.Duration
+	killQueryRetries int
+
+	// killQueryTemplate is the statement killing timed out queries
+	// with config.KillQueryIDPlaceholder substituted by the query id.
+	killQueryTemplate string
+
+	// queue tracks requests waiting for a free slot in the cluster
+	queue priorityQueue
+
+	// maxConcurrentQueriesPerNode is the maximum number of queries
+	// running on every node. Zero means no limits.
+	maxConcurrentQueriesPerNode uint32
+
+	// consistentHash is true if hosts for requests without session_id
+	// are chosen by the hash of the query.
+	consistentHash bool
+
+	// heartbeatSem limits the number of simultaneous heartbeats
+	// against the cluster nodes. It is nil if heartbeats aren't limited.
+	heartbeatSem chan struct{}
+
+	// penaltySize and penaltyDuration configure penalties of the nodes
+	// on failed queries. Zero values keep the defaults of topology.Node.
+	penaltySize     uint32
+	penaltyDuration time.Duration
+
+	// segmentRouting is true if replicas are chosen in round-robin order
+	// instead of the least loaded replica. See getReplicaRoundRobin.
+	segmentRouting bool
+}
+
+// retryBackoff returns the delay before the retry with the given number,
+// which starts from 0.
+func (c *cluster) retryBackoff(numRetry int) time.Duration {
+	if c.retryDelay <= 0 {
+		return 0
+	}
+	d := float64(c.retryDelay) * math.Pow(c.retryBackoffMultiplier, float64(numRetry))
+	if c.maxRetryDelay > 0 && d > float64(c.maxRetryDelay) {
+		return c.maxRetryDelay
+	}
+	if d >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(d)
+}
+
+// newKillQueryTemplate returns the statement killing timed out queries on the cluster.
+func newKillQueryTemplate(c config.Cluster) string {
+	switch {
+	case len(c.KillQueryTemplate) > 0:
+		return c.KillQueryTemplate
+	case len(c.KillQueryOnCluster) > 0:
+		return fmt.Sprintf("KILL QUERY ON CLUSTER `%s` WHERE query_id = '%s'", c.KillQueryOnCluster, config.KillQueryIDPlaceholder)
+	default:
+		return fmt.Sprintf("KILL QUERY WHERE query_id = '%s'", config.KillQueryIDPlaceholder)
+	}
 }
 
-func newCluster(c config.Cluster) (*cluster, error) {
+func newCluster(c config.Cluster, transport http.RoundTripper) (*cluster, error) {
 	clusterUsers := make(map[string]*clusterUser, len(c.ClusterUsers))
 	for _, cu := range c.ClusterUsers {
 		if _, ok := clusterUsers[cu.Name]; ok {
@@ -791,42 +2103,94 @@ func newCluster(c config.Cluster) (*cluster, error) {
 		clusterUsers[cu.Name] = newClusterUser(cu)
 	}
 
-	heartBeat := heartbeat.NewHeartbeat(c.HeartBeat, heartbeat.WithDefaultUser(c.ClusterUsers[0].Name, c.ClusterUsers[0].Password))
+	hbOpts := []heartbeat.Option{
+		heartbeat.WithDefaultUser(c.ClusterUsers[0].Name, c.ClusterUsers[0].Password),
+		heartbeat.WithTransport(transport),
+	}
+
+	killQueryTimeout := time.Duration(c.KillQueryTimeout)
+	if killQueryTimeout <= 0 {
+		killQueryTimeout = defaultKillQueryTimeout
+	}
 
 	newC := &cluster{
 		name:                  c.Name,
+		scheme:                c.Scheme,
 		users:                 clusterUsers,
 		killQueryUserName:     c.KillQueryUser.Name,
 		killQueryUserPassword: c.KillQueryUser.Password,
-		heartBeat:             heartBeat,
 		retryNumber:           c.RetryNumber,
+		retryDelay:            time.Duration(c.RetryDelay),
+		maxRetryDelay:         time.Duration(c.MaxRetryDelay),
+		transport:             transport,
+		killQueryTimeout:      killQueryTimeout,
+		killQueryRetries:      c.KillQueryRetries,
+		killQueryTemplate:     newKillQueryTemplate(c),
+
+		maxConcurrentQueriesPerNode: c.MaxConcurrentQueriesPerNode,
+		consistentHash:              c.LoadBalancing == config.LoadBalancingConsistentHash,
+		fixedScheme:                 c.HTTP2 || c.H2C,
+		penaltySize:                 c.PenaltySize,
+		penaltyDuration:             time.Duration(c.PenaltyDuration),
+		segmentRouting:              c.SegmentRouting,
+	}
+	newC.retryBackoffMultiplier = c.RetryBackoffMultiplier
+	if newC.retryBackoffMultiplier == 0 {
+		newC.retryBackoffMultiplier = 1
+	}
+	if c.HeartBeat.MaxConcurrent > 0 {
+		newC.heartbeatSem = make(chan struct{}, c.HeartBeat.MaxConcurrent)
 	}
 
-	replicas, err := newReplicas(c.Replicas, c.Nodes, c.Scheme, newC)
+	replicas, err := newReplicas(c.Replicas, c.Nodes, c.NodeWeights, c.Scheme, c.HeartBeat, hbOpts, newC)
 	if err != nil {
 		return nil, fmt.Errorf("cannot initialize replicas: %w", err)
 	}
 	newC.replicas = replicas
+	weights := make([]uint32, len(replicas))
+	for i, r := range replicas {
+		weights[i] = r.getWeight()
+	}
+	newC.replicaSchedule = newWeightedSchedule(weights)
 
 	return newC, nil
 }
 
-func newClusters(cfg []config.Cluster) (map[string]*cluster, error) {
+// newClusters initializes clusters from cfg.
+// Transports for the cluster nodes are taken from transports if it isn't nil.
+// newClusters returns the clusters initialized from cfg.
+// The errors of all the clusters are returned along with the clusters
+// initialized successfully.
+func newClusters(cfg []config.Cluster, transports *clusterTransports) (map[string]*cluster, error) {
 	clusters := make(map[string]*cluster, len(cfg))
+	var errs []error
 	for _, c := range cfg {
 		if _, ok := clusters[c.Name]; ok {
-			return nil, fmt.Errorf("duplicate config for cluster %q", c.Name)
+			errs = append(errs, fmt.Errorf("duplicate config for cluster %q", c.Name))
+			continue
 		}
-		tmpC, err := newCluster(c)
+		transport, err := transports.get(c)
 		if err != nil {
-			return nil, fmt.Errorf("cannot initialize cluster %q: %w", c.Name, err)
+			errs = append(errs, fmt.Errorf("cannot initialize cluster %q: %w", c.Name, err))
+			continue
+		}
+		tmpC, err := newCluster(c, transport)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cannot initialize cluster %q: %w", c.Name, err))
+			continue
 		}
 		clusters[c.Name] = tmpC
 	}
-	return clusters, nil
+	return clusters, errors.Join(errs...)
+}
+
+// isNodeFull returns true if h runs max_concurrent_queries_per_node queries.
+func (c *cluster) isNodeFull(h *topology.Node) bool {
+	return c.maxConcurrentQueriesPerNode > 0 && h.CurrentLoad() >= c.maxConcurrentQueriesPerNode
 }
 
 // getReplica returns least loaded + round-robin replica from the cluster.
+// Replicas with all the hosts running max_concurrent_queries_per_node queries are skipped.
 //
 // Always returns non-nil.
 func (c *cluster) getReplica() *replica {
@@ -836,16 +2200,19 @@ func (c *cluster) getReplica() *replica {
 		return c.replicas[0]
 	}
 
-	idx %= n
+	idx = nextScheduledIdx(idx, n, c.replicaSchedule)
 	r := c.replicas[idx]
 	reqs := r.load()
+	// The load is compared per unit of weight, so heavier replicas
+	// run proportionally more queries.
+	load := float64(reqs) / float64(r.getWeight())
 
-	// Set least priority to inactive replica.
-	if !r.isActive() {
-		reqs = ^uint32(0)
+	// Set least priority to inactive or full replica.
+	if !r.isActive() || r.isFull() {
+		load = math.Inf(1)
 	}
 
-	if reqs == 0 {
+	if load == 0 {
 		return r
 	}
 
@@ -853,129 +2220,174 @@ func (c *cluster) getReplica() *replica {
 	for i := uint32(1); i < n; i++ {
 		tmpIdx := (idx + i) % n
 		tmpR := c.replicas[tmpIdx]
-		if !tmpR.isActive() {
+		if !tmpR.isActive() || tmpR.isFull() {
 			continue
 		}
 		tmpReqs := tmpR.load()
 		if tmpReqs == 0 {
 			return tmpR
 		}
-		if tmpReqs < reqs {
+		if tmpLoad := float64(tmpReqs) / float64(tmpR.getWeight()); tmpLoad < load {
 			r = tmpR
-			reqs = tmpReqs
+			load = tmpLoad
 		}
 	}
-	// The returned replica may be inactive. This is OK,
-	// since this means all the replicas are inactive,
+	// The returned replica may be inactive or full. This is OK,
+	// since this means all the replicas are inactive or full,
 	// so let's try proxying the request to any replica.
+	// Requests to full replicas wait in the queue, see scope.inc.
 	return r
 }
 
-func (c *cluster) getReplicaSticky(sessionId string) *replica {
+// getReplicaRoundRobin returns the next replica of the cluster in round-robin order
+// regardless of the load of replicas, so identical queries are evenly spread
+// among replicas. Replicas are picked according to their weights.
+// Inactive replicas are skipped.
+//
+// Always returns non-nil.
+func (c *cluster) getReplicaRoundRobin() *replica {
 	idx := atomic.AddUint32(&c.nextReplicaIdx, 1)
 	n := uint32(len(c.replicas))
 	if n == 1 {
 		return c.replicas[0]
 	}
 
-	idx %= n
-	r := c.replicas[idx]
+	idx = nextScheduledIdx(idx, n, c.replicaSchedule)
+	for i := uint32(0); i < n; i++ {
+		if r := c.replicas[(idx+i)%n]; r.isActive() {
+			return r
+		}
+	}
+	// All the replicas are inactive, so let's try proxying
+	// the request to the scheduled replica.
+	return c.replicas[idx]
+}
 
-	for i := uint32(1); i < n; i++ {
-		// handling sticky session
-		sessionId := hash(sessionId)
-		tmpIdx := (sessionId) % n
-		tmpRSticky := c.replicas[tmpIdx]
-		log.Debugf("Sticky replica candidate is: %s", tmpRSticky.name)
-		if !tmpRSticky.isActive() {
-			log.Debugf("Sticky session replica has been picked up, but it is not available")
-			continue
+// nextScheduledIdx returns the index of the item to start scanning n items from
+// for the given round-robin counter. Items are picked in turn if schedule is empty.
+func nextScheduledIdx(counter, n uint32, schedule []int) uint32 {
+	if len(schedule) == 0 {
+		return counter % n
+	}
+	return uint32(schedule[counter%uint32(len(schedule))])
+}
+
+// getReplicaSticky returns replica by stickiness from cluster.
+//
+// Replicas are chosen via rendezvous hashing on their names, so the mapping
+// survives config reloads which reorder, add or remove replicas.
+func (c *cluster) getReplicaSticky(sessionId string) *replica {
+	r := c.getReplicaByKey(sessionId)
+	if !r.isActive() {
+		log.Debugf("Sticky session replica %s has been picked up, but it is not available", r.name)
+		return c.getReplica()
+	}
+	log.Debugf("Sticky session replica is: %s, session_id: %s, max replicas in pool: %d", r.name, sessionId, len(c.replicas))
+	return r
+}
+
+// getReplicaByKey returns the replica with the highest rendezvous hash of key.
+//
+// Always returns non-nil.
+func (c *cluster) getReplicaByKey(key string) *replica {
+	r := c.replicas[0]
+	if len(c.replicas) == 1 {
+		return r
+	}
+	weight := rendezvousHash(key, r.name)
+	for _, tmpR := range c.replicas[1:] {
+		if tmpWeight := rendezvousHash(key, tmpR.name); tmpWeight > weight {
+			r = tmpR
+			weight = tmpWeight
 		}
-		log.Debugf("Sticky session replica is: %s, session_id: %d, replica_idx: %d, max replicas in pool: %d", tmpRSticky.name, sessionId, tmpIdx, n)
-		return tmpRSticky
 	}
-	// The returned replica may be inactive. This is OK,
-	// since this means all the replicas are inactive,
-	// so let's try proxying the request to any replica.
 	return r
 }
 
 // getHostSticky returns host by stickiness from replica.
 //
+// Hosts are chosen via rendezvous hashing on their addresses, so the mapping
+// survives config reloads which reorder, add or remove hosts.
+// Hosts running max_concurrent_queries_per_node queries aren't skipped,
+// since sessions are bound to the host. Such requests wait in the queue instead.
+//
 // Always returns non-nil.
 func (r *replica) getHostSticky(sessionId string) *topology.Node {
-	idx := atomic.AddUint32(&r.nextHostIdx, 1)
-	n := uint32(len(r.hosts))
-	if n == 1 {
-		return r.hosts[0]
+	hosts := r.getHosts()
+	if len(hosts) == 1 {
+		return hosts[0]
 	}
 
-	idx %= n
-	h := r.hosts[idx]
+	h := getHostByKey(hosts, sessionId)
+	if !h.IsActive() {
+		log.Debugf("Sticky session server %s has been picked up, but it is not available", h)
+		return r.getHost()
+	}
+	log.Debugf("Sticky session server is: %s, session_id: %s, max nodes in pool: %d", h, sessionId, len(hosts))
+	return h
+}
 
-	// Scan all the hosts for the least loaded host.
-	for i := uint32(1); i < n; i++ {
-		// handling sticky session
-		sessionId := hash(sessionId)
-		tmpIdx := (sessionId) % n
-		tmpHSticky := r.hosts[tmpIdx]
-		log.Debugf("Sticky server candidate is: %s", tmpHSticky)
-		if !tmpHSticky.IsActive() {
-			log.Debugf("Sticky session server has been picked up, but it is not available")
-			continue
+// getHostByKey returns the host with the highest rendezvous hash of key.
+func getHostByKey(hosts []*topology.Node, key string) *topology.Node {
+	h := hosts[0]
+	weight := rendezvousHash(key, h.Host())
+	for _, tmpH := range hosts[1:] {
+		if tmpWeight := rendezvousHash(key, tmpH.Host()); tmpWeight > weight {
+			h = tmpH
+			weight = tmpWeight
 		}
-		log.Debugf("Sticky session server is: %s, session_id: %d, server_idx: %d, max nodes in pool: %d", tmpHSticky, sessionId, tmpIdx, n)
-		return tmpHSticky
 	}
-
-	// The returned host may be inactive. This is OK,
-	// since this means all the hosts are inactive,
-	// so let's try proxying the request to any host.
 	return h
 }
 
 // getHost returns least loaded + round-robin host from replica.
+// The load of hosts is weighted by their health score
+// and is compared per unit of their weight.
+// Hosts running max_concurrent_queries_per_node queries are skipped.
 //
 // Always returns non-nil.
 func (r *replica) getHost() *topology.Node {
 	idx := atomic.AddUint32(&r.nextHostIdx, 1)
-	n := uint32(len(r.hosts))
+	hosts, schedule := r.getHostsWithSchedule()
+	n := uint32(len(hosts))
 	if n == 1 {
-		return r.hosts[0]
+		return hosts[0]
 	}
 
-	idx %= n
-	h := r.hosts[idx]
-	reqs := h.CurrentLoad()
+	idx = nextScheduledIdx(idx, n, schedule)
+	h := hosts[idx]
+	load := h.WeightedLoad()
 
-	// Set least priority to inactive host.
-	if !h.IsActive() {
-		reqs = ^uint32(0)
+	// Set least priority to inactive or full host.
+	if !h.IsActive() || r.cluster.isNodeFull(h) {
+		load = math.Inf(1)
 	}
 
-	if reqs == 0 {
+	// Idle healthy hosts have the lowest possible load.
+	if load <= 1 {
 		return h
 	}
+	load /= float64(h.Weight())
 
 	// Scan all the hosts for the least loaded host.
 	for i := uint32(1); i < n; i++ {
 		tmpIdx := (idx + i) % n
-		tmpH := r.hosts[tmpIdx]
-		if !tmpH.IsActive() {
+		tmpH := hosts[tmpIdx]
+		if !tmpH.IsActive() || r.cluster.isNodeFull(tmpH) {
 			continue
 		}
-		tmpReqs := tmpH.CurrentLoad()
-		if tmpReqs == 0 {
+		tmpLoad := tmpH.WeightedLoad()
+		if tmpLoad <= 1 {
 			return tmpH
 		}
-		if tmpReqs < reqs {
+		if tmpLoad /= float64(tmpH.Weight()); tmpLoad < load {
 			h = tmpH
-			reqs = tmpReqs
+			load = tmpLoad
 		}
 	}
 
-	// The returned host may be inactive. This is OK,
-	// since this means all the hosts are inactive,
+	// The returned host may be inactive or full. This is OK,
+	// since this means all the hosts are inactive or full,
 	// so let's try proxying the request to any host.
 	return h
 }
@@ -988,16 +2400,107 @@ func (c *cluster) getHostSticky(sessionId string) *topology.Node {
 	return r.getHostSticky(sessionId)
 }
 
+// stickyHost returns the host of sessionId regardless of its availability,
+// i.e. the host getHostSticky returns while all the hosts are active.
+//
+// Always returns non-nil.
+func (c *cluster) stickyHost(sessionId string) *topology.Node {
+	r := c.getReplicaByKey(sessionId)
+	return getHostByKey(r.getHosts(), sessionId)
+}
+
 // getHost returns least loaded + round-robin host from cluster.
+// The replica is chosen in round-robin order if segmentRouting is set.
 //
 // Always returns non-nil.
 func (c *cluster) getHost() *topology.Node {
+	if c.segmentRouting {
+		return c.getReplicaRoundRobin().getHost()
+	}
 	r := c.getReplica()
 	return r.getHost()
 }
 
+// getHostConsistent returns host by the rendezvous hash of key from cluster,
+// so the same key is mapped to the same host while the host is available.
+// Falls back to least loaded + round-robin host if the chosen replica or host
+// is inactive or runs max_concurrent_queries_per_node queries.
+//
+// Always returns non-nil.
+func (c *cluster) getHostConsistent(key string) *topology.Node {
+	r := c.getReplicaByKey(key)
+	if !r.isActive() || r.isFull() {
+		return c.getHost()
+	}
+	h := getHostByKey(r.getHosts(), key)
+	if !h.IsActive() || c.isNodeFull(h) {
+		return r.getHost()
+	}
+	return h
+}
+
+// pickHost returns the host for the request with the given sessionId and hashKey.
+// Requests with sessionId stick to the host of the session, while the hosts
+// for other requests are chosen according to the `load_balancing` of cluster.
+//
+// Always returns non-nil.
+func (c *cluster) pickHost(sessionId, hashKey string) *topology.Node {
+	if sessionId != "" {
+		return c.getHostSticky(sessionId)
+	}
+	if c.consistentHash && hashKey != "" {
+		return c.getHostConsistent(hashKey)
+	}
+	return c.getHost()
+}
+
+// health returns "ok" if the cluster has at least one active host.
+func (c *cluster) health() string {
+	for _, r := range c.replicas {
+		for _, h := range r.getHosts() {
+			if h.IsActive() {
+				return healthStatusOK
+			}
+		}
+	}
+	return "no active hosts"
+}
+
 type rateLimiter struct {
 	counter
+
+	// shared is the counter shared between chproxy instances.
+	// Only the local counter is used if it is nil.
+	shared *distributedRateCounter
+}
+
+// inc increments the number of requests during the current minute.
+// The shared counter is authoritative if it is reachable,
+// otherwise the local one is used.
+func (rl *rateLimiter) inc() uint32 {
+	n := rl.counter.inc()
+	if rl.shared == nil {
+		return n
+	}
+
+	sn, err := rl.shared.inc(time.Now())
+	if err != nil {
+		distributedRateLimitHits.With(prometheus.Labels{"user": rl.shared.user, "result": "failure"}).Inc()
+		log.Debugf("cannot check distributed rate limit for user %q, falling back to the local one: %s", rl.shared.user, err)
+		return n
+	}
+	distributedRateLimitHits.With(prometheus.Labels{"user": rl.shared.user, "result": "success"}).Inc()
+	return sn
+}
+
+func (rl *rateLimiter) dec() {
+	rl.counter.dec()
+	if rl.shared == nil {
+		return
+	}
+	if err := rl.shared.dec(time.Now()); err != nil {
+		log.Debugf("cannot decrement distributed rate limit counter for user %q: %s", rl.shared.user, err)
+	}
 }
 
 func (rl *rateLimiter) run(done <-chan struct{}) {
@@ -1022,3 +2525,65 @@ func (c *counter) load() uint32 { return atomic.LoadUint32(&c.value) }
 func (c *counter) dec() { atomic.AddUint32(&c.value, ^uint32(0)) }
 
 func (c *counter) inc() uint32 { return atomic.AddUint32(&c.value, 1) }
+
+// queuePriority is the priority level of requests waiting in the queue.
+type queuePriority int
+
+const (
+	queuePriorityHigh queuePriority = iota
+	queuePriorityNormal
+	queuePriorityLow
+
+	queuePrioritiesCount
+)
+
+// newQueuePriority maps the `queue_priority` of the user to its level:
+// 1-3 are high, 4-7 are normal and 8-10 are low.
+func newQueuePriority(p uint32) queuePriority {
+	if p == 0 {
+		p = config.DefaultQueuePriority
+	}
+	switch {
+	case p <= 3:
+		return queuePriorityHigh
+	case p <= 7:
+		return queuePriorityNormal
+	default:
+		return queuePriorityLow
+	}
+}
+
+func (p queuePriority) String() string {
+	switch p {
+	case queuePriorityHigh:
+		return "high"
+	case queuePriorityNormal:
+		return "normal"
+	case queuePriorityLow:
+		return "low"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(p))
+	}
+}
+
+// priorityQueue counts queued requests per priority level.
+// Requests aren't allowed to start while requests with
+// higher priority are waiting, so the slots are drained
+// by priority.
+type priorityQueue struct {
+	waiting [queuePrioritiesCount]counter
+}
+
+func (pq *priorityQueue) enqueue(p queuePriority) { pq.waiting[p].inc() }
+
+func (pq *priorityQueue) dequeue(p queuePriority) { pq.waiting[p].dec() }
+
+// hasWaitingAbove returns true if requests with priority higher than p are waiting.
+func (pq *priorityQueue) hasWaitingAbove(p queuePriority) bool {
+	for i := queuePriorityHigh; i < p; i++ {
+		if pq.waiting[i].load() > 0 {
+			return true
+		}
+	}
+	return false
+}
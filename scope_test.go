@@ -1,17 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"fmt"
+	"io"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"regexp"
 	"sort"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/contentsquare/chproxy/config"
 	"github.com/contentsquare/chproxy/internal/topology"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
 )
 
 var (
@@ -108,6 +117,34 @@ func TestRunningQueries(t *testing.T) {
 	check(1, 2, 2)
 }
 
+func TestReplicaRetireHost(t *testing.T) {
+	r := &replica{name: "default", cluster: &cluster{}}
+	r.hosts = []*topology.Node{
+		topology.NewNode(&url.URL{Host: "127.0.0.1"}, nil, "", r.name, topology.WithDefaultActiveState(true)),
+		topology.NewNode(&url.URL{Host: "127.0.0.2"}, nil, "", r.name, topology.WithDefaultActiveState(true)),
+	}
+
+	h, err := r.retireHost("127.0.0.3")
+	assert.NoError(t, err)
+	assert.Nil(t, h)
+
+	h, err = r.retireHost("127.0.0.1")
+	assert.NoError(t, err)
+	assert.False(t, h.IsActive())
+
+	// The retired host isn't chosen while it is drained.
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, "127.0.0.2", r.getHost().Host())
+	}
+
+	_, err = r.retireHost("127.0.0.2")
+	assert.EqualError(t, err, "cannot remove the last node \"127.0.0.2\" of replica \"default\"")
+
+	assert.NoError(t, r.removeHost("127.0.0.1"))
+	assert.Len(t, r.getHosts(), 1)
+	assert.Error(t, r.removeHost("127.0.0.1"))
+}
+
 func TestGetHost(t *testing.T) {
 	c := &cluster{
 		name:     "default",
@@ -201,6 +238,325 @@ func TestGetHost(t *testing.T) {
 	h.IncrementConnections()
 }
 
+func TestGetHostPenaltyDecay(t *testing.T) {
+	const penaltyDuration = 50 * time.Millisecond
+	c := &cluster{
+		name:     "default",
+		replicas: []*replica{{}},
+	}
+	r := c.replicas[0]
+	r.cluster = c
+	r.hosts = []*topology.Node{
+		topology.NewNode(&url.URL{Host: "127.0.0.1"}, nil, "", r.name, topology.WithDefaultActiveState(true),
+			topology.WithPenalty(3, penaltyDuration)),
+		topology.NewNode(&url.URL{Host: "127.0.0.2"}, nil, "", r.name, topology.WithDefaultActiveState(true),
+			topology.WithPenalty(3, penaltyDuration)),
+	}
+	penalized := r.hosts[0]
+	penalized.Penalize()
+	assert.Equal(t, uint32(3), penalized.CurrentLoad())
+
+	pickedHosts := func() map[string]bool {
+		hosts := make(map[string]bool)
+		for i := 0; i < 4; i++ {
+			hosts[c.getHost().Host()] = true
+		}
+		return hosts
+	}
+	assert.Equal(t, map[string]bool{"127.0.0.2": true}, pickedHosts())
+
+	assert.Eventually(t, func() bool {
+		return penalized.CurrentLoad() == 0
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, map[string]bool{"127.0.0.1": true, "127.0.0.2": true}, pickedHosts())
+}
+
+func TestGetHostSegmentRouting(t *testing.T) {
+	c := &cluster{
+		name:           "default",
+		segmentRouting: true,
+	}
+	for _, name := range []string{"replica1", "replica2", "replica3"} {
+		r := &replica{cluster: c, name: name}
+		r.hosts = []*topology.Node{
+			topology.NewNode(&url.URL{Host: name}, nil, c.name, name, topology.WithDefaultActiveState(true)),
+		}
+		c.replicas = append(c.replicas, r)
+	}
+
+	// Replicas are picked in turn regardless of their load.
+	c.replicas[1].hosts[0].IncrementConnections()
+	c.replicas[1].hosts[0].Penalize()
+	var picked []string
+	for i := 0; i < 6; i++ {
+		picked = append(picked, c.getHost().Host())
+	}
+	assert.Equal(t, []string{"replica2", "replica3", "replica1", "replica2", "replica3", "replica1"}, picked)
+
+	// Inactive replicas are skipped.
+	c.replicas[2].hosts[0].SetIsActive(false)
+	picked = picked[:0]
+	for i := 0; i < 4; i++ {
+		picked = append(picked, c.getHost().Host())
+	}
+	assert.Equal(t, []string{"replica2", "replica1", "replica1", "replica2"}, picked)
+}
+
+// slowHeartbeat reports hosts as healthy after the given delay.
+type slowHeartbeat struct {
+	delay time.Duration
+}
+
+func (hb *slowHeartbeat) Interval() time.Duration {
+	return 10 * time.Millisecond
+}
+
+func (hb *slowHeartbeat) IsHealthy(ctx context.Context, addr string) error {
+	time.Sleep(hb.delay)
+	return nil
+}
+
+func TestGetHostHealthScore(t *testing.T) {
+	c := &cluster{
+		name:     "default",
+		replicas: []*replica{{}},
+	}
+	r := c.replicas[0]
+	r.cluster = c
+	slow := topology.NewNode(&url.URL{Host: "127.0.0.1"}, &slowHeartbeat{delay: 20 * time.Millisecond}, "", r.name,
+		topology.WithDefaultActiveState(true), topology.WithMaxHealthyLatency(5*time.Millisecond))
+	r.hosts = []*topology.Node{
+		slow,
+		topology.NewNode(&url.URL{Host: "127.0.0.2"}, nil, "", r.name, topology.WithDefaultActiveState(true)),
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		slow.StartHeartbeat(done)
+		close(stopped)
+	}()
+	assert.Eventually(t, func() bool {
+		return slow.HealthScore() > 4
+	}, time.Second, 10*time.Millisecond)
+	// Stop the heartbeat, so the score doesn't change anymore.
+	close(done)
+	<-stopped
+	score := slow.HealthScore()
+
+	// The slow host is avoided until the other host
+	// is loaded enough to outweigh its health score.
+	other := r.hosts[1]
+	for other.WeightedLoad() < score {
+		h := c.getHost()
+		if h.Host() != "127.0.0.2" {
+			t.Fatalf("got host %q with load %v; expected %q with load %v", h.Host(), h.WeightedLoad(), other.Host(), other.WeightedLoad())
+		}
+		h.IncrementConnections()
+	}
+	if other.WeightedLoad() == score {
+		other.IncrementConnections()
+	}
+	if h := c.getHost(); h.Host() != "127.0.0.1" {
+		t.Fatalf("got host %q; expected %q", h.Host(), "127.0.0.1")
+	}
+}
+
+func TestGetHostWeighted(t *testing.T) {
+	newReplica := func() (*cluster, *replica) {
+		c := &cluster{
+			name:     "default",
+			replicas: []*replica{{name: "default"}},
+		}
+		r := c.replicas[0]
+		r.cluster = c
+		r.setHosts([]*topology.Node{
+			topology.NewNode(&url.URL{Host: "127.0.0.1"}, nil, "", r.name, topology.WithDefaultActiveState(true), topology.WithWeight(2)),
+			topology.NewNode(&url.URL{Host: "127.0.0.2"}, nil, "", r.name, topology.WithDefaultActiveState(true)),
+		})
+		return c, r
+	}
+
+	t.Run("idle hosts", func(t *testing.T) {
+		c, _ := newReplica()
+		picked := make(map[string]int)
+		for i := 0; i < 3000; i++ {
+			picked[c.getHost().Host()]++
+		}
+		assert.InDelta(t, 2000, picked["127.0.0.1"], 30)
+		assert.InDelta(t, 1000, picked["127.0.0.2"], 30)
+	})
+
+	t.Run("loaded hosts", func(t *testing.T) {
+		c, r := newReplica()
+		// Queries never complete, so the load of hosts grows.
+		for i := 0; i < 300; i++ {
+			c.getHost().IncrementConnections()
+		}
+		assert.InDelta(t, 200, r.hosts[0].CurrentLoad(), 5)
+		assert.InDelta(t, 100, r.hosts[1].CurrentLoad(), 5)
+	})
+
+	t.Run("inactive host", func(t *testing.T) {
+		c, r := newReplica()
+		r.hosts[0].SetIsActive(false)
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, "127.0.0.2", c.getHost().Host())
+		}
+	})
+}
+
+func TestGetReplicaWeighted(t *testing.T) {
+	c := &cluster{name: "default"}
+	for i, w := range []uint32{2, 0} {
+		r := &replica{name: fmt.Sprintf("replica%d", i), cluster: c, weight: w}
+		r.setHosts([]*topology.Node{
+			topology.NewNode(&url.URL{Host: fmt.Sprintf("127.0.0.%d", i+1)}, nil, "", r.name, topology.WithDefaultActiveState(true)),
+		})
+		c.replicas = append(c.replicas, r)
+	}
+	c.replicaSchedule = newWeightedSchedule([]uint32{c.replicas[0].getWeight(), c.replicas[1].getWeight()})
+
+	picked := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		picked[c.getReplica().name]++
+	}
+	assert.InDelta(t, 2000, picked["replica0"], 30)
+	assert.InDelta(t, 1000, picked["replica1"], 30)
+
+	// Queries never complete, so the load of replicas grows.
+	for i := 0; i < 300; i++ {
+		c.getHost().IncrementConnections()
+	}
+	assert.InDelta(t, 200, c.replicas[0].load(), 5)
+	assert.InDelta(t, 100, c.replicas[1].load(), 5)
+}
+
+func TestNewWeightedSchedule(t *testing.T) {
+	assert.Nil(t, newWeightedSchedule([]uint32{1, 1, 1}))
+	assert.Nil(t, newWeightedSchedule([]uint32{3, 3}))
+	assert.Equal(t, []int{0, 1, 0}, newWeightedSchedule([]uint32{2, 1}))
+	assert.Equal(t, []int{0, 0, 1, 0, 2, 0, 0}, newWeightedSchedule([]uint32{5, 1, 1}))
+}
+
+func TestClusterHeartbeatMaxConcurrent(t *testing.T) {
+	var running, maxRunning atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			max := maxRunning.Load()
+			if n <= max || maxRunning.CompareAndSwap(max, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		fmt.Fprint(w, "Ok.\n")
+	}))
+	defer srv.Close()
+	addr, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	c, err := newCluster(config.Cluster{
+		Name:   "cluster",
+		Scheme: "http",
+		Replicas: []config.Replica{
+			{Name: "main", Nodes: []string{addr.Host, addr.Host}},
+			{Name: "dr", Nodes: []string{addr.Host, addr.Host}},
+		},
+		ClusterUsers: []config.ClusterUser{{Name: "default"}},
+		HeartBeat: config.HeartBeat{
+			Interval:      config.Duration(time.Millisecond),
+			Timeout:       config.Duration(time.Second),
+			Request:       "/ping",
+			Response:      "Ok.\n",
+			MaxConcurrent: 1,
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	for _, r := range c.replicas {
+		for _, h := range r.hosts {
+			go h.StartHeartbeat(done)
+		}
+	}
+	assert.Eventually(t, func() bool {
+		return c.replicas[0].isActive() && c.replicas[1].isActive()
+	}, 5*time.Second, 10*time.Millisecond)
+	if n := maxRunning.Load(); n != 1 {
+		t.Fatalf("got %d simultaneous heartbeats; expected 1", n)
+	}
+}
+
+func TestReplicaHeartBeat(t *testing.T) {
+	var response atomic.Value
+	response.Store("Ok. lag: 1\n")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, response.Load())
+	}))
+	defer srv.Close()
+	addr, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	hb := config.HeartBeat{
+		Interval: config.Duration(10 * time.Millisecond),
+		Timeout:  config.Duration(time.Second),
+		Request:  "/ping",
+		Response: "Ok. lag: 1\n",
+	}
+	drHB := hb
+	drHB.Match = config.HeartBeatMatchRegex
+	drHB.Response = `^Ok\. lag: [0-9]+`
+	c, err := newCluster(config.Cluster{
+		Name:   "cluster",
+		Scheme: "http",
+		Replicas: []config.Replica{
+			{Name: "main", Nodes: []string{addr.Host}},
+			{Name: "dr", Nodes: []string{addr.Host}, HeartBeat: &drHB},
+		},
+		ClusterUsers: []config.ClusterUser{{Name: "default"}},
+		HeartBeat:    hb,
+	}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	for _, r := range c.replicas {
+		for _, h := range r.hosts {
+			go h.StartHeartbeat(done)
+		}
+	}
+	main, dr := c.replicas[0], c.replicas[1]
+	waitActive := func(mainActive, drActive bool) {
+		t.Helper()
+		assert.Eventually(t, func() bool {
+			return main.isActive() == mainActive && dr.isActive() == drActive
+		}, time.Second, 10*time.Millisecond, "response: %q", response.Load())
+	}
+
+	waitActive(true, true)
+
+	// The lenient probe of the dr replica accepts bigger lags.
+	response.Store("Ok. lag: 100\n")
+	waitActive(false, true)
+
+	response.Store("Fail.\n")
+	waitActive(false, false)
+
+	response.Store("Ok. lag: 1\n")
+	waitActive(true, true)
+}
+
 func TestRunningQueriesConcurrent(t *testing.T) {
 	cu := &clusterUser{
 		maxConcurrentQueries: 10,
@@ -227,6 +583,7 @@ func TestGetHostConcurrent(t *testing.T) {
 			},
 		},
 	}
+	c.replicas[0].cluster = c
 	f := func() {
 		h := c.getHost()
 		h.IncrementConnections()
@@ -270,6 +627,13 @@ func TestDecorateRequest(t *testing.T) {
 			nil,
 			[]string{"query_id", "session_timeout", "query"},
 		},
+		{
+			"http://127.0.0.1?user=default&password=default&query=SELECT&session_id=a&session_close=1",
+			"text/plain",
+			"GET",
+			nil,
+			[]string{"query_id", "session_timeout", "query", "session_id"},
+		},
 		{
 			"http://127.0.0.1?user=default&password=default&query=SELECT&database=default&wait_end_of_query=1",
 			"text/plain",
@@ -371,7 +735,10 @@ func TestDecorateRequest(t *testing.T) {
 			},
 			host: topology.NewNode(&url.URL{Host: "127.0.0.1"}, nil, "", ""),
 		}
-		req, _ = s.decorateRequest(req)
+		req, _, err = s.decorateRequest(req)
+		if err != nil {
+			t.Fatalf("unexpected error while decorating request: %s", err)
+		}
 		values := req.URL.Query()
 		params := make([]string, len(values))
 		var i int
@@ -394,12 +761,380 @@ func TestDecorateRequest(t *testing.T) {
 	}
 }
 
+func TestDecorateRequestForcedParams(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://127.0.0.1?query=SELECT&max_result_rows=5&database=default", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while creating request: %s", err)
+	}
+	s := &scope{
+		id:          newScopeID(),
+		clusterUser: &clusterUser{},
+		user: &user{
+			params: &paramsRegistry{
+				key: uint32(1),
+				params: []config.Param{
+					{Key: "max_result_rows", Value: "10"},
+					{Key: "max_threads", Value: "4"},
+				},
+			},
+			forcedParams: &paramsRegistry{
+				key: uint32(2),
+				params: []config.Param{
+					{Key: "max_result_rows", Value: "100"},
+					{Key: "max_memory_usage", Value: "1000000000"},
+				},
+			},
+		},
+		host: topology.NewNode(&url.URL{Host: "127.0.0.1"}, nil, "", ""),
+	}
+	req, _, err = s.decorateRequest(req)
+	if err != nil {
+		t.Fatalf("unexpected error while decorating request: %s", err)
+	}
+	values := req.URL.Query()
+	assert.Equal(t, "100", values.Get("max_result_rows"))
+	assert.Equal(t, "1000000000", values.Get("max_memory_usage"))
+	assert.Equal(t, "4", values.Get("max_threads"))
+	assert.Equal(t, "default", values.Get("database"))
+}
+
+func TestDecorateRequestAllowedHeaders(t *testing.T) {
+	testCases := []struct {
+		name            string
+		allowedHeaders  []string
+		expectedHeaders []string
+	}{
+		{
+			"all headers pass without allowlist",
+			nil,
+			[]string{"Accept-Encoding", "Authorization", "Content-Type", "User-Agent", "X-App-Tenant", "X-Forwarded-For", "X-Request-Id"},
+		},
+		{
+			"only allowed and preserved headers pass",
+			[]string{"x-app-tenant"},
+			[]string{"Accept-Encoding", "Authorization", "Content-Type", "User-Agent", "X-App-Tenant", "X-Request-Id"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "http://127.0.0.1?query=SELECT", nil)
+			if err != nil {
+				t.Fatalf("unexpected error while creating request: %s", err)
+			}
+			req.Header.Set("Content-Type", "text/plain")
+			req.Header.Set("Accept-Encoding", "gzip")
+			req.Header.Set("X-App-Tenant", "tenant")
+			req.Header.Set("X-Forwarded-For", "10.0.0.1")
+			s := &scope{
+				id:          newScopeID(),
+				clusterUser: &clusterUser{},
+				user: &user{
+					allowedRequestHeaders: newHeaderSet(tc.allowedHeaders),
+				},
+				host: topology.NewNode(&url.URL{Host: "127.0.0.1"}, nil, "", ""),
+			}
+			req, _, err = s.decorateRequest(req)
+			if err != nil {
+				t.Fatalf("unexpected error while decorating request: %s", err)
+			}
+
+			headers := make([]string, 0, len(req.Header))
+			for h := range req.Header {
+				headers = append(headers, h)
+			}
+			sort.Strings(headers)
+			assert.Equal(t, tc.expectedHeaders, headers)
+		})
+	}
+}
+
+func TestDecorateRequestAllowedEncodings(t *testing.T) {
+	testCases := []struct {
+		name                   string
+		acceptEncoding         string
+		allowedEncodings       []string
+		expectedAcceptEncoding string
+	}{
+		{"all encodings pass without allowlist", "identity, br", nil, "identity, br"},
+		{"allowed encodings pass", "zstd, gzip, br", []string{"gzip", "br"}, "br,gzip"},
+		{"encodings are compared case-insensitively", "GZIP;q=0.8", []string{"gzip"}, "GZIP;q=0.8"},
+		{"the first allowed encoding is forced", "identity", []string{"gzip", "br"}, "gzip"},
+		{"the first allowed encoding is forced without header", "", []string{"gzip"}, "gzip"},
+		{"rejected encodings are dropped", "gzip;q=0, br", []string{"gzip"}, "gzip"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "http://127.0.0.1?query=SELECT", nil)
+			if err != nil {
+				t.Fatalf("unexpected error while creating request: %s", err)
+			}
+			if len(tc.acceptEncoding) > 0 {
+				req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			}
+			s := &scope{
+				id:          newScopeID(),
+				clusterUser: &clusterUser{},
+				user: &user{
+					allowedEncodings: tc.allowedEncodings,
+				},
+				host: topology.NewNode(&url.URL{Host: "127.0.0.1"}, nil, "", ""),
+			}
+			req, _, err = s.decorateRequest(req)
+			if err != nil {
+				t.Fatalf("unexpected error while decorating request: %s", err)
+			}
+			assert.Equal(t, tc.expectedAcceptEncoding, req.Header.Get("Accept-Encoding"))
+		})
+	}
+}
+
+func TestDecorateRequestHeaders(t *testing.T) {
+	testCases := []struct {
+		name          string
+		user          *user
+		expectedQuota string
+	}{
+		{
+			"user",
+			&user{name: "foo"},
+			"quota-foo",
+		},
+		{
+			"wildcarded user",
+			&user{name: "*_analytics", isWildcarded: true},
+			"quota-bar_analytics",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "http://127.0.0.1?query=SELECT", nil)
+			if err != nil {
+				t.Fatalf("unexpected error while creating request: %s", err)
+			}
+			req.Header.Set("X-ClickHouse-Format", "CSV")
+			tc.user.requestHeaders = newRequestHeaders(map[string]string{
+				"X-ClickHouse-Quota":  "quota-" + config.HeaderUserPlaceholder,
+				"x-clickhouse-format": "JSON",
+			})
+			// Headers of the user are sent even if they aren't allowed for the client.
+			tc.user.allowedRequestHeaders = newHeaderSet([]string{"X-App-Tenant"})
+			s := &scope{
+				id:          newScopeID(),
+				clusterUser: &clusterUser{name: "bar_analytics"},
+				user:        tc.user,
+				host:        topology.NewNode(&url.URL{Host: "127.0.0.1"}, nil, "", ""),
+			}
+			req, _, err = s.decorateRequest(req)
+			if err != nil {
+				t.Fatalf("unexpected error while decorating request: %s", err)
+			}
+			assert.Equal(t, tc.expectedQuota, req.Header.Get("X-ClickHouse-Quota"))
+			assert.Equal(t, []string{"JSON"}, req.Header.Values("X-ClickHouse-Format"))
+		})
+	}
+}
+
+func TestDecorateRequestUserAgentTemplate(t *testing.T) {
+	testCases := []struct {
+		name       string
+		template   string
+		expectedUA string
+	}{
+		{
+			"template variables",
+			"{{.User}}/{{.ClusterUser}} from {{.RemoteAddr}}: {{.OriginalUserAgent}}",
+			"foo/web from 10.0.0.1:1234: client/1.0",
+		},
+		{
+			"line breaks are replaced",
+			"{{.User}}\r\n{{.ClusterUser}}",
+			"foo  web",
+		},
+		{
+			"too long User-Agent is truncated",
+			strings.Repeat("a", maxUserAgentSize+1),
+			strings.Repeat("a", maxUserAgentSize-3) + "...",
+		},
+		{
+			"empty template",
+			"",
+			"",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpl, err := newUserAgentTemplate(tc.template)
+			if err != nil {
+				t.Fatalf("unexpected error while parsing template: %s", err)
+			}
+			req, err := http.NewRequest("GET", "http://127.0.0.1?query=SELECT", nil)
+			if err != nil {
+				t.Fatalf("unexpected error while creating request: %s", err)
+			}
+			req.Header.Set("User-Agent", "client/1.0")
+			s := &scope{
+				id:          newScopeID(),
+				remoteAddr:  "10.0.0.1:1234",
+				clusterUser: &clusterUser{name: "web"},
+				user:        &user{name: "foo", userAgentTemplate: tmpl},
+				host:        topology.NewNode(&url.URL{Host: "127.0.0.1"}, nil, "", ""),
+			}
+			req, _, err = s.decorateRequest(req)
+			if err != nil {
+				t.Fatalf("unexpected error while decorating request: %s", err)
+			}
+
+			ua, ok := req.Header["User-Agent"]
+			assert.True(t, ok)
+			assert.Equal(t, []string{tc.expectedUA}, ua)
+		})
+	}
+}
+
+func TestNewUserAgentTemplate(t *testing.T) {
+	for _, tmpl := range []string{"{{.User", "{{.Unknown}}"} {
+		if _, err := newUserAgentTemplate(tmpl); err == nil {
+			t.Fatalf("expected error for template %q", tmpl)
+		}
+	}
+}
+
+func TestDecorateRequestRewriteRules(t *testing.T) {
+	rules := []rewriteRule{
+		{re: regexp.MustCompile(`\bprod\.(\w+)`), replace: []byte("staging.$1")},
+		{re: regexp.MustCompile(`(?i)^\s*DROP\b.*$`), replace: []byte("")},
+	}
+	testCases := []struct {
+		name          string
+		request       string
+		body          string
+		expectedQuery string
+		expectedBody  string
+		expectedErr   bool
+	}{
+		{
+			name:          "query param is rewritten",
+			request:       "http://127.0.0.1?query=SELECT+*+FROM+prod.events",
+			expectedQuery: "SELECT * FROM staging.events",
+		},
+		{
+			name:          "body is not rewritten when query param is set",
+			request:       "http://127.0.0.1?query=INSERT+INTO+prod.events+FORMAT+TSV",
+			body:          "prod.value",
+			expectedQuery: "INSERT INTO staging.events FORMAT TSV",
+			expectedBody:  "prod.value",
+		},
+		{
+			name:         "body is rewritten",
+			request:      "http://127.0.0.1",
+			body:         "SELECT count() FROM prod.events JOIN prod.users USING id",
+			expectedBody: "SELECT count() FROM staging.events JOIN staging.users USING id",
+		},
+		{
+			name:         "data of INSERT in body is not rewritten",
+			request:      "http://127.0.0.1",
+			body:         "INSERT INTO prod.events VALUES ('prod.value')",
+			expectedBody: "INSERT INTO staging.events VALUES ('prod.value')",
+		},
+		{
+			name:         "INSERT with matching data only is kept as is",
+			request:      "http://127.0.0.1",
+			body:         "INSERT INTO events FORMAT TSV\nprod.value\nDROP x\n",
+			expectedBody: "INSERT INTO events FORMAT TSV\nprod.value\nDROP x\n",
+		},
+		{
+			name:         "unmatched query is kept as is",
+			request:      "http://127.0.0.1",
+			body:         "SELECT 1",
+			expectedBody: "SELECT 1",
+		},
+		{
+			name:        "empty query after rewrite",
+			request:     "http://127.0.0.1",
+			body:        "DROP TABLE prod.events",
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tc.request, strings.NewReader(tc.body))
+			s := &scope{
+				id:          newScopeID(),
+				clusterUser: &clusterUser{},
+				user: &user{
+					name:         "default",
+					rewriteRules: rules,
+				},
+				host: topology.NewNode(&url.URL{Host: "127.0.0.1"}, nil, "", ""),
+			}
+			req, _, err := s.decorateRequest(req)
+			if tc.expectedErr {
+				if err == nil {
+					t.Fatalf("expected error for query %q", tc.body)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error while decorating request: %s", err)
+			}
+			if q := req.URL.Query().Get("query"); q != tc.expectedQuery {
+				t.Fatalf("unexpected query param: got %q; want %q", q, tc.expectedQuery)
+			}
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				t.Fatalf("unexpected error while reading body: %s", err)
+			}
+			if string(body) != tc.expectedBody {
+				t.Fatalf("unexpected body: got %q; want %q", body, tc.expectedBody)
+			}
+		})
+	}
+}
+
+func TestDecorateRequestRewriteRulesCompressedInsert(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte("INSERT INTO events FORMAT TSV\nprod.value\n")); err != nil {
+		t.Fatalf("cannot compress body: %s", err)
+	}
+	checkErr(t, zw.Close())
+	compressed := buf.Bytes()
+
+	req := httptest.NewRequest(http.MethodPost, "http://127.0.0.1", bytes.NewReader(compressed))
+	req.Header.Set("Content-Encoding", "gzip")
+	s := &scope{
+		id:          newScopeID(),
+		clusterUser: &clusterUser{},
+		user: &user{
+			name:         "default",
+			rewriteRules: []rewriteRule{{re: regexp.MustCompile(`\bprod\.(\w+)`), replace: []byte("staging.$1")}},
+		},
+		host: topology.NewNode(&url.URL{Host: "127.0.0.1"}, nil, "", ""),
+	}
+	req, _, err := s.decorateRequest(req)
+	if err != nil {
+		t.Fatalf("unexpected error while decorating request: %s", err)
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("unexpected error while reading body: %s", err)
+	}
+	// The data matching the rule arrives unchanged and still compressed.
+	assert.Equal(t, compressed, body)
+	assert.Equal(t, "gzip", req.Header.Get("Content-Encoding"))
+}
+
 func TestGetHostSticky(t *testing.T) {
 	exceptedSessionHostMap := map[string]string{
-		"0": "127.0.0.22",
-		"1": "127.0.0.33",
-		"2": "127.0.0.44",
-		"3": "127.0.0.55",
+		"0": "127.0.0.66",
+		"1": "127.0.0.66",
+		"2": "127.0.0.33",
+		"3": "127.0.0.44",
 	}
 	c := testGetCluster()
 	for i := 0; i < 10000; i++ {
@@ -410,21 +1145,260 @@ func TestGetHostSticky(t *testing.T) {
 	}
 }
 
+func TestGetHostStickyNodeAppended(t *testing.T) {
+	const sessions = 1000
+	r := &replica{name: "replica"}
+	for i := 1; i <= 4; i++ {
+		h := topology.NewNode(&url.URL{Host: fmt.Sprintf("127.0.0.%d:8123", i)}, nil, "", r.name, topology.WithDefaultActiveState(true))
+		r.hosts = append(r.hosts, h)
+	}
+	before := make(map[string]string, sessions)
+	for i := 0; i < sessions; i++ {
+		sessionId := strconv.Itoa(i)
+		before[sessionId] = r.getHostSticky(sessionId).Host()
+	}
+
+	newHost := topology.NewNode(&url.URL{Host: "127.0.0.5:8123"}, nil, "", r.name, topology.WithDefaultActiveState(true))
+	r.hosts = append(r.hosts, newHost)
+	var moved int
+	for sessionId, host := range before {
+		h := r.getHostSticky(sessionId).Host()
+		if h == host {
+			continue
+		}
+		if h != newHost.Host() {
+			t.Fatalf("session %s moved from %s to %s instead of the appended host", sessionId, host, h)
+		}
+		moved++
+	}
+	if moved == 0 || moved > sessions/4 {
+		t.Fatalf("unexpected number of moved sessions: %d; want at most %d", moved, sessions/4)
+	}
+}
+
+func TestGetHostStickyInactive(t *testing.T) {
+	c := testGetCluster()
+	sticky := c.getHostSticky("0")
+	sticky.SetIsActive(false)
+	for i := 0; i < 100; i++ {
+		if h := c.getHostSticky("0"); h == sticky {
+			t.Fatalf("inactive sticky host %s must not be chosen", h)
+		}
+	}
+	assert.Equal(t, sticky, c.stickyHost("0"))
+}
+
+func TestPickHostConsistentHash(t *testing.T) {
+	c := testGetCluster()
+	c.consistentHash = true
+
+	// The same key is always mapped to the same host.
+	keys := make(map[string]*topology.Node)
+	for i := 0; i < 100; i++ {
+		keys[strconv.Itoa(i)] = c.pickHost("", strconv.Itoa(i))
+	}
+	hosts := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i % 100)
+		h := c.pickHost("", key)
+		if h != keys[key] {
+			t.Fatalf("key %s moved from %s to %s", key, keys[key], h)
+		}
+		hosts[h.Host()] = true
+	}
+	assert.Len(t, hosts, 6)
+
+	// session_id overrides the query hash.
+	for i := 0; i < 100; i++ {
+		sessionId := strconv.Itoa(i % 4)
+		assert.Equal(t, c.getHostSticky(sessionId), c.pickHost(sessionId, "0"))
+	}
+
+	// Inactive and full hosts aren't chosen.
+	h := keys["0"]
+	h.SetIsActive(false)
+	for i := 0; i < 100; i++ {
+		assert.NotEqual(t, h, c.pickHost("", "0"))
+	}
+	h.SetIsActive(true)
+	c.maxConcurrentQueriesPerNode = 1
+	h.IncrementConnections()
+	for i := 0; i < 100; i++ {
+		assert.NotEqual(t, h, c.pickHost("", "0"))
+	}
+	h.DecrementConnections()
+	assert.Equal(t, h, c.pickHost("", "0"))
+
+	// The least loaded host is chosen without consistent hashing.
+	c.consistentHash = false
+	hosts = make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		hosts[c.pickHost("", "0").Host()] = true
+	}
+	assert.Greater(t, len(hosts), 1)
+}
+
 func TestIncQueued(t *testing.T) {
 	u := testGetUser()
 	cu := testGetClusterUser()
 	c := testGetCluster()
 	expectedSessionHostMap := map[string]string{
-		"0": "127.0.0.22",
-		"1": "127.0.0.33",
-		"2": "127.0.0.44",
-		"3": "127.0.0.55",
+		"0": "127.0.0.66",
+		"1": "127.0.0.66",
+		"2": "127.0.0.33",
+		"3": "127.0.0.44",
 	}
 	if err := testConcurrentQuery(c, u, cu, 10000, expectedSessionHostMap); err != nil {
 		t.Fatalf("incQueue test err: %s", err)
 	}
 }
 
+func TestIncMaxConcurrentQueriesPerNode(t *testing.T) {
+	c := &cluster{
+		name:                        "default",
+		replicas:                    []*replica{{name: "replica"}},
+		maxConcurrentQueriesPerNode: 2,
+	}
+	r := c.replicas[0]
+	r.cluster = c
+	r.hosts = []*topology.Node{
+		topology.NewNode(&url.URL{Host: "127.0.0.1"}, nil, "", r.name, topology.WithDefaultActiveState(true)),
+		topology.NewNode(&url.URL{Host: "127.0.0.2"}, nil, "", r.name, topology.WithDefaultActiveState(true)),
+		topology.NewNode(&url.URL{Host: "127.0.0.3"}, nil, "", r.name, topology.WithDefaultActiveState(true)),
+	}
+	u := &user{name: "default"}
+	cu := &clusterUser{name: "default"}
+
+	// Full nodes aren't chosen while others have free slots.
+	running := make([]*scope, 0, 6)
+	for i := 0; i < 6; i++ {
+		s := testGetScope(c, u, cu, "")
+		if err := s.inc(); err != nil {
+			t.Fatalf("unexpected err: %s", err)
+		}
+		running = append(running, s)
+	}
+	for _, h := range r.hosts {
+		assert.Equal(t, uint32(2), h.CurrentConnections(), h.Host())
+	}
+
+	// Requests are rejected once all the nodes are full and the queue is disabled.
+	s := testGetScope(c, u, cu, "")
+	assert.EqualError(t, s.incQueued(), "limits for node \""+s.host.Host()+"\" of cluster \"default\" are exceeded: max_concurrent_queries_per_node limit: 2")
+
+	// Queued requests wait for a free node.
+	u.queueCh = make(chan struct{}, 1)
+	u.maxQueueTime = 5 * time.Second
+	queued := testGetScope(c, u, cu, "")
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- queued.incQueued()
+	}()
+	select {
+	case err := <-errCh:
+		t.Fatalf("the request must wait in the queue while all the nodes are full; got err: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	for _, h := range r.hosts {
+		assert.Equal(t, uint32(2), h.CurrentConnections(), h.Host())
+	}
+
+	freed := running[0].host
+	running[0].dec()
+	if err := <-errCh; err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	assert.Equal(t, freed, queued.host)
+	assert.Equal(t, uint32(2), freed.CurrentConnections())
+
+	queued.dec()
+	for _, s := range running[1:] {
+		s.dec()
+	}
+}
+
+func TestIncQueuedPriority(t *testing.T) {
+	c := testGetCluster()
+	cu := &clusterUser{
+		maxConcurrentQueries: 1,
+	}
+	high := &user{
+		name:          "high",
+		queueCh:       make(chan struct{}, 10),
+		maxQueueTime:  5 * time.Second,
+		queuePriority: newQueuePriority(1),
+	}
+	low := &user{
+		name:          "low",
+		queueCh:       make(chan struct{}, 10),
+		maxQueueTime:  5 * time.Second,
+		queuePriority: newQueuePriority(10),
+	}
+
+	running := testGetScope(c, low, cu, "")
+	if err := running.inc(); err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+
+	queued := testGetScope(c, high, cu, "")
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- queued.incQueued()
+	}()
+	waitFor := func(cond func() bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timeout while waiting for the queue")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitFor(func() bool { return c.queue.waiting[queuePriorityHigh].load() == 1 })
+
+	// The low priority request must not take the slot
+	// while the high priority one is waiting.
+	s := testGetScope(c, low, cu, "")
+	if err := s.inc(); err == nil {
+		t.Fatalf("error expected while call .inc() with higher priority requests waiting")
+	}
+	if !c.queue.hasWaitingAbove(queuePriorityLow) {
+		t.Fatalf("expected higher priority requests to be waiting")
+	}
+
+	running.dec()
+	if err := <-errCh; err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	waitFor(func() bool { return c.queue.waiting[queuePriorityHigh].load() == 0 })
+	queued.dec()
+
+	if err := s.inc(); err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	s.dec()
+}
+
+func TestNewQueuePriority(t *testing.T) {
+	testCases := []struct {
+		priority uint32
+		expected queuePriority
+	}{
+		{0, queuePriorityNormal},
+		{1, queuePriorityHigh},
+		{3, queuePriorityHigh},
+		{4, queuePriorityNormal},
+		{7, queuePriorityNormal},
+		{8, queuePriorityLow},
+		{10, queuePriorityLow},
+	}
+	for _, tc := range testCases {
+		if p := newQueuePriority(tc.priority); p != tc.expected {
+			t.Fatalf("unexpected priority level for %d; expected: %s; got: %s", tc.priority, tc.expected, p)
+		}
+	}
+}
+
 func testConcurrentQuery(c *cluster, u *user, cu *clusterUser, concurrency int, expectedSessionHostMap map[string]string) error {
 	ch := make(chan map[string]string, 10000)
 
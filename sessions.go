@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/contentsquare/chproxy/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sessionsSweepInterval is the minimum interval between sweeps of expired sessions.
+const sessionsSweepInterval = time.Second
+
+// sessions tracks active sessions of the user or the cluster user
+// in order to limit their number with `max_sessions`.
+//
+// ClickHouse has no way to close sessions, so sessions are active
+// until session_timeout elapses since their last request.
+// Clients may release sessions earlier with `session_close=1`.
+type sessions struct {
+	max uint32
+
+	// user is the name of the user for the active_sessions metric.
+	// It is empty for cluster users.
+	user string
+
+	// active holds *session per session_id.
+	active sync.Map
+	n      atomic.Int64
+
+	// lastSweep is the unix time in nanoseconds of the last sweep.
+	lastSweep atomic.Int64
+}
+
+type session struct {
+	timeout atomic.Int64
+	// expiry is the unix time in nanoseconds the session expires at.
+	expiry atomic.Int64
+}
+
+// newSessions returns sessions limited by max
+// or nil if the number of sessions isn't limited.
+func newSessions(max uint32, user string) *sessions {
+	if max == 0 {
+		return nil
+	}
+	return &sessions{
+		max:  max,
+		user: user,
+	}
+}
+
+// open registers the request with sessionId and sessionTimeout in seconds.
+//
+// Returns true if the request opens a new session.
+// An error is returned if the new session exceeds the limit.
+func (s *sessions) open(sessionId string, sessionTimeout int, now time.Time) (bool, error) {
+	if s == nil {
+		return false, nil
+	}
+	timeout := time.Duration(sessionTimeout) * time.Second
+	if v, ok := s.active.Load(sessionId); ok {
+		// nolint:forcetypeassert // We will cover this by tests as we control what is stored.
+		s.touch(sessionId, v.(*session), timeout, now)
+		return false, nil
+	}
+
+	s.sweep(now, false)
+	if s.n.Load() >= int64(s.max) {
+		s.sweep(now, true)
+	}
+	ss := &session{}
+	ss.timeout.Store(int64(timeout))
+	ss.expiry.Store(now.Add(timeout).UnixNano())
+	if v, loaded := s.active.LoadOrStore(sessionId, ss); loaded {
+		// The session has been opened by a concurrent request.
+		// nolint:forcetypeassert // We will cover this by tests as we control what is stored.
+		s.touch(sessionId, v.(*session), timeout, now)
+		return false, nil
+	}
+	if s.n.Add(1) > int64(s.max) {
+		s.active.Delete(sessionId)
+		s.n.Add(-1)
+		return false, fmt.Errorf("limit for sessions is exceeded: max_sessions limit: %d", s.max)
+	}
+	s.updateMetric()
+	return true, nil
+}
+
+// touch prolongs the active session ss.
+func (s *sessions) touch(sessionId string, ss *session, timeout time.Duration, now time.Time) {
+	if prev := time.Duration(ss.timeout.Swap(int64(timeout))); prev != timeout {
+		log.Errorf("session_timeout of session %q changed from %s to %s; the session expires according to the last one",
+			sessionId, prev, timeout)
+	}
+	ss.expiry.Store(now.Add(timeout).UnixNano())
+}
+
+// close releases the session with sessionId.
+func (s *sessions) close(sessionId string) {
+	if s == nil {
+		return
+	}
+	if _, ok := s.active.LoadAndDelete(sessionId); ok {
+		s.n.Add(-1)
+		s.updateMetric()
+	}
+}
+
+// sweep releases expired sessions.
+//
+// Sessions are swept at most once per sessionsSweepInterval
+// by the request which happens to come first unless force is set.
+func (s *sessions) sweep(now time.Time, force bool) {
+	last := s.lastSweep.Load()
+	if !force && now.UnixNano()-last < int64(sessionsSweepInterval) {
+		return
+	}
+	if !s.lastSweep.CompareAndSwap(last, now.UnixNano()) && !force {
+		return
+	}
+	s.active.Range(func(id, v any) bool {
+		// nolint:forcetypeassert // We will cover this by tests as we control what is stored.
+		if v.(*session).expiry.Load() < now.UnixNano() && s.active.CompareAndDelete(id, v) {
+			s.n.Add(-1)
+		}
+		return true
+	})
+	s.updateMetric()
+}
+
+// openSession registers the request of s in sessions of the user and the cluster user.
+func (s *scope) openSession() error {
+	now := time.Now()
+	opened, err := s.user.sessions.open(s.sessionId, s.sessionTimeout, now)
+	if err != nil {
+		return fmt.Errorf("user %q: %w", s.user.name, err)
+	}
+	if _, err := s.clusterUser.sessions.open(s.sessionId, s.sessionTimeout, now); err != nil {
+		if opened {
+			s.user.sessions.close(s.sessionId)
+		}
+		return fmt.Errorf("cluster user %q: %w", s.clusterUser.name, err)
+	}
+	return nil
+}
+
+// closeSession releases the session of s once the request completes.
+func (s *scope) closeSession() {
+	s.user.sessions.close(s.sessionId)
+	s.clusterUser.sessions.close(s.sessionId)
+}
+
+// preserveSessions moves active sessions of users and cluster users
+// with unchanged `max_sessions` from the previous config,
+// so the limits aren't reset on config reload.
+func preserveSessions(users, oldUsers map[string]*user, clusters, oldClusters map[string]*cluster) {
+	for name, u := range users {
+		if old, ok := oldUsers[name]; ok && u.sessions != nil && old.sessions != nil && u.sessions.max == old.sessions.max {
+			u.sessions = old.sessions
+		}
+	}
+	for name, c := range clusters {
+		oldC, ok := oldClusters[name]
+		if !ok {
+			continue
+		}
+		for cuName, cu := range c.users {
+			if old, ok := oldC.users[cuName]; ok && cu.sessions != nil && old.sessions != nil && cu.sessions.max == old.sessions.max {
+				cu.sessions = old.sessions
+			}
+		}
+	}
+}
+
+func (s *sessions) updateMetric() {
+	if len(s.user) == 0 {
+		return
+	}
+	activeSessions.With(prometheus.Labels{"user": s.user}).Set(float64(s.n.Load()))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionsOpen(t *testing.T) {
+	s := newSessions(2, "")
+	now := time.Now()
+
+	opened, err := s.open("a", 60, now)
+	assert.NoError(t, err)
+	assert.True(t, opened)
+	opened, err = s.open("b", 60, now)
+	assert.NoError(t, err)
+	assert.True(t, opened)
+
+	_, err = s.open("c", 60, now)
+	assert.EqualError(t, err, "limit for sessions is exceeded: max_sessions limit: 2")
+
+	// Requests of active sessions aren't limited.
+	opened, err = s.open("a", 60, now)
+	assert.NoError(t, err)
+	assert.False(t, opened)
+
+	s.close("a")
+	opened, err = s.open("c", 60, now)
+	assert.NoError(t, err)
+	assert.True(t, opened)
+	assert.Equal(t, int64(2), s.n.Load())
+}
+
+func TestSessionsExpiry(t *testing.T) {
+	s := newSessions(1, "")
+	now := time.Now()
+
+	_, err := s.open("a", 10, now)
+	assert.NoError(t, err)
+	_, err = s.open("b", 10, now.Add(5*time.Second))
+	assert.Error(t, err)
+
+	// The request prolongs the session.
+	_, err = s.open("a", 10, now.Add(5*time.Second))
+	assert.NoError(t, err)
+	_, err = s.open("b", 10, now.Add(11*time.Second))
+	assert.Error(t, err)
+
+	// The session expires after session_timeout since its last request.
+	opened, err := s.open("b", 10, now.Add(16*time.Second))
+	assert.NoError(t, err)
+	assert.True(t, opened)
+	_, ok := s.active.Load("a")
+	assert.False(t, ok)
+}
+
+func TestSessionsUnlimited(t *testing.T) {
+	var s *sessions
+	assert.Nil(t, newSessions(0, ""))
+	opened, err := s.open("a", 60, time.Now())
+	assert.NoError(t, err)
+	assert.False(t, opened)
+	s.close("a")
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/contentsquare/chproxy/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// slowQueriesEndpoint lists the most recent requests taking longer
+// than `slow_query_threshold` of their users.
+const slowQueriesEndpoint = "/debug/slow_queries"
+
+// slowQueryInfo describes the request in /debug/slow_queries responses.
+type slowQueryInfo struct {
+	RequestID       string    `json:"request_id"`
+	User            string    `json:"user"`
+	Cluster         string    `json:"cluster"`
+	ClusterUser     string    `json:"cluster_user"`
+	Node            string    `json:"node"`
+	StartTime       time.Time `json:"start_time"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	StatusCode      int       `json:"status_code"`
+	// Cache is the X-Cache header of the response.
+	// It is empty for users without cache.
+	Cache string `json:"cache,omitempty"`
+	Query string `json:"query"`
+}
+
+// slowQueryLog is the ring buffer of the most recent slow queries.
+type slowQueryLog struct {
+	mu sync.Mutex
+
+	// entries holds up to size queries. Once it is full,
+	// next points to the oldest query, which is overwritten first.
+	entries []slowQueryInfo
+	next    int
+	size    int
+}
+
+func newSlowQueryLog(size int) *slowQueryLog {
+	return &slowQueryLog{size: size}
+}
+
+// resize changes the maximum number of kept queries.
+// The most recent queries are kept if the log shrinks.
+func (l *slowQueryLog) resize(size int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if size == l.size {
+		return
+	}
+	entries := l.listLocked()
+	if len(entries) > size {
+		entries = entries[:size]
+	}
+	// listLocked returns the most recent queries first.
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	l.entries = entries
+	l.next = 0
+	l.size = size
+}
+
+func (l *slowQueryLog) add(q slowQueryInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.size <= 0 {
+		return
+	}
+	if len(l.entries) < l.size {
+		l.entries = append(l.entries, q)
+		return
+	}
+	l.entries[l.next] = q
+	l.next = (l.next + 1) % l.size
+}
+
+// list returns the kept queries, the most recent first.
+func (l *slowQueryLog) list() []slowQueryInfo {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.listLocked()
+}
+
+func (l *slowQueryLog) listLocked() []slowQueryInfo {
+	queries := make([]slowQueryInfo, 0, len(l.entries))
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		queries = append(queries, l.entries[(l.next+i)%len(l.entries)])
+	}
+	return queries
+}
+
+// recordSlowQuery adds the request to the slow query log
+// if it took longer than `slow_query_threshold` of the user.
+func (rp *reverseProxy) recordSlowQuery(s *scope, srw *statResponseWriter, query string, startTime time.Time) {
+	d := time.Since(startTime)
+	if s.user.slowQueryThreshold <= 0 || d <= s.user.slowQueryThreshold {
+		return
+	}
+	slowQueries.With(prometheus.Labels{"user": s.user.name}).Inc()
+
+	cacheState := srw.Header().Get("X-Cache")
+	log.Infof("%s: slow query took %s; status code: %d; cache: %q; query: %q", s, d, srw.StatusCode(), cacheState, query)
+
+	if len(query) > maxRunningQuerySnippetLen {
+		query = query[:maxRunningQuerySnippetLen]
+	}
+	rp.slowQueries.add(slowQueryInfo{
+		RequestID:       s.requestID,
+		User:            s.user.name,
+		Cluster:         s.cluster.name,
+		ClusterUser:     s.clusterUser.name,
+		Node:            s.host.Host(),
+		StartTime:       startTime,
+		DurationSeconds: d.Seconds(),
+		StatusCode:      srw.StatusCode(),
+		Cache:           cacheState,
+		Query:           query,
+	})
+}
+
+// serveSlowQueries serves /debug/slow_queries.
+func (rp *reverseProxy) serveSlowQueries(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		err := fmt.Errorf("%q: unsupported method %q for %q", r.RemoteAddr, r.Method, r.URL.Path)
+		respondWith(rw, err, http.StatusMethodNotAllowed)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(rp.slowQueries.list()); err != nil {
+		log.Errorf("cannot send slow queries to %s: %s", r.RemoteAddr, err)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/contentsquare/chproxy/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlowQueryLog(t *testing.T) {
+	l := newSlowQueryLog(3)
+	for _, id := range []string{"1", "2", "3", "4"} {
+		l.add(slowQueryInfo{RequestID: id})
+	}
+	assert.Equal(t, []string{"4", "3", "2"}, slowQueryIDs(l.list()))
+
+	l.resize(2)
+	assert.Equal(t, []string{"4", "3"}, slowQueryIDs(l.list()))
+	l.add(slowQueryInfo{RequestID: "5"})
+	assert.Equal(t, []string{"5", "4"}, slowQueryIDs(l.list()))
+
+	l.resize(4)
+	l.add(slowQueryInfo{RequestID: "6"})
+	assert.Equal(t, []string{"6", "5", "4"}, slowQueryIDs(l.list()))
+
+	l.resize(0)
+	l.add(slowQueryInfo{RequestID: "7"})
+	assert.Empty(t, l.list())
+}
+
+func slowQueryIDs(queries []slowQueryInfo) []string {
+	ids := make([]string, 0, len(queries))
+	for _, q := range queries {
+		ids = append(ids, q.RequestID)
+	}
+	return ids
+}
+
+func TestReverseProxy_SlowQueries(t *testing.T) {
+	// The threshold is high enough for fast queries to stay below it on loaded hosts.
+	const (
+		threshold = 500 * time.Millisecond
+		slow      = threshold + 100*time.Millisecond
+	)
+	addr, err := url.Parse(fakeServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	proxy, err := newConfiguredProxy(&config.Config{
+		Clusters: []config.Cluster{
+			{
+				Name:         "cluster",
+				Scheme:       "http",
+				Nodes:        []string{addr.Host},
+				ClusterUsers: []config.ClusterUser{{Name: "web"}},
+			},
+		},
+		Users: []config.User{
+			{
+				Name:               defaultUsername,
+				ToCluster:          "cluster",
+				ToUser:             "web",
+				SlowQueryThreshold: config.Duration(threshold),
+			},
+		},
+		SlowQueryLogSize: 10,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	counter := slowQueries.WithLabelValues(defaultUsername)
+	before := testutil.ToFloat64(counter)
+
+	resp := makeHeavyRequest(proxy, slow)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = makeHeavyRequest(proxy, 0)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	rw := httptest.NewRecorder()
+	proxy.serveSlowQueries(rw, httptest.NewRequest(http.MethodGet, slowQueriesEndpoint, nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	var queries []slowQueryInfo
+	if err := json.NewDecoder(rw.Body).Decode(&queries); err != nil {
+		t.Fatalf("cannot decode slow queries: %s", err)
+	}
+	if len(queries) != 1 {
+		t.Fatalf("expected only the slow query to be recorded; got %+v", queries)
+	}
+	q := queries[0]
+	assert.Equal(t, defaultUsername, q.User)
+	assert.Equal(t, "cluster", q.Cluster)
+	assert.Equal(t, "web", q.ClusterUser)
+	assert.NotEmpty(t, q.Node)
+	assert.Equal(t, http.StatusOK, q.StatusCode)
+	assert.Equal(t, slow.String(), q.Query)
+	assert.GreaterOrEqual(t, q.DurationSeconds, slow.Seconds())
+	assert.Equal(t, before+1, testutil.ToFloat64(counter))
+
+	rw = httptest.NewRecorder()
+	proxy.serveSlowQueries(rw, httptest.NewRequest(http.MethodPost, slowQueriesEndpoint, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+}
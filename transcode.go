@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/contentsquare/chproxy/cache"
+	"github.com/klauspost/compress/zstd"
+)
+
+// maxTranscodeSize is the maximum size of cached responses re-encoded
+// to the encoding accepted by clients. Bigger responses are sent as is,
+// since re-encoded responses are buffered in memory.
+const maxTranscodeSize = 32 << 20
+
+const (
+	encodingGzip     = "gzip"
+	encodingZstd     = "zstd"
+	encodingBrotli   = "br"
+	encodingIdentity = "identity"
+)
+
+var (
+	gzipWriterPool = sync.Pool{
+		New: func() interface{} {
+			return gzip.NewWriter(nil)
+		},
+	}
+	zstdEncoderPool = sync.Pool{
+		New: func() interface{} {
+			// NewWriter fails only on invalid options.
+			enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+			return enc
+		},
+	}
+	zstdDecoderPool = sync.Pool{
+		New: func() interface{} {
+			dec, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+			return dec
+		},
+	}
+	brotliWriterPool = sync.Pool{
+		New: func() interface{} {
+			return brotli.NewWriter(nil)
+		},
+	}
+)
+
+// transcodeResponse re-encodes the cached response to the best encoding
+// in acceptEncoding if the encoding of the response isn't accepted.
+//
+// The response is returned as is if it doesn't need re-encoding,
+// exceeds maxTranscodeSize or its encoding isn't supported.
+func transcodeResponse(data io.Reader, metadata cache.ContentMetadata, acceptEncoding string) (io.Reader, cache.ContentMetadata, error) {
+	if metadata.Length > maxTranscodeSize {
+		return data, metadata, nil
+	}
+	from := metadata.Encoding
+	if from == "" {
+		from = encodingIdentity
+	}
+	if !isSupportedEncoding(from) {
+		return data, metadata, nil
+	}
+	to := preferredEncoding(acceptEncoding, from)
+	if to == "" || to == from {
+		return data, metadata, nil
+	}
+	return reencodeResponse(data, metadata, from, to)
+}
+
+// reencodeResponse re-encodes the response encoded with from to the encoding to.
+// The re-encoded response is buffered in memory.
+func reencodeResponse(data io.Reader, metadata cache.ContentMetadata, from, to string) (io.Reader, cache.ContentMetadata, error) {
+	var buf bytes.Buffer
+	if err := transcode(&buf, data, from, to); err != nil {
+		return nil, metadata, fmt.Errorf("cannot transcode response from %q to %q: %w", from, to, err)
+	}
+
+	metadata.Length = int64(buf.Len())
+	metadata.Encoding = to
+	if to == encodingIdentity {
+		metadata.Encoding = ""
+	}
+	return &buf, metadata, nil
+}
+
+func isSupportedEncoding(encoding string) bool {
+	switch encoding {
+	case encodingGzip, encodingZstd, encodingBrotli, encodingIdentity:
+		return true
+	}
+	return false
+}
+
+// preferredEncoding returns the supported encoding with the highest weight
+// in acceptEncoding. It returns current if current is acceptable
+// and an empty string if no supported encoding is acceptable.
+func preferredEncoding(acceptEncoding, current string) string {
+	weights := parseAcceptEncoding(acceptEncoding)
+	weight := func(encoding string) float64 {
+		if q, ok := weights[encoding]; ok {
+			return q
+		}
+		if q, ok := weights["*"]; ok {
+			return q
+		}
+		if encoding == encodingIdentity {
+			// identity is acceptable unless it is explicitly excluded.
+			return 1
+		}
+		return 0
+	}
+
+	if weight(current) > 0 {
+		return current
+	}
+	// Compressed encodings are preferred over identity with the same weight.
+	best, bestWeight := "", 0.0
+	for _, encoding := range []string{encodingZstd, encodingGzip, encodingIdentity} {
+		if q := weight(encoding); q > bestWeight {
+			best, bestWeight = encoding, q
+		}
+	}
+	return best
+}
+
+// parseAcceptEncoding returns weights of the encodings listed in acceptEncoding.
+func parseAcceptEncoding(acceptEncoding string) map[string]float64 {
+	weights := make(map[string]float64)
+	if strings.TrimSpace(acceptEncoding) == "" {
+		return weights
+	}
+	for _, v := range strings.Split(sortHeader(acceptEncoding), ",") {
+		name, params, _ := strings.Cut(v, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		if k, w, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(k) == "q" {
+			if f, err := strconv.ParseFloat(strings.TrimSpace(w), 64); err == nil {
+				q = f
+			}
+		}
+		weights[name] = q
+	}
+	return weights
+}
+
+func transcode(dst io.Writer, src io.Reader, from, to string) error {
+	r, release, err := newEncodingReader(src, from)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	switch to {
+	case encodingGzip:
+		zw := gzipWriterPool.Get().(*gzip.Writer)
+		defer gzipWriterPool.Put(zw)
+		zw.Reset(dst)
+		if _, err := io.Copy(zw, r); err != nil {
+			return err
+		}
+		return zw.Close()
+	case encodingZstd:
+		enc := zstdEncoderPool.Get().(*zstd.Encoder)
+		defer zstdEncoderPool.Put(enc)
+		enc.Reset(dst)
+		if _, err := io.Copy(enc, r); err != nil {
+			return err
+		}
+		return enc.Close()
+	case encodingBrotli:
+		bw := brotliWriterPool.Get().(*brotli.Writer)
+		defer brotliWriterPool.Put(bw)
+		bw.Reset(dst)
+		if _, err := io.Copy(bw, r); err != nil {
+			return err
+		}
+		return bw.Close()
+	default:
+		_, err := io.Copy(dst, r)
+		return err
+	}
+}
+
+// newEncodingReader returns the reader decoding src encoded with encoding.
+// release must be called once the reader isn't needed anymore.
+func newEncodingReader(src io.Reader, encoding string) (io.Reader, func(), error) {
+	switch encoding {
+	case encodingGzip:
+		zr, err := gzip.NewReader(src)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, func() { zr.Close() }, nil
+	case encodingZstd:
+		dec := zstdDecoderPool.Get().(*zstd.Decoder)
+		if err := dec.Reset(src); err != nil {
+			zstdDecoderPool.Put(dec)
+			return nil, nil, err
+		}
+		return dec, func() {
+			// Drop the reference to src.
+			_ = dec.Reset(nil)
+			zstdDecoderPool.Put(dec)
+		}, nil
+	case encodingBrotli:
+		return brotli.NewReader(src), func() {}, nil
+	default:
+		return src, func() {}, nil
+	}
+}
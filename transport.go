@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/contentsquare/chproxy/config"
+	"golang.org/x/net/http2"
+)
+
+// clusterTransports provides transports for connections to cluster nodes.
+//
+// Transports are reused between config reloads,
+// so idle connections to nodes aren't closed on every reload.
+type clusterTransports struct {
+	base *http.Transport
+
+	mu sync.Mutex
+	// transports contains transports of clusters with non-default settings
+	transports map[transportSettings]http.RoundTripper
+}
+
+// transportSettings are the cluster settings requiring a distinct transport.
+type transportSettings struct {
+	// insecure skips verification of node certificates
+	insecure bool
+
+	// tlsFiles is the hash of the contents of `tls` files,
+	// so the transport is rebuilt once the files change.
+	tlsFiles [sha256.Size]byte
+
+	// proxy is the URL of the HTTP proxy
+	proxy string
+
+	// http2 enforces HTTP/2 over TLS
+	http2 bool
+
+	// h2c enforces HTTP/2 without TLS
+	h2c bool
+}
+
+func newClusterTransports(base *http.Transport) *clusterTransports {
+	return &clusterTransports{
+		base:       base,
+		transports: make(map[transportSettings]http.RoundTripper),
+	}
+}
+
+// get returns the transport for the cluster c.
+// It returns nil if ct is nil, so http.DefaultTransport is used then.
+func (ct *clusterTransports) get(c config.Cluster) (http.RoundTripper, error) {
+	if ct == nil {
+		return nil, nil
+	}
+	tlsCfg, tlsFiles, err := newClusterTLSConfig(c.TLS)
+	if err != nil {
+		return nil, err
+	}
+	ts := transportSettings{
+		insecure: c.TLS.InsecureSkipVerify,
+		tlsFiles: tlsFiles,
+		proxy:    c.HTTPProxy,
+		http2:    c.HTTP2,
+		h2c:      c.H2C,
+	}
+	if ts == (transportSettings{}) {
+		return ct.base, nil
+	}
+
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if t, ok := ct.transports[ts]; ok {
+		return t, nil
+	}
+	if ts.http2 || ts.h2c {
+		t := ct.newHTTP2Transport(ts, tlsCfg)
+		ct.transports[ts] = t
+		return t, nil
+	}
+	t := ct.base.Clone()
+	if tlsCfg != nil {
+		t.TLSClientConfig = tlsCfg
+	}
+	if len(ts.proxy) > 0 {
+		proxyURL, err := url.Parse(ts.proxy)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse `http_proxy`: %w", err)
+		}
+		t.Proxy = http.ProxyURL(proxyURL)
+	}
+	ct.transports[ts] = t
+	return t, nil
+}
+
+// newHTTP2Transport returns the transport talking only HTTP/2 to the nodes.
+//
+// Unlike the base transport it doesn't fall back to HTTP/1.1
+// and ignores proxies.
+func (ct *clusterTransports) newHTTP2Transport(ts transportSettings, tlsCfg *tls.Config) *http2.Transport {
+	t := &http2.Transport{
+		IdleConnTimeout: ct.base.IdleConnTimeout,
+	}
+	if ts.h2c {
+		// h2c connections are sent in plaintext with prior knowledge,
+		// so the TLS config is ignored.
+		t.AllowHTTP = true
+		t.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			if ct.base.DialContext != nil {
+				return ct.base.DialContext(ctx, network, addr)
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		}
+		return t
+	}
+	t.TLSClientConfig = tlsCfg
+	return t
+}
+
+// newClusterTLSConfig returns the TLS config for connections to the nodes
+// along with the hash of the contents of the files it is loaded from.
+// It returns nil if the default TLS config must be used.
+func newClusterTLSConfig(cfg config.ClusterTLS) (*tls.Config, [sha256.Size]byte, error) {
+	var hash [sha256.Size]byte
+	if !cfg.InsecureSkipVerify && len(cfg.CertFile) == 0 && len(cfg.CAFile) == 0 {
+		return nil, hash, nil
+	}
+	tlsCfg := &tls.Config{
+		InsecureSkipVerify: cfg.InsecureSkipVerify, // nolint: gosec
+	}
+	h := sha256.New()
+	readFile := func(name string) ([]byte, error) {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		h.Write(data)
+		h.Write([]byte{0})
+		return data, nil
+	}
+	if len(cfg.CertFile) > 0 {
+		certPEM, err := readFile(cfg.CertFile)
+		if err != nil {
+			return nil, hash, fmt.Errorf("cannot read `tls.cert_file`: %w", err)
+		}
+		keyPEM, err := readFile(cfg.KeyFile)
+		if err != nil {
+			return nil, hash, fmt.Errorf("cannot read `tls.key_file`: %w", err)
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, hash, fmt.Errorf("cannot load cert for `tls.cert_file`=%q, `tls.key_file`=%q: %w",
+				cfg.CertFile, cfg.KeyFile, err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	if len(cfg.CAFile) > 0 {
+		caPEM, err := readFile(cfg.CAFile)
+		if err != nil {
+			return nil, hash, fmt.Errorf("cannot read `tls.ca_file`: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, hash, fmt.Errorf("cannot find certificates in `tls.ca_file`=%q", cfg.CAFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	h.Sum(hash[:0])
+	return tlsCfg, hash, nil
+}
+
+type clusterTransportKey struct{}
+
+// withClusterTransport returns ctx for requests sent to the nodes of c.
+// Such requests are sent via the transport of c by clusterRoundTripper.
+func withClusterTransport(ctx context.Context, c *cluster) context.Context {
+	if c.transport == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, clusterTransportKey{}, c.transport)
+}
+
+// clusterRoundTripper sends requests via the transport of the cluster
+// set by withClusterTransport or via the base transport otherwise.
+type clusterRoundTripper struct {
+	base http.RoundTripper
+}
+
+func (rt *clusterRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t, ok := req.Context().Value(clusterTransportKey{}).(http.RoundTripper); ok {
+		return t.RoundTrip(req)
+	}
+	return rt.base.RoundTrip(req)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/contentsquare/chproxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	checkErr(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "chproxy test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	checkErr(t, err)
+	cert, err := x509.ParseCertificate(der)
+	checkErr(t, err)
+	return &testCA{cert: cert, key: key}
+}
+
+// writeClientCert writes the client certificate with the given
+// common name signed by ca to cert.pem and key.pem in dir.
+func (ca *testCA) writeClientCert(t *testing.T, dir, cn string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	checkErr(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	checkErr(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	checkErr(t, err)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	checkErr(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	checkErr(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func TestReverseProxy_ClusterTLSClientCert(t *testing.T) {
+	ca := newTestCA(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	// The node requires client certificates signed by ca
+	// and responds with the common name of the certificate.
+	chServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ping" {
+			fmt.Fprintln(w, "Ok.")
+			return
+		}
+		fmt.Fprint(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	chServer.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	chServer.StartTLS()
+	defer chServer.Close()
+	chAddr, err := url.Parse(chServer.URL)
+	checkErr(t, err)
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	checkErr(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: chServer.Certificate().Raw}), 0600))
+	certFile, keyFile := ca.writeClientCert(t, dir, "client-1")
+
+	newConfig := func(tlsCfg config.ClusterTLS) *config.Config {
+		return &config.Config{
+			Clusters: []config.Cluster{
+				{
+					Name:         "cluster",
+					Scheme:       "https",
+					Nodes:        []string{chAddr.Host},
+					ClusterUsers: []config.ClusterUser{{Name: "web"}},
+					TLS:          tlsCfg,
+					HeartBeat: config.HeartBeat{
+						Interval: config.Duration(time.Minute),
+						Timeout:  config.Duration(time.Second),
+						Request:  "/ping",
+						Response: "Ok.\n",
+					},
+				},
+			},
+			Users: []config.User{
+				{
+					Name:      defaultUsername,
+					ToCluster: "cluster",
+					ToUser:    "web",
+				},
+			},
+		}
+	}
+	makeRequest := func(proxy *reverseProxy) (int, string) {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost:9090/?query="+url.QueryEscape("SELECT 1"), nil)
+		resp := makeCustomRequest(proxy, req)
+		return resp.StatusCode, bbToString(t, resp.Body)
+	}
+
+	proxy, err := newConfiguredProxy(newConfig(config.ClusterTLS{CAFile: caFile}))
+	checkErr(t, err)
+	stopProxy(t, proxy)
+	code, _ := makeRequest(proxy)
+	assert.Equal(t, http.StatusBadGateway, code, "requests without client certificates must be rejected")
+
+	cfg := newConfig(config.ClusterTLS{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		CAFile:   caFile,
+	})
+	proxy, err = newConfiguredProxy(cfg)
+	checkErr(t, err)
+	stopProxy(t, proxy)
+	code, body := makeRequest(proxy)
+	assert.Equal(t, http.StatusOK, code, body)
+	assert.Equal(t, "client-1", body)
+
+	// Heartbeats are sent via the same transport.
+	r := proxy.snapshot.Load().clusters["cluster"].replicas[0]
+	assert.NoError(t, r.heartBeat.IsHealthy(context.Background(), chServer.URL))
+
+	// Rotated certificates are picked up on config reload.
+	ca.writeClientCert(t, dir, "client-2")
+	checkErr(t, proxy.applyConfig(cfg))
+	code, body = makeRequest(proxy)
+	assert.Equal(t, http.StatusOK, code, body)
+	assert.Equal(t, "client-2", body)
+}
+
+func TestNewClusterTLSConfig(t *testing.T) {
+	tlsCfg, _, err := newClusterTLSConfig(config.ClusterTLS{})
+	assert.NoError(t, err)
+	assert.Nil(t, tlsCfg)
+
+	tlsCfg, _, err = newClusterTLSConfig(config.ClusterTLS{InsecureSkipVerify: true})
+	assert.NoError(t, err)
+	assert.True(t, tlsCfg.InsecureSkipVerify)
+
+	dir := t.TempDir()
+	certFile, keyFile := newTestCA(t).writeClientCert(t, dir, "client")
+	tlsCfg, hash, err := newClusterTLSConfig(config.ClusterTLS{CertFile: certFile, KeyFile: keyFile})
+	assert.NoError(t, err)
+	assert.Len(t, tlsCfg.Certificates, 1)
+	_, sameHash, err := newClusterTLSConfig(config.ClusterTLS{CertFile: certFile, KeyFile: keyFile})
+	assert.NoError(t, err)
+	assert.Equal(t, hash, sameHash)
+
+	_, err = os.Stat(filepath.Join(dir, "missing.pem"))
+	assert.True(t, os.IsNotExist(err))
+	_, _, err = newClusterTLSConfig(config.ClusterTLS{CAFile: filepath.Join(dir, "missing.pem")})
+	assert.ErrorContains(t, err, "cannot read `tls.ca_file`")
+	_, _, err = newClusterTLSConfig(config.ClusterTLS{CAFile: keyFile})
+	assert.ErrorContains(t, err, "cannot find certificates in `tls.ca_file`")
+}
@@ -7,6 +7,7 @@ import (
 	"hash/fnv"
 	"io"
 	"net/http"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -17,6 +18,10 @@ import (
 
 func respondWith(rw http.ResponseWriter, err error, status int) {
 	log.ErrorWithCallDepth(err, 1)
+	if clickhouseExceptions.Load() {
+		writeException(rw, err, status)
+		return
+	}
 	rw.WriteHeader(status)
 	fmt.Fprintf(rw, "%s\n", err)
 }
@@ -53,6 +58,20 @@ func getSessionId(req *http.Request) string {
 	return sessionId
 }
 
+// getSessionClose returns true if the request asks to release its session
+// via `session_close=1`
+func getSessionClose(req *http.Request) bool {
+	params := req.URL.Query()
+	return params.Get("session_close") == "1"
+}
+
+// getSessionCheck returns true if the request must fail instead of
+// being proxied to other hosts than the one of its session via `session_check=1`
+func getSessionCheck(req *http.Request) bool {
+	params := req.URL.Query()
+	return params.Get("session_check") == "1"
+}
+
 // getSessionId retrieves session id
 func getSessionTimeout(req *http.Request) int {
 	params := req.URL.Query()
@@ -77,12 +96,52 @@ func getQuerySnippet(req *http.Request) string {
 	return query + body
 }
 
+// peekQuerySnippet returns the same snippet as getQuerySnippet,
+// but doesn't consume the request body, so req may still be proxied.
+func peekQuerySnippet(req *http.Request) string {
+	if req.Body == nil {
+		return getQuerySnippet(req)
+	}
+
+	body := req.Body
+	// Errors are ignored like in getQuerySnippetFromBody.
+	// They are reported once the body is proxied.
+	prefix, _ := io.ReadAll(io.LimitReader(body, 1024))
+	req.Body = io.NopCloser(bytes.NewReader(prefix))
+	snippet := getQuerySnippet(req)
+	req.Body = &readCloser{
+		Reader: io.MultiReader(bytes.NewReader(prefix), body),
+		Closer: body,
+	}
+	return snippet
+}
+
 func hash(s string) uint32 {
 	h := fnv.New32a()
 	h.Write([]byte(s))
 	return h.Sum32()
 }
 
+// rendezvousHash returns the weight of the node for the given key.
+// The node with the highest weight should be chosen for the key,
+// so adding or removing a node only remaps keys which belong to it.
+func rendezvousHash(key, node string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(node))
+	x := h.Sum64()
+
+	// fnv has poor avalanche on short keys, so mix the bits
+	// to distribute keys evenly among nodes.
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
 func getQuerySnippetFromBody(req *http.Request) string {
 	if req.Body == nil {
 		return ""
@@ -155,12 +214,22 @@ func getFullQueryFromBody(req *http.Request) ([]byte, error) {
 		return nil, nil
 	}
 
-	data, err := io.ReadAll(req.Body)
-	if err != nil {
-		return nil, err
+	var data []byte
+	lcrc, streaming := req.Body.(*limitedCachedReadCloser)
+	streaming = streaming && lcrc.streaming
+	if streaming {
+		// Only the cached beginning of streamed bodies is available,
+		// since the rest is sent to ClickHouse without being read in memory.
+		data = lcrc.b
+	} else {
+		var err error
+		data, err = io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		// restore body for further reading
+		req.Body = io.NopCloser(bytes.NewBuffer(data))
 	}
-	// restore body for further reading
-	req.Body = io.NopCloser(bytes.NewBuffer(data))
 	u := getDecompressor(req)
 	if u == nil {
 		return data, nil
@@ -168,19 +237,118 @@ func getFullQueryFromBody(req *http.Request) ([]byte, error) {
 	br := bytes.NewReader(data)
 	b, err := u.decompress(br)
 	if err != nil {
+		if streaming {
+			// The cached beginning cannot be decompressed completely.
+			return b, nil
+		}
 		return nil, fmt.Errorf("cannot uncompress query: %w", err)
 	}
 
 	return b, nil
 }
 
-var cachableStatements = []string{"SELECT", "WITH"}
+// cachableStatements contains the keywords of read-only statements.
+var cachableStatements = newKeywordSet("SELECT SHOW DESCRIBE DESC EXPLAIN EXISTS")
+
+// mainStatements contains the keywords of statements which may follow
+// the WITH clause. Other words are considered a part of the WITH clause.
+var mainStatements = newKeywordSet(`SELECT SHOW DESCRIBE DESC EXPLAIN EXISTS INSERT ALTER CREATE DROP
+	TRUNCATE DELETE UPDATE OPTIMIZE SYSTEM KILL RENAME EXCHANGE ATTACH DETACH SET USE GRANT REVOKE`)
 
 // canCacheQuery returns true if q can be cached.
 func canCacheQuery(q []byte) bool {
+	_, ok := cachableStatements[mainStatement(q)]
+	return ok
+}
+
+// mainStatement returns the upper-cased leading keyword of the first statement
+// in q. Common table expressions of the leading WITH clause are skipped,
+// so the keyword of the statement following them is returned.
+// It returns an empty string if the statement is unknown.
+//
+// It is used both for caching and for statement restrictions of users,
+// so queries are classified the same way by both.
+func mainStatement(q []byte) string {
 	q = skipLeadingComments(q)
+	for len(q) > 0 && q[0] == '(' {
+		q = skipLeadingComments(q[1:])
+	}
+	n := 0
+	for n < len(q) && isWordChar(q[n]) {
+		n++
+	}
+	word := strings.ToUpper(string(q[:n]))
+	if strings.IndexFunc(word, func(r rune) bool { return r < 'A' || r > 'Z' }) >= 0 {
+		// Keywords consist of letters only.
+		return ""
+	}
+	if word != "WITH" {
+		return word
+	}
+	return statementAfterWith(q[n:])
+}
 
-	for _, statement := range cachableStatements {
+// statementAfterWith returns the upper-cased keyword of the statement
+// following the WITH clause at the beginning of q. Literals, quoted
+// identifiers, comments and parenthesized expressions are skipped.
+// It returns an empty string if the statement isn't found.
+//
+//nolint:cyclop // No clean way to split this.
+func statementAfterWith(q []byte) string {
+	depth := 0
+	for i := 0; i < len(q); {
+		c := q[i]
+		n := i + 1
+		switch {
+		case c == '-' && n < len(q) && q[n] == '-':
+			n = bytes.IndexByte(q[i:], '\n')
+			if n < 0 {
+				return ""
+			}
+			n += i + 1
+		case c == '/' && n < len(q) && q[n] == '*':
+			n = bytes.Index(q[i+2:], []byte("*/"))
+			if n < 0 {
+				return ""
+			}
+			n += i + 4
+		case c == '\'' || c == '"' || c == '`':
+			for n < len(q) && q[n] != c {
+				if q[n] == '\\' {
+					n++
+				}
+				n++
+			}
+			n++
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ';' && depth <= 0:
+			return ""
+		case isWordChar(c):
+			for n < len(q) && isWordChar(q[n]) {
+				n++
+			}
+			if depth <= 0 {
+				word := strings.ToUpper(string(q[i:n]))
+				if _, ok := mainStatements[word]; ok {
+					return word
+				}
+			}
+		}
+		i = n
+	}
+	return ""
+}
+
+var writeStatements = []string{"INSERT", "CREATE", "ALTER", "DROP", "TRUNCATE"}
+
+// isWriteQuery returns true if q modifies data or schema.
+func isWriteQuery(q []byte) bool {
+	q = skipLeadingComments(q)
+
+	for _, statement := range writeStatements {
 		if len(q) < len(statement) {
 			continue
 		}
@@ -194,6 +362,202 @@ func canCacheQuery(q []byte) bool {
 	return false
 }
 
+// queryStatements returns types of the statements in q, e.g. SELECT for
+// `WITH ... SELECT` queries. Statements following INSERT aren't returned,
+// since the rest of q may contain the inserted data.
+func queryStatements(q []byte) []string {
+	var statements []string
+	for {
+		q = skipLeadingComments(q)
+		if len(q) == 0 {
+			return statements
+		}
+		st := mainStatement(q)
+		statements = append(statements, st)
+		if st == "INSERT" {
+			return statements
+		}
+		n := statementEnd(q)
+		if n < 0 {
+			return statements
+		}
+		q = q[n+1:]
+	}
+}
+
+// tableRefRegexp matches `db.table` references following FROM, JOIN,
+// INTO and TABLE keywords. The database is captured by one of the groups
+// depending on its quoting.
+var tableRefRegexp = regexp.MustCompile("(?i)\\b(?:FROM|JOIN|INTO|TABLE)\\s+(?:IF\\s+(?:NOT\\s+)?EXISTS\\s+)?" +
+	"(?:`([^`]+)`|\"([^\"]+)\"|([a-zA-Z_][a-zA-Z0-9_]*))\\s*\\.")
+
+// insertDataRegexp matches the beginning of the data of INSERT queries.
+var insertDataRegexp = regexp.MustCompile(`(?i)\b(?:VALUES|FORMAT)\b`)
+
+// splitInsertData splits q into the statement and the data following it
+// if q is an INSERT query. The data is empty for other queries.
+func splitInsertData(q []byte) ([]byte, []byte) {
+	st := skipLeadingComments(q)
+	if mainStatement(st) != "INSERT" {
+		return q, nil
+	}
+	loc := insertDataRegexp.FindIndex(st)
+	if loc == nil {
+		return q, nil
+	}
+	n := len(q) - len(st) + loc[0]
+	return q[:n], q[n:]
+}
+
+// insertSelectRegexp matches keywords of INSERT queries reading
+// their data from other tables.
+var insertSelectRegexp = regexp.MustCompile(`(?i)\b(?:SELECT|WITH)\b`)
+
+// hasInsertData returns true if q contains the whole statement of an INSERT
+// query followed by the beginning of its data, so the statement can be
+// checked without reading the rest of the data.
+func hasInsertData(q []byte) bool {
+	st, data := splitInsertData(q)
+	return len(data) > 0 && !insertSelectRegexp.Match(st)
+}
+
+// queryDatabases returns databases referenced via `db.table` in q.
+// The data of INSERT queries isn't scanned.
+func queryDatabases(q []byte) []string {
+	var databases []string
+	for len(q) > 0 {
+		q = skipLeadingComments(q)
+		st := q
+		if mainStatement(q) == "INSERT" {
+			// The rest of q may contain the inserted data.
+			if loc := insertDataRegexp.FindIndex(q); loc != nil {
+				st = q[:loc[0]]
+			}
+			q = nil
+		} else if n := statementEnd(q); n >= 0 {
+			st, q = q[:n], q[n+1:]
+		} else {
+			q = nil
+		}
+		for _, m := range tableRefRegexp.FindAllSubmatch(st, -1) {
+			for _, db := range m[1:] {
+				if len(db) > 0 {
+					databases = append(databases, string(db))
+					break
+				}
+			}
+		}
+	}
+	return databases
+}
+
+// queryFormatRe matches the trailing FORMAT clause of the stripped query.
+var queryFormatRe = regexp.MustCompile(`(?i)\bFORMAT\s+(\w+)\s*$`)
+
+// settingsClauseRe matches the trailing SETTINGS clause of the stripped query,
+// which may follow the FORMAT clause.
+var settingsClauseRe = regexp.MustCompile(`(?i)\bSETTINGS\b[^()]*$`)
+
+// queryFormat returns the format set via the trailing FORMAT clause of q,
+// which may be followed only by the SETTINGS clause.
+func queryFormat(q []byte) string {
+	st := stripQuery(q)
+	if m := queryFormatRe.FindSubmatch(st); m != nil {
+		return string(m[1])
+	}
+	if loc := settingsClauseRe.FindIndex(st); loc != nil {
+		if m := queryFormatRe.FindSubmatch(st[:loc[0]]); m != nil {
+			return string(m[1])
+		}
+	}
+	return ""
+}
+
+// stripQuery returns q with comments replaced by spaces, literals and quoted
+// identifiers replaced by empty literals, and trailing whitespace and semicolons
+// stripped, so keywords inside them aren't matched by regular expressions.
+//
+//nolint:cyclop // No clean way to split this.
+func stripQuery(q []byte) []byte {
+	res := make([]byte, 0, len(q))
+	for i := 0; i < len(q); {
+		c := q[i]
+		n := i + 1
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			for n < len(q) && q[n] != c {
+				if q[n] == '\\' {
+					n++
+				}
+				n++
+			}
+			res = append(res, "''"...)
+			i = n + 1
+			continue
+		case c == '-' && n < len(q) && q[n] == '-':
+			n = bytes.IndexByte(q[i:], '\n')
+			if n < 0 {
+				n = len(q)
+			} else {
+				n += i
+			}
+			res = append(res, ' ')
+			i = n
+			continue
+		case c == '/' && n < len(q) && q[n] == '*':
+			n = bytes.Index(q[i+2:], []byte("*/"))
+			if n < 0 {
+				n = len(q)
+			} else {
+				n += i + 4
+			}
+			res = append(res, ' ')
+			i = n
+			continue
+		}
+		res = append(res, c)
+		i = n
+	}
+	return bytes.TrimRight(res, " \t\n\v\f\r;")
+}
+
+// statementEnd returns the index of the semicolon terminating the first
+// statement in q, skipping literals and comments. It returns -1 if the
+// statement isn't terminated.
+//
+//nolint:cyclop // No clean way to split this.
+func statementEnd(q []byte) int {
+	var quote byte
+	for i := 0; i < len(q); i++ {
+		c := q[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '-' && i+1 < len(q) && q[i+1] == '-':
+			n := bytes.IndexByte(q[i:], '\n')
+			if n < 0 {
+				return -1
+			}
+			i += n
+		case c == '/' && i+1 < len(q) && q[i+1] == '*':
+			n := bytes.Index(q[i+2:], []byte("*/"))
+			if n < 0 {
+				return -1
+			}
+			i += n + 3
+		case c == ';':
+			return i
+		}
+	}
+	return -1
+}
+
 //nolint:cyclop // No clean way to split this.
 func skipLeadingComments(q []byte) []byte {
 	for len(q) > 0 {
@@ -238,6 +602,100 @@ func skipLeadingComments(q []byte) []byte {
 	return nil
 }
 
+// sqlKeywords contains the keywords lowercased by normalizeQuery.
+// Identifiers and function names are case-sensitive in ClickHouse,
+// so they are left as is.
+var sqlKeywords = newKeywordSet(`ALL AND ANY ARRAY AS ASC BETWEEN BY CASE CROSS DESC DISTINCT ELSE END
+	EXISTS FINAL FIRST FORMAT FROM FULL GLOBAL GROUP HAVING ILIKE IN INNER INTERVAL IS JOIN LAST LEFT LIKE
+	LIMIT NOT NULL NULLS OFFSET ON OR ORDER OUTER PREWHERE RIGHT SAMPLE SELECT SETTINGS THEN TOTALS UNION
+	USING WHEN WHERE WITH`)
+
+func newKeywordSet(keywords string) map[string]struct{} {
+	m := make(map[string]struct{})
+	for _, kw := range strings.Fields(keywords) {
+		m[kw] = struct{}{}
+	}
+	return m
+}
+
+// normalizeQuery returns q with runs of whitespace collapsed into a single space,
+// the trailing semicolon stripped and keywords lowercased, so equivalent queries
+// share the same cache key. Literals, quoted identifiers and comments are left as is.
+//
+//nolint:cyclop // No clean way to split this.
+func normalizeQuery(q []byte) []byte {
+	res := make([]byte, 0, len(q))
+	sep := byte(0)
+	for i := 0; i < len(q); {
+		c := q[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\v' || c == '\f' || c == '\r':
+			if sep == 0 {
+				sep = ' '
+			}
+			i++
+			continue
+		}
+		if sep != 0 && len(res) > 0 {
+			res = append(res, sep)
+		}
+		sep = 0
+
+		n := i + 1
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			for n < len(q) && q[n] != c {
+				if q[n] == '\\' {
+					n++
+				}
+				n++
+			}
+			if n < len(q) {
+				n++
+			}
+		case c == '-' && n < len(q) && q[n] == '-':
+			n = bytes.IndexByte(q[i:], '\n')
+			if n < 0 {
+				n = len(q)
+			} else {
+				n += i
+			}
+			// The comment must be terminated by a newline,
+			// otherwise the next token becomes a part of it.
+			sep = '\n'
+		case c == '/' && n < len(q) && q[n] == '*':
+			n = bytes.Index(q[i+2:], []byte("*/"))
+			if n < 0 {
+				n = len(q)
+			} else {
+				n += i + 4
+			}
+		case isWordChar(c):
+			for n < len(q) && isWordChar(q[n]) {
+				n++
+			}
+			word := q[i:n]
+			afterDot := len(res) > 0 && res[len(res)-1] == '.'
+			if _, ok := sqlKeywords[strings.ToUpper(string(word))]; ok && !afterDot {
+				res = append(res, bytes.ToLower(word)...)
+				i = n
+				continue
+			}
+		}
+		res = append(res, q[i:n]...)
+		i = n
+	}
+
+	for len(res) > 0 && res[len(res)-1] == ';' {
+		res = bytes.TrimRight(res[:len(res)-1], " ")
+	}
+	return res
+}
+
+func isWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_'
+}
+
 // splits header string in sorted slice
 func sortHeader(header string) string {
 	h := strings.Split(header, ",")
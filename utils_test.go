@@ -59,16 +59,171 @@ func TestCanCacheQuery(t *testing.T) {
 	testCanCacheQuery(t, "   --- sd s\n /* dfsf */\n seleCT ", true)
 	testCanCacheQuery(t, "   --- sd s\n /* dfsf */\n insert ", false)
 	testCanCacheQuery(t, "WITH 1 as alias SELECT alias FROM nothing ", true)
+	testCanCacheQuery(t, "selected", false)
+	testCanCacheQuery(t, "SELECT (SELECT max(x) FROM t) AS m", true)
+	testCanCacheQuery(t, "(SELECT 1) UNION ALL (SELECT 2)", true)
+
+	// Common table expressions
+	testCanCacheQuery(t, "WITH cte AS (SELECT x FROM t) SELECT * FROM cte", true)
+	testCanCacheQuery(t, "WITH a AS (SELECT 1), b AS (SELECT (2)) SELECT * FROM a, b", true)
+	testCanCacheQuery(t, "\n\nWITH\n  cte AS (\n    SELECT x FROM t\n  )\nSELECT *\nFROM cte", true)
+	testCanCacheQuery(t, "with cte as (select 1) /* SELECT */ insert into t select * from cte", false)
+	testCanCacheQuery(t, "WITH cte AS (SELECT ')') INSERT INTO t SELECT * FROM cte", false)
+	testCanCacheQuery(t, "WITH 'SELECT' AS `select` -- SELECT\nALTER TABLE t DELETE WHERE 1", false)
+	testCanCacheQuery(t, "WITH cte AS (SELECT 1); SELECT 2", false)
+	testCanCacheQuery(t, "WITH cte AS (SELECT 1", false)
+	testCanCacheQuery(t, "WITH", false)
+	testCanCacheQuery(t, "\n\nWITH\n", false)
+	testCanCacheQuery(t, "WITH /* unterminated", false)
+	testCanCacheQuery(t, "WITH 'unterminated", false)
+
+	// Read-only statements
+	testCanCacheQuery(t, "SHOW TABLES", true)
+	testCanCacheQuery(t, "show create table t", true)
+	testCanCacheQuery(t, "DESCRIBE TABLE t", true)
+	testCanCacheQuery(t, "DESC t", true)
+	testCanCacheQuery(t, "EXPLAIN SELECT 1", true)
+	testCanCacheQuery(t, "EXISTS TABLE t", true)
+	testCanCacheQuery(t, "OPTIMIZE TABLE t", false)
 }
 
 func testCanCacheQuery(t *testing.T, q string, expected bool) {
 	t.Helper()
 	canCache := canCacheQuery([]byte(q))
 	if canCache != expected {
-		t.Fatalf("unexpected result %v; expecting %v", canCache, expected)
+		t.Fatalf("unexpected result for %q: %v; expecting %v", q, canCache, expected)
+	}
+}
+
+func TestIsWriteQuery(t *testing.T) {
+	testIsWriteQuery(t, "", false)
+	testIsWriteQuery(t, "SELECT 1", false)
+	testIsWriteQuery(t, "WITH 1 as alias SELECT alias FROM nothing ", false)
+	testIsWriteQuery(t, "INSERT INTO t VALUES (1)", true)
+	testIsWriteQuery(t, "\t  insert into t values (1)", true)
+	testIsWriteQuery(t, "   --- sd s\n /* dfsf */\n Create table t (a UInt8) ", true)
+	testIsWriteQuery(t, "ALTER TABLE t DELETE WHERE 1", true)
+	testIsWriteQuery(t, "DROP TABLE t", true)
+	testIsWriteQuery(t, "TRUNCATE TABLE t", true)
+}
+
+func testIsWriteQuery(t *testing.T, q string, expected bool) {
+	t.Helper()
+	isWrite := isWriteQuery([]byte(q))
+	if isWrite != expected {
+		t.Fatalf("unexpected result %v for %q; expecting %v", isWrite, q, expected)
 	}
 }
 
+func TestQueryStatements(t *testing.T) {
+	testCases := []struct {
+		q        string
+		expected []string
+	}{
+		{"", nil},
+		{"SELECT 1", []string{"SELECT"}},
+		{"  -- comment\n /* select */ insert into t values (';')", []string{"INSERT"}},
+		{"WITH 1 AS x SELECT x", []string{"SELECT"}},
+		{"(SELECT 1) UNION ALL (SELECT 2)", []string{"SELECT"}},
+		{"SELECT ';'; DROP TABLE t;", []string{"SELECT", "DROP"}},
+		{"SELECT 'it\\'s; fine' /* ; */ -- ;\n; system reload dictionaries", []string{"SELECT", "SYSTEM"}},
+		{"INSERT INTO t FORMAT TSV\n1;DROP TABLE t", []string{"INSERT"}},
+		{"SELECT 1; ", []string{"SELECT"}},
+		{"1; SELECT 2", []string{"", "SELECT"}},
+		{"SELECT1", []string{""}},
+		// Statements following common table expressions are detected
+		// the same way as for caching.
+		{"WITH cte AS (SELECT 1) INSERT INTO t SELECT * FROM cte", []string{"INSERT"}},
+		{"WITH 'SELECT' AS `select` -- SELECT\nALTER TABLE t DELETE WHERE 1", []string{"ALTER"}},
+		{"WITH cte AS (SELECT 1", []string{""}},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, queryStatements([]byte(tc.q)), "query: %q", tc.q)
+	}
+}
+
+func TestQueryDatabases(t *testing.T) {
+	testCases := []struct {
+		q        string
+		expected []string
+	}{
+		{"SELECT 1", nil},
+		{"SELECT t.x FROM t JOIN db1.u ON t.x = u.x", []string{"db1"}},
+		{"select * from `db 1`.t, \"db2\" . t", []string{"db 1"}},
+		{"SELECT 1; drop table if exists db3.t", []string{"db3"}},
+		{"INSERT INTO db1.t SELECT * FROM db2.t", []string{"db1", "db2"}},
+		{"INSERT INTO db1.t FORMAT TSV\nfrom db2.t", []string{"db1"}},
+		{"insert into db1.t values ('from db2.t')", []string{"db1"}},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, queryDatabases([]byte(tc.q)), "query: %q", tc.q)
+	}
+}
+
+func TestQueryFormat(t *testing.T) {
+	testCases := []struct {
+		q        string
+		expected string
+	}{
+		{"SELECT 1", ""},
+		{"SELECT 1 FORMAT JSON", "JSON"},
+		{"select 1\nformat JSONEachRow;\n", "JSONEachRow"},
+		{"SELECT 1 FORMAT CSV SETTINGS max_threads = 1", "CSV"},
+		{"SELECT 1 FORMAT CSV -- FORMAT JSON", "CSV"},
+		{"SELECT 1 FORMAT Parquet -- x", "Parquet"},
+		{"SELECT 1 FORMAT CSV /* x */ SETTINGS max_threads = 1, s = 'a(b'", "CSV"},
+		{"SELECT 1 SETTINGS max_threads = 1 FORMAT CSV", "CSV"},
+		{"SELECT * FROM (SELECT 1 FORMAT JSON SETTINGS max_threads = 1)", ""},
+		{"SELECT 1 FORMAT CSV ; ;", "CSV"},
+		{"SELECT 1 -- FORMAT JSON", ""},
+		{"SELECT 1 /* FORMAT JSON */", ""},
+		{"SELECT 'FORMAT JSON'", ""},
+		{"SELECT 'it''s', \"FORMAT JSON\"", ""},
+		{"SELECT format FROM t", ""},
+		{"SELECT format('{}', x) FROM t", ""},
+		{"SELECT x AS format", ""},
+		{"SELECT * FROM (SELECT 1 FORMAT JSON) FORMAT TSV", "TSV"},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, queryFormat([]byte(tc.q)), "query: %q", tc.q)
+	}
+}
+
+func TestNormalizeQuery(t *testing.T) {
+	equivalent := []struct {
+		q1, q2 string
+	}{
+		{"SELECT 1", "  select\t1 ;\n"},
+		{"SELECT a FROM t WHERE x = 1 FORMAT JSON", "select a\n  from t\n  where x = 1\nformat JSON;"},
+		{"SELECT 'a  b'", "SELECT   'a  b';;"},
+		{"SELECT `Order` FROM t -- note\nLIMIT 1", "select `Order`  from t -- note\n\n  limit 1"},
+		{"SELECT /* a  b */ 1", "SELECT  /* a  b */\n1"},
+		{"SELECT 'it''s  ok', 'x\\'  y'", "select 'it''s  ok',  'x\\'  y'"},
+	}
+	for _, tc := range equivalent {
+		assert.Equal(t, string(normalizeQuery([]byte(tc.q1))), string(normalizeQuery([]byte(tc.q2))), "queries: %q, %q", tc.q1, tc.q2)
+	}
+
+	different := []struct {
+		q1, q2 string
+	}{
+		{"SELECT 'a  b'", "SELECT 'a b'"},
+		{"SELECT \"Limit\" FROM t", "SELECT \"limit\" FROM t"},
+		{"SELECT `a  b` FROM t", "SELECT `a b` FROM t"},
+		{"SELECT x FROM t FORMAT JSON", "SELECT x FROM t FORMAT JSONCompact"},
+		{"SELECT Count() FROM t", "SELECT count() FROM t"},
+		{"SELECT t.Order FROM t", "SELECT t.order FROM t"},
+		{"SELECT 1 -- c\n, 2", "SELECT 1 -- c , 2"},
+		{"SELECT ';'", "SELECT ''"},
+	}
+	for _, tc := range different {
+		assert.NotEqual(t, string(normalizeQuery([]byte(tc.q1))), string(normalizeQuery([]byte(tc.q2))), "queries: %q, %q", tc.q1, tc.q2)
+	}
+
+	assert.Equal(t, "select a, b from t where s = 'A  B' format JSON",
+		string(normalizeQuery([]byte("SELECT a,  b\nFROM t\nWHERE s = 'A  B'\nFORMAT JSON;\n"))))
+}
+
 func TestGetQuerySnippetGET(t *testing.T) {
 	req, err := http.NewRequest("GET", "", nil)
 	checkErr(t, err)
@@ -123,6 +278,22 @@ func TestGetQuerySnippetPOST(t *testing.T) {
 	}
 }
 
+func TestPeekQuerySnippet(t *testing.T) {
+	q := makeQuery(2000)
+	req, err := http.NewRequest("POST", "http://127.0.0.1:9090/?query=INSERT", bytes.NewReader(q))
+	checkErr(t, err)
+	query := peekQuerySnippet(req)
+	expected := "INSERT\n" + string(q[:1024]) + "..."
+	if query != expected {
+		t.Fatalf("got: %q; expected: %q", query, expected)
+	}
+	body, err := readAndRestoreRequestBody(req)
+	checkErr(t, err)
+	if !bytes.Equal(body, q) {
+		t.Fatalf("the body must be preserved; got %d bytes; expected %d bytes", len(body), len(q))
+	}
+}
+
 func TestGetQuerySnippetGzipped(t *testing.T) {
 	var buf bytes.Buffer
 	zw := gzip.NewWriter(&buf)
@@ -167,6 +338,24 @@ func TestGetFullQueryGzipped(t *testing.T) {
 	}
 }
 
+func TestGetFullQueryStreamed(t *testing.T) {
+	data := makeQuery(1000)
+	req, err := http.NewRequest("POST", "http://127.0.0.1:9090/?query=INSERT+INTO+t+FORMAT+TSV", bytes.NewReader(data))
+	checkErr(t, err)
+	lcrc, err := newLimitedCachedReadCloser(req.Body, 100)
+	checkErr(t, err)
+	req.Body = lcrc
+
+	query, err := getFullQuery(req)
+	checkErr(t, err)
+	expected := "INSERT INTO t FORMAT TSV\n" + string(data[:101])
+	if string(query) != expected {
+		t.Fatalf("got: %q; expected %q", query, expected)
+	}
+	// The streamed body isn't consumed.
+	checkResponse(t, req.Body, string(data))
+}
+
 var (
 	testQuery     = "SELECT column col0, col1, col2, col3, col4, col5, col6, col7, col8, col9, col10, col11, col12, col13, col14, col15, col16, col17, col18, col19, col20, col21, col22, col23, col24, col25, col26, col27, col28, col29, col30, col31, col32, col33, col34, col35, col36, col37, col38, col39, col40, col41, col42, col43, col44, col45, col46, col47, col48, col49, col50, col51, col52, col53, col54, col55, col56, col57, col58, col59, col60, col61, col62, col63, col64, col65, col66, col67, col68, col69, col70, col71, col72, col73, col74, col75, col76, col77, col78, col79, col80, col81, col82, col83, col84, col85, col86, col87, col88, col89, col90, col91, col92, col93, col94, col95, col96, col97, col98, col99, col100, col101, col102, col103, col104, col105, col106, col107, col108, col109, col110, col111, col112, col113, col114, col115, col116, col117, col118, col119, col120, col121, col122, col123, col124, col125, col126, col127, col128, col129, col130, col131, col132, col133, col134, col135, col136, col137, col138, col139, col140, col141, col142, col143, col144, col145, col146, col147, col148, col149, col150, col151, col152, col153, col154, col155, col156, col157, col158, col159, col160, col161, col162, col163, col164, col165, col166, col167, col168, col169, col170, col171, col172, col173, col174, col175, col176, col177, col178, col179, col180, col181, col182, col183, col184, col185, col186, col187, col188, col189, col190, col191, col192, col193, col194, col195, col196, col197, col198, col199, WHERE Date=today()\n"
 	lz4TestQuery  = "\xfb\xd7NϹ\xec\xf2\x81Hp`\xe3'A(>\x82N\x03\x00\x00\xf3\x05\x00\x00\xd0SELECT column\a\x00 0,\x06\x00\x111\x06\x00\x112\x06\x00\x113\x06\x00\x114\x06\x00\x115\x06\x00\x116\x06\x00\x117\x06\x00\x118\x06\x00\x119\x06\x00\x131=\x00\x02>\x00\x121?\x00\x121@\x00\x121A\x00\x121B\x00\x121C\x00\x121D\x00\x121E\x00\x121F\x00\x122F\x00\x122F\x00\x122F\x00\x122F\x00\x122F\x00\x122F\x00\x122F\x00\x122F\x00\x122F\x00\x122F\x00\x123F\x00\x123F\x00\x123F\x00\x123F\x00\x123F\x00\x123F\x00\x123F\x00\x123F\x00\x123F\x00\x123F\x00\x124F\x00\x124F\x00\x124F\x00\x124F\x00\x124F\x00\x124F\x00\x124F\x00\x124F\x00\x124F\x00\x124F\x00\x125F\x00\x125F\x00\x125F\x00\x125F\x00\x125F\x00\x125F\x00\x125F\x00\x125F\x00\x125F\x00\x125F\x00\x126F\x00\x126F\x00\x126F\x00\x126F\x00\x126F\x00\x126F\x00\x126F\x00\x126F\x00\x126F\x00\x126F\x00\x127F\x00\x127F\x00\x127F\x00\x127F\x00\x127F\x00\x127F\x00\x127F\x00\x127F\x00\x127F\x00\x127F\x00\x128F\x00\x128F\x00\x128F\x00\x128F\x00\x128F\x00\x128F\x00\x128F\x00\x128F\x00\x128F\x00\x128F\x00\x129F\x00\x129F\x00\x129F\x00\x129F\x00\x129F\x00\x129F\x00\x129F\x00\x129F\x00\x129F\x00\x129F\x00\"10G\x00\"10H\x00\"10I\x00\"10J\x00\"10K\x00\"10L\x00\"10M\x00\"10N\x00\"10O\x00#10P\x00\x05\xc7\x02\x03P\x00\x04\xc9\x02\x04\xca\x02\x04\xcb\x02\x04\xcc\x02\x04\xcd\x02\x04\xce\x02\x04\xcf\x02\x03\xd0\x02\x131\xd1\x02\x131\xd2\x02\x131\xd3\x02\x131\xd4\x02\x131\xd5\x02\x131\xd6\x02\x131\xd7\x02\x131\xd8\x02\x131\xd9\x02#12\xa0\x00\x03\xdb\x02\x131\xdc\x02\x131\xdd\x02\x131\xde\x02\x131\xdf\x02\x131\xe0\x02\x131\xe1\x02\x131\xe2\x02\x131\xe3\x02\x131\xe4\x02\x131\xe5\x02\x131\xe6\x02\x131\xe7\x02\x131\xe8\x02\x131\xe9\x02\x131\xea\x02\x131\xeb\x02\x131\xec\x02\x131\xed\x02\x131\xee\x02\x131\xef\x02\x131\xf0\x02\x131\xf1\x02\x131\xf2\x02\x131\xf3\x02\x131\xf4\x02\x131\xf5\x02\x131\xf6\x02\x131\xf7\x02\x131\xf8\x02\x131\xf9\x02\x131\xfa\x02\x131\xfb\x02\x131\xfc\x02\x131\xfd\x02\x131\xfe\x02\x131\xff\x02\x131\x00\x03\x131\x01\x03\x131\x02\x03\x131\x03\x03\x131\x04\x03\x131\x05\x03\x131\x06\x03\x131\a\x03\x131\b\x03#170\x02\x03\n\x03\x131\v\x03\x131\f\x03\x131\r\x03\x131\x0e\x03\x131\x0f\x03\x131\x10\x03\x131\x11\x03\x131\x12\x03\x131\x13\x03\x131\x14\x03\x131\x15\x03\x131\x16\x03\x131\x17\x03\x131\x18\x03\x131\x19\x03\x131\x1a\x03\x131\x1b\x03\x131\x1c\x03\x131\x1d\x03\x131\x1e\x03\x131\x1f\x03\x101 \x03\xf0\x04WHERE Date=today()\n"